@@ -2,19 +2,57 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
 	"time"
 
 	"github.com/arimatakao/simple-events-handler/internal/aggregator"
+	"github.com/arimatakao/simple-events-handler/internal/alerting"
+	"github.com/arimatakao/simple-events-handler/internal/anomaly"
+	"github.com/arimatakao/simple-events-handler/internal/app"
+	"github.com/arimatakao/simple-events-handler/internal/archive"
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/deadletter"
+	"github.com/arimatakao/simple-events-handler/internal/dedup"
+	"github.com/arimatakao/simple-events-handler/internal/expiry"
+	"github.com/arimatakao/simple-events-handler/internal/export"
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+	"github.com/arimatakao/simple-events-handler/internal/importer"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/buffer"
+	bgjobs "github.com/arimatakao/simple-events-handler/internal/jobs"
+	"github.com/arimatakao/simple-events-handler/internal/lifecycle"
+	"github.com/arimatakao/simple-events-handler/internal/logging"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+	"github.com/arimatakao/simple-events-handler/internal/recorder"
+	"github.com/arimatakao/simple-events-handler/internal/reload"
+	"github.com/arimatakao/simple-events-handler/internal/replay"
+	"github.com/arimatakao/simple-events-handler/internal/reporting"
+	"github.com/arimatakao/simple-events-handler/internal/reports"
+	"github.com/arimatakao/simple-events-handler/internal/scheduler"
 	"github.com/arimatakao/simple-events-handler/internal/server"
+	"github.com/arimatakao/simple-events-handler/internal/sessions"
+	"github.com/arimatakao/simple-events-handler/internal/sink/elasticsearch"
+	"github.com/arimatakao/simple-events-handler/internal/sink/forward"
+	kafkasink "github.com/arimatakao/simple-events-handler/internal/sink/kafka"
+	webhooksink "github.com/arimatakao/simple-events-handler/internal/sink/webhooks"
+	"github.com/arimatakao/simple-events-handler/internal/spool"
+	"github.com/arimatakao/simple-events-handler/internal/usercheck"
+	"github.com/arimatakao/simple-events-handler/internal/webhook"
+	ginjson "github.com/gin-gonic/gin/codec/json"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-func gracefulShutdown(apiServer *http.Server, agg *aggregator.Aggregator, logger *slog.Logger, done chan bool) {
+func gracefulShutdown(lc *lifecycle.Manager, logger *slog.Logger, done chan bool) {
 	// Create context that listens for the interrupt signal from the OS.
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
@@ -25,17 +63,9 @@ func gracefulShutdown(apiServer *http.Server, agg *aggregator.Aggregator, logger
 	logger.Warn("shutting down gracefully, press Ctrl+C again to force")
 	stop() // Allow Ctrl+C to force shutdown
 
-	// The context is used to inform the server it has 10 seconds to finish
-	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := apiServer.Shutdown(ctx); err != nil {
-		logger.Error("Server forced to shutdown with error", "error", err)
-	}
-
-	// Stop the cron scheduler
-	if agg != nil {
-		agg.Stop()
+	// Stop every component in order, each stage bounded by its own timeout
+	if err := lc.Shutdown(); err != nil {
+		logger.Error("graceful shutdown finished with errors", "error", err)
 	}
 
 	logger.Info("Server exiting")
@@ -44,28 +74,622 @@ func gracefulShutdown(apiServer *http.Server, agg *aggregator.Aggregator, logger
 	done <- true
 }
 
+// aggregation keeps the aggregates of the events up to date, on a cron job
+// or with TimescaleDB continuous aggregates.
+type aggregation interface {
+	server.DeepChecker
+	server.Aggregator
+	Start() error
+	Stop(ctx context.Context) error
+}
+
+// drainServer returns a shutdown stage for srv. It waits for in-flight
+// requests to finish; when the stage times out, the contexts of the remaining
+// requests (long queries, streams) are cancelled and connections are closed.
+// It must be called before srv starts serving.
+func drainServer(srv *http.Server) lifecycle.StopFunc {
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context { return baseCtx }
+
+	return func(ctx context.Context) error {
+		defer cancelRequests()
+		if err := srv.Shutdown(ctx); err != nil {
+			cancelRequests()
+			_ = srv.Close()
+			return err
+		}
+		return nil
+	}
+}
+
 func main() {
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, nil))
+	started := time.Now()
+	configPath := flag.String("config", "", "path to a YAML or TOML configuration file")
+	flag.Parse()
 
-	server := server.NewServer(logger)
-	logger.Info("server created", "address", server.Addr)
+	// Validate the whole configuration before opening any sockets or
+	// database connections.
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("failed to load configuration", "error", err.Error())
+		os.Exit(1)
+	}
 
-	agg, err := aggregator.New(logger)
+	// Closed last, once the shutdown is logged
+	var logOutput io.Writer = os.Stdout
+	if cfg.Log.Output == "file" {
+		logFile, err := logging.OpenFile(cfg.Log.File)
+		if err != nil {
+			panic(fmt.Sprintf("failed to open log file: %s", err))
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+	logger, logLevel, err := logging.New(cfg.Log, logOutput)
 	if err != nil {
-		panic(fmt.Sprintf("failed to create cron job: %s", err))
+		panic(fmt.Sprintf("failed to create logger: %s", err))
 	}
+	database.Configure(cfg.DB)
+	database.ExcludeTags(cfg.Aggregation.ExcludeTags)
 
-	if err := agg.Start(); err != nil {
-		panic(fmt.Sprintf("failed to start cron job: %s", err))
+	reporter, err := reporting.New(cfg.Reporting)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create error reporter: %s", err))
+	}
+	defer reporter.Flush(2 * time.Second)
+
+	lc := lifecycle.New(logger)
+
+	// Runtime settings are re-read on SIGHUP
+	reloader := reload.New(logger, *configPath)
+	reloader.Register("log level", func(cfg *config.Config) error {
+		return logLevel.UnmarshalText([]byte(cfg.Log.Level))
+	})
+
+	if err := app.InstallRules(cfg, reloader); err != nil {
+		panic(fmt.Sprintf("failed to compile the validation rules: %s", err))
+	}
+
+	// The pools connect lazily; startup waits for Postgres further down,
+	// once the admin listener can report the instance as starting.
+	storage, err := app.OpenStorage(logger, cfg, reloader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open the database: %s", err))
+	}
+	db := storage.DB
+	var eventStore server.EventStore = storage.Events
+
+	// With WORKER_SEPARATE, cmd/worker runs the queue consumers, the sinks
+	// and the scheduled and background jobs instead
+	background := !cfg.Worker.Separate
+
+	// Batches that still fail after their retries are kept for operators
+	var deadLetters server.DeadLetters
+	var dl *deadletter.Store
+	if cfg.DeadLetter.Enabled() {
+		dl, err = deadletter.Open(logger, cfg.DeadLetter, db)
+		if err != nil {
+			panic(fmt.Sprintf("failed to open dead-letter store: %s", err))
+		}
+		deadLetters = dl
+	}
+
+	// Write-behind mode of POST /events
+	var queue server.EventQueue
+	var buf *buffer.Buffer
+	if cfg.Ingest.Buffer.Async {
+		buf = buffer.New(logger, cfg.Ingest.Buffer, db)
+		if dl != nil {
+			buf.DeadLetterTo(dl, time.Duration(cfg.DeadLetter.MaxRetrySeconds)*time.Second)
+		}
+		queue = buf
+	}
+
+	// Identical events sent within the window are stored once
+	var deduplicator server.Deduplicator
+	if cfg.Ingest.Dedup.Enabled() {
+		deduplicator = dedup.New(db, time.Duration(cfg.Ingest.Dedup.WindowSeconds)*time.Second, cfg.Ingest.Dedup.CacheSize)
+	}
+
+	// User ids verified with the user service
+	var users server.UserChecker
+	if cfg.UserCheck.Enabled() {
+		users = usercheck.New(cfg.UserCheck)
+	}
+
+	// Events whose insert failed are kept on disk and replayed
+	var spooler server.Spooler
+	var sp *spool.Spool
+	if cfg.Spool.Enabled() {
+		sp, err = spool.Open(logger, cfg.Spool, db)
+		if err != nil {
+			panic(fmt.Sprintf("failed to open spool: %s", err))
+		}
+		spooler = sp
+	}
+
+	// Background imports of files uploaded to POST /events/import
+	var imports server.Importer
+	var jobs *importer.Jobs
+	if cfg.Import.Enabled() {
+		jobs, err = importer.NewJobs(logger, cfg.Import, db)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create import jobs: %s", err))
+		}
+		imports = jobs
+	}
+
+	// Exports of time windows to object storage, scheduled and on demand
+	var exports server.Exports
+	var exporter *export.Exporter
+	if cfg.Export.Enabled() {
+		exportCfg := cfg.Export
+		if !background {
+			// The workers run the scheduled exports
+			exportCfg.Schedule = ""
+		}
+		exporter, err = export.New(logger, exportCfg, database.NewEventStream().WithCipher(storage.Cipher))
+		if err != nil {
+			panic(fmt.Sprintf("failed to create exporter: %s", err))
+		}
+		exports = exporter
+	}
+
+	// Signed payloads of third-party senders on POST /webhooks/:provider
+	var webhooks server.Webhooks
+	if len(cfg.Webhooks) > 0 {
+		webhooks = webhook.New(cfg.Webhooks)
+	}
+
+	// Deliveries of stored events to the registered webhook subscriptions
+	var subscriptions server.Subscriptions
+	var dispatcher *webhooksink.Dispatcher
+	var deliveries *database.SubscriptionStore
+	if cfg.Sinks.Webhooks.Enabled {
+		store := database.NewSubscriptionStore().WithCipher(storage.Cipher)
+		subscriptions, deliveries = store, store
+		if background {
+			dispatcher = webhooksink.New(logger, cfg.Sinks.Webhooks, store)
+		}
+	}
+
+	// Firehose of the stored events for stream processors, only publishing
+	// replays when the workers relay the events
+	var producer *kafkasink.Producer
+	if cfg.Sinks.Kafka.Enabled() {
+		producer = kafkasink.New(logger, cfg.Sinks.Kafka, database.NewOutbox().WithCipher(storage.Cipher))
+	}
+
+	// Historical events published again to the webhook and Kafka sinks
+	var replays server.Replays
+	var replayer *replay.Replayer
+	if subscriptions != nil || producer != nil {
+		targets := replay.Targets{}
+		if subscriptions != nil {
+			targets.Subscriptions = database.NewSubscriptionStore().WithCipher(storage.Cipher)
+		}
+		if producer != nil {
+			targets.Kafka = producer
+		}
+		replayer = replay.New(logger, database.NewEventStream().WithCipher(storage.Cipher), targets)
+		replays = replayer
+	}
+
+	// Search index of the stored events
+	var indexer *elasticsearch.Indexer
+	if background && cfg.Sinks.Elasticsearch.Enabled() {
+		indexer = elasticsearch.New(logger, cfg.Sinks.Elasticsearch, database.NewOutbox().WithCipher(storage.Cipher))
+	}
+
+	// Edge mode: stored events forwarded to a central instance
+	var forwarder *forward.Forwarder
+	if background && cfg.Federation.Forward.Enabled() {
+		forwarder = forward.New(logger, cfg.Federation.Forward, database.NewOutbox().WithCipher(storage.Cipher))
+	}
+
+	// Summaries of the aggregates sent to Slack and by email
+	var summaries *reports.Scheduler
+	if background && cfg.Reports.Enabled() {
+		summaries, err = reports.New(logger, cfg.Reports, database.NewReportStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create reports: %s", err))
+		}
+	}
+
+	// Alerts on actions whose rate departs from their baseline
+	var detector *anomaly.Detector
+	if background && cfg.Anomaly.Enabled {
+		detector, err = anomaly.New(logger, cfg.Anomaly, database.NewAnomalyStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the anomaly detector: %s", err))
+		}
+	}
+
+	// Threshold alert rules managed on the admin listener
+	var alertRules server.AlertRules
+	var evaluator *alerting.Evaluator
+	if cfg.Alerts.Enabled {
+		store := database.NewAlertStore()
+		alertRules = store
+		if background {
+			evaluator, err = alerting.New(logger, cfg.Alerts, store)
+			if err != nil {
+				panic(fmt.Sprintf("failed to create the alert rules evaluator: %s", err))
+			}
+		}
+	}
+
+	// Old events moved out of the events table
+	var archiver *archive.Archiver
+	if background && cfg.Archive.Enabled() {
+		archiver, err = archive.New(logger, cfg.Archive, storage.ArchiveStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the events archiver: %s", err))
+		}
+	}
+
+	// Events posted with a future deliver_at, pending in each database
+	// holding events, and events expiring after their ttl_seconds
+	var sched *scheduler.Scheduler
+	var janitor *expiry.Janitor
+	if background {
+		sched, err = scheduler.New(logger, cfg.Scheduled, storage.ScheduledStores()...)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the scheduled events delivery: %s", err))
+		}
+		janitor, err = expiry.New(logger, cfg.TTL, storage.ExpiryStores()...)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the expired events deletion: %s", err))
+		}
+	}
+
+	// Background jobs of the projects, claimed from the jobs table by the
+	// workers of every instance, only queued here with WORKER_SEPARATE
+	var backgroundJobs server.Jobs
+	var jobPool *bgjobs.Pool
+	if cfg.Jobs.Enabled() {
+		jobPool, err = bgjobs.New(logger, cfg.Jobs, database.NewJobStore(), storage.JobHandlers())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create background jobs: %s", err))
+		}
+		backgroundJobs = jobPool
+	}
+
+	// Optional API behaviors enabled per project; INGEST_ASYNC enables
+	// async ingestion unless an override turns it off
+	defaultFlags := cfg.Flags.Enabled
+	if cfg.Ingest.Buffer.Async && !slices.Contains(defaultFlags, flags.AsyncIngest) {
+		defaultFlags = append(slices.Clone(defaultFlags), flags.AsyncIngest)
+	}
+	flagSet, err := flags.New(logger, defaultFlags, cfg.Flags.RefreshSeconds, database.NewFlagStore())
+	if err != nil {
+		panic(fmt.Sprintf("failed to create the feature flags: %s", err))
+	}
+
+	projects := database.NewProjectStore()
+	meter := quota.New(logger, cfg.Quotas, database.NewUsageStore())
+	if cfg.Quotas.Redis {
+		meter.ShareWith(quota.NewRedisCounter(storage.Redis))
+	}
+	// Statistics, tags, the dual write and the snapshots use the events of
+	// the primary database alone
+	var stats server.Stats
+	var tags server.EventTags
+	var dualWrites server.DualWrites
+	var snapshots server.Snapshots
+	if !cfg.DB.SpreadsEvents() {
+		stats = database.NewStatsStore()
+		tags = database.NewTagStore()
+		dualWrites = database.NewDualWriteStore()
+		snapshots = storage.SnapshotStore()
+	}
+
+	// Sanitized copies of the API requests, for debugging
+	var requestRecorder server.RequestRecorder
+	var requests *recorder.Recorder
+	if cfg.Debug.Enabled() {
+		requests, err = recorder.New(cfg.Debug)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the request recorder: %s", err))
+		}
+		requestRecorder = requests
+		logger.Warn("recording API requests", "requests", cfg.Debug.RecordRequests, "file", cfg.Debug.RecordFile)
+	}
+
+	apiServer := server.NewServer(logger, cfg, server.Options{
+		DB:       db,
+		Queue:    queue,
+		Spool:    spooler,
+		Dedup:    deduplicator,
+		Users:    users,
+		Importer: imports,
+		Webhooks: webhooks,
+		APIKeys:  projects,
+		Quotas:   meter,
+		Stats:    stats,
+		Sessions: sessions.New(db, time.Duration(cfg.Sessions.GapMinutes)*time.Minute),
+		// Saved queries are kept with the projects and run against db
+		SavedQueries: database.NewSavedQueryStore(),
+		EventTags:    tags,
+		Jobs:         backgroundJobs,
+		Flags:        flagSet,
+		Reporter:     reporter,
+		Reloader:     reloader,
+		Recorder:     requestRecorder,
+	})
+	logger.Info("server created", "address", apiServer.Addr, "json_codec", ginjson.Package)
+
+	// In the TimescaleDB mode, TimescaleDB refreshes the continuous
+	// aggregates instead of the cron job
+	var agg aggregation
+	var aggStatus server.StatusReporter
+	if cfg.DB.Timescale.Enabled {
+		continuous := aggregator.NewContinuous(logger, cfg.Aggregation, cfg.DB.Timescale, database.NewTimescaleStore())
+		agg = continuous
+		aggStatus = server.StatusFunc(func(ctx context.Context) (any, error) {
+			return continuous.Status(ctx)
+		})
+	} else {
+		scheduled, err := aggregator.New(logger, cfg.Aggregation, db)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create cron job: %s", err))
+		}
+		agg = scheduled
+		aggStatus = server.StatusFunc(func(context.Context) (any, error) {
+			return scheduled.Status(), nil
+		})
+	}
+
+	// Queue consumers feeding the same pipeline as POST /events
+	sources := map[string]ingest.Source{}
+	if background {
+		sources, err = app.Sources(logger, cfg, db)
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the queue consumers: %s", err))
+		}
 	}
 
 	// Create a done channel to signal when the shutdown is complete
 	done := make(chan bool, 1)
 
+	// Automatic certificates take the place of static ones when configured
+	var certManager *autocert.Manager
+	if cfg.TLS.ACMEEnabled() {
+		certManager = server.EnableACME(apiServer, cfg.TLS)
+		logger.Info("automatic certificates enabled", "domains", cfg.TLS.ACMEDomains)
+	}
+
+	// Shutdown order: stop consuming queues, stop producing and reporting
+	// aggregates, stop receiving traffic, drain the public listeners, flush the ingest buffer,
+	// close the database and finally the admin listener, which keeps reporting
+	// readiness until the end.
+	shutdownCfg := cfg.Shutdown
+	readinessDelay := time.Duration(shutdownCfg.ReadinessDelaySeconds) * time.Second
+	for name, src := range sources {
+		lc.Add(name, time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, src.Stop)
+	}
+	lc.Add("aggregator", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, agg.Stop)
+	if summaries != nil {
+		lc.Add("reports", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, summaries.Stop)
+	}
+	if detector != nil {
+		lc.Add("anomaly detector", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, detector.Stop)
+	}
+	if evaluator != nil {
+		lc.Add("alert rules", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, evaluator.Stop)
+	}
+	if archiver != nil {
+		lc.Add("events archiver", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, archiver.Stop)
+	}
+	if sched != nil {
+		lc.Add("scheduled events", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, sched.Stop)
+		lc.Add("expired events", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, janitor.Stop)
+	}
+	lc.Add("feature flags", time.Duration(shutdownCfg.AggregatorTimeoutSeconds)*time.Second, flagSet.Stop)
+	lc.Add("readiness", readinessDelay+time.Second, lc.NotReady(readinessDelay))
+	lc.Add("api server", time.Duration(shutdownCfg.HTTPTimeoutSeconds)*time.Second, drainServer(apiServer))
+	if requests != nil {
+		lc.Add("request recording", time.Duration(shutdownCfg.HTTPTimeoutSeconds)*time.Second, func(context.Context) error {
+			return requests.Close()
+		})
+	}
+
+	// Optional plain HTTP listener redirecting to HTTPS
+	var redirectServer *http.Server
+	if cfg.TLS.RedirectPort != 0 {
+		redirectServer = server.NewRedirectServer(cfg.TLS.RedirectPort, cfg.Server.Port, certManager)
+		lc.Add("redirect server", time.Duration(shutdownCfg.HTTPTimeoutSeconds)*time.Second, drainServer(redirectServer))
+		go func() {
+			logger.Info("redirect server started", "address", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				panic(fmt.Sprintf("redirect server error: %s", err))
+			}
+		}()
+	}
+
+	// Flush the events accepted by the drained listeners, interrupt import,
+	// export, background and replay jobs, stop replaying the spool and stop the sinks
+	// before closing the database
+	if buf != nil {
+		lc.Add("ingest buffer", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, buf.Stop)
+	}
+	if jobs != nil {
+		lc.Add("import jobs", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, jobs.Stop)
+	}
+	if jobPool != nil {
+		lc.Add("background jobs", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, jobPool.Stop)
+	}
+	lc.Add("quotas", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, meter.Stop)
+	if replayer != nil {
+		lc.Add("replay", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, replayer.Stop)
+	}
+	if sp != nil {
+		lc.Add("spool", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, sp.Stop)
+	}
+	if dispatcher != nil {
+		lc.Add("webhook dispatcher", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, dispatcher.Stop)
+	}
+	if exporter != nil {
+		lc.Add("exporter", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, exporter.Stop)
+	}
+	if producer != nil {
+		lc.Add("kafka sink", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, producer.Stop)
+	}
+	if indexer != nil {
+		lc.Add("elasticsearch sink", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, indexer.Stop)
+	}
+	if forwarder != nil {
+		lc.Add("forwarder", time.Duration(shutdownCfg.IngestTimeoutSeconds)*time.Second, forwarder.Stop)
+	}
+
+	storage.AddShutdown(lc, time.Duration(shutdownCfg.DBTimeoutSeconds)*time.Second)
+
+	// Operational endpoints (metrics, health, readiness) on the internal admin port
+	audit := database.NewAuditStore()
+	deepCheckers := append(storage.DeepCheckers(), agg)
+	// Subsystem states summarized on GET /status
+	statuses := map[string]server.StatusReporter{
+		"aggregation": aggStatus,
+	}
+	if buf != nil {
+		statuses["ingest_buffer"] = server.StatusFunc(func(context.Context) (any, error) {
+			return map[string]int{"depth": buf.Len(), "capacity": cfg.Ingest.Buffer.Size}, nil
+		})
+	}
+	if deliveries != nil {
+		statuses["webhook_deliveries"] = server.StatusFunc(func(ctx context.Context) (any, error) {
+			return deliveries.DeliveryBacklog(ctx)
+		})
+	}
+	if storage.Breaker != nil {
+		statuses["circuit_breaker"] = server.StatusFunc(func(context.Context) (any, error) {
+			state, _ := database.CircuitState(storage.Breaker)
+			return map[string]string{"state": state.String()}, nil
+		})
+	}
+	adminServer := server.NewAdminServer(logger, cfg, server.AdminOptions{
+		DB:          db,
+		Reporter:    reporter,
+		Readiness:   lc,
+		LogLevel:    logLevel,
+		DeadLetters: deadLetters,
+
+		Subscriptions: subscriptions,
+		AlertRules:    alertRules,
+		Exports:       exports,
+		Replays:       replays,
+		EventStore:    eventStore,
+		Stats:         stats,
+		Aggregator:    agg,
+		DeepCheckers:  deepCheckers,
+		Started:       started,
+		Status:        statuses,
+		Projects:      projects,
+		Audit:         audit,
+		Flags:         flagSet,
+		Jobs:          backgroundJobs,
+		Recorder:      requestRecorder,
+		ReplayTarget:  apiServer.Handler,
+		DualWrites:    dualWrites,
+		Snapshots:     snapshots,
+	})
+	lc.Add("admin server", time.Duration(shutdownCfg.HTTPTimeoutSeconds)*time.Second, drainServer(adminServer))
+	go func() {
+		logger.Info("admin server started", "address", adminServer.Addr)
+		if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(fmt.Sprintf("admin server error: %s", err))
+		}
+	}()
+
+	// Readiness reports "starting" until Postgres accepts connections, so
+	// the container may start before the database does.
+	startupWait := time.Duration(cfg.DB.StartupWaitSeconds) * time.Second
+	if err := storage.WaitForConnection(context.Background(), logger, startupWait); err != nil {
+		logger.Error("failed to connect to database", "wait", startupWait.String(), "error", err)
+		os.Exit(1)
+	}
+	logger.Info("connected to database")
+
+	if err := agg.Start(); err != nil {
+		panic(fmt.Sprintf("failed to start cron job: %s", err))
+	}
+	for _, src := range sources {
+		src.Start()
+	}
+	if buf != nil {
+		buf.Start()
+	}
+	if sp != nil {
+		sp.Start()
+	}
+	if jobs != nil {
+		jobs.Start()
+	}
+	if background && jobPool != nil {
+		jobPool.Start()
+	}
+	flagSet.Start()
+	if archiver != nil {
+		archiver.Start()
+	}
+	if sched != nil {
+		sched.Start()
+		janitor.Start()
+	}
+	meter.Start()
+	if exporter != nil {
+		exporter.Start()
+	}
+	if dispatcher != nil {
+		dispatcher.Start()
+	}
+	if background && producer != nil {
+		producer.Start()
+	}
+	if replayer != nil {
+		replayer.Start()
+	}
+	if indexer != nil {
+		indexer.Start()
+	}
+	if forwarder != nil {
+		forwarder.Start()
+	}
+	if summaries != nil {
+		summaries.Start()
+	}
+	if detector != nil {
+		detector.Start()
+	}
+	if evaluator != nil {
+		evaluator.Start()
+	}
+
 	// Run graceful shutdown in a separate goroutine
-	go gracefulShutdown(server, agg, logger, done)
+	go gracefulShutdown(lc, logger, done)
+
+	// Registered last, so that reloads are recorded once every hook ran
+	reloader.Register("audit log", func(cfg *config.Config) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return audit.Record(ctx, database.AuditEntry{Actor: "SIGHUP", Action: "reload config", Payload: map[string]string{"config": *configPath}})
+	})
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	go reloader.WatchSignals(reloadCtx)
 
-	err = server.ListenAndServe()
+	lc.SetReady()
+
+	switch {
+	case certManager != nil:
+		logger.Info("serving with TLS", "acme_domains", cfg.TLS.ACMEDomains)
+		err = apiServer.ListenAndServeTLS("", "")
+	case cfg.TLS.HasStaticCert():
+		logger.Info("serving with TLS", "cert_file", cfg.TLS.CertFile)
+		err = apiServer.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+	default:
+		err = apiServer.ListenAndServe()
+	}
 	if err != nil && err != http.ErrServerClosed {
 		panic(fmt.Sprintf("http server error: %s", err))
 	}
@@ -0,0 +1,23 @@
+// Command eventsctl operates an instance through its HTTP APIs:
+//
+//	go run ./cmd/eventsctl count -user 42
+//	go run ./cmd/eventsctl -token $ADMIN_TOKEN delete -action spam -from 2025-01-01T00:00:00Z
+//
+// Run it without arguments for the list of commands.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/arimatakao/simple-events-handler/internal/eventsctl"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	status := eventsctl.Run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(status)
+}
@@ -0,0 +1,135 @@
+// Command import loads historical events from CSV or NDJSON files into the
+// events table through the same COPY path as the service:
+//
+//	go run ./cmd/import -config config.yaml events-2023.csv events-2024.ndjson
+//
+// Database settings are read like the service reads them, from -config and
+// the environment. Use -dry-run to validate files without connecting.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/importer"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to a YAML or TOML configuration file")
+	format := flag.String("format", "", "input format, csv or ndjson; inferred from the file extension when empty")
+	batchSize := flag.Int("batch-size", 1000, "events per insert")
+	project := flag.Int64("project", database.DefaultProjectID, "id of the project receiving the events")
+	dryRun := flag.Bool("dry-run", false, "validate the files without writing to the database")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] FILE...\n\nUse - to read standard input (requires -format).\n\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *batchSize <= 0 {
+		fatalf("-batch-size must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var db database.Service
+	if !*dryRun {
+		cfg, err := config.Load(*configPath)
+		if err != nil {
+			fatalf("failed to load configuration: %v", err)
+		}
+		database.Configure(cfg.DB)
+		rules, err := ingest.NewRules(cfg.Validation)
+		if err != nil {
+			fatalf("invalid validation rules: %v", err)
+		}
+		ingest.SetRules(rules)
+		db = database.New()
+		defer db.Close()
+	}
+
+	var total importer.Stats
+	for _, name := range flag.Args() {
+		stats, err := importFile(ctx, db, name, *format, importer.Options{
+			ProjectID: *project,
+			BatchSize: *batchSize,
+			DryRun:    *dryRun,
+		})
+		total.Read += stats.Read
+		total.Imported += stats.Imported
+		total.Invalid += stats.Invalid
+		if err != nil {
+			fatalf("%s: %v (%d events imported before the error)", name, err, stats.Imported)
+		}
+	}
+
+	verb := "imported"
+	if *dryRun {
+		verb = "valid"
+	}
+	fmt.Printf("%d records read, %d %s, %d invalid\n", total.Read, total.Imported, verb, total.Invalid)
+	if total.Invalid > 0 {
+		os.Exit(1)
+	}
+}
+
+func importFile(ctx context.Context, db database.Eventter, name, format string, opts importer.Options) (importer.Stats, error) {
+	var f importer.Format
+	var err error
+	if format != "" {
+		f, err = importer.ParseFormat(format)
+	} else {
+		f, err = importer.FormatFromName(name)
+	}
+	if err != nil {
+		return importer.Stats{}, err
+	}
+
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return importer.Stats{}, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	// Report progress at most once a second
+	var last time.Time
+	opts.Progress = func(s importer.Stats) {
+		if time.Since(last) < time.Second {
+			return
+		}
+		last = time.Now()
+		fmt.Fprintf(os.Stderr, "%s: %d records read, %d imported, %d invalid\n", name, s.Read, s.Imported, s.Invalid)
+	}
+
+	stats, err := importer.Import(ctx, db, r, f, opts)
+	for _, msg := range stats.Errors {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, msg)
+	}
+	if stats.Invalid > len(stats.Errors) {
+		fmt.Fprintf(os.Stderr, "%s: %d more invalid records not shown\n", name, stats.Invalid-len(stats.Errors))
+	}
+	return stats, err
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
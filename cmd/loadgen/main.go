@@ -0,0 +1,61 @@
+// Command loadgen sends a mix of POST /events and GET /events requests to an
+// instance and reports their latency percentiles:
+//
+//	go run ./cmd/loadgen -target http://localhost:8080/api -rate 500 -duration 1m
+//
+// Use the same flags against two releases to compare them; the exit status
+// is 1 when any request failed.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/loadgen"
+)
+
+func main() {
+	var cfg loadgen.Config
+	flag.StringVar(&cfg.Target, "target", "http://localhost:8080/api", "base URL of the API, including the base path")
+	flag.Float64Var(&cfg.Rate, "rate", 100, "requests per second over all workers; 0 for as fast as possible")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 10, "concurrent workers")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "length of the run")
+	flag.Float64Var(&cfg.ReadRatio, "read-ratio", 0.2, "share of GET /events requests, from 0 to 1")
+	flag.IntVar(&cfg.PayloadBytes, "payload-bytes", 32, "length of the metadata page of the events sent")
+	flag.IntVar(&cfg.Users, "users", 1000, "distinct user ids events are sent for and queried by")
+	flag.DurationVar(&cfg.Window, "window", time.Hour, "time range of the GET /events queries, ending now")
+	timeout := flag.Duration("timeout", 10*time.Second, "deadline of a single request")
+	flag.Parse()
+
+	if err := cfg.Validate(); err != nil {
+		fatalf("invalid flags: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = cfg.Concurrency
+	client := &http.Client{Transport: transport, Timeout: *timeout}
+
+	fmt.Fprintf(os.Stderr, "sending to %s for %s with %d workers\n", cfg.Target, cfg.Duration, cfg.Concurrency)
+	report, err := loadgen.Run(ctx, cfg, client)
+	if err != nil {
+		fatalf("load generation failed: %v", err)
+	}
+	_, _ = report.WriteTo(os.Stdout)
+	if report.Ops[loadgen.OpAdd].Errors+report.Ops[loadgen.OpGet].Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
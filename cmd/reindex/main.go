@@ -0,0 +1,102 @@
+// Command reindex rebuilds the Elasticsearch index of the events sink from
+// Postgres, for example after changing the mapping or losing the cluster:
+//
+//	go run ./cmd/reindex -config config.yaml -index events-v2
+//
+// The cluster and database settings are read like the service reads them,
+// from -config and the environment. Events keep their id as document id,
+// so running it again over the same range replaces the documents.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+	"github.com/arimatakao/simple-events-handler/internal/sink/elasticsearch"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to a YAML or TOML configuration file")
+	index := flag.String("index", "", "index to write to; SINK_ELASTICSEARCH_INDEX when empty")
+	from := flag.String("from", "", "reindex the events created at or after this RFC 3339 time")
+	to := flag.String("to", "", "reindex the events created before this RFC 3339 time; now when empty")
+	batchSize := flag.Int("batch-size", 0, "documents per bulk request; SINK_ELASTICSEARCH_BATCH_SIZE when 0")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fatalf("failed to load configuration: %v", err)
+	}
+	es := cfg.Sinks.Elasticsearch
+	if !es.Enabled() {
+		fatalf("SINK_ELASTICSEARCH_URL is not set")
+	}
+	if *index == "" {
+		*index = es.Index
+	}
+	if *batchSize == 0 {
+		*batchSize = es.BatchSize
+	}
+	if *batchSize < 1 {
+		fatalf("-batch-size must be positive")
+	}
+
+	start, end := time.Unix(0, 0), time.Now()
+	if *from != "" {
+		if start, err = time.Parse(time.RFC3339, *from); err != nil {
+			fatalf("invalid -from: %v", err)
+		}
+	}
+	if *to != "" {
+		if end, err = time.Parse(time.RFC3339, *to); err != nil {
+			fatalf("invalid -to: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	database.Configure(cfg.DB)
+	db := database.New()
+	defer db.Close()
+	// Indexed in clear, like the sink indexes them
+	cipher, err := fieldcrypt.Load(ctx, cfg.Privacy)
+	if err != nil {
+		fatalf("failed to load the metadata encryption key: %v", err)
+	}
+
+	// Report progress at most once a second
+	var last time.Time
+	progress := func(r elasticsearch.BulkResult) {
+		if time.Since(last) < time.Second {
+			return
+		}
+		last = time.Now()
+		fmt.Fprintf(os.Stderr, "%d indexed, %d rejected\n", r.Indexed, r.Rejected)
+	}
+
+	total, err := elasticsearch.Reindex(ctx, elasticsearch.NewClient(es), database.NewEventStream().WithCipher(cipher), *index, start, end, *batchSize, progress)
+	if total.Reason != "" {
+		fmt.Fprintf(os.Stderr, "first rejected %s\n", total.Reason)
+	}
+	if err != nil {
+		fatalf("reindex failed: %v (%d events indexed before the error)", err, total.Indexed)
+	}
+	fmt.Printf("%d events indexed into %s, %d rejected\n", total.Indexed, *index, total.Rejected)
+	if total.Rejected > 0 {
+		os.Exit(1)
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,93 @@
+// Command seed fills the events table with generated data for local
+// development and demos, through the same batch insert path as the
+// service:
+//
+//	go run ./cmd/seed -config config.yaml -events 100000 -users 500 -days 30
+//
+// The same flags and -seed always generate the same events. Database
+// settings are read like the service reads them, from -config and the
+// environment.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/seed"
+)
+
+func main() {
+	configPath := flag.String("config", "", "path to a YAML or TOML configuration file")
+	events := flag.Int("events", 10000, "number of events to generate")
+	users := flag.Int("users", 100, "number of users, with ids from 1")
+	actions := flag.String("actions", "view=60,click=25,leave=7,signup=5,purchase=3", "relative weights of the actions")
+	days := flag.Int("days", 7, "spread the events over this many days")
+	until := flag.String("until", "", "RFC 3339 end of the spread; the start of the current hour when empty")
+	batchSize := flag.Int("batch-size", 1000, "events per insert")
+	seedValue := flag.Uint64("seed", 1, "random seed")
+	dryRun := flag.Bool("dry-run", false, "print the summary without writing to the database")
+	flag.Parse()
+
+	mix, err := seed.ParseActions(*actions)
+	if err != nil {
+		fatalf("invalid -actions: %v", err)
+	}
+	// The default end only moves once an hour, so reruns stay comparable
+	end := time.Now().UTC().Truncate(time.Hour)
+	if *until != "" {
+		if end, err = time.Parse(time.RFC3339, *until); err != nil {
+			fatalf("invalid -until: %v", err)
+		}
+	}
+	cfg := seed.Config{
+		Events:    *events,
+		Users:     *users,
+		Actions:   mix,
+		Until:     end,
+		Span:      time.Duration(*days) * 24 * time.Hour,
+		BatchSize: *batchSize,
+		Seed:      *seedValue,
+	}
+	if err := cfg.Validate(); err != nil {
+		fatalf("invalid flags: %v", err)
+	}
+
+	insert := func([]database.NewEvent) error { return nil }
+	if !*dryRun {
+		appCfg, err := config.Load(*configPath)
+		if err != nil {
+			fatalf("failed to load configuration: %v", err)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer stop()
+
+		database.Configure(appCfg.DB)
+		db := database.New()
+		defer db.Close()
+		insert = func(batch []database.NewEvent) error {
+			return db.InsertEvents(ctx, batch)
+		}
+	}
+
+	started := time.Now()
+	sum, err := seed.Generate(cfg, insert)
+	if err != nil {
+		fatalf("seeding failed after %d events: %v", sum.Events, err)
+	}
+	fmt.Print(sum)
+	if !*dryRun {
+		fmt.Printf("inserted in %s\n", time.Since(started).Round(time.Millisecond))
+	}
+}
+
+func fatalf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
@@ -0,0 +1,259 @@
+// Command worker runs the background work of the service apart from the
+// HTTP API, so that both can be scaled on their own:
+//
+//	go run ./cmd/worker -config config.yaml
+//
+// It consumes the ingestion queues, delivers the webhooks, feeds the Kafka
+// and Elasticsearch sinks and the forwarder, runs the scheduled exports,
+// the background jobs, the reports, anomaly detection and alert rules, the
+// archival, the scheduled events and the deletion of expired events.
+// Settings are read like the API reads them. Set WORKER_SEPARATE on the API
+// instances so that they leave this work to the workers. Metrics, health
+// and readiness are served on WORKER_PORT.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/alerting"
+	"github.com/arimatakao/simple-events-handler/internal/anomaly"
+	"github.com/arimatakao/simple-events-handler/internal/app"
+	"github.com/arimatakao/simple-events-handler/internal/archive"
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/expiry"
+	"github.com/arimatakao/simple-events-handler/internal/export"
+	"github.com/arimatakao/simple-events-handler/internal/jobs"
+	"github.com/arimatakao/simple-events-handler/internal/lifecycle"
+	"github.com/arimatakao/simple-events-handler/internal/logging"
+	"github.com/arimatakao/simple-events-handler/internal/reload"
+	"github.com/arimatakao/simple-events-handler/internal/reports"
+	"github.com/arimatakao/simple-events-handler/internal/scheduler"
+	"github.com/arimatakao/simple-events-handler/internal/server"
+	"github.com/arimatakao/simple-events-handler/internal/sink/elasticsearch"
+	"github.com/arimatakao/simple-events-handler/internal/sink/forward"
+	kafkasink "github.com/arimatakao/simple-events-handler/internal/sink/kafka"
+	webhooksink "github.com/arimatakao/simple-events-handler/internal/sink/webhooks"
+)
+
+// component is a background component started once the database accepts
+// connections and stopped on shutdown.
+type component struct {
+	name    string
+	timeout time.Duration
+	start   func()
+	stop    lifecycle.StopFunc
+}
+
+func main() {
+	started := time.Now()
+	configPath := flag.String("config", "", "path to a YAML or TOML configuration file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		slog.New(slog.NewJSONHandler(os.Stderr, nil)).Error("failed to load configuration", "error", err.Error())
+		os.Exit(1)
+	}
+
+	// Closed last, once the shutdown is logged
+	var logOutput io.Writer = os.Stdout
+	if cfg.Log.Output == "file" {
+		logFile, err := logging.OpenFile(cfg.Log.File)
+		if err != nil {
+			panic(fmt.Sprintf("failed to open log file: %s", err))
+		}
+		defer logFile.Close()
+		logOutput = logFile
+	}
+	logger, logLevel, err := logging.New(cfg.Log, logOutput)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create logger: %s", err))
+	}
+	logger = logger.With("command", "worker")
+	database.Configure(cfg.DB)
+	database.ExcludeTags(cfg.Aggregation.ExcludeTags)
+
+	lc := lifecycle.New(logger)
+
+	// Runtime settings are re-read on SIGHUP
+	reloader := reload.New(logger, *configPath)
+	reloader.Register("log level", func(cfg *config.Config) error {
+		return logLevel.UnmarshalText([]byte(cfg.Log.Level))
+	})
+	if err := app.InstallRules(cfg, reloader); err != nil {
+		panic(fmt.Sprintf("failed to compile the validation rules: %s", err))
+	}
+
+	// The events are stored exactly like the API stores them
+	storage, err := app.OpenStorage(logger, cfg, reloader)
+	if err != nil {
+		panic(fmt.Sprintf("failed to open the database: %s", err))
+	}
+	db := storage.DB
+
+	ingestTimeout := time.Duration(cfg.Shutdown.IngestTimeoutSeconds) * time.Second
+	aggregatorTimeout := time.Duration(cfg.Shutdown.AggregatorTimeoutSeconds) * time.Second
+	// In shutdown order: the consumers first, so that no event is taken
+	// from a queue once the database closes
+	var components []component
+
+	sources, err := app.Sources(logger, cfg, db)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create the queue consumers: %s", err))
+	}
+	for _, name := range slices.Sorted(maps.Keys(sources)) {
+		components = append(components, component{name, ingestTimeout, sources[name].Start, sources[name].Stop})
+	}
+
+	if cfg.Reports.Enabled() {
+		summaries, err := reports.New(logger, cfg.Reports, database.NewReportStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create reports: %s", err))
+		}
+		components = append(components, component{"reports", aggregatorTimeout, summaries.Start, summaries.Stop})
+	}
+	if cfg.Anomaly.Enabled {
+		detector, err := anomaly.New(logger, cfg.Anomaly, database.NewAnomalyStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the anomaly detector: %s", err))
+		}
+		components = append(components, component{"anomaly detector", aggregatorTimeout, detector.Start, detector.Stop})
+	}
+	if cfg.Alerts.Enabled {
+		evaluator, err := alerting.New(logger, cfg.Alerts, database.NewAlertStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the alert rules evaluator: %s", err))
+		}
+		components = append(components, component{"alert rules", aggregatorTimeout, evaluator.Start, evaluator.Stop})
+	}
+	if cfg.Archive.Enabled() {
+		archiver, err := archive.New(logger, cfg.Archive, storage.ArchiveStore())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create the events archiver: %s", err))
+		}
+		components = append(components, component{"events archiver", aggregatorTimeout, archiver.Start, archiver.Stop})
+	}
+	sched, err := scheduler.New(logger, cfg.Scheduled, storage.ScheduledStores()...)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create the scheduled events delivery: %s", err))
+	}
+	components = append(components, component{"scheduled events", aggregatorTimeout, sched.Start, sched.Stop})
+	janitor, err := expiry.New(logger, cfg.TTL, storage.ExpiryStores()...)
+	if err != nil {
+		panic(fmt.Sprintf("failed to create the expired events deletion: %s", err))
+	}
+	components = append(components, component{"expired events", aggregatorTimeout, janitor.Start, janitor.Stop})
+
+	if cfg.Jobs.Enabled() {
+		pool, err := jobs.New(logger, cfg.Jobs, database.NewJobStore(), storage.JobHandlers())
+		if err != nil {
+			panic(fmt.Sprintf("failed to create background jobs: %s", err))
+		}
+		components = append(components, component{"background jobs", ingestTimeout, pool.Start, pool.Stop})
+	}
+	// The exports on demand run in the API, which keeps their state
+	if cfg.Export.Enabled() && cfg.Export.Schedule != "" {
+		exporter, err := export.New(logger, cfg.Export, database.NewEventStream().WithCipher(storage.Cipher))
+		if err != nil {
+			panic(fmt.Sprintf("failed to create exporter: %s", err))
+		}
+		components = append(components, component{"exporter", ingestTimeout, exporter.Start, exporter.Stop})
+	}
+
+	// Subsystem states summarized on GET /status
+	statuses := map[string]server.StatusReporter{
+		"sources": server.StatusFunc(func(context.Context) (any, error) {
+			return slices.Sorted(maps.Keys(sources)), nil
+		}),
+	}
+	if cfg.Sinks.Webhooks.Enabled {
+		store := database.NewSubscriptionStore().WithCipher(storage.Cipher)
+		dispatcher := webhooksink.New(logger, cfg.Sinks.Webhooks, store)
+		components = append(components, component{"webhook dispatcher", ingestTimeout, dispatcher.Start, dispatcher.Stop})
+		statuses["webhook_deliveries"] = server.StatusFunc(func(ctx context.Context) (any, error) {
+			return store.DeliveryBacklog(ctx)
+		})
+	}
+	if cfg.Sinks.Kafka.Enabled() {
+		producer := kafkasink.New(logger, cfg.Sinks.Kafka, database.NewOutbox().WithCipher(storage.Cipher))
+		components = append(components, component{"kafka sink", ingestTimeout, producer.Start, producer.Stop})
+	}
+	if cfg.Sinks.Elasticsearch.Enabled() {
+		indexer := elasticsearch.New(logger, cfg.Sinks.Elasticsearch, database.NewOutbox().WithCipher(storage.Cipher))
+		components = append(components, component{"elasticsearch sink", ingestTimeout, indexer.Start, indexer.Stop})
+	}
+	if cfg.Federation.Forward.Enabled() {
+		forwarder := forward.New(logger, cfg.Federation.Forward, database.NewOutbox().WithCipher(storage.Cipher))
+		components = append(components, component{"forwarder", ingestTimeout, forwarder.Start, forwarder.Stop})
+	}
+	if storage.Breaker != nil {
+		statuses["circuit_breaker"] = server.StatusFunc(func(context.Context) (any, error) {
+			state, _ := database.CircuitState(storage.Breaker)
+			return map[string]string{"state": state.String()}, nil
+		})
+	}
+
+	for _, c := range components {
+		lc.Add(c.name, c.timeout, c.stop)
+	}
+	storage.AddShutdown(lc, time.Duration(cfg.Shutdown.DBTimeoutSeconds)*time.Second)
+
+	// Metrics, health and readiness, reporting until the end
+	workerServer := server.NewWorkerServer(logger, cfg, server.WorkerOptions{
+		DB:           db,
+		Readiness:    lc,
+		LogLevel:     logLevel,
+		DeepCheckers: storage.DeepCheckers(),
+		Started:      started,
+		Status:       statuses,
+	})
+	lc.Add("worker server", time.Duration(cfg.Shutdown.HTTPTimeoutSeconds)*time.Second, workerServer.Shutdown)
+	go func() {
+		logger.Info("worker server started", "address", workerServer.Addr)
+		if err := workerServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			panic(fmt.Sprintf("worker server error: %s", err))
+		}
+	}()
+
+	// Readiness reports "starting" until Postgres accepts connections
+	startupWait := time.Duration(cfg.DB.StartupWaitSeconds) * time.Second
+	if err := storage.WaitForConnection(context.Background(), logger, startupWait); err != nil {
+		logger.Error("failed to connect to database", "wait", startupWait.String(), "error", err)
+		os.Exit(1)
+	}
+	logger.Info("connected to database")
+
+	for _, c := range components {
+		c.start()
+	}
+
+	reloadCtx, stopReload := context.WithCancel(context.Background())
+	defer stopReload()
+	go reloader.WatchSignals(reloadCtx)
+
+	lc.SetReady()
+	logger.Info("worker started", "components", len(components))
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	logger.Warn("shutting down gracefully, press Ctrl+C again to force")
+	stop()
+
+	if err := lc.Shutdown(); err != nil {
+		logger.Error("graceful shutdown finished with errors", "error", err)
+	}
+	logger.Info("Graceful shutdown complete.")
+}
@@ -1,16 +1,32 @@
 package aggregator
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"os"
+	"math/rand/v2"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"log/slog"
 
+	"github.com/arimatakao/simple-events-handler/internal/config"
 	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/robfig/cron/v3"
 )
 
+var skippedRuns = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "aggregation_runs_skipped_total",
+	Help: "Total number of aggregation runs skipped because the previous run was still in progress",
+})
+
+func init() {
+	prometheus.MustRegister(skippedRuns)
+}
+
 // Aggregator manages a cron scheduler that periodically calls db.AggregateEvents.
 type Aggregator struct {
 	c              *cron.Cron
@@ -18,57 +34,190 @@ type Aggregator struct {
 	db             database.Aggregatter
 	logger         *slog.Logger
 	intervalSecond int
+	jitterSecond   int
+
+	// running guards against overlapping runs when an aggregation takes
+	// longer than the configured interval.
+	running atomic.Bool
+	// jitter draws the delay of a scheduled run, below its argument.
+	jitter func(time.Duration) time.Duration
+	// triggered tracks the runs started by Trigger, which the cron
+	// scheduler does not wait for.
+	triggered sync.WaitGroup
+	// stop is closed by Stop to cut the jitter of a pending run short.
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// The outcome of the last run, for the deep health check
+	mu      sync.Mutex
+	started time.Time
+	lastRun time.Time
+	lastErr error
+	now     func() time.Time
 }
 
-func New(logger *slog.Logger) (*Aggregator, error) {
-	aggSeconds := 60
-	if s := os.Getenv("AGGREGATION_INTERVAL_SECONDS"); s != "" {
-		if v, err := strconv.Atoi(s); err == nil {
-			if v <= 0 {
-				return nil, fmt.Errorf("invalid range number of AGGREGATION_INTERVAL_SECONDS=%s: must be positive integer", s)
-			}
-			aggSeconds = v
-		} else {
-			logger.Warn("invalid AGGREGATION_INTERVAL_SECONDS, using default 60 seconds", "error", err.Error())
-		}
+func New(logger *slog.Logger, cfg config.AggregationConfig, db database.Aggregatter) (*Aggregator, error) {
+	a := &Aggregator{
+		c:              cron.New(cron.WithSeconds()),
+		db:             db,
+		logger:         logger,
+		intervalSecond: cfg.IntervalSeconds,
+		jitterSecond:   cfg.JitterSeconds,
+		jitter:         rand.N[time.Duration],
+		stop:           make(chan struct{}),
+		now:            time.Now,
+	}
+
+	spec := "@every " + strconv.Itoa(cfg.IntervalSeconds) + "s"
+	id, err := a.c.AddFunc(spec, a.run)
+	if err != nil {
+		return nil, err
 	}
+	a.entryID = id
 
-	db := database.New()
+	return a, nil
+}
+
+// run executes a single aggregation. If the previous run is still in progress
+// the current one is skipped, so long runs don't pile up and upsert the same
+// window twice. A run still waiting out its jitter when Stop is called is
+// dropped.
+func (a *Aggregator) run() {
+	if !a.running.CompareAndSwap(false, true) {
+		a.logger.Warn("aggregation skipped, previous run still in progress")
+		skippedRuns.Inc()
+		return
+	}
+	defer a.running.Store(false)
 
-	c := cron.New(cron.WithSeconds())
-	spec := "@every " + strconv.Itoa(aggSeconds) + "s"
-	id, err := c.AddFunc(spec, func() {
-		logger.Info("Aggregation started")
-		if err := db.AggregateEvents(aggSeconds); err != nil {
-			logger.Error("aggregation error", "error", err.Error())
-		} else {
-			logger.Info("Aggregation completed successfully")
+	if a.jitterSecond > 0 {
+		timer := time.NewTimer(a.jitter(time.Duration(a.jitterSecond) * time.Second))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-a.stop:
+			return
 		}
-	})
+	}
+	a.aggregate()
+}
+
+// Trigger starts an aggregation in the background right away, without
+// jitter, unless one is already running. It reports whether a run started.
+func (a *Aggregator) Trigger() bool {
+	if !a.running.CompareAndSwap(false, true) {
+		return false
+	}
+	a.triggered.Add(1)
+	go func() {
+		defer a.triggered.Done()
+		defer a.running.Store(false)
+		a.aggregate()
+	}()
+	return true
+}
+
+func (a *Aggregator) aggregate() {
+	a.logger.Info("Aggregation started")
+	err := a.db.AggregateEvents(a.intervalSecond)
 	if err != nil {
-		return nil, err
+		a.logger.Error("aggregation error", "error", err.Error())
+	} else {
+		a.logger.Info("Aggregation completed successfully")
 	}
 
-	return &Aggregator{
-		c:              c,
-		entryID:        id,
-		db:             db,
-		logger:         logger,
-		intervalSecond: aggSeconds,
-	}, nil
+	a.mu.Lock()
+	a.lastRun, a.lastErr = a.now(), err
+	a.mu.Unlock()
+}
+
+// DeepCheck reports whether the last aggregation succeeded and ran within
+// two intervals plus the jitter, or whether the scheduler started that
+// recently when it did not run yet.
+func (a *Aggregator) DeepCheck(ctx context.Context) []database.CheckResult {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	maxAge := time.Duration(2*a.intervalSecond+a.jitterSecond) * time.Second
+	var err error
+	switch {
+	case a.started.IsZero():
+		err = errors.New("not started")
+	case a.lastRun.IsZero():
+		if a.now().Sub(a.started) > maxAge {
+			err = fmt.Errorf("no run since the start at %s", a.started.UTC().Format(time.RFC3339))
+		}
+	case a.lastErr != nil:
+		err = fmt.Errorf("last run at %s failed: %w", a.lastRun.UTC().Format(time.RFC3339), a.lastErr)
+	case a.now().Sub(a.lastRun) > maxAge:
+		err = fmt.Errorf("last run at %s, more than %s ago", a.lastRun.UTC().Format(time.RFC3339), maxAge)
+	}
+	return []database.CheckResult{database.NewCheckResult("aggregation", err)}
+}
+
+// Status is the state of the aggregation on GET /status. Times are unset
+// until the first start or run.
+type Status struct {
+	IntervalSeconds int        `json:"interval_seconds"`
+	Running         bool       `json:"running"`
+	StartedAt       *time.Time `json:"started_at,omitempty"`
+	LastRunAt       *time.Time `json:"last_run_at,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+}
+
+// Status returns whether an aggregation is running and the outcome of the
+// last one.
+func (a *Aggregator) Status() Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := Status{IntervalSeconds: a.intervalSecond, Running: a.running.Load()}
+	if !a.started.IsZero() {
+		started := a.started.UTC()
+		st.StartedAt = &started
+	}
+	if !a.lastRun.IsZero() {
+		lastRun := a.lastRun.UTC()
+		st.LastRunAt = &lastRun
+	}
+	if a.lastErr != nil {
+		st.LastError = a.lastErr.Error()
+	}
+	return st
 }
 
 // Start begins the scheduled aggregation job. It is safe to call Start multiple times.
 func (a *Aggregator) Start() error {
+	a.mu.Lock()
+	if a.started.IsZero() {
+		a.started = a.now()
+	}
+	a.mu.Unlock()
 	a.c.Start()
-	a.logger.Info("aggregation cron started", "interval_seconds", a.intervalSecond)
+	a.logger.Info("aggregation cron started", "interval_seconds", a.intervalSecond, "jitter_seconds", a.jitterSecond)
 	return nil
 }
 
-// Stop stops the cron scheduler.
-func (a *Aggregator) Stop() {
-	if a.c != nil {
-		a.c.Stop()
+// Stop stops the cron scheduler, drops a run waiting out its jitter and
+// waits for a running aggregation to finish, or for ctx to be done.
+func (a *Aggregator) Stop(ctx context.Context) error {
+	if a.c == nil {
+		return nil
+	}
+
+	a.stopOnce.Do(func() { close(a.stop) })
+	stopped := a.c.Stop()
+	triggered := make(chan struct{})
+	go func() {
+		<-stopped.Done()
+		a.triggered.Wait()
+		close(triggered)
+	}()
+	select {
+	case <-triggered:
 		a.logger.Info("aggregation cron stopped", "cron_entry_id", a.entryID)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
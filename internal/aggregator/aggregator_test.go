@@ -0,0 +1,196 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// blockingDB blocks every aggregation until it is released with its
+// outcome, and tells the interval of the aggregations it starts.
+type blockingDB struct {
+	started chan int
+	release chan error
+}
+
+func newBlockingDB() *blockingDB {
+	return &blockingDB{started: make(chan int, 1), release: make(chan error)}
+}
+
+func (d *blockingDB) AggregateEvents(seconds int) error {
+	d.started <- seconds
+	return <-d.release
+}
+
+func newAggregator(t *testing.T, jitterSeconds int, db *blockingDB) *Aggregator {
+	t.Helper()
+	a, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.AggregationConfig{IntervalSeconds: 60, JitterSeconds: jitterSeconds}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// runAsync runs a scheduled aggregation and returns a channel closed once
+// it returned.
+func runAsync(a *Aggregator) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.run()
+	}()
+	return done
+}
+
+func TestSkipWhileRunning(t *testing.T) {
+	db := newBlockingDB()
+	a := newAggregator(t, 0, db)
+	// New can be called again, the metric being registered once
+	newAggregator(t, 0, newBlockingDB())
+
+	done := runAsync(a)
+	if seconds := <-db.started; seconds != 60 {
+		t.Fatalf("expected an aggregation of 60 seconds, got %d", seconds)
+	}
+
+	// The runs falling during the aggregation are skipped and counted
+	skipped := testutil.ToFloat64(skippedRuns)
+	a.run()
+	if got := testutil.ToFloat64(skippedRuns); got != skipped+1 {
+		t.Fatalf("expected the run skipped, counted %v then %v", skipped, got)
+	}
+	if a.Trigger() {
+		t.Fatal("expected no trigger while running")
+	}
+	if !a.Status().Running {
+		t.Fatal("expected the status to be running")
+	}
+
+	db.release <- nil
+	<-done
+	if a.Status().Running {
+		t.Fatal("expected the run to be over")
+	}
+	select {
+	case <-db.started:
+		t.Fatal("expected the skipped runs not to aggregate")
+	default:
+	}
+}
+
+func TestJitter(t *testing.T) {
+	db := newBlockingDB()
+	a := newAggregator(t, 5, db)
+	var bound time.Duration
+	a.jitter = func(d time.Duration) time.Duration {
+		bound = d
+		return 50 * time.Millisecond
+	}
+
+	start := time.Now()
+	done := runAsync(a)
+	<-db.started
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Fatalf("expected the run to wait out its jitter, aggregated after %s", waited)
+	}
+	if bound != 5*time.Second {
+		t.Fatalf("expected a jitter below 5s, drawn below %s", bound)
+	}
+	db.release <- nil
+	<-done
+}
+
+func TestStopDuringJitter(t *testing.T) {
+	db := newBlockingDB()
+	a := newAggregator(t, 3600, db)
+	a.jitter = func(d time.Duration) time.Duration { return d }
+
+	done := runAsync(a)
+	for !a.running.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("expected the run waiting out its jitter to be dropped")
+	}
+	select {
+	case <-db.started:
+		t.Fatal("expected the dropped run not to aggregate")
+	default:
+	}
+	if a.Status().Running {
+		t.Fatal("expected no run after stop")
+	}
+}
+
+func TestTrigger(t *testing.T) {
+	db := newBlockingDB()
+	a := newAggregator(t, 3600, db)
+
+	// Triggered runs skip the jitter and are waited for by Stop
+	if !a.Trigger() {
+		t.Fatal("expected the trigger to start a run")
+	}
+	<-db.started
+	if a.Trigger() {
+		t.Fatal("expected no second trigger while running")
+	}
+	stopped := make(chan error)
+	go func() {
+		stopped <- a.Stop(context.Background())
+	}()
+	select {
+	case err := <-stopped:
+		t.Fatalf("expected stop to wait for the triggered run, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	db.release <- nil
+	if err := <-stopped; err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	db := newBlockingDB()
+	a := newAggregator(t, 0, db)
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*3600))
+	a.now = func() time.Time { return now }
+
+	if st := a.Status(); st.IntervalSeconds != 60 || st.Running || st.StartedAt != nil || st.LastRunAt != nil || st.LastError != "" {
+		t.Fatalf("expected an empty status before the start, got %+v", st)
+	}
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop(context.Background())
+
+	// The outcome of the last run, in UTC
+	if !a.Trigger() {
+		t.Fatal("expected the trigger to start a run")
+	}
+	<-db.started
+	db.release <- errors.New("connection refused")
+	for a.Status().Running {
+		time.Sleep(time.Millisecond)
+	}
+	st := a.Status()
+	if st.StartedAt == nil || !st.StartedAt.Equal(now) || st.StartedAt.Location() != time.UTC {
+		t.Fatalf("expected the start time in UTC, got %v", st.StartedAt)
+	}
+	if st.LastRunAt == nil || !st.LastRunAt.Equal(now) || st.LastError != "connection refused" {
+		t.Fatalf("expected the failed run, got %+v", st)
+	}
+}
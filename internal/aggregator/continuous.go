@@ -0,0 +1,156 @@
+package aggregator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Policies are the TimescaleDB policies of the events and of their
+// continuous aggregates.
+type Policies interface {
+	ApplyPolicies(ctx context.Context, cfg config.TimescaleConfig, refreshEvery time.Duration) error
+	RefreshAggregates(ctx context.Context) error
+	AggregateJobs(ctx context.Context) ([]database.AggregateJob, error)
+}
+
+// Continuous replaces the Aggregator in the TimescaleDB mode: TimescaleDB
+// refreshes the continuous aggregates itself, on the policies set by Start.
+type Continuous struct {
+	db             Policies
+	logger         *slog.Logger
+	cfg            config.TimescaleConfig
+	intervalSecond int
+
+	running   atomic.Bool
+	triggered sync.WaitGroup
+
+	mu      sync.Mutex
+	started time.Time
+	now     func() time.Time
+}
+
+func NewContinuous(logger *slog.Logger, cfg config.AggregationConfig, tsCfg config.TimescaleConfig, db Policies) *Continuous {
+	return &Continuous{
+		db:             db,
+		logger:         logger,
+		cfg:            tsCfg,
+		intervalSecond: cfg.IntervalSeconds,
+		now:            time.Now,
+	}
+}
+
+// Start sets the chunk interval, the compression policy and the refresh
+// policies, so that the continuous aggregates are refreshed every
+// aggregation interval.
+func (a *Continuous) Start() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := a.db.ApplyPolicies(ctx, a.cfg, time.Duration(a.intervalSecond)*time.Second); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	if a.started.IsZero() {
+		a.started = a.now()
+	}
+	a.mu.Unlock()
+	a.logger.Info("continuous aggregates policies set", "interval_seconds", a.intervalSecond,
+		"chunk_interval_hours", a.cfg.ChunkIntervalHours, "compress_after_days", a.cfg.CompressAfterDays)
+	return nil
+}
+
+// Trigger refreshes the continuous aggregates in the background right away,
+// unless a refresh started by Trigger is running. It reports whether one
+// started.
+func (a *Continuous) Trigger() bool {
+	if !a.running.CompareAndSwap(false, true) {
+		return false
+	}
+	a.triggered.Add(1)
+	go func() {
+		defer a.triggered.Done()
+		defer a.running.Store(false)
+		a.logger.Info("continuous aggregates refresh started")
+		if err := a.db.RefreshAggregates(context.Background()); err != nil {
+			a.logger.Error("continuous aggregates refresh error", "error", err.Error())
+			return
+		}
+		a.logger.Info("continuous aggregates refreshed")
+	}()
+	return true
+}
+
+// DeepCheck reports whether every refresh policy last succeeded within two
+// intervals, or whether the policies were set that recently when one did
+// not run yet.
+func (a *Continuous) DeepCheck(ctx context.Context) []database.CheckResult {
+	a.mu.Lock()
+	started := a.started
+	a.mu.Unlock()
+	if started.IsZero() {
+		return []database.CheckResult{database.NewCheckResult("aggregation", errors.New("not started"))}
+	}
+
+	jobs, err := a.db.AggregateJobs(ctx)
+	if err != nil {
+		return []database.CheckResult{database.NewCheckResult("aggregation", err)}
+	}
+	maxAge := time.Duration(2*a.intervalSecond) * time.Second
+	var errs []error
+	for _, j := range jobs {
+		switch {
+		case j.LastStatus == "Failed":
+			errs = append(errs, fmt.Errorf("last refresh of %s failed", j.View))
+		case j.LastSuccessAt == nil:
+			if a.now().Sub(started) > maxAge {
+				errs = append(errs, fmt.Errorf("no refresh of %s since the start at %s", j.View, started.UTC().Format(time.RFC3339)))
+			}
+		case a.now().Sub(*j.LastSuccessAt) > maxAge:
+			errs = append(errs, fmt.Errorf("last refresh of %s at %s, more than %s ago", j.View, j.LastSuccessAt.Format(time.RFC3339), maxAge))
+		}
+	}
+	return []database.CheckResult{database.NewCheckResult("aggregation", errors.Join(errs...))}
+}
+
+// ContinuousStatus is the state of the aggregation on GET /status in the
+// TimescaleDB mode.
+type ContinuousStatus struct {
+	IntervalSeconds int                     `json:"interval_seconds"`
+	Running         bool                    `json:"running"`
+	Jobs            []database.AggregateJob `json:"jobs"`
+}
+
+// Status returns whether a triggered refresh is running and the state of
+// the refresh policies.
+func (a *Continuous) Status(ctx context.Context) (ContinuousStatus, error) {
+	jobs, err := a.db.AggregateJobs(ctx)
+	if err != nil {
+		return ContinuousStatus{}, err
+	}
+	return ContinuousStatus{IntervalSeconds: a.intervalSecond, Running: a.running.Load(), Jobs: jobs}, nil
+}
+
+// Stop waits for a triggered refresh to finish, or for ctx to be done. The
+// policies keep running in TimescaleDB.
+func (a *Continuous) Stop(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		a.triggered.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,182 @@
+// Package alerting evaluates the threshold alert rules managed on the admin
+// listener, such as more than 10 login_failed events of a single user
+// within 5 minutes, and sends their alerts to a Slack incoming webhook and
+// to a JSON webhook.
+package alerting
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/notify"
+)
+
+var firingsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "alert_firings_total",
+	Help: "Alerts fired by the alert rules",
+})
+
+func init() {
+	prometheus.MustRegister(firingsTotal)
+}
+
+// evaluateTimeout bounds an evaluation of the rules, including the
+// notifications it sends.
+const evaluateTimeout = time.Minute
+
+// Store reads the rules, counts their events and keeps their firings.
+type Store interface {
+	ListAlertRules(ctx context.Context, activeOnly bool) ([]database.AlertRule, error)
+	EvaluateAlertRule(ctx context.Context, r database.AlertRule) ([]database.RuleMatch, error)
+	OpenAlertFiring(ctx context.Context, f database.AlertFiring) (database.AlertFiring, bool, error)
+	ResolveAlertFirings(ctx context.Context, ruleID int64, matching []int64) (int64, error)
+}
+
+// Alert is the JSON body sent to the webhook channel.
+type Alert struct {
+	Rule   database.AlertRule   `json:"rule"`
+	Firing database.AlertFiring `json:"firing"`
+}
+
+// Evaluator evaluates the active rules at every interval.
+type Evaluator struct {
+	l        *slog.Logger
+	store    Store
+	interval int
+	senders  map[string]notify.Sender
+	cron     *cron.Cron
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// New creates an evaluator sending alerts to the channels configured in cfg.
+func New(logger *slog.Logger, cfg config.AlertsConfig, store Store) (*Evaluator, error) {
+	senders := map[string]notify.Sender{}
+	if cfg.SlackWebhookURL != "" {
+		senders["slack"] = notify.NewSlack(cfg.SlackWebhookURL)
+	}
+	if cfg.WebhookURL != "" {
+		senders["webhook"] = notify.NewWebhook(cfg.WebhookURL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	e := &Evaluator{
+		l:        logger,
+		store:    store,
+		interval: cfg.CheckIntervalSeconds,
+		senders:  senders,
+		cron:     cron.New(cron.WithSeconds()),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	// The cron scheduler skips a tick while the previous evaluation still runs
+	spec := "@every " + strconv.Itoa(cfg.CheckIntervalSeconds) + "s"
+	if _, err := e.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(e.run))); err != nil {
+		cancel()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *Evaluator) run() {
+	ctx, cancel := context.WithTimeout(e.ctx, evaluateTimeout)
+	defer cancel()
+	if err := e.Evaluate(ctx); err != nil && e.ctx.Err() == nil {
+		e.l.Error("alert rules evaluation failed", "error", err)
+	}
+}
+
+// Start schedules the evaluations.
+func (e *Evaluator) Start() {
+	e.cron.Start()
+	e.l.Info("alert rules evaluation started", "interval_seconds", e.interval, "channels", len(e.senders))
+}
+
+// Stop cancels the running evaluation and waits for it, or for ctx to be
+// done.
+func (e *Evaluator) Stop(ctx context.Context) error {
+	stopped := e.cron.Stop()
+	e.cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Evaluate evaluates every active rule. A rule that fails to evaluate does
+// not prevent the others from being evaluated.
+func (e *Evaluator) Evaluate(ctx context.Context) error {
+	rules, err := e.store.ListAlertRules(ctx, true)
+	if err != nil {
+		return fmt.Errorf("list alert rules: %w", err)
+	}
+	var failed int
+	for _, r := range rules {
+		if err := e.evaluate(ctx, r); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			e.l.Error("alert rule evaluation failed", "rule_id", r.ID, "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d alert rules failed to evaluate", failed, len(rules))
+	}
+	return nil
+}
+
+// evaluate fires the rule for each new match, once until it no longer
+// matches, and resolves the firings of the users that no longer match.
+func (e *Evaluator) evaluate(ctx context.Context, r database.AlertRule) error {
+	matches, err := e.store.EvaluateAlertRule(ctx, r)
+	if err != nil {
+		return err
+	}
+	matching := make([]int64, 0, len(matches))
+	for _, m := range matches {
+		matching = append(matching, m.UserID)
+		f, opened, err := e.store.OpenAlertFiring(ctx, database.AlertFiring{RuleID: r.ID, UserID: m.UserID, Count: m.Count})
+		if err != nil {
+			return err
+		}
+		// Already fired, possibly by another instance
+		if !opened {
+			continue
+		}
+		firingsTotal.Inc()
+		e.l.Warn("alert fired", "rule_id", r.ID, "rule", r.Name, "user_id", m.UserID, "count", m.Count)
+		e.notify(ctx, r, f)
+	}
+	_, err = e.store.ResolveAlertFirings(ctx, r.ID, matching)
+	return err
+}
+
+// notify sends the alert to every channel. A failed channel does not
+// prevent the others from receiving it.
+func (e *Evaluator) notify(ctx context.Context, r database.AlertRule, f database.AlertFiring) {
+	who := fmt.Sprintf("project %d", r.ProjectID)
+	if r.PerUser {
+		who = fmt.Sprintf("user %d of project %d", f.UserID, r.ProjectID)
+	}
+	m := notify.Message{
+		Title:   "Alert: " + r.Name,
+		Text:    fmt.Sprintf("%d %s events of %s within %s, more than %d", f.Count, r.Action, who, time.Duration(r.WindowSeconds)*time.Second, r.Threshold),
+		Payload: Alert{Rule: r, Firing: f},
+	}
+	for channel, snd := range e.senders {
+		if err := snd.Send(ctx, m); err != nil {
+			e.l.Error("alert not sent", "channel", channel, "rule_id", r.ID, "error", err)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type firingKey struct{ rule, user int64 }
+
+// fakeStore answers fixed matches per rule and keeps the firings in memory.
+type fakeStore struct {
+	rules    []database.AlertRule
+	matches  map[int64][]database.RuleMatch
+	failing  map[int64]bool
+	open     map[firingKey]bool
+	resolved []firingKey
+}
+
+func (f *fakeStore) ListAlertRules(ctx context.Context, activeOnly bool) ([]database.AlertRule, error) {
+	return f.rules, nil
+}
+
+func (f *fakeStore) EvaluateAlertRule(ctx context.Context, r database.AlertRule) ([]database.RuleMatch, error) {
+	if f.failing[r.ID] {
+		return nil, errors.New("canceling statement due to statement timeout")
+	}
+	return f.matches[r.ID], nil
+}
+
+func (f *fakeStore) OpenAlertFiring(ctx context.Context, a database.AlertFiring) (database.AlertFiring, bool, error) {
+	k := firingKey{a.RuleID, a.UserID}
+	if f.open[k] {
+		return database.AlertFiring{}, false, nil
+	}
+	f.open[k] = true
+	a.ID = int64(len(f.open))
+	return a, true, nil
+}
+
+func (f *fakeStore) ResolveAlertFirings(ctx context.Context, ruleID int64, matching []int64) (int64, error) {
+	var n int64
+	for k := range f.open {
+		if k.rule == ruleID && !slices.Contains(matching, k.user) {
+			delete(f.open, k)
+			f.resolved = append(f.resolved, k)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestEvaluate(t *testing.T) {
+	var alerts []Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a Alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		alerts = append(alerts, a)
+	}))
+	defer srv.Close()
+
+	store := &fakeStore{
+		rules: []database.AlertRule{
+			{ID: 1, Name: "brute force", ProjectID: 1, Action: "login_failed", PerUser: true, Threshold: 10, WindowSeconds: 300, Active: true},
+			{ID: 2, Name: "checkout errors", ProjectID: 1, Action: "checkout_error", Threshold: 100, WindowSeconds: 60, Active: true},
+		},
+		matches: map[int64][]database.RuleMatch{1: {{UserID: 42, Count: 12}, {UserID: 43, Count: 11}}},
+		open:    map[firingKey]bool{{2, 0}: true},
+	}
+	cfg := config.AlertsConfig{CheckIntervalSeconds: 30, WebhookURL: srv.URL}
+	e, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Evaluate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected 2 alerts, got %+v", alerts)
+	}
+	if a := alerts[0]; a.Rule.ID != 1 || a.Firing.UserID != 42 || a.Firing.Count != 12 {
+		t.Fatalf("expected an alert of user 42, got %+v", a)
+	}
+	if len(store.resolved) != 1 || store.resolved[0] != (firingKey{2, 0}) {
+		t.Fatalf("expected the firing of rule 2 to be resolved, got %v", store.resolved)
+	}
+
+	// A match fires once until it no longer matches
+	store.matches[1] = []database.RuleMatch{{UserID: 42, Count: 15}}
+	if err := e.Evaluate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected no new alert, got %+v", alerts[2:])
+	}
+	if len(store.resolved) != 2 || store.resolved[1] != (firingKey{1, 43}) {
+		t.Fatalf("expected the firing of user 43 to be resolved, got %v", store.resolved)
+	}
+
+	// A failing rule does not prevent the others from being evaluated
+	store.failing = map[int64]bool{1: true}
+	store.matches[2] = []database.RuleMatch{{Count: 120}}
+	err = e.Evaluate(context.Background())
+	if err == nil || err.Error() != "1 of 2 alert rules failed to evaluate" {
+		t.Fatalf("expected the failed rule to be reported, got %v", err)
+	}
+	if len(alerts) != 3 || alerts[2].Rule.ID != 2 {
+		t.Fatalf("expected an alert of rule 2, got %+v", alerts[2:])
+	}
+}
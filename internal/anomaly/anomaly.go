@@ -0,0 +1,207 @@
+// Package anomaly flags the actions of a project whose event rate suddenly
+// departs from its baseline, such as a tracking call lost in a deploy or a
+// client retrying in a loop. Rates are read from the aggregate tables
+// filled by the aggregator; alerts are stored, then sent to a Slack incoming
+// webhook and to a JSON webhook.
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/notify"
+)
+
+const (
+	KindSpike = "spike"
+	KindDrop  = "drop"
+)
+
+var alertsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "anomaly_alerts_total",
+		Help: "Anomaly alerts raised by kind (spike, drop)",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(alertsTotal)
+}
+
+// checkTimeout bounds a check, including the notifications it sends.
+const checkTimeout = time.Minute
+
+// Store reads the action rates and keeps the alerts.
+type Store interface {
+	ActionRates(ctx context.Context, window, baseline time.Duration) (database.Rates, error)
+	OpenAnomaly(ctx context.Context, a database.Anomaly) (database.Anomaly, bool, error)
+	ResolveAnomalies(ctx context.Context, projectID int64, actions []string) (int64, error)
+}
+
+// Detector checks the action rates at every interval.
+type Detector struct {
+	l         *slog.Logger
+	store     Store
+	window    time.Duration
+	baseline  time.Duration
+	factor    float64
+	minEvents float64
+	senders   map[string]notify.Sender
+	cron      *cron.Cron
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// New creates a detector sending alerts to the channels configured in cfg.
+func New(logger *slog.Logger, cfg config.AnomalyConfig, store Store) (*Detector, error) {
+	senders := map[string]notify.Sender{}
+	if cfg.SlackWebhookURL != "" {
+		senders["slack"] = notify.NewSlack(cfg.SlackWebhookURL)
+	}
+	if cfg.WebhookURL != "" {
+		senders["webhook"] = notify.NewWebhook(cfg.WebhookURL)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Detector{
+		l:         logger,
+		store:     store,
+		window:    time.Duration(cfg.WindowMinutes) * time.Minute,
+		baseline:  time.Duration(cfg.BaselineHours) * time.Hour,
+		factor:    float64(cfg.Factor),
+		minEvents: float64(cfg.MinEvents),
+		senders:   senders,
+		cron:      cron.New(cron.WithSeconds()),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	// The cron scheduler skips a tick while the previous check still runs
+	spec := "@every " + strconv.Itoa(cfg.CheckIntervalSeconds) + "s"
+	if _, err := d.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(d.run))); err != nil {
+		cancel()
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *Detector) run() {
+	ctx, cancel := context.WithTimeout(d.ctx, checkTimeout)
+	defer cancel()
+	if err := d.Check(ctx); err != nil && d.ctx.Err() == nil {
+		d.l.Error("anomaly check failed", "error", err)
+	}
+}
+
+// Start schedules the checks.
+func (d *Detector) Start() {
+	d.cron.Start()
+	d.l.Info("anomaly detection started", "window", d.window, "baseline", d.baseline, "channels", len(d.senders))
+}
+
+// Stop cancels the running check and waits for it, or for ctx to be done.
+func (d *Detector) Stop(ctx context.Context) error {
+	stopped := d.cron.Stop()
+	d.cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Check compares the rate of every action of every project over the window
+// with its rate over the baseline, opens an alert for each action departing
+// from it and resolves the alerts of the others, project by project.
+func (d *Detector) Check(ctx context.Context) error {
+	rates, err := d.store.ActionRates(ctx, d.window, d.baseline)
+	if err != nil {
+		return fmt.Errorf("read action rates: %w", err)
+	}
+	windowStart := rates.End.Add(-d.window)
+	// The baseline is shorter than configured until the aggregates reach
+	// back far enough, and missing before a full window is aggregated
+	span := min(windowStart.Sub(rates.BaselineStart), d.baseline)
+	if rates.End.IsZero() || span <= 0 {
+		return nil
+	}
+
+	// The actions back to normal, by project in the order of the rates
+	var projects []int64
+	normal := map[int64][]string{}
+	for _, r := range rates.Actions {
+		current := float64(r.Current)
+		expected := float64(r.Baseline) * float64(d.window) / float64(span)
+		kind := ""
+		switch {
+		case expected < d.minEvents && current < d.minEvents:
+		case current >= d.factor*expected:
+			kind = KindSpike
+		case current*d.factor <= expected:
+			kind = KindDrop
+		}
+		if kind == "" {
+			if _, ok := normal[r.ProjectID]; !ok {
+				projects = append(projects, r.ProjectID)
+			}
+			normal[r.ProjectID] = append(normal[r.ProjectID], r.Action)
+			continue
+		}
+
+		a, opened, err := d.store.OpenAnomaly(ctx, database.Anomaly{
+			ProjectID:   r.ProjectID,
+			Action:      r.Action,
+			Kind:        kind,
+			WindowStart: windowStart,
+			WindowEnd:   rates.End,
+			Current:     r.Current,
+			Expected:    expected,
+		})
+		if err != nil {
+			return fmt.Errorf("store anomaly of %s in project %d: %w", r.Action, r.ProjectID, err)
+		}
+		// Another check, possibly of another instance, already raised it
+		if !opened {
+			continue
+		}
+		alertsTotal.WithLabelValues(kind).Inc()
+		d.l.Warn("anomaly detected", "project_id", a.ProjectID, "action", a.Action, "kind", kind, "current", a.Current, "expected", expected)
+		d.notify(ctx, a)
+	}
+
+	for _, projectID := range projects {
+		n, err := d.store.ResolveAnomalies(ctx, projectID, normal[projectID])
+		if err != nil {
+			return fmt.Errorf("resolve anomalies of project %d: %w", projectID, err)
+		}
+		if n > 0 {
+			d.l.Info("anomalies resolved", "project_id", projectID, "count", n)
+		}
+	}
+	return nil
+}
+
+// notify sends the alert to every channel. A failed channel does not
+// prevent the others from receiving it.
+func (d *Detector) notify(ctx context.Context, a database.Anomaly) {
+	m := notify.Message{
+		Title: fmt.Sprintf("Event rate %s for %s in project %d", a.Kind, a.Action, a.ProjectID),
+		Text: fmt.Sprintf("%d events between %s and %s, %.0f expected from the baseline",
+			a.Current, a.WindowStart.Format(time.RFC3339), a.WindowEnd.Format(time.RFC3339), a.Expected),
+		Payload: a,
+	}
+	for channel, snd := range d.senders {
+		if err := snd.Send(ctx, m); err != nil {
+			d.l.Error("anomaly alert not sent", "channel", channel, "project_id", a.ProjectID, "action", a.Action, "error", err)
+		}
+	}
+}
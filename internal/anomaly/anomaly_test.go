@@ -0,0 +1,133 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// alertKey is an action of a project.
+type alertKey struct {
+	projectID int64
+	action    string
+}
+
+// fakeStore answers fixed rates and keeps the alerts in memory.
+type fakeStore struct {
+	rates    database.Rates
+	open     map[alertKey]database.Anomaly
+	resolved []alertKey
+}
+
+func (f *fakeStore) ActionRates(ctx context.Context, window, baseline time.Duration) (database.Rates, error) {
+	return f.rates, nil
+}
+
+func (f *fakeStore) OpenAnomaly(ctx context.Context, a database.Anomaly) (database.Anomaly, bool, error) {
+	key := alertKey{a.ProjectID, a.Action}
+	if _, ok := f.open[key]; ok {
+		return database.Anomaly{}, false, nil
+	}
+	a.ID = int64(len(f.open) + 1)
+	f.open[key] = a
+	return a, true, nil
+}
+
+func (f *fakeStore) ResolveAnomalies(ctx context.Context, projectID int64, actions []string) (int64, error) {
+	var n int64
+	for _, action := range actions {
+		key := alertKey{projectID, action}
+		if _, ok := f.open[key]; ok {
+			delete(f.open, key)
+			f.resolved = append(f.resolved, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func TestCheck(t *testing.T) {
+	var alerts []database.Anomaly
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a database.Anomaly
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Error(err)
+		}
+		alerts = append(alerts, a)
+	}))
+	defer srv.Close()
+
+	end := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	store := &fakeStore{open: map[alertKey]database.Anomaly{{1, "signup"}: {ProjectID: 1, Action: "signup"}, {2, "signup"}: {ProjectID: 2, Action: "signup"}}}
+	// 24h of baseline: 96 windows of 15 minutes, 100 events expected in each
+	store.rates = database.Rates{End: end, BaselineStart: end.Add(-24*time.Hour - 15*time.Minute), Actions: []database.ActionRate{
+		{ProjectID: 1, Action: "checkout", Current: 20, Baseline: 9600},
+		{ProjectID: 1, Action: "purchase", Current: 350, Baseline: 9600},
+		{ProjectID: 1, Action: "signup", Current: 110, Baseline: 9600},
+		{ProjectID: 1, Action: "rare", Current: 0, Baseline: 960},
+		{ProjectID: 1, Action: "view", Current: 150, Baseline: 9600},
+		// Rates are compared within each project
+		{ProjectID: 2, Action: "checkout", Current: 100, Baseline: 9600},
+		{ProjectID: 2, Action: "signup", Current: 20, Baseline: 9600},
+	}}
+
+	cfg := config.AnomalyConfig{CheckIntervalSeconds: 60, WindowMinutes: 15, BaselineHours: 24, Factor: 3, MinEvents: 50, WebhookURL: srv.URL}
+	d, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), cfg, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected 2 alerts, got %+v", alerts)
+	}
+	if a := alerts[0]; a.ProjectID != 1 || a.Action != "checkout" || a.Kind != KindDrop || a.Current != 20 || a.Expected != 100 || !a.WindowEnd.Equal(end) {
+		t.Fatalf("expected a drop of checkout, got %+v", a)
+	}
+	if a := alerts[1]; a.ProjectID != 1 || a.Action != "purchase" || a.Kind != KindSpike {
+		t.Fatalf("expected a spike of purchase, got %+v", a)
+	}
+	if !slices.Equal(store.resolved, []alertKey{{1, "signup"}}) {
+		t.Fatalf("expected the signup alert of project 1 alone to be resolved, got %v", store.resolved)
+	}
+
+	// Open alerts are not sent again
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected no new alert, got %+v", alerts[2:])
+	}
+
+	// The baseline is prorated while the aggregates are recent
+	store.open = map[alertKey]database.Anomaly{}
+	store.rates.BaselineStart = end.Add(-2*time.Hour - 15*time.Minute)
+	store.rates.Actions = []database.ActionRate{{Action: "view", Current: 100, Baseline: 800}}
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected no new alert, got %+v", alerts[2:])
+	}
+
+	// Nothing is checked before a window and some baseline are aggregated
+	store.rates.BaselineStart = end.Add(-15 * time.Minute)
+	store.rates.Actions = []database.ActionRate{{Action: "view", Current: 1000}}
+	if err := d.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 2 {
+		t.Fatalf("expected no new alert, got %+v", alerts[2:])
+	}
+}
@@ -0,0 +1,446 @@
+// Package app assembles the parts shared by cmd/api and cmd/worker: the
+// validation rules, the chain of database.Service wrappers every event is
+// stored and read through, the queue consumers and the background job
+// handlers. Both commands must store events the same way, so that a worker
+// never writes a user id in clear or skips a rule the API enforces.
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/arimatakao/simple-events-handler/internal/archive"
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/expiry"
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/amqp"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/kafka"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/nats"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/pubsub"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/redis"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/sqs"
+	"github.com/arimatakao/simple-events-handler/internal/jobs"
+	"github.com/arimatakao/simple-events-handler/internal/lifecycle"
+	"github.com/arimatakao/simple-events-handler/internal/pseudonym"
+	"github.com/arimatakao/simple-events-handler/internal/querycache"
+	"github.com/arimatakao/simple-events-handler/internal/reload"
+	"github.com/arimatakao/simple-events-handler/internal/residency"
+	"github.com/arimatakao/simple-events-handler/internal/scheduler"
+	"github.com/arimatakao/simple-events-handler/internal/schema"
+	"github.com/arimatakao/simple-events-handler/internal/server"
+	"github.com/arimatakao/simple-events-handler/internal/shard"
+)
+
+// InstallRules compiles the validation rules of cfg, applied to the events
+// of every ingestion path, and recompiles them on reload.
+func InstallRules(cfg *config.Config, reloader *reload.Reloader) error {
+	rules, err := ingest.NewRules(cfg.Validation)
+	if err != nil {
+		return err
+	}
+	ingest.SetRules(rules)
+	reloader.Register("validation rules", func(cfg *config.Config) error {
+		rules, err := ingest.NewRules(cfg.Validation)
+		if err != nil {
+			return err
+		}
+		ingest.SetRules(rules)
+		return nil
+	})
+	return nil
+}
+
+// Storage holds the databases of the events and the wrappers of DB.
+type Storage struct {
+	// DB is the outermost wrapper: every ingestion path stores its events
+	// through it.
+	DB database.Service
+	// Events counts and deletes the events of every shard or region, by
+	// pseudonymized user id when the user ids are.
+	Events database.EventMaintainer
+	// Shards hold the events when set; the other tables stay in Primary.
+	Primary database.Service
+	Shards  []*database.Pool
+	// Regions hold the events of the projects of DB_PROJECT_REGIONS when
+	// set, by name; the events of the other projects stay in Primary.
+	Regions map[string]*database.Pool
+	// Batcher, Breaker, Redis and Cache are set when configured.
+	Batcher *database.InsertBatcher
+	Breaker database.Service
+	Redis   *goredis.Client
+	Cache   *querycache.Cache
+	// Cipher encrypts the metadata when configured. The stores reading the
+	// events past DB, like the sinks and the exports, decrypt with it.
+	Cipher *fieldcrypt.Cipher
+}
+
+// OpenStorage opens the pools of cfg, which connect lazily, and wraps them
+// in order: insert batching, slow query logging, circuit breaker,
+// pseudonymization, metadata encryption, schema upgrades, metrics and the
+// query cache. The schema versions are re-read on reload.
+func OpenStorage(logger *slog.Logger, cfg *config.Config, reloader *reload.Reloader) (*Storage, error) {
+	s := &Storage{Primary: database.Open()}
+	database.RegisterPoolStats(cfg.DB.Database)
+	db := s.Primary
+	// Events spread across databases by user; the other tables stay in
+	// the main one
+	events := database.EventMaintainer(database.NewEventStore())
+	if len(cfg.DB.Shards) > 0 {
+		services := make([]database.Service, len(cfg.DB.Shards))
+		stores := make([]database.EventMaintainer, len(cfg.DB.Shards))
+		for i, url := range cfg.DB.Shards {
+			pool, err := database.OpenURL(url)
+			if err != nil {
+				return nil, fmt.Errorf("open shard %d: %w", i, err)
+			}
+			pool.RegisterStats(fmt.Sprintf("shard_%d", i))
+			s.Shards = append(s.Shards, pool)
+			services[i], stores[i] = pool, pool.EventStore()
+		}
+		db = shard.New(services)
+		events = shard.NewEventStore(stores)
+	}
+	// Or the events of some projects stay in the database of their region
+	if len(cfg.DB.Regions) > 0 {
+		s.Regions = map[string]*database.Pool{}
+		services := map[string]database.Service{}
+		stores := map[string]database.EventMaintainer{}
+		for name, url := range cfg.DB.Regions {
+			pool, err := database.OpenURL(url)
+			if err != nil {
+				return nil, fmt.Errorf("open region %s: %w", name, err)
+			}
+			pool.RegisterStats("region_" + name)
+			s.Regions[name] = pool
+			services[name], stores[name] = pool, pool.EventStore()
+		}
+		projects := map[int64]string{}
+		for project, region := range cfg.DB.ProjectRegions {
+			id, err := strconv.ParseInt(project, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid project id %q: %w", project, err)
+			}
+			projects[id] = region
+		}
+		router, err := residency.New(db, services, projects)
+		if err != nil {
+			return nil, err
+		}
+		db = router
+		events = residency.NewEventStore(router, events, stores)
+	}
+	// Innermost, so that the events it batches are already pseudonymized
+	// and encrypted
+	if cfg.DB.InsertBatchWindowMillis > 0 {
+		s.Batcher = database.NewInsertBatcher(time.Duration(cfg.DB.InsertBatchWindowMillis)*time.Millisecond, cfg.DB.InsertBatchSize)
+		db = s.Batcher
+	}
+	if cfg.DB.SlowQueryMillis > 0 {
+		db = database.NewSlowQueryLogger(db, logger, time.Duration(cfg.DB.SlowQueryMillis)*time.Millisecond)
+	}
+	if cfg.DB.BreakerFailureThreshold > 0 {
+		s.Breaker = database.NewCircuitBreaker(db, cfg.DB.BreakerFailureThreshold, time.Duration(cfg.DB.BreakerOpenSeconds)*time.Second)
+		db = s.Breaker
+	}
+	// Every writer goes through db, so no user id is stored in clear
+	s.Events = events
+	if secrets := cfg.Privacy.PseudonymizeSecrets; len(secrets) > 0 {
+		pseudonyms := pseudonym.New(secrets)
+		db = database.NewPseudonymizer(db, pseudonyms)
+		s.Events = database.NewPseudonymEventStore(events, pseudonyms)
+	}
+	metadataCipher, err := fieldcrypt.Load(context.Background(), cfg.Privacy)
+	if err != nil {
+		return nil, fmt.Errorf("load the metadata encryption key: %w", err)
+	}
+	if metadataCipher != nil {
+		db = database.NewMetadataEncryptor(db, metadataCipher)
+		s.Cipher = metadataCipher
+	}
+	// Outside the decryption, so that default pages are never decrypted
+	if cfg.Validation.UpgradeSchemaOnRead {
+		upgrader := schema.NewUpgrader(db, schema.NewRegistry(cfg.Validation.SchemaVersions))
+		db = upgrader
+		reloader.Register("schema versions", func(cfg *config.Config) error {
+			upgrader.Set(schema.NewRegistry(cfg.Validation.SchemaVersions))
+			return nil
+		})
+	}
+	// Every ingestion path stores its events through db from here on
+	db = ingest.NewInstrumented(db)
+	// State shared by the instances: query results and quota counters
+	if cfg.QueryCache.Redis || cfg.Quotas.Redis {
+		opts, err := goredis.ParseURL(cfg.Redis.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+		}
+		s.Redis = goredis.NewClient(opts)
+	}
+
+	// Outermost, so that cached results are decrypted and every insert
+	// drops the results it changes
+	if cfg.QueryCache.Enabled() {
+		ttl := time.Duration(cfg.QueryCache.TTLSeconds) * time.Second
+		if cfg.QueryCache.Redis {
+			s.Cache = querycache.NewShared(db, s.Redis, ttl)
+		} else {
+			s.Cache = querycache.New(db, ttl, cfg.QueryCache.Size)
+		}
+		db = s.Cache
+		s.Events = s.Cache.EventStore(s.Events)
+	}
+	s.DB = db
+	return s, nil
+}
+
+// WaitForConnection waits up to wait for the main database and then for
+// every shard and region to accept connections.
+func (s *Storage) WaitForConnection(ctx context.Context, logger *slog.Logger, wait time.Duration) error {
+	if err := database.WaitForConnection(ctx, logger, wait); err != nil {
+		return err
+	}
+	for i, pool := range s.Shards {
+		if err := pool.WaitForConnection(ctx, logger, wait); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Regions)) {
+		if err := s.Regions[name].WaitForConnection(ctx, logger, wait); err != nil {
+			return fmt.Errorf("region %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// DeepCheckers check the schema of the main database, of the shards and of
+// the regions.
+func (s *Storage) DeepCheckers() []server.DeepChecker {
+	checkers := []server.DeepChecker{database.NewSchemaChecker()}
+	for i, pool := range s.Shards {
+		checkers = append(checkers, pool.SchemaChecker(fmt.Sprintf("shard_%d", i)))
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Regions)) {
+		checkers = append(checkers, s.Regions[name].SchemaChecker("region_"+name))
+	}
+	return checkers
+}
+
+// AddShutdown adds the stages flushing the insert batches and closing
+// Redis and the databases, each bounded by timeout, to lc. They come last.
+func (s *Storage) AddShutdown(lc *lifecycle.Manager, timeout time.Duration) {
+	if s.Batcher != nil {
+		lc.Add("insert batcher", timeout, s.Batcher.Stop)
+	}
+	if s.Redis != nil {
+		lc.Add("redis", timeout, func(ctx context.Context) error {
+			return s.Redis.Close()
+		})
+	}
+	lc.Add("database", timeout, func(ctx context.Context) error {
+		if len(s.Shards) > 0 {
+			return errors.Join(s.DB.Close(), s.Primary.Close())
+		}
+		return s.DB.Close()
+	})
+}
+
+// ScheduledStores are the pending events of each database holding events.
+func (s *Storage) ScheduledStores() []scheduler.Store {
+	var stores []scheduler.Store
+	if len(s.Shards) == 0 {
+		stores = []scheduler.Store{database.NewScheduledStore()}
+		for _, name := range slices.Sorted(maps.Keys(s.Regions)) {
+			stores = append(stores, s.Regions[name].ScheduledStore())
+		}
+	} else {
+		for _, pool := range s.Shards {
+			stores = append(stores, pool.ScheduledStore())
+		}
+	}
+	if s.Cache != nil {
+		for i, store := range stores {
+			stores[i] = flushingScheduler{Store: store, cache: s.Cache}
+		}
+	}
+	return stores
+}
+
+// flushingScheduler drops every cached result once due events are
+// delivered, which may be of any project.
+type flushingScheduler struct {
+	scheduler.Store
+	cache *querycache.Cache
+}
+
+func (d flushingScheduler) DeliverEvents(ctx context.Context, now time.Time, limit int) (int64, error) {
+	n, err := d.Store.DeliverEvents(ctx, now, limit)
+	if n > 0 {
+		d.cache.Flush(ctx, nil)
+	}
+	return n, err
+}
+
+// ArchiveStore moves the old events of the main database to its archive.
+func (s *Storage) ArchiveStore() archive.Store {
+	var store archive.Store = database.NewArchiveStore()
+	if s.Cache != nil {
+		store = flushingArchive{Store: store, cache: s.Cache}
+	}
+	return store
+}
+
+// flushingArchive drops every cached result once events are archived, which
+// may be of any project.
+type flushingArchive struct {
+	archive.Store
+	cache *querycache.Cache
+}
+
+func (a flushingArchive) ArchiveEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	n, err := a.Store.ArchiveEvents(ctx, before, limit)
+	if n > 0 {
+		a.cache.Flush(ctx, nil)
+	}
+	return n, err
+}
+
+// SnapshotStore snapshots and restores the events of the main database.
+func (s *Storage) SnapshotStore() server.Snapshots {
+	var store server.Snapshots = database.NewSnapshotStore().WithCipher(s.Cipher)
+	if s.Cache != nil {
+		store = flushingSnapshots{Snapshots: store, cache: s.Cache}
+	}
+	return store
+}
+
+// flushingSnapshots drops every cached result after a restore, which may
+// write events of any project, even when it fails part way.
+type flushingSnapshots struct {
+	server.Snapshots
+	cache *querycache.Cache
+}
+
+func (r flushingSnapshots) Restore(ctx context.Context, next func() (database.SnapshotRecord, error)) (database.RestoreResult, error) {
+	res, err := r.Snapshots.Restore(ctx, next)
+	r.cache.Flush(ctx, nil)
+	return res, err
+}
+
+// ExpiryStores are the events of each database holding events.
+func (s *Storage) ExpiryStores() []expiry.Store {
+	var stores []expiry.Store
+	if len(s.Shards) == 0 {
+		stores = []expiry.Store{database.NewEventStore()}
+		for _, name := range slices.Sorted(maps.Keys(s.Regions)) {
+			stores = append(stores, s.Regions[name].EventStore())
+		}
+	} else {
+		for _, pool := range s.Shards {
+			stores = append(stores, pool.EventStore())
+		}
+	}
+	if s.Cache != nil {
+		for i, store := range stores {
+			stores[i] = flushingExpiry{Store: store, cache: s.Cache}
+		}
+	}
+	return stores
+}
+
+// flushingExpiry drops every cached result once expired events are
+// deleted, which may be of any project.
+type flushingExpiry struct {
+	expiry.Store
+	cache *querycache.Cache
+}
+
+func (e flushingExpiry) DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error) {
+	n, err := e.Store.DeleteExpired(ctx, now, limit)
+	if n > 0 {
+		e.cache.Flush(ctx, nil)
+	}
+	return n, err
+}
+
+// JobHandlers are the kinds of background jobs run on s. The hourly
+// aggregates are backfilled, actions renamed and the dual write verified in
+// the main database only, so not with shards or regions.
+func (s *Storage) JobHandlers() map[string]jobs.Handler {
+	handlers := map[string]jobs.Handler{
+		jobs.KindExport:    jobs.NewExporter(s.DB, s.Events),
+		jobs.KindEraseUser: jobs.NewEraser(s.Events),
+	}
+	if len(s.Shards) == 0 && len(s.Regions) == 0 {
+		handlers[jobs.KindBackfill] = jobs.NewBackfiller(database.NewBackfillStore())
+		var renames jobs.ActionRenamer = database.NewRenameStore()
+		if s.Cache != nil {
+			renames = flushingRenamer{ActionRenamer: renames, cache: s.Cache}
+		}
+		handlers[jobs.KindRename] = jobs.NewRenamer(renames)
+		handlers[jobs.KindDualWrite] = jobs.NewDualWriteVerifier(database.NewDualWriteStore())
+	}
+	return handlers
+}
+
+// flushingRenamer drops the cached results of the projects whose actions
+// it renames.
+type flushingRenamer struct {
+	jobs.ActionRenamer
+	cache *querycache.Cache
+}
+
+func (r flushingRenamer) RenameActions(ctx context.Context, projectID int64, from, to string, limit int) (int64, error) {
+	n, err := r.ActionRenamer.RenameActions(ctx, projectID, from, to, limit)
+	if n > 0 || err != nil {
+		r.cache.Flush(ctx, &projectID)
+	}
+	return n, err
+}
+
+// Sources are the queue consumers of cfg, feeding db like POST /events,
+// by name.
+func Sources(logger *slog.Logger, cfg *config.Config, db database.Service) (map[string]ingest.Source, error) {
+	sources := map[string]ingest.Source{}
+	var err error
+	if cfg.Ingest.Kafka.Enabled() {
+		if sources["kafka consumer"], err = kafka.New(logger, cfg.Ingest.Kafka, db); err != nil {
+			return nil, fmt.Errorf("create kafka consumer: %w", err)
+		}
+	}
+	if cfg.Ingest.NATS.Enabled() {
+		if sources["nats consumer"], err = nats.New(logger, cfg.Ingest.NATS, db); err != nil {
+			return nil, fmt.Errorf("create nats consumer: %w", err)
+		}
+	}
+	if cfg.Ingest.AMQP.Enabled() {
+		if sources["rabbitmq consumer"], err = amqp.New(logger, cfg.Ingest.AMQP, db); err != nil {
+			return nil, fmt.Errorf("create rabbitmq consumer: %w", err)
+		}
+	}
+	if cfg.Ingest.SQS.Enabled() {
+		if sources["sqs consumer"], err = sqs.New(logger, cfg.Ingest.SQS, db); err != nil {
+			return nil, fmt.Errorf("create sqs consumer: %w", err)
+		}
+	}
+	if cfg.Ingest.PubSub.Enabled() {
+		if sources["pubsub consumer"], err = pubsub.New(logger, cfg.Ingest.PubSub, db); err != nil {
+			return nil, fmt.Errorf("create pubsub consumer: %w", err)
+		}
+	}
+	if cfg.Ingest.Redis.Enabled() {
+		if sources["redis stream consumer"], err = redis.New(logger, cfg.Redis, cfg.Ingest.Redis, db); err != nil {
+			return nil, fmt.Errorf("create redis stream consumer: %w", err)
+		}
+	}
+	return sources, nil
+}
@@ -0,0 +1,115 @@
+// Package archive moves the events older than ARCHIVE_AFTER_DAYS from the
+// events table to events_archive, indexed by a BRIN index on the creation
+// time only, so that the hot table and its indexes stay small.
+// GET /events reads the archived events with include_archive=true.
+package archive
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+var archivedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "events_archived_total",
+	Help: "Events moved to events_archive",
+})
+
+func init() {
+	prometheus.MustRegister(archivedTotal)
+}
+
+// Store moves events to the archive, a batch at a time.
+type Store interface {
+	ArchiveEvents(ctx context.Context, before time.Time, limit int) (int64, error)
+}
+
+// Archiver archives the old events at every interval.
+type Archiver struct {
+	l         *slog.Logger
+	store     Store
+	after     time.Duration
+	batchSize int
+	interval  int
+	now       func() time.Time
+	cron      *cron.Cron
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// New creates an archiver of the events older than cfg.AfterDays.
+func New(logger *slog.Logger, cfg config.ArchiveConfig, store Store) (*Archiver, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &Archiver{
+		l:         logger,
+		store:     store,
+		after:     time.Duration(cfg.AfterDays) * 24 * time.Hour,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.IntervalMinutes,
+		now:       time.Now,
+		cron:      cron.New(cron.WithSeconds()),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	// The cron scheduler skips a tick while the previous run still archives
+	spec := "@every " + strconv.Itoa(cfg.IntervalMinutes) + "m"
+	if _, err := a.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(a.run))); err != nil {
+		cancel()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *Archiver) run() {
+	n, err := a.Archive(a.ctx)
+	if err != nil && a.ctx.Err() == nil {
+		a.l.Error("events archival failed", "archived", n, "error", err)
+		return
+	}
+	if n > 0 {
+		a.l.Info("events archived", "archived", n)
+	}
+}
+
+// Start schedules the archival.
+func (a *Archiver) Start() {
+	a.cron.Start()
+	a.l.Info("events archival started", "after_days", int(a.after.Hours()/24), "interval_minutes", a.interval)
+}
+
+// Stop cancels the running archival, whose current batch is rolled back,
+// and waits for it, or for ctx to be done.
+func (a *Archiver) Stop(ctx context.Context) error {
+	stopped := a.cron.Stop()
+	a.cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Archive moves every event older than the configured age, in batches, and
+// returns how many were moved.
+func (a *Archiver) Archive(ctx context.Context) (int64, error) {
+	before := a.now().Add(-a.after)
+	var total int64
+	for {
+		n, err := a.store.ArchiveEvents(ctx, before, a.batchSize)
+		total += n
+		archivedTotal.Add(float64(n))
+		if err != nil {
+			return total, err
+		}
+		if n < int64(a.batchSize) {
+			return total, nil
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// fakeStore holds events created at the given times and fails once failAt
+// batches were moved, when set.
+type fakeStore struct {
+	events  []time.Time
+	batches int
+	failAt  int
+}
+
+func (f *fakeStore) ArchiveEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	if f.failAt > 0 && f.batches == f.failAt {
+		return 0, errors.New("canceling statement due to statement timeout")
+	}
+	f.batches++
+	var kept []time.Time
+	var moved int64
+	for _, t := range f.events {
+		if t.Before(before) && moved < int64(limit) {
+			moved++
+			continue
+		}
+		kept = append(kept, t)
+	}
+	f.events = kept
+	return moved, nil
+}
+
+func TestArchive(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	old := now.Add(-31 * 24 * time.Hour)
+	recent := now.Add(-29 * 24 * time.Hour)
+
+	tests := []struct {
+		name          string
+		events        []time.Time
+		failAt        int
+		expectMoved   int64
+		expectBatches int
+		expectKept    int
+		expectErr     bool
+	}{
+		{name: "nothing to archive", events: []time.Time{recent}, expectBatches: 1, expectKept: 1},
+		{name: "partial batch", events: []time.Time{old, recent}, expectMoved: 1, expectBatches: 1, expectKept: 1},
+		{name: "every batch until a partial one", events: []time.Time{old, old, old, old, old, recent}, expectMoved: 5, expectBatches: 3, expectKept: 1},
+		{name: "full batches end with an empty one", events: []time.Time{old, old, old, old}, expectMoved: 4, expectBatches: 3},
+		{name: "failed batch keeps the moved events", events: []time.Time{old, old, old, old, old}, failAt: 1, expectMoved: 2, expectBatches: 1, expectKept: 3, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeStore{events: tt.events, failAt: tt.failAt}
+			a, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.ArchiveConfig{AfterDays: 30, IntervalMinutes: 60, BatchSize: 2}, store)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.now = func() time.Time { return now }
+
+			moved, err := a.Archive(context.Background())
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if moved != tt.expectMoved || store.batches != tt.expectBatches || len(store.events) != tt.expectKept {
+				t.Fatalf("expected %d moved in %d batches and %d kept, got %d in %d and %d", tt.expectMoved, tt.expectBatches, tt.expectKept, moved, store.batches, len(store.events))
+			}
+		})
+	}
+}
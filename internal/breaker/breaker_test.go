@@ -0,0 +1,97 @@
+package breaker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	var transitions []State
+	b := New(2, time.Minute, func(s State) { transitions = append(transitions, s) })
+
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	boom := errors.New("boom")
+	fail := func() error { return boom }
+	ok := func() error { return nil }
+
+	// cancellations and deadlines don't count
+	if err := b.Do(func() error { return context.Canceled }); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+	if err := b.Do(func() error { return context.DeadlineExceeded }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if err := b.Do(func() error { return context.DeadlineExceeded }); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline error, got %v", err)
+	}
+	if b.State() != StateClosed {
+		t.Fatalf("expected closed after deadlines, got %s", b.State())
+	}
+	if err := b.Do(fail); !errors.Is(err, boom) {
+		t.Fatalf("expected boom, got %v", err)
+	}
+	if b.State() != StateClosed {
+		t.Fatalf("expected closed after one failure, got %s", b.State())
+	}
+	_ = b.Do(fail)
+	if b.State() != StateOpen {
+		t.Fatalf("expected open after threshold, got %s", b.State())
+	}
+
+	called := false
+	if err := b.Do(func() error { called = true; return nil }); !errors.Is(err, ErrOpen) || called {
+		t.Fatalf("expected fast failure while open, got %v (called=%v)", err, called)
+	}
+
+	// after the cooldown a failing probe opens the breaker again
+	now = now.Add(time.Minute)
+	if err := b.Do(fail); !errors.Is(err, boom) {
+		t.Fatalf("expected probe to run, got %v", err)
+	}
+	if b.State() != StateOpen {
+		t.Fatalf("expected open after failed probe, got %s", b.State())
+	}
+
+	// a successful probe closes it
+	now = now.Add(time.Minute)
+	if err := b.Do(ok); err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+	if b.State() != StateClosed {
+		t.Fatalf("expected closed after successful probe, got %s", b.State())
+	}
+
+	expected := []State{StateOpen, StateHalfOpen, StateOpen, StateHalfOpen, StateClosed}
+	if len(transitions) != len(expected) {
+		t.Fatalf("expected transitions %v got %v", expected, transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Fatalf("expected transitions %v got %v", expected, transitions)
+		}
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := New(1, time.Minute, nil)
+	now := time.Now()
+	b.now = func() time.Time { return now }
+
+	_ = b.Do(func() error { return errors.New("boom") })
+	now = now.Add(time.Minute)
+
+	// while the probe is in flight other calls fail fast
+	err := b.Do(func() error {
+		if err := b.Do(func() error { return nil }); !errors.Is(err, ErrOpen) {
+			t.Errorf("expected concurrent call to fail fast, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected probe to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,2242 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the application. Values are loaded from
+// defaults, then an optional YAML/TOML file, then environment variables.
+type Config struct {
+	Server      ServerConfig         `yaml:"server" toml:"server"`
+	TLS         TLSConfig            `yaml:"tls" toml:"tls"`
+	Admin       AdminConfig          `yaml:"admin" toml:"admin"`
+	Worker      WorkerConfig         `yaml:"worker" toml:"worker"`
+	Auth        AuthConfig           `yaml:"auth" toml:"auth"`
+	Quotas      QuotaConfig          `yaml:"quotas" toml:"quotas"`
+	Privacy     PrivacyConfig        `yaml:"privacy" toml:"privacy"`
+	CORS        CORSConfig           `yaml:"cors" toml:"cors"`
+	DB          DBConfig             `yaml:"db" toml:"db"`
+	QueryCache  QueryCacheConfig     `yaml:"query_cache" toml:"query_cache"`
+	Aggregation AggregationConfig    `yaml:"aggregation" toml:"aggregation"`
+	Sessions    SessionsConfig       `yaml:"sessions" toml:"sessions"`
+	Ingest      IngestConfig         `yaml:"ingest" toml:"ingest"`
+	Validation  ValidationConfig     `yaml:"validation" toml:"validation"`
+	UserCheck   UserCheckConfig      `yaml:"user_check" toml:"user_check"`
+	Redis       RedisConfig          `yaml:"redis" toml:"redis"`
+	Spool       SpoolConfig          `yaml:"spool" toml:"spool"`
+	DeadLetter  DeadLetterConfig     `yaml:"dead_letter" toml:"dead_letter"`
+	Import      ImportConfig         `yaml:"import" toml:"import"`
+	Jobs        JobsConfig           `yaml:"jobs" toml:"jobs"`
+	Export      ExportConfig         `yaml:"export" toml:"export"`
+	Sinks       SinksConfig          `yaml:"sinks" toml:"sinks"`
+	Federation  FederationConfig     `yaml:"federation" toml:"federation"`
+	Reports     ReportsConfig        `yaml:"reports" toml:"reports"`
+	Anomaly     AnomalyConfig        `yaml:"anomaly" toml:"anomaly"`
+	Alerts      AlertsConfig         `yaml:"alerts" toml:"alerts"`
+	Flags       FeatureFlagsConfig   `yaml:"feature_flags" toml:"feature_flags"`
+	Archive     ArchiveConfig        `yaml:"archive" toml:"archive"`
+	Scheduled   ScheduledConfig      `yaml:"scheduled_events" toml:"scheduled_events"`
+	TTL         TTLConfig            `yaml:"event_ttl" toml:"event_ttl"`
+	Reporting   ErrorReportingConfig `yaml:"reporting" toml:"reporting"`
+	Shutdown    ShutdownConfig       `yaml:"shutdown" toml:"shutdown"`
+	Log         LogConfig            `yaml:"log" toml:"log"`
+	Debug       DebugConfig          `yaml:"debug" toml:"debug"`
+
+	// Webhooks configures POST /webhooks/:provider, keyed by provider name.
+	Webhooks map[string]WebhookConfig `yaml:"webhooks" toml:"webhooks"`
+}
+
+type ServerConfig struct {
+	Port                int    `yaml:"port" toml:"port"`
+	BasePath            string `yaml:"base_path" toml:"base_path"`
+	IdleTimeoutSeconds  int    `yaml:"idle_timeout_seconds" toml:"idle_timeout_seconds"`
+	ReadTimeoutSeconds  int    `yaml:"read_timeout_seconds" toml:"read_timeout_seconds"`
+	WriteTimeoutSeconds int    `yaml:"write_timeout_seconds" toml:"write_timeout_seconds"`
+
+	// Per route group deadlines applied to the request context. They must be
+	// shorter than WriteTimeoutSeconds so that a timeout response can still
+	// be written.
+	IngestRequestTimeoutSeconds int `yaml:"ingest_request_timeout_seconds" toml:"ingest_request_timeout_seconds"`
+	QueryRequestTimeoutSeconds  int `yaml:"query_request_timeout_seconds" toml:"query_request_timeout_seconds"`
+
+	// MaxInFlightRequests caps concurrently served API requests; requests
+	// above the cap are rejected with 503 instead of queueing. 0 disables it.
+	MaxInFlightRequests int `yaml:"max_in_flight_requests" toml:"max_in_flight_requests"`
+	// ShedRetryAfterSeconds is sent in the Retry-After header of shed requests.
+	ShedRetryAfterSeconds int `yaml:"shed_retry_after_seconds" toml:"shed_retry_after_seconds"`
+
+	// AllowCIDRs, when set, restricts the API to clients in these networks.
+	// DenyCIDRs rejects clients in these networks and wins over AllowCIDRs.
+	AllowCIDRs []string `yaml:"allow_cidrs" toml:"allow_cidrs"`
+	DenyCIDRs  []string `yaml:"deny_cidrs" toml:"deny_cidrs"`
+	// TrustedProxies are the networks of the load balancers whose
+	// X-Forwarded-For header is trusted for the client address. Without them
+	// the address of the connection is used.
+	TrustedProxies []string `yaml:"trusted_proxies" toml:"trusted_proxies"`
+
+	// StrictTimeParsing accepts only RFC3339 times in GET /events, instead
+	// of guessing among several layouts and escapings.
+	StrictTimeParsing bool `yaml:"strict_time_parsing" toml:"strict_time_parsing"`
+	// DefaultEventsLimit bounds the events returned by GET /events when the
+	// request sets no limit; MaxEventsLimit bounds the limit it may set.
+	// limit=0, every event, is only served on the admin listener, within
+	// EventsExportTimeoutSeconds.
+	DefaultEventsLimit         int `yaml:"default_events_limit" toml:"default_events_limit"`
+	MaxEventsLimit             int `yaml:"max_events_limit" toml:"max_events_limit"`
+	EventsExportTimeoutSeconds int `yaml:"events_export_timeout_seconds" toml:"events_export_timeout_seconds"`
+	// EventsFlushIntervalMillis is how often the events of GET /events are
+	// sent to the client while they are read; 0 sends them only when the
+	// response buffer is full.
+	EventsFlushIntervalMillis int `yaml:"events_flush_interval_ms" toml:"events_flush_interval_ms"`
+	// StrictJSON rejects the JSON bodies holding fields the endpoint does
+	// not know, e.g. userid instead of user_id, instead of ignoring them.
+	StrictJSON bool `yaml:"strict_json" toml:"strict_json"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// RedirectPort, when set, starts a plain HTTP listener that redirects
+	// every request to the HTTPS port.
+	RedirectPort int `yaml:"redirect_port" toml:"redirect_port"`
+
+	// ACMEDomains enables automatic certificates (Let's Encrypt) for the
+	// listed domains. It takes the place of CertFile and KeyFile.
+	ACMEDomains  []string `yaml:"acme_domains" toml:"acme_domains"`
+	ACMECacheDir string   `yaml:"acme_cache_dir" toml:"acme_cache_dir"`
+	ACMEEmail    string   `yaml:"acme_email" toml:"acme_email"`
+}
+
+// Enabled reports whether the server should terminate TLS itself.
+func (t TLSConfig) Enabled() bool {
+	return t.HasStaticCert() || t.ACMEEnabled()
+}
+
+// HasStaticCert reports whether a certificate and key file are configured.
+func (t TLSConfig) HasStaticCert() bool {
+	return t.CertFile != "" && t.KeyFile != ""
+}
+
+// ACMEEnabled reports whether certificates are obtained automatically.
+func (t TLSConfig) ACMEEnabled() bool {
+	return len(t.ACMEDomains) > 0
+}
+
+// AdminConfig describes the internal listener serving operational
+// endpoints (metrics, health, profiling). It should not be exposed publicly.
+type AdminConfig struct {
+	Port int `yaml:"port" toml:"port"`
+	// Token, when set, is required as a bearer token by the admin endpoints
+	// that change state or expose internals (everything except metrics and
+	// health, which are scraped by infrastructure).
+	Token string `yaml:"token" toml:"token"`
+
+	// AllowCIDRs and DenyCIDRs restrict the admin listener like the ones of
+	// ServerConfig restrict the API, health and metrics included.
+	AllowCIDRs []string `yaml:"allow_cidrs" toml:"allow_cidrs"`
+	DenyCIDRs  []string `yaml:"deny_cidrs" toml:"deny_cidrs"`
+}
+
+// WorkerConfig describes cmd/worker, which runs the queue consumers, the
+// sinks and the scheduled and background jobs apart from the API. Separate
+// stops cmd/api from running them, once workers are deployed. Port is the
+// listener of the metrics and health of the worker, protected by the admin
+// token and CIDRs.
+type WorkerConfig struct {
+	Separate bool `yaml:"separate" toml:"separate"`
+	Port     int  `yaml:"port" toml:"port"`
+}
+
+// AuthConfig controls the project API keys of the public API.
+type AuthConfig struct {
+	// RequireAPIKey rejects requests without an API key. Otherwise they are
+	// served as the default project, while requests with a key are still
+	// limited to its project.
+	RequireAPIKey bool `yaml:"require_api_key" toml:"require_api_key"`
+
+	// SigningSecrets verify the X-Signature header of POST /events and
+	// POST /events/batch; signatures made with any of them are accepted, so
+	// that a secret can be rotated. Signed requests are always verified,
+	// RequireSignature also rejects unsigned ones.
+	SigningSecrets   []string `yaml:"signing_secrets" toml:"signing_secrets"`
+	RequireSignature bool     `yaml:"require_signature" toml:"require_signature"`
+	// SignatureWindowSeconds bounds the difference between the timestamp of
+	// a signature and the server clock.
+	SignatureWindowSeconds int `yaml:"signature_window_seconds" toml:"signature_window_seconds"`
+}
+
+// QuotaConfig limits what each API key may do per UTC day and month; 0
+// means unlimited. Usage is counted in memory and shared with the other
+// instances through the database every FlushIntervalSeconds, so quotas are
+// enforced with that much lag, unless Redis is set: usage is then also
+// counted in Redis, where every instance sees it at once.
+type QuotaConfig struct {
+	DailyEvents          int  `yaml:"daily_events" toml:"daily_events"`
+	MonthlyEvents        int  `yaml:"monthly_events" toml:"monthly_events"`
+	DailyQueries         int  `yaml:"daily_queries" toml:"daily_queries"`
+	MonthlyQueries       int  `yaml:"monthly_queries" toml:"monthly_queries"`
+	FlushIntervalSeconds int  `yaml:"flush_interval_seconds" toml:"flush_interval_seconds"`
+	Redis                bool `yaml:"redis" toml:"redis"`
+}
+
+// PrivacyConfig controls how user identifiers are stored.
+type PrivacyConfig struct {
+	// PseudonymizeSecrets, when set, replaces every user_id with an HMAC of
+	// it before storage. The first secret hashes new events; the others are
+	// previous secrets, still used to look up the events they hashed.
+	PseudonymizeSecrets []string `yaml:"pseudonymize_secrets" toml:"pseudonymize_secrets"`
+
+	// MetadataKey, when set, encrypts the metadata of events with AES-256-GCM
+	// before storage. It is the base64 of a 32 bytes key.
+	MetadataKey string `yaml:"metadata_key" toml:"metadata_key"`
+	// MetadataKMSKey is the alternative to MetadataKey for envelope
+	// encryption: the base64 ciphertext of the data key, decrypted with AWS
+	// KMS at startup.
+	MetadataKMSKey string `yaml:"metadata_kms_key" toml:"metadata_kms_key"`
+	KMSRegion      string `yaml:"kms_region" toml:"kms_region"`
+	// KMSEndpoint overrides the AWS endpoint, e.g. for LocalStack.
+	KMSEndpoint string `yaml:"kms_endpoint" toml:"kms_endpoint"`
+}
+
+type CORSConfig struct {
+	AllowOrigins     []string `yaml:"allow_origins" toml:"allow_origins"`
+	AllowMethods     []string `yaml:"allow_methods" toml:"allow_methods"`
+	AllowHeaders     []string `yaml:"allow_headers" toml:"allow_headers"`
+	AllowCredentials bool     `yaml:"allow_credentials" toml:"allow_credentials"`
+}
+
+type DBConfig struct {
+	Host     string `yaml:"host" toml:"host"`
+	Port     int    `yaml:"port" toml:"port"`
+	Database string `yaml:"database" toml:"database"`
+	Username string `yaml:"username" toml:"username"`
+	Password string `yaml:"password" toml:"password"`
+	Schema   string `yaml:"schema" toml:"schema"`
+
+	// BreakerFailureThreshold consecutive failures open the circuit breaker
+	// for BreakerOpenSeconds. A zero threshold disables the breaker.
+	BreakerFailureThreshold int `yaml:"breaker_failure_threshold" toml:"breaker_failure_threshold"`
+	BreakerOpenSeconds      int `yaml:"breaker_open_seconds" toml:"breaker_open_seconds"`
+
+	// StartupWaitSeconds bounds how long startup waits for Postgres to
+	// accept connections. Zero makes a single attempt.
+	StartupWaitSeconds int `yaml:"startup_wait_seconds" toml:"startup_wait_seconds"`
+
+	// InsertBatchWindowMillis coalesces the single-event inserts made
+	// within that many milliseconds into one statement of up to
+	// InsertBatchSize events. Zero disables it.
+	InsertBatchWindowMillis int `yaml:"insert_batch_window_millis" toml:"insert_batch_window_millis"`
+	InsertBatchSize         int `yaml:"insert_batch_size" toml:"insert_batch_size"`
+
+	// SlowQueryMillis logs the operations taking at least that many
+	// milliseconds. Zero disables it.
+	SlowQueryMillis int `yaml:"slow_query_millis" toml:"slow_query_millis"`
+
+	// Shards are the Postgres URLs of the databases the events are spread
+	// across by hash of user_id. Empty keeps the events in the database
+	// above.
+	Shards []string `yaml:"shards" toml:"shards"`
+
+	// Regions are the Postgres URLs of the databases holding the events of
+	// the projects of ProjectRegions, by region name, e.g. for data that
+	// must stay in a country. The events of the other projects stay in the
+	// database above.
+	Regions map[string]string `yaml:"regions" toml:"regions"`
+	// ProjectRegions maps project ids to the region of their events.
+	ProjectRegions map[string]string `yaml:"project_regions" toml:"project_regions"`
+
+	Timescale TimescaleConfig `yaml:"timescale" toml:"timescale"`
+
+	// Cockroach selects the CockroachDB compatibility mode, for a database
+	// created with other/init_tables_cockroach.sql.
+	Cockroach bool `yaml:"cockroach" toml:"cockroach"`
+}
+
+// SpreadsEvents reports whether events are stored outside the database
+// above, in shards or regions, so that the features reading the events of
+// that database alone are unavailable.
+func (d DBConfig) SpreadsEvents() bool {
+	return len(d.Shards) > 0 || len(d.Regions) > 0
+}
+
+// TimescaleConfig selects the TimescaleDB mode, for a database migrated
+// with other/timescale.sql: events is a hypertable of ChunkIntervalHours
+// chunks, compressed once older than CompressAfterDays, 0 keeping them
+// uncompressed, and the aggregates are continuous aggregates refreshed by
+// TimescaleDB every AGGREGATION_INTERVAL_SECONDS instead of the cron.
+type TimescaleConfig struct {
+	Enabled            bool `yaml:"enabled" toml:"enabled"`
+	ChunkIntervalHours int  `yaml:"chunk_interval_hours" toml:"chunk_interval_hours"`
+	CompressAfterDays  int  `yaml:"compress_after_days" toml:"compress_after_days"`
+}
+
+// QueryCacheConfig keeps the results of GET /events in memory for TTLSeconds,
+// for dashboards repeating the same queries. Size bounds the number of
+// cached results. With Redis, the results are kept in Redis instead, shared
+// by every instance, and Size does not apply. A zero TTL disables the cache.
+type QueryCacheConfig struct {
+	TTLSeconds int  `yaml:"ttl_seconds" toml:"ttl_seconds"`
+	Size       int  `yaml:"size" toml:"size"`
+	Redis      bool `yaml:"redis" toml:"redis"`
+}
+
+func (q QueryCacheConfig) Enabled() bool {
+	return q.TTLSeconds > 0
+}
+
+// AggregationConfig runs the aggregator every IntervalSeconds, after a
+// random delay of up to JitterSeconds. The events carrying one of
+// ExcludeTags are left out of the counts and the statistics.
+type AggregationConfig struct {
+	IntervalSeconds int      `yaml:"interval_seconds" toml:"interval_seconds"`
+	JitterSeconds   int      `yaml:"jitter_seconds" toml:"jitter_seconds"`
+	ExcludeTags     []string `yaml:"exclude_tags" toml:"exclude_tags"`
+}
+
+// SessionsConfig splits the events of a user into sessions on GET
+// /users/:id/sessions: a session ends after GapMinutes without events.
+type SessionsConfig struct {
+	GapMinutes int `yaml:"gap_minutes" toml:"gap_minutes"`
+}
+
+// ValidationConfig adds rules to the validation of events, applied by every
+// ingestion path: the API, the queue sources, webhooks and imports.
+type ValidationConfig struct {
+	// AllowedActions lists the accepted actions; an entry ending with "*"
+	// accepts every action starting with the rest of it. Empty accepts
+	// every action.
+	AllowedActions []string `yaml:"allowed_actions" toml:"allowed_actions"`
+	// ActionPattern is a regular expression actions must match entirely,
+	// e.g. [a-z][a-z0-9_]* for lowercase snake_case.
+	ActionPattern string `yaml:"action_pattern" toml:"action_pattern"`
+	// MaxActionLength bounds the length of actions in bytes; 0 means
+	// unlimited.
+	MaxActionLength int `yaml:"max_action_length" toml:"max_action_length"`
+
+	// Limits on metadata, in keys and bytes; 0 means unlimited.
+	MaxMetadataKeys        int `yaml:"max_metadata_keys" toml:"max_metadata_keys"`
+	MaxMetadataKeyLength   int `yaml:"max_metadata_key_length" toml:"max_metadata_key_length"`
+	MaxMetadataValueLength int `yaml:"max_metadata_value_length" toml:"max_metadata_value_length"`
+	// MaxMetadataBytes bounds the sum of the lengths of keys and values.
+	MaxMetadataBytes int `yaml:"max_metadata_bytes" toml:"max_metadata_bytes"`
+
+	// MaxFutureSkewSeconds bounds how far in the future the timestamps sent
+	// by clients (created_at of POST /events/batch) may be; 0 disables the
+	// check. Later timestamps are rejected, or set to the current time when
+	// ClampFutureTimestamps is set.
+	MaxFutureSkewSeconds  int  `yaml:"max_future_skew_seconds" toml:"max_future_skew_seconds"`
+	ClampFutureTimestamps bool `yaml:"clamp_future_timestamps" toml:"clamp_future_timestamps"`
+	// LateEventSeconds is the age from which a client timestamp is logged
+	// and counted as late; 0 disables it. Late events are still stored.
+	LateEventSeconds int `yaml:"late_event_seconds" toml:"late_event_seconds"`
+
+	// SchemaVersions registers the versions of the event schema, matched
+	// with the schema_version of the events. Declared in the configuration
+	// file only.
+	SchemaVersions []SchemaVersionConfig `yaml:"schema_versions" toml:"schema_versions"`
+	// UpgradeSchemaOnRead returns the events of older registered versions
+	// upgraded to the latest one.
+	UpgradeSchemaOnRead bool `yaml:"upgrade_schema_on_read" toml:"upgrade_schema_on_read"`
+}
+
+// SchemaVersionConfig describes a version of the event schema: the metadata
+// its events carry, and how the events of the previous version are upgraded
+// to it on read.
+type SchemaVersionConfig struct {
+	Version int `yaml:"version" toml:"version"`
+	// RequiredMetadata lists the metadata keys the events must carry.
+	RequiredMetadata []string `yaml:"required_metadata" toml:"required_metadata"`
+	// AllowedMetadata, when set, lists the only metadata keys accepted.
+	AllowedMetadata []string `yaml:"allowed_metadata" toml:"allowed_metadata"`
+	// RenameActions maps the actions of the previous version to their name
+	// in this one.
+	RenameActions map[string]string `yaml:"rename_actions" toml:"rename_actions"`
+	// DefaultPage is the metadata page given to the events of the previous
+	// version without one.
+	DefaultPage string `yaml:"default_page" toml:"default_page"`
+}
+
+// UserCheckConfig verifies with an external user service that the user of
+// an event sent to the HTTP API exists. URL is a template holding {user_id}
+// and optionally {project_id}; the service answers 2xx for an existing user
+// and 404 for an unknown one. Mode tells what to do with the events of
+// unknown users: reject, flag or allow.
+type UserCheckConfig struct {
+	URL           string `yaml:"url" toml:"url"`
+	Token         string `yaml:"token" toml:"token"`
+	Mode          string `yaml:"mode" toml:"mode"`
+	TimeoutMillis int    `yaml:"timeout_millis" toml:"timeout_millis"`
+	// Answers are cached per project and user, the unknown users for a
+	// shorter time. CacheSize bounds the number of cached answers.
+	CacheSeconds         int `yaml:"cache_seconds" toml:"cache_seconds"`
+	NegativeCacheSeconds int `yaml:"negative_cache_seconds" toml:"negative_cache_seconds"`
+	CacheSize            int `yaml:"cache_size" toml:"cache_size"`
+}
+
+func (u UserCheckConfig) Enabled() bool {
+	return u.URL != ""
+}
+
+// IngestConfig configures the message queue ingestion sources and the
+// write-behind buffer of the HTTP API. A source is disabled until its
+// connection settings are provided.
+type IngestConfig struct {
+	Kafka  KafkaConfig       `yaml:"kafka" toml:"kafka"`
+	NATS   NATSConfig        `yaml:"nats" toml:"nats"`
+	AMQP   AMQPConfig        `yaml:"amqp" toml:"amqp"`
+	SQS    SQSConfig         `yaml:"sqs" toml:"sqs"`
+	PubSub PubSubConfig      `yaml:"pubsub" toml:"pubsub"`
+	Redis  RedisStreamConfig `yaml:"redis" toml:"redis"`
+
+	Buffer BufferConfig `yaml:"buffer" toml:"buffer"`
+	Dedup  DedupConfig  `yaml:"dedup" toml:"dedup"`
+}
+
+// DedupConfig stores an event only once when identical events (same
+// project, user, action and metadata) are sent through the API within
+// WindowSeconds; the event stored first is returned instead. CacheSize
+// events are also remembered in memory to answer duplicates without a
+// database round trip.
+type DedupConfig struct {
+	WindowSeconds int `yaml:"window_seconds" toml:"window_seconds"`
+	CacheSize     int `yaml:"cache_size" toml:"cache_size"`
+}
+
+func (d DedupConfig) Enabled() bool {
+	return d.WindowSeconds > 0
+}
+
+// BufferConfig enables the write-behind mode of POST /events: events are
+// queued in memory, acknowledged with 202 and inserted in batches every
+// FlushIntervalMillis or as soon as FlushBatchSize events are queued.
+type BufferConfig struct {
+	Async               bool `yaml:"async" toml:"async"`
+	Size                int  `yaml:"size" toml:"size"`
+	FlushBatchSize      int  `yaml:"flush_batch_size" toml:"flush_batch_size"`
+	FlushIntervalMillis int  `yaml:"flush_interval_millis" toml:"flush_interval_millis"`
+	// EnqueueWaitMillis bounds how long a request waits for room in a full
+	// buffer before it is rejected with 429. Zero rejects immediately.
+	EnqueueWaitMillis int `yaml:"enqueue_wait_millis" toml:"enqueue_wait_millis"`
+}
+
+type KafkaConfig struct {
+	Brokers []string `yaml:"brokers" toml:"brokers"`
+	Topic   string   `yaml:"topic" toml:"topic"`
+	GroupID string   `yaml:"group_id" toml:"group_id"`
+	// Format of the message values: json, protobuf (AddEvent of
+	// proto/events/v1/events.proto), or avro with the schema read from
+	// AvroSchemaFile.
+	Format         string `yaml:"format" toml:"format"`
+	AvroSchemaFile string `yaml:"avro_schema_file" toml:"avro_schema_file"`
+	// Messages are stored in batches of up to BatchSize, waiting at most
+	// BatchWaitMillis for a batch to fill.
+	BatchSize       int `yaml:"batch_size" toml:"batch_size"`
+	BatchWaitMillis int `yaml:"batch_wait_millis" toml:"batch_wait_millis"`
+}
+
+// Enabled reports whether events are consumed from Kafka.
+func (k KafkaConfig) Enabled() bool {
+	return len(k.Brokers) > 0
+}
+
+// NATSConfig describes a JetStream durable pull consumer.
+type NATSConfig struct {
+	URL    string `yaml:"url" toml:"url"`
+	Stream string `yaml:"stream" toml:"stream"`
+	// Subject optionally restricts the consumer to a subject of the stream.
+	Subject string `yaml:"subject" toml:"subject"`
+	Durable string `yaml:"durable" toml:"durable"`
+	// Concurrency is the number of workers fetching batches in parallel.
+	Concurrency     int `yaml:"concurrency" toml:"concurrency"`
+	BatchSize       int `yaml:"batch_size" toml:"batch_size"`
+	BatchWaitMillis int `yaml:"batch_wait_millis" toml:"batch_wait_millis"`
+	// AckWaitSeconds is how long the server waits for an ack before
+	// redelivering a message.
+	AckWaitSeconds int `yaml:"ack_wait_seconds" toml:"ack_wait_seconds"`
+}
+
+// Enabled reports whether events are consumed from NATS JetStream.
+func (n NATSConfig) Enabled() bool {
+	return n.URL != ""
+}
+
+// AMQPConfig describes a RabbitMQ queue consumer.
+type AMQPConfig struct {
+	URL   string `yaml:"url" toml:"url"`
+	Queue string `yaml:"queue" toml:"queue"`
+	// Prefetch is the number of unacknowledged messages the broker sends
+	// ahead; it is also the maximum batch size.
+	Prefetch        int `yaml:"prefetch" toml:"prefetch"`
+	BatchWaitMillis int `yaml:"batch_wait_millis" toml:"batch_wait_millis"`
+	// DeadLetterExchange receives rejected messages (malformed, or failing
+	// to store after a redelivery). They are dropped when it is empty.
+	DeadLetterExchange   string `yaml:"dead_letter_exchange" toml:"dead_letter_exchange"`
+	DeadLetterRoutingKey string `yaml:"dead_letter_routing_key" toml:"dead_letter_routing_key"`
+}
+
+// Enabled reports whether events are consumed from RabbitMQ.
+func (a AMQPConfig) Enabled() bool {
+	return a.URL != ""
+}
+
+// SQSConfig describes an AWS SQS long-polling worker pool. Credentials come
+// from the default AWS chain (environment, shared config, instance role).
+type SQSConfig struct {
+	QueueURL string `yaml:"queue_url" toml:"queue_url"`
+	Region   string `yaml:"region" toml:"region"`
+	// Endpoint overrides the AWS endpoint, e.g. for LocalStack.
+	Endpoint    string `yaml:"endpoint" toml:"endpoint"`
+	Workers     int    `yaml:"workers" toml:"workers"`
+	WaitSeconds int    `yaml:"wait_seconds" toml:"wait_seconds"`
+	// VisibilityTimeoutSeconds hides received messages from other workers
+	// while they are being stored.
+	VisibilityTimeoutSeconds int `yaml:"visibility_timeout_seconds" toml:"visibility_timeout_seconds"`
+}
+
+// Enabled reports whether events are consumed from SQS.
+func (q SQSConfig) Enabled() bool {
+	return q.QueueURL != ""
+}
+
+// PubSubConfig describes a Google Cloud Pub/Sub subscription consumer.
+// Credentials come from Application Default Credentials; PUBSUB_EMULATOR_HOST
+// is honoured by the client library.
+type PubSubConfig struct {
+	ProjectID    string `yaml:"project_id" toml:"project_id"`
+	Subscription string `yaml:"subscription" toml:"subscription"`
+	// Flow control: messages received but not yet acked are capped by count
+	// and size, pausing delivery when either limit is reached.
+	MaxOutstandingMessages int `yaml:"max_outstanding_messages" toml:"max_outstanding_messages"`
+	MaxOutstandingBytes    int `yaml:"max_outstanding_bytes" toml:"max_outstanding_bytes"`
+	NumGoroutines          int `yaml:"num_goroutines" toml:"num_goroutines"`
+	BatchSize              int `yaml:"batch_size" toml:"batch_size"`
+	BatchWaitMillis        int `yaml:"batch_wait_millis" toml:"batch_wait_millis"`
+}
+
+// Enabled reports whether events are consumed from Pub/Sub.
+func (p PubSubConfig) Enabled() bool {
+	return p.Subscription != ""
+}
+
+// RedisStreamConfig describes a Redis stream consumer group member. The
+// connection comes from RedisConfig.
+type RedisStreamConfig struct {
+	Stream string `yaml:"stream" toml:"stream"`
+	Group  string `yaml:"group" toml:"group"`
+	// Consumer names this instance within the group; it defaults to the
+	// hostname and must be stable across restarts.
+	Consumer    string `yaml:"consumer" toml:"consumer"`
+	BatchSize   int    `yaml:"batch_size" toml:"batch_size"`
+	BlockMillis int    `yaml:"block_millis" toml:"block_millis"`
+	// ClaimIdleSeconds is how long an entry may stay pending (delivered but
+	// not acked) before another consumer reclaims it.
+	ClaimIdleSeconds int `yaml:"claim_idle_seconds" toml:"claim_idle_seconds"`
+}
+
+// Enabled reports whether events are consumed from a Redis stream.
+func (r RedisStreamConfig) Enabled() bool {
+	return r.Stream != ""
+}
+
+// RedisConfig holds the connection shared by the features using Redis.
+type RedisConfig struct {
+	// URL in the redis:// or rediss:// form.
+	URL string `yaml:"url" toml:"url"`
+}
+
+// SpoolConfig configures the on-disk spool that keeps events while the
+// database is unavailable. It is disabled when Dir is empty.
+type SpoolConfig struct {
+	Dir       string `yaml:"dir" toml:"dir"`
+	MaxSizeMB int    `yaml:"max_size_mb" toml:"max_size_mb"`
+	// Spooled events are replayed in inserts of ReplayBatchSize events,
+	// checking for recovery every ReplayIntervalMillis.
+	ReplayBatchSize      int `yaml:"replay_batch_size" toml:"replay_batch_size"`
+	ReplayIntervalMillis int `yaml:"replay_interval_millis" toml:"replay_interval_millis"`
+}
+
+// Enabled reports whether failed inserts are spooled to disk.
+func (s SpoolConfig) Enabled() bool {
+	return s.Dir != ""
+}
+
+// DeadLetterConfig configures where batches that could not be inserted
+// after MaxRetrySeconds of retries are kept. It is disabled when Dir is
+// empty, in which case those batches are retried until shutdown.
+type DeadLetterConfig struct {
+	Dir             string `yaml:"dir" toml:"dir"`
+	MaxRetrySeconds int    `yaml:"max_retry_seconds" toml:"max_retry_seconds"`
+}
+
+// Enabled reports whether failed batches are dead-lettered.
+func (d DeadLetterConfig) Enabled() bool {
+	return d.Dir != ""
+}
+
+// ImportConfig configures POST /events/import. Uploaded files are kept in
+// Dir until their import job finished. It is disabled when Dir is empty.
+type ImportConfig struct {
+	Dir         string `yaml:"dir" toml:"dir"`
+	MaxUploadMB int    `yaml:"max_upload_mb" toml:"max_upload_mb"`
+	BatchSize   int    `yaml:"batch_size" toml:"batch_size"`
+	// MaxJobs bounds the jobs kept for status queries; the oldest finished
+	// jobs are forgotten first.
+	MaxJobs int `yaml:"max_jobs" toml:"max_jobs"`
+}
+
+// Enabled reports whether file uploads are accepted.
+func (i ImportConfig) Enabled() bool {
+	return i.Dir != ""
+}
+
+// JobsConfig configures the background jobs of POST /exports and of the
+// admin POST /jobs, run by Workers workers per instance. Their artifacts
+// are written to Dir, which the instances must share, and are deleted with
+// the jobs RetentionHours after they finished. A running job whose instance
+// did not report for StaleSeconds is run again. It is disabled when Dir is
+// empty.
+type JobsConfig struct {
+	Dir            string `yaml:"dir" toml:"dir"`
+	Workers        int    `yaml:"workers" toml:"workers"`
+	StaleSeconds   int    `yaml:"stale_seconds" toml:"stale_seconds"`
+	RetentionHours int    `yaml:"retention_hours" toml:"retention_hours"`
+}
+
+// Enabled reports whether the jobs are run.
+func (j JobsConfig) Enabled() bool {
+	return j.Dir != ""
+}
+
+// ExportConfig configures the export of events to S3-compatible storage,
+// one directory per time window of WindowMinutes. It is disabled when Bucket
+// is empty.
+type ExportConfig struct {
+	Bucket string `yaml:"bucket" toml:"bucket"`
+	Prefix string `yaml:"prefix" toml:"prefix"`
+	Region string `yaml:"region" toml:"region"`
+	// Endpoint and UsePathStyle target S3-compatible stores such as MinIO.
+	Endpoint     string `yaml:"endpoint" toml:"endpoint"`
+	UsePathStyle bool   `yaml:"use_path_style" toml:"use_path_style"`
+	// Format is parquet or csv (gzipped).
+	Format string `yaml:"format" toml:"format"`
+	// Schedule is a cron expression (minute hour day month weekday) at which
+	// the last LookbackWindows complete windows are exported unless they
+	// already were. Exports only run through the admin API when empty.
+	Schedule        string `yaml:"schedule" toml:"schedule"`
+	WindowMinutes   int    `yaml:"window_minutes" toml:"window_minutes"`
+	LookbackWindows int    `yaml:"lookback_windows" toml:"lookback_windows"`
+	// SettleSeconds is how long after its end a window is considered
+	// complete.
+	SettleSeconds  int `yaml:"settle_seconds" toml:"settle_seconds"`
+	MaxRowsPerFile int `yaml:"max_rows_per_file" toml:"max_rows_per_file"`
+}
+
+// Enabled reports whether events can be exported.
+func (e ExportConfig) Enabled() bool {
+	return e.Bucket != ""
+}
+
+// SinksConfig configures the destinations stored events are published to.
+// Sinks follow the events table in id order, so an event is published once
+// its insert committed, including events inserted by other instances.
+type SinksConfig struct {
+	Webhooks OutboundWebhooksConfig `yaml:"webhooks" toml:"webhooks"`
+	Kafka    KafkaSinkConfig        `yaml:"kafka" toml:"kafka"`
+
+	Elasticsearch ElasticsearchSinkConfig `yaml:"elasticsearch" toml:"elasticsearch"`
+}
+
+// OutboundWebhooksConfig configures the delivery of stored events to the
+// URLs registered as webhook subscriptions.
+type OutboundWebhooksConfig struct {
+	Enabled            bool `yaml:"enabled" toml:"enabled"`
+	PollIntervalMillis int  `yaml:"poll_interval_millis" toml:"poll_interval_millis"`
+	// SettleMillis delays publishing so that concurrent inserts holding a
+	// lower id commit first.
+	SettleMillis   int `yaml:"settle_millis" toml:"settle_millis"`
+	BatchSize      int `yaml:"batch_size" toml:"batch_size"`
+	Workers        int `yaml:"workers" toml:"workers"`
+	TimeoutSeconds int `yaml:"timeout_seconds" toml:"timeout_seconds"`
+	// MaxAttempts is the number of attempts before a delivery is marked failed.
+	MaxAttempts int `yaml:"max_attempts" toml:"max_attempts"`
+	// RetentionHours is how long finished deliveries stay queryable.
+	RetentionHours int `yaml:"retention_hours" toml:"retention_hours"`
+}
+
+// KafkaSinkConfig publishes every stored event to Topic, keyed by user id
+// so that the events of a user stay ordered within a partition.
+type KafkaSinkConfig struct {
+	Brokers            []string `yaml:"brokers" toml:"brokers"`
+	Topic              string   `yaml:"topic" toml:"topic"`
+	PollIntervalMillis int      `yaml:"poll_interval_millis" toml:"poll_interval_millis"`
+	SettleMillis       int      `yaml:"settle_millis" toml:"settle_millis"`
+	BatchSize          int      `yaml:"batch_size" toml:"batch_size"`
+	// Format of the message values: json, or protobuf (Event of
+	// proto/events/v1/events.proto).
+	Format string `yaml:"format" toml:"format"`
+}
+
+// Enabled reports whether stored events are published to Kafka.
+func (k KafkaSinkConfig) Enabled() bool {
+	return len(k.Brokers) > 0
+}
+
+// ElasticsearchSinkConfig indexes every stored event into Index of an
+// Elasticsearch or OpenSearch cluster, with the event id as document id.
+type ElasticsearchSinkConfig struct {
+	URL   string `yaml:"url" toml:"url"`
+	Index string `yaml:"index" toml:"index"`
+	// APIKey takes precedence over Username and Password.
+	Username           string `yaml:"username" toml:"username"`
+	Password           string `yaml:"password" toml:"password"`
+	APIKey             string `yaml:"api_key" toml:"api_key"`
+	PollIntervalMillis int    `yaml:"poll_interval_millis" toml:"poll_interval_millis"`
+	SettleMillis       int    `yaml:"settle_millis" toml:"settle_millis"`
+	BatchSize          int    `yaml:"batch_size" toml:"batch_size"`
+	TimeoutSeconds     int    `yaml:"timeout_seconds" toml:"timeout_seconds"`
+	// MaxRetries bounds the retries of documents failing with 429 or 5xx
+	// within a batch; the batch is sent again on the next poll afterwards.
+	MaxRetries int `yaml:"max_retries" toml:"max_retries"`
+}
+
+// Enabled reports whether stored events are indexed.
+func (e ElasticsearchSinkConfig) Enabled() bool {
+	return e.URL != ""
+}
+
+// FederationConfig connects edge deployments to a central one: edge
+// instances store events locally and forward them to POST /events/batch of
+// the central instance.
+type FederationConfig struct {
+	// Token, when set, is required as a bearer token by POST /events/batch.
+	Token   string        `yaml:"token" toml:"token"`
+	Forward ForwardConfig `yaml:"forward" toml:"forward"`
+}
+
+// ForwardConfig makes this instance an edge forwarding every stored event
+// to a central instance.
+type ForwardConfig struct {
+	// URL is the base URL of the central API, e.g. https://events.example.com/api.
+	URL   string `yaml:"url" toml:"url"`
+	Token string `yaml:"token" toml:"token"`
+	// SigningSecret, when set, signs the forwarded batches in X-Signature
+	// for a central instance configured with SIGNING_SECRETS.
+	SigningSecret string `yaml:"signing_secret" toml:"signing_secret"`
+	// Origin names this edge deployment in the dedupe keys of its events,
+	// "<origin>:<id>"; it must be unique among the edges of a central
+	// instance and never change.
+	Origin             string `yaml:"origin" toml:"origin"`
+	PollIntervalMillis int    `yaml:"poll_interval_millis" toml:"poll_interval_millis"`
+	SettleMillis       int    `yaml:"settle_millis" toml:"settle_millis"`
+	BatchSize          int    `yaml:"batch_size" toml:"batch_size"`
+	TimeoutSeconds     int    `yaml:"timeout_seconds" toml:"timeout_seconds"`
+}
+
+// Enabled reports whether stored events are forwarded.
+func (f ForwardConfig) Enabled() bool {
+	return f.URL != ""
+}
+
+// ReportsConfig configures the summaries of the last complete period (total
+// events, top actions, active users) sent to Slack and by email.
+type ReportsConfig struct {
+	// Period is daily or weekly (Monday to Sunday), in UTC.
+	Period string `yaml:"period" toml:"period"`
+	// Schedule is a cron expression (minute hour day month weekday),
+	// evaluated in UTC, at which the report of the last complete period is
+	// sent.
+	Schedule        string     `yaml:"schedule" toml:"schedule"`
+	TopActions      int        `yaml:"top_actions" toml:"top_actions"`
+	SlackWebhookURL string     `yaml:"slack_webhook_url" toml:"slack_webhook_url"`
+	SMTP            SMTPConfig `yaml:"smtp" toml:"smtp"`
+}
+
+// Enabled reports whether reports have a recipient.
+func (r ReportsConfig) Enabled() bool {
+	return r.SlackWebhookURL != "" || len(r.SMTP.To) > 0
+}
+
+// AnomalyConfig compares, every CheckIntervalSeconds, the rate of each
+// action over the last WindowMinutes with its rate over the BaselineHours
+// before, from the aggregate tables. An action whose rate is Factor times
+// higher or lower raises an alert, stored and sent to the configured
+// channels. Actions expecting fewer than MinEvents events in the window,
+// and seeing fewer, are not checked.
+type AnomalyConfig struct {
+	Enabled              bool   `yaml:"enabled" toml:"enabled"`
+	CheckIntervalSeconds int    `yaml:"check_interval_seconds" toml:"check_interval_seconds"`
+	WindowMinutes        int    `yaml:"window_minutes" toml:"window_minutes"`
+	BaselineHours        int    `yaml:"baseline_hours" toml:"baseline_hours"`
+	Factor               int    `yaml:"factor" toml:"factor"`
+	MinEvents            int    `yaml:"min_events" toml:"min_events"`
+	SlackWebhookURL      string `yaml:"slack_webhook_url" toml:"slack_webhook_url"`
+	// WebhookURL receives every alert as JSON.
+	WebhookURL string `yaml:"webhook_url" toml:"webhook_url"`
+}
+
+// AlertsConfig evaluates the alert rules managed on the admin listener
+// every CheckIntervalSeconds, and sends their alerts to the configured
+// channels.
+type AlertsConfig struct {
+	Enabled              bool   `yaml:"enabled" toml:"enabled"`
+	CheckIntervalSeconds int    `yaml:"check_interval_seconds" toml:"check_interval_seconds"`
+	SlackWebhookURL      string `yaml:"slack_webhook_url" toml:"slack_webhook_url"`
+	// WebhookURL receives every alert as JSON.
+	WebhookURL string `yaml:"webhook_url" toml:"webhook_url"`
+}
+
+// tagName matches the tags of events, like POST /events/:id/tags accepts
+// them.
+var tagName = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// FeatureFlagNames lists the optional API behaviors controlled by feature
+// flags.
+var FeatureFlagNames = []string{"strict_validation", "async_ingest", "response_envelope"}
+
+// FeatureFlagsConfig sets the flags enabled by default. The overrides set
+// on the admin listener are read again every RefreshSeconds, so that every
+// instance sees them.
+type FeatureFlagsConfig struct {
+	Enabled        []string `yaml:"enabled" toml:"enabled"`
+	RefreshSeconds int      `yaml:"refresh_seconds" toml:"refresh_seconds"`
+}
+
+// ArchiveConfig moves the events older than AfterDays from events to
+// events_archive every IntervalMinutes, BatchSize events per transaction.
+// 0 AfterDays disables it.
+type ArchiveConfig struct {
+	AfterDays       int `yaml:"after_days" toml:"after_days"`
+	IntervalMinutes int `yaml:"interval_minutes" toml:"interval_minutes"`
+	BatchSize       int `yaml:"batch_size" toml:"batch_size"`
+}
+
+func (a ArchiveConfig) Enabled() bool {
+	return a.AfterDays > 0
+}
+
+// ScheduledConfig bounds the deliver_at of POST /events to MaxDelayDays
+// ahead, and moves the due events to events every IntervalSeconds,
+// BatchSize events per transaction.
+type ScheduledConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds" toml:"interval_seconds"`
+	BatchSize       int `yaml:"batch_size" toml:"batch_size"`
+	MaxDelayDays    int `yaml:"max_delay_days" toml:"max_delay_days"`
+}
+
+// TTLConfig deletes the events past their ttl_seconds every
+// IntervalSeconds, BatchSize events per transaction.
+type TTLConfig struct {
+	IntervalSeconds int `yaml:"interval_seconds" toml:"interval_seconds"`
+	BatchSize       int `yaml:"batch_size" toml:"batch_size"`
+}
+
+// SMTPConfig configures the server reports are mailed through. STARTTLS is
+// used when the server offers it; Username enables PLAIN authentication.
+type SMTPConfig struct {
+	Host     string   `yaml:"host" toml:"host"`
+	Port     int      `yaml:"port" toml:"port"`
+	Username string   `yaml:"username" toml:"username"`
+	Password string   `yaml:"password" toml:"password"`
+	From     string   `yaml:"from" toml:"from"`
+	To       []string `yaml:"to" toml:"to"`
+}
+
+// WebhookConfig describes a third-party webhook sender: how its requests are
+// signed and how its payloads map to events. Fields are dotted paths into
+// the JSON payload (e.g. "data.object.metadata.user_id"), or "header:Name"
+// to read a request header.
+type WebhookConfig struct {
+	Secret string `yaml:"secret" toml:"secret"`
+	// SignatureHeader carries the signature, e.g. X-Hub-Signature-256.
+	SignatureHeader string `yaml:"signature_header" toml:"signature_header"`
+	// SignatureScheme is sha256 for a hex HMAC-SHA256 of the body, with an
+	// optional "sha256=" prefix (GitHub), or stripe for the timestamped
+	// "t=...,v1=..." form.
+	SignatureScheme string `yaml:"signature_scheme" toml:"signature_scheme"`
+	// ToleranceSeconds bounds the age of stripe signatures, 300 when unset.
+	ToleranceSeconds int `yaml:"tolerance_seconds" toml:"tolerance_seconds"`
+
+	UserIDField string `yaml:"user_id_field" toml:"user_id_field"`
+	// ActionField is read when set, otherwise every payload is stored with
+	// Action. ActionPrefix is prepended in both cases, e.g. "github.".
+	ActionField  string `yaml:"action_field" toml:"action_field"`
+	Action       string `yaml:"action" toml:"action"`
+	ActionPrefix string `yaml:"action_prefix" toml:"action_prefix"`
+	// MetadataFields maps metadata keys to fields of the payload.
+	MetadataFields map[string]string `yaml:"metadata_fields" toml:"metadata_fields"`
+}
+
+// ErrorReportingConfig configures where panics and 5xx errors are reported.
+// Reporting is disabled when SentryDSN is empty.
+type ErrorReportingConfig struct {
+	SentryDSN   string `yaml:"sentry_dsn" toml:"sentry_dsn"`
+	Environment string `yaml:"environment" toml:"environment"`
+}
+
+// ShutdownConfig holds the timeout of every graceful shutdown stage.
+type ShutdownConfig struct {
+	// ReadinessDelaySeconds is how long the application keeps serving after
+	// reporting not ready, so load balancers can stop routing to it.
+	ReadinessDelaySeconds    int `yaml:"readiness_delay_seconds" toml:"readiness_delay_seconds"`
+	AggregatorTimeoutSeconds int `yaml:"aggregator_timeout_seconds" toml:"aggregator_timeout_seconds"`
+	IngestTimeoutSeconds     int `yaml:"ingest_timeout_seconds" toml:"ingest_timeout_seconds"`
+	HTTPTimeoutSeconds       int `yaml:"http_timeout_seconds" toml:"http_timeout_seconds"`
+	DBTimeoutSeconds         int `yaml:"db_timeout_seconds" toml:"db_timeout_seconds"`
+}
+
+// LogConfig selects the level (debug, info, warn, error) and the output
+// format (json, text) of the application logger.
+type LogConfig struct {
+	Level  string `yaml:"level" toml:"level"`
+	Format string `yaml:"format" toml:"format"`
+
+	// RequestSampleRate logs 1 in N successful requests. Client and server
+	// errors and slow requests are always logged.
+	RequestSampleRate int `yaml:"request_sample_rate" toml:"request_sample_rate"`
+	// SlowRequestMillis is the duration from which a request is always logged.
+	SlowRequestMillis int `yaml:"slow_request_millis" toml:"slow_request_millis"`
+	// ExcludePaths are never logged (metrics are still recorded).
+	ExcludePaths []string `yaml:"exclude_paths" toml:"exclude_paths"`
+
+	// Output is stdout, or file to write the logs to File instead.
+	Output string        `yaml:"output" toml:"output"`
+	File   LogFileConfig `yaml:"file" toml:"file"`
+}
+
+// LogFileConfig rotates the log file at Path once it reaches MaxSizeMB,
+// keeping MaxBackups rotated files, gzipped with Compress. Zero backups
+// keeps them all.
+type LogFileConfig struct {
+	Path       string `yaml:"path" toml:"path"`
+	MaxSizeMB  int    `yaml:"max_size_mb" toml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups" toml:"max_backups"`
+	Compress   bool   `yaml:"compress" toml:"compress"`
+}
+
+// DebugConfig records sanitized copies of the requests of the public API,
+// to inspect and replay them on the admin listener. The last RecordRequests
+// are kept in memory, and every one is appended to RecordFile when set.
+// Bodies are cut after RecordMaxBodyKB. It is disabled when RecordRequests
+// is 0.
+type DebugConfig struct {
+	RecordRequests  int    `yaml:"record_requests" toml:"record_requests"`
+	RecordFile      string `yaml:"record_file" toml:"record_file"`
+	RecordMaxBodyKB int    `yaml:"record_max_body_kb" toml:"record_max_body_kb"`
+}
+
+// Enabled reports whether the requests are recorded.
+func (d DebugConfig) Enabled() bool {
+	return d.RecordRequests > 0
+}
+
+// Default returns the configuration used when neither a file nor
+// environment variables provide a value.
+func Default() *Config {
+	return &Config{
+		TLS: TLSConfig{
+			ACMECacheDir: "certs",
+		},
+		Server: ServerConfig{
+			Port:                8080,
+			IdleTimeoutSeconds:  60,
+			ReadTimeoutSeconds:  10,
+			WriteTimeoutSeconds: 30,
+
+			IngestRequestTimeoutSeconds: 5,
+			QueryRequestTimeoutSeconds:  25,
+
+			ShedRetryAfterSeconds: 1,
+
+			DefaultEventsLimit:         1000,
+			MaxEventsLimit:             10000,
+			EventsExportTimeoutSeconds: 600,
+
+			EventsFlushIntervalMillis: 200,
+		},
+		Admin: AdminConfig{
+			Port: 8090,
+		},
+		Worker: WorkerConfig{
+			Port: 8091,
+		},
+		Auth: AuthConfig{
+			SignatureWindowSeconds: 300,
+		},
+		Quotas: QuotaConfig{
+			FlushIntervalSeconds: 10,
+		},
+		CORS: CORSConfig{
+			AllowOrigins: []string{"http://localhost:3000"},
+			AllowMethods: []string{"GET", "POST"},
+			AllowHeaders: []string{"Accept", "Authorization", "Content-Type", "X-API-Key"},
+		},
+		DB: DBConfig{
+			Host:   "localhost",
+			Port:   5432,
+			Schema: "public",
+
+			BreakerFailureThreshold: 5,
+			BreakerOpenSeconds:      10,
+			StartupWaitSeconds:      30,
+			InsertBatchSize:         100,
+			SlowQueryMillis:         500,
+
+			Timescale: TimescaleConfig{
+				ChunkIntervalHours: 24,
+				CompressAfterDays:  7,
+			},
+		},
+		Validation: ValidationConfig{
+			MaxMetadataKeys:        64,
+			MaxMetadataKeyLength:   128,
+			MaxMetadataValueLength: 4096,
+			MaxMetadataBytes:       16384,
+
+			MaxFutureSkewSeconds: 300,
+			LateEventSeconds:     7 * 24 * 3600,
+		},
+		UserCheck: UserCheckConfig{
+			Mode:                 "reject",
+			TimeoutMillis:        500,
+			CacheSeconds:         300,
+			NegativeCacheSeconds: 30,
+			CacheSize:            100000,
+		},
+		QueryCache: QueryCacheConfig{
+			Size: 1000,
+		},
+		Aggregation: AggregationConfig{
+			IntervalSeconds: 60,
+		},
+		Sessions: SessionsConfig{
+			GapMinutes: 30,
+		},
+		Ingest: IngestConfig{
+			Kafka: KafkaConfig{
+				Topic:           "events",
+				GroupID:         "simple-events-handler",
+				Format:          "json",
+				BatchSize:       500,
+				BatchWaitMillis: 1000,
+			},
+			NATS: NATSConfig{
+				Stream:          "EVENTS",
+				Durable:         "simple-events-handler",
+				Concurrency:     4,
+				BatchSize:       100,
+				BatchWaitMillis: 1000,
+				AckWaitSeconds:  30,
+			},
+			AMQP: AMQPConfig{
+				Queue:           "events",
+				Prefetch:        100,
+				BatchWaitMillis: 1000,
+			},
+			SQS: SQSConfig{
+				Workers:                  4,
+				WaitSeconds:              20,
+				VisibilityTimeoutSeconds: 30,
+			},
+			PubSub: PubSubConfig{
+				MaxOutstandingMessages: 1000,
+				MaxOutstandingBytes:    100 << 20,
+				NumGoroutines:          1,
+				BatchSize:              500,
+				BatchWaitMillis:        1000,
+			},
+			Redis: RedisStreamConfig{
+				Group:            "simple-events-handler",
+				BatchSize:        100,
+				BlockMillis:      1000,
+				ClaimIdleSeconds: 60,
+			},
+			Buffer: BufferConfig{
+				Size:                10000,
+				FlushBatchSize:      1000,
+				FlushIntervalMillis: 200,
+			},
+			Dedup: DedupConfig{
+				CacheSize: 10000,
+			},
+		},
+		Spool: SpoolConfig{
+			MaxSizeMB:            1024,
+			ReplayBatchSize:      500,
+			ReplayIntervalMillis: 1000,
+		},
+		DeadLetter: DeadLetterConfig{
+			MaxRetrySeconds: 60,
+		},
+		Import: ImportConfig{
+			MaxUploadMB: 100,
+			BatchSize:   1000,
+			MaxJobs:     100,
+		},
+		Jobs: JobsConfig{
+			Workers:        2,
+			StaleSeconds:   60,
+			RetentionHours: 24,
+		},
+		Export: ExportConfig{
+			Prefix:          "events/",
+			Format:          "parquet",
+			WindowMinutes:   1440,
+			LookbackWindows: 3,
+			SettleSeconds:   300,
+			MaxRowsPerFile:  1000000,
+		},
+		Sinks: SinksConfig{
+			Webhooks: OutboundWebhooksConfig{
+				PollIntervalMillis: 1000,
+				SettleMillis:       2000,
+				BatchSize:          500,
+				Workers:            4,
+				TimeoutSeconds:     10,
+				MaxAttempts:        10,
+				RetentionHours:     168,
+			},
+			Kafka: KafkaSinkConfig{
+				Topic:              "events-stored",
+				PollIntervalMillis: 1000,
+				SettleMillis:       2000,
+				BatchSize:          500,
+				Format:             "json",
+			},
+			Elasticsearch: ElasticsearchSinkConfig{
+				Index:              "events",
+				PollIntervalMillis: 1000,
+				SettleMillis:       2000,
+				BatchSize:          500,
+				TimeoutSeconds:     30,
+				MaxRetries:         3,
+			},
+		},
+		Federation: FederationConfig{
+			Forward: ForwardConfig{
+				PollIntervalMillis: 1000,
+				SettleMillis:       2000,
+				BatchSize:          500,
+				TimeoutSeconds:     30,
+			},
+		},
+		Reports: ReportsConfig{
+			Period:     "daily",
+			Schedule:   "0 7 * * *",
+			TopActions: 5,
+			SMTP: SMTPConfig{
+				Port: 587,
+			},
+		},
+		Anomaly: AnomalyConfig{
+			CheckIntervalSeconds: 60,
+			WindowMinutes:        15,
+			BaselineHours:        24,
+			Factor:               3,
+			MinEvents:            50,
+		},
+		Alerts: AlertsConfig{
+			CheckIntervalSeconds: 30,
+		},
+		Flags: FeatureFlagsConfig{
+			RefreshSeconds: 30,
+		},
+		Archive: ArchiveConfig{
+			IntervalMinutes: 60,
+			BatchSize:       5000,
+		},
+		Scheduled: ScheduledConfig{
+			IntervalSeconds: 5,
+			BatchSize:       1000,
+			MaxDelayDays:    365,
+		},
+		TTL: TTLConfig{
+			IntervalSeconds: 60,
+			BatchSize:       5000,
+		},
+		Log: LogConfig{
+			Level:             "info",
+			Format:            "json",
+			RequestSampleRate: 1,
+			SlowRequestMillis: 1000,
+			ExcludePaths:      []string{"/health", "/metrics", "/ready"},
+			Output:            "stdout",
+			File: LogFileConfig{
+				MaxSizeMB:  100,
+				MaxBackups: 5,
+			},
+		},
+		Debug: DebugConfig{
+			RecordMaxBodyKB: 64,
+		},
+		Shutdown: ShutdownConfig{
+			AggregatorTimeoutSeconds: 30,
+			IngestTimeoutSeconds:     10,
+			HTTPTimeoutSeconds:       10,
+			DBTimeoutSeconds:         5,
+		},
+	}
+}
+
+// Load builds the configuration. path may be empty, in which case only
+// defaults and environment variables are used. The returned error lists
+// every invalid field, not only the first one.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	errs := cfg.applyEnv()
+	errs = append(errs, cfg.validate()...)
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("parse yaml config %s: %w", path, err)
+		}
+	case ".toml":
+		dec := toml.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return fmt.Errorf("parse toml config %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file extension %q: use .yaml, .yml or .toml", ext)
+	}
+	return nil
+}
+
+// applyEnv overrides file values with environment variables that are set.
+// It returns one error per variable that could not be parsed.
+func (c *Config) applyEnv() []error {
+	var errs []error
+
+	str := func(name string, dst *string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	integer := func(name string, dst *int) {
+		if v := os.Getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	boolean := func(name string, dst *bool) {
+		if v := os.Getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a boolean, got %q", name, v))
+				return
+			}
+			*dst = b
+		}
+	}
+	list := func(name string, dst *[]string) {
+		if v := os.Getenv(name); v != "" {
+			*dst = SplitAndTrim(v)
+		}
+	}
+	mapping := func(name string, dst *map[string]string) {
+		if v := os.Getenv(name); v != "" {
+			m := map[string]string{}
+			for _, pair := range SplitAndTrim(v) {
+				key, value, ok := strings.Cut(pair, "=")
+				if !ok {
+					errs = append(errs, fmt.Errorf("%s must hold key=value pairs, got %q", name, pair))
+					return
+				}
+				m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+			*dst = m
+		}
+	}
+
+	integer("PORT", &c.Server.Port)
+	str("BASE_PATH", &c.Server.BasePath)
+	integer("IDLE_TIMEOUT_SECONDS", &c.Server.IdleTimeoutSeconds)
+	integer("READ_TIMEOUT_SECONDS", &c.Server.ReadTimeoutSeconds)
+	integer("WRITE_TIMEOUT_SECONDS", &c.Server.WriteTimeoutSeconds)
+	integer("INGEST_REQUEST_TIMEOUT_SECONDS", &c.Server.IngestRequestTimeoutSeconds)
+	integer("QUERY_REQUEST_TIMEOUT_SECONDS", &c.Server.QueryRequestTimeoutSeconds)
+	integer("MAX_IN_FLIGHT_REQUESTS", &c.Server.MaxInFlightRequests)
+	integer("SHED_RETRY_AFTER_SECONDS", &c.Server.ShedRetryAfterSeconds)
+	list("ALLOW_CIDRS", &c.Server.AllowCIDRs)
+	list("DENY_CIDRS", &c.Server.DenyCIDRs)
+	list("TRUSTED_PROXIES", &c.Server.TrustedProxies)
+	boolean("STRICT_TIME_PARSING", &c.Server.StrictTimeParsing)
+	integer("EVENTS_DEFAULT_LIMIT", &c.Server.DefaultEventsLimit)
+	integer("EVENTS_MAX_LIMIT", &c.Server.MaxEventsLimit)
+	integer("EVENTS_EXPORT_TIMEOUT_SECONDS", &c.Server.EventsExportTimeoutSeconds)
+	integer("EVENTS_FLUSH_INTERVAL_MS", &c.Server.EventsFlushIntervalMillis)
+	boolean("STRICT_JSON", &c.Server.StrictJSON)
+
+	str("TLS_CERT_FILE", &c.TLS.CertFile)
+	str("TLS_KEY_FILE", &c.TLS.KeyFile)
+	integer("TLS_REDIRECT_PORT", &c.TLS.RedirectPort)
+	list("TLS_ACME_DOMAINS", &c.TLS.ACMEDomains)
+	str("TLS_ACME_CACHE_DIR", &c.TLS.ACMECacheDir)
+	str("TLS_ACME_EMAIL", &c.TLS.ACMEEmail)
+
+	integer("ADMIN_PORT", &c.Admin.Port)
+	str("ADMIN_TOKEN", &c.Admin.Token)
+	list("ADMIN_ALLOW_CIDRS", &c.Admin.AllowCIDRs)
+	list("ADMIN_DENY_CIDRS", &c.Admin.DenyCIDRs)
+	boolean("WORKER_SEPARATE", &c.Worker.Separate)
+	integer("WORKER_PORT", &c.Worker.Port)
+	boolean("REQUIRE_API_KEY", &c.Auth.RequireAPIKey)
+	list("SIGNING_SECRETS", &c.Auth.SigningSecrets)
+	boolean("REQUIRE_SIGNATURE", &c.Auth.RequireSignature)
+	integer("SIGNATURE_WINDOW_SECONDS", &c.Auth.SignatureWindowSeconds)
+	integer("QUOTA_DAILY_EVENTS", &c.Quotas.DailyEvents)
+	integer("QUOTA_MONTHLY_EVENTS", &c.Quotas.MonthlyEvents)
+	integer("QUOTA_DAILY_QUERIES", &c.Quotas.DailyQueries)
+	integer("QUOTA_MONTHLY_QUERIES", &c.Quotas.MonthlyQueries)
+	integer("QUOTA_FLUSH_INTERVAL_SECONDS", &c.Quotas.FlushIntervalSeconds)
+	boolean("QUOTA_REDIS", &c.Quotas.Redis)
+
+	list("PSEUDONYMIZE_SECRETS", &c.Privacy.PseudonymizeSecrets)
+	str("METADATA_ENCRYPTION_KEY", &c.Privacy.MetadataKey)
+	str("METADATA_ENCRYPTION_KMS_KEY", &c.Privacy.MetadataKMSKey)
+	str("KMS_REGION", &c.Privacy.KMSRegion)
+	str("KMS_ENDPOINT", &c.Privacy.KMSEndpoint)
+
+	list("CORS_ALLOW_ORIGINS", &c.CORS.AllowOrigins)
+	list("CORS_ALLOW_METHODS", &c.CORS.AllowMethods)
+	list("CORS_ALLOW_HEADERS", &c.CORS.AllowHeaders)
+	boolean("CORS_ALLOW_CREDENTIALS", &c.CORS.AllowCredentials)
+
+	str("DB_HOST", &c.DB.Host)
+	integer("DB_PORT", &c.DB.Port)
+	str("DB_DATABASE", &c.DB.Database)
+	str("DB_USERNAME", &c.DB.Username)
+	str("DB_PASSWORD", &c.DB.Password)
+	str("DB_SCHEMA", &c.DB.Schema)
+	integer("DB_BREAKER_FAILURE_THRESHOLD", &c.DB.BreakerFailureThreshold)
+	integer("DB_BREAKER_OPEN_SECONDS", &c.DB.BreakerOpenSeconds)
+	integer("DB_STARTUP_WAIT_SECONDS", &c.DB.StartupWaitSeconds)
+	integer("DB_INSERT_BATCH_WINDOW_MS", &c.DB.InsertBatchWindowMillis)
+	integer("DB_INSERT_BATCH_SIZE", &c.DB.InsertBatchSize)
+	list("DB_SHARDS", &c.DB.Shards)
+	mapping("DB_REGIONS", &c.DB.Regions)
+	mapping("DB_PROJECT_REGIONS", &c.DB.ProjectRegions)
+	integer("DB_SLOW_QUERY_MS", &c.DB.SlowQueryMillis)
+	boolean("DB_TIMESCALE", &c.DB.Timescale.Enabled)
+	integer("DB_TIMESCALE_CHUNK_INTERVAL_HOURS", &c.DB.Timescale.ChunkIntervalHours)
+	integer("DB_TIMESCALE_COMPRESS_AFTER_DAYS", &c.DB.Timescale.CompressAfterDays)
+	boolean("DB_COCKROACH", &c.DB.Cockroach)
+
+	list("ACTION_ALLOWLIST", &c.Validation.AllowedActions)
+	str("ACTION_PATTERN", &c.Validation.ActionPattern)
+	integer("ACTION_MAX_LENGTH", &c.Validation.MaxActionLength)
+	integer("METADATA_MAX_KEYS", &c.Validation.MaxMetadataKeys)
+	integer("METADATA_MAX_KEY_LENGTH", &c.Validation.MaxMetadataKeyLength)
+	integer("METADATA_MAX_VALUE_LENGTH", &c.Validation.MaxMetadataValueLength)
+	integer("METADATA_MAX_BYTES", &c.Validation.MaxMetadataBytes)
+	integer("MAX_FUTURE_SKEW_SECONDS", &c.Validation.MaxFutureSkewSeconds)
+	boolean("CLAMP_FUTURE_TIMESTAMPS", &c.Validation.ClampFutureTimestamps)
+	integer("LATE_EVENT_SECONDS", &c.Validation.LateEventSeconds)
+	boolean("SCHEMA_UPGRADE_ON_READ", &c.Validation.UpgradeSchemaOnRead)
+	str("USER_CHECK_URL", &c.UserCheck.URL)
+	str("USER_CHECK_TOKEN", &c.UserCheck.Token)
+	str("USER_CHECK_MODE", &c.UserCheck.Mode)
+	integer("USER_CHECK_TIMEOUT_MS", &c.UserCheck.TimeoutMillis)
+	integer("USER_CHECK_CACHE_SECONDS", &c.UserCheck.CacheSeconds)
+	integer("USER_CHECK_NEGATIVE_CACHE_SECONDS", &c.UserCheck.NegativeCacheSeconds)
+	integer("USER_CHECK_CACHE_SIZE", &c.UserCheck.CacheSize)
+
+	integer("QUERY_CACHE_TTL_SECONDS", &c.QueryCache.TTLSeconds)
+	integer("QUERY_CACHE_SIZE", &c.QueryCache.Size)
+	boolean("QUERY_CACHE_REDIS", &c.QueryCache.Redis)
+
+	str("SENTRY_DSN", &c.Reporting.SentryDSN)
+	str("SENTRY_ENVIRONMENT", &c.Reporting.Environment)
+
+	integer("AGGREGATION_INTERVAL_SECONDS", &c.Aggregation.IntervalSeconds)
+	integer("AGGREGATION_JITTER_SECONDS", &c.Aggregation.JitterSeconds)
+	list("AGGREGATION_EXCLUDE_TAGS", &c.Aggregation.ExcludeTags)
+	integer("SESSIONS_GAP_MINUTES", &c.Sessions.GapMinutes)
+
+	list("KAFKA_BROKERS", &c.Ingest.Kafka.Brokers)
+	str("KAFKA_TOPIC", &c.Ingest.Kafka.Topic)
+	str("KAFKA_GROUP_ID", &c.Ingest.Kafka.GroupID)
+	str("KAFKA_FORMAT", &c.Ingest.Kafka.Format)
+	str("KAFKA_AVRO_SCHEMA_FILE", &c.Ingest.Kafka.AvroSchemaFile)
+	integer("KAFKA_BATCH_SIZE", &c.Ingest.Kafka.BatchSize)
+	integer("KAFKA_BATCH_WAIT_MS", &c.Ingest.Kafka.BatchWaitMillis)
+
+	str("NATS_URL", &c.Ingest.NATS.URL)
+	str("NATS_STREAM", &c.Ingest.NATS.Stream)
+	str("NATS_SUBJECT", &c.Ingest.NATS.Subject)
+	str("NATS_DURABLE", &c.Ingest.NATS.Durable)
+	integer("NATS_CONCURRENCY", &c.Ingest.NATS.Concurrency)
+	integer("NATS_BATCH_SIZE", &c.Ingest.NATS.BatchSize)
+	integer("NATS_BATCH_WAIT_MS", &c.Ingest.NATS.BatchWaitMillis)
+	integer("NATS_ACK_WAIT_SECONDS", &c.Ingest.NATS.AckWaitSeconds)
+
+	str("AMQP_URL", &c.Ingest.AMQP.URL)
+	str("AMQP_QUEUE", &c.Ingest.AMQP.Queue)
+	integer("AMQP_PREFETCH", &c.Ingest.AMQP.Prefetch)
+	integer("AMQP_BATCH_WAIT_MS", &c.Ingest.AMQP.BatchWaitMillis)
+	str("AMQP_DEAD_LETTER_EXCHANGE", &c.Ingest.AMQP.DeadLetterExchange)
+	str("AMQP_DEAD_LETTER_ROUTING_KEY", &c.Ingest.AMQP.DeadLetterRoutingKey)
+
+	str("SQS_QUEUE_URL", &c.Ingest.SQS.QueueURL)
+	str("SQS_REGION", &c.Ingest.SQS.Region)
+	str("SQS_ENDPOINT", &c.Ingest.SQS.Endpoint)
+	integer("SQS_WORKERS", &c.Ingest.SQS.Workers)
+	integer("SQS_WAIT_SECONDS", &c.Ingest.SQS.WaitSeconds)
+	integer("SQS_VISIBILITY_TIMEOUT_SECONDS", &c.Ingest.SQS.VisibilityTimeoutSeconds)
+
+	str("PUBSUB_PROJECT_ID", &c.Ingest.PubSub.ProjectID)
+	str("PUBSUB_SUBSCRIPTION", &c.Ingest.PubSub.Subscription)
+	integer("PUBSUB_MAX_OUTSTANDING_MESSAGES", &c.Ingest.PubSub.MaxOutstandingMessages)
+	integer("PUBSUB_MAX_OUTSTANDING_BYTES", &c.Ingest.PubSub.MaxOutstandingBytes)
+	integer("PUBSUB_NUM_GOROUTINES", &c.Ingest.PubSub.NumGoroutines)
+	integer("PUBSUB_BATCH_SIZE", &c.Ingest.PubSub.BatchSize)
+	integer("PUBSUB_BATCH_WAIT_MS", &c.Ingest.PubSub.BatchWaitMillis)
+
+	str("REDIS_URL", &c.Redis.URL)
+	str("REDIS_STREAM", &c.Ingest.Redis.Stream)
+	str("REDIS_STREAM_GROUP", &c.Ingest.Redis.Group)
+	str("REDIS_STREAM_CONSUMER", &c.Ingest.Redis.Consumer)
+	integer("REDIS_STREAM_BATCH_SIZE", &c.Ingest.Redis.BatchSize)
+	integer("REDIS_STREAM_BLOCK_MS", &c.Ingest.Redis.BlockMillis)
+	integer("REDIS_STREAM_CLAIM_IDLE_SECONDS", &c.Ingest.Redis.ClaimIdleSeconds)
+
+	boolean("INGEST_ASYNC", &c.Ingest.Buffer.Async)
+	integer("INGEST_BUFFER_SIZE", &c.Ingest.Buffer.Size)
+	integer("INGEST_FLUSH_BATCH_SIZE", &c.Ingest.Buffer.FlushBatchSize)
+	integer("INGEST_FLUSH_INTERVAL_MS", &c.Ingest.Buffer.FlushIntervalMillis)
+	integer("INGEST_ENQUEUE_WAIT_MS", &c.Ingest.Buffer.EnqueueWaitMillis)
+	integer("DEDUP_WINDOW_SECONDS", &c.Ingest.Dedup.WindowSeconds)
+	integer("DEDUP_CACHE_SIZE", &c.Ingest.Dedup.CacheSize)
+
+	str("SPOOL_DIR", &c.Spool.Dir)
+	integer("SPOOL_MAX_SIZE_MB", &c.Spool.MaxSizeMB)
+	integer("SPOOL_REPLAY_BATCH_SIZE", &c.Spool.ReplayBatchSize)
+	integer("SPOOL_REPLAY_INTERVAL_MS", &c.Spool.ReplayIntervalMillis)
+
+	str("DEADLETTER_DIR", &c.DeadLetter.Dir)
+	integer("DEADLETTER_MAX_RETRY_SECONDS", &c.DeadLetter.MaxRetrySeconds)
+
+	str("IMPORT_DIR", &c.Import.Dir)
+	integer("IMPORT_MAX_UPLOAD_MB", &c.Import.MaxUploadMB)
+	integer("IMPORT_BATCH_SIZE", &c.Import.BatchSize)
+	integer("IMPORT_MAX_JOBS", &c.Import.MaxJobs)
+	str("JOBS_DIR", &c.Jobs.Dir)
+	integer("JOBS_WORKERS", &c.Jobs.Workers)
+	integer("JOBS_STALE_SECONDS", &c.Jobs.StaleSeconds)
+	integer("JOBS_RETENTION_HOURS", &c.Jobs.RetentionHours)
+
+	str("EXPORT_BUCKET", &c.Export.Bucket)
+	str("EXPORT_PREFIX", &c.Export.Prefix)
+	str("EXPORT_REGION", &c.Export.Region)
+	str("EXPORT_ENDPOINT", &c.Export.Endpoint)
+	boolean("EXPORT_USE_PATH_STYLE", &c.Export.UsePathStyle)
+	str("EXPORT_FORMAT", &c.Export.Format)
+	str("EXPORT_SCHEDULE", &c.Export.Schedule)
+	integer("EXPORT_WINDOW_MINUTES", &c.Export.WindowMinutes)
+	integer("EXPORT_LOOKBACK_WINDOWS", &c.Export.LookbackWindows)
+	integer("EXPORT_SETTLE_SECONDS", &c.Export.SettleSeconds)
+	integer("EXPORT_MAX_ROWS_PER_FILE", &c.Export.MaxRowsPerFile)
+
+	boolean("SINK_WEBHOOKS_ENABLED", &c.Sinks.Webhooks.Enabled)
+	integer("SINK_WEBHOOKS_POLL_INTERVAL_MS", &c.Sinks.Webhooks.PollIntervalMillis)
+	integer("SINK_WEBHOOKS_SETTLE_MS", &c.Sinks.Webhooks.SettleMillis)
+	integer("SINK_WEBHOOKS_BATCH_SIZE", &c.Sinks.Webhooks.BatchSize)
+	integer("SINK_WEBHOOKS_WORKERS", &c.Sinks.Webhooks.Workers)
+	integer("SINK_WEBHOOKS_TIMEOUT_SECONDS", &c.Sinks.Webhooks.TimeoutSeconds)
+	integer("SINK_WEBHOOKS_MAX_ATTEMPTS", &c.Sinks.Webhooks.MaxAttempts)
+	integer("SINK_WEBHOOKS_RETENTION_HOURS", &c.Sinks.Webhooks.RetentionHours)
+	list("SINK_KAFKA_BROKERS", &c.Sinks.Kafka.Brokers)
+	str("SINK_KAFKA_TOPIC", &c.Sinks.Kafka.Topic)
+	integer("SINK_KAFKA_POLL_INTERVAL_MS", &c.Sinks.Kafka.PollIntervalMillis)
+	integer("SINK_KAFKA_SETTLE_MS", &c.Sinks.Kafka.SettleMillis)
+	integer("SINK_KAFKA_BATCH_SIZE", &c.Sinks.Kafka.BatchSize)
+	str("SINK_KAFKA_FORMAT", &c.Sinks.Kafka.Format)
+	str("SINK_ELASTICSEARCH_URL", &c.Sinks.Elasticsearch.URL)
+	str("SINK_ELASTICSEARCH_INDEX", &c.Sinks.Elasticsearch.Index)
+	str("SINK_ELASTICSEARCH_USERNAME", &c.Sinks.Elasticsearch.Username)
+	str("SINK_ELASTICSEARCH_PASSWORD", &c.Sinks.Elasticsearch.Password)
+	str("SINK_ELASTICSEARCH_API_KEY", &c.Sinks.Elasticsearch.APIKey)
+	integer("SINK_ELASTICSEARCH_POLL_INTERVAL_MS", &c.Sinks.Elasticsearch.PollIntervalMillis)
+	integer("SINK_ELASTICSEARCH_SETTLE_MS", &c.Sinks.Elasticsearch.SettleMillis)
+	integer("SINK_ELASTICSEARCH_BATCH_SIZE", &c.Sinks.Elasticsearch.BatchSize)
+	integer("SINK_ELASTICSEARCH_TIMEOUT_SECONDS", &c.Sinks.Elasticsearch.TimeoutSeconds)
+	integer("SINK_ELASTICSEARCH_MAX_RETRIES", &c.Sinks.Elasticsearch.MaxRetries)
+
+	str("FEDERATION_TOKEN", &c.Federation.Token)
+	str("FORWARD_URL", &c.Federation.Forward.URL)
+	str("FORWARD_TOKEN", &c.Federation.Forward.Token)
+	str("FORWARD_SIGNING_SECRET", &c.Federation.Forward.SigningSecret)
+	str("FORWARD_ORIGIN", &c.Federation.Forward.Origin)
+	integer("FORWARD_POLL_INTERVAL_MS", &c.Federation.Forward.PollIntervalMillis)
+	integer("FORWARD_SETTLE_MS", &c.Federation.Forward.SettleMillis)
+	integer("FORWARD_BATCH_SIZE", &c.Federation.Forward.BatchSize)
+	integer("FORWARD_TIMEOUT_SECONDS", &c.Federation.Forward.TimeoutSeconds)
+
+	str("REPORT_PERIOD", &c.Reports.Period)
+	str("REPORT_SCHEDULE", &c.Reports.Schedule)
+	integer("REPORT_TOP_ACTIONS", &c.Reports.TopActions)
+	str("REPORT_SLACK_WEBHOOK_URL", &c.Reports.SlackWebhookURL)
+	str("REPORT_SMTP_HOST", &c.Reports.SMTP.Host)
+	integer("REPORT_SMTP_PORT", &c.Reports.SMTP.Port)
+	str("REPORT_SMTP_USERNAME", &c.Reports.SMTP.Username)
+	str("REPORT_SMTP_PASSWORD", &c.Reports.SMTP.Password)
+	str("REPORT_SMTP_FROM", &c.Reports.SMTP.From)
+	list("REPORT_SMTP_TO", &c.Reports.SMTP.To)
+
+	boolean("ANOMALY_ENABLED", &c.Anomaly.Enabled)
+	integer("ANOMALY_CHECK_INTERVAL_SECONDS", &c.Anomaly.CheckIntervalSeconds)
+	integer("ANOMALY_WINDOW_MINUTES", &c.Anomaly.WindowMinutes)
+	integer("ANOMALY_BASELINE_HOURS", &c.Anomaly.BaselineHours)
+	integer("ANOMALY_FACTOR", &c.Anomaly.Factor)
+	integer("ANOMALY_MIN_EVENTS", &c.Anomaly.MinEvents)
+	str("ANOMALY_SLACK_WEBHOOK_URL", &c.Anomaly.SlackWebhookURL)
+	str("ANOMALY_WEBHOOK_URL", &c.Anomaly.WebhookURL)
+
+	boolean("ALERTS_ENABLED", &c.Alerts.Enabled)
+	integer("ALERTS_CHECK_INTERVAL_SECONDS", &c.Alerts.CheckIntervalSeconds)
+	str("ALERTS_SLACK_WEBHOOK_URL", &c.Alerts.SlackWebhookURL)
+	str("ALERTS_WEBHOOK_URL", &c.Alerts.WebhookURL)
+	list("FEATURE_FLAGS", &c.Flags.Enabled)
+	integer("FEATURE_FLAGS_REFRESH_SECONDS", &c.Flags.RefreshSeconds)
+	integer("ARCHIVE_AFTER_DAYS", &c.Archive.AfterDays)
+	integer("ARCHIVE_INTERVAL_MINUTES", &c.Archive.IntervalMinutes)
+	integer("ARCHIVE_BATCH_SIZE", &c.Archive.BatchSize)
+
+	integer("SCHEDULED_EVENTS_INTERVAL_SECONDS", &c.Scheduled.IntervalSeconds)
+	integer("SCHEDULED_EVENTS_BATCH_SIZE", &c.Scheduled.BatchSize)
+	integer("SCHEDULED_EVENTS_MAX_DELAY_DAYS", &c.Scheduled.MaxDelayDays)
+	integer("EVENT_TTL_CLEANUP_INTERVAL_SECONDS", &c.TTL.IntervalSeconds)
+	integer("EVENT_TTL_CLEANUP_BATCH_SIZE", &c.TTL.BatchSize)
+
+	// Secrets of the webhook providers declared in the file, e.g.
+	// WEBHOOK_GITHUB_SECRET for the "github" provider
+	for name, w := range c.Webhooks {
+		str("WEBHOOK_"+strings.ToUpper(strings.ReplaceAll(name, "-", "_"))+"_SECRET", &w.Secret)
+		c.Webhooks[name] = w
+	}
+
+	str("LOG_LEVEL", &c.Log.Level)
+	str("LOG_FORMAT", &c.Log.Format)
+	integer("LOG_REQUEST_SAMPLE_RATE", &c.Log.RequestSampleRate)
+	integer("LOG_SLOW_REQUEST_MS", &c.Log.SlowRequestMillis)
+	list("LOG_EXCLUDE_PATHS", &c.Log.ExcludePaths)
+	str("LOG_OUTPUT", &c.Log.Output)
+	str("LOG_FILE_PATH", &c.Log.File.Path)
+	integer("LOG_FILE_MAX_SIZE_MB", &c.Log.File.MaxSizeMB)
+	integer("LOG_FILE_MAX_BACKUPS", &c.Log.File.MaxBackups)
+	boolean("LOG_FILE_COMPRESS", &c.Log.File.Compress)
+
+	integer("DEBUG_RECORD_REQUESTS", &c.Debug.RecordRequests)
+	str("DEBUG_RECORD_FILE", &c.Debug.RecordFile)
+	integer("DEBUG_RECORD_MAX_BODY_KB", &c.Debug.RecordMaxBodyKB)
+
+	integer("SHUTDOWN_READINESS_DELAY_SECONDS", &c.Shutdown.ReadinessDelaySeconds)
+	integer("SHUTDOWN_AGGREGATOR_TIMEOUT_SECONDS", &c.Shutdown.AggregatorTimeoutSeconds)
+	integer("SHUTDOWN_INGEST_TIMEOUT_SECONDS", &c.Shutdown.IngestTimeoutSeconds)
+	integer("SHUTDOWN_HTTP_TIMEOUT_SECONDS", &c.Shutdown.HTTPTimeoutSeconds)
+	integer("SHUTDOWN_DB_TIMEOUT_SECONDS", &c.Shutdown.DBTimeoutSeconds)
+
+	return errs
+}
+
+// validate checks semantic constraints, so that missing or out of range
+// settings are reported before any socket or connection is opened.
+func (c *Config) validate() []error {
+	var errs []error
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("PORT must be 1-65535, got %d", c.Server.Port))
+	}
+	if c.Server.BasePath != "" && !strings.HasPrefix(c.Server.BasePath, "/") {
+		errs = append(errs, fmt.Errorf("BASE_PATH must start with \"/\", got %q", c.Server.BasePath))
+	}
+	if c.Server.IdleTimeoutSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("IDLE_TIMEOUT_SECONDS must be a positive integer"))
+	}
+	if c.Server.ReadTimeoutSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("READ_TIMEOUT_SECONDS must be a positive integer"))
+	}
+	if c.Server.WriteTimeoutSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("WRITE_TIMEOUT_SECONDS must be a positive integer"))
+	}
+
+	for _, t := range []struct {
+		name  string
+		value int
+	}{
+		{"INGEST_REQUEST_TIMEOUT_SECONDS", c.Server.IngestRequestTimeoutSeconds},
+		{"QUERY_REQUEST_TIMEOUT_SECONDS", c.Server.QueryRequestTimeoutSeconds},
+	} {
+		if t.value <= 0 || t.value >= c.Server.WriteTimeoutSeconds {
+			errs = append(errs, fmt.Errorf("%s must be positive and lower than WRITE_TIMEOUT_SECONDS, got %d", t.name, t.value))
+		}
+	}
+
+	if c.Server.MaxInFlightRequests < 0 {
+		errs = append(errs, fmt.Errorf("MAX_IN_FLIGHT_REQUESTS must not be negative"))
+	}
+	if c.Server.ShedRetryAfterSeconds < 1 {
+		errs = append(errs, fmt.Errorf("SHED_RETRY_AFTER_SECONDS must be a positive integer"))
+	}
+	if c.Server.DefaultEventsLimit < 1 || c.Server.MaxEventsLimit < c.Server.DefaultEventsLimit {
+		errs = append(errs, fmt.Errorf("EVENTS_DEFAULT_LIMIT must be a positive integer no greater than EVENTS_MAX_LIMIT"))
+	}
+	if c.Server.EventsExportTimeoutSeconds < 1 {
+		errs = append(errs, fmt.Errorf("EVENTS_EXPORT_TIMEOUT_SECONDS must be a positive integer"))
+	}
+	if c.Server.EventsFlushIntervalMillis < 0 {
+		errs = append(errs, fmt.Errorf("EVENTS_FLUSH_INTERVAL_MS must not be negative"))
+	}
+	for _, l := range []struct {
+		name  string
+		cidrs []string
+	}{
+		{"ALLOW_CIDRS", c.Server.AllowCIDRs},
+		{"DENY_CIDRS", c.Server.DenyCIDRs},
+		{"TRUSTED_PROXIES", c.Server.TrustedProxies},
+		{"ADMIN_ALLOW_CIDRS", c.Admin.AllowCIDRs},
+		{"ADMIN_DENY_CIDRS", c.Admin.DenyCIDRs},
+	} {
+		if _, err := ParseCIDRs(l.cidrs); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", l.name, err))
+		}
+	}
+
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together"))
+	}
+	for _, f := range []struct{ name, path string }{
+		{"TLS_CERT_FILE", c.TLS.CertFile},
+		{"TLS_KEY_FILE", c.TLS.KeyFile},
+	} {
+		if f.path == "" {
+			continue
+		}
+		if _, err := os.Stat(f.path); err != nil {
+			errs = append(errs, fmt.Errorf("%s is not readable: %w", f.name, err))
+		}
+	}
+	if c.TLS.ACMEEnabled() {
+		if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+			errs = append(errs, fmt.Errorf("TLS_ACME_DOMAINS cannot be combined with TLS_CERT_FILE and TLS_KEY_FILE"))
+		}
+		if c.TLS.ACMECacheDir == "" {
+			errs = append(errs, fmt.Errorf("TLS_ACME_CACHE_DIR required when TLS_ACME_DOMAINS is set"))
+		}
+	}
+	if c.TLS.RedirectPort != 0 {
+		if !c.TLS.Enabled() {
+			errs = append(errs, fmt.Errorf("TLS_REDIRECT_PORT requires TLS_CERT_FILE and TLS_KEY_FILE or TLS_ACME_DOMAINS"))
+		}
+		if c.TLS.RedirectPort < 1 || c.TLS.RedirectPort > 65535 || c.TLS.RedirectPort == c.Server.Port {
+			errs = append(errs, fmt.Errorf("TLS_REDIRECT_PORT must be 1-65535 and differ from PORT, got %d", c.TLS.RedirectPort))
+		}
+	}
+
+	if c.Admin.Port < 1 || c.Admin.Port > 65535 || c.Admin.Port == c.Server.Port || c.Admin.Port == c.TLS.RedirectPort {
+		errs = append(errs, fmt.Errorf("ADMIN_PORT must be 1-65535 and differ from PORT and TLS_REDIRECT_PORT, got %d", c.Admin.Port))
+	}
+	// Both commands may run on the same host with the same configuration
+	if c.Worker.Port < 1 || c.Worker.Port > 65535 || c.Worker.Port == c.Server.Port || c.Worker.Port == c.Admin.Port || c.Worker.Port == c.TLS.RedirectPort {
+		errs = append(errs, fmt.Errorf("WORKER_PORT must be 1-65535 and differ from PORT, ADMIN_PORT and TLS_REDIRECT_PORT, got %d", c.Worker.Port))
+	}
+
+	if q := c.Quotas; q.DailyEvents < 0 || q.MonthlyEvents < 0 || q.DailyQueries < 0 || q.MonthlyQueries < 0 {
+		errs = append(errs, fmt.Errorf("QUOTA_DAILY_EVENTS, QUOTA_MONTHLY_EVENTS, QUOTA_DAILY_QUERIES and QUOTA_MONTHLY_QUERIES must not be negative"))
+	}
+	if c.Quotas.FlushIntervalSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("QUOTA_FLUSH_INTERVAL_SECONDS must be a positive integer, got %d", c.Quotas.FlushIntervalSeconds))
+	}
+	if c.Quotas.Redis && c.Redis.URL == "" {
+		errs = append(errs, fmt.Errorf("REDIS_URL required when QUOTA_REDIS is set"))
+	}
+
+	for i, secret := range c.Auth.SigningSecrets {
+		if len(secret) < 16 {
+			errs = append(errs, fmt.Errorf("SIGNING_SECRETS[%d] must be at least 16 bytes long", i))
+		}
+	}
+	if c.Auth.RequireSignature && len(c.Auth.SigningSecrets) == 0 {
+		errs = append(errs, fmt.Errorf("REQUIRE_SIGNATURE requires SIGNING_SECRETS"))
+	}
+	if c.Auth.SignatureWindowSeconds < 1 {
+		errs = append(errs, fmt.Errorf("SIGNATURE_WINDOW_SECONDS must be a positive integer, got %d", c.Auth.SignatureWindowSeconds))
+	}
+
+	for i, secret := range c.Privacy.PseudonymizeSecrets {
+		if len(secret) < 16 {
+			errs = append(errs, fmt.Errorf("PSEUDONYMIZE_SECRETS[%d] must be at least 16 bytes long", i))
+		}
+	}
+	if p := c.Privacy; p.MetadataKey != "" && p.MetadataKMSKey != "" {
+		errs = append(errs, fmt.Errorf("METADATA_ENCRYPTION_KEY and METADATA_ENCRYPTION_KMS_KEY are mutually exclusive"))
+	}
+	if key := c.Privacy.MetadataKey; key != "" {
+		if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 32 {
+			errs = append(errs, fmt.Errorf("METADATA_ENCRYPTION_KEY must be the base64 of a 32 bytes key"))
+		}
+	}
+	if key := c.Privacy.MetadataKMSKey; key != "" {
+		if _, err := base64.StdEncoding.DecodeString(key); err != nil {
+			errs = append(errs, fmt.Errorf("METADATA_ENCRYPTION_KMS_KEY must be base64: %v", err))
+		}
+	}
+
+	if len(c.CORS.AllowOrigins) == 0 {
+		errs = append(errs, fmt.Errorf("CORS_ALLOW_ORIGINS requires at least one origin"))
+	}
+	if len(c.CORS.AllowMethods) == 0 {
+		errs = append(errs, fmt.Errorf("CORS_ALLOW_METHODS requires at least one method"))
+	}
+
+	if c.DB.Host == "" {
+		errs = append(errs, fmt.Errorf("DB_HOST required"))
+	}
+	if c.DB.Port < 1 || c.DB.Port > 65535 {
+		errs = append(errs, fmt.Errorf("DB_PORT must be 1-65535, got %d", c.DB.Port))
+	}
+	if c.DB.Database == "" {
+		errs = append(errs, fmt.Errorf("DB_DATABASE required"))
+	}
+	if c.DB.Username == "" {
+		errs = append(errs, fmt.Errorf("DB_USERNAME required"))
+	}
+	if c.DB.Schema == "" {
+		errs = append(errs, fmt.Errorf("DB_SCHEMA required"))
+	}
+	if c.DB.BreakerFailureThreshold < 0 {
+		errs = append(errs, fmt.Errorf("DB_BREAKER_FAILURE_THRESHOLD must not be negative"))
+	}
+	if c.DB.BreakerFailureThreshold > 0 && c.DB.BreakerOpenSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("DB_BREAKER_OPEN_SECONDS must be a positive integer"))
+	}
+	if c.DB.StartupWaitSeconds < 0 {
+		errs = append(errs, fmt.Errorf("DB_STARTUP_WAIT_SECONDS must not be negative"))
+	}
+	if c.DB.InsertBatchWindowMillis < 0 || c.DB.InsertBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("DB_INSERT_BATCH_WINDOW_MS must not be negative and DB_INSERT_BATCH_SIZE must be a positive integer"))
+	}
+	if c.DB.SlowQueryMillis < 0 {
+		errs = append(errs, fmt.Errorf("DB_SLOW_QUERY_MS must not be negative"))
+	}
+	for _, shard := range c.DB.Shards {
+		if u, err := url.Parse(shard); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("DB_SHARDS must hold postgres:// URLs"))
+			break
+		}
+	}
+	if len(c.DB.Shards) == 1 {
+		errs = append(errs, fmt.Errorf("DB_SHARDS must hold at least 2 databases"))
+	}
+	if len(c.DB.Shards) > 0 && c.DB.InsertBatchWindowMillis > 0 {
+		errs = append(errs, fmt.Errorf("DB_INSERT_BATCH_WINDOW_MS is not supported with DB_SHARDS"))
+	}
+	// They follow the events or the aggregates of the main database, which
+	// holds none with shards
+	if len(c.DB.Shards) > 0 && (c.Export.Enabled() || c.Sinks.Webhooks.Enabled || c.Sinks.Kafka.Enabled() ||
+		c.Sinks.Elasticsearch.Enabled() || c.Federation.Forward.Enabled() || c.Reports.Enabled() || c.Anomaly.Enabled || c.Alerts.Enabled || c.Archive.Enabled()) {
+		errs = append(errs, fmt.Errorf("DB_SHARDS cannot be used with exports, sinks, forwarding, reports, anomaly detection, alerts or archival"))
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.DB.Regions)) {
+		if name == "" {
+			errs = append(errs, fmt.Errorf("DB_REGIONS must name every region"))
+		}
+		if u, err := url.Parse(c.DB.Regions[name]); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("DB_REGIONS must hold postgres:// URLs, got an invalid one for %q", name))
+		}
+	}
+	for _, project := range slices.Sorted(maps.Keys(c.DB.ProjectRegions)) {
+		region := c.DB.ProjectRegions[project]
+		if id, err := strconv.ParseInt(project, 10, 64); err != nil || id < 1 {
+			errs = append(errs, fmt.Errorf("DB_PROJECT_REGIONS must map positive project ids, got %q", project))
+		}
+		if _, ok := c.DB.Regions[region]; !ok {
+			errs = append(errs, fmt.Errorf("DB_PROJECT_REGIONS maps project %s to %q, which is not in DB_REGIONS", project, region))
+		}
+	}
+	if len(c.DB.Regions) > 0 {
+		if len(c.DB.ProjectRegions) == 0 {
+			errs = append(errs, fmt.Errorf("DB_PROJECT_REGIONS required when DB_REGIONS is set"))
+		}
+		// The batcher writes to the main database alone, and the hypertable
+		// and CockroachDB modes apply to it alone
+		if len(c.DB.Shards) > 0 || c.DB.InsertBatchWindowMillis > 0 || c.DB.Timescale.Enabled || c.DB.Cockroach {
+			errs = append(errs, fmt.Errorf("DB_REGIONS cannot be used with DB_SHARDS, DB_INSERT_BATCH_WINDOW_MS, DB_TIMESCALE or DB_COCKROACH"))
+		}
+		if c.Export.Enabled() || c.Sinks.Webhooks.Enabled || c.Sinks.Kafka.Enabled() || c.Sinks.Elasticsearch.Enabled() ||
+			c.Federation.Forward.Enabled() || c.Reports.Enabled() || c.Anomaly.Enabled || c.Alerts.Enabled || c.Archive.Enabled() {
+			errs = append(errs, fmt.Errorf("DB_REGIONS cannot be used with exports, sinks, forwarding, reports, anomaly detection, alerts or archival"))
+		}
+	}
+	// CockroachDB spreads the events across its nodes itself
+	if c.DB.Cockroach && (len(c.DB.Shards) > 0 || c.DB.Timescale.Enabled) {
+		errs = append(errs, fmt.Errorf("DB_COCKROACH cannot be used with DB_SHARDS or DB_TIMESCALE"))
+	}
+	if t := c.DB.Timescale; t.Enabled {
+		if t.ChunkIntervalHours < 1 || t.CompressAfterDays < 0 {
+			errs = append(errs, fmt.Errorf("DB_TIMESCALE_CHUNK_INTERVAL_HOURS must be a positive integer and DB_TIMESCALE_COMPRESS_AFTER_DAYS must not be negative"))
+		}
+		// The hypertable is created in the main database, and its
+		// compressed chunks replace the archive
+		if len(c.DB.Shards) > 0 || c.Archive.Enabled() {
+			errs = append(errs, fmt.Errorf("DB_TIMESCALE cannot be used with DB_SHARDS or ARCHIVE_AFTER_DAYS"))
+		}
+	}
+
+	if _, err := regexp.Compile(c.Validation.ActionPattern); err != nil {
+		errs = append(errs, fmt.Errorf("ACTION_PATTERN is not a valid regular expression: %w", err))
+	}
+	if v := c.Validation; v.MaxActionLength < 0 || v.MaxMetadataKeys < 0 || v.MaxMetadataKeyLength < 0 || v.MaxMetadataValueLength < 0 || v.MaxMetadataBytes < 0 {
+		errs = append(errs, fmt.Errorf("ACTION_MAX_LENGTH, METADATA_MAX_KEYS, METADATA_MAX_KEY_LENGTH, METADATA_MAX_VALUE_LENGTH and METADATA_MAX_BYTES must not be negative"))
+	}
+	if c.Validation.MaxFutureSkewSeconds < 0 || c.Validation.LateEventSeconds < 0 {
+		errs = append(errs, fmt.Errorf("MAX_FUTURE_SKEW_SECONDS and LATE_EVENT_SECONDS must not be negative"))
+	}
+	versions := make(map[int]bool, len(c.Validation.SchemaVersions))
+	for _, v := range c.Validation.SchemaVersions {
+		if v.Version < 1 || versions[v.Version] {
+			errs = append(errs, fmt.Errorf("schema_versions must hold distinct positive versions, got %d", v.Version))
+		}
+		if v.Version == 1 && (len(v.RenameActions) > 0 || v.DefaultPage != "") {
+			errs = append(errs, fmt.Errorf("schema version 1 has no previous version to upgrade"))
+		}
+		versions[v.Version] = true
+	}
+
+	if u := c.UserCheck; u.Enabled() {
+		if parsed, err := url.Parse(u.URL); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || !strings.Contains(u.URL, "{user_id}") {
+			errs = append(errs, fmt.Errorf("USER_CHECK_URL must be an http(s) URL holding {user_id}"))
+		}
+		if u.Mode != "reject" && u.Mode != "flag" && u.Mode != "allow" {
+			errs = append(errs, fmt.Errorf("USER_CHECK_MODE must be reject, flag or allow"))
+		}
+		if u.TimeoutMillis < 1 {
+			errs = append(errs, fmt.Errorf("USER_CHECK_TIMEOUT_MS must be a positive integer"))
+		}
+		if u.CacheSeconds < 0 || u.NegativeCacheSeconds < 0 || u.CacheSize < 0 {
+			errs = append(errs, fmt.Errorf("USER_CHECK_CACHE_SECONDS, USER_CHECK_NEGATIVE_CACHE_SECONDS and USER_CHECK_CACHE_SIZE must not be negative"))
+		}
+	}
+
+	if c.QueryCache.TTLSeconds < 0 || (c.QueryCache.Enabled() && c.QueryCache.Size < 1) {
+		errs = append(errs, fmt.Errorf("QUERY_CACHE_TTL_SECONDS must not be negative and QUERY_CACHE_SIZE must be a positive integer"))
+	}
+	if c.QueryCache.Redis && c.Redis.URL == "" {
+		errs = append(errs, fmt.Errorf("REDIS_URL required when QUERY_CACHE_REDIS is set"))
+	}
+
+	if c.Aggregation.IntervalSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("AGGREGATION_INTERVAL_SECONDS must be a positive integer"))
+	}
+	if c.Aggregation.JitterSeconds < 0 || c.Aggregation.JitterSeconds >= c.Aggregation.IntervalSeconds {
+		errs = append(errs, fmt.Errorf("AGGREGATION_JITTER_SECONDS must be between 0 and AGGREGATION_INTERVAL_SECONDS"))
+	}
+	for _, tag := range c.Aggregation.ExcludeTags {
+		if !tagName.MatchString(tag) {
+			errs = append(errs, fmt.Errorf("AGGREGATION_EXCLUDE_TAGS must hold tags of 1 to 64 letters, digits, '_', '.', ':' or '-', got %q", tag))
+		}
+	}
+	if c.Sessions.GapMinutes <= 0 {
+		errs = append(errs, fmt.Errorf("SESSIONS_GAP_MINUTES must be a positive integer"))
+	}
+	if k := c.Ingest.Kafka; k.Enabled() {
+		if k.Topic == "" || k.GroupID == "" {
+			errs = append(errs, fmt.Errorf("KAFKA_TOPIC and KAFKA_GROUP_ID required when KAFKA_BROKERS is set"))
+		}
+		switch k.Format {
+		case "json", "protobuf":
+		case "avro":
+			if k.AvroSchemaFile == "" {
+				errs = append(errs, fmt.Errorf("KAFKA_AVRO_SCHEMA_FILE required when KAFKA_FORMAT is avro"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("KAFKA_FORMAT must be json, avro or protobuf, got %q", k.Format))
+		}
+		if k.BatchSize < 1 || k.BatchWaitMillis < 1 {
+			errs = append(errs, fmt.Errorf("KAFKA_BATCH_SIZE and KAFKA_BATCH_WAIT_MS must be positive integers"))
+		}
+	}
+
+	if n := c.Ingest.NATS; n.Enabled() {
+		if n.Stream == "" || n.Durable == "" {
+			errs = append(errs, fmt.Errorf("NATS_STREAM and NATS_DURABLE required when NATS_URL is set"))
+		}
+		if n.Concurrency < 1 || n.BatchSize < 1 || n.BatchWaitMillis < 1 {
+			errs = append(errs, fmt.Errorf("NATS_CONCURRENCY, NATS_BATCH_SIZE and NATS_BATCH_WAIT_MS must be positive integers"))
+		}
+		if n.AckWaitSeconds < 1 || n.AckWaitSeconds*1000 <= n.BatchWaitMillis {
+			errs = append(errs, fmt.Errorf("NATS_ACK_WAIT_SECONDS must be positive and longer than NATS_BATCH_WAIT_MS"))
+		}
+	}
+
+	if a := c.Ingest.AMQP; a.Enabled() {
+		if a.Queue == "" {
+			errs = append(errs, fmt.Errorf("AMQP_QUEUE required when AMQP_URL is set"))
+		}
+		if a.Prefetch < 1 || a.BatchWaitMillis < 1 {
+			errs = append(errs, fmt.Errorf("AMQP_PREFETCH and AMQP_BATCH_WAIT_MS must be positive integers"))
+		}
+		if a.DeadLetterRoutingKey != "" && a.DeadLetterExchange == "" {
+			errs = append(errs, fmt.Errorf("AMQP_DEAD_LETTER_ROUTING_KEY requires AMQP_DEAD_LETTER_EXCHANGE"))
+		}
+	}
+
+	if q := c.Ingest.SQS; q.Enabled() {
+		if q.Workers < 1 {
+			errs = append(errs, fmt.Errorf("SQS_WORKERS must be a positive integer"))
+		}
+		if q.WaitSeconds < 0 || q.WaitSeconds > 20 {
+			errs = append(errs, fmt.Errorf("SQS_WAIT_SECONDS must be 0-20, got %d", q.WaitSeconds))
+		}
+		if q.VisibilityTimeoutSeconds < 2 || q.VisibilityTimeoutSeconds > 43200 {
+			errs = append(errs, fmt.Errorf("SQS_VISIBILITY_TIMEOUT_SECONDS must be 2-43200, got %d", q.VisibilityTimeoutSeconds))
+		}
+	}
+
+	if p := c.Ingest.PubSub; p.Enabled() {
+		if p.ProjectID == "" {
+			errs = append(errs, fmt.Errorf("PUBSUB_PROJECT_ID required when PUBSUB_SUBSCRIPTION is set"))
+		}
+		if p.MaxOutstandingMessages < 1 || p.MaxOutstandingBytes < 1 || p.NumGoroutines < 1 {
+			errs = append(errs, fmt.Errorf("PUBSUB_MAX_OUTSTANDING_MESSAGES, PUBSUB_MAX_OUTSTANDING_BYTES and PUBSUB_NUM_GOROUTINES must be positive integers"))
+		}
+		if p.BatchSize < 1 || p.BatchSize > p.MaxOutstandingMessages || p.BatchWaitMillis < 1 {
+			errs = append(errs, fmt.Errorf("PUBSUB_BATCH_SIZE must be 1-PUBSUB_MAX_OUTSTANDING_MESSAGES and PUBSUB_BATCH_WAIT_MS positive"))
+		}
+	}
+
+	if r := c.Ingest.Redis; r.Enabled() {
+		if c.Redis.URL == "" {
+			errs = append(errs, fmt.Errorf("REDIS_URL required when REDIS_STREAM is set"))
+		}
+		if r.Group == "" {
+			errs = append(errs, fmt.Errorf("REDIS_STREAM_GROUP required when REDIS_STREAM is set"))
+		}
+		if r.BatchSize < 1 || r.BlockMillis < 1 || r.ClaimIdleSeconds < 1 {
+			errs = append(errs, fmt.Errorf("REDIS_STREAM_BATCH_SIZE, REDIS_STREAM_BLOCK_MS and REDIS_STREAM_CLAIM_IDLE_SECONDS must be positive integers"))
+		}
+	}
+
+	if b := c.Ingest.Buffer; b.Async {
+		if b.Size < 1 || b.FlushBatchSize < 1 || b.FlushIntervalMillis < 1 {
+			errs = append(errs, fmt.Errorf("INGEST_BUFFER_SIZE, INGEST_FLUSH_BATCH_SIZE and INGEST_FLUSH_INTERVAL_MS must be positive integers"))
+		} else if b.FlushBatchSize > b.Size {
+			errs = append(errs, fmt.Errorf("INGEST_FLUSH_BATCH_SIZE (%d) cannot exceed INGEST_BUFFER_SIZE (%d)", b.FlushBatchSize, b.Size))
+		}
+		if b.EnqueueWaitMillis < 0 {
+			errs = append(errs, fmt.Errorf("INGEST_ENQUEUE_WAIT_MS must be 0 or a positive integer"))
+		}
+		if b.EnqueueWaitMillis >= c.Server.IngestRequestTimeoutSeconds*1000 {
+			errs = append(errs, fmt.Errorf("INGEST_ENQUEUE_WAIT_MS must be lower than INGEST_REQUEST_TIMEOUT_SECONDS"))
+		}
+	}
+
+	if d := c.Ingest.Dedup; d.WindowSeconds < 0 || d.CacheSize < 0 {
+		errs = append(errs, fmt.Errorf("DEDUP_WINDOW_SECONDS and DEDUP_CACHE_SIZE must be 0 or positive integers"))
+	} else if d.Enabled() && c.Ingest.Buffer.Async {
+		errs = append(errs, fmt.Errorf("DEDUP_WINDOW_SECONDS cannot be used with INGEST_ASYNC, whose events are not stored yet when they are acknowledged"))
+	}
+
+	if sp := c.Spool; sp.Enabled() && (sp.MaxSizeMB < 1 || sp.ReplayBatchSize < 1 || sp.ReplayIntervalMillis < 1) {
+		errs = append(errs, fmt.Errorf("SPOOL_MAX_SIZE_MB, SPOOL_REPLAY_BATCH_SIZE and SPOOL_REPLAY_INTERVAL_MS must be positive integers"))
+	}
+
+	if d := c.DeadLetter; d.Enabled() && d.MaxRetrySeconds < 1 {
+		errs = append(errs, fmt.Errorf("DEADLETTER_MAX_RETRY_SECONDS must be a positive integer"))
+	}
+
+	if i := c.Import; i.Enabled() && (i.MaxUploadMB < 1 || i.BatchSize < 1 || i.MaxJobs < 1) {
+		errs = append(errs, fmt.Errorf("IMPORT_MAX_UPLOAD_MB, IMPORT_BATCH_SIZE and IMPORT_MAX_JOBS must be positive integers"))
+	}
+	if j := c.Jobs; j.Enabled() && (j.Workers < 1 || j.StaleSeconds < 1 || j.RetentionHours < 1) {
+		errs = append(errs, fmt.Errorf("JOBS_WORKERS, JOBS_STALE_SECONDS and JOBS_RETENTION_HOURS must be positive integers"))
+	}
+
+	if e := c.Export; e.Enabled() {
+		if e.Format != "parquet" && e.Format != "csv" {
+			errs = append(errs, fmt.Errorf("EXPORT_FORMAT must be parquet or csv, got %q", e.Format))
+		}
+		if e.WindowMinutes < 1 || e.LookbackWindows < 1 || e.MaxRowsPerFile < 1 {
+			errs = append(errs, fmt.Errorf("EXPORT_WINDOW_MINUTES, EXPORT_LOOKBACK_WINDOWS and EXPORT_MAX_ROWS_PER_FILE must be positive integers"))
+		}
+		if e.SettleSeconds < 0 {
+			errs = append(errs, fmt.Errorf("EXPORT_SETTLE_SECONDS must not be negative"))
+		}
+	}
+
+	if w := c.Sinks.Webhooks; w.Enabled {
+		if w.PollIntervalMillis < 1 || w.BatchSize < 1 || w.Workers < 1 || w.TimeoutSeconds < 1 || w.MaxAttempts < 1 || w.RetentionHours < 1 {
+			errs = append(errs, fmt.Errorf("SINK_WEBHOOKS_POLL_INTERVAL_MS, SINK_WEBHOOKS_BATCH_SIZE, SINK_WEBHOOKS_WORKERS, SINK_WEBHOOKS_TIMEOUT_SECONDS, SINK_WEBHOOKS_MAX_ATTEMPTS and SINK_WEBHOOKS_RETENTION_HOURS must be positive integers"))
+		}
+		if w.SettleMillis < 0 {
+			errs = append(errs, fmt.Errorf("SINK_WEBHOOKS_SETTLE_MS must not be negative"))
+		}
+	}
+	if k := c.Sinks.Kafka; k.Enabled() {
+		if k.Topic == "" {
+			errs = append(errs, fmt.Errorf("SINK_KAFKA_TOPIC required when SINK_KAFKA_BROKERS is set"))
+		}
+		if k.PollIntervalMillis < 1 || k.BatchSize < 1 {
+			errs = append(errs, fmt.Errorf("SINK_KAFKA_POLL_INTERVAL_MS and SINK_KAFKA_BATCH_SIZE must be positive integers"))
+		}
+		if k.SettleMillis < 0 {
+			errs = append(errs, fmt.Errorf("SINK_KAFKA_SETTLE_MS must not be negative"))
+		}
+		if k.Format != "json" && k.Format != "protobuf" {
+			errs = append(errs, fmt.Errorf("SINK_KAFKA_FORMAT must be json or protobuf, got %q", k.Format))
+		}
+	}
+	if e := c.Sinks.Elasticsearch; e.Enabled() {
+		if e.Index == "" || e.Index != strings.ToLower(e.Index) || strings.ContainsAny(e.Index, `/\*?"<>| ,#`) {
+			errs = append(errs, fmt.Errorf("SINK_ELASTICSEARCH_INDEX must be a lowercase index name, got %q", e.Index))
+		}
+		if e.PollIntervalMillis < 1 || e.BatchSize < 1 || e.TimeoutSeconds < 1 {
+			errs = append(errs, fmt.Errorf("SINK_ELASTICSEARCH_POLL_INTERVAL_MS, SINK_ELASTICSEARCH_BATCH_SIZE and SINK_ELASTICSEARCH_TIMEOUT_SECONDS must be positive integers"))
+		}
+		if e.SettleMillis < 0 || e.MaxRetries < 0 {
+			errs = append(errs, fmt.Errorf("SINK_ELASTICSEARCH_SETTLE_MS and SINK_ELASTICSEARCH_MAX_RETRIES must not be negative"))
+		}
+	}
+
+	if f := c.Federation.Forward; f.Enabled() {
+		if u, err := url.Parse(f.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("FORWARD_URL must be an http or https URL, got %q", f.URL))
+		}
+		if f.Origin == "" || strings.Trim(f.Origin, "abcdefghijklmnopqrstuvwxyz0123456789_-.") != "" {
+			errs = append(errs, fmt.Errorf("FORWARD_ORIGIN must use lowercase letters, digits, '.', '-' and '_', got %q", f.Origin))
+		}
+		if f.PollIntervalMillis < 1 || f.TimeoutSeconds < 1 {
+			errs = append(errs, fmt.Errorf("FORWARD_POLL_INTERVAL_MS and FORWARD_TIMEOUT_SECONDS must be positive integers"))
+		}
+		if f.BatchSize < 1 || f.BatchSize > 1000 {
+			errs = append(errs, fmt.Errorf("FORWARD_BATCH_SIZE must be within 1-1000, got %d", f.BatchSize))
+		}
+		if f.SettleMillis < 0 {
+			errs = append(errs, fmt.Errorf("FORWARD_SETTLE_MS must not be negative"))
+		}
+	}
+
+	if r := c.Reports; r.Enabled() {
+		if r.Period != "daily" && r.Period != "weekly" {
+			errs = append(errs, fmt.Errorf("REPORT_PERIOD must be daily or weekly, got %q", r.Period))
+		}
+		if r.Schedule == "" {
+			errs = append(errs, fmt.Errorf("REPORT_SCHEDULE required when reports are enabled"))
+		}
+		if r.TopActions < 1 {
+			errs = append(errs, fmt.Errorf("REPORT_TOP_ACTIONS must be a positive integer"))
+		}
+		if len(r.SMTP.To) > 0 {
+			if r.SMTP.Host == "" || r.SMTP.From == "" {
+				errs = append(errs, fmt.Errorf("REPORT_SMTP_HOST and REPORT_SMTP_FROM required when REPORT_SMTP_TO is set"))
+			}
+			if r.SMTP.Port < 1 || r.SMTP.Port > 65535 {
+				errs = append(errs, fmt.Errorf("REPORT_SMTP_PORT must be within 1-65535, got %d", r.SMTP.Port))
+			}
+		}
+	}
+
+	if a := c.Anomaly; a.Enabled {
+		if a.CheckIntervalSeconds <= 0 || a.WindowMinutes <= 0 || a.BaselineHours <= 0 {
+			errs = append(errs, fmt.Errorf("ANOMALY_CHECK_INTERVAL_SECONDS, ANOMALY_WINDOW_MINUTES and ANOMALY_BASELINE_HOURS must be positive integers"))
+		}
+		if a.WindowMinutes >= a.BaselineHours*60 {
+			errs = append(errs, fmt.Errorf("ANOMALY_WINDOW_MINUTES must be shorter than ANOMALY_BASELINE_HOURS"))
+		}
+		if a.Factor < 2 {
+			errs = append(errs, fmt.Errorf("ANOMALY_FACTOR must be at least 2"))
+		}
+		if a.MinEvents < 1 {
+			errs = append(errs, fmt.Errorf("ANOMALY_MIN_EVENTS must be a positive integer"))
+		}
+		for _, u := range []struct{ name, url string }{
+			{"ANOMALY_SLACK_WEBHOOK_URL", a.SlackWebhookURL},
+			{"ANOMALY_WEBHOOK_URL", a.WebhookURL},
+		} {
+			if u.url != "" && !strings.HasPrefix(u.url, "http://") && !strings.HasPrefix(u.url, "https://") {
+				errs = append(errs, fmt.Errorf("%s must be an http(s) URL", u.name))
+			}
+		}
+	}
+
+	if a := c.Alerts; a.Enabled {
+		if a.CheckIntervalSeconds <= 0 {
+			errs = append(errs, fmt.Errorf("ALERTS_CHECK_INTERVAL_SECONDS must be a positive integer"))
+		}
+		for _, u := range []struct{ name, url string }{
+			{"ALERTS_SLACK_WEBHOOK_URL", a.SlackWebhookURL},
+			{"ALERTS_WEBHOOK_URL", a.WebhookURL},
+		} {
+			if u.url != "" && !strings.HasPrefix(u.url, "http://") && !strings.HasPrefix(u.url, "https://") {
+				errs = append(errs, fmt.Errorf("%s must be an http(s) URL", u.name))
+			}
+		}
+	}
+
+	for _, name := range c.Flags.Enabled {
+		if !slices.Contains(FeatureFlagNames, name) {
+			errs = append(errs, fmt.Errorf("FEATURE_FLAGS: unknown flag %q, expected one of %s", name, strings.Join(FeatureFlagNames, ", ")))
+		} else if name == "async_ingest" && !c.Ingest.Buffer.Async {
+			errs = append(errs, fmt.Errorf("FEATURE_FLAGS: async_ingest requires INGEST_ASYNC, which creates the ingest buffer"))
+		}
+	}
+	if c.Flags.RefreshSeconds <= 0 {
+		errs = append(errs, fmt.Errorf("FEATURE_FLAGS_REFRESH_SECONDS must be a positive integer"))
+	}
+
+	if a := c.Archive; a.AfterDays < 0 {
+		errs = append(errs, fmt.Errorf("ARCHIVE_AFTER_DAYS must be 0 or a positive integer"))
+	} else if a.Enabled() && (a.IntervalMinutes < 1 || a.BatchSize < 1) {
+		errs = append(errs, fmt.Errorf("ARCHIVE_INTERVAL_MINUTES and ARCHIVE_BATCH_SIZE must be positive integers"))
+	}
+	if s := c.Scheduled; s.IntervalSeconds < 1 || s.BatchSize < 1 || s.MaxDelayDays < 1 {
+		errs = append(errs, fmt.Errorf("SCHEDULED_EVENTS_INTERVAL_SECONDS, SCHEDULED_EVENTS_BATCH_SIZE and SCHEDULED_EVENTS_MAX_DELAY_DAYS must be positive integers"))
+	}
+	if t := c.TTL; t.IntervalSeconds < 1 || t.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("EVENT_TTL_CLEANUP_INTERVAL_SECONDS and EVENT_TTL_CLEANUP_BATCH_SIZE must be positive integers"))
+	}
+
+	for name, w := range c.Webhooks {
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789_-") != "" {
+			errs = append(errs, fmt.Errorf("webhook provider names must use lowercase letters, digits, - and _, got %q", name))
+		}
+		if w.Secret == "" || w.SignatureHeader == "" {
+			errs = append(errs, fmt.Errorf("webhook %s: secret and signature_header are required", name))
+		}
+		if s := w.SignatureScheme; s != "sha256" && s != "stripe" {
+			errs = append(errs, fmt.Errorf("webhook %s: signature_scheme must be sha256 or stripe, got %q", name, s))
+		}
+		if w.ToleranceSeconds < 0 {
+			errs = append(errs, fmt.Errorf("webhook %s: tolerance_seconds must not be negative", name))
+		}
+		if w.UserIDField == "" || (w.ActionField == "" && w.Action == "") {
+			errs = append(errs, fmt.Errorf("webhook %s: user_id_field and either action_field or action are required", name))
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL must be one of debug, info, warn, error, got %q", c.Log.Level))
+	}
+	if f := strings.ToLower(c.Log.Format); f != "json" && f != "text" {
+		errs = append(errs, fmt.Errorf("LOG_FORMAT must be json or text, got %q", c.Log.Format))
+	}
+
+	if c.Log.RequestSampleRate < 1 {
+		errs = append(errs, fmt.Errorf("LOG_REQUEST_SAMPLE_RATE must be a positive integer"))
+	}
+	if c.Log.SlowRequestMillis < 0 {
+		errs = append(errs, fmt.Errorf("LOG_SLOW_REQUEST_MS must not be negative"))
+	}
+	switch c.Log.Output {
+	case "stdout":
+	case "file":
+		if c.Log.File.Path == "" {
+			errs = append(errs, fmt.Errorf("LOG_FILE_PATH required when LOG_OUTPUT is file"))
+		}
+		if c.Log.File.MaxSizeMB < 1 || c.Log.File.MaxBackups < 0 {
+			errs = append(errs, fmt.Errorf("LOG_FILE_MAX_SIZE_MB must be a positive integer and LOG_FILE_MAX_BACKUPS must not be negative"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("LOG_OUTPUT must be stdout or file, got %q", c.Log.Output))
+	}
+
+	if d := c.Debug; d.RecordRequests < 0 || (d.Enabled() && d.RecordMaxBodyKB < 1) {
+		errs = append(errs, fmt.Errorf("DEBUG_RECORD_REQUESTS must not be negative and DEBUG_RECORD_MAX_BODY_KB must be a positive integer"))
+	}
+	if c.Debug.RecordFile != "" && !c.Debug.Enabled() {
+		errs = append(errs, fmt.Errorf("DEBUG_RECORD_FILE requires DEBUG_RECORD_REQUESTS"))
+	}
+
+	if c.Shutdown.ReadinessDelaySeconds < 0 {
+		errs = append(errs, fmt.Errorf("SHUTDOWN_READINESS_DELAY_SECONDS must not be negative"))
+	}
+	for _, t := range []struct {
+		name  string
+		value int
+	}{
+		{"SHUTDOWN_AGGREGATOR_TIMEOUT_SECONDS", c.Shutdown.AggregatorTimeoutSeconds},
+		{"SHUTDOWN_INGEST_TIMEOUT_SECONDS", c.Shutdown.IngestTimeoutSeconds},
+		{"SHUTDOWN_HTTP_TIMEOUT_SECONDS", c.Shutdown.HTTPTimeoutSeconds},
+		{"SHUTDOWN_DB_TIMEOUT_SECONDS", c.Shutdown.DBTimeoutSeconds},
+	} {
+		if t.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be a positive integer", t.name))
+		}
+	}
+
+	return errs
+}
+
+// ParseCIDRs parses networks in CIDR notation; a bare address stands for
+// itself.
+func ParseCIDRs(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, v := range cidrs {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", v)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", v)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// SplitAndTrim splits a comma separated list and drops empty entries.
+func SplitAndTrim(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if t := strings.TrimSpace(part); t != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
@@ -0,0 +1,461 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+	return path
+}
+
+// setRequiredEnv provides the settings that have no default.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("DB_DATABASE", "events")
+	t.Setenv("DB_USERNAME", "username")
+}
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		content   string
+		env       map[string]string
+		expectErr []string
+		check     func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "defaults",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Port != 8080 {
+					t.Fatalf("expected default port 8080 got %d", cfg.Server.Port)
+				}
+				if cfg.Aggregation.IntervalSeconds != 60 {
+					t.Fatalf("expected default interval 60 got %d", cfg.Aggregation.IntervalSeconds)
+				}
+			},
+		},
+		{
+			name:    "yaml file",
+			file:    "config.yaml",
+			content: "server:\n  port: 9000\n  base_path: /v1\ncors:\n  allow_origins: [\"*\"]\ndb:\n  host: pg\n",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Port != 9000 || cfg.Server.BasePath != "/v1" {
+					t.Fatalf("unexpected server config %+v", cfg.Server)
+				}
+				if len(cfg.CORS.AllowOrigins) != 1 || cfg.CORS.AllowOrigins[0] != "*" {
+					t.Fatalf("unexpected origins %v", cfg.CORS.AllowOrigins)
+				}
+				if cfg.DB.Host != "pg" || cfg.DB.Port != 5432 {
+					t.Fatalf("unexpected db config %+v", cfg.DB)
+				}
+			},
+		},
+		{
+			name:    "toml file with env override",
+			file:    "config.toml",
+			content: "[server]\nport = 9000\n\n[aggregation]\ninterval_seconds = 15\n",
+			env:     map[string]string{"PORT": "9100", "CORS_ALLOW_METHODS": "GET, POST ,PUT", "SHUTDOWN_HTTP_TIMEOUT_SECONDS": "20", "LOG_LEVEL": "debug", "LOG_EXCLUDE_PATHS": "/health"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Server.Port != 9100 {
+					t.Fatalf("expected env to override port, got %d", cfg.Server.Port)
+				}
+				if cfg.Shutdown.HTTPTimeoutSeconds != 20 {
+					t.Fatalf("expected env to override shutdown timeout, got %d", cfg.Shutdown.HTTPTimeoutSeconds)
+				}
+				if cfg.Log.Level != "debug" {
+					t.Fatalf("expected env to override log level, got %q", cfg.Log.Level)
+				}
+				if strings.Join(cfg.Log.ExcludePaths, ",") != "/health" {
+					t.Fatalf("unexpected excluded paths %v", cfg.Log.ExcludePaths)
+				}
+				if cfg.Aggregation.IntervalSeconds != 15 {
+					t.Fatalf("expected interval 15 got %d", cfg.Aggregation.IntervalSeconds)
+				}
+				if strings.Join(cfg.CORS.AllowMethods, ",") != "GET,POST,PUT" {
+					t.Fatalf("unexpected methods %v", cfg.CORS.AllowMethods)
+				}
+			},
+		},
+		{
+			name:      "unknown field in file",
+			file:      "config.yaml",
+			content:   "server:\n  prot: 9000\n",
+			expectErr: []string{"prot"},
+		},
+		{
+			name:      "unsupported extension",
+			file:      "config.json",
+			content:   "{}",
+			expectErr: []string{"unsupported config file extension"},
+		},
+		{
+			name: "every bad field is reported",
+			env: map[string]string{
+				"PORT":                         "abc",
+				"CORS_ALLOW_CREDENTIALS":       "maybe",
+				"AGGREGATION_INTERVAL_SECONDS": "0",
+				"DB_STARTUP_WAIT_SECONDS":      "-1",
+			},
+			expectErr: []string{"PORT", "CORS_ALLOW_CREDENTIALS", "AGGREGATION_INTERVAL_SECONDS", "DB_STARTUP_WAIT_SECONDS"},
+		},
+		{
+			name:    "out of range and missing values",
+			file:    "config.yaml",
+			content: "server:\n  port: 70000\n  read_timeout_seconds: 0\ndb:\n  host: \"\"\n",
+			expectErr: []string{
+				"PORT must be 1-65535",
+				"READ_TIMEOUT_SECONDS must be a positive integer",
+				"DB_HOST required",
+			},
+		},
+		{
+			name: "flush batch larger than the ingest buffer",
+			env: map[string]string{
+				"INGEST_ASYNC":            "true",
+				"INGEST_BUFFER_SIZE":      "10",
+				"INGEST_FLUSH_BATCH_SIZE": "100",
+			},
+			expectErr: []string{"INGEST_FLUSH_BATCH_SIZE (100) cannot exceed INGEST_BUFFER_SIZE (10)"},
+		},
+		{
+			name: "invalid user check",
+			env: map[string]string{
+				"USER_CHECK_URL":  "https://users.internal/users",
+				"USER_CHECK_MODE": "drop",
+			},
+			expectErr: []string{
+				"USER_CHECK_URL must be an http(s) URL holding {user_id}",
+				"USER_CHECK_MODE must be reject, flag or allow",
+			},
+		},
+		{
+			name:      "query cache without room",
+			env:       map[string]string{"QUERY_CACHE_TTL_SECONDS": "5", "QUERY_CACHE_SIZE": "0"},
+			expectErr: []string{"QUERY_CACHE_TTL_SECONDS must not be negative and QUERY_CACHE_SIZE must be a positive integer"},
+		},
+		{
+			name:      "insert batches without room",
+			env:       map[string]string{"DB_INSERT_BATCH_WINDOW_MS": "5", "DB_INSERT_BATCH_SIZE": "0"},
+			expectErr: []string{"DB_INSERT_BATCH_WINDOW_MS must not be negative and DB_INSERT_BATCH_SIZE must be a positive integer"},
+		},
+		{
+			name: "shards",
+			env:  map[string]string{"DB_SHARDS": "postgres://u:p@shard0:5432/events, postgresql://u:p@shard1:5432/events?search_path=shard1"},
+			check: func(t *testing.T, cfg *Config) {
+				if len(cfg.DB.Shards) != 2 || cfg.DB.Shards[1] != "postgresql://u:p@shard1:5432/events?search_path=shard1" {
+					t.Fatalf("expected 2 shards got %q", cfg.DB.Shards)
+				}
+			},
+		},
+		{
+			name: "log file without path",
+			env:  map[string]string{"LOG_OUTPUT": "file", "LOG_FILE_MAX_SIZE_MB": "0"},
+			expectErr: []string{
+				"LOG_FILE_PATH required when LOG_OUTPUT is file",
+				"LOG_FILE_MAX_SIZE_MB must be a positive integer and LOG_FILE_MAX_BACKUPS must not be negative",
+			},
+		},
+		{
+			name:      "unknown log output",
+			env:       map[string]string{"LOG_OUTPUT": "syslog"},
+			expectErr: []string{`LOG_OUTPUT must be stdout or file, got "syslog"`},
+		},
+		{
+			name:      "worker port taken by the admin listener",
+			env:       map[string]string{"WORKER_PORT": "8090"},
+			expectErr: []string{"WORKER_PORT must be 1-65535 and differ from PORT, ADMIN_PORT and TLS_REDIRECT_PORT, got 8090"},
+		},
+		{
+			name: "invalid request recording",
+			env:  map[string]string{"DEBUG_RECORD_REQUESTS": "-1", "DEBUG_RECORD_FILE": "/tmp/requests.jsonl"},
+			expectErr: []string{
+				"DEBUG_RECORD_REQUESTS must not be negative and DEBUG_RECORD_MAX_BODY_KB must be a positive integer",
+				"DEBUG_RECORD_FILE requires DEBUG_RECORD_REQUESTS",
+			},
+		},
+		{
+			name: "invalid anomaly detection",
+			env: map[string]string{
+				"ANOMALY_ENABLED":        "true",
+				"ANOMALY_WINDOW_MINUTES": "120",
+				"ANOMALY_BASELINE_HOURS": "1",
+				"ANOMALY_FACTOR":         "1",
+				"ANOMALY_WEBHOOK_URL":    "hooks.internal/anomalies",
+			},
+			expectErr: []string{
+				"ANOMALY_WINDOW_MINUTES must be shorter than ANOMALY_BASELINE_HOURS",
+				"ANOMALY_FACTOR must be at least 2",
+				"ANOMALY_WEBHOOK_URL must be an http(s) URL",
+			},
+		},
+		{
+			name: "invalid alerts",
+			env: map[string]string{
+				"ALERTS_ENABLED":                "true",
+				"ALERTS_CHECK_INTERVAL_SECONDS": "0",
+				"ALERTS_SLACK_WEBHOOK_URL":      "hooks.slack.com/services/T0/B0/x",
+			},
+			expectErr: []string{
+				"ALERTS_CHECK_INTERVAL_SECONDS must be a positive integer",
+				"ALERTS_SLACK_WEBHOOK_URL must be an http(s) URL",
+			},
+		},
+		{
+			name: "invalid feature flags",
+			env: map[string]string{
+				"FEATURE_FLAGS":                 "strict_validation,dark_mode,async_ingest",
+				"FEATURE_FLAGS_REFRESH_SECONDS": "0",
+			},
+			expectErr: []string{
+				`FEATURE_FLAGS: unknown flag "dark_mode"`,
+				"FEATURE_FLAGS: async_ingest requires INGEST_ASYNC",
+				"FEATURE_FLAGS_REFRESH_SECONDS must be a positive integer",
+			},
+		},
+		{
+			name:      "negative archive age",
+			env:       map[string]string{"ARCHIVE_AFTER_DAYS": "-1"},
+			expectErr: []string{"ARCHIVE_AFTER_DAYS must be 0 or a positive integer"},
+		},
+		{
+			name:      "invalid archive batches",
+			env:       map[string]string{"ARCHIVE_AFTER_DAYS": "90", "ARCHIVE_BATCH_SIZE": "0"},
+			expectErr: []string{"ARCHIVE_INTERVAL_MINUTES and ARCHIVE_BATCH_SIZE must be positive integers"},
+		},
+		{
+			name:      "invalid scheduled events",
+			env:       map[string]string{"SCHEDULED_EVENTS_MAX_DELAY_DAYS": "0"},
+			expectErr: []string{"SCHEDULED_EVENTS_INTERVAL_SECONDS, SCHEDULED_EVENTS_BATCH_SIZE and SCHEDULED_EVENTS_MAX_DELAY_DAYS must be positive integers"},
+		},
+		{
+			name:      "invalid jobs",
+			env:       map[string]string{"JOBS_DIR": "/tmp/jobs", "JOBS_WORKERS": "0"},
+			expectErr: []string{"JOBS_WORKERS, JOBS_STALE_SECONDS and JOBS_RETENTION_HOURS must be positive integers"},
+		},
+		{
+			name:      "invalid event ttl cleanup",
+			env:       map[string]string{"EVENT_TTL_CLEANUP_BATCH_SIZE": "0"},
+			expectErr: []string{"EVENT_TTL_CLEANUP_INTERVAL_SECONDS and EVENT_TTL_CLEANUP_BATCH_SIZE must be positive integers"},
+		},
+		{
+			name:      "invalid excluded tags",
+			env:       map[string]string{"AGGREGATION_EXCLUDE_TAGS": "bot-traffic,bad tag"},
+			expectErr: []string{`AGGREGATION_EXCLUDE_TAGS must hold tags of 1 to 64 letters, digits, '_', '.', ':' or '-', got "bad tag"`},
+		},
+		{
+			name:      "zero session gap",
+			env:       map[string]string{"SESSIONS_GAP_MINUTES": "0"},
+			expectErr: []string{"SESSIONS_GAP_MINUTES must be a positive integer"},
+		},
+		{
+			name: "invalid kafka formats",
+			env: map[string]string{
+				"KAFKA_BROKERS": "kafka:9092", "KAFKA_FORMAT": "xml",
+				"SINK_KAFKA_BROKERS": "kafka:9092", "SINK_KAFKA_FORMAT": "avro",
+			},
+			expectErr: []string{
+				`KAFKA_FORMAT must be json, avro or protobuf, got "xml"`,
+				`SINK_KAFKA_FORMAT must be json or protobuf, got "avro"`,
+			},
+		},
+		{
+			name:      "negative slow query threshold",
+			env:       map[string]string{"DB_SLOW_QUERY_MS": "-1"},
+			expectErr: []string{"DB_SLOW_QUERY_MS must not be negative"},
+		},
+		{
+			name: "invalid shards",
+			env:  map[string]string{"DB_SHARDS": "shard0:5432", "DB_INSERT_BATCH_WINDOW_MS": "5", "SINK_WEBHOOKS_ENABLED": "true"},
+			expectErr: []string{
+				"DB_SHARDS must hold postgres:// URLs",
+				"DB_SHARDS must hold at least 2 databases",
+				"DB_INSERT_BATCH_WINDOW_MS is not supported with DB_SHARDS",
+				"DB_SHARDS cannot be used with exports, sinks, forwarding, reports, anomaly detection, alerts or archival",
+			},
+		},
+		{
+			name: "regions",
+			env:  map[string]string{"DB_REGIONS": "eu=postgres://eu-db:5432/events, us=postgres://us-db:5432/events", "DB_PROJECT_REGIONS": "3=eu,7=us"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.Regions["eu"] != "postgres://eu-db:5432/events" || cfg.DB.Regions["us"] != "postgres://us-db:5432/events" {
+					t.Fatalf("unexpected regions %v", cfg.DB.Regions)
+				}
+				if len(cfg.DB.ProjectRegions) != 2 || cfg.DB.ProjectRegions["3"] != "eu" || !cfg.DB.SpreadsEvents() {
+					t.Fatalf("unexpected project regions %v", cfg.DB.ProjectRegions)
+				}
+			},
+		},
+		{
+			name:    "regions from a file",
+			file:    "config.yaml",
+			content: "db:\n  regions:\n    eu: postgres://eu-db:5432/events\n  project_regions:\n    3: eu\n",
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.DB.Regions["eu"] != "postgres://eu-db:5432/events" || cfg.DB.ProjectRegions["3"] != "eu" {
+					t.Fatalf("unexpected regions %v and project regions %v", cfg.DB.Regions, cfg.DB.ProjectRegions)
+				}
+			},
+		},
+		{
+			name: "invalid regions",
+			env: map[string]string{
+				"DB_REGIONS": "eu=eu-db:5432", "DB_PROJECT_REGIONS": "x=eu,4=us",
+				"DB_SHARDS": "postgres://a:5432/e,postgres://b:5432/e", "SINK_WEBHOOKS_ENABLED": "true",
+			},
+			expectErr: []string{
+				`DB_REGIONS must hold postgres:// URLs, got an invalid one for "eu"`,
+				`DB_PROJECT_REGIONS maps project 4 to "us", which is not in DB_REGIONS`,
+				`DB_PROJECT_REGIONS must map positive project ids, got "x"`,
+				"DB_REGIONS cannot be used with DB_SHARDS, DB_INSERT_BATCH_WINDOW_MS, DB_TIMESCALE or DB_COCKROACH",
+				"DB_REGIONS cannot be used with exports, sinks, forwarding, reports, anomaly detection, alerts or archival",
+			},
+		},
+		{
+			name:      "regions without pairs",
+			env:       map[string]string{"DB_REGIONS": "postgres://eu-db:5432/events"},
+			expectErr: []string{`DB_REGIONS must hold key=value pairs, got "postgres://eu-db:5432/events"`},
+		},
+		{
+			name:      "cockroach with shards",
+			env:       map[string]string{"DB_COCKROACH": "true", "DB_SHARDS": "postgres://a:5432/e,postgres://b:5432/e"},
+			expectErr: []string{"DB_COCKROACH cannot be used with DB_SHARDS or DB_TIMESCALE"},
+		},
+		{
+			name: "invalid timescale",
+			env:  map[string]string{"DB_TIMESCALE": "true", "DB_TIMESCALE_CHUNK_INTERVAL_HOURS": "0", "ARCHIVE_AFTER_DAYS": "90"},
+			expectErr: []string{
+				"DB_TIMESCALE_CHUNK_INTERVAL_HOURS must be a positive integer and DB_TIMESCALE_COMPRESS_AFTER_DAYS must not be negative",
+				"DB_TIMESCALE cannot be used with DB_SHARDS or ARCHIVE_AFTER_DAYS",
+			},
+		},
+		{
+			name: "shared state without redis",
+			env:  map[string]string{"QUERY_CACHE_REDIS": "true", "QUOTA_REDIS": "true"},
+			expectErr: []string{
+				"REDIS_URL required when QUOTA_REDIS is set",
+				"REDIS_URL required when QUERY_CACHE_REDIS is set",
+			},
+		},
+		{
+			name:      "negative events flush interval",
+			env:       map[string]string{"EVENTS_FLUSH_INTERVAL_MS": "-1"},
+			expectErr: []string{"EVENTS_FLUSH_INTERVAL_MS must not be negative"},
+		},
+		{
+			name:      "default events limit above the maximum",
+			env:       map[string]string{"EVENTS_DEFAULT_LIMIT": "5000", "EVENTS_MAX_LIMIT": "100"},
+			expectErr: []string{"EVENTS_DEFAULT_LIMIT must be a positive integer no greater than EVENTS_MAX_LIMIT"},
+		},
+		{
+			name:      "no export timeout",
+			env:       map[string]string{"EVENTS_EXPORT_TIMEOUT_SECONDS": "0"},
+			expectErr: []string{"EVENTS_EXPORT_TIMEOUT_SECONDS must be a positive integer"},
+		},
+		{
+			name: "dedup with the write-behind buffer",
+			env: map[string]string{
+				"INGEST_ASYNC":         "true",
+				"DEDUP_WINDOW_SECONDS": "60",
+			},
+			expectErr: []string{"DEDUP_WINDOW_SECONDS cannot be used with INGEST_ASYNC"},
+		},
+		{
+			name:    "webhook secret from the environment",
+			file:    "config.yaml",
+			content: "webhooks:\n  github:\n    signature_header: X-Hub-Signature-256\n    signature_scheme: sha256\n    user_id_field: sender.id\n    action_field: \"header:X-GitHub-Event\"\n",
+			env:     map[string]string{"WEBHOOK_GITHUB_SECRET": "s3cret"},
+			check: func(t *testing.T, cfg *Config) {
+				if cfg.Webhooks["github"].Secret != "s3cret" || cfg.Webhooks["github"].UserIDField != "sender.id" {
+					t.Fatalf("unexpected webhook config %+v", cfg.Webhooks)
+				}
+			},
+		},
+		{
+			name:      "short pseudonymization secret",
+			env:       map[string]string{"PSEUDONYMIZE_SECRETS": "0123456789abcdef0123,short"},
+			expectErr: []string{"PSEUDONYMIZE_SECRETS[1] must be at least 16 bytes long"},
+		},
+		{
+			name:      "invalid metadata keys",
+			env:       map[string]string{"METADATA_ENCRYPTION_KEY": "c2hvcnQ=", "METADATA_ENCRYPTION_KMS_KEY": "not base64!"},
+			expectErr: []string{"mutually exclusive", "base64 of a 32 bytes key", "METADATA_ENCRYPTION_KMS_KEY must be base64"},
+		},
+		{
+			name:      "signatures required without secrets",
+			env:       map[string]string{"REQUIRE_SIGNATURE": "true", "SIGNATURE_WINDOW_SECONDS": "0"},
+			expectErr: []string{"REQUIRE_SIGNATURE requires SIGNING_SECRETS", "SIGNATURE_WINDOW_SECONDS must be a positive integer"},
+		},
+		{
+			name:      "invalid action rules",
+			env:       map[string]string{"ACTION_PATTERN": "[a-z", "METADATA_MAX_BYTES": "-1"},
+			expectErr: []string{"ACTION_PATTERN is not a valid regular expression", "METADATA_MAX_BYTES must not be negative"},
+		},
+		{
+			name:    "schema versions",
+			file:    "config.yaml",
+			content: "validation:\n  schema_versions:\n    - version: 2\n      required_metadata: [plan]\n      rename_actions:\n        signup: sign_up\n",
+			env:     map[string]string{"SCHEMA_UPGRADE_ON_READ": "true"},
+			check: func(t *testing.T, cfg *Config) {
+				v := cfg.Validation
+				if !v.UpgradeSchemaOnRead || len(v.SchemaVersions) != 1 || v.SchemaVersions[0].RenameActions["signup"] != "sign_up" || v.SchemaVersions[0].RequiredMetadata[0] != "plan" {
+					t.Fatalf("unexpected schema versions %+v", v)
+				}
+			},
+		},
+		{
+			name:      "invalid schema versions",
+			file:      "config.yaml",
+			content:   "validation:\n  schema_versions:\n    - version: 1\n      default_page: /\n    - version: 1\n    - version: 0\n",
+			expectErr: []string{"schema version 1 has no previous version", "distinct positive versions, got 1", "distinct positive versions, got 0"},
+		},
+		{
+			name:      "invalid networks",
+			env:       map[string]string{"ALLOW_CIDRS": "10.0.0.0/8, 192.168.1.7", "ADMIN_DENY_CIDRS": "10.0.0.0/33", "TRUSTED_PROXIES": "proxy"},
+			expectErr: []string{`ADMIN_DENY_CIDRS: invalid network "10.0.0.0/33"`, `TRUSTED_PROXIES: invalid address "proxy"`},
+		},
+		{
+			name:      "incomplete webhook",
+			file:      "config.yaml",
+			content:   "webhooks:\n  Stripe:\n    signature_scheme: hmac\n",
+			expectErr: []string{"webhook provider names", "secret and signature_header are required", "signature_scheme must be sha256 or stripe", "user_id_field and either action_field or action"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tt.file != "" {
+				path = writeFile(t, tt.file, tt.content)
+			}
+
+			cfg, err := Load(path)
+			if len(tt.expectErr) > 0 {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				for _, want := range tt.expectErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Fatalf("expected error to mention %q, got: %v", want, err)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
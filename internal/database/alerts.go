@@ -0,0 +1,228 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrAlertRuleNotFound is returned for unknown alert rule ids.
+var ErrAlertRuleNotFound = errors.New("alert rule not found")
+
+// AlertRule fires when a project stores more than Threshold events of
+// Action within WindowSeconds, or a single user does with PerUser.
+type AlertRule struct {
+	ID            int64     `json:"id"`
+	Name          string    `json:"name"`
+	ProjectID     int64     `json:"project_id"`
+	Action        string    `json:"action"`
+	PerUser       bool      `json:"per_user"`
+	Threshold     int64     `json:"threshold"`
+	WindowSeconds int       `json:"window_seconds"`
+	Active        bool      `json:"active"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// RuleMatch is a count exceeding the threshold of a rule. UserID is 0 for
+// the rules counting every user together.
+type RuleMatch struct {
+	UserID int64
+	Count  int64
+}
+
+// AlertFiring is an alert of a rule, for one user with PerUser. It stays
+// open, and the rule does not fire again for the user, until the count is
+// back under the threshold.
+type AlertFiring struct {
+	ID         int64      `json:"id"`
+	RuleID     int64      `json:"rule_id"`
+	UserID     int64      `json:"user_id,omitempty"`
+	Count      int64      `json:"count"`
+	FiredAt    time.Time  `json:"fired_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// AlertStore keeps the alert rules in alert_rules and their firings in
+// alert_firings, and evaluates the rules against the events.
+type AlertStore struct {
+	db *sql.DB
+}
+
+// NewAlertStore uses the shared connection pool.
+func NewAlertStore() *AlertStore {
+	return &AlertStore{db: open().db}
+}
+
+const alertRuleColumns = `id, name, project_id, action, per_user, threshold, window_seconds, active, created_at, updated_at`
+
+func scanAlertRule(row interface{ Scan(...any) error }) (AlertRule, error) {
+	var r AlertRule
+	err := row.Scan(&r.ID, &r.Name, &r.ProjectID, &r.Action, &r.PerUser, &r.Threshold, &r.WindowSeconds, &r.Active, &r.CreatedAt, &r.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AlertRule{}, ErrAlertRuleNotFound
+	}
+	return r, err
+}
+
+// CreateAlertRule stores a rule, or returns ErrProjectNotFound.
+func (s *AlertStore) CreateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error) {
+	created, err := scanAlertRule(s.db.QueryRowContext(ctx, `
+INSERT INTO alert_rules (name, project_id, action, per_user, threshold, window_seconds, active)
+SELECT $1, id, $3, $4, $5, $6, $7 FROM projects WHERE id = $2
+RETURNING `+alertRuleColumns,
+		r.Name, r.ProjectID, r.Action, r.PerUser, r.Threshold, r.WindowSeconds, r.Active))
+	if errors.Is(err, ErrAlertRuleNotFound) {
+		return AlertRule{}, ErrProjectNotFound
+	}
+	return created, err
+}
+
+// ListAlertRules returns every rule, or the active ones only.
+func (s *AlertStore) ListAlertRules(ctx context.Context, activeOnly bool) ([]AlertRule, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+alertRuleColumns+` FROM alert_rules WHERE active OR NOT $1 ORDER BY id`, activeOnly)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := make([]AlertRule, 0)
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, rows.Err()
+}
+
+func (s *AlertStore) GetAlertRule(ctx context.Context, id int64) (AlertRule, error) {
+	return scanAlertRule(s.db.QueryRowContext(ctx, `SELECT `+alertRuleColumns+` FROM alert_rules WHERE id = $1`, id))
+}
+
+// UpdateAlertRule replaces a rule, or returns ErrProjectNotFound. Its open
+// firings are resolved, so that the new condition fires again.
+func (s *AlertStore) UpdateAlertRule(ctx context.Context, r AlertRule) (AlertRule, error) {
+	var updated AlertRule
+	err := inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM projects WHERE id = $1)`, r.ProjectID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrProjectNotFound
+		}
+
+		var err error
+		updated, err = scanAlertRule(tx.QueryRowContext(ctx, `
+UPDATE alert_rules
+SET name = $2, project_id = $3, action = $4, per_user = $5, threshold = $6, window_seconds = $7, active = $8, updated_at = now()
+WHERE id = $1
+RETURNING `+alertRuleColumns,
+			r.ID, r.Name, r.ProjectID, r.Action, r.PerUser, r.Threshold, r.WindowSeconds, r.Active))
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE alert_firings SET resolved_at = now() WHERE rule_id = $1 AND resolved_at IS NULL`, r.ID)
+		return err
+	})
+	if err != nil {
+		return AlertRule{}, err
+	}
+	return updated, nil
+}
+
+// DeleteAlertRule removes a rule with its firings.
+func (s *AlertStore) DeleteAlertRule(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM alert_rules WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlertRuleNotFound
+	}
+	return nil
+}
+
+// ListAlertFirings returns the latest firings of a rule, newest first.
+func (s *AlertStore) ListAlertFirings(ctx context.Context, ruleID int64, limit int) ([]AlertFiring, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, rule_id, user_id, event_count, fired_at, resolved_at
+FROM alert_firings
+WHERE rule_id = $1
+ORDER BY id DESC
+LIMIT $2`, ruleID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	firings := make([]AlertFiring, 0)
+	for rows.Next() {
+		var f AlertFiring
+		if err := rows.Scan(&f.ID, &f.RuleID, &f.UserID, &f.Count, &f.FiredAt, &f.ResolvedAt); err != nil {
+			return nil, err
+		}
+		firings = append(firings, f)
+	}
+	return firings, rows.Err()
+}
+
+// EvaluateAlertRule counts the events of the rule within its window and
+// returns the counts exceeding its threshold, per user with PerUser.
+func (s *AlertStore) EvaluateAlertRule(ctx context.Context, r AlertRule) ([]RuleMatch, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT CASE WHEN $4 THEN user_id ELSE 0 END AS match_user, count(*)
+FROM events
+WHERE project_id = $1 AND action = $2 AND created_at >= now() - $3::float8 * INTERVAL '1 second'
+	AND `+notExpired+`
+GROUP BY match_user
+HAVING count(*) > $5
+ORDER BY match_user`, r.ProjectID, r.Action, r.WindowSeconds, r.PerUser, r.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var matches []RuleMatch
+	for rows.Next() {
+		var m RuleMatch
+		if err := rows.Scan(&m.UserID, &m.Count); err != nil {
+			return nil, err
+		}
+		matches = append(matches, m)
+	}
+	return matches, rows.Err()
+}
+
+// OpenAlertFiring stores the firing unless one is already open for its
+// rule and user, in which case opened is false. Concurrent evaluators open
+// a single firing.
+func (s *AlertStore) OpenAlertFiring(ctx context.Context, f AlertFiring) (stored AlertFiring, opened bool, err error) {
+	err = s.db.QueryRowContext(ctx, `
+INSERT INTO alert_firings (rule_id, user_id, event_count)
+VALUES ($1, $2, $3)
+ON CONFLICT (rule_id, user_id) WHERE resolved_at IS NULL DO NOTHING
+RETURNING id, fired_at`, f.RuleID, f.UserID, f.Count).Scan(&f.ID, &f.FiredAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AlertFiring{}, false, nil
+	}
+	if err != nil {
+		return AlertFiring{}, false, err
+	}
+	return f, true, nil
+}
+
+// ResolveAlertFirings closes the open firings of the rule for the users
+// that no longer match it.
+func (s *AlertStore) ResolveAlertFirings(ctx context.Context, ruleID int64, matching []int64) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+UPDATE alert_firings SET resolved_at = now()
+WHERE rule_id = $1 AND resolved_at IS NULL AND NOT (user_id = ANY($2))`, ruleID, nonNil(matching))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
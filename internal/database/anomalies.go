@@ -0,0 +1,129 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ActionRate counts the events of an action of a project in the window
+// checked for anomalies and in the baseline before it.
+type ActionRate struct {
+	ProjectID int64
+	Action    string
+	Current   int64
+	Baseline  int64
+}
+
+// Rates are the action rates of a window ending at End. The baseline runs
+// from BaselineStart to the start of the window; it is shorter than asked
+// while the aggregates do not reach back far enough.
+type Rates struct {
+	End           time.Time
+	BaselineStart time.Time
+	Actions       []ActionRate
+}
+
+// Anomaly is an alert raised for an action of a project whose rate departs
+// from its baseline. It stays open, and no other alert is raised for the
+// action of the project, until the rate is back to normal.
+type Anomaly struct {
+	ID        int64  `json:"id"`
+	ProjectID int64  `json:"project_id"`
+	Action    string `json:"action"`
+	// Kind is spike or drop.
+	Kind        string     `json:"kind"`
+	WindowStart time.Time  `json:"window_start"`
+	WindowEnd   time.Time  `json:"window_end"`
+	Current     int64      `json:"current"`
+	Expected    float64    `json:"expected"`
+	DetectedAt  time.Time  `json:"detected_at"`
+	ResolvedAt  *time.Time `json:"resolved_at,omitempty"`
+}
+
+// AnomalyStore reads the action rates from action_event_counts and keeps
+// the alerts in anomaly_alerts.
+type AnomalyStore struct {
+	db *sql.DB
+}
+
+// NewAnomalyStore uses the shared connection pool.
+func NewAnomalyStore() *AnomalyStore {
+	return &AnomalyStore{db: open().db}
+}
+
+// ActionRates counts the events of every action of every project over the
+// window ending at the end of the latest aggregation period, and over the
+// baseline before it. The zero Rates is returned while nothing is
+// aggregated.
+func (s *AnomalyStore) ActionRates(ctx context.Context, window, baseline time.Duration) (Rates, error) {
+	var end, first sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+SELECT end_at, (
+	SELECT min(period_start) FROM action_event_counts
+	WHERE period_start >= end_at - ($1::float8 + $2::float8) * INTERVAL '1 second'
+)
+FROM (SELECT max(period_end) AS end_at FROM action_event_counts) b`,
+		window.Seconds(), baseline.Seconds()).Scan(&end, &first)
+	if err != nil {
+		return Rates{}, err
+	}
+	if !end.Valid {
+		return Rates{}, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT project_id, action,
+	COALESCE(sum(event_count) FILTER (WHERE period_start >= $1 - $2::float8 * INTERVAL '1 second'), 0),
+	COALESCE(sum(event_count) FILTER (WHERE period_start < $1 - $2::float8 * INTERVAL '1 second'), 0)
+FROM action_event_counts
+WHERE period_start >= $1 - ($2::float8 + $3::float8) * INTERVAL '1 second' AND period_start < $1
+GROUP BY project_id, action
+ORDER BY project_id, action`, end.Time, window.Seconds(), baseline.Seconds())
+	if err != nil {
+		return Rates{}, err
+	}
+	defer rows.Close()
+
+	r := Rates{End: end.Time.UTC(), BaselineStart: first.Time.UTC()}
+	for rows.Next() {
+		var a ActionRate
+		if err := rows.Scan(&a.ProjectID, &a.Action, &a.Current, &a.Baseline); err != nil {
+			return Rates{}, err
+		}
+		r.Actions = append(r.Actions, a)
+	}
+	return r, rows.Err()
+}
+
+// OpenAnomaly stores the alert unless one is already open for its action in
+// its project, in which case opened is false. Concurrent detectors open a
+// single alert.
+func (s *AnomalyStore) OpenAnomaly(ctx context.Context, a Anomaly) (stored Anomaly, opened bool, err error) {
+	a.ProjectID = projectOrDefault(a.ProjectID)
+	err = s.db.QueryRowContext(ctx, `
+INSERT INTO anomaly_alerts (project_id, action, kind, window_start, window_end, event_count, expected_count)
+VALUES ($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (project_id, action) WHERE resolved_at IS NULL DO NOTHING
+RETURNING id, detected_at`, a.ProjectID, a.Action, a.Kind, a.WindowStart, a.WindowEnd, a.Current, a.Expected).Scan(&a.ID, &a.DetectedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Anomaly{}, false, nil
+	}
+	if err != nil {
+		return Anomaly{}, false, err
+	}
+	return a, true, nil
+}
+
+// ResolveAnomalies closes the open alerts of the actions of the project,
+// back to normal.
+func (s *AnomalyStore) ResolveAnomalies(ctx context.Context, projectID int64, actions []string) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+UPDATE anomaly_alerts SET resolved_at = now()
+WHERE project_id = $1 AND action = ANY($2) AND resolved_at IS NULL`, projectOrDefault(projectID), actions)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
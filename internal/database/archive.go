@@ -0,0 +1,76 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type archiveKey struct{}
+
+// WithArchive returns a context in which the events read by StreamEvents,
+// FilterEvents and GetEvents include the archived events.
+func WithArchive(ctx context.Context) context.Context {
+	return context.WithValue(ctx, archiveKey{}, true)
+}
+
+// ArchiveIncluded reports whether the events read with ctx include the
+// archived events.
+func ArchiveIncluded(ctx context.Context) bool {
+	included, _ := ctx.Value(archiveKey{}).(bool)
+	return included
+}
+
+// eventsSource is the table the events are read from: events, or events
+// together with events_archive, under the name events so that the
+// conditions of the queries apply to both.
+func eventsSource(ctx context.Context) string {
+	if !ArchiveIncluded(ctx) {
+		return "events"
+	}
+	return `(SELECT id, project_id, user_id, action, metadata_page, created_at, expires_at, schema_version FROM events
+UNION ALL
+SELECT id, project_id, user_id, action, metadata_page, created_at, NULL, schema_version FROM events_archive) AS events`
+}
+
+// ArchiveStore moves old events to events_archive.
+type ArchiveStore struct {
+	db *sql.DB
+}
+
+// NewArchiveStore uses the shared connection pool.
+func NewArchiveStore() *ArchiveStore {
+	return &ArchiveStore{db: open().db}
+}
+
+// ArchiveEvents moves up to limit events created before before, oldest
+// first, from events to events_archive with their tags, and returns how
+// many were moved. Events with a TTL are left to the janitor. Events are
+// moved in a single statement, so that an event is never in both tables or
+// in neither, and taken off the aggregates like deleted events, which
+// count the events table alone.
+func (s *ArchiveStore) ArchiveEvents(ctx context.Context, before time.Time, limit int) (int64, error) {
+	var n int64
+	err := inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		params, err := uncountArgs(ctx, tx, []any{before, limit})
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+WITH deleted AS (
+	DELETE FROM events
+	WHERE id IN (SELECT id FROM events WHERE created_at < $1 AND expires_at IS NULL ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED)
+	RETURNING id, project_id, user_id, action, metadata_page, created_at, expires_at, schema_version
+)`+uncount(3)+`
+INSERT INTO events_archive (id, project_id, user_id, action, metadata_page, created_at, schema_version, tags)
+SELECT m.id, m.project_id, m.user_id, m.action, m.metadata_page, m.created_at, m.schema_version,
+	COALESCE((SELECT array_agg(t.tag ORDER BY t.tag) FROM event_tags t WHERE t.event_id = m.id), '{}')
+FROM deleted m`, params...)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// AuditEntry records a privileged operation.
+type AuditEntry struct {
+	ID        int64     `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// Actor is who the operator says they are; RemoteAddr is where the
+	// request came from.
+	Actor      string `json:"actor,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	// Action is the operation, e.g. "DELETE /keys/:id".
+	Action string `json:"action"`
+	// Status is the HTTP status of the operation, 0 for operations not
+	// made over HTTP.
+	Status int `json:"status,omitempty"`
+	// Payload summarizes the parameters of the operation, secrets redacted.
+	Payload map[string]string `json:"payload,omitempty"`
+}
+
+// AuditFilter selects audit entries, newest first. Empty fields match every
+// entry; Before pages through older entries by id.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Before int64
+	Limit  int
+}
+
+// AuditStore keeps the audit log in the audit_log table.
+type AuditStore struct {
+	db *sql.DB
+}
+
+// NewAuditStore uses the shared connection pool.
+func NewAuditStore() *AuditStore {
+	return &AuditStore{db: open().db}
+}
+
+func (s *AuditStore) Record(ctx context.Context, e AuditEntry) error {
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+	if e.Payload == nil {
+		payload = []byte("{}")
+	}
+	_, err = s.db.ExecContext(ctx, `
+INSERT INTO audit_log (actor, remote_addr, request_id, action, status, payload)
+VALUES ($1, $2, $3, $4, $5, $6)`, e.Actor, e.RemoteAddr, e.RequestID, e.Action, e.Status, payload)
+	return err
+}
+
+func (s *AuditStore) ListAudit(ctx context.Context, f AuditFilter) ([]AuditEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, created_at, actor, remote_addr, request_id, action, status, payload
+FROM audit_log
+WHERE ($1 = '' OR actor = $1)
+	AND ($2 = '' OR action = $2)
+	AND ($3::bigint = 0 OR id < $3)
+ORDER BY id DESC
+LIMIT $4`, f.Actor, f.Action, f.Before, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]AuditEntry, 0)
+	for rows.Next() {
+		var e AuditEntry
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Actor, &e.RemoteAddr, &e.RequestID, &e.Action, &e.Status, &payload); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &e.Payload); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// BackfillStore counts the aggregates of past events again, after events
+// were imported, deleted or stored late.
+type BackfillStore struct {
+	db *sql.DB
+}
+
+// NewBackfillStore uses the shared connection pool.
+func NewBackfillStore() *BackfillStore {
+	return &BackfillStore{db: open().db}
+}
+
+// RecountHours replaces the rows of action_user_hours of the hours in
+// [from, to), which must be whole UTC hours, with the counts of the events
+// stored now, counted as by the last aggregation run (see counted). In the
+// TimescaleDB mode the continuous aggregates are refreshed on the range
+// instead.
+func (s *BackfillStore) RecountHours(ctx context.Context, from, to time.Time) error {
+	if timescale {
+		// A refresh cannot run in a transaction
+		for _, view := range continuousAggregates {
+			if _, err := s.db.ExecContext(ctx, `CALL refresh_continuous_aggregate($1::regclass, $2::timestamptz, $3::timestamptz)`, view, from, to); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM action_user_hours WHERE hour >= $1 AND hour < $2`, from, to); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, `
+INSERT INTO action_user_hours (project_id, action, hour, user_id, event_count)
+SELECT project_id, action, date_trunc('hour', created_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', user_id, COUNT(*) FROM events
+WHERE created_at >= $1 AND created_at < $2
+	AND `+counted("events", "COALESCE((SELECT aggregated_at FROM aggregated_periods WHERE id = 1), now())", "$3")+`
+GROUP BY 1, 2, 3, 4`, from, to, nonNil(excludedTags))
+		return err
+	})
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/microbatch"
+)
+
+var insertBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "db_insert_batch_size",
+	Help:    "Single-event inserts coalesced into one statement by the insert batcher",
+	Buckets: []float64{1, 2, 5, 10, 20, 50, 100, 200, 500},
+})
+
+func init() {
+	prometheus.MustRegister(insertBatchSize)
+}
+
+// InsertBatcher is a Service coalescing the InsertEvent calls made within a
+// few milliseconds into one multi-row INSERT, so that concurrent requests
+// share a round trip instead of each waiting for its own. Every caller
+// still gets the id of its event.
+type InsertBatcher struct {
+	Service
+	b *microbatch.Batcher[NewEvent, int64]
+}
+
+// NewInsertBatcher wraps the pool of Open with a batcher running the
+// InsertEvent calls made within window together, up to size at once. It
+// must wrap the pool itself, before the breaker, pseudonymization and
+// encryption, which it passes the events through unchanged.
+func NewInsertBatcher(window time.Duration, size int) *InsertBatcher {
+	s := open()
+	return &InsertBatcher{
+		Service: s,
+		b: microbatch.New(window, size, func(ctx context.Context, events []NewEvent) []microbatch.Result[int64] {
+			insertBatchSize.Observe(float64(len(events)))
+			return s.insertBatch(ctx, events)
+		}),
+	}
+}
+
+func (s *InsertBatcher) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return s.b.Do(ctx, NewEvent{ProjectID: projectID, UserID: userID, Action: action, Metadata: metadata})
+}
+
+// Stop inserts the events waiting for their batch; later events are
+// inserted one by one.
+func (s *InsertBatcher) Stop(ctx context.Context) error {
+	return s.b.Stop(ctx)
+}
+
+// insertBatch inserts events in one statement. When Postgres rejects the
+// statement, because of one of the events, they are inserted one by one so
+// that only that event fails.
+func (s *service) insertBatch(ctx context.Context, events []NewEvent) []microbatch.Result[int64] {
+	results := make([]microbatch.Result[int64], len(events))
+	ids, err := s.insertReturning(ctx, events)
+	var pgErr *pgconn.PgError
+	if err != nil && len(events) > 1 && errors.As(err, &pgErr) {
+		for i, e := range events {
+			results[i].Value, results[i].Err = s.InsertEvent(ctx, e.ProjectID, e.UserID, e.Action, e.Metadata)
+		}
+		return results
+	}
+	for i := range results {
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		results[i].Value = ids[i]
+	}
+	return results
+}
+
+// insertReturning inserts events and returns their ids, in the order of
+// events. The ids are drawn before the insert, with the position of their
+// event, since RETURNING tells neither the order of the rows nor the
+// columns of the input.
+func (s *service) insertReturning(ctx context.Context, events []NewEvent) ([]int64, error) {
+	projectIDs := make([]int64, len(events))
+	userIDs := make([]int64, len(events))
+	actions := make([]string, len(events))
+	pages := make([]*string, len(events))
+	for i, e := range events {
+		projectIDs[i], userIDs[i], actions[i] = projectOrDefault(e.ProjectID), e.UserID, e.Action
+		if page, ok := e.Metadata["page"]; ok {
+			pages[i] = &page
+		}
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+WITH input AS (
+	SELECT `+nextEventID()+` AS id, project_id, user_id, action, metadata_page, n
+	FROM unnest($1::bigint[], $2::bigint[], $3::text[], $4::text[]) WITH ORDINALITY
+		AS e(project_id, user_id, action, metadata_page, n)
+), inserted AS (
+	INSERT INTO events (id, project_id, user_id, action, metadata_page)
+	SELECT id, project_id, user_id, action, metadata_page FROM input
+	RETURNING id
+)
+SELECT input.id, input.n FROM input JOIN inserted ON inserted.id = input.id`, projectIDs, userIDs, actions, pages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]int64, len(events))
+	found := 0
+	for rows.Next() {
+		var id, n int64
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		if n < 1 || n > int64(len(events)) || ids[n-1] != 0 {
+			return nil, errors.New("insert batch: unexpected event position")
+		}
+		ids[n-1] = id
+		found++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if found != len(events) {
+		return nil, errors.New("insert batch: unexpected number of ids")
+	}
+	return ids, nil
+}
+
+// nextEventID is the expression drawing the id of a new event; CockroachDB
+// does not use sequences for them.
+func nextEventID() string {
+	if cockroach {
+		return `unique_rowid()`
+	}
+	return `nextval(pg_get_serial_sequence('events', 'id'))`
+}
@@ -0,0 +1,130 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/breaker"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+)
+
+// ErrCircuitOpen is returned by a Service wrapped with NewCircuitBreaker
+// while the database is considered unavailable.
+var ErrCircuitOpen = breaker.ErrOpen
+
+// breakerService guards the query methods of a Service with a circuit
+// breaker, so requests fail fast instead of all waiting on a dead database.
+type breakerService struct {
+	Service
+	b *breaker.Breaker
+}
+
+// NewCircuitBreaker wraps svc with a breaker that opens after threshold
+// consecutive failures and probes for recovery after cooldown. Its state is
+// exported as the db_circuit_breaker_state gauge (0 closed, 1 half-open, 2 open).
+func NewCircuitBreaker(svc Service, threshold int, cooldown time.Duration) Service {
+	state := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "db_circuit_breaker_state",
+		Help: "State of the database circuit breaker: 0 closed, 1 half-open, 2 open",
+	})
+	prometheus.MustRegister(state)
+
+	return &breakerService{
+		Service: svc,
+		b: breaker.New(threshold, cooldown, func(s breaker.State) {
+			state.Set(float64(s))
+		}),
+	}
+}
+
+// CircuitState returns the state of the breaker of svc, a Service returned
+// by NewCircuitBreaker; ok is false for any other Service.
+func CircuitState(svc Service) (state breaker.State, ok bool) {
+	s, ok := svc.(*breakerService)
+	if !ok {
+		return breaker.StateClosed, false
+	}
+	return s.b.State(), true
+}
+
+func (s *breakerService) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	var id int64
+	err := s.b.Do(func() error {
+		var err error
+		id, err = s.Service.InsertEvent(ctx, projectID, userID, action, metadata)
+		return err
+	})
+	return id, err
+}
+
+func (s *breakerService) InsertEvents(ctx context.Context, events []NewEvent) error {
+	return s.b.Do(func() error {
+		return s.Service.InsertEvents(ctx, events)
+	})
+}
+
+func (s *breakerService) InsertEventOnce(ctx context.Context, e NewEvent, window time.Duration) (Event, bool, error) {
+	var stored Event
+	var duplicate bool
+	err := s.b.Do(func() error {
+		var err error
+		stored, duplicate, err = s.Service.InsertEventOnce(ctx, e, window)
+		return err
+	})
+	return stored, duplicate, err
+}
+
+func (s *breakerService) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]Event, error) {
+	var events []Event
+	err := s.b.Do(func() error {
+		var err error
+		events, err = s.Service.GetEvents(ctx, projectID, userID, start, end, limit)
+		return err
+	})
+	return events, err
+}
+
+func (s *breakerService) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	var fnErr error
+	err := s.b.Do(func() error {
+		err := s.Service.StreamEvents(ctx, projectID, userID, start, end, limit, func(e Event) error {
+			fnErr = fn(e)
+			return fnErr
+		})
+		if fnErr != nil {
+			// e.g. the client went away: the database did not fail
+			return nil
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s *breakerService) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	var fnErr error
+	err := s.b.Do(func() error {
+		err := s.Service.FilterEvents(ctx, projectID, expr, userID, start, end, limit, func(e Event) error {
+			fnErr = fn(e)
+			return fnErr
+		})
+		if fnErr != nil {
+			return nil
+		}
+		return err
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s *breakerService) AggregateEvents(seconds int) error {
+	return s.b.Do(func() error {
+		return s.Service.AggregateEvents(seconds)
+	})
+}
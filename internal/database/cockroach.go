@@ -0,0 +1,70 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// cockroach is set by Configure in the CockroachDB compatibility mode, in
+// which the statements CockroachDB does not support are replaced: the
+// events are inserted without COPY, identical events are deduplicated by
+// the serializable transactions instead of an advisory lock, and the
+// aggregates are written with UPSERT.
+var cockroach bool
+
+// maxTxAttempts bounds the runs of a transaction aborted by serialization
+// failures.
+const maxTxAttempts = 5
+
+var txRetries = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "db_transaction_retries_total",
+	Help: "Transactions run again after a serialization failure (SQLSTATE 40001)",
+})
+
+func init() {
+	prometheus.MustRegister(txRetries)
+}
+
+// inTx runs fn in a transaction and commits it. A transaction aborted by a
+// serialization failure, which CockroachDB reports whenever concurrent
+// transactions conflict, is run again from the start, backing off between
+// attempts.
+func inTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	backoff := 10 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := runTx(ctx, db, opts, fn)
+		if err == nil || !isSerializationFailure(err) || attempt == maxTxAttempts {
+			return err
+		}
+		txRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func runTx(ctx context.Context, db *sql.DB, opts *sql.TxOptions, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func isSerializationFailure(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == "40001"
+}
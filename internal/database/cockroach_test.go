@@ -0,0 +1,182 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// startCockroach starts a single-node CockroachDB with the schema of
+// other/init_tables_cockroach.sql, and returns a pool to it.
+func startCockroach(t *testing.T) *sql.DB {
+	t.Helper()
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "cockroachdb/cockroach:latest-v24.3",
+			Cmd:          []string{"start-single-node", "--insecure"},
+			ExposedPorts: []string{"26257/tcp", "8080/tcp"},
+			WaitingFor:   wait.ForHTTP("/health?ready=1").WithPort("8080/tcp").WithStartupTimeout(60 * time.Second),
+		},
+		Started: true,
+	})
+	if err != nil {
+		t.Fatalf("could not start cockroachdb container: %v", err)
+	}
+	t.Cleanup(func() { _ = container.Terminate(context.Background()) })
+
+	dbHost, err := container.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbPort, err := container.MappedPort(ctx, "26257/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("pgx", fmt.Sprintf("postgres://root@%s:%s/defaultdb?sslmode=disable", dbHost, dbPort.Port()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	schema, err := os.ReadFile(filepath.Join("..", "..", "other", "init_tables_cockroach.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range regexp.MustCompile(`(?m);\s*$`).Split(string(schema), -1) {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("create schema: %v\n%s", err, stmt)
+		}
+	}
+	return db
+}
+
+func TestCockroach(t *testing.T) {
+	ctx := context.Background()
+	db := startCockroach(t)
+	cockroach = true
+	t.Cleanup(func() { cockroach = false })
+	srv := &service{db: db}
+
+	t.Run("schema follows init_tables.sql", func(t *testing.T) {
+		columns := func(db *sql.DB) map[string]bool {
+			rows, err := db.QueryContext(ctx, `
+SELECT table_name, column_name FROM information_schema.columns
+WHERE table_schema = current_schema() AND column_name <> 'rowid'`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			cols := map[string]bool{}
+			for rows.Next() {
+				var table, column string
+				if err := rows.Scan(&table, &column); err != nil {
+					t.Fatal(err)
+				}
+				cols[table+"."+column] = true
+			}
+			return cols
+		}
+		crdb := columns(db)
+		for col := range columns(open().db) {
+			if !crdb[col] {
+				t.Errorf("%s is missing from init_tables_cockroach.sql", col)
+			}
+		}
+	})
+
+	t.Run("insert and read", func(t *testing.T) {
+		if _, err := srv.InsertEvent(ctx, 0, 1201, "login", map[string]string{"page": "/home"}); err != nil {
+			t.Fatalf("insert event: %v", err)
+		}
+		created := time.Now().UTC().Add(-time.Minute).Truncate(time.Microsecond)
+		batch := []NewEvent{
+			{UserID: 1201, Action: "view"},
+			{UserID: 1201, Action: "click", CreatedAt: created, DedupeKey: "crdb-1"},
+			{UserID: 1201, Action: "click", CreatedAt: created, DedupeKey: "crdb-1"},
+		}
+		for range 2 {
+			if err := srv.InsertEvents(ctx, batch); err != nil {
+				t.Fatalf("insert events: %v", err)
+			}
+		}
+
+		user := int64(1201)
+		events, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+		if err != nil {
+			t.Fatalf("get events: %v", err)
+		}
+		// The unkeyed event twice, the keyed one once
+		if len(events) != 4 {
+			t.Fatalf("expected 4 events, got %+v", events)
+		}
+		var streamed int
+		if err := srv.StreamEvents(ctx, DefaultProjectID, &user, nil, nil, 2, func(Event) error { streamed++; return nil }); err != nil || streamed != 2 {
+			t.Fatalf("expected 2 streamed events, got %d: %v", streamed, err)
+		}
+	})
+
+	t.Run("concurrent identical events are stored once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		stored := make([]bool, 8)
+		errs := make([]error, 8)
+		for i := range stored {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, duplicate, err := srv.InsertEventOnce(ctx, NewEvent{UserID: 1202, Action: "purchase", Metadata: map[string]string{"page": "/cart"}}, time.Minute)
+				stored[i], errs[i] = !duplicate, err
+			}()
+		}
+		wg.Wait()
+		var n int
+		for i := range stored {
+			if errs[i] != nil {
+				t.Fatalf("insert event once: %v", errs[i])
+			}
+			if stored[i] {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Fatalf("expected a single stored event, got %d", n)
+		}
+	})
+
+	t.Run("aggregate", func(t *testing.T) {
+		for range 2 {
+			if err := srv.AggregateEvents(3600); err != nil {
+				t.Fatalf("aggregate events: %v", err)
+			}
+		}
+		var count int64
+		if err := db.QueryRowContext(ctx, `SELECT sum(event_count) FROM user_event_counts WHERE user_id = 1201`).Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		// Every period counts the same events once
+		var periods int64
+		if err := db.QueryRowContext(ctx, `SELECT count(*) FROM user_event_counts WHERE user_id = 1201`).Scan(&periods); err != nil {
+			t.Fatal(err)
+		}
+		if count != 4*periods {
+			t.Fatalf("expected 4 events per period, got %d in %d periods", count, periods)
+		}
+		var hours int64
+		if err := db.QueryRowContext(ctx, `SELECT sum(event_count) FROM action_user_hours WHERE user_id = 1201`).Scan(&hours); err != nil || hours != 4 {
+			t.Fatalf("expected 4 events in the hours, got %d: %v", hours, err)
+		}
+	})
+}
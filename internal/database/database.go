@@ -3,14 +3,22 @@ package database
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/url"
 	"os"
 	"strconv"
 	"time"
 
-	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 )
 
 // Event represents a row from the events table.
@@ -20,13 +28,81 @@ type Event struct {
 	Action       string    `json:"action"`
 	MetadataPage *string   `json:"metadata_page,omitempty"`
 	CreatedAt    time.Time `json:"created_at"`
+	// SchemaVersion is the version of the event schema the event was sent
+	// with, 1 for the events sent without one
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// ProjectID and ExpiresAt are read by the outbox relay and EventStream
+	// only, for the sinks and replays publishing the events of every
+	// project
+	ProjectID int64      `json:"project_id,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// DefaultProjectID is the project of the events sent without an API key,
+// and of the events stored before projects were introduced.
+const DefaultProjectID int64 = 1
+
+// NewEvent is an event to be stored by InsertEvents.
+type NewEvent struct {
+	// ProjectID defaults to DefaultProjectID when zero.
+	ProjectID int64
+	UserID    int64
+	Action    string
+	Metadata  map[string]string
+	// CreatedAt defaults to the time of the insert when zero.
+	CreatedAt time.Time
+	// DedupeKey, when set, stores the event only if no event with the same
+	// key was stored before.
+	DedupeKey string
+	// DeliverAt, when set, keeps the event in pending_events until then,
+	// and it is created at that time.
+	DeliverAt time.Time
+	// TTL, when set, makes the event expire that long after it is
+	// created: it is left out of the queries, then deleted.
+	TTL time.Duration
+	// SchemaVersion is stored as 1 when 0.
+	SchemaVersion int
+
+	// metadataDigest replaces the digest of Metadata in the fingerprint
+	// once the values are encrypted.
+	metadataDigest []byte
 }
 
 type Eventter interface {
-	// InsertEvent inserts a new event and returns the created event id.
-	InsertEvent(ctx context.Context, userID int64, action string, metadata map[string]string) (int64, error)
-	// GetEvents returns events filtered by optional userID, start and end timestamps.
-	GetEvents(ctx context.Context, userID *int64, start *time.Time, end *time.Time) ([]Event, error)
+	// InsertEvent inserts a new event of the project and returns the created event id.
+	InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error)
+	// InsertEvents stores a batch of events in a single round trip.
+	InsertEvents(ctx context.Context, events []NewEvent) error
+	// GetEvents returns at most limit events of the project, newest first,
+	// filtered by optional userID, start and end timestamps. A limit of 0
+	// returns every event.
+	GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]Event, error)
+}
+
+// Streamer reads events without loading them all in memory.
+type Streamer interface {
+	// StreamEvents calls fn with every event GetEvents would return, row
+	// by row, and stops at the first error of fn.
+	StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error
+}
+
+// ErrFilterUnsupported is returned for the filters on a field the database
+// cannot compare, such as encrypted metadata.
+var ErrFilterUnsupported = errors.New("filter not supported")
+
+// Filterer reads the events matching a filter expression.
+type Filterer interface {
+	// FilterEvents calls fn with the events StreamEvents would return that
+	// also match expr, and stops at the first error of fn.
+	FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error
+}
+
+// Deduplicater stores events once within a window.
+type Deduplicater interface {
+	// InsertEventOnce inserts an event unless an identical one (same
+	// fingerprint) was stored in the project within window, in which case
+	// that event is returned with duplicate set.
+	InsertEventOnce(ctx context.Context, e NewEvent, window time.Duration) (stored Event, duplicate bool, err error)
 }
 
 type Aggregatter interface {
@@ -46,6 +122,12 @@ type Service interface {
 
 	Eventter
 
+	Deduplicater
+
+	Streamer
+
+	Filterer
+
 	Aggregatter
 }
 
@@ -63,18 +145,45 @@ var (
 	dbInstance *service
 )
 
+// Configure overrides the connection settings read from the environment.
+// It must be called before the first call to New.
+func Configure(cfg config.DBConfig) {
+	host = cfg.Host
+	port = strconv.Itoa(cfg.Port)
+	database = cfg.Database
+	username = cfg.Username
+	password = cfg.Password
+	schema = cfg.Schema
+	timescale = cfg.Timescale.Enabled
+	cockroach = cfg.Cockroach
+}
+
 func New() Service {
 	// Reuse Connection
 	if dbInstance != nil {
 		return dbInstance
 	}
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema)
-	db, err := sql.Open("pgx", connStr)
+	s := open()
+
+	err := s.db.Ping()
 	if err != nil {
 		log.Fatal(err)
 	}
+	return s
+}
 
-	err = db.Ping()
+// Open returns the shared connection pool without waiting for the database
+// to accept connections. Use WaitForConnection before serving traffic.
+func Open() Service {
+	return open()
+}
+
+func open() *service {
+	if dbInstance != nil {
+		return dbInstance
+	}
+	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=disable&search_path=%s", username, password, host, port, database, schema)
+	db, err := sql.Open("pgx", connStr)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -85,8 +194,92 @@ func New() Service {
 	return dbInstance
 }
 
+// Pool is a connection pool of its own to a database other than the one of
+// Configure, such as a shard.
+type Pool struct {
+	*service
+	host string
+}
+
+// OpenURL opens a pool to the Postgres database at rawURL without waiting
+// for it to accept connections.
+func OpenURL(rawURL string) (*Pool, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse database url: %w", err)
+	}
+	db, err := sql.Open("pgx", rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", u.Host, err)
+	}
+	return &Pool{service: &service{db: db}, host: u.Host}, nil
+}
+
+// WaitForConnection waits for the database of the pool like the function
+// of the same name does for the shared pool.
+func (p *Pool) WaitForConnection(ctx context.Context, logger *slog.Logger, wait time.Duration) error {
+	return waitFor(ctx, logger.With("database", p.host), wait, p.db)
+}
+
+// EventStore runs the maintenance operations on the events of the pool.
+func (p *Pool) EventStore() *EventStore {
+	return &EventStore{db: p.db}
+}
+
+// RegisterStats exports the statistics of the pool like RegisterPoolStats.
+func (p *Pool) RegisterStats(name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(p.db, name))
+}
+
+func (p *Pool) Close() error {
+	log.Printf("Disconnected from database at %s", p.host)
+	return p.db.Close()
+}
+
+// RegisterPoolStats exports the statistics of the shared pool as the
+// go_sql_* gauges and counters labelled db_name, sampled at every scrape,
+// so that the saturation of the pool can be followed over time.
+func RegisterPoolStats(name string) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(open().db, name))
+}
+
+// WaitForConnection pings the database until it answers, backing off
+// exponentially between attempts, for at most wait. A zero wait makes a
+// single attempt. It returns the last ping error when the database never
+// came up.
+func WaitForConnection(ctx context.Context, logger *slog.Logger, wait time.Duration) error {
+	return waitFor(ctx, logger, wait, open().db)
+}
+
+func waitFor(ctx context.Context, logger *slog.Logger, wait time.Duration, db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancelPing := context.WithTimeout(context.Background(), 2*time.Second)
+		err := db.PingContext(pingCtx)
+		cancelPing()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("database not reachable after %d attempts: %w", attempt, err)
+		}
+
+		logger.Warn("database not reachable yet", "attempt", attempt, "retry_in", backoff.String(), "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database not reachable after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
+
 // Health checks the health of the database connection by pinging the database.
-// It returns a map with keys indicating various health statistics.
+// It returns a map with keys indicating various health statistics, with the
+// status "down" and the error when the ping fails.
 func (s *service) Health() map[string]string {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
@@ -98,7 +291,6 @@ func (s *service) Health() map[string]string {
 	if err != nil {
 		stats["status"] = "down"
 		stats["error"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf("db down: %v", err) // Log the error and terminate the program
 		return stats
 	}
 
@@ -147,7 +339,7 @@ func (s *service) Close() error {
 
 // InsertEvent inserts a new event into the events table.
 // metadata is stored in the metadata_page column as plain text or JSON string depending on input.
-func (s *service) InsertEvent(ctx context.Context, userID int64, action string, metadata map[string]string) (int64, error) {
+func (s *service) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
 	// For now we'll store metadata.page into metadata_page column if present.
 	var metadataPage sql.NullString
 	if metadata != nil {
@@ -156,32 +348,133 @@ func (s *service) InsertEvent(ctx context.Context, userID int64, action string,
 		}
 	}
 
-	query := `INSERT INTO events(user_id, action, metadata_page) VALUES ($1, $2, $3) RETURNING id`
+	query := `INSERT INTO events(project_id, user_id, action, metadata_page) VALUES ($1, $2, $3, $4) RETURNING id`
 	var id int64
 	// Use QueryRowContext to return the inserted id
-	err := s.db.QueryRowContext(ctx, query, userID, action, metadataPage).Scan(&id)
+	err := s.db.QueryRowContext(ctx, query, projectOrDefault(projectID), userID, action, metadataPage).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
 	return id, nil
 }
 
+// InsertEvents stores events with COPY, which is much cheaper than one
+// INSERT per event for the batches produced by the ingestion pipelines.
+// Either the whole batch is stored or none of it. Batches carrying dedupe
+// keys or TTLs, or timestamps on some of their events only, are inserted by
+// insertKeyed instead.
+func (s *service) InsertEvents(ctx context.Context, events []NewEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	pending, events := splitScheduled(events)
+	if len(pending) > 0 {
+		if err := s.insertPending(ctx, pending); err != nil || len(events) == 0 {
+			return err
+		}
+	}
+	// CockroachDB does not take the binary COPY of pgx
+	if cockroach {
+		return s.insertKeyed(ctx, events)
+	}
+	timed := 0
+	for _, e := range events {
+		if e.DedupeKey != "" || e.TTL > 0 {
+			return s.insertKeyed(ctx, events)
+		}
+		if !e.CreatedAt.IsZero() {
+			timed++
+		}
+	}
+	if timed > 0 && timed < len(events) {
+		return s.insertKeyed(ctx, events)
+	}
+
+	columns := []string{"project_id", "user_id", "action", "metadata_page", "schema_version"}
+	if timed > 0 {
+		columns = append(columns, "created_at")
+	}
+	rows := make([][]any, len(events))
+	for i, e := range events {
+		var metadataPage *string
+		if page, ok := e.Metadata["page"]; ok {
+			metadataPage = &page
+		}
+		rows[i] = []any{projectOrDefault(e.ProjectID), e.UserID, e.Action, metadataPage, e.schemaVersion()}
+		if timed > 0 {
+			rows[i] = append(rows[i], e.CreatedAt)
+		}
+	}
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+		_, err := pgxConn.CopyFrom(ctx,
+			pgx.Identifier{"events"},
+			columns,
+			pgx.CopyFromRows(rows),
+		)
+		return err
+	})
+}
+
 // GetEvents queries events table using optional filters.
 // Uses the provided SQL:
 // SELECT id, user_id, action, metadata_page, created_at
 // FROM events
-// WHERE ($1::bigint IS NULL OR user_id = $1)
+// WHERE project_id = $4
+// AND ($1::bigint IS NULL OR user_id = $1)
 // AND ($2::timestamptz IS NULL OR created_at >= $2)
 // AND ($3::timestamptz IS NULL OR created_at <= $3)
-// ORDER BY created_at DESC;
-func (s *service) GetEvents(ctx context.Context, userID *int64, start *time.Time, end *time.Time) ([]Event, error) {
+// ORDER BY created_at DESC
+// LIMIT $5;
+func (s *service) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]Event, error) {
+	events := make([]Event, 0)
+	err := s.queryEvents(ctx, projectID, nil, userID, start, end, limit, func(e Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (s *service) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	return s.queryEvents(ctx, projectID, nil, userID, start, end, limit, fn)
+}
+
+func (s *service) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	return s.queryEvents(ctx, projectID, expr, userID, start, end, limit, fn)
+}
+
+// queryEvents calls fn with the events selected by GetEvents, and matching
+// expr unless nil, as they are read from the database. Expired events are
+// left out before the janitor deletes them. The archived events
+// are included when ctx says so (see WithArchive).
+func (s *service) queryEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	var cond string
+	var condArgs []any
+	if expr != nil {
+		cond, condArgs = expr.SQL(6)
+		cond = "AND " + cond
+	}
 	query := `
-SELECT id, user_id, action, metadata_page, created_at
-FROM events
-WHERE ($1::bigint IS NULL OR user_id = $1)
+SELECT id, user_id, action, metadata_page, created_at, schema_version
+FROM ` + eventsSource(ctx) + `
+WHERE project_id = $4
+AND ($1::bigint IS NULL OR user_id = $1)
 AND ($2::timestamptz IS NULL OR created_at >= $2)
 AND ($3::timestamptz IS NULL OR created_at <= $3)
-ORDER BY created_at DESC;
+AND ` + notExpired + `
+` + cond + `
+ORDER BY created_at DESC
+LIMIT $5;
 `
 	var uid interface{} = nil
 	if userID != nil {
@@ -195,50 +488,285 @@ ORDER BY created_at DESC;
 	if end != nil {
 		endVal = *end
 	}
+	// LIMIT NULL returns every row
+	var limitVal interface{} = nil
+	if limit > 0 {
+		limitVal = limit
+	}
 
-	rows, err := s.db.QueryContext(ctx, query, uid, startVal, endVal)
+	args := append([]any{uid, startVal, endVal, projectOrDefault(projectID), limitVal}, condArgs...)
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer rows.Close()
 
-	events := make([]Event, 0)
 	for rows.Next() {
 		var e Event
 		var metadata sql.NullString
-		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &metadata, &e.CreatedAt); err != nil {
-			return nil, err
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &metadata, &e.CreatedAt, &e.SchemaVersion); err != nil {
+			return err
 		}
 		if metadata.Valid {
 			e.MetadataPage = &metadata.String
 		} else {
 			e.MetadataPage = nil
 		}
-		events = append(events, e)
+		if err := fn(e); err != nil {
+			return err
+		}
 	}
-	if err := rows.Err(); err != nil {
-		return nil, err
+	return rows.Err()
+}
+
+// insertKeyed stores events with their timestamp, dedupe key and expiry,
+// which COPY cannot skip on conflict, in a single statement.
+func (s *service) insertKeyed(ctx context.Context, events []NewEvent) error {
+	projectIDs := make([]int64, len(events))
+	userIDs := make([]int64, len(events))
+	actions := make([]string, len(events))
+	pages := make([]*string, len(events))
+	createdAt := make([]*time.Time, len(events))
+	keys := make([]*string, len(events))
+	ttls := make([]*float64, len(events))
+	versions := make([]int, len(events))
+	for i, e := range events {
+		projectIDs[i], userIDs[i], actions[i], ttls[i], versions[i] = projectOrDefault(e.ProjectID), e.UserID, e.Action, e.ttlSeconds(), e.schemaVersion()
+		if page, ok := e.Metadata["page"]; ok {
+			pages[i] = &page
+		}
+		if !e.CreatedAt.IsZero() {
+			createdAt[i] = &events[i].CreatedAt
+		}
+		if e.DedupeKey != "" {
+			keys[i] = &events[i].DedupeKey
+		}
 	}
-	return events, nil
+
+	if timescale {
+		return s.insertKeyedOnce(ctx, projectIDs, userIDs, actions, pages, createdAt, keys, ttls, versions)
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO events (project_id, user_id, action, metadata_page, created_at, dedupe_key, expires_at, schema_version)
+SELECT project_id, user_id, action, metadata_page, COALESCE(created_at, now()), dedupe_key,
+	COALESCE(created_at, now()) + ttl * INTERVAL '1 second', schema_version
+FROM unnest($1::bigint[], $2::bigint[], $3::text[], $4::text[], $5::timestamptz[], $6::text[], $7::float8[], $8::int[])
+	AS e(project_id, user_id, action, metadata_page, created_at, dedupe_key, ttl, schema_version)
+ON CONFLICT (dedupe_key) WHERE dedupe_key IS NOT NULL DO NOTHING`, projectIDs, userIDs, actions, pages, createdAt, keys, ttls, versions)
+	return err
+}
+
+// insertKeyedOnce stores the events of insertKeyed in the TimescaleDB mode,
+// where the hypertable cannot hold a unique index on the dedupe key: the
+// keys are claimed in event_dedupe_keys first, and only the first event of
+// each claimed key is stored.
+func (s *service) insertKeyedOnce(ctx context.Context, projectIDs, userIDs []int64, actions []string, pages []*string, createdAt []*time.Time, keys []*string, ttls []*float64, versions []int) error {
+	_, err := s.db.ExecContext(ctx, `
+WITH e AS (
+	SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::text[], $4::text[], $5::timestamptz[], $6::text[], $7::float8[], $8::int[])
+		WITH ORDINALITY AS e(project_id, user_id, action, metadata_page, created_at, dedupe_key, ttl, schema_version, n)
+), claimed AS (
+	INSERT INTO event_dedupe_keys (dedupe_key)
+	SELECT DISTINCT dedupe_key FROM e WHERE dedupe_key IS NOT NULL
+	ON CONFLICT DO NOTHING
+	RETURNING dedupe_key
+)
+INSERT INTO events (project_id, user_id, action, metadata_page, created_at, dedupe_key, expires_at, schema_version)
+SELECT project_id, user_id, action, metadata_page, COALESCE(created_at, now()), dedupe_key,
+	COALESCE(created_at, now()) + ttl * INTERVAL '1 second', schema_version
+FROM e
+WHERE dedupe_key IS NULL
+	OR dedupe_key IN (SELECT dedupe_key FROM claimed) AND n = (SELECT min(f.n) FROM e f WHERE f.dedupe_key = e.dedupe_key)`,
+		projectIDs, userIDs, actions, pages, createdAt, keys, ttls, versions)
+	return err
+}
+
+func projectOrDefault(id int64) int64 {
+	if id == 0 {
+		return DefaultProjectID
+	}
+	return id
 }
 
-// AggregateEvents creates/upserts aggregated counts into user_event_counts for the time window defined
-// by nowUTC - seconds .. nowUTC. It uses an INSERT ... ON CONFLICT to upsert per (user_id, period_start).
+// ttlSeconds is the TTL of e in seconds, nil when the event is kept.
+func (e NewEvent) ttlSeconds() *float64 {
+	if e.TTL <= 0 {
+		return nil
+	}
+	secs := e.TTL.Seconds()
+	return &secs
+}
+
+// schemaVersion is the version e is stored with.
+func (e NewEvent) schemaVersion() int {
+	return max(e.SchemaVersion, 1)
+}
+
+// AggregateEvents counts the events into user_event_counts and action_event_counts per project by periods of
+// seconds, aligned on multiples of seconds since the Unix epoch, from the last complete period counted, recorded
+// in aggregated_periods, up to now. The complete periods that received events with an older created_at since
+// the run before the last one are counted again. The hours the periods touch are counted again into
+// action_user_hours, with an INSERT ... ON CONFLICT, or UPSERT with CockroachDB. The expired events and those with an
+// excluded tag are left out (see counted), and the events that expired since the last run are taken off the
+// aggregates.
 func (s *service) AggregateEvents(seconds int) error {
-	periodEnd := time.Now().UTC()
-	periodStart := periodEnd.Add(-time.Duration(seconds) * time.Second)
-
-	_, err := s.db.Exec(`
-	INSERT INTO user_event_counts (user_id, period_start, period_end, event_count)
-	SELECT user_id, $1, $2, COUNT(*) FROM events
-	WHERE created_at >= $1 AND created_at < $2
-	GROUP BY user_id
-	ON CONFLICT (user_id, period_start)
-	DO UPDATE SET event_count = EXCLUDED.event_count;
-	`, periodStart, periodEnd)
-	if err == sql.ErrNoRows {
+	// The continuous aggregates of the TimescaleDB mode are counted by
+	// TimescaleDB
+	if timescale {
+		return refreshAggregates(context.Background(), s.db)
+	}
+
+	now := time.Now().UTC()
+	until := time.Unix(now.Unix()/int64(seconds)*int64(seconds), 0).UTC()
+
+	return inTx(context.Background(), s.db, nil, func(tx *sql.Tx) error {
+		// The row is locked, so that the runs of several instances follow each
+		// other
+		if _, err := tx.Exec(`INSERT INTO aggregated_periods (id, period_seconds, covered_from, covered_to, aggregated_at) VALUES (1, 0, $1, $1, $1) ON CONFLICT (id) DO NOTHING`, until); err != nil {
+			return err
+		}
+		var periodSeconds int
+		var coveredFrom, from, aggregatedAt time.Time
+		var checkedID, lastID int64
+		if err := tx.QueryRow(`
+	SELECT period_seconds, covered_from, covered_to, aggregated_at, checked_event_id, last_event_id
+	FROM aggregated_periods WHERE id = 1 FOR UPDATE`).Scan(&periodSeconds, &coveredFrom, &from, &aggregatedAt, &checkedID, &lastID); err != nil {
+			return err
+		}
+
+		// The events counted by the last run that expired since are taken off
+		// the aggregates, before the periods are counted again
+		if _, err := tx.Exec(`
+	WITH gone AS (
+		SELECT project_id, user_id, action, created_at FROM events
+		WHERE expires_at > $1 AND expires_at <= $2 AND created_at < $1 AND `+untagged("events", "$3")+`
+	)`+subtract()+`
+	SELECT count(*) FROM gone`, aggregatedAt, now, nonNil(excludedTags)); err != nil {
+			return err
+		}
+		var maxID int64
+		if err := tx.QueryRow(`SELECT COALESCE(max(id), 0) FROM events`).Scan(&maxID); err != nil {
+			return err
+		}
+
+		var late []time.Time
+		if periodSeconds != seconds {
+			// The first run, or the interval changed: the counts restart with
+			// the last complete period, without the periods of the former
+			// interval overlapping it
+			from = until.Add(-time.Duration(seconds) * time.Second)
+			coveredFrom = from
+			for _, table := range []string{"user_event_counts", "action_event_counts"} {
+				if _, err := tx.Exec(`DELETE FROM `+table+` WHERE period_end > $1`, from); err != nil {
+					return err
+				}
+			}
+		} else {
+			// Events stored since the run before the last one, whose ids may
+			// have been committed after it, with a created_at in a period
+			// counted already, such as imports or replays of the spool
+			rows, err := tx.Query(`
+	SELECT DISTINCT to_timestamp(`+aggregationPeriod+` * $3::float8) FROM events
+	WHERE id > $1 AND created_at >= $2 AND created_at < $4`, checkedID, coveredFrom, float64(seconds), from)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var start time.Time
+				if err := rows.Scan(&start); err != nil {
+					rows.Close()
+					return err
+				}
+				late = append(late, start.UTC())
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+		}
+
+		for _, start := range late {
+			if err := countPeriods(tx, start, start.Add(time.Duration(seconds)*time.Second), seconds, now); err != nil {
+				return err
+			}
+		}
+		// The last period, still running, is counted up to now and again by the
+		// next run
+		if err := countPeriods(tx, from, now, seconds, now); err != nil {
+			return err
+		}
+
+		// Hours are counted whole, from the start of the hour of the periods
+		for _, start := range late {
+			end := start.Add(time.Duration(seconds) * time.Second).Add(-time.Nanosecond).Truncate(time.Hour).Add(time.Hour)
+			if end.After(now) {
+				end = now
+			}
+			if err := countHours(tx, start, end, now); err != nil {
+				return err
+			}
+		}
+		if err := countHours(tx, from, now, now); err != nil {
+			return err
+		}
+
+		to := until
+		if to.Before(from) {
+			to = from
+		}
+		if _, err := tx.Exec(`
+	UPDATE aggregated_periods
+	SET period_seconds = $1, covered_from = $2, covered_to = $3, aggregated_at = $4, checked_event_id = $5, last_event_id = $6
+	WHERE id = 1`, seconds, coveredFrom, to, now, lastID, maxID); err != nil {
+			return err
+		}
 		return nil
+	})
+}
+
+// aggregationPeriod numbers the aggregation period of $3 seconds of the
+// created_at of an event, from the Unix epoch.
+const aggregationPeriod = `floor(extract(epoch FROM created_at) / $3::float8)`
+
+// countPeriods replaces the counts of the periods of seconds starting in
+// [from, to) with the events created in the range that are counted by
+// cutoff (see counted); from is the start of a period.
+func countPeriods(tx *sql.Tx, from, to time.Time, seconds int, cutoff time.Time) error {
+	for _, table := range []string{"user_event_counts", "action_event_counts"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE period_start >= $1 AND period_start < $2`, from, to); err != nil {
+			return err
+		}
 	}
 
+	if _, err := tx.Exec(`
+	INSERT INTO user_event_counts (project_id, user_id, period_start, period_end, event_count)
+	SELECT project_id, user_id, to_timestamp(period * $3::float8), LEAST(to_timestamp((period + 1) * $3::float8), $2), COUNT(*) FROM (
+		SELECT project_id, user_id, `+aggregationPeriod+` AS period FROM events
+		WHERE created_at >= $1 AND created_at < $2 AND `+counted("events", "$4", "$5")+`) e
+	GROUP BY project_id, user_id, period`, from, to, float64(seconds), cutoff, nonNil(excludedTags)); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+	INSERT INTO action_event_counts (project_id, action, period_start, period_end, event_count)
+	SELECT project_id, action, to_timestamp(period * $3::float8), LEAST(to_timestamp((period + 1) * $3::float8), $2), COUNT(*) FROM (
+		SELECT project_id, action, `+aggregationPeriod+` AS period FROM events
+		WHERE created_at >= $1 AND created_at < $2 AND `+counted("events", "$4", "$5")+`) e
+	GROUP BY project_id, action, period`, from, to, float64(seconds), cutoff, nonNil(excludedTags))
+	return err
+}
+
+// countHours counts the events created in [from, to) into action_user_hours,
+// from the start of the UTC hour of from, that are counted by cutoff (see
+// counted).
+func countHours(tx *sql.Tx, from, to, cutoff time.Time) error {
+	_, err := tx.Exec(`
+	INSERT INTO action_user_hours (project_id, action, hour, user_id, event_count)
+	SELECT project_id, action, date_trunc('hour', created_at, 'UTC'), user_id, COUNT(*) FROM events
+	WHERE created_at >= date_trunc('hour', $1::timestamptz, 'UTC') AND created_at < $2 AND `+counted("events", "$3", "$4")+`
+	GROUP BY 1, 2, 3, 4
+	ON CONFLICT (project_id, action, hour, user_id)
+	DO UPDATE SET event_count = EXCLUDED.event_count`, from, to, cutoff, nonNil(excludedTags))
 	return err
 }
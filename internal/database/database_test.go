@@ -3,6 +3,7 @@ package database
 import (
 	"context"
 	"log"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -24,10 +25,12 @@ func mustStartPostgresContainer() (func(context.Context, ...testcontainers.Termi
 		postgres.WithDatabase(dbName),
 		postgres.WithUsername(dbUser),
 		postgres.WithPassword(dbPwd),
+		// The schema of the docker compose setup
+		postgres.WithInitScripts(filepath.Join("..", "..", "other", "init_tables.sql")),
 		testcontainers.WithWaitStrategy(
 			wait.ForLog("database system is ready to accept connections").
 				WithOccurrence(2).
-				WithStartupTimeout(5*time.Second)),
+				WithStartupTimeout(30*time.Second)),
 	)
 	if err != nil {
 		return nil, err
@@ -36,6 +39,7 @@ func mustStartPostgresContainer() (func(context.Context, ...testcontainers.Termi
 	database = dbName
 	password = dbPwd
 	username = dbUser
+	schema = "public"
 
 	dbHost, err := dbContainer.Host(context.Background())
 	if err != nil {
@@ -93,8 +97,15 @@ func TestHealth(t *testing.T) {
 
 func TestClose(t *testing.T) {
 	srv := New()
+	// Let the following tests open a new pool
+	t.Cleanup(func() { dbInstance = nil })
 
 	if srv.Close() != nil {
 		t.Fatalf("expected Close() to return nil")
 	}
+
+	// A failed ping is reported, not fatal
+	if stats := srv.Health(); stats["status"] != "down" || stats["error"] == "" {
+		t.Fatalf("expected the closed database to be down, got %v", stats)
+	}
 }
@@ -0,0 +1,92 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Fingerprint identifies the events with the same project, user, action and
+// metadata, whatever the order of the metadata keys.
+func (e NewEvent) Fingerprint() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:%d:%s", projectOrDefault(e.ProjectID), e.UserID, len(e.Action), e.Action)
+	digest := e.metadataDigest
+	if digest == nil {
+		digest = metadataDigest(e.Metadata)
+	}
+	h.Write(digest)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func metadataDigest(metadata map[string]string) []byte {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%d:%s%d:%s", len(k), k, len(metadata[k]), metadata[k])
+	}
+	return h.Sum(nil)
+}
+
+// InsertEventOnce inserts e with its fingerprint unless an event with the
+// same fingerprint was stored in the project within window. Identical events
+// inserted concurrently, even by other instances, are serialized with an
+// advisory lock on the fingerprint, so only one of them is stored. With
+// CockroachDB, which has no advisory locks, its serializable transactions
+// conflict instead, and the one run again finds the stored event.
+func (s *service) InsertEventOnce(ctx context.Context, e NewEvent, window time.Duration) (Event, bool, error) {
+	fingerprint := e.Fingerprint()
+	projectID := projectOrDefault(e.ProjectID)
+
+	var stored Event
+	var duplicate bool
+	err := inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		if !cockroach {
+			if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtextextended($1, 0))`, fingerprint); err != nil {
+				return err
+			}
+		}
+
+		var existing Event
+		var page sql.NullString
+		err := tx.QueryRowContext(ctx, `
+SELECT id, user_id, action, metadata_page, created_at, schema_version
+FROM events
+WHERE project_id = $1 AND fingerprint = $2 AND created_at > now() - $3::float8 * INTERVAL '1 second'
+ORDER BY created_at DESC
+LIMIT 1`, projectID, fingerprint, window.Seconds()).Scan(&existing.ID, &existing.UserID, &existing.Action, &page, &existing.CreatedAt, &existing.SchemaVersion)
+		switch {
+		case err == nil:
+			if page.Valid {
+				existing.MetadataPage = &page.String
+			}
+			stored, duplicate = existing, true
+			return nil
+		case !errors.Is(err, sql.ErrNoRows):
+			return err
+		}
+
+		stored, duplicate = Event{UserID: e.UserID, Action: e.Action, SchemaVersion: e.schemaVersion()}, false
+		if p, ok := e.Metadata["page"]; ok {
+			stored.MetadataPage = &p
+		}
+		return tx.QueryRowContext(ctx, `
+INSERT INTO events (project_id, user_id, action, metadata_page, fingerprint, expires_at, schema_version)
+VALUES ($1, $2, $3, $4, $5, now() + $6::float8 * INTERVAL '1 second', $7)
+RETURNING id, created_at`, projectID, e.UserID, e.Action, stored.MetadataPage, fingerprint, e.ttlSeconds(), stored.SchemaVersion).Scan(&stored.ID, &stored.CreatedAt)
+	})
+	if err != nil {
+		return Event{}, false, err
+	}
+	return stored, duplicate, nil
+}
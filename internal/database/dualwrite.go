@@ -0,0 +1,118 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ErrDualWriteNotInstalled is returned when other/dual_write.sql did not
+// migrate the database.
+var ErrDualWriteNotInstalled = errors.New("dual write is not installed, run other/dual_write.sql")
+
+// DualWrite is the state of the copy of the events to events_v2 by the
+// trigger of other/dual_write.sql. StartedAt is set while enabled.
+type DualWrite struct {
+	Name      string     `json:"name"`
+	Enabled   bool       `json:"enabled"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+// dualWriteName is the row of dual_writes of events_v2.
+const dualWriteName = "events_v2"
+
+// v2Metadata is the metadata of events_v2 of a row of events e.
+const v2Metadata = `CASE WHEN e.metadata_page IS NULL THEN '{}'::jsonb ELSE jsonb_build_object('page', e.metadata_page) END`
+
+// DualWriteStore switches the dual write of the events to events_v2 and
+// compares both tables.
+type DualWriteStore struct {
+	db *sql.DB
+}
+
+// NewDualWriteStore uses the shared connection pool.
+func NewDualWriteStore() *DualWriteStore {
+	return &DualWriteStore{db: open().db}
+}
+
+// dualWriteError returns ErrDualWriteNotInstalled when a table of
+// other/dual_write.sql is missing.
+func dualWriteError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "42P01" {
+		return ErrDualWriteNotInstalled
+	}
+	return err
+}
+
+func (s *DualWriteStore) GetDualWrite(ctx context.Context) (DualWrite, error) {
+	d := DualWrite{Name: dualWriteName}
+	err := s.db.QueryRowContext(ctx, `SELECT enabled, started_at, updated_at FROM dual_writes WHERE name = $1`, dualWriteName).
+		Scan(&d.Enabled, &d.StartedAt, &d.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DualWrite{}, ErrDualWriteNotInstalled
+	}
+	return d, dualWriteError(err)
+}
+
+// SetDualWrite enables or disables the copy. Enabling it again keeps the
+// time it started.
+func (s *DualWriteStore) SetDualWrite(ctx context.Context, enabled bool) (DualWrite, error) {
+	d := DualWrite{Name: dualWriteName}
+	err := s.db.QueryRowContext(ctx, `
+UPDATE dual_writes SET
+	started_at = CASE WHEN NOT $2 THEN NULL WHEN enabled THEN started_at ELSE now() END,
+	enabled = $2,
+	updated_at = now()
+WHERE name = $1
+RETURNING enabled, started_at, updated_at`, dualWriteName, enabled).Scan(&d.Enabled, &d.StartedAt, &d.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DualWrite{}, ErrDualWriteNotInstalled
+	}
+	return d, dualWriteError(err)
+}
+
+// CountDualWrite returns the number of events created in [from, to) in
+// events and in events_v2.
+func (s *DualWriteStore) CountDualWrite(ctx context.Context, from, to time.Time) (events, copies int64, err error) {
+	err = s.db.QueryRowContext(ctx, `
+SELECT (SELECT count(*) FROM events WHERE created_at >= $1 AND created_at < $2),
+	(SELECT count(*) FROM events_v2 WHERE created_at >= $1 AND created_at < $2)`, from, to).Scan(&events, &copies)
+	return events, copies, dualWriteError(err)
+}
+
+// RepairDualWrite copies the events created in [from, to) missing from
+// events_v2, such as the events stored before the dual write started, and
+// deletes the copies of the events deleted meanwhile. It returns the
+// numbers of rows copied and deleted.
+func (s *DualWriteStore) RepairDualWrite(ctx context.Context, from, to time.Time) (copied, deleted int64, err error) {
+	err = inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, `
+INSERT INTO events_v2 (id, project_id, user_id, action, metadata, created_at, expires_at, schema_version)
+SELECT e.id, e.project_id, e.user_id, e.action, `+v2Metadata+`, e.created_at, e.expires_at, e.schema_version
+FROM events e
+WHERE e.created_at >= $1 AND e.created_at < $2
+	AND NOT EXISTS (SELECT 1 FROM events_v2 v WHERE v.id = e.id)
+ON CONFLICT (id) DO NOTHING`, from, to)
+		if err != nil {
+			return err
+		}
+		if copied, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		res, err = tx.ExecContext(ctx, `
+DELETE FROM events_v2 v
+WHERE v.created_at >= $1 AND v.created_at < $2
+	AND NOT EXISTS (SELECT 1 FROM events e WHERE e.id = v.id)`, from, to)
+		if err != nil {
+			return err
+		}
+		deleted, err = res.RowsAffected()
+		return err
+	})
+	return copied, deleted, dualWriteError(err)
+}
@@ -0,0 +1,123 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// TestDualWrite runs the dual write migration on a database of its own,
+// since it adds a trigger to the events table.
+func TestDualWrite(t *testing.T) {
+	ctx := context.Background()
+	container, err := postgres.Run(ctx,
+		"postgres:latest",
+		postgres.WithDatabase("database"),
+		postgres.WithUsername("user"),
+		postgres.WithPassword("password"),
+		postgres.WithInitScripts(filepath.Join("..", "..", "other", "init_tables.sql")),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(30*time.Second)),
+	)
+	if err != nil {
+		t.Fatalf("could not start postgres container: %v", err)
+	}
+	t.Cleanup(func() { _ = container.Terminate(context.Background()) })
+
+	connStr, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	srv := &service{db: db}
+	store := &DualWriteStore{db: db}
+
+	if _, err := store.GetDualWrite(ctx); !errors.Is(err, ErrDualWriteNotInstalled) {
+		t.Fatalf("expected ErrDualWriteNotInstalled before the migration, got %v", err)
+	}
+	if err := container.CopyFileToContainer(ctx, filepath.Join("..", "..", "other", "dual_write.sql"), "/tmp/dual_write.sql", 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// Running it twice changes nothing
+	for range 2 {
+		if code, _, err := container.Exec(ctx, []string{"psql", "-v", "ON_ERROR_STOP=1", "-U", "user", "-d", "database", "-f", "/tmp/dual_write.sql"}); err != nil || code != 0 {
+			t.Fatalf("migrate: exit code %d: %v", code, err)
+		}
+	}
+
+	from, to := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	page := "/home"
+	before, err := srv.InsertEvent(ctx, DefaultProjectID, 7, "signup", map[string]string{"page": page})
+	if err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	d, err := store.SetDualWrite(ctx, true)
+	if err != nil || !d.Enabled || d.StartedAt == nil {
+		t.Fatalf("expected the dual write started, got %+v: %v", d, err)
+	}
+	if again, err := store.SetDualWrite(ctx, true); err != nil || !again.StartedAt.Equal(*d.StartedAt) {
+		t.Fatalf("expected the start kept, got %+v: %v", again, err)
+	}
+	after, err := srv.InsertEvent(ctx, DefaultProjectID, 7, "login", nil)
+	if err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: 8, Action: "view", Metadata: map[string]string{"page": page}}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	if events, copies, err := store.CountDualWrite(ctx, from, to); err != nil || events != 3 || copies != 2 {
+		t.Fatalf("expected 3 events and 2 copies, got %d and %d: %v", events, copies, err)
+	}
+	var metadata string
+	if err := db.QueryRowContext(ctx, `SELECT metadata::text FROM events_v2 WHERE id = $1`, after).Scan(&metadata); err != nil || metadata != "{}" {
+		t.Fatalf("expected empty metadata, got %q: %v", metadata, err)
+	}
+
+	// The events stored before are copied, the copies of deleted ones go
+	if _, err := db.ExecContext(ctx, `ALTER TABLE events DISABLE TRIGGER events_dual_write`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM events WHERE id = $1`, after); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, `ALTER TABLE events ENABLE TRIGGER events_dual_write`); err != nil {
+		t.Fatal(err)
+	}
+	if copied, deleted, err := store.RepairDualWrite(ctx, from, to); err != nil || copied != 1 || deleted != 1 {
+		t.Fatalf("expected 1 copied and 1 deleted, got %d and %d: %v", copied, deleted, err)
+	}
+	if events, copies, err := store.CountDualWrite(ctx, from, to); err != nil || events != 2 || copies != 2 {
+		t.Fatalf("expected 2 events and copies, got %d and %d: %v", events, copies, err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT metadata->>'page' FROM events_v2 WHERE id = $1`, before).Scan(&metadata); err != nil || metadata != page {
+		t.Fatalf("expected the page in the metadata, got %q: %v", metadata, err)
+	}
+
+	// Deletes follow while enabled, nothing is copied once disabled
+	if _, err := db.ExecContext(ctx, `DELETE FROM events WHERE id = $1`, before); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := store.SetDualWrite(ctx, false); err != nil || d.Enabled || d.StartedAt != nil {
+		t.Fatalf("expected the dual write stopped, got %+v: %v", d, err)
+	}
+	if _, err := srv.InsertEvent(ctx, DefaultProjectID, 7, "logout", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if events, copies, err := store.CountDualWrite(ctx, from, to); err != nil || events != 2 || copies != 1 {
+		t.Fatalf("expected 2 events and 1 copy, got %d and %d: %v", events, copies, err)
+	}
+}
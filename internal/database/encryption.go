@@ -0,0 +1,116 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+)
+
+// encryptedService encrypts metadata values before they are stored and
+// decrypts them when events are read back through GetEvents.
+type encryptedService struct {
+	Service
+	c *fieldcrypt.Cipher
+}
+
+// NewMetadataEncryptor wraps svc so that the database only holds encrypted
+// metadata values. Values that fail to decrypt are returned as stored.
+func NewMetadataEncryptor(svc Service, c *fieldcrypt.Cipher) Service {
+	return &encryptedService{Service: svc, c: c}
+}
+
+func (s *encryptedService) encrypt(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	encrypted := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		encrypted[k] = s.c.Encrypt(v)
+	}
+	return encrypted
+}
+
+func (s *encryptedService) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return s.Service.InsertEvent(ctx, projectID, userID, action, s.encrypt(metadata))
+}
+
+func (s *encryptedService) InsertEvents(ctx context.Context, events []NewEvent) error {
+	encrypted := make([]NewEvent, len(events))
+	for i, e := range events {
+		e.Metadata = s.encrypt(e.Metadata)
+		encrypted[i] = e
+	}
+	return s.Service.InsertEvents(ctx, encrypted)
+}
+
+// InsertEventOnce fingerprints the metadata before it is encrypted, since
+// encrypting the same value twice gives different ciphertexts.
+func (s *encryptedService) InsertEventOnce(ctx context.Context, e NewEvent, window time.Duration) (Event, bool, error) {
+	e.metadataDigest = metadataDigest(e.Metadata)
+	e.Metadata = s.encrypt(e.Metadata)
+	stored, duplicate, err := s.Service.InsertEventOnce(ctx, e, window)
+	if err != nil {
+		return Event{}, false, err
+	}
+	s.decrypt(&stored)
+	return stored, duplicate, nil
+}
+
+func (s *encryptedService) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]Event, error) {
+	events, err := s.Service.GetEvents(ctx, projectID, userID, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		s.decrypt(&events[i])
+	}
+	return events, nil
+}
+
+func (s *encryptedService) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	return s.Service.StreamEvents(ctx, projectID, userID, start, end, limit, func(e Event) error {
+		s.decrypt(&e)
+		return fn(e)
+	})
+}
+
+// FilterEvents rejects the filters on metadata, which is stored encrypted
+// with a random nonce and cannot be compared by the database.
+func (s *encryptedService) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	if expr.Uses("metadata.page") {
+		return fmt.Errorf("%w: metadata is encrypted and cannot be filtered on", ErrFilterUnsupported)
+	}
+	return s.Service.FilterEvents(ctx, projectID, expr, userID, start, end, limit, func(e Event) error {
+		s.decrypt(&e)
+		return fn(e)
+	})
+}
+
+func (s *encryptedService) decrypt(e *Event) {
+	e.MetadataPage = decryptPage(s.c, e.MetadataPage)
+}
+
+// decryptPage returns the plaintext of page, or page as stored when c is
+// nil or it fails to decrypt.
+func decryptPage(c *fieldcrypt.Cipher, page *string) *string {
+	if c == nil || page == nil {
+		return page
+	}
+	plain, err := c.Decrypt(*page)
+	if err != nil {
+		return page
+	}
+	return &plain
+}
+
+// encryptPage encrypts page unless c is nil or page is encrypted already.
+func encryptPage(c *fieldcrypt.Cipher, page *string) *string {
+	if c == nil || page == nil || fieldcrypt.Encrypted(*page) {
+		return page
+	}
+	encrypted := c.Encrypt(*page)
+	return &encrypted
+}
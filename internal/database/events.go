@@ -0,0 +1,266 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// EventMaintainer counts and deletes events, such as an EventStore.
+type EventMaintainer interface {
+	Count(ctx context.Context, f EventFilter) (int64, error)
+	Delete(ctx context.Context, f EventFilter) (int64, error)
+}
+
+// EventStore runs the maintenance operations of the admin API on the events
+// table.
+type EventStore struct {
+	db *sql.DB
+}
+
+// NewEventStore uses the shared connection pool.
+func NewEventStore() *EventStore {
+	return &EventStore{db: open().db}
+}
+
+type exactCountKey struct{}
+
+// WithExactCount returns a context in which Count counts the events table
+// alone, rather than the aggregates of the complete aggregation periods.
+func WithExactCount(ctx context.Context) context.Context {
+	return context.WithValue(ctx, exactCountKey{}, true)
+}
+
+// ExactCount reports whether Count counts the events table alone with ctx.
+func ExactCount(ctx context.Context) bool {
+	exact, _ := ctx.Value(exactCountKey{}).(bool)
+	return exact
+}
+
+// Count returns the number of events matching f. The complete aggregation
+// periods within f are read from user_event_counts, or action_event_counts
+// for an action of every user, and only the rest of the range from the
+// events, unless ctx asks for an exact count: a range of complete periods
+// does not read the events. A filter on both a user and an
+// action, and the TimescaleDB mode, always count the events.
+func (s *EventStore) Count(ctx context.Context, f EventFilter) (int64, error) {
+	if ExactCount(ctx) || timescale || (f.UserID != nil && f.Action != "") {
+		return countEvents(ctx, s.db, f)
+	}
+
+	// The periods read and the aggregates are those of the same run
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var seconds int
+	var coveredFrom, coveredTo time.Time
+	err = tx.QueryRowContext(ctx, `SELECT period_seconds, covered_from, covered_to FROM aggregated_periods WHERE id = 1`).Scan(&seconds, &coveredFrom, &coveredTo)
+	if errors.Is(err, sql.ErrNoRows) || seconds == 0 {
+		return countEvents(ctx, tx, f)
+	} else if err != nil {
+		return 0, err
+	}
+	start, end, ok := completePeriods(f.From, f.To, coveredFrom, coveredTo, time.Duration(seconds)*time.Second)
+	if !ok {
+		return countEvents(ctx, tx, f)
+	}
+
+	// The complete periods, from the aggregates
+	counts := `
+SELECT COALESCE(sum(event_count), 0)::bigint FROM user_event_counts
+WHERE period_start >= $1 AND period_start < $2
+	AND ($3::bigint IS NULL OR project_id = $3)
+	AND ($4::bigint IS NULL OR user_id = $4)`
+	key := any(f.UserID)
+	if f.Action != "" {
+		counts = `
+SELECT COALESCE(sum(event_count), 0)::bigint FROM action_event_counts
+WHERE period_start >= $1 AND period_start < $2
+	AND ($3::bigint IS NULL OR project_id = $3)
+	AND action = $4`
+		key = f.Action
+	}
+	var n int64
+	if err := tx.QueryRowContext(ctx, counts, start, end, f.ProjectID, key).Scan(&n); err != nil {
+		return 0, err
+	}
+	if start.Equal(f.From) && end.Equal(f.To) {
+		return n, nil
+	}
+
+	// The rest of the range, from the events
+	var rest int64
+	err = tx.QueryRowContext(ctx, `
+SELECT count(*)
+FROM events
+WHERE ((created_at >= $1 AND created_at < $6) OR (created_at >= $7 AND created_at < $2))
+	AND ($3::bigint IS NULL OR user_id = $3)
+	AND ($4 = '' OR action = $4)
+	AND ($5::bigint IS NULL OR project_id = $5)
+	AND `+counted("events", "now()", "$8"), f.From, f.To, f.UserID, f.Action, f.ProjectID, start, end, nonNil(excludedTags)).Scan(&rest)
+	return n + rest, err
+}
+
+// notExpired leaves out the events that expired and that the janitor has
+// not deleted yet.
+const notExpired = `(expires_at IS NULL OR expires_at > now())`
+
+// counted is the condition of the events of table, a table name or alias,
+// that the counts and the statistics include: not expired by cutoff, and
+// without a tag of the text[] parameter tags, the excluded tags (see
+// untagged). The aggregates count with the cutoff of their run, and an
+// event expiring later is taken off them by the next run.
+func counted(table, cutoff, tags string) string {
+	return `(` + table + `.expires_at IS NULL OR ` + table + `.expires_at > ` + cutoff + `) AND ` + untagged(table, tags)
+}
+
+// rowQuerier is a *sql.DB or a *sql.Tx.
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// countEvents counts the events matching f in the events table.
+func countEvents(ctx context.Context, q rowQuerier, f EventFilter) (int64, error) {
+	var n int64
+	err := q.QueryRowContext(ctx, `
+SELECT count(*)
+FROM events
+WHERE created_at >= $1 AND created_at < $2
+	AND ($3::bigint IS NULL OR user_id = $3)
+	AND ($4 = '' OR action = $4)
+	AND ($5::bigint IS NULL OR project_id = $5)
+	AND `+counted("events", "now()", "$6"), f.From, f.To, f.UserID, f.Action, f.ProjectID, nonNil(excludedTags)).Scan(&n)
+	return n, err
+}
+
+// completePeriods returns the range [start, end) of the whole periods of
+// period within [from, to), out of the periods counted from coveredFrom to
+// coveredTo, and whether there is one.
+func completePeriods(from, to, coveredFrom, coveredTo time.Time, period time.Duration) (start, end time.Time, ok bool) {
+	if from.Before(coveredFrom) {
+		from = coveredFrom
+	}
+	if to.After(coveredTo) {
+		to = coveredTo
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, false
+	}
+	start = coveredFrom.Add((from.Sub(coveredFrom) + period - 1) / period * period)
+	end = coveredFrom.Add(to.Sub(coveredFrom) / period * period)
+	return start, end, start.Before(end)
+}
+
+// Delete removes the events matching f and returns how many were removed.
+// They are taken off the aggregation periods counting them, so that the
+// counts read from the aggregates stay exact.
+func (s *EventStore) Delete(ctx context.Context, f EventFilter) (int64, error) {
+	return deleteEvents(ctx, s.db, `
+created_at >= $1 AND created_at < $2
+	AND ($3::bigint IS NULL OR user_id = $3)
+	AND ($4 = '' OR action = $4)
+	AND ($5::bigint IS NULL OR project_id = $5)`, f.From, f.To, f.UserID, f.Action, f.ProjectID)
+}
+
+// deleteEvents deletes the events matching where, whose parameters are
+// args, takes them off the aggregates (see uncount) and returns how many
+// were deleted.
+func deleteEvents(ctx context.Context, db *sql.DB, where string, args ...any) (int64, error) {
+	query := `
+WITH deleted AS (
+	DELETE FROM events WHERE ` + where + `
+	RETURNING id, project_id, user_id, action, created_at, expires_at
+)` + uncount(len(args)+1) + `
+SELECT count(*) FROM deleted`
+
+	var n int64
+	err := inTx(ctx, db, nil, func(tx *sql.Tx) error {
+		params, err := uncountArgs(ctx, tx, args)
+		if err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, query, params...).Scan(&n)
+	})
+	return n, err
+}
+
+// uncount continues a WITH whose deleted statement returns the id, project,
+// user, action, created_at and expires_at of the events removed from
+// events, and subtracts those the last aggregation run counted, created
+// before it, not expired by it and without an excluded tag, from the rows
+// of user_event_counts, action_event_counts and action_user_hours whose
+// period holds them; the statements of a WITH run even when unused. Its
+// parameters, from $n on, are those uncountArgs appends. The continuous
+// aggregates of the TimescaleDB mode follow the events by themselves.
+func uncount(n int) string {
+	if timescale {
+		return ""
+	}
+	return fmt.Sprintf(`, gone AS (
+	SELECT project_id, user_id, action, created_at FROM deleted
+	WHERE created_at < $%d AND `, n) + counted("deleted", fmt.Sprintf("$%d", n), fmt.Sprintf("$%d", n+1)) + `
+)` + subtract()
+}
+
+// uncountArgs appends the parameters of uncount to args: the time of the
+// last aggregation run, whose row of aggregated_periods stays locked until
+// tx ends so that no run goes between, and the excluded tags.
+func uncountArgs(ctx context.Context, tx *sql.Tx, args []any) ([]any, error) {
+	if timescale {
+		return args, nil
+	}
+	var aggregatedAt sql.NullTime
+	err := tx.QueryRowContext(ctx, `SELECT aggregated_at FROM aggregated_periods WHERE id = 1 FOR SHARE`).Scan(&aggregatedAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return append(slices.Clip(args), aggregatedAt, nonNil(excludedTags)), nil
+}
+
+// subtract continues a WITH whose gone statement returns the project, user,
+// action and created_at of events counted by the aggregates, and subtracts
+// them from the rows whose period holds them.
+func subtract() string {
+	return `, users AS (
+	UPDATE user_event_counts c SET event_count = c.event_count - d.n
+	FROM (
+		SELECT c.project_id, c.user_id, c.period_start, count(*) AS n
+		FROM gone e JOIN user_event_counts c
+			ON c.project_id = e.project_id AND c.user_id = e.user_id
+			AND e.created_at >= c.period_start AND e.created_at < c.period_end
+		GROUP BY 1, 2, 3
+	) d
+	WHERE c.project_id = d.project_id AND c.user_id = d.user_id AND c.period_start = d.period_start
+), actions AS (
+	UPDATE action_event_counts c SET event_count = c.event_count - d.n
+	FROM (
+		SELECT c.project_id, c.action, c.period_start, count(*) AS n
+		FROM gone e JOIN action_event_counts c
+			ON c.project_id = e.project_id AND c.action = e.action
+			AND e.created_at >= c.period_start AND e.created_at < c.period_end
+		GROUP BY 1, 2, 3
+	) d
+	WHERE c.project_id = d.project_id AND c.action = d.action AND c.period_start = d.period_start
+), hours AS (
+	UPDATE action_user_hours h SET event_count = h.event_count - d.n
+	FROM (
+		SELECT project_id, action, date_trunc('hour', created_at, 'UTC') AS hour, user_id, count(*) AS n
+		FROM gone
+		GROUP BY 1, 2, 3, 4
+	) d
+	WHERE h.project_id = d.project_id AND h.action = d.action AND h.hour = d.hour AND h.user_id = d.user_id
+)`
+}
+
+// DeleteExpired removes up to limit events that expired by now, and returns
+// how many were removed. Like Delete, it takes them off the aggregates.
+func (s *EventStore) DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error) {
+	return deleteEvents(ctx, s.db, `
+id IN (SELECT id FROM events WHERE expires_at <= $1 ORDER BY expires_at LIMIT $2 FOR UPDATE SKIP LOCKED)`, now, limit)
+}
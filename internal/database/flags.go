@@ -0,0 +1,82 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrFeatureFlagNotFound is returned when a flag has no override for the
+// project.
+var ErrFeatureFlagNotFound = errors.New("feature flag override not found")
+
+// FeatureFlag overrides the default of a flag for a project, or for every
+// project when ProjectID is 0.
+type FeatureFlag struct {
+	Name      string    `json:"name"`
+	ProjectID int64     `json:"project_id,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FlagStore keeps the overrides of the feature flags in feature_flags.
+type FlagStore struct {
+	db *sql.DB
+}
+
+// NewFlagStore uses the shared connection pool.
+func NewFlagStore() *FlagStore {
+	return &FlagStore{db: open().db}
+}
+
+// ListFeatureFlags returns every override, by name and project.
+func (s *FlagStore) ListFeatureFlags(ctx context.Context) ([]FeatureFlag, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT name, project_id, enabled, updated_at FROM feature_flags ORDER BY name, project_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := make([]FeatureFlag, 0)
+	for rows.Next() {
+		var f FeatureFlag
+		if err := rows.Scan(&f.Name, &f.ProjectID, &f.Enabled, &f.UpdatedAt); err != nil {
+			return nil, err
+		}
+		flags = append(flags, f)
+	}
+	return flags, rows.Err()
+}
+
+// SetFeatureFlag creates or replaces an override, or returns
+// ErrProjectNotFound.
+func (s *FlagStore) SetFeatureFlag(ctx context.Context, f FeatureFlag) (FeatureFlag, error) {
+	err := s.db.QueryRowContext(ctx, `
+INSERT INTO feature_flags (name, project_id, enabled)
+SELECT $1, $2, $3 WHERE $2 = 0 OR EXISTS (SELECT 1 FROM projects WHERE id = $2)
+ON CONFLICT (name, project_id) DO UPDATE SET enabled = EXCLUDED.enabled, updated_at = now()
+RETURNING updated_at`,
+		f.Name, f.ProjectID, f.Enabled).Scan(&f.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return FeatureFlag{}, ErrProjectNotFound
+	}
+	return f, err
+}
+
+// DeleteFeatureFlag removes an override, so that the flag falls back to the
+// global override or its default.
+func (s *FlagStore) DeleteFeatureFlag(ctx context.Context, name string, projectID int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM feature_flags WHERE name = $1 AND project_id = $2`, name, projectID)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrFeatureFlagNotFound
+	}
+	return nil
+}
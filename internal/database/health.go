@@ -0,0 +1,107 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// CheckResult is the outcome of one check of the deep health check.
+type CheckResult struct {
+	Name string `json:"name"`
+	// Status is ok or failed.
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// NewCheckResult returns the result of the check name, failed with err.
+func NewCheckResult(name string, err error) CheckResult {
+	if err != nil {
+		return CheckResult{Name: name, Status: "failed", Error: err.Error()}
+	}
+	return CheckResult{Name: name, Status: "ok"}
+}
+
+// expectedColumns are the columns the service reads and writes, per table.
+var expectedColumns = map[string][]string{
+	"events":            {"id", "project_id", "user_id", "action", "metadata_page", "created_at", "dedupe_key", "fingerprint"},
+	"user_event_counts": {"project_id", "user_id", "period_start", "period_end", "event_count"},
+}
+
+// SchemaChecker verifies that the tables of the events have the expected
+// columns and can be read, for the deep health check.
+type SchemaChecker struct {
+	db     *sql.DB
+	prefix string
+}
+
+// NewSchemaChecker checks the database of the shared pool.
+func NewSchemaChecker() *SchemaChecker {
+	return &SchemaChecker{db: open().db}
+}
+
+// SchemaChecker checks the database of the pool, naming its checks after
+// name.
+func (p *Pool) SchemaChecker(name string) *SchemaChecker {
+	return &SchemaChecker{db: p.db, prefix: name + "_"}
+}
+
+// DeepCheck returns the result of the events and user_event_counts table
+// checks, and of a read of the latest event.
+func (c *SchemaChecker) DeepCheck(ctx context.Context) []CheckResult {
+	return []CheckResult{
+		NewCheckResult(c.prefix+"events_table", c.columns(ctx, "events")),
+		NewCheckResult(c.prefix+"user_event_counts_table", c.columns(ctx, "user_event_counts")),
+		NewCheckResult(c.prefix+"events_read", c.read(ctx)),
+	}
+}
+
+// columns reports the expected columns missing from table in the schema
+// of the search path.
+func (c *SchemaChecker) columns(ctx context.Context, table string) error {
+	rows, err := c.db.QueryContext(ctx, `
+SELECT column_name FROM information_schema.columns
+WHERE table_schema = current_schema() AND table_name = $1`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var found []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		found = append(found, name)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("table %s does not exist", table)
+	}
+	var missing []string
+	for _, name := range expectedColumns[table] {
+		if !slices.Contains(found, name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("table %s misses columns %s", table, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// read reads the latest event; an empty table passes.
+func (c *SchemaChecker) read(ctx context.Context) error {
+	var id int64
+	err := c.db.QueryRowContext(ctx, `SELECT id FROM events ORDER BY id DESC LIMIT 1`).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	return err
+}
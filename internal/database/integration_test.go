@@ -0,0 +1,1431 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/logging"
+	"github.com/arimatakao/simple-events-handler/internal/pseudonym"
+)
+
+// The tests share the database started by TestMain; each uses its own user
+// ids so that they do not see each other's events.
+
+func TestInsertAndGetEvents(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	user := int64(1001)
+
+	id, err := srv.InsertEvent(ctx, DefaultProjectID, user, "view", map[string]string{"page": "/docs"})
+	if err != nil || id == 0 {
+		t.Fatalf("insert event: id %d, %v", id, err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "click"}, {UserID: user, Action: "leave"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	events, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("get events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %+v", events)
+	}
+	var viewed bool
+	for _, e := range events {
+		if e.ID == id {
+			viewed = e.Action == "view" && e.MetadataPage != nil && *e.MetadataPage == "/docs"
+		}
+	}
+	if !viewed {
+		t.Fatalf("inserted event not returned as stored: %+v", events)
+	}
+
+	future := time.Now().Add(time.Hour)
+	events, err = srv.GetEvents(ctx, DefaultProjectID, &user, &future, nil, 0)
+	if err != nil || len(events) != 0 {
+		t.Fatalf("expected no events after now, got %+v, %v", events, err)
+	}
+
+	// A batch with the accept times of its events is copied with them
+	accepted := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	timed := int64(1031)
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: timed, Action: "click", CreatedAt: accepted}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+	events, err = srv.GetEvents(ctx, DefaultProjectID, &timed, nil, nil, 0)
+	if err != nil || len(events) != 1 || !events[0].CreatedAt.Equal(accepted) {
+		t.Fatalf("expected the event created at %v, got %+v, %v", accepted, events, err)
+	}
+}
+
+func TestInsertEventsDedupe(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	user := int64(1002)
+	created := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	batch := []NewEvent{
+		{UserID: user, Action: "view", CreatedAt: created, DedupeKey: "edge-1:1"},
+		{UserID: user, Action: "view", CreatedAt: created, DedupeKey: "edge-1:2"},
+	}
+
+	// The second batch repeats a key and brings a new one
+	if err := srv.InsertEvents(ctx, batch); err != nil {
+		t.Fatalf("insert batch: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, append(batch[1:], NewEvent{UserID: user, Action: "click", DedupeKey: "edge-1:3"})); err != nil {
+		t.Fatalf("insert batch again: %v", err)
+	}
+
+	events, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("get events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 distinct events, got %d", len(events))
+	}
+	var kept int
+	for _, e := range events {
+		if e.CreatedAt.Equal(created) {
+			kept++
+		}
+	}
+	if kept != 2 {
+		t.Fatalf("expected the forwarded timestamps to be kept, got %+v", events)
+	}
+}
+
+func TestAggregateEvents(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	user := int64(1003)
+	other, err := NewProjectStore().CreateProject(ctx, "aggregate")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "agg-a"}, {UserID: user, Action: "agg-a"}, {UserID: user, Action: "agg-b"}, {ProjectID: other.ID, UserID: user, Action: "agg-a"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	before := time.Now().UTC().Add(-time.Minute)
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+
+	// The users and actions of each project are counted apart
+	var count, otherCount int64
+	err = srv.(*service).db.QueryRowContext(ctx, `
+SELECT event_count FROM user_event_counts WHERE project_id = $1 AND user_id = $2 ORDER BY period_start DESC LIMIT 1`, DefaultProjectID, user).Scan(&count)
+	if err != nil || count != 3 {
+		t.Fatalf("expected 3 events aggregated for the user, got %d, %v", count, err)
+	}
+	err = srv.(*service).db.QueryRowContext(ctx, `
+SELECT event_count FROM action_event_counts WHERE project_id = $1 AND action = 'agg-a' ORDER BY period_start DESC LIMIT 1`, other.ID).Scan(&otherCount)
+	if err != nil || otherCount != 1 {
+		t.Fatalf("expected 1 event aggregated for the action of the other project, got %d, %v", otherCount, err)
+	}
+
+	sum, err := NewReportStore().Summary(ctx, before, time.Now().UTC().Add(time.Minute), 100)
+	if err != nil {
+		t.Fatalf("summary: %v", err)
+	}
+	actions := map[string]int64{}
+	for _, a := range sum.TopActions {
+		actions[a.Action] = a.Count
+	}
+	if actions["agg-a"] != 3 || actions["agg-b"] != 1 || sum.ActiveUsers < 2 {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+}
+
+func TestEventStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	user := int64(1004)
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "spam"}, {UserID: user, Action: "spam"}, {UserID: user, Action: "view"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	store := NewEventStore()
+	all := EventFilter{UserID: &user, From: time.Unix(0, 0), To: time.Now().Add(time.Minute)}
+	spam := all
+	spam.Action = "spam"
+
+	if n, err := store.Count(ctx, all); err != nil || n != 3 {
+		t.Fatalf("expected 3 events, got %d, %v", n, err)
+	}
+	if n, err := store.Delete(ctx, spam); err != nil || n != 2 {
+		t.Fatalf("expected 2 events deleted, got %d, %v", n, err)
+	}
+	if n, err := store.Count(ctx, all); err != nil || n != 1 {
+		t.Fatalf("expected 1 event left, got %d, %v", n, err)
+	}
+}
+
+func TestCountFromAggregates(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	db := srv.(*service).db
+	deleted, counted, late := int64(1032), int64(1033), int64(1034)
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: deleted, Action: "agg-count"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	var coveredTo time.Time
+	if err := db.QueryRowContext(ctx, `SELECT covered_to FROM aggregated_periods WHERE id = 1`).Scan(&coveredTo); err != nil {
+		t.Fatalf("read the aggregated periods: %v", err)
+	}
+
+	// The last complete period counts 5 events the events table no longer
+	// has, and an event is stored after it
+	period := coveredTo.Add(-time.Minute)
+	if _, err := db.ExecContext(ctx, `INSERT INTO user_event_counts (project_id, user_id, period_start, period_end, event_count) VALUES ($1, $2, $3, $4, 5)`, DefaultProjectID, counted, period, coveredTo); err != nil {
+		t.Fatalf("insert counts: %v", err)
+	}
+	if _, err := db.ExecContext(ctx, `INSERT INTO action_event_counts (project_id, action, period_start, period_end, event_count) VALUES ($1, 'agg-counted', $2, $3, 5)`, DefaultProjectID, period, coveredTo); err != nil {
+		t.Fatalf("insert counts: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: counted, Action: "agg-counted"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	store := NewEventStore()
+	to := time.Now().Add(time.Minute)
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		filter EventFilter
+		expect int64
+	}{
+		{name: "user", ctx: ctx, filter: EventFilter{UserID: &counted, From: period, To: to}, expect: 6},
+		{name: "action", ctx: ctx, filter: EventFilter{Action: "agg-counted", From: period, To: to}, expect: 6},
+		{name: "user and action", ctx: ctx, filter: EventFilter{UserID: &counted, Action: "agg-counted", From: period, To: to}, expect: 1},
+		{name: "exact", ctx: WithExactCount(ctx), filter: EventFilter{UserID: &counted, From: period, To: to}, expect: 1},
+		{name: "partial period", ctx: ctx, filter: EventFilter{UserID: &counted, From: period.Add(time.Second), To: to}, expect: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if n, err := store.Count(tt.ctx, tt.filter); err != nil || n != tt.expect {
+				t.Fatalf("expected %d events, got %d, %v", tt.expect, n, err)
+			}
+		})
+	}
+
+	// Complete periods are read from the aggregates alone, without waiting
+	// for a lock on events
+	lock, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Rollback()
+	if _, err := lock.ExecContext(ctx, `LOCK TABLE events IN ACCESS EXCLUSIVE MODE`); err != nil {
+		t.Fatalf("lock events: %v", err)
+	}
+	locked, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if n, err := store.Count(locked, EventFilter{UserID: &counted, From: period, To: coveredTo}); err != nil || n != 5 {
+		t.Fatalf("expected the 5 aggregated events, got %d, %v", n, err)
+	}
+	if err := lock.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An event stored with a created_at in a counted period is counted by
+	// the next run
+	lateFilter := EventFilter{UserID: &late, From: period, To: coveredTo}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: late, Action: "agg-late", CreatedAt: period}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if n, err := store.Count(ctx, lateFilter); err != nil || n != 1 {
+		t.Fatalf("expected the late event counted, got %d, %v", n, err)
+	}
+
+	// A deleted event is taken off the period counting it
+	all := EventFilter{UserID: &deleted, From: time.Unix(0, 0), To: to}
+	if n, err := store.Delete(ctx, all); err != nil || n != 1 {
+		t.Fatalf("expected 1 event deleted, got %d, %v", n, err)
+	}
+	var users, actions int64
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(sum(event_count), 0) FROM user_event_counts WHERE user_id = $1`, deleted).Scan(&users); err != nil || users != 0 {
+		t.Fatalf("expected the user counts down to 0, got %d, %v", users, err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT COALESCE(sum(event_count), 0) FROM action_event_counts WHERE action = 'agg-count'`).Scan(&actions); err != nil || actions != 0 {
+		t.Fatalf("expected the action counts down to 0, got %d, %v", actions, err)
+	}
+}
+
+func TestCompletePeriods(t *testing.T) {
+	covered := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	at := func(minutes, seconds int) time.Time {
+		return covered.Add(time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second)
+	}
+	tests := []struct {
+		name       string
+		from, to   time.Time
+		start, end time.Time
+		ok         bool
+	}{
+		{name: "whole periods", from: at(1, 0), to: at(3, 0), start: at(1, 0), end: at(3, 0), ok: true},
+		{name: "partial periods left out", from: at(0, 30), to: at(3, 30), start: at(1, 0), end: at(3, 0), ok: true},
+		{name: "clipped to the periods counted", from: at(-5, 0), to: at(20, 0), start: at(0, 0), end: at(10, 0), ok: true},
+		{name: "within a period", from: at(1, 10), to: at(1, 50)},
+		{name: "after the periods counted", from: at(11, 0), to: at(12, 0)},
+		{name: "before the periods counted", from: at(-3, 0), to: at(-1, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, ok := completePeriods(tt.from, tt.to, covered, at(10, 0), time.Minute)
+			if ok != tt.ok || (ok && (!start.Equal(tt.start) || !end.Equal(tt.end))) {
+				t.Fatalf("expected [%v, %v) %v, got [%v, %v) %v", tt.start, tt.end, tt.ok, start, end, ok)
+			}
+		})
+	}
+}
+
+func TestOutboxRelay(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	outbox := NewOutbox()
+	user := int64(1005)
+	relay := func(limit int) ([]Event, error) {
+		var got []Event
+		_, err := outbox.Relay(ctx, "integration", time.Now().Add(time.Minute), limit, func(ctx context.Context, events []Event) error {
+			got = append(got, events...)
+			return nil
+		})
+		return got, err
+	}
+
+	// The first relay creates the cursor at the newest event
+	if _, err := relay(10); err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "a"}, {UserID: user, Action: "b"}, {UserID: user, Action: "c"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	first, err := relay(2)
+	if err != nil || len(first) != 2 || first[0].ProjectID != DefaultProjectID {
+		t.Fatalf("expected a first batch of 2 of the default project, got %+v, %v", first, err)
+	}
+	rest, err := relay(10)
+	if err != nil || len(rest) != 1 || rest[0].ID <= first[1].ID {
+		t.Fatalf("expected the third event after the cursor, got %+v, %v", rest, err)
+	}
+	if again, err := relay(10); err != nil || len(again) != 0 {
+		t.Fatalf("expected nothing left, got %+v, %v", again, err)
+	}
+}
+
+func TestProjects(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	store := NewProjectStore()
+	user := int64(1006)
+
+	p, err := store.CreateProject(ctx, "integration")
+	if err != nil || p.ID == DefaultProjectID {
+		t.Fatalf("create project: %+v, %v", p, err)
+	}
+	if _, err := store.CreateProject(ctx, "integration"); !errors.Is(err, ErrProjectExists) {
+		t.Fatalf("expected ErrProjectExists, got %v", err)
+	}
+	key, err := store.CreateAPIKey(ctx, p.ID, "backend")
+	if err != nil || !strings.HasPrefix(key.Key, key.Prefix) {
+		t.Fatalf("create API key: %+v, %v", key, err)
+	}
+	if got, err := store.Authenticate(ctx, key.Key); err != nil || got.ID != key.ID || got.ProjectID != p.ID {
+		t.Fatalf("expected key %d of project %d, got %+v, %v", key.ID, p.ID, got, err)
+	}
+
+	if _, err := srv.InsertEvent(ctx, p.ID, user, "view", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "click"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+	for project, action := range map[int64]string{p.ID: "view", DefaultProjectID: "click"} {
+		events, err := srv.GetEvents(ctx, project, &user, nil, nil, 0)
+		if err != nil || len(events) != 1 || events[0].Action != action {
+			t.Fatalf("expected only the %s event in project %d, got %+v, %v", action, project, events, err)
+		}
+	}
+
+	if err := store.RevokeAPIKey(ctx, key.ID); err != nil {
+		t.Fatalf("revoke: %v", err)
+	}
+	if _, err := store.Authenticate(ctx, key.Key); !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Fatalf("expected the revoked key to be rejected, got %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	ctx := context.Background()
+	projects := NewProjectStore()
+	store := NewUsageStore()
+
+	key, err := projects.CreateAPIKey(ctx, DefaultProjectID, "usage")
+	if err != nil {
+		t.Fatalf("create API key: %v", err)
+	}
+	day := time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC)
+	deltas := []UsageDelta{
+		{APIKeyID: key.ID, Day: day.AddDate(0, 0, -1), Counts: Counts{Events: 5, Queries: 1}},
+		{APIKeyID: key.ID, Day: day, Counts: Counts{Events: 2}},
+		// Last month is not counted
+		{APIKeyID: key.ID, Day: day.AddDate(0, -1, 0), Counts: Counts{Events: 100}},
+	}
+	for range 2 {
+		if err := store.AddUsage(ctx, deltas); err != nil {
+			t.Fatalf("add usage: %v", err)
+		}
+	}
+
+	usage, err := store.Usage(ctx, []int64{key.ID, key.ID + 1000}, day)
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	expect := Usage{Day: Counts{Events: 4}, Month: Counts{Events: 14, Queries: 2}}
+	if len(usage) != 1 || usage[key.ID] != expect {
+		t.Fatalf("expected %+v, got %+v", expect, usage)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	ctx := context.Background()
+	p, err := NewProjectStore().CreateProject(ctx, "retention")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	at := func(day string) time.Time {
+		d, err := time.Parse(time.DateOnly, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Add(12 * time.Hour)
+	}
+	events := []NewEvent{
+		// Weeks start on Monday: cohort of 2025-02-24
+		{ProjectID: p.ID, UserID: 1011, Action: "signup", CreatedAt: at("2025-02-24")},
+		{ProjectID: p.ID, UserID: 1011, Action: "view", CreatedAt: at("2025-03-04")},
+		{ProjectID: p.ID, UserID: 1011, Action: "view", CreatedAt: at("2025-03-11")},
+		{ProjectID: p.ID, UserID: 1012, Action: "signup", CreatedAt: at("2025-03-02")},
+		// Cohort of 2025-03-03
+		{ProjectID: p.ID, UserID: 1013, Action: "signup", CreatedAt: at("2025-03-03")},
+		{ProjectID: p.ID, UserID: 1013, Action: "view", CreatedAt: at("2025-03-10")},
+		// First seen before the oldest cohort
+		{ProjectID: p.ID, UserID: 1014, Action: "signup", CreatedAt: at("2025-02-10")},
+		{ProjectID: p.ID, UserID: 1014, Action: "view", CreatedAt: at("2025-03-11")},
+	}
+	if err := New().InsertEvents(ctx, events); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	store := NewStatsStore()
+	store.now = func() time.Time { return at("2025-03-12") }
+	r, err := store.Retention(ctx, p.ID, CohortWeek, 3)
+	if err != nil {
+		t.Fatalf("retention: %v", err)
+	}
+	got, _ := json.Marshal(r.Cohorts)
+	expect := `[{"start":"2025-02-24T00:00:00Z","users":2,"returning":[2,1,1],"retention":[1,0.5,0.5]},` +
+		`{"start":"2025-03-03T00:00:00Z","users":1,"returning":[1,1],"retention":[1,1]}]`
+	if string(got) != expect {
+		t.Fatalf("expected cohorts %s, got %s", expect, got)
+	}
+}
+
+func TestTimeSeries(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "timeseries")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	for _, user := range []int64{1015, 1015, 1016} {
+		if _, err := srv.InsertEvent(ctx, p.ID, user, "purchase", nil); err != nil {
+			t.Fatalf("insert event: %v", err)
+		}
+	}
+	if _, err := srv.InsertEvent(ctx, p.ID, 1015, "view", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+
+	now := time.Now().UTC()
+	points, err := NewStatsStore().TimeSeries(ctx, p.ID, "purchase", now.Add(-2*time.Hour), now.Add(time.Second), time.Hour)
+	if err != nil {
+		t.Fatalf("time series: %v", err)
+	}
+	if len(points) != 3 || points[0].Events != 0 || !points[2].Start.Equal(now.Truncate(time.Hour)) {
+		t.Fatalf("expected 3 hourly points, the current hour last, got %+v", points)
+	}
+	// The events may fall in the previous hour when the test runs on the hour
+	if events, users := points[1].Events+points[2].Events, points[1].Users+points[2].Users; events != 3 || users < 2 {
+		t.Fatalf("expected 3 purchases of 2 users, got %+v", points)
+	}
+
+	// The hour of the last run is counted from the events
+	if _, err := srv.InsertEvent(ctx, p.ID, 1016, "purchase", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	points, err = NewStatsStore().TimeSeries(ctx, p.ID, "purchase", now.Add(-2*time.Hour), time.Now().Add(time.Second), time.Hour)
+	if err != nil {
+		t.Fatalf("time series: %v", err)
+	}
+	if events := points[1].Events + points[2].Events; events != 4 {
+		t.Fatalf("expected the purchase stored since the run, got %+v", points)
+	}
+}
+
+func TestFilterEvents(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "filter")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	for _, e := range []struct {
+		user   int64
+		action string
+		page   string
+	}{{1017, "view", "/checkout/cart"}, {1017, "view", "/docs"}, {1018, "click", "/checkout/pay"}, {1018, "view", ""}} {
+		var meta map[string]string
+		if e.page != "" {
+			meta = map[string]string{"page": e.page}
+		}
+		if _, err := srv.InsertEvent(ctx, p.ID, e.user, e.action, meta); err != nil {
+			t.Fatalf("insert event: %v", err)
+		}
+	}
+
+	expr, err := filter.Parse(`metadata.page =~ "^/checkout" && !(action == "click" || user_id > 1017)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pages []string
+	err = srv.FilterEvents(ctx, p.ID, expr, nil, nil, nil, 0, func(e Event) error {
+		pages = append(pages, *e.MetadataPage)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("filter events: %v", err)
+	}
+	if len(pages) != 1 || pages[0] != "/checkout/cart" {
+		t.Fatalf("expected the cart view only, got %v", pages)
+	}
+
+	// A missing page compares as an empty one
+	expr, err = filter.Parse(`metadata.page == ""`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	user := int64(1018)
+	err = srv.FilterEvents(ctx, p.ID, expr, &user, nil, nil, 0, func(e Event) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 1 {
+		t.Fatalf("expected the view without a page, got %d, %v", n, err)
+	}
+}
+
+func TestTagStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	store := NewTagStore()
+	p, err := NewProjectStore().CreateProject(ctx, "tags")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	bot, err := srv.InsertEvent(ctx, p.ID, 1019, "view", nil)
+	if err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	human, err := srv.InsertEvent(ctx, p.ID, 1019, "view", nil)
+	if err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+
+	if _, err := store.AddEventTags(ctx, p.ID, bot, []string{"test"}); err != nil {
+		t.Fatalf("add tags: %v", err)
+	}
+	tags, err := store.AddEventTags(ctx, p.ID, bot, []string{"test", "bot-traffic"})
+	if err != nil || !slices.Equal(tags, []string{"bot-traffic", "test"}) {
+		t.Fatalf("expected both tags, got %v, %v", tags, err)
+	}
+	// The events of other projects are not found
+	if _, err := store.AddEventTags(ctx, DefaultProjectID, bot, []string{"test"}); !errors.Is(err, ErrEventNotFound) {
+		t.Fatalf("expected ErrEventNotFound, got %v", err)
+	}
+
+	expr, err := filter.Parse(`tag != "bot-traffic"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int64
+	err = srv.FilterEvents(ctx, p.ID, expr, nil, nil, nil, 0, func(e Event) error {
+		ids = append(ids, e.ID)
+		return nil
+	})
+	if err != nil || len(ids) != 1 || ids[0] == bot {
+		t.Fatalf("expected the untagged event only, got %v, %v", ids, err)
+	}
+
+	if err := store.RemoveEventTag(ctx, p.ID, bot, "test"); err != nil {
+		t.Fatalf("remove tag: %v", err)
+	}
+	if err := store.RemoveEventTag(ctx, p.ID, bot, "test"); !errors.Is(err, ErrEventTagNotFound) {
+		t.Fatalf("expected ErrEventTagNotFound, got %v", err)
+	}
+	if tags, err := store.ListEventTags(ctx, p.ID, bot); err != nil || !slices.Equal(tags, []string{"bot-traffic"}) {
+		t.Fatalf("expected the remaining tag, got %v, %v", tags, err)
+	}
+
+	// Left out of the counts, exact and from the aggregates
+	ExcludeTags([]string{"bot-traffic"})
+	defer ExcludeTags(nil)
+	day := EventFilter{ProjectID: &p.ID, From: time.Now().Add(-24 * time.Hour), To: time.Now().Add(time.Hour)}
+	if n, err := NewEventStore().Count(WithExactCount(ctx), day); err != nil || n != 1 {
+		t.Fatalf("expected the tagged event not to be counted, got %d: %v", n, err)
+	}
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate events: %v", err)
+	}
+	if n, err := NewEventStore().Count(ctx, day); err != nil || n != 1 {
+		t.Fatalf("expected the tagged event not to be counted from the aggregates, got %d: %v", n, err)
+	}
+
+	// Tagging an event counts its period again, tags being parameters
+	ExcludeTags([]string{"bot-traffic", "it's"})
+	aggregated := func() (n int64) {
+		t.Helper()
+		if err := open().db.QueryRowContext(ctx, `SELECT COALESCE(sum(event_count), 0) FROM user_event_counts WHERE project_id = $1`, p.ID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if _, err := store.AddEventTags(ctx, p.ID, human, []string{"it's"}); err != nil {
+		t.Fatalf("add tags: %v", err)
+	}
+	if n, err := NewEventStore().Count(WithExactCount(ctx), day); err != nil || n != 0 || aggregated() != 0 {
+		t.Fatalf("expected the events tagged it's not to be counted, got %d: %v", n, err)
+	}
+	if err := store.RemoveEventTag(ctx, p.ID, human, "it's"); err != nil {
+		t.Fatalf("remove tag: %v", err)
+	}
+	if n := aggregated(); n != 1 {
+		t.Fatalf("expected the untagged event to be counted again, got %d", n)
+	}
+}
+
+func TestArchiveStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "archive")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := srv.InsertEvents(ctx, []NewEvent{
+		{ProjectID: p.ID, UserID: 1020, Action: "view", CreatedAt: old},
+		{ProjectID: p.ID, UserID: 1020, Action: "click", CreatedAt: old.Add(time.Hour)},
+		{ProjectID: p.ID, UserID: 1020, Action: "leave"},
+	}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	// Counted in the aggregates before they are archived
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+	if err := NewBackfillStore().RecountHours(ctx, old, old.Add(2*time.Hour)); err != nil {
+		t.Fatalf("recount hours: %v", err)
+	}
+
+	store := NewArchiveStore()
+	cutoff := old.AddDate(1, 0, 0)
+	for {
+		n, err := store.ArchiveEvents(ctx, cutoff, 1)
+		if err != nil {
+			t.Fatalf("archive events: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+	}
+
+	count := func(ctx context.Context) int {
+		var n int
+		user := int64(1020)
+		if err := srv.StreamEvents(ctx, p.ID, &user, nil, nil, 0, func(Event) error { n++; return nil }); err != nil {
+			t.Fatalf("stream events: %v", err)
+		}
+		return n
+	}
+	if n := count(ctx); n != 1 {
+		t.Fatalf("expected the recent event only, got %d", n)
+	}
+	if n := count(WithArchive(ctx)); n != 3 {
+		t.Fatalf("expected the archived events too, got %d", n)
+	}
+	points, err := NewStatsStore().TimeSeries(ctx, p.ID, "view", old, old.Add(time.Hour), time.Hour)
+	if err != nil || len(points) != 1 || points[0].Events != 0 {
+		t.Fatalf("expected the archived event taken off the aggregates, got %+v, %v", points, err)
+	}
+}
+
+func TestScheduledStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "scheduled")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if err := srv.InsertEvents(ctx, []NewEvent{
+		{ProjectID: p.ID, UserID: 1021, Action: "view"},
+		{ProjectID: p.ID, UserID: 1021, Action: "reminder", Metadata: map[string]string{"page": "/trial"}, DeliverAt: now.Add(time.Hour)},
+		{ProjectID: p.ID, UserID: 1021, Action: "expired", DeliverAt: now.Add(2 * time.Hour)},
+	}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	user := int64(1021)
+	if events, err := srv.GetEvents(ctx, p.ID, &user, nil, nil, 0); err != nil || len(events) != 1 {
+		t.Fatalf("expected the pending events to be left out, got %+v: %v", events, err)
+	}
+
+	store := NewScheduledStore()
+	if n, err := store.DeliverEvents(ctx, now.Add(90*time.Minute), 10); err != nil || n != 1 {
+		t.Fatalf("expected a delivered event, got %d: %v", n, err)
+	}
+	events, err := srv.GetEvents(ctx, p.ID, &user, nil, nil, 0)
+	if err != nil {
+		t.Fatalf("get events: %v", err)
+	}
+	if len(events) != 2 || events[0].Action != "reminder" || !events[0].CreatedAt.Equal(now.Add(time.Hour)) || events[0].MetadataPage == nil || *events[0].MetadataPage != "/trial" {
+		t.Fatalf("expected the reminder created at its delivery time, got %+v", events)
+	}
+	// Delivered once
+	if n, err := store.DeliverEvents(ctx, now.Add(90*time.Minute), 10); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to deliver, got %d: %v", n, err)
+	}
+}
+
+func TestEventTTL(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "ttl")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{
+		{ProjectID: p.ID, UserID: 1022, Action: "view"},
+		{ProjectID: p.ID, UserID: 1022, Action: "ping", TTL: time.Hour},
+		{ProjectID: p.ID, UserID: 1022, Action: "ping", CreatedAt: time.Now().Add(-2 * time.Hour), TTL: time.Hour},
+		{ProjectID: p.ID, UserID: 1022, Action: "blink", TTL: 3 * time.Second},
+	}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	user := int64(1022)
+	if events, err := srv.GetEvents(ctx, p.ID, &user, nil, nil, 0); err != nil || len(events) != 3 {
+		t.Fatalf("expected the expired event to be left out, got %+v: %v", events, err)
+	}
+
+	store := NewEventStore()
+	day := EventFilter{From: time.Now().Add(-24 * time.Hour), To: time.Now().Add(time.Hour), UserID: &user}
+	if n, err := store.Count(WithExactCount(ctx), day); err != nil || n != 3 {
+		t.Fatalf("expected the expired event not to be counted, got %d: %v", n, err)
+	}
+	aggregated := func() (n int64) {
+		t.Helper()
+		if err := open().db.QueryRowContext(ctx, `SELECT COALESCE(sum(event_count), 0) FROM user_event_counts WHERE project_id = $1`, p.ID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate events: %v", err)
+	}
+	if n := aggregated(); n != 3 {
+		t.Fatalf("expected the expired event not to be aggregated, got %d", n)
+	}
+
+	// Taken off the aggregates by the next run once expired, and not again
+	// by the janitor
+	time.Sleep(3 * time.Second)
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate events: %v", err)
+	}
+	if n := aggregated(); n != 2 {
+		t.Fatalf("expected the event expired since to be taken off the aggregates, got %d", n)
+	}
+	if n, err := store.Count(ctx, day); err != nil || n != 2 {
+		t.Fatalf("expected the expired events not to be counted from the aggregates, got %d: %v", n, err)
+	}
+	if n, err := store.DeleteExpired(ctx, time.Now(), 10); err != nil || n != 2 {
+		t.Fatalf("expected the expired events deleted, got %d: %v", n, err)
+	}
+	if n := aggregated(); n != 2 {
+		t.Fatalf("expected the deleted events to be taken off the aggregates once, got %d", n)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "schema-version")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	if _, err := srv.InsertEvent(ctx, p.ID, 1023, "view", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{ProjectID: p.ID, UserID: 1023, Action: "tap", SchemaVersion: 2}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	events, err := srv.GetEvents(ctx, p.ID, nil, nil, nil, 0)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("expected 2 events, got %+v: %v", events, err)
+	}
+	versions := map[string]int{}
+	for _, e := range events {
+		versions[e.Action] = e.SchemaVersion
+	}
+	if versions["view"] != 1 || versions["tap"] != 2 {
+		t.Fatalf("unexpected versions %v", versions)
+	}
+
+	expr, err := filter.Parse(`schema_version >= 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	err = srv.FilterEvents(ctx, p.ID, expr, nil, nil, nil, 0, func(e Event) error {
+		actions = append(actions, e.Action)
+		return nil
+	})
+	if err != nil || len(actions) != 1 || actions[0] != "tap" {
+		t.Fatalf("expected the version 2 event only, got %v: %v", actions, err)
+	}
+}
+
+func TestRenameStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	p, err := NewProjectStore().CreateProject(ctx, "rename")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	for _, user := range []int64{1024, 1024, 1025} {
+		if _, err := srv.InsertEvent(ctx, p.ID, user, "rename-old", nil); err != nil {
+			t.Fatalf("insert event: %v", err)
+		}
+	}
+	if err := srv.AggregateEvents(60); err != nil {
+		t.Fatalf("aggregate: %v", err)
+	}
+
+	store := NewRenameStore()
+	if n, err := store.CountAction(ctx, p.ID, "rename-old"); err != nil || n != 3 {
+		t.Fatalf("expected 3 events to rename, got %d: %v", n, err)
+	}
+	var batches []int64
+	for {
+		n, err := store.RenameActions(ctx, p.ID, "rename-old", "rename-new", 2)
+		if err != nil {
+			t.Fatalf("rename: %v", err)
+		}
+		if n == 0 {
+			break
+		}
+		batches = append(batches, n)
+	}
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 {
+		t.Fatalf("expected batches of 2 and 1, got %v", batches)
+	}
+
+	db := srv.(*service).db
+	counts := map[string]int64{}
+	rows, err := db.QueryContext(ctx, `SELECT action, sum(event_count) FROM action_event_counts WHERE action IN ('rename-old', 'rename-new') GROUP BY action`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var action string
+		var n int64
+		if err := rows.Scan(&action, &n); err != nil {
+			t.Fatal(err)
+		}
+		counts[action] = n
+	}
+	rows.Close()
+	if counts["rename-new"] != 3 || counts["rename-old"] != 0 {
+		t.Fatalf("expected the counts moved to the new name, got %v", counts)
+	}
+	var hours int64
+	if err := db.QueryRowContext(ctx, `SELECT coalesce(sum(event_count), 0) FROM action_user_hours WHERE project_id = $1 AND action = 'rename-new'`, p.ID).Scan(&hours); err != nil || hours != 3 {
+		t.Fatalf("expected 3 events counted in the hours of the new name, got %d: %v", hours, err)
+	}
+}
+
+func TestJobStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewJobStore()
+
+	queued, err := store.CreateJob(ctx, 0, "export", json.RawMessage(`{"format":"csv"}`))
+	if err != nil || queued.Status != JobQueued || queued.ProjectID != DefaultProjectID {
+		t.Fatalf("expected a queued job of the default project, got %+v: %v", queued, err)
+	}
+
+	job, ok, err := store.ClaimJob(ctx, time.Now().Add(-time.Minute))
+	if err != nil || !ok || job.ID != queued.ID || job.Status != JobRunning || job.Attempts != 1 {
+		t.Fatalf("expected the job to be claimed, got %+v %v: %v", job, ok, err)
+	}
+	// Running with a fresh heartbeat
+	if _, ok, err := store.ClaimJob(ctx, time.Now().Add(-time.Minute)); err != nil || ok {
+		t.Fatalf("expected no job to claim, got %v: %v", ok, err)
+	}
+	if err := store.ReleaseJob(ctx, job.ID); err != nil {
+		t.Fatalf("release job: %v", err)
+	}
+	if job, ok, err = store.ClaimJob(ctx, time.Now().Add(-time.Minute)); err != nil || !ok || job.Attempts != 1 {
+		t.Fatalf("expected the released job to be claimed, got %+v %v: %v", job, ok, err)
+	}
+	// A heartbeat older than staleBefore is claimed again
+	if job, ok, err = store.ClaimJob(ctx, time.Now().Add(time.Minute)); err != nil || !ok || job.Attempts != 2 {
+		t.Fatalf("expected the stale job to be claimed, got %+v %v: %v", job, ok, err)
+	}
+
+	if err := store.ReportJob(ctx, job.ID, 5, 10); err != nil {
+		t.Fatalf("report job: %v", err)
+	}
+	if err := store.FinishJob(ctx, job.ID, JobSucceeded, "", "events.csv"); err != nil {
+		t.Fatalf("finish job: %v", err)
+	}
+	got, err := store.GetJob(ctx, job.ID)
+	if err != nil || got.Status != JobSucceeded || got.Done != 5 || got.Artifact != "events.csv" || got.FinishedAt == nil || string(got.Params) != `{"format": "csv"}` {
+		t.Fatalf("unexpected finished job %+v: %v", got, err)
+	}
+
+	if deleted, err := store.DeleteFinishedJobs(ctx, time.Now().Add(time.Minute)); err != nil || len(deleted) != 1 || deleted[0].Artifact != "events.csv" {
+		t.Fatalf("expected the finished job to be deleted, got %+v: %v", deleted, err)
+	}
+	if _, err := store.GetJob(ctx, job.ID); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("expected ErrJobNotFound, got %v", err)
+	}
+}
+
+func TestFlagStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewFlagStore()
+	p, err := NewProjectStore().CreateProject(ctx, "flags")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+
+	if _, err := store.SetFeatureFlag(ctx, FeatureFlag{Name: "strict_validation", ProjectID: p.ID, Enabled: true}); err != nil {
+		t.Fatalf("set flag: %v", err)
+	}
+	f, err := store.SetFeatureFlag(ctx, FeatureFlag{Name: "strict_validation", ProjectID: p.ID, Enabled: false})
+	if err != nil || f.Enabled || f.UpdatedAt.IsZero() {
+		t.Fatalf("expected the override to be replaced, got %+v, %v", f, err)
+	}
+	if _, err := store.SetFeatureFlag(ctx, FeatureFlag{Name: "strict_validation", ProjectID: -1, Enabled: true}); !errors.Is(err, ErrProjectNotFound) {
+		t.Fatalf("expected ErrProjectNotFound, got %v", err)
+	}
+
+	flags, err := store.ListFeatureFlags(ctx)
+	if err != nil || !slices.ContainsFunc(flags, func(o FeatureFlag) bool { return o.ProjectID == p.ID && !o.Enabled }) {
+		t.Fatalf("expected the override to be listed, got %+v, %v", flags, err)
+	}
+	if err := store.DeleteFeatureFlag(ctx, "strict_validation", p.ID); err != nil {
+		t.Fatalf("delete flag: %v", err)
+	}
+	if err := store.DeleteFeatureFlag(ctx, "strict_validation", p.ID); !errors.Is(err, ErrFeatureFlagNotFound) {
+		t.Fatalf("expected ErrFeatureFlagNotFound, got %v", err)
+	}
+}
+
+func TestSavedQueryStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewSavedQueryStore()
+	p, err := NewProjectStore().CreateProject(ctx, "saved queries")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+
+	limit := 0
+	q, err := store.CreateSavedQuery(ctx, SavedQuery{ProjectID: p.ID, Name: "clicks", Filter: `action == "click"`, RangeSeconds: 3600, GroupBy: "day", Format: "json", Limit: &limit})
+	if err != nil || q.ID == 0 || q.Limit == nil || *q.Limit != 0 {
+		t.Fatalf("create saved query: %+v, %v", q, err)
+	}
+	if _, err := store.CreateSavedQuery(ctx, SavedQuery{ProjectID: p.ID, Name: "clicks", RangeSeconds: 60, Format: "csv"}); !errors.Is(err, ErrSavedQueryExists) {
+		t.Fatalf("expected ErrSavedQueryExists, got %v", err)
+	}
+	// Names are unique per project
+	if _, err := store.CreateSavedQuery(ctx, SavedQuery{ProjectID: DefaultProjectID, Name: "clicks", RangeSeconds: 60, Format: "csv"}); err != nil {
+		t.Fatalf("create saved query in another project: %v", err)
+	}
+
+	q.Filter, q.Format, q.Limit = "", "csv", nil
+	updated, err := store.UpdateSavedQuery(ctx, q)
+	if err != nil || updated.Format != "csv" || updated.Limit != nil || updated.Filter != "" {
+		t.Fatalf("update saved query: %+v, %v", updated, err)
+	}
+	queries, err := store.ListSavedQueries(ctx, p.ID)
+	if err != nil || len(queries) != 1 || queries[0].GroupBy != "day" {
+		t.Fatalf("expected the updated query, got %+v, %v", queries, err)
+	}
+
+	if err := store.DeleteSavedQuery(ctx, p.ID, "clicks"); err != nil {
+		t.Fatalf("delete saved query: %v", err)
+	}
+	if _, err := store.GetSavedQuery(ctx, p.ID, "clicks"); !errors.Is(err, ErrSavedQueryNotFound) {
+		t.Fatalf("expected ErrSavedQueryNotFound, got %v", err)
+	}
+}
+
+func TestAnomalyStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewAnomalyStore()
+	end := time.Now().UTC().Truncate(time.Minute)
+	a := Anomaly{Action: "anomaly_test", Kind: "drop", WindowStart: end.Add(-15 * time.Minute), WindowEnd: end, Current: 2, Expected: 40}
+
+	stored, opened, err := store.OpenAnomaly(ctx, a)
+	if err != nil {
+		t.Fatalf("open anomaly: %v", err)
+	}
+	if !opened || stored.ID == 0 || stored.DetectedAt.IsZero() {
+		t.Fatalf("expected the anomaly to be opened, got %+v", stored)
+	}
+	if _, opened, err := store.OpenAnomaly(ctx, a); err != nil || opened {
+		t.Fatalf("expected a single open anomaly per action, got %v, %v", opened, err)
+	}
+
+	// The alerts of another project are kept apart
+	p, err := NewProjectStore().CreateProject(ctx, "anomalies")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	other := a
+	other.ProjectID = p.ID
+	if stored, opened, err := store.OpenAnomaly(ctx, other); err != nil || !opened || stored.ProjectID != p.ID {
+		t.Fatalf("expected the anomaly of the other project to be opened, got %+v, %v, %v", stored, opened, err)
+	}
+
+	n, err := store.ResolveAnomalies(ctx, DefaultProjectID, []string{"anomaly_test"})
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 resolved anomaly, got %d, %v", n, err)
+	}
+	if _, opened, err := store.OpenAnomaly(ctx, other); err != nil || opened {
+		t.Fatalf("expected the anomaly of the other project to stay open, got %v, %v", opened, err)
+	}
+	if _, opened, err := store.OpenAnomaly(ctx, a); err != nil || !opened {
+		t.Fatalf("expected a new anomaly once resolved, got %v, %v", opened, err)
+	}
+	for _, projectID := range []int64{DefaultProjectID, p.ID} {
+		if _, err := store.ResolveAnomalies(ctx, projectID, []string{"anomaly_test"}); err != nil {
+			t.Fatalf("resolve anomalies: %v", err)
+		}
+	}
+}
+
+func TestAlertStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	store := NewAlertStore()
+	p, err := NewProjectStore().CreateProject(ctx, "alerts")
+	if err != nil {
+		t.Fatalf("create project: %v", err)
+	}
+	for _, user := range []int64{1015, 1015, 1015, 1016} {
+		if _, err := srv.InsertEvent(ctx, p.ID, user, "login_failed", nil); err != nil {
+			t.Fatalf("insert event: %v", err)
+		}
+	}
+
+	if _, err := store.CreateAlertRule(ctx, AlertRule{Name: "x", ProjectID: -1, Action: "login_failed", WindowSeconds: 60}); !errors.Is(err, ErrProjectNotFound) {
+		t.Fatalf("expected ErrProjectNotFound, got %v", err)
+	}
+	rule, err := store.CreateAlertRule(ctx, AlertRule{Name: "brute force", ProjectID: p.ID, Action: "login_failed", PerUser: true, Threshold: 2, WindowSeconds: 300, Active: true})
+	if err != nil {
+		t.Fatalf("create rule: %v", err)
+	}
+
+	matches, err := store.EvaluateAlertRule(ctx, rule)
+	if err != nil {
+		t.Fatalf("evaluate rule: %v", err)
+	}
+	if len(matches) != 1 || matches[0] != (RuleMatch{UserID: 1015, Count: 3}) {
+		t.Fatalf("expected 3 events of user 1015, got %+v", matches)
+	}
+
+	f, opened, err := store.OpenAlertFiring(ctx, AlertFiring{RuleID: rule.ID, UserID: 1015, Count: 3})
+	if err != nil || !opened || f.ID == 0 {
+		t.Fatalf("expected the firing to be opened, got %+v, %v", f, err)
+	}
+	if _, opened, err := store.OpenAlertFiring(ctx, AlertFiring{RuleID: rule.ID, UserID: 1015, Count: 4}); err != nil || opened {
+		t.Fatalf("expected a single open firing per user, got %v, %v", opened, err)
+	}
+	if n, err := store.ResolveAlertFirings(ctx, rule.ID, []int64{1015}); err != nil || n != 0 {
+		t.Fatalf("expected the matching firing to stay open, got %d, %v", n, err)
+	}
+	if n, err := store.ResolveAlertFirings(ctx, rule.ID, nil); err != nil || n != 1 {
+		t.Fatalf("expected 1 resolved firing, got %d, %v", n, err)
+	}
+
+	firings, err := store.ListAlertFirings(ctx, rule.ID, 10)
+	if err != nil || len(firings) != 1 || firings[0].ResolvedAt == nil {
+		t.Fatalf("expected a resolved firing, got %+v, %v", firings, err)
+	}
+	if err := store.DeleteAlertRule(ctx, rule.ID); err != nil {
+		t.Fatalf("delete rule: %v", err)
+	}
+	if _, err := store.GetAlertRule(ctx, rule.ID); !errors.Is(err, ErrAlertRuleNotFound) {
+		t.Fatalf("expected ErrAlertRuleNotFound, got %v", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	ctx := context.Background()
+	store := NewAuditStore()
+
+	for _, e := range []AuditEntry{
+		{Actor: "alice", RequestID: "a", Action: "POST /projects", Status: 201, Payload: map[string]string{"name": "shop"}},
+		{Actor: "bob", RequestID: "b", Action: "DELETE /events", Status: 200},
+		{Actor: "alice", RequestID: "c", Action: "DELETE /events", Status: 200, Payload: map[string]string{"user_id": "1"}},
+	} {
+		if err := store.Record(ctx, e); err != nil {
+			t.Fatalf("record: %v", err)
+		}
+	}
+
+	entries, err := store.ListAudit(ctx, AuditFilter{Actor: "alice", Limit: 10})
+	if err != nil || len(entries) != 2 || entries[0].RequestID != "c" || entries[0].Payload["user_id"] != "1" || entries[1].Payload["name"] != "shop" {
+		t.Fatalf("unexpected entries of alice %+v, %v", entries, err)
+	}
+	older, err := store.ListAudit(ctx, AuditFilter{Action: "DELETE /events", Before: entries[0].ID, Limit: 10})
+	if err != nil || len(older) != 1 || older[0].Actor != "bob" || len(older[0].Payload) != 0 {
+		t.Fatalf("unexpected older entries %+v, %v", older, err)
+	}
+}
+
+func TestPseudonymizer(t *testing.T) {
+	ctx := context.Background()
+	user := int64(1007)
+	old := pseudonym.New([]string{"old-secret-0123456789"})
+	rotated := pseudonym.New([]string{"new-secret-0123456789", "old-secret-0123456789"})
+
+	if _, err := NewPseudonymizer(New(), old).InsertEvent(ctx, DefaultProjectID, user, "view", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	srv := NewPseudonymizer(New(), rotated)
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "click"}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	// Nothing is stored under the original id
+	if events, err := New().GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0); err != nil || len(events) != 0 {
+		t.Fatalf("expected no events under the original id, got %+v, %v", events, err)
+	}
+	events, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+	if err != nil || len(events) != 2 || events[0].Action != "click" || events[0].UserID != rotated.Hash(user) || events[1].UserID != old.Hash(user) {
+		t.Fatalf("expected the events of both secrets, newest first, got %+v, %v", events, err)
+	}
+
+	store := NewPseudonymEventStore(NewEventStore(), rotated)
+	all := EventFilter{UserID: &user, From: time.Unix(0, 0), To: time.Now().Add(time.Minute)}
+	if n, err := store.Count(ctx, all); err != nil || n != 2 {
+		t.Fatalf("expected 2 events, got %d, %v", n, err)
+	}
+	if n, err := store.Delete(ctx, all); err != nil || n != 2 {
+		t.Fatalf("expected 2 events deleted, got %d, %v", n, err)
+	}
+}
+
+func TestMetadataEncryptor(t *testing.T) {
+	ctx := context.Background()
+	user := int64(1008)
+	c, err := fieldcrypt.New([]byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("cipher: %v", err)
+	}
+	srv := NewMetadataEncryptor(New(), c)
+
+	if _, err := srv.InsertEvent(ctx, DefaultProjectID, user, "view", map[string]string{"page": "/account/settings"}); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if err := srv.InsertEvents(ctx, []NewEvent{{UserID: user, Action: "click", Metadata: map[string]string{"page": "/checkout"}}}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+
+	stored, err := New().GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+	if err != nil || len(stored) != 2 {
+		t.Fatalf("get stored events: %+v, %v", stored, err)
+	}
+	for _, e := range stored {
+		if e.MetadataPage == nil || strings.Contains(*e.MetadataPage, "account") || strings.Contains(*e.MetadataPage, "checkout") {
+			t.Fatalf("expected the page to be stored encrypted, got %v", e.MetadataPage)
+		}
+	}
+
+	events, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+	if err != nil || len(events) != 2 || *events[0].MetadataPage != "/checkout" || *events[1].MetadataPage != "/account/settings" {
+		t.Fatalf("expected decrypted pages, got %+v, %v", events, err)
+	}
+
+	// Read past GetEvents, like exports and replays
+	var pages []string
+	err = NewEventStream().WithCipher(c).Filter(ctx, EventFilter{UserID: &user, From: time.Unix(0, 0), To: time.Now().Add(time.Minute)}, func(e Event) error {
+		pages = append(pages, *e.MetadataPage)
+		return nil
+	})
+	if err != nil || len(pages) != 2 || pages[0] != "/account/settings" || pages[1] != "/checkout" {
+		t.Fatalf("expected the stream to decrypt the pages, got %v, %v", pages, err)
+	}
+}
+
+func TestInsertBatcher(t *testing.T) {
+	ctx := context.Background()
+	b := NewInsertBatcher(50*time.Millisecond, 100)
+	user := int64(1009)
+
+	actions := []string{"view", "click", "scroll", "leave"}
+	ids := make([]int64, len(actions))
+	errs := make(chan error, len(actions))
+	for i, action := range actions {
+		go func() {
+			var err error
+			ids[i], err = b.InsertEvent(ctx, DefaultProjectID, user, action, nil)
+			errs <- err
+		}()
+	}
+	for range actions {
+		if err := <-errs; err != nil {
+			t.Fatalf("insert event: %v", err)
+		}
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	events, err := b.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+	if err != nil || len(events) != len(actions) {
+		t.Fatalf("expected %d events, got %+v, %v", len(actions), events, err)
+	}
+	stored := make(map[int64]string)
+	for _, e := range events {
+		stored[e.ID] = e.Action
+	}
+	for i, action := range actions {
+		if stored[ids[i]] != action {
+			t.Fatalf("expected id %d to be the %s event, got %q", ids[i], action, stored[ids[i]])
+		}
+	}
+}
+
+func TestSlowQueryLogger(t *testing.T) {
+	var logs bytes.Buffer
+	s := NewSlowQueryLogger(New(), slog.New(slog.NewJSONHandler(&logs, nil)), 0)
+	ctx := logging.WithRequestID(context.Background(), "req-1")
+	user := int64(1010)
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	to := from.Add(48 * time.Hour)
+
+	if _, err := s.InsertEvent(ctx, DefaultProjectID, user, "view", nil); err != nil {
+		t.Fatalf("insert event: %v", err)
+	}
+	if _, err := s.GetEvents(ctx, DefaultProjectID, &user, &from, &to, 10); err != nil {
+		t.Fatalf("get events: %v", err)
+	}
+
+	var entries []map[string]any
+	for line := range strings.Lines(logs.String()) {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 2 || entries[0]["op"] != "insert_event" || entries[1]["op"] != "get_events" {
+		t.Fatalf("expected both operations logged with a zero threshold, got %v", entries)
+	}
+	query := entries[1]
+	if query["level"] != "WARN" || query["request_id"] != "req-1" || query["user_filter"] != true ||
+		query["start"] != "2024-01-01T00:00:00Z" || query["range_hours"] != 48.0 || query["limit"] != 10.0 {
+		t.Fatalf("unexpected slow query entry %v", query)
+	}
+	if strings.Contains(logs.String(), "1010") {
+		t.Fatalf("expected the user id left out of the logs, got %s", logs.String())
+	}
+}
+
+func TestSchemaChecker(t *testing.T) {
+	for _, check := range NewSchemaChecker().DeepCheck(context.Background()) {
+		if check.Status != "ok" {
+			t.Fatalf("expected check %s to pass, got %+v", check.Name, check)
+		}
+	}
+}
+
+// The benchmarks use user ids from 2001, apart from those of the tests,
+// and only run with -bench, after the tests.
+
+func BenchmarkGetEvents(b *testing.B) {
+	ctx := context.Background()
+	srv := New()
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, size := range []int{10, 100, 1000, 10000} {
+		user := int64(2001 + i)
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			events := make([]NewEvent, size)
+			for j := range events {
+				events[j] = NewEvent{UserID: user, Action: "view", Metadata: map[string]string{"page": "/pricing"}, CreatedAt: created.Add(time.Duration(j) * time.Second)}
+			}
+			existing, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			// b.Run may call the function several times
+			if len(existing) == 0 {
+				if err := srv.InsertEvents(ctx, events); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportAllocs()
+			for b.Loop() {
+				got, err := srv.GetEvents(ctx, DefaultProjectID, &user, nil, nil, 0)
+				if err != nil || len(got) != size {
+					b.Fatalf("expected %d events, got %d, %v", size, len(got), err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAggregateEvents(b *testing.B) {
+	ctx := context.Background()
+	srv := New()
+	now := time.Now().UTC()
+
+	// Events of the last hour, over 100 users and 10 actions; the
+	// aggregation only covers recent periods
+	events := make([]NewEvent, 10000)
+	for i := range events {
+		events[i] = NewEvent{
+			UserID:    int64(3000 + i%100),
+			Action:    "action-" + strconv.Itoa(i%10),
+			CreatedAt: now.Add(-time.Duration(i%3600) * time.Second),
+		}
+	}
+	if err := srv.InsertEvents(ctx, events); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := srv.AggregateEvents(3600); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSnapshotStore(t *testing.T) {
+	ctx := context.Background()
+	srv := New()
+	user := int64(1040)
+	from := time.Date(2001, 3, 4, 0, 0, 0, 0, time.UTC)
+	to := from.Add(24 * time.Hour)
+	if err := srv.InsertEvents(ctx, []NewEvent{
+		{UserID: user, Action: "view", CreatedAt: from.Add(time.Hour), DedupeKey: "snapshot-1"},
+		{UserID: user, Action: "click", CreatedAt: from.Add(2 * time.Hour), Metadata: map[string]string{"page": "/home"}},
+	}); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+	window := EventFilter{UserID: &user, From: from, To: to}
+	var tagged int64
+	err := NewEventStream().Filter(ctx, window, func(e Event) error {
+		tagged = e.ID
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTagStore().AddEventTags(ctx, DefaultProjectID, tagged, []string{"snapshot"}); err != nil {
+		t.Fatalf("add tags: %v", err)
+	}
+
+	store := NewSnapshotStore()
+	var records []SnapshotRecord
+	if err := store.Snapshot(ctx, from, to, func(r SnapshotRecord) error {
+		records = append(records, r)
+		return nil
+	}); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	last := records[len(records)-1]
+	if records[0].Kind != SnapshotHeaderKind || last.Kind != SnapshotTrailerKind || last.Trailer.Events != 2 || last.Trailer.Tags != 1 || last.Trailer.Projects == 0 {
+		t.Fatalf("unexpected snapshot %+v, trailer %+v", records, last.Trailer)
+	}
+	replay := func(records []SnapshotRecord) func() (SnapshotRecord, error) {
+		return func() (SnapshotRecord, error) {
+			if len(records) == 0 {
+				return SnapshotRecord{}, io.EOF
+			}
+			r := records[0]
+			records = records[1:]
+			return r, nil
+		}
+	}
+
+	// Nothing is restored from a truncated snapshot
+	if _, err := NewEventStore().Delete(ctx, window); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Restore(ctx, replay(records[:len(records)-1])); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("expected ErrInvalidSnapshot, got %v", err)
+	}
+	if n, err := NewEventStore().Count(ctx, window); err != nil || n != 0 {
+		t.Fatalf("expected no event restored, got %d: %v", n, err)
+	}
+
+	res, err := store.Restore(ctx, replay(records))
+	if err != nil || res.Events != 2 || res.Tags != 1 || res.Skipped != 0 {
+		t.Fatalf("expected 2 events and a tag restored, got %+v: %v", res, err)
+	}
+	if tags, err := NewTagStore().ListEventTags(ctx, DefaultProjectID, tagged); err != nil || !slices.Equal(tags, []string{"snapshot"}) {
+		t.Fatalf("expected the tag restored with its event, got %v: %v", tags, err)
+	}
+	// Restoring again keeps the events stored
+	if res, err := store.Restore(ctx, replay(records)); err != nil || res.Skipped != 2 {
+		t.Fatalf("expected the 2 events skipped, got %+v: %v", res, err)
+	}
+	if _, err := srv.InsertEvent(ctx, DefaultProjectID, user, "after", nil); err != nil {
+		t.Fatalf("expected the ids to follow the restored ones: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrJobNotFound is returned for unknown job ids.
+var ErrJobNotFound = errors.New("job not found")
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is a background job of a project, run by a worker of any instance.
+type Job struct {
+	ID        int64           `json:"id"`
+	ProjectID int64           `json:"project_id"`
+	Kind      string          `json:"kind"`
+	Params    json.RawMessage `json:"params"`
+	Status    JobStatus       `json:"status"`
+	// Attempts counts the runs started, more than one when the instance
+	// running the job stopped
+	Attempts int `json:"attempts"`
+	// Done counts the work done out of Total, 0 when not known yet, in the
+	// unit of the kind
+	Done  int64  `json:"done"`
+	Total int64  `json:"total"`
+	Error string `json:"error,omitempty"`
+	// Artifact is the name of the file written by the job, downloadable
+	// once it succeeded
+	Artifact   string     `json:"artifact,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobStore keeps the background jobs in the jobs table, where the workers
+// of every instance claim them.
+type JobStore struct {
+	db *sql.DB
+}
+
+// NewJobStore uses the shared connection pool.
+func NewJobStore() *JobStore {
+	return &JobStore{db: open().db}
+}
+
+const jobColumns = `id, project_id, kind, params, status, attempts, done, total, error, artifact, created_at, started_at, finished_at`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var j Job
+	var params []byte
+	var jobErr, artifact sql.NullString
+	err := row.Scan(&j.ID, &j.ProjectID, &j.Kind, &params, &j.Status, &j.Attempts, &j.Done, &j.Total, &jobErr, &artifact, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, ErrJobNotFound
+	}
+	j.Params, j.Error, j.Artifact = params, jobErr.String, artifact.String
+	return j, err
+}
+
+// CreateJob queues a job of kind with its params.
+func (s *JobStore) CreateJob(ctx context.Context, projectID int64, kind string, params json.RawMessage) (Job, error) {
+	return scanJob(s.db.QueryRowContext(ctx, `
+INSERT INTO jobs (project_id, kind, params)
+VALUES ($1, $2, $3)
+RETURNING `+jobColumns, projectOrDefault(projectID), kind, []byte(params)))
+}
+
+func (s *JobStore) GetJob(ctx context.Context, id int64) (Job, error) {
+	return scanJob(s.db.QueryRowContext(ctx, `SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id))
+}
+
+// ClaimJob marks the oldest queued job running and returns it, or a running
+// job whose heartbeat stopped before staleBefore. It reports false when no
+// job is waiting. Workers claiming concurrently get distinct jobs.
+func (s *JobStore) ClaimJob(ctx context.Context, staleBefore time.Time) (Job, bool, error) {
+	j, err := scanJob(s.db.QueryRowContext(ctx, `
+UPDATE jobs
+SET status = 'running', attempts = attempts + 1, done = 0, total = 0, started_at = now(), heartbeat_at = now()
+WHERE id = (
+	SELECT id FROM jobs
+	WHERE status = 'queued' OR (status = 'running' AND heartbeat_at < $1)
+	ORDER BY id
+	LIMIT 1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING `+jobColumns, staleBefore))
+	if errors.Is(err, ErrJobNotFound) {
+		return Job{}, false, nil
+	}
+	return j, err == nil, err
+}
+
+// ReportJob records the progress of a running job and its heartbeat.
+func (s *JobStore) ReportJob(ctx context.Context, id, done, total int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET done = $2, total = $3, heartbeat_at = now() WHERE id = $1 AND status = 'running'`, id, done, total)
+	return err
+}
+
+// FinishJob records the outcome of a running job: succeeded with its
+// artifact, when it wrote one, or failed with jobErr.
+func (s *JobStore) FinishJob(ctx context.Context, id int64, status JobStatus, jobErr, artifact string) error {
+	_, err := s.db.ExecContext(ctx, `
+UPDATE jobs
+SET status = $2, error = NULLIF($3, ''), artifact = NULLIF($4, ''), finished_at = now()
+WHERE id = $1 AND status = 'running'`, id, status, jobErr, artifact)
+	return err
+}
+
+// ReleaseJob queues a running job again, for a worker stopping before it
+// finished; the run is not counted as an attempt.
+func (s *JobStore) ReleaseJob(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE jobs SET status = 'queued', attempts = attempts - 1, heartbeat_at = NULL WHERE id = $1 AND status = 'running'`, id)
+	return err
+}
+
+// DeleteFinishedJobs removes the jobs finished before before and returns
+// them, so that their artifacts can be removed too.
+func (s *JobStore) DeleteFinishedJobs(ctx context.Context, before time.Time) ([]Job, error) {
+	rows, err := s.db.QueryContext(ctx, `DELETE FROM jobs WHERE finished_at < $1 RETURNING `+jobColumns, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,98 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+)
+
+// Outbox relays the events table to sinks. Each event is committed in its
+// own insert transaction, so the table is the outbox; every sink keeps its
+// position in sink_cursors.
+type Outbox struct {
+	db     *sql.DB
+	cipher *fieldcrypt.Cipher
+}
+
+// NewOutbox uses the shared connection pool.
+func NewOutbox() *Outbox {
+	return &Outbox{db: open().db}
+}
+
+// WithCipher returns an outbox relaying the events with their metadata
+// decrypted by c. A nil c relays the metadata as stored.
+func (o *Outbox) WithCipher(c *fieldcrypt.Cipher) *Outbox {
+	return &Outbox{db: o.db, cipher: c}
+}
+
+// Relay passes the events stored after the cursor of sink and created
+// before settledBefore to publish, at most limit in id order, and moves the
+// cursor past them once publish returns nil. It returns the number of
+// events published. A new cursor starts at the newest event, so existing
+// history is not published.
+//
+// The cursor row stays locked while publish runs: only one instance relays
+// a sink at a time and the others return 0. Events are published at least
+// once, since publish may succeed before the commit fails.
+func (o *Outbox) Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []Event) error) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO sink_cursors (name, last_event_id)
+SELECT $1, COALESCE(max(id), 0) FROM events
+ON CONFLICT (name) DO NOTHING`, sink); err != nil {
+		return 0, err
+	}
+
+	var cursor int64
+	err = tx.QueryRowContext(ctx, `SELECT last_event_id FROM sink_cursors WHERE name = $1 FOR UPDATE SKIP LOCKED`, sink).Scan(&cursor)
+	if errors.Is(err, sql.ErrNoRows) {
+		// Another instance is relaying
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+SELECT id, project_id, user_id, action, metadata_page, created_at, schema_version, expires_at
+FROM events
+WHERE id > $1 AND created_at < $2
+ORDER BY id
+LIMIT $3`, cursor, settledBefore, limit)
+	if err != nil {
+		return 0, err
+	}
+	var events []Event
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Action, &e.MetadataPage, &e.CreatedAt, &e.SchemaVersion, &e.ExpiresAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		e.MetadataPage = decryptPage(o.cipher, e.MetadataPage)
+		events = append(events, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err := publish(ctx, events); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE sink_cursors SET last_event_id = $2 WHERE name = $1`, sink, events[len(events)-1].ID); err != nil {
+		return 0, err
+	}
+	return len(events), tx.Commit()
+}
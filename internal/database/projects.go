@@ -0,0 +1,161 @@
+package database
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrProjectNotFound is returned for unknown project ids.
+	ErrProjectNotFound = errors.New("project not found")
+	// ErrProjectExists is returned when a project name is already taken.
+	ErrProjectExists = errors.New("a project with this name already exists")
+	// ErrAPIKeyNotFound is returned for unknown or revoked API keys.
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// Project owns events; every read and write made with one of its API keys
+// is limited to its events.
+type Project struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey authenticates the requests of a project on the public API.
+type APIKey struct {
+	ID        int64  `json:"id"`
+	ProjectID int64  `json:"project_id"`
+	Name      string `json:"name"`
+	// Prefix is the start of the key, enough to recognize it.
+	Prefix string `json:"prefix"`
+	// Key is only returned on creation; the store keeps its hash.
+	Key       string     `json:"key,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// apiKeyPrefix starts every key, so that leaked keys are easy to grep for.
+const apiKeyPrefix = "seh_"
+
+// ProjectStore keeps projects and their API keys in the projects and
+// api_keys tables.
+type ProjectStore struct {
+	db *sql.DB
+}
+
+// NewProjectStore uses the shared connection pool.
+func NewProjectStore() *ProjectStore {
+	return &ProjectStore{db: open().db}
+}
+
+func (s *ProjectStore) CreateProject(ctx context.Context, name string) (Project, error) {
+	var p Project
+	err := s.db.QueryRowContext(ctx, `
+INSERT INTO projects (name) VALUES ($1)
+ON CONFLICT (name) DO NOTHING
+RETURNING id, name, created_at`, name).Scan(&p.ID, &p.Name, &p.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Project{}, ErrProjectExists
+	}
+	return p, err
+}
+
+func (s *ProjectStore) ListProjects(ctx context.Context) ([]Project, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, created_at FROM projects ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	projects := make([]Project, 0)
+	for rows.Next() {
+		var p Project
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		projects = append(projects, p)
+	}
+	return projects, rows.Err()
+}
+
+// CreateAPIKey generates a key for the project. The returned APIKey is the
+// only one carrying the key itself.
+func (s *ProjectStore) CreateAPIKey(ctx context.Context, projectID int64, name string) (APIKey, error) {
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(secret)
+
+	k := APIKey{Key: key}
+	err := s.db.QueryRowContext(ctx, `
+INSERT INTO api_keys (project_id, name, prefix, key_hash)
+SELECT id, $2, $3, $4 FROM projects WHERE id = $1
+RETURNING id, project_id, name, prefix, created_at`,
+		projectID, name, key[:len(apiKeyPrefix)+8], hashAPIKey(key)).Scan(&k.ID, &k.ProjectID, &k.Name, &k.Prefix, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrProjectNotFound
+	}
+	return k, err
+}
+
+// ListAPIKeys returns the keys of a project, revoked ones included.
+func (s *ProjectStore) ListAPIKeys(ctx context.Context, projectID int64) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, project_id, name, prefix, created_at, revoked_at
+FROM api_keys
+WHERE project_id = $1
+ORDER BY id`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]APIKey, 0)
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.ProjectID, &k.Name, &k.Prefix, &k.CreatedAt, &k.RevokedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RevokeAPIKey stops accepting a key. Revoked keys stay listed.
+func (s *ProjectStore) RevokeAPIKey(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// Authenticate returns an active API key, without the key itself.
+func (s *ProjectStore) Authenticate(ctx context.Context, key string) (APIKey, error) {
+	var k APIKey
+	err := s.db.QueryRowContext(ctx, `
+SELECT id, project_id, name, prefix, created_at
+FROM api_keys
+WHERE key_hash = $1 AND revoked_at IS NULL`, hashAPIKey(key)).Scan(&k.ID, &k.ProjectID, &k.Name, &k.Prefix, &k.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+// hashAPIKey is what the api_keys table stores instead of the key. Keys are
+// random, so an unsalted fast hash is enough.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,194 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/pseudonym"
+)
+
+// pseudonymService stores the pseudonyms of user ids instead of the ids and
+// translates user lookups the same way. Events are returned as stored, with
+// pseudonyms.
+type pseudonymService struct {
+	Service
+	h *pseudonym.Hasher
+}
+
+// NewPseudonymizer wraps svc so that events are stored with the pseudonym
+// of their user id. GetEvents looks a user up under every secret of h.
+func NewPseudonymizer(svc Service, h *pseudonym.Hasher) Service {
+	return &pseudonymService{Service: svc, h: h}
+}
+
+func (s *pseudonymService) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return s.Service.InsertEvent(ctx, projectID, s.h.Hash(userID), action, metadata)
+}
+
+func (s *pseudonymService) InsertEvents(ctx context.Context, events []NewEvent) error {
+	hashed := make([]NewEvent, len(events))
+	for i, e := range events {
+		e.UserID = s.h.Hash(e.UserID)
+		hashed[i] = e
+	}
+	return s.Service.InsertEvents(ctx, hashed)
+}
+
+func (s *pseudonymService) InsertEventOnce(ctx context.Context, e NewEvent, window time.Duration) (Event, bool, error) {
+	e.UserID = s.h.Hash(e.UserID)
+	return s.Service.InsertEventOnce(ctx, e, window)
+}
+
+// GetEvents queries each pseudonym of the user and merges the results,
+// newest first like the wrapped service.
+func (s *pseudonymService) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]Event, error) {
+	if userID == nil {
+		return s.Service.GetEvents(ctx, projectID, nil, start, end, limit)
+	}
+	candidates := s.h.Candidates(*userID)
+	if len(candidates) == 1 {
+		return s.Service.GetEvents(ctx, projectID, &candidates[0], start, end, limit)
+	}
+
+	events := make([]Event, 0)
+	for _, id := range candidates {
+		found, err := s.Service.GetEvents(ctx, projectID, &id, start, end, limit)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, found...)
+	}
+	slices.SortStableFunc(events, func(a, b Event) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// StreamEvents streams the events of each pseudonym of the user in turn:
+// unlike GetEvents, the events are newest first per pseudonym only while
+// secrets are rotated. Limited results are merged by GetEvents instead, so
+// that the newest events are kept.
+func (s *pseudonymService) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	if userID == nil {
+		return s.Service.StreamEvents(ctx, projectID, nil, start, end, limit, fn)
+	}
+	candidates := s.h.Candidates(*userID)
+	if len(candidates) > 1 && limit > 0 {
+		events, err := s.GetEvents(ctx, projectID, userID, start, end, limit)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, id := range candidates {
+		if err := s.Service.StreamEvents(ctx, projectID, &id, start, end, limit, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FilterEvents filters the events of each pseudonym of the user like
+// StreamEvents, merging limited results. Filters on user_id are rejected:
+// the stored ids are pseudonyms, which an expression cannot be translated
+// to; the user is selected by userID instead.
+func (s *pseudonymService) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	if expr.Uses("user_id") {
+		return fmt.Errorf("%w: user ids are pseudonymized, select the user with the user_id parameter", ErrFilterUnsupported)
+	}
+	if userID == nil {
+		return s.Service.FilterEvents(ctx, projectID, expr, nil, start, end, limit, fn)
+	}
+	candidates := s.h.Candidates(*userID)
+	if len(candidates) > 1 && limit > 0 {
+		var events []Event
+		for _, id := range candidates {
+			err := s.Service.FilterEvents(ctx, projectID, expr, &id, start, end, limit, func(e Event) error {
+				events = append(events, e)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		slices.SortStableFunc(events, func(a, b Event) int {
+			return b.CreatedAt.Compare(a.CreatedAt)
+		})
+		for i, e := range events {
+			if i == limit {
+				break
+			}
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, id := range candidates {
+		if err := s.Service.FilterEvents(ctx, projectID, expr, &id, start, end, limit, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PseudonymEventStore translates the user filter of the EventStore
+// operations to the pseudonyms of the user.
+type PseudonymEventStore struct {
+	store EventMaintainer
+	h     *pseudonym.Hasher
+}
+
+func NewPseudonymEventStore(store EventMaintainer, h *pseudonym.Hasher) *PseudonymEventStore {
+	return &PseudonymEventStore{store: store, h: h}
+}
+
+// filters returns f once per pseudonym of its user.
+func (s *PseudonymEventStore) filters(f EventFilter) []EventFilter {
+	if f.UserID == nil {
+		return []EventFilter{f}
+	}
+	var filters []EventFilter
+	for _, id := range s.h.Candidates(*f.UserID) {
+		f.UserID = &id
+		filters = append(filters, f)
+	}
+	return filters
+}
+
+func (s *PseudonymEventStore) Count(ctx context.Context, f EventFilter) (int64, error) {
+	var total int64
+	for _, f := range s.filters(f) {
+		n, err := s.store.Count(ctx, f)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Delete removes the events of every pseudonym of the user. A failure may
+// leave the events of the other pseudonyms deleted.
+func (s *PseudonymEventStore) Delete(ctx context.Context, f EventFilter) (int64, error) {
+	var total int64
+	for _, f := range s.filters(f) {
+		n, err := s.store.Delete(ctx, f)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrSavedQueryNotFound is returned for unknown saved query names.
+	ErrSavedQueryNotFound = errors.New("saved query not found")
+	// ErrSavedQueryExists is returned when a project already has a saved
+	// query of the name.
+	ErrSavedQueryExists = errors.New("a saved query with this name already exists")
+)
+
+// SavedQuery is a named query on the events of a project. It selects the
+// events of the last RangeSeconds matching Filter, and of UserID when set,
+// and returns them, or their counts by GroupBy, in Format.
+type SavedQuery struct {
+	ID           int64  `json:"id"`
+	ProjectID    int64  `json:"project_id"`
+	Name         string `json:"name"`
+	Filter       string `json:"filter,omitempty"`
+	UserID       *int64 `json:"user_id,omitempty"`
+	RangeSeconds int    `json:"range_seconds"`
+	GroupBy      string `json:"group_by,omitempty"`
+	Format       string `json:"format"`
+	// Limit bounds the events, or the groups, returned; nil leaves the
+	// default limit of GET /events, 0 returns them all.
+	Limit     *int      `json:"limit,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SavedQueryStore keeps the saved queries of the projects in saved_queries.
+type SavedQueryStore struct {
+	db *sql.DB
+}
+
+// NewSavedQueryStore uses the shared connection pool.
+func NewSavedQueryStore() *SavedQueryStore {
+	return &SavedQueryStore{db: open().db}
+}
+
+const savedQueryColumns = `id, project_id, name, filter, user_id, range_seconds, group_by, format, result_limit, created_at, updated_at`
+
+func scanSavedQuery(row interface{ Scan(...any) error }) (SavedQuery, error) {
+	var q SavedQuery
+	err := row.Scan(&q.ID, &q.ProjectID, &q.Name, &q.Filter, &q.UserID, &q.RangeSeconds, &q.GroupBy, &q.Format, &q.Limit, &q.CreatedAt, &q.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return SavedQuery{}, ErrSavedQueryNotFound
+	}
+	return q, err
+}
+
+// CreateSavedQuery stores a query, or returns ErrSavedQueryExists.
+func (s *SavedQueryStore) CreateSavedQuery(ctx context.Context, q SavedQuery) (SavedQuery, error) {
+	created, err := scanSavedQuery(s.db.QueryRowContext(ctx, `
+INSERT INTO saved_queries (project_id, name, filter, user_id, range_seconds, group_by, format, result_limit)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+ON CONFLICT (project_id, name) DO NOTHING
+RETURNING `+savedQueryColumns,
+		q.ProjectID, q.Name, q.Filter, q.UserID, q.RangeSeconds, q.GroupBy, q.Format, q.Limit))
+	if errors.Is(err, ErrSavedQueryNotFound) {
+		return SavedQuery{}, ErrSavedQueryExists
+	}
+	return created, err
+}
+
+// ListSavedQueries returns the queries of a project, by name.
+func (s *SavedQueryStore) ListSavedQueries(ctx context.Context, projectID int64) ([]SavedQuery, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+savedQueryColumns+` FROM saved_queries WHERE project_id = $1 ORDER BY name`, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queries := make([]SavedQuery, 0)
+	for rows.Next() {
+		q, err := scanSavedQuery(rows)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+func (s *SavedQueryStore) GetSavedQuery(ctx context.Context, projectID int64, name string) (SavedQuery, error) {
+	return scanSavedQuery(s.db.QueryRowContext(ctx, `SELECT `+savedQueryColumns+` FROM saved_queries WHERE project_id = $1 AND name = $2`, projectID, name))
+}
+
+// UpdateSavedQuery replaces the definition of the query of the project
+// named q.Name.
+func (s *SavedQueryStore) UpdateSavedQuery(ctx context.Context, q SavedQuery) (SavedQuery, error) {
+	return scanSavedQuery(s.db.QueryRowContext(ctx, `
+UPDATE saved_queries
+SET filter = $3, user_id = $4, range_seconds = $5, group_by = $6, format = $7, result_limit = $8, updated_at = now()
+WHERE project_id = $1 AND name = $2
+RETURNING `+savedQueryColumns,
+		q.ProjectID, q.Name, q.Filter, q.UserID, q.RangeSeconds, q.GroupBy, q.Format, q.Limit))
+}
+
+func (s *SavedQueryStore) DeleteSavedQuery(ctx context.Context, projectID int64, name string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM saved_queries WHERE project_id = $1 AND name = $2`, projectID, name)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSavedQueryNotFound
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// RenameStore renames the action of stored events, moving their counts in
+// the aggregates to the new name.
+type RenameStore struct {
+	db *sql.DB
+}
+
+// NewRenameStore uses the shared connection pool.
+func NewRenameStore() *RenameStore {
+	return &RenameStore{db: open().db}
+}
+
+// CountAction returns the number of events of the project with action,
+// archived and pending ones included.
+func (s *RenameStore) CountAction(ctx context.Context, projectID int64, action string) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `
+SELECT (SELECT count(*) FROM events WHERE project_id = $1 AND action = $2)
+	+ (SELECT count(*) FROM events_archive WHERE project_id = $1 AND action = $2)
+	+ (SELECT count(*) FROM pending_events WHERE project_id = $1 AND action = $2)`, projectID, action).Scan(&n)
+	return n, err
+}
+
+// RenameActions renames from to to on at most limit events of the project,
+// and returns how many were renamed, 0 once none is left. The events are
+// renamed first, then the archived ones, then the pending ones at once.
+// The counts of the renamed events move to the new name in the aggregates
+// of the same transaction; in the TimescaleDB mode the continuous
+// aggregates are refreshed on their hours instead.
+func (s *RenameStore) RenameActions(ctx context.Context, projectID int64, from, to string, limit int) (int64, error) {
+	var userIDs []int64
+	var times []time.Time
+	var n int64
+	err := inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		userIDs, times, n = nil, nil, 0
+		for _, table := range []string{"events", "events_archive"} {
+			rows, err := tx.QueryContext(ctx, `
+UPDATE `+table+` SET action = $3
+WHERE project_id = $1 AND id IN (SELECT id FROM `+table+` WHERE project_id = $1 AND action = $2 ORDER BY id LIMIT $4 FOR UPDATE)
+RETURNING user_id, created_at`, projectID, from, to, limit)
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+				var userID int64
+				var createdAt time.Time
+				if err := rows.Scan(&userID, &createdAt); err != nil {
+					rows.Close()
+					return err
+				}
+				userIDs, times = append(userIDs, userID), append(times, createdAt)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if len(times) > 0 {
+				n = int64(len(times))
+				if timescale {
+					return nil
+				}
+				return moveCounts(ctx, tx, projectID, from, to, userIDs, times)
+			}
+		}
+
+		res, err := tx.ExecContext(ctx, `UPDATE pending_events SET action = $3 WHERE project_id = $1 AND action = $2`, projectID, from, to)
+		if err != nil {
+			return err
+		}
+		n, err = res.RowsAffected()
+		return err
+	})
+	if err != nil || !timescale || len(times) == 0 {
+		return n, err
+	}
+
+	first, last := times[0], times[0]
+	for _, t := range times {
+		if t.Before(first) {
+			first = t
+		}
+		if t.After(last) {
+			last = t
+		}
+	}
+	return n, (&BackfillStore{db: s.db}).RecountHours(ctx, first.UTC().Truncate(time.Hour), last.UTC().Truncate(time.Hour).Add(time.Hour))
+}
+
+// moveCounts moves the counts of the events renamed from from to to, of
+// userIDs created at times, in action_event_counts and action_user_hours.
+// Only the periods and hours already counted move; the rows left empty are
+// deleted.
+func moveCounts(ctx context.Context, tx *sql.Tx, projectID int64, from, to string, userIDs []int64, times []time.Time) error {
+	if _, err := tx.ExecContext(ctx, `
+WITH moved AS (
+	SELECT c.period_start, c.period_end, count(*) AS n
+	FROM action_event_counts c
+	JOIN unnest($4::timestamptz[]) AS r(created_at) ON r.created_at >= c.period_start AND r.created_at < c.period_end
+	WHERE c.project_id = $1 AND c.action = $2
+	GROUP BY 1, 2
+), taken AS (
+	UPDATE action_event_counts c SET event_count = c.event_count - m.n
+	FROM moved m
+	WHERE c.project_id = $1 AND c.action = $2 AND c.period_start = m.period_start
+)
+INSERT INTO action_event_counts (project_id, action, period_start, period_end, event_count)
+SELECT $1, $3, period_start, period_end, n FROM moved
+ON CONFLICT (project_id, action, period_start) DO UPDATE SET event_count = action_event_counts.event_count + EXCLUDED.event_count`, projectID, from, to, times); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+WITH moved AS (
+	SELECT h.hour, h.user_id, count(*) AS n
+	FROM action_user_hours h
+	JOIN unnest($4::bigint[], $5::timestamptz[]) AS r(user_id, created_at)
+		ON r.user_id = h.user_id AND h.hour = date_trunc('hour', r.created_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'
+	WHERE h.project_id = $1 AND h.action = $2
+	GROUP BY 1, 2
+), taken AS (
+	UPDATE action_user_hours h SET event_count = h.event_count - m.n
+	FROM moved m
+	WHERE h.project_id = $1 AND h.action = $2 AND h.hour = m.hour AND h.user_id = m.user_id
+)
+INSERT INTO action_user_hours (project_id, action, hour, user_id, event_count)
+SELECT $1, $3, hour, user_id, n FROM moved
+ON CONFLICT (project_id, action, hour, user_id) DO UPDATE SET event_count = action_user_hours.event_count + EXCLUDED.event_count`, projectID, from, to, userIDs, times); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM action_event_counts WHERE project_id = $1 AND action = $2 AND event_count <= 0`, projectID, from); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx, `DELETE FROM action_user_hours WHERE project_id = $1 AND action = $2 AND event_count <= 0`, projectID, from)
+	return err
+}
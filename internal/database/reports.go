@@ -0,0 +1,71 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Summary totals the aggregates of a period.
+type Summary struct {
+	From        time.Time     `json:"from"`
+	To          time.Time     `json:"to"`
+	TotalEvents int64         `json:"total_events"`
+	ActiveUsers int64         `json:"active_users"`
+	TopActions  []ActionCount `json:"top_actions"`
+}
+
+type ActionCount struct {
+	Action string `json:"action"`
+	Count  int64  `json:"count"`
+}
+
+// ReportStore reads the summaries of reports from the aggregate tables, so
+// a report does not scan the events of the period.
+type ReportStore struct {
+	db *sql.DB
+}
+
+// NewReportStore uses the shared connection pool.
+func NewReportStore() *ReportStore {
+	return &ReportStore{db: open().db}
+}
+
+// Summary totals the aggregation periods starting in [from, to) over every
+// project and returns at most top actions, the most frequent first. The
+// users of the projects are told apart, user ids being per project.
+func (s *ReportStore) Summary(ctx context.Context, from, to time.Time, top int) (Summary, error) {
+	sum := Summary{From: from, To: to, TopActions: []ActionCount{}}
+	err := s.db.QueryRowContext(ctx, `
+SELECT COALESCE(sum(n), 0), count(*)
+FROM (
+	SELECT sum(event_count) AS n FROM user_event_counts
+	WHERE period_start >= $1 AND period_start < $2
+	GROUP BY project_id, user_id
+	HAVING sum(event_count) > 0
+) u`, from, to).Scan(&sum.TotalEvents, &sum.ActiveUsers)
+	if err != nil {
+		return Summary{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+SELECT action, sum(event_count) AS total
+FROM action_event_counts
+WHERE period_start >= $1 AND period_start < $2
+GROUP BY action
+HAVING sum(event_count) > 0
+ORDER BY total DESC, action
+LIMIT $3`, from, to, top)
+	if err != nil {
+		return Summary{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a ActionCount
+		if err := rows.Scan(&a.Action, &a.Count); err != nil {
+			return Summary{}, err
+		}
+		sum.TopActions = append(sum.TopActions, a)
+	}
+	return sum, rows.Err()
+}
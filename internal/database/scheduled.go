@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// splitScheduled separates the events to deliver later from the others,
+// keeping their order.
+func splitScheduled(events []NewEvent) (pending, now []NewEvent) {
+	for _, e := range events {
+		if e.DeliverAt.IsZero() {
+			now = append(now, e)
+		} else {
+			pending = append(pending, e)
+		}
+	}
+	return pending, now
+}
+
+// insertPending stores events in pending_events until their DeliverAt.
+func (s *service) insertPending(ctx context.Context, events []NewEvent) error {
+	projectIDs := make([]int64, len(events))
+	userIDs := make([]int64, len(events))
+	actions := make([]string, len(events))
+	pages := make([]*string, len(events))
+	deliverAt := make([]time.Time, len(events))
+	expiresAt := make([]*time.Time, len(events))
+	versions := make([]int, len(events))
+	for i, e := range events {
+		projectIDs[i], userIDs[i], actions[i], deliverAt[i], versions[i] = projectOrDefault(e.ProjectID), e.UserID, e.Action, e.DeliverAt, e.schemaVersion()
+		if page, ok := e.Metadata["page"]; ok {
+			pages[i] = &page
+		}
+		if e.TTL > 0 {
+			t := e.DeliverAt.Add(e.TTL)
+			expiresAt[i] = &t
+		}
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO pending_events (project_id, user_id, action, metadata_page, deliver_at, expires_at, schema_version)
+SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::text[], $4::text[], $5::timestamptz[], $6::timestamptz[], $7::int[])`,
+		projectIDs, userIDs, actions, pages, deliverAt, expiresAt, versions)
+	return err
+}
+
+// ScheduledStore moves the due events of pending_events to events.
+type ScheduledStore struct {
+	db *sql.DB
+}
+
+// NewScheduledStore uses the shared connection pool.
+func NewScheduledStore() *ScheduledStore {
+	return &ScheduledStore{db: open().db}
+}
+
+// ScheduledStore moves the due events of the pool.
+func (p *Pool) ScheduledStore() *ScheduledStore {
+	return &ScheduledStore{db: p.db}
+}
+
+// DeliverEvents moves at most limit events due by now to events, the
+// earliest first, created at their delivery time, and returns how many were
+// moved. An event is deleted and inserted by the same statement, and the
+// instances delivering concurrently move distinct events.
+func (s *ScheduledStore) DeliverEvents(ctx context.Context, now time.Time, limit int) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+WITH due AS (
+	DELETE FROM pending_events
+	WHERE id IN (
+		SELECT id FROM pending_events
+		WHERE deliver_at <= $1
+		ORDER BY deliver_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING project_id, user_id, action, metadata_page, deliver_at, expires_at, schema_version
+)
+INSERT INTO events (project_id, user_id, action, metadata_page, created_at, expires_at, schema_version)
+SELECT project_id, user_id, action, metadata_page, deliver_at, expires_at, schema_version FROM due
+ORDER BY deliver_at`, now, limit)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/logging"
+)
+
+// SlowQueryLogger is a Service logging at Warn the operations taking
+// threshold or longer, with their filters and the id of the request, to
+// find the time ranges that are expensive to query. User ids are not
+// logged, only whether the query filtered on one.
+type SlowQueryLogger struct {
+	Service
+	l         *slog.Logger
+	threshold time.Duration
+}
+
+func NewSlowQueryLogger(svc Service, logger *slog.Logger, threshold time.Duration) *SlowQueryLogger {
+	return &SlowQueryLogger{Service: svc, l: logger, threshold: threshold}
+}
+
+func (s *SlowQueryLogger) log(ctx context.Context, op string, took time.Duration, attrs ...any) {
+	if took < s.threshold {
+		return
+	}
+	attrs = append([]any{"op", op, "duration_ms", took.Milliseconds()}, attrs...)
+	if id := logging.RequestID(ctx); id != "" {
+		attrs = append(attrs, "request_id", id)
+	}
+	s.l.WarnContext(ctx, "slow database query", attrs...)
+}
+
+// filterAttrs describes the filters of an event query.
+func filterAttrs(projectID int64, userID *int64, start, end *time.Time, limit int) []any {
+	attrs := []any{"project_id", projectOrDefault(projectID), "user_filter", userID != nil, "limit", limit}
+	if start != nil {
+		attrs = append(attrs, "start", start.UTC().Format(time.RFC3339))
+	}
+	if end != nil {
+		attrs = append(attrs, "end", end.UTC().Format(time.RFC3339))
+	}
+	if start != nil && end != nil {
+		attrs = append(attrs, "range_hours", end.Sub(*start).Hours())
+	}
+	return attrs
+}
+
+func (s *SlowQueryLogger) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	start := time.Now()
+	id, err := s.Service.InsertEvent(ctx, projectID, userID, action, metadata)
+	s.log(ctx, "insert_event", time.Since(start), "project_id", projectOrDefault(projectID))
+	return id, err
+}
+
+func (s *SlowQueryLogger) InsertEvents(ctx context.Context, events []NewEvent) error {
+	start := time.Now()
+	err := s.Service.InsertEvents(ctx, events)
+	s.log(ctx, "insert_events", time.Since(start), "events", len(events))
+	return err
+}
+
+func (s *SlowQueryLogger) InsertEventOnce(ctx context.Context, e NewEvent, window time.Duration) (Event, bool, error) {
+	start := time.Now()
+	stored, duplicate, err := s.Service.InsertEventOnce(ctx, e, window)
+	s.log(ctx, "insert_event_once", time.Since(start), "project_id", projectOrDefault(e.ProjectID), "window", window.String())
+	return stored, duplicate, err
+}
+
+func (s *SlowQueryLogger) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]Event, error) {
+	began := time.Now()
+	events, err := s.Service.GetEvents(ctx, projectID, userID, start, end, limit)
+	s.log(ctx, "get_events", time.Since(began), append(filterAttrs(projectID, userID, start, end, limit), "rows", len(events))...)
+	return events, err
+}
+
+// StreamEvents leaves out of the duration the time spent in fn, such as
+// writing to a slow client.
+func (s *SlowQueryLogger) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	began := time.Now()
+	var inFn time.Duration
+	rows := 0
+	err := s.Service.StreamEvents(ctx, projectID, userID, start, end, limit, func(e Event) error {
+		rows++
+		called := time.Now()
+		defer func() { inFn += time.Since(called) }()
+		return fn(e)
+	})
+	s.log(ctx, "stream_events", time.Since(began)-inFn, append(filterAttrs(projectID, userID, start, end, limit), "rows", rows)...)
+	return err
+}
+
+// FilterEvents logs the expression unless it compares user ids.
+func (s *SlowQueryLogger) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(Event) error) error {
+	began := time.Now()
+	var inFn time.Duration
+	rows := 0
+	err := s.Service.FilterEvents(ctx, projectID, expr, userID, start, end, limit, func(e Event) error {
+		rows++
+		called := time.Now()
+		defer func() { inFn += time.Since(called) }()
+		return fn(e)
+	})
+	attrs := append(filterAttrs(projectID, userID, start, end, limit), "rows", rows)
+	if !expr.Uses("user_id") {
+		attrs = append(attrs, "filter", expr.String())
+	}
+	s.log(ctx, "filter_events", time.Since(began)-inFn, attrs...)
+	return err
+}
+
+func (s *SlowQueryLogger) AggregateEvents(seconds int) error {
+	start := time.Now()
+	err := s.Service.AggregateEvents(seconds)
+	s.log(context.Background(), "aggregate_events", time.Since(start), "period_seconds", seconds)
+	return err
+}
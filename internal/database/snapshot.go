@@ -0,0 +1,439 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+)
+
+// SnapshotVersion is the version of the records written by Snapshot, the
+// only one Restore accepts.
+const SnapshotVersion = 1
+
+// The kinds of the records of a snapshot, in the order they are written.
+const (
+	SnapshotHeaderKind     = "header"
+	SnapshotProjectKind    = "project"
+	SnapshotEventKind      = "event"
+	SnapshotTagKind        = "tag"
+	SnapshotUserCountKind  = "user_count"
+	SnapshotActionKind     = "action_count"
+	SnapshotActionUserKind = "action_user_hour"
+	SnapshotTrailerKind    = "trailer"
+)
+
+// ErrInvalidSnapshot is returned by Restore for records out of order, of
+// another version, or missing their trailer.
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// SnapshotRecord is a line of a snapshot: Kind tells which field is set.
+type SnapshotRecord struct {
+	Kind    string          `json:"kind"`
+	Header  *SnapshotHeader `json:"header,omitempty"`
+	Project *Project        `json:"project,omitempty"`
+	Event   *SnapshotEvent  `json:"event,omitempty"`
+	Tag     *SnapshotTag    `json:"tag,omitempty"`
+	// Count is set for the kinds of the aggregates.
+	Count   *SnapshotCount  `json:"count,omitempty"`
+	Trailer *SnapshotCounts `json:"trailer,omitempty"`
+}
+
+// SnapshotHeader opens a snapshot of the events created in [From, To).
+type SnapshotHeader struct {
+	Version   int       `json:"version"`
+	From      time.Time `json:"from"`
+	To        time.Time `json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SnapshotEvent is a row of events: user ids pseudonymized when they are,
+// and pages in clear when the store has the cipher.
+type SnapshotEvent struct {
+	ID            int64      `json:"id"`
+	ProjectID     int64      `json:"project_id"`
+	UserID        int64      `json:"user_id"`
+	Action        string     `json:"action"`
+	MetadataPage  *string    `json:"metadata_page,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DedupeKey     *string    `json:"dedupe_key,omitempty"`
+	Fingerprint   *string    `json:"fingerprint,omitempty"`
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"`
+	SchemaVersion int        `json:"schema_version"`
+}
+
+// SnapshotTag is a row of event_tags.
+type SnapshotTag struct {
+	EventID   int64     `json:"event_id"`
+	Tag       string    `json:"tag"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// SnapshotCount is a row of an aggregate of a project: user_event_counts
+// has UserID, action_event_counts Action, and action_user_hours both for
+// the hour starting at PeriodStart. The counts of snapshots taken before
+// they were kept per project have no ProjectID and are restored into the
+// default project.
+type SnapshotCount struct {
+	ProjectID   int64     `json:"project_id,omitempty"`
+	UserID      int64     `json:"user_id,omitempty"`
+	Action      string    `json:"action,omitempty"`
+	PeriodStart time.Time `json:"period_start"`
+	PeriodEnd   time.Time `json:"period_end"`
+	EventCount  int64     `json:"event_count"`
+}
+
+// SnapshotCounts closes a snapshot with the number of records of each
+// kind, so that a truncated snapshot is never restored.
+type SnapshotCounts struct {
+	Projects   int64 `json:"projects"`
+	Events     int64 `json:"events"`
+	Tags       int64 `json:"tags"`
+	Aggregates int64 `json:"aggregates"`
+}
+
+// RestoreResult counts the records restored. Skipped are the events already
+// stored with the same id or dedupe key, such as those of an earlier
+// restore of the snapshot.
+type RestoreResult struct {
+	SnapshotCounts
+	Skipped int64 `json:"skipped"`
+}
+
+// restoreBatch is the number of events inserted by each statement of
+// Restore.
+const restoreBatch = 1000
+
+// SnapshotStore copies the events of a window with their tags and
+// aggregates to a portable snapshot, and restores such snapshots, e.g. in
+// another environment.
+type SnapshotStore struct {
+	db     *sql.DB
+	cipher *fieldcrypt.Cipher
+}
+
+// NewSnapshotStore uses the shared connection pool.
+func NewSnapshotStore() *SnapshotStore {
+	return &SnapshotStore{db: open().db}
+}
+
+// WithCipher returns a store writing the pages of the snapshots decrypted
+// by c and encrypting the plain pages it restores. A nil c copies the pages
+// as stored.
+func (s *SnapshotStore) WithCipher(c *fieldcrypt.Cipher) *SnapshotStore {
+	return &SnapshotStore{db: s.db, cipher: c}
+}
+
+// Snapshot calls fn with the records of a snapshot of the events created in
+// [from, to): the header, every project, the events in id order, their
+// tags, the aggregates of the periods starting in the window, and the
+// trailer. The records are read in a single repeatable read transaction,
+// so that the events and the aggregates are consistent.
+func (s *SnapshotStore) Snapshot(ctx context.Context, from, to time.Time, fn func(SnapshotRecord) error) error {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := fn(SnapshotRecord{Kind: SnapshotHeaderKind, Header: &SnapshotHeader{Version: SnapshotVersion, From: from, To: to, CreatedAt: time.Now().UTC()}}); err != nil {
+		return err
+	}
+	var counts SnapshotCounts
+	each := func(n *int64, query string, scan func(*sql.Rows) (SnapshotRecord, error), args ...any) error {
+		rows, err := tx.QueryContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			r, err := scan(rows)
+			if err != nil {
+				return err
+			}
+			if err := fn(r); err != nil {
+				return err
+			}
+			*n++
+		}
+		return rows.Err()
+	}
+
+	err = each(&counts.Projects, `SELECT id, name, created_at FROM projects ORDER BY id`, func(rows *sql.Rows) (SnapshotRecord, error) {
+		var p Project
+		err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt)
+		return SnapshotRecord{Kind: SnapshotProjectKind, Project: &p}, err
+	})
+	if err != nil {
+		return fmt.Errorf("projects: %w", err)
+	}
+	err = each(&counts.Events, `
+SELECT id, project_id, user_id, action, metadata_page, created_at, dedupe_key, fingerprint, expires_at, schema_version
+FROM events WHERE created_at >= $1 AND created_at < $2 ORDER BY id`, func(rows *sql.Rows) (SnapshotRecord, error) {
+		var e SnapshotEvent
+		err := rows.Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Action, &e.MetadataPage, &e.CreatedAt, &e.DedupeKey, &e.Fingerprint, &e.ExpiresAt, &e.SchemaVersion)
+		e.MetadataPage = decryptPage(s.cipher, e.MetadataPage)
+		return SnapshotRecord{Kind: SnapshotEventKind, Event: &e}, err
+	}, from, to)
+	if err != nil {
+		return fmt.Errorf("events: %w", err)
+	}
+	err = each(&counts.Tags, `
+SELECT t.event_id, t.tag, t.created_at FROM event_tags t JOIN events e ON e.id = t.event_id
+WHERE e.created_at >= $1 AND e.created_at < $2 ORDER BY t.event_id, t.tag`, func(rows *sql.Rows) (SnapshotRecord, error) {
+		var t SnapshotTag
+		err := rows.Scan(&t.EventID, &t.Tag, &t.CreatedAt)
+		return SnapshotRecord{Kind: SnapshotTagKind, Tag: &t}, err
+	}, from, to)
+	if err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+
+	aggregates := []struct {
+		kind, query string
+		scan        func(*SnapshotCount) []any
+	}{
+		{SnapshotUserCountKind, `
+SELECT project_id, user_id, period_start, period_end, event_count FROM user_event_counts
+WHERE period_start >= $1 AND period_start < $2 ORDER BY period_start, project_id, user_id`, func(n *SnapshotCount) []any {
+			return []any{&n.ProjectID, &n.UserID, &n.PeriodStart, &n.PeriodEnd, &n.EventCount}
+		}},
+		{SnapshotActionKind, `
+SELECT project_id, action, period_start, period_end, event_count FROM action_event_counts
+WHERE period_start >= $1 AND period_start < $2 ORDER BY period_start, project_id, action`, func(n *SnapshotCount) []any {
+			return []any{&n.ProjectID, &n.Action, &n.PeriodStart, &n.PeriodEnd, &n.EventCount}
+		}},
+		{SnapshotActionUserKind, `
+SELECT project_id, action, user_id, hour, hour + INTERVAL '1 hour', event_count FROM action_user_hours
+WHERE hour >= $1 AND hour < $2 ORDER BY hour, project_id, action, user_id`, func(n *SnapshotCount) []any {
+			return []any{&n.ProjectID, &n.Action, &n.UserID, &n.PeriodStart, &n.PeriodEnd, &n.EventCount}
+		}},
+	}
+	for _, a := range aggregates {
+		err = each(&counts.Aggregates, a.query, func(rows *sql.Rows) (SnapshotRecord, error) {
+			var n SnapshotCount
+			err := rows.Scan(a.scan(&n)...)
+			return SnapshotRecord{Kind: a.kind, Count: &n}, err
+		}, from, to)
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.kind, err)
+		}
+	}
+	return fn(SnapshotRecord{Kind: SnapshotTrailerKind, Trailer: &counts})
+}
+
+// Restore stores the records returned by next, until it returns io.EOF, in
+// a single transaction: nothing is restored unless the snapshot is
+// complete. Projects and events keep their ids, so that the tags follow
+// them; the projects and events already stored are kept, and the
+// aggregates replaced. In the TimescaleDB mode the continuous aggregates
+// are refreshed on the window instead.
+func (s *SnapshotStore) Restore(ctx context.Context, next func() (SnapshotRecord, error)) (RestoreResult, error) {
+	var res RestoreResult
+	first, err := next()
+	if errors.Is(err, io.EOF) {
+		return res, fmt.Errorf("%w: empty", ErrInvalidSnapshot)
+	}
+	if err != nil {
+		return res, err
+	}
+	header := first.Header
+	if first.Kind != SnapshotHeaderKind || header == nil {
+		return res, fmt.Errorf("%w: the first record must be the header, got %q", ErrInvalidSnapshot, first.Kind)
+	}
+	if header.Version != SnapshotVersion {
+		return res, fmt.Errorf("%w: version %d, only version %d is supported", ErrInvalidSnapshot, header.Version, SnapshotVersion)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	var events []SnapshotEvent
+	flush := func() error {
+		if len(events) == 0 {
+			return nil
+		}
+		n, err := restoreEvents(ctx, tx, events)
+		res.Skipped += int64(len(events)) - n
+		events = events[:0]
+		return err
+	}
+	var trailer *SnapshotCounts
+	for {
+		r, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		if trailer != nil {
+			return res, fmt.Errorf("%w: %q record after the trailer", ErrInvalidSnapshot, r.Kind)
+		}
+		if r.Kind != SnapshotEventKind {
+			if err := flush(); err != nil {
+				return res, fmt.Errorf("restore events: %w", err)
+			}
+		}
+		switch {
+		case r.Kind == SnapshotProjectKind && r.Project != nil:
+			if err := restoreProject(ctx, tx, *r.Project); err != nil {
+				return res, err
+			}
+			res.Projects++
+		case r.Kind == SnapshotEventKind && r.Event != nil:
+			e := *r.Event
+			e.MetadataPage = encryptPage(s.cipher, e.MetadataPage)
+			events = append(events, e)
+			res.Events++
+			if len(events) == restoreBatch {
+				if err := flush(); err != nil {
+					return res, fmt.Errorf("restore events: %w", err)
+				}
+			}
+		case r.Kind == SnapshotTagKind && r.Tag != nil:
+			if _, err := tx.ExecContext(ctx, `
+INSERT INTO event_tags (event_id, tag, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, r.Tag.EventID, r.Tag.Tag, r.Tag.CreatedAt); err != nil {
+				return res, fmt.Errorf("restore the tag %q of event %d: %w", r.Tag.Tag, r.Tag.EventID, err)
+			}
+			res.Tags++
+		case (r.Kind == SnapshotUserCountKind || r.Kind == SnapshotActionKind || r.Kind == SnapshotActionUserKind) && r.Count != nil:
+			if !timescale {
+				if err := restoreCount(ctx, tx, r.Kind, *r.Count); err != nil {
+					return res, fmt.Errorf("restore %s: %w", r.Kind, err)
+				}
+			}
+			res.Aggregates++
+		case r.Kind == SnapshotTrailerKind && r.Trailer != nil:
+			trailer = r.Trailer
+		default:
+			return res, fmt.Errorf("%w: unknown or empty %q record", ErrInvalidSnapshot, r.Kind)
+		}
+	}
+	if trailer == nil {
+		return res, fmt.Errorf("%w: no trailer, the snapshot is truncated", ErrInvalidSnapshot)
+	}
+	if *trailer != res.SnapshotCounts {
+		return res, fmt.Errorf("%w: the trailer counts %+v, got %+v", ErrInvalidSnapshot, *trailer, res.SnapshotCounts)
+	}
+
+	// The next ids follow the restored ones; CockroachDB does not use
+	// sequences for them
+	if !cockroach {
+		for _, table := range []string{"projects", "events"} {
+			if _, err := tx.ExecContext(ctx, `SELECT setval(pg_get_serial_sequence('`+table+`', 'id'), GREATEST((SELECT max(id) FROM `+table+`), 1))`); err != nil {
+				return res, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+
+	if timescale {
+		// A refresh cannot run in a transaction
+		for _, view := range continuousAggregates {
+			if _, err := s.db.ExecContext(ctx, `CALL refresh_continuous_aggregate($1::regclass, $2::timestamptz, $3::timestamptz)`, view, header.From, header.To); err != nil {
+				return res, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// restoreProject creates the project unless its id is taken. A project of
+// another name with the id is an error, since the events would join it.
+func restoreProject(ctx context.Context, tx *sql.Tx, p Project) error {
+	var name string
+	err := tx.QueryRowContext(ctx, `
+WITH created AS (
+	INSERT INTO projects (id, name, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING RETURNING name
+)
+SELECT name FROM created UNION ALL SELECT name FROM projects WHERE id = $1
+LIMIT 1`, p.ID, p.Name, p.CreatedAt).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w: the project name %q is taken by another id than %d", ErrInvalidSnapshot, p.Name, p.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("restore project %d: %w", p.ID, err)
+	}
+	if name != p.Name {
+		return fmt.Errorf("%w: project %d is %q here, %q in the snapshot", ErrInvalidSnapshot, p.ID, name, p.Name)
+	}
+	return nil
+}
+
+// restoreEvents inserts the events that are not stored yet and returns how
+// many were.
+func restoreEvents(ctx context.Context, tx *sql.Tx, events []SnapshotEvent) (int64, error) {
+	ids := make([]int64, len(events))
+	projectIDs := make([]int64, len(events))
+	userIDs := make([]int64, len(events))
+	actions := make([]string, len(events))
+	pages := make([]*string, len(events))
+	createdAt := make([]time.Time, len(events))
+	keys := make([]*string, len(events))
+	fingerprints := make([]*string, len(events))
+	expiresAt := make([]*time.Time, len(events))
+	versions := make([]int, len(events))
+	for i, e := range events {
+		ids[i], projectIDs[i], userIDs[i], actions[i], pages[i], createdAt[i] = e.ID, e.ProjectID, e.UserID, e.Action, e.MetadataPage, e.CreatedAt
+		keys[i], fingerprints[i], expiresAt[i], versions[i] = e.DedupeKey, e.Fingerprint, e.ExpiresAt, max(e.SchemaVersion, 1)
+	}
+	query := `
+INSERT INTO events (id, project_id, user_id, action, metadata_page, created_at, dedupe_key, fingerprint, expires_at, schema_version)
+SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::text[], $5::text[], $6::timestamptz[], $7::text[], $8::text[], $9::timestamptz[], $10::int[])
+ON CONFLICT DO NOTHING`
+	if timescale {
+		// The primary key holds the creation time and the dedupe keys are
+		// claimed in their own table
+		query = `
+WITH e AS (
+	SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::bigint[], $4::text[], $5::text[], $6::timestamptz[], $7::text[], $8::text[], $9::timestamptz[], $10::int[])
+		AS e(id, project_id, user_id, action, metadata_page, created_at, dedupe_key, fingerprint, expires_at, schema_version)
+	WHERE NOT EXISTS (SELECT 1 FROM events s WHERE s.id = e.id)
+), claimed AS (
+	INSERT INTO event_dedupe_keys (dedupe_key, created_at)
+	SELECT dedupe_key, created_at FROM e WHERE dedupe_key IS NOT NULL
+	ON CONFLICT DO NOTHING
+	RETURNING dedupe_key
+)
+INSERT INTO events (id, project_id, user_id, action, metadata_page, created_at, dedupe_key, fingerprint, expires_at, schema_version)
+SELECT * FROM e WHERE dedupe_key IS NULL OR dedupe_key IN (SELECT dedupe_key FROM claimed)`
+	}
+	r, err := tx.ExecContext(ctx, query, ids, projectIDs, userIDs, actions, pages, createdAt, keys, fingerprints, expiresAt, versions)
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// restoreCount replaces a row of an aggregate.
+func restoreCount(ctx context.Context, tx *sql.Tx, kind string, n SnapshotCount) error {
+	var err error
+	switch kind {
+	case SnapshotUserCountKind:
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO user_event_counts (project_id, user_id, period_start, period_end, event_count) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (project_id, user_id, period_start) DO UPDATE SET period_end = EXCLUDED.period_end, event_count = EXCLUDED.event_count`,
+			projectOrDefault(n.ProjectID), n.UserID, n.PeriodStart, n.PeriodEnd, n.EventCount)
+	case SnapshotActionKind:
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO action_event_counts (project_id, action, period_start, period_end, event_count) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (project_id, action, period_start) DO UPDATE SET period_end = EXCLUDED.period_end, event_count = EXCLUDED.event_count`,
+			projectOrDefault(n.ProjectID), n.Action, n.PeriodStart, n.PeriodEnd, n.EventCount)
+	case SnapshotActionUserKind:
+		_, err = tx.ExecContext(ctx, `
+INSERT INTO action_user_hours (project_id, action, hour, user_id, event_count) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (project_id, action, hour, user_id) DO UPDATE SET event_count = EXCLUDED.event_count`,
+			n.ProjectID, n.Action, n.PeriodStart, n.UserID, n.EventCount)
+	}
+	return err
+}
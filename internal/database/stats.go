@@ -0,0 +1,255 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Cohort units of Retention.
+const (
+	CohortDay   = "day"
+	CohortWeek  = "week"
+	CohortMonth = "month"
+)
+
+// periodIndex is the number of cohort units from the cohort c to the
+// period p of an event, both truncated to the unit.
+var periodIndex = map[string]string{
+	CohortDay:   `(p::date - c::date)`,
+	CohortWeek:  `(p::date - c::date) / 7`,
+	CohortMonth: `((extract(year FROM p) - extract(year FROM c)) * 12 + extract(month FROM p) - extract(month FROM c))::int`,
+}
+
+// Retention is the share of the users of each cohort active again in the
+// periods following their first event.
+type Retention struct {
+	Cohort  string            `json:"cohort"`
+	Periods int               `json:"periods"`
+	Cohorts []RetentionCohort `json:"cohorts"`
+}
+
+// RetentionCohort holds the users first seen in the period starting at
+// Start. Returning[i] of them had an event i periods later, Retention[i]
+// being their fraction; periods that have not started yet are left out.
+type RetentionCohort struct {
+	Start     time.Time `json:"start"`
+	Users     int64     `json:"users"`
+	Returning []int64   `json:"returning"`
+	Retention []float64 `json:"retention"`
+}
+
+// StatsStore computes statistics over the events of a project.
+type StatsStore struct {
+	db  *sql.DB
+	now func() time.Time
+}
+
+// NewStatsStore uses the shared connection pool.
+func NewStatsStore() *StatsStore {
+	return &StatsStore{db: open().db, now: time.Now}
+}
+
+// Retention groups the users of the project by the UTC day, week (starting
+// on Monday) or month of their first event, for the last periods cohorts up
+// to the current one, and counts those active in each of the periods
+// following it. Users first seen before the oldest cohort are left out.
+//
+// The activity of the complete aggregation periods is read from
+// user_event_counts when the periods divide a day, so that each falls in a
+// single cohort period, and from the events elsewhere. The TimescaleDB mode
+// reads user_event_counts alone.
+func (s *StatsStore) Retention(ctx context.Context, projectID int64, unit string, periods int) (Retention, error) {
+	index, ok := periodIndex[unit]
+	if !ok {
+		return Retention{}, fmt.Errorf("unknown cohort unit %q", unit)
+	}
+	current := truncate(s.now().UTC(), unit)
+	first := addUnits(current, unit, 1-periods)
+
+	// The periods read and the aggregates are those of the same run
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Retention{}, err
+	}
+	defer tx.Rollback()
+
+	// An empty range reads every event
+	var coveredFrom, coveredTo time.Time
+	if timescale {
+		coveredTo = addUnits(current, unit, 1)
+	} else {
+		var seconds int
+		var from, to time.Time
+		err := tx.QueryRowContext(ctx, `SELECT period_seconds, covered_from, covered_to FROM aggregated_periods WHERE id = 1`).Scan(&seconds, &from, &to)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return Retention{}, err
+		}
+		if err == nil && seconds > 0 && 86400%seconds == 0 {
+			coveredFrom, coveredTo = from, to
+		}
+	}
+
+	// The size of a cohort is its count in period 0, which holds the first
+	// event of every user
+	rows, err := tx.QueryContext(ctx, `
+WITH seen AS (
+	SELECT user_id, period_start AS at
+	FROM user_event_counts
+	WHERE project_id = $1 AND event_count > 0 AND period_start >= $5 AND period_start < $6
+	UNION ALL
+	SELECT user_id, created_at
+	FROM events
+	WHERE project_id = $1 AND `+counted("events", "now()", "$7")+`
+		AND NOT (created_at >= $5 AND created_at < $6)
+), activity AS (
+	SELECT user_id,
+		date_trunc($2, at AT TIME ZONE 'UTC') AS p,
+		date_trunc($2, (min(at) OVER (PARTITION BY user_id)) AT TIME ZONE 'UTC') AS c
+	FROM seen
+),
+counts AS (
+	SELECT c, `+index+` AS period, count(DISTINCT user_id) AS users
+	FROM activity
+	WHERE c >= $3
+	GROUP BY c, period
+)
+SELECT c, period, users, first_value(users) OVER (PARTITION BY c ORDER BY period)
+FROM counts
+WHERE period < $4
+ORDER BY c, period`, projectOrDefault(projectID), unit, first, periods, coveredFrom, coveredTo, nonNil(excludedTags))
+	if err != nil {
+		return Retention{}, err
+	}
+	defer rows.Close()
+
+	r := Retention{Cohort: unit, Periods: periods, Cohorts: []RetentionCohort{}}
+	var cohort *RetentionCohort
+	for rows.Next() {
+		var start time.Time
+		var period int
+		var users, size int64
+		if err := rows.Scan(&start, &period, &users, &size); err != nil {
+			return Retention{}, err
+		}
+		if cohort == nil || !cohort.Start.Equal(start) {
+			r.Cohorts = append(r.Cohorts, newRetentionCohort(start, size, elapsed(start, current, unit, periods)))
+			cohort = &r.Cohorts[len(r.Cohorts)-1]
+		}
+		if period < len(cohort.Returning) {
+			cohort.Returning[period] = users
+			cohort.Retention[period] = float64(users) / float64(size)
+		}
+	}
+	return r, rows.Err()
+}
+
+// TimePoint counts the events of an action and their unique users in the
+// bucket starting at Start.
+type TimePoint struct {
+	Start  time.Time `json:"start"`
+	Events int64     `json:"events"`
+	Users  int64     `json:"users"`
+}
+
+// TimeSeries returns a point for every bucket, a multiple of an hour, from
+// the one holding from to the one holding the instant before to, empty
+// buckets included. It reads the hourly counts of action_user_hours up to
+// the hour of the last aggregation run, and counts the events of the later
+// hours, which the aggregator has not counted whole yet. The TimescaleDB
+// mode reads action_user_hours alone.
+func (s *StatsStore) TimeSeries(ctx context.Context, projectID int64, action string, from, to time.Time, bucket time.Duration) ([]TimePoint, error) {
+	first := from.UTC().Truncate(bucket)
+	last := to.UTC().Add(-time.Nanosecond).Truncate(bucket)
+
+	// The hours from live on are counted from the events. A later run only
+	// moves it forward, so it is read on its own.
+	live := last.Add(bucket)
+	if !timescale {
+		var aggregatedAt time.Time
+		err := s.db.QueryRowContext(ctx, `SELECT aggregated_at FROM aggregated_periods WHERE id = 1`).Scan(&aggregatedAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			live = first
+		} else if err != nil {
+			return nil, err
+		} else if h := aggregatedAt.UTC().Truncate(time.Hour); h.Before(live) {
+			live = h
+		}
+	}
+	rows, err := s.db.QueryContext(ctx, `
+WITH hours AS (
+	SELECT hour, user_id, event_count
+	FROM action_user_hours
+	WHERE project_id = $1 AND action = $2 AND event_count > 0 AND hour >= $3 AND hour < $6
+	UNION ALL
+	SELECT date_trunc('hour', created_at, 'UTC'), user_id, count(*)
+	FROM events
+	WHERE project_id = $1 AND action = $2 AND `+counted("events", "now()", "$7")+`
+		AND created_at >= GREATEST($3, $6) AND created_at < $4 + $5::float8 * INTERVAL '1 second'
+	GROUP BY 1, 2
+)
+SELECT b.start, COALESCE(sum(h.event_count), 0), count(DISTINCT h.user_id)
+FROM generate_series($3::timestamptz, $4::timestamptz, $5::float8 * INTERVAL '1 second') AS b(start)
+LEFT JOIN hours h ON h.hour >= b.start AND h.hour < b.start + $5::float8 * INTERVAL '1 second'
+GROUP BY b.start
+ORDER BY b.start`, projectOrDefault(projectID), action, first, last, bucket.Seconds(), live, nonNil(excludedTags))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	points := []TimePoint{}
+	for rows.Next() {
+		var p TimePoint
+		if err := rows.Scan(&p.Start, &p.Events, &p.Users); err != nil {
+			return nil, err
+		}
+		p.Start = p.Start.UTC()
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+// newRetentionCohort returns a cohort of size users with n periods without
+// returning users.
+func newRetentionCohort(start time.Time, size int64, n int) RetentionCohort {
+	return RetentionCohort{Start: start, Users: size, Returning: make([]int64, n), Retention: make([]float64, n)}
+}
+
+// elapsed returns the number of periods of the cohort starting at start
+// that have started by the current period, at most periods.
+func elapsed(start, current time.Time, unit string, periods int) int {
+	n := 1
+	for n < periods && !addUnits(start, unit, n).After(current) {
+		n++
+	}
+	return n
+}
+
+// truncate returns the start of the period of t, in UTC.
+func truncate(t time.Time, unit string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch unit {
+	case CohortWeek:
+		// date_trunc weeks start on Monday
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case CohortMonth:
+		return day.AddDate(0, 0, 1-day.Day())
+	default:
+		return day
+	}
+}
+
+// addUnits moves t, the start of a period, by n periods.
+func addUnits(t time.Time, unit string, n int) time.Time {
+	switch unit {
+	case CohortWeek:
+		return t.AddDate(0, 0, 7*n)
+	case CohortMonth:
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(0, 0, n)
+	}
+}
@@ -0,0 +1,72 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+)
+
+// EventStream reads ranges of events row by row, for ranges too large to be
+// loaded at once like GetEvents does.
+type EventStream struct {
+	db     *sql.DB
+	cipher *fieldcrypt.Cipher
+}
+
+// NewEventStream uses the shared connection pool.
+func NewEventStream() *EventStream {
+	return &EventStream{db: open().db}
+}
+
+// WithCipher returns a stream reading the events with their metadata
+// decrypted by c. A nil c reads the metadata as stored.
+func (s *EventStream) WithCipher(c *fieldcrypt.Cipher) *EventStream {
+	return &EventStream{db: s.db, cipher: c}
+}
+
+// EventFilter selects the events created in [From, To). ProjectID, UserID
+// and Action match every event when nil and empty.
+type EventFilter struct {
+	ProjectID *int64
+	UserID    *int64
+	Action    string
+	From      time.Time
+	To        time.Time
+}
+
+// Each calls fn with the events created in [from, to), in id order, and
+// stops at the first error.
+func (s *EventStream) Each(ctx context.Context, from, to time.Time, fn func(Event) error) error {
+	return s.Filter(ctx, EventFilter{From: from, To: to}, fn)
+}
+
+// Filter calls fn with the events matching f, in id order, and stops at the
+// first error.
+func (s *EventStream) Filter(ctx context.Context, f EventFilter, fn func(Event) error) error {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, project_id, user_id, action, metadata_page, created_at, schema_version, expires_at
+FROM events
+WHERE created_at >= $1 AND created_at < $2
+	AND ($3::bigint IS NULL OR user_id = $3)
+	AND ($4 = '' OR action = $4)
+	AND ($5::bigint IS NULL OR project_id = $5)
+ORDER BY id`, f.From, f.To, f.UserID, f.Action, f.ProjectID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e Event
+		if err := rows.Scan(&e.ID, &e.ProjectID, &e.UserID, &e.Action, &e.MetadataPage, &e.CreatedAt, &e.SchemaVersion, &e.ExpiresAt); err != nil {
+			return err
+		}
+		e.MetadataPage = decryptPage(s.cipher, e.MetadataPage)
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
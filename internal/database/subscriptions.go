@@ -0,0 +1,345 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/fieldcrypt"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+// ErrSubscriptionNotFound is returned for unknown webhook subscription ids.
+var ErrSubscriptionNotFound = errors.New("webhook subscription not found")
+
+// Subscription is a URL receiving the stored events that match its filters.
+// Empty filters match every event.
+type Subscription struct {
+	ID  int64  `json:"id"`
+	URL string `json:"url"`
+	// Secret signs the deliveries. It is only returned on creation.
+	Secret    string    `json:"secret,omitempty"`
+	Actions   []string  `json:"actions"`
+	UserIDs   []int64   `json:"user_ids"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Delivery states.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// Delivery is the delivery of one event to one subscription.
+type Delivery struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int64      `json:"subscription_id"`
+	EventID        int64      `json:"event_id"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus *int       `json:"response_status,omitempty"`
+	Error          *string    `json:"error,omitempty"`
+	NextAttemptAt  time.Time  `json:"next_attempt_at"`
+	CreatedAt      time.Time  `json:"created_at"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+}
+
+// PendingDelivery is a delivery claimed by a worker, with what it needs to
+// send it.
+type PendingDelivery struct {
+	ID             int64
+	Attempt        int
+	SubscriptionID int64
+	URL            string
+	Secret         string
+	Event          Event
+}
+
+// SubscriptionStore keeps webhook subscriptions and their deliveries in the
+// webhook_subscriptions and webhook_deliveries tables.
+type SubscriptionStore struct {
+	db     *sql.DB
+	types  *pgtype.Map
+	cipher *fieldcrypt.Cipher
+}
+
+// NewSubscriptionStore uses the shared connection pool.
+func NewSubscriptionStore() *SubscriptionStore {
+	return &SubscriptionStore{db: open().db, types: pgtype.NewMap()}
+}
+
+// WithCipher returns a store claiming the deliveries with the metadata of
+// their events decrypted by c. A nil c claims the metadata as stored.
+func (s *SubscriptionStore) WithCipher(c *fieldcrypt.Cipher) *SubscriptionStore {
+	return &SubscriptionStore{db: s.db, types: s.types, cipher: c}
+}
+
+const subscriptionColumns = `id, url, actions, user_ids, active, created_at, updated_at`
+
+func (s *SubscriptionStore) scanSubscription(row interface{ Scan(...any) error }) (Subscription, error) {
+	var sub Subscription
+	err := row.Scan(&sub.ID, &sub.URL, s.types.SQLScanner(&sub.Actions), s.types.SQLScanner(&sub.UserIDs), &sub.Active, &sub.CreatedAt, &sub.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, ErrSubscriptionNotFound
+	}
+	return sub, err
+}
+
+func (s *SubscriptionStore) CreateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	created, err := s.scanSubscription(s.db.QueryRowContext(ctx, `
+INSERT INTO webhook_subscriptions (url, secret, actions, user_ids, active)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING `+subscriptionColumns,
+		sub.URL, sub.Secret, nonNil(sub.Actions), nonNil(sub.UserIDs), sub.Active))
+	created.Secret = sub.Secret
+	return created, err
+}
+
+func (s *SubscriptionStore) ListSubscriptions(ctx context.Context) ([]Subscription, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+subscriptionColumns+` FROM webhook_subscriptions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := make([]Subscription, 0)
+	for rows.Next() {
+		sub, err := s.scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *SubscriptionStore) GetSubscription(ctx context.Context, id int64) (Subscription, error) {
+	return s.scanSubscription(s.db.QueryRowContext(ctx, `SELECT `+subscriptionColumns+` FROM webhook_subscriptions WHERE id = $1`, id))
+}
+
+// UpdateSubscription replaces the URL, filters and state of a subscription;
+// its secret is kept.
+func (s *SubscriptionStore) UpdateSubscription(ctx context.Context, sub Subscription) (Subscription, error) {
+	return s.scanSubscription(s.db.QueryRowContext(ctx, `
+UPDATE webhook_subscriptions
+SET url = $2, actions = $3, user_ids = $4, active = $5, updated_at = now()
+WHERE id = $1
+RETURNING `+subscriptionColumns,
+		sub.ID, sub.URL, nonNil(sub.Actions), nonNil(sub.UserIDs), sub.Active))
+}
+
+// DeleteSubscription removes a subscription with its deliveries.
+func (s *SubscriptionStore) DeleteSubscription(ctx context.Context, id int64) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhook_subscriptions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
+
+// ListDeliveries returns the latest deliveries of a subscription, newest first.
+func (s *SubscriptionStore) ListDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]Delivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT id, subscription_id, event_id, status, attempts, response_status, error, next_attempt_at, created_at, finished_at
+FROM webhook_deliveries
+WHERE subscription_id = $1
+ORDER BY id DESC
+LIMIT $2`, subscriptionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := make([]Delivery, 0)
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.EventID, &d.Status, &d.Attempts, &d.ResponseStatus, &d.Error, &d.NextAttemptAt, &d.CreatedAt, &d.FinishedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// ScheduleDeliveries creates the deliveries of the events inserted since the
+// last call and created before settledBefore, at most limit events. It
+// returns the number of events examined. The webhooks cursor starts at the
+// newest event, so existing history is not delivered.
+func (s *SubscriptionStore) ScheduleDeliveries(ctx context.Context, settledBefore time.Time, limit int) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO sink_cursors (name, last_event_id)
+SELECT 'webhooks', COALESCE(max(id), 0) FROM events
+ON CONFLICT (name) DO NOTHING`); err != nil {
+		return 0, err
+	}
+
+	// Locking the cursor serializes instances scheduling concurrently
+	var cursor int64
+	if err := tx.QueryRowContext(ctx, `SELECT last_event_id FROM sink_cursors WHERE name = 'webhooks' FOR UPDATE`).Scan(&cursor); err != nil {
+		return 0, err
+	}
+
+	var upTo sql.NullInt64
+	var n int
+	if err := tx.QueryRowContext(ctx, `
+SELECT max(id), count(*) FROM (
+	SELECT id FROM events WHERE id > $1 AND created_at < $2 ORDER BY id LIMIT $3
+) batch`, cursor, settledBefore, limit).Scan(&upTo, &n); err != nil {
+		return 0, err
+	}
+	if !upTo.Valid {
+		return 0, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+INSERT INTO webhook_deliveries (subscription_id, event_id)
+SELECT s.id, e.id
+FROM events e
+JOIN webhook_subscriptions s ON s.active
+	AND (cardinality(s.actions) = 0 OR e.action = ANY(s.actions))
+	AND (cardinality(s.user_ids) = 0 OR e.user_id = ANY(s.user_ids))
+WHERE e.id > $1 AND e.id <= $2`, cursor, upTo.Int64); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE sink_cursors SET last_event_id = $1 WHERE name = 'webhooks'`, upTo.Int64); err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
+
+// ClaimDeliveries returns up to limit due deliveries and counts an attempt
+// for each. They are not due again for lease, so that another instance only
+// picks them up if this one died while sending.
+func (s *SubscriptionStore) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]PendingDelivery, error) {
+	rows, err := s.db.QueryContext(ctx, `
+UPDATE webhook_deliveries d
+SET attempts = d.attempts + 1, next_attempt_at = now() + $2::float8 * INTERVAL '1 second'
+FROM webhook_subscriptions s, events e
+WHERE d.id IN (
+	SELECT id FROM webhook_deliveries
+	WHERE status = 'pending' AND next_attempt_at <= now()
+	ORDER BY next_attempt_at
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+AND s.id = d.subscription_id AND e.id = d.event_id
+RETURNING d.id, d.attempts, s.id, s.url, s.secret, e.id, e.user_id, e.action, e.metadata_page, e.created_at`,
+		limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claimed []PendingDelivery
+	for rows.Next() {
+		var d PendingDelivery
+		if err := rows.Scan(&d.ID, &d.Attempt, &d.SubscriptionID, &d.URL, &d.Secret,
+			&d.Event.ID, &d.Event.UserID, &d.Event.Action, &d.Event.MetadataPage, &d.Event.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.Event.MetadataPage = decryptPage(s.cipher, d.Event.MetadataPage)
+		claimed = append(claimed, d)
+	}
+	return claimed, rows.Err()
+}
+
+// CompleteDelivery records a successful attempt.
+func (s *SubscriptionStore) CompleteDelivery(ctx context.Context, id int64, responseStatus int) error {
+	_, err := s.db.ExecContext(ctx, `
+UPDATE webhook_deliveries
+SET status = 'delivered', response_status = $2, error = NULL, finished_at = now()
+WHERE id = $1`, id, responseStatus)
+	return err
+}
+
+// FailDelivery records a failed attempt. The delivery is retried at next,
+// or marked failed when final is set. responseStatus is 0 when no response
+// was received.
+func (s *SubscriptionStore) FailDelivery(ctx context.Context, id int64, responseStatus int, cause string, next time.Time, final bool) error {
+	var status sql.NullInt64
+	if responseStatus != 0 {
+		status = sql.NullInt64{Int64: int64(responseStatus), Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx, `
+UPDATE webhook_deliveries
+SET response_status = $2, error = $3, next_attempt_at = $4,
+	status = CASE WHEN $5 THEN 'failed' ELSE 'pending' END,
+	finished_at = CASE WHEN $5 THEN now() END
+WHERE id = $1`, id, status, cause, next, final)
+	return err
+}
+
+// EnqueueDeliveries schedules again the delivery of events to a
+// subscription, for events matching its filters, and returns the number of
+// deliveries created.
+func (s *SubscriptionStore) EnqueueDeliveries(ctx context.Context, subscriptionID int64, eventIDs []int64) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `
+INSERT INTO webhook_deliveries (subscription_id, event_id)
+SELECT s.id, e.id
+FROM events e
+JOIN webhook_subscriptions s ON s.id = $1
+	AND (cardinality(s.actions) = 0 OR e.action = ANY(s.actions))
+	AND (cardinality(s.user_ids) = 0 OR e.user_id = ANY(s.user_ids))
+WHERE e.id = ANY($2)`, subscriptionID, eventIDs)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// DeliveryBacklog describes the deliveries waiting to be sent.
+type DeliveryBacklog struct {
+	Pending int64 `json:"pending"`
+	// Due are the pending deliveries whose next attempt is already due.
+	Due int64 `json:"due"`
+	// OldestDueAt is the time the longest waiting due delivery was due at.
+	OldestDueAt *time.Time `json:"oldest_due_at,omitempty"`
+}
+
+// DeliveryBacklog counts the pending deliveries.
+func (s *SubscriptionStore) DeliveryBacklog(ctx context.Context) (DeliveryBacklog, error) {
+	var b DeliveryBacklog
+	var oldest sql.NullTime
+	err := s.db.QueryRowContext(ctx, `
+SELECT count(*), count(*) FILTER (WHERE next_attempt_at <= now()),
+	min(next_attempt_at) FILTER (WHERE next_attempt_at <= now())
+FROM webhook_deliveries WHERE status = 'pending'`).Scan(&b.Pending, &b.Due, &oldest)
+	if err != nil {
+		return DeliveryBacklog{}, err
+	}
+	if oldest.Valid {
+		t := oldest.Time.UTC()
+		b.OldestDueAt = &t
+	}
+	return b, nil
+}
+
+// PruneDeliveries removes the deliveries finished before t.
+func (s *SubscriptionStore) PruneDeliveries(ctx context.Context, t time.Time) (int64, error) {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhook_deliveries WHERE status <> 'pending' AND finished_at < $1`, t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// nonNil turns a nil filter into an empty array for the NOT NULL columns.
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
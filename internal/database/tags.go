@@ -0,0 +1,214 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	// ErrEventNotFound is returned for unknown event ids, or the events of
+	// another project.
+	ErrEventNotFound = errors.New("event not found")
+	// ErrEventTagNotFound is returned when removing a tag an event does not
+	// carry.
+	ErrEventTagNotFound = errors.New("event tag not found")
+)
+
+// excludedTags are the tags of the events left out of the counts and the
+// statistics, set by ExcludeTags.
+var excludedTags []string
+
+// ExcludeTags leaves the events carrying one of tags out of the counts and
+// the statistics. The aggregates leave them out as they are counted, and
+// count again the period and the hour of an event when it is tagged or
+// untagged with one of tags.
+func ExcludeTags(tags []string) {
+	excludedTags = tags
+}
+
+// excluded reports whether one of tags is an excluded tag.
+func excluded(tags ...string) bool {
+	for _, tag := range tags {
+		if slices.Contains(excludedTags, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// untagged is the condition of the events of table, a table name or alias,
+// carrying none of the tags of the text[] parameter tags, the excluded
+// tags: a lookup of the primary key of event_tags per event, skipped when
+// no tag is excluded.
+func untagged(table, tags string) string {
+	return `(cardinality(` + tags + `::text[]) = 0 OR NOT EXISTS (
+	SELECT 1 FROM event_tags t WHERE t.event_id = ` + table + `.id AND t.tag = ANY(` + tags + `::text[])))`
+}
+
+// TagStore keeps the tags put on events in event_tags.
+type TagStore struct {
+	db *sql.DB
+}
+
+// NewTagStore uses the shared connection pool.
+func NewTagStore() *TagStore {
+	return &TagStore{db: open().db}
+}
+
+// AddEventTags tags an event of the project, tags it already carries
+// included, and returns every tag of the event.
+func (s *TagStore) AddEventTags(ctx context.Context, projectID, eventID int64, tags []string) ([]string, error) {
+	var all []string
+	err := inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		a, err := lockAggregation(ctx, tx, excluded(tags...))
+		if err != nil {
+			return err
+		}
+		if err := eventExists(ctx, tx, projectID, eventID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO event_tags (event_id, tag)
+SELECT $1, unnest($2::text[])
+ON CONFLICT DO NOTHING`, eventID, nonNil(tags)); err != nil {
+			return err
+		}
+		if err := recountEvent(ctx, tx, a, eventID); err != nil {
+			return err
+		}
+		all, err = eventTags(ctx, tx, eventID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+// ListEventTags returns the tags of an event of the project, by name.
+func (s *TagStore) ListEventTags(ctx context.Context, projectID, eventID int64) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := eventExists(ctx, tx, projectID, eventID); err != nil {
+		return nil, err
+	}
+	return eventTags(ctx, tx, eventID)
+}
+
+// RemoveEventTag removes a tag from an event of the project.
+func (s *TagStore) RemoveEventTag(ctx context.Context, projectID, eventID int64, tag string) error {
+	return inTx(ctx, s.db, nil, func(tx *sql.Tx) error {
+		a, err := lockAggregation(ctx, tx, excluded(tag))
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, `
+DELETE FROM event_tags t
+USING events e
+WHERE t.event_id = e.id AND e.id = $1 AND e.project_id = $2 AND t.tag = $3`, eventID, projectID, tag)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrEventTagNotFound
+		}
+		return recountEvent(ctx, tx, a, eventID)
+	})
+}
+
+// aggregation is the state of the aggregates left by the last aggregation
+// run.
+type aggregation struct {
+	seconds      int
+	coveredFrom  time.Time
+	aggregatedAt time.Time
+}
+
+// lockAggregation locks the row of aggregated_periods like an aggregation
+// run when lock is true, before the events are changed, and returns it. The
+// zero aggregation, before the first run, in the TimescaleDB mode or
+// without lock, has nothing to count again.
+func lockAggregation(ctx context.Context, tx *sql.Tx, lock bool) (aggregation, error) {
+	var a aggregation
+	if !lock || timescale {
+		return a, nil
+	}
+	err := tx.QueryRowContext(ctx, `SELECT period_seconds, covered_from, aggregated_at FROM aggregated_periods WHERE id = 1 FOR UPDATE`).Scan(&a.seconds, &a.coveredFrom, &a.aggregatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return aggregation{}, nil
+	}
+	return a, err
+}
+
+// recountEvent counts again the aggregation period and the hour of an event
+// whose excluded tags changed, if a has counted them, up to the run of a.
+func recountEvent(ctx context.Context, tx *sql.Tx, a aggregation, eventID int64) error {
+	if a.seconds == 0 {
+		return nil
+	}
+	var createdAt time.Time
+	if err := tx.QueryRowContext(ctx, `SELECT created_at FROM events WHERE id = $1`, eventID).Scan(&createdAt); err != nil {
+		return err
+	}
+	if !createdAt.Before(a.aggregatedAt) {
+		return nil
+	}
+
+	period := time.Duration(a.seconds) * time.Second
+	if start := time.Unix(createdAt.Unix()/int64(a.seconds)*int64(a.seconds), 0).UTC(); !start.Before(a.coveredFrom) {
+		if err := countPeriods(tx, start, minTime(start.Add(period), a.aggregatedAt), a.seconds, a.aggregatedAt); err != nil {
+			return err
+		}
+	}
+	hour := createdAt.UTC().Truncate(time.Hour)
+	if hour.Before(a.coveredFrom.UTC().Truncate(time.Hour)) {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM action_user_hours WHERE hour = $1`, hour); err != nil {
+		return err
+	}
+	return countHours(tx, hour, minTime(hour.Add(time.Hour), a.aggregatedAt), a.aggregatedAt)
+}
+
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+func eventExists(ctx context.Context, tx *sql.Tx, projectID, eventID int64) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM events WHERE id = $1 AND project_id = $2)`, eventID, projectID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrEventNotFound
+	}
+	return nil
+}
+
+func eventTags(ctx context.Context, tx *sql.Tx, eventID int64) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT tag FROM event_tags WHERE event_id = $1 ORDER BY tag`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make([]string, 0)
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// ErrNotHypertable is returned when the TimescaleDB mode is selected for a
+// database that other/timescale.sql did not migrate.
+var ErrNotHypertable = errors.New("events is not a TimescaleDB hypertable, run other/timescale.sql")
+
+// timescale is set by Configure in the TimescaleDB mode, in which the dedupe
+// keys are kept in event_dedupe_keys and the aggregates are continuous
+// aggregates.
+var timescale bool
+
+// continuousAggregates are the continuous aggregates of other/timescale.sql.
+var continuousAggregates = []string{"action_event_minutes", "action_user_hours", "user_event_minutes"}
+
+// AggregateJob is the state of the refresh policy of a continuous
+// aggregate. Times are unset until the first run.
+type AggregateJob struct {
+	View          string     `json:"view"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+	LastStatus    string     `json:"last_status,omitempty"`
+	NextStartAt   *time.Time `json:"next_start_at,omitempty"`
+}
+
+// TimescaleStore sets the policies of the events hypertable and of the
+// continuous aggregates.
+type TimescaleStore struct {
+	db *sql.DB
+}
+
+// NewTimescaleStore uses the shared connection pool.
+func NewTimescaleStore() *TimescaleStore {
+	return &TimescaleStore{db: open().db}
+}
+
+// ApplyPolicies sets the chunk interval and the compression policy of the
+// events, and refreshes the continuous aggregates every refreshEvery,
+// replacing the policies set before.
+func (s *TimescaleStore) ApplyPolicies(ctx context.Context, cfg config.TimescaleConfig, refreshEvery time.Duration) error {
+	var hypertable bool
+	err := s.db.QueryRowContext(ctx, `
+SELECT to_regclass('timescaledb_information.hypertables') IS NOT NULL`).Scan(&hypertable)
+	if err == nil && hypertable {
+		err = s.db.QueryRowContext(ctx, `
+SELECT EXISTS (
+	SELECT 1 FROM timescaledb_information.hypertables
+	WHERE hypertable_schema = current_schema() AND hypertable_name = 'events'
+)`).Scan(&hypertable)
+	}
+	if err != nil {
+		return err
+	}
+	if !hypertable {
+		return ErrNotHypertable
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The interval applies to the chunks created from now on
+	if _, err := tx.ExecContext(ctx, `SELECT set_chunk_time_interval('events', make_interval(hours => $1))`, cfg.ChunkIntervalHours); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `SELECT remove_compression_policy('events', if_exists => true)`); err != nil {
+		return err
+	}
+	if cfg.CompressAfterDays > 0 {
+		if _, err := tx.ExecContext(ctx, `SELECT add_compression_policy('events', compress_after => make_interval(days => $1))`, cfg.CompressAfterDays); err != nil {
+			return err
+		}
+	}
+
+	// The current bucket is left to the real-time aggregation; TimescaleDB
+	// only counts again the buckets whose events changed
+	for _, view := range continuousAggregates {
+		if _, err := tx.ExecContext(ctx, `SELECT remove_continuous_aggregate_policy($1::regclass, if_exists => true)`, view); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+SELECT add_continuous_aggregate_policy($1::regclass,
+	start_offset => NULL,
+	end_offset => CASE WHEN $1 = 'action_user_hours' THEN INTERVAL '1 hour' ELSE INTERVAL '1 minute' END,
+	schedule_interval => make_interval(secs => $2))`, view, refreshEvery.Seconds()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// RefreshAggregates counts again the buckets of the continuous aggregates
+// whose events changed since their last refresh.
+func (s *TimescaleStore) RefreshAggregates(ctx context.Context) error {
+	return refreshAggregates(ctx, s.db)
+}
+
+func refreshAggregates(ctx context.Context, db *sql.DB) error {
+	// A refresh cannot run in a transaction
+	for _, view := range continuousAggregates {
+		if _, err := db.ExecContext(ctx, `CALL refresh_continuous_aggregate($1::regclass, NULL, now())`, view); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AggregateJobs returns the state of the refresh policy of every continuous
+// aggregate, by name.
+func (s *TimescaleStore) AggregateJobs(ctx context.Context) ([]AggregateJob, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT c.view_name, NULLIF(st.last_successful_finish, '-infinity'), COALESCE(st.last_run_status, ''), NULLIF(st.next_start, '-infinity')
+FROM timescaledb_information.continuous_aggregates c
+LEFT JOIN timescaledb_information.jobs j
+	ON j.hypertable_schema = c.materialization_hypertable_schema
+	AND j.hypertable_name = c.materialization_hypertable_name
+	AND j.proc_name = 'policy_refresh_continuous_aggregate'
+LEFT JOIN timescaledb_information.job_stats st ON st.job_id = j.job_id
+WHERE c.view_schema = current_schema() AND c.view_name = ANY($1)
+ORDER BY c.view_name`, continuousAggregates)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []AggregateJob{}
+	for rows.Next() {
+		var j AggregateJob
+		var success, next sql.NullTime
+		if err := rows.Scan(&j.View, &success, &j.LastStatus, &next); err != nil {
+			return nil, err
+		}
+		if success.Valid {
+			t := success.Time.UTC()
+			j.LastSuccessAt = &t
+		}
+		if next.Valid {
+			t := next.Time.UTC()
+			j.NextStartAt = &t
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// TestTimescale runs the migration of the TimescaleDB mode on a database
+// of its own, since it changes the events table.
+func TestTimescale(t *testing.T) {
+	ctx := context.Background()
+	container, err := postgres.Run(ctx,
+		"timescale/timescaledb:latest-pg17",
+		postgres.WithDatabase("database"),
+		postgres.WithUsername("user"),
+		postgres.WithPassword("password"),
+		postgres.WithInitScripts(
+			filepath.Join("..", "..", "other", "init_tables.sql"),
+			filepath.Join("..", "..", "other", "timescale.sql"),
+		),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(60*time.Second)),
+	)
+	if err != nil {
+		t.Fatalf("could not start timescaledb container: %v", err)
+	}
+	t.Cleanup(func() { _ = container.Terminate(context.Background()) })
+
+	connStr, err := container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("pgx", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	timescale = true
+	t.Cleanup(func() { timescale = false })
+	srv := &service{db: db}
+	store := &TimescaleStore{db: db}
+
+	if err := store.ApplyPolicies(ctx, config.TimescaleConfig{ChunkIntervalHours: 24, CompressAfterDays: 7}, time.Minute); err != nil {
+		t.Fatalf("apply policies: %v", err)
+	}
+	// Applying them again replaces them
+	if err := store.ApplyPolicies(ctx, config.TimescaleConfig{ChunkIntervalHours: 12}, time.Minute); err != nil {
+		t.Fatalf("apply policies again: %v", err)
+	}
+
+	hour := time.Now().UTC().Truncate(time.Hour).Add(-2 * time.Hour)
+	batch := []NewEvent{
+		{UserID: 1101, Action: "view", CreatedAt: hour, DedupeKey: "k1"},
+		{UserID: 1101, Action: "click", CreatedAt: hour, DedupeKey: "k1"},
+		{UserID: 1101, Action: "view", CreatedAt: hour.Add(time.Minute)},
+		{UserID: 1102, Action: "view", CreatedAt: hour.Add(time.Minute), DedupeKey: "k2"},
+	}
+	for range 2 {
+		if err := srv.InsertEvents(ctx, batch); err != nil {
+			t.Fatalf("insert events: %v", err)
+		}
+	}
+	var stored int
+	var firstAction string
+	if err := db.QueryRowContext(ctx, `SELECT count(*), min(action) FILTER (WHERE dedupe_key = 'k1') FROM events`).Scan(&stored, &firstAction); err != nil {
+		t.Fatal(err)
+	}
+	if stored != 4 || firstAction != "view" {
+		t.Fatalf("expected the first event of each key once and the unkeyed ones, got %d events and %q for k1", stored, firstAction)
+	}
+
+	if err := store.RefreshAggregates(ctx); err != nil {
+		t.Fatalf("refresh aggregates: %v", err)
+	}
+	var views, users int64
+	if err := db.QueryRowContext(ctx, `
+SELECT (SELECT sum(event_count) FROM action_event_counts WHERE action = 'view' AND period_start >= $1),
+	(SELECT count(DISTINCT user_id) FROM action_user_hours WHERE action = 'view' AND hour = $1)`, hour).Scan(&views, &users); err != nil {
+		t.Fatal(err)
+	}
+	if views != 4 || users != 2 {
+		t.Fatalf("expected 4 views by 2 users, got %d by %d", views, users)
+	}
+
+	// Deleting an event frees its dedupe key
+	if _, err := db.ExecContext(ctx, `DELETE FROM events WHERE dedupe_key = 'k2'`); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.InsertEvents(ctx, batch[3:]); err != nil {
+		t.Fatalf("insert events: %v", err)
+	}
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM events WHERE dedupe_key = 'k2'`).Scan(&stored); err != nil || stored != 1 {
+		t.Fatalf("expected the key to be used again, got %d: %v", stored, err)
+	}
+
+	jobs, err := store.AggregateJobs(ctx)
+	if err != nil {
+		t.Fatalf("aggregate jobs: %v", err)
+	}
+	if len(jobs) != 3 {
+		t.Fatalf("expected a job per continuous aggregate, got %+v", jobs)
+	}
+
+	checks := (&SchemaChecker{db: db}).DeepCheck(ctx)
+	for _, c := range checks {
+		if c.Status != "ok" {
+			t.Fatalf("expected the schema check to pass on the views, got %+v", c)
+		}
+	}
+}
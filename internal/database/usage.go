@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Counts is the usage of an API key over a period.
+type Counts struct {
+	Events  int64 `json:"events"`
+	Queries int64 `json:"queries"`
+}
+
+// Usage is the usage of an API key on a UTC day and in its month so far.
+type Usage struct {
+	Day   Counts
+	Month Counts
+}
+
+// UsageDelta is usage to add to an API key on a UTC day.
+type UsageDelta struct {
+	APIKeyID int64
+	Day      time.Time
+	Counts
+}
+
+// UsageStore keeps the daily usage of API keys in the api_key_usage table.
+type UsageStore struct {
+	db *sql.DB
+}
+
+// NewUsageStore uses the shared connection pool.
+func NewUsageStore() *UsageStore {
+	return &UsageStore{db: open().db}
+}
+
+// AddUsage adds the deltas to the stored usage in a single statement.
+func (s *UsageStore) AddUsage(ctx context.Context, deltas []UsageDelta) error {
+	if len(deltas) == 0 {
+		return nil
+	}
+	keys := make([]int64, len(deltas))
+	days := make([]time.Time, len(deltas))
+	events := make([]int64, len(deltas))
+	queries := make([]int64, len(deltas))
+	for i, d := range deltas {
+		keys[i], days[i], events[i], queries[i] = d.APIKeyID, d.Day, d.Events, d.Queries
+	}
+
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO api_key_usage (api_key_id, day, events, queries)
+SELECT * FROM unnest($1::bigint[], $2::date[], $3::bigint[], $4::bigint[])
+ON CONFLICT (api_key_id, day) DO UPDATE
+SET events = api_key_usage.events + EXCLUDED.events, queries = api_key_usage.queries + EXCLUDED.queries`,
+		keys, days, events, queries)
+	return err
+}
+
+// Usage returns the usage of the keys on day and in its month up to day.
+// Keys without usage are left out.
+func (s *UsageStore) Usage(ctx context.Context, keyIDs []int64, day time.Time) (map[int64]Usage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+SELECT api_key_id,
+	COALESCE(sum(events) FILTER (WHERE day = $2), 0),
+	COALESCE(sum(queries) FILTER (WHERE day = $2), 0),
+	sum(events),
+	sum(queries)
+FROM api_key_usage
+WHERE api_key_id = ANY($1) AND day >= date_trunc('month', $2::date) AND day <= $2::date
+GROUP BY api_key_id`, keyIDs, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := make(map[int64]Usage)
+	for rows.Next() {
+		var id int64
+		var u Usage
+		if err := rows.Scan(&id, &u.Day.Events, &u.Day.Queries, &u.Month.Events, &u.Month.Queries); err != nil {
+			return nil, err
+		}
+		usage[id] = u
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,283 @@
+// Package deadletter keeps batches of events that could not be inserted
+// once their retries were exhausted, so that they can be inspected and
+// retried or discarded by an operator instead of being dropped. Each batch
+// is a JSON file in the dead-letter directory.
+package deadletter
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const entryExt = ".json"
+
+// ErrNotFound is returned for an unknown entry ID.
+var ErrNotFound = errors.New("dead-letter entry not found")
+
+var (
+	entriesGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "deadletter_entries",
+		Help: "Batches waiting in the dead-letter store",
+	})
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "deadletter_events_total",
+			Help: "Events handled by the dead-letter store: added, retried (stored on retry) or discarded",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(entriesGauge, eventsTotal)
+}
+
+// Entry is a batch of events whose insert failed.
+type Entry struct {
+	ID       string    `json:"id"`
+	Source   string    `json:"source"`
+	FailedAt time.Time `json:"failed_at"`
+	Error    string    `json:"error"`
+	// Retries counts the failed retries requested by an operator.
+	Retries int     `json:"retries"`
+	Count   int     `json:"count"`
+	Events  []Event `json:"events,omitempty"`
+}
+
+// Event is a dead-lettered event with the time it was accepted, which it is
+// stored with on retry. Entries written before the time was kept have none
+// and are stored at the time of the retry.
+type Event struct {
+	ingest.Event
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+type Store struct {
+	l   *slog.Logger
+	db  database.Eventter
+	dir string
+
+	mu     sync.Mutex
+	lastID int64
+}
+
+// Open creates the dead-letter directory if needed.
+func Open(logger *slog.Logger, cfg config.DeadLetterConfig, db database.Eventter) (*Store, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create dead-letter directory: %w", err)
+	}
+	s := &Store{l: logger.With("component", "deadletter", "dir", cfg.Dir), db: db, dir: cfg.Dir}
+
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	entriesGauge.Set(float64(len(ids)))
+	if len(ids) > 0 {
+		s.l.Warn("dead-letter store has entries", "entries", len(ids))
+	}
+	return s, nil
+}
+
+// Add stores a failed batch.
+func (s *Store) Add(source string, events []ingest.Event, cause error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// IDs are increasing so that listing follows the failure order
+	id := max(time.Now().UnixNano(), s.lastID+1)
+	s.lastID = id
+	e := Entry{
+		ID:       strconv.FormatInt(id, 10),
+		Source:   source,
+		FailedAt: time.Now().UTC(),
+		Error:    cause.Error(),
+		Count:    len(events),
+		Events:   make([]Event, len(events)),
+	}
+	for i, ev := range events {
+		e.Events[i] = Event{Event: ev, AcceptedAt: ev.AcceptedAt}
+	}
+	if err := s.write(e); err != nil {
+		return err
+	}
+
+	eventsTotal.WithLabelValues("added").Add(float64(len(events)))
+	entriesGauge.Inc()
+	s.l.Warn("batch dead-lettered", "id", e.ID, "source", source, "events", len(events), "error", cause)
+	return nil
+}
+
+// List returns the entries, oldest first, without their events.
+func (s *Store) List() ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, err := s.ids()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := s.read(id)
+		if err != nil {
+			return nil, err
+		}
+		e.Events = nil
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Get returns an entry with its events.
+func (s *Store) Get(id string) (Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read(id)
+}
+
+// Retry inserts the events of an entry and removes it. When the insert
+// fails the entry is kept with the new error.
+func (s *Store) Retry(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	batch := make([]database.NewEvent, len(e.Events))
+	for i, ev := range e.Events {
+		batch[i] = database.NewEvent{ProjectID: ev.ProjectID, UserID: ev.UserID, Action: ev.Action, Metadata: ev.Metadata, CreatedAt: ev.AcceptedAt, TTL: ev.TTL(), SchemaVersion: ev.SchemaVersion}
+	}
+	if err := s.db.InsertEvents(ctx, batch); err != nil {
+		e.Retries++
+		e.Error = err.Error()
+		if werr := s.write(e); werr != nil {
+			s.l.Error("failed to update dead-letter entry", "id", id, "error", werr)
+		}
+		return err
+	}
+
+	if err := s.remove(id); err != nil {
+		return err
+	}
+	eventsTotal.WithLabelValues("retried").Add(float64(len(e.Events)))
+	s.l.Info("dead-letter entry retried", "id", id, "events", len(e.Events))
+	return nil
+}
+
+// Discard removes an entry without storing its events.
+func (s *Store) Discard(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	if err := s.remove(id); err != nil {
+		return err
+	}
+	eventsTotal.WithLabelValues("discarded").Add(float64(e.Count))
+	s.l.Warn("dead-letter entry discarded", "id", id, "events", e.Count)
+	return nil
+}
+
+// ids lists the entry IDs, oldest first. s.mu must be held.
+func (s *Store) ids() ([]string, error) {
+	files, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("read dead-letter directory: %w", err)
+	}
+	var ids []string
+	for _, f := range files {
+		if id, ok := strings.CutSuffix(f.Name(), entryExt); ok && validID(id) {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, func(a, b string) int {
+		x, _ := strconv.ParseInt(a, 10, 64)
+		y, _ := strconv.ParseInt(b, 10, 64)
+		return cmp.Compare(x, y)
+	})
+	return ids, nil
+}
+
+// validID keeps IDs from the admin API from escaping the directory.
+func validID(id string) bool {
+	_, err := strconv.ParseInt(id, 10, 64)
+	return err == nil
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+entryExt)
+}
+
+func (s *Store) read(id string) (Entry, error) {
+	if !validID(id) {
+		return Entry{}, ErrNotFound
+	}
+	b, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return Entry{}, ErrNotFound
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return Entry{}, fmt.Errorf("decode dead-letter entry %s: %w", id, err)
+	}
+	return e, nil
+}
+
+// write replaces the entry file atomically.
+func (s *Store) write(e Entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := s.path(e.ID) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("write dead-letter entry: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("write dead-letter entry: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("sync dead-letter entry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(e.ID))
+}
+
+func (s *Store) remove(id string) error {
+	if err := os.Remove(s.path(id)); err != nil {
+		return fmt.Errorf("remove dead-letter entry: %w", err)
+	}
+	entriesGauge.Dec()
+	return nil
+}
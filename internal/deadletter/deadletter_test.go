@@ -0,0 +1,91 @@
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+type fakeDB struct {
+	database.Eventter
+	err    error
+	stored []database.NewEvent
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.stored = append(f.stored, events...)
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := &fakeDB{err: errors.New("db down")}
+	s, err := Open(logger, config.DeadLetterConfig{Dir: t.TempDir(), MaxRetrySeconds: 1}, db)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	accepted := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := []ingest.Event{{UserID: 1, Action: "click", AcceptedAt: accepted}, {UserID: 2, Action: "view", AcceptedAt: accepted}}
+	if err := s.Add("http", events, errors.New("timeout")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	if err := s.Add("http", events[:1], errors.New("timeout")); err != nil {
+		t.Fatalf("add: %v", err)
+	}
+
+	entries, err := s.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(entries) != 2 || entries[0].Count != 2 || entries[1].Count != 1 || entries[0].Events != nil {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	first, second := entries[0].ID, entries[1].ID
+
+	// A failed retry keeps the entry with the new error
+	if err := s.Retry(context.Background(), first); err == nil {
+		t.Fatalf("expected retry to fail while the database is down")
+	}
+	e, err := s.Get(first)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if e.Retries != 1 || e.Error != "db down" || len(e.Events) != 2 {
+		t.Fatalf("unexpected entry after a failed retry %+v", e)
+	}
+
+	db.err = nil
+	if err := s.Retry(context.Background(), first); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if len(db.stored) != 2 {
+		t.Fatalf("expected 2 stored events got %d", len(db.stored))
+	}
+	// Retried events keep the time they were accepted
+	if !db.stored[0].CreatedAt.Equal(accepted) {
+		t.Fatalf("expected the accept time of the event, got %v", db.stored[0].CreatedAt)
+	}
+	if err := s.Discard(second); err != nil {
+		t.Fatalf("discard: %v", err)
+	}
+	if entries, _ := s.List(); len(entries) != 0 {
+		t.Fatalf("expected no entries left, got %+v", entries)
+	}
+
+	for _, id := range []string{first, "../etc/passwd", ""} {
+		if _, err := s.Get(id); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound for %q got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Package dedup stores an event only once when identical events (same
+// project, user, action and metadata) are sent within a window, e.g. by a
+// client retrying after a timeout.
+//
+// The database is the source of truth: it finds the identical events stored
+// by every instance. The events stored or found recently are also kept in an
+// in-memory LRU, so that a burst of duplicates does not cost a round trip
+// each.
+package dedup
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var duplicates = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ingest_duplicates_total",
+		Help: "Events not stored because an identical event was stored within the deduplication window, by where it was found",
+	},
+	[]string{"source"},
+)
+
+func init() {
+	prometheus.MustRegister(duplicates)
+}
+
+// Store inserts an event unless an identical one was stored within window.
+type Store interface {
+	InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error)
+}
+
+// Deduplicator inserts events through a Store, in front of an LRU of the
+// recent events.
+type Deduplicator struct {
+	store  Store
+	window time.Duration
+	size   int
+	now    func() time.Time
+
+	mu sync.Mutex
+	// recent holds *entry values, most recently used first
+	recent  *list.List
+	entries map[string]*list.Element
+}
+
+type entry struct {
+	fingerprint string
+	event       database.Event
+	expires     time.Time
+}
+
+// New returns a Deduplicator keeping up to size events in memory; a size of
+// 0 checks every event against the store.
+func New(store Store, window time.Duration, size int) *Deduplicator {
+	return &Deduplicator{
+		store:   store,
+		window:  window,
+		size:    size,
+		now:     time.Now,
+		recent:  list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Insert stores e, unless an identical event was stored within the window:
+// that event is returned instead, with duplicate set.
+func (d *Deduplicator) Insert(ctx context.Context, e database.NewEvent) (stored database.Event, duplicate bool, err error) {
+	fingerprint := e.Fingerprint()
+	if stored, ok := d.get(fingerprint); ok {
+		duplicates.WithLabelValues("memory").Inc()
+		return stored, true, nil
+	}
+
+	stored, duplicate, err = d.store.InsertEventOnce(ctx, e, d.window)
+	if err != nil {
+		return database.Event{}, false, err
+	}
+	if duplicate {
+		duplicates.WithLabelValues("database").Inc()
+	}
+	d.add(fingerprint, stored)
+	return stored, duplicate, nil
+}
+
+func (d *Deduplicator) get(fingerprint string) (database.Event, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	el, ok := d.entries[fingerprint]
+	if !ok {
+		return database.Event{}, false
+	}
+	en := el.Value.(*entry)
+	if !d.now().Before(en.expires) {
+		d.recent.Remove(el)
+		delete(d.entries, fingerprint)
+		return database.Event{}, false
+	}
+	d.recent.MoveToFront(el)
+	return en.event, true
+}
+
+// add remembers e until the end of its window, which starts when it was
+// stored.
+func (d *Deduplicator) add(fingerprint string, e database.Event) {
+	if d.size == 0 {
+		return
+	}
+	expires := e.CreatedAt.Add(d.window)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if el, ok := d.entries[fingerprint]; ok {
+		el.Value = &entry{fingerprint: fingerprint, event: e, expires: expires}
+		d.recent.MoveToFront(el)
+		return
+	}
+	d.entries[fingerprint] = d.recent.PushFront(&entry{fingerprint: fingerprint, event: e, expires: expires})
+	if d.recent.Len() > d.size {
+		oldest := d.recent.Back()
+		d.recent.Remove(oldest)
+		delete(d.entries, oldest.Value.(*entry).fingerprint)
+	}
+}
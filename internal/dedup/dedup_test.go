@@ -0,0 +1,58 @@
+package dedup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeStore stores every event it is given, as if no duplicate was found
+// in the database.
+type fakeStore struct {
+	now   time.Time
+	calls int
+}
+
+func (f *fakeStore) InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error) {
+	f.calls++
+	return database.Event{ID: int64(f.calls), UserID: e.UserID, Action: e.Action, CreatedAt: f.now}, false, nil
+}
+
+func TestDeduplicator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	store := &fakeStore{now: now}
+	d := New(store, time.Minute, 2)
+	d.now = func() time.Time { return now }
+
+	insert := func(action string) (database.Event, bool) {
+		t.Helper()
+		stored, duplicate, err := d.Insert(context.Background(), database.NewEvent{UserID: 1, Action: action})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored, duplicate
+	}
+
+	first, _ := insert("view")
+	if stored, duplicate := insert("view"); !duplicate || stored.ID != first.ID {
+		t.Fatalf("expected the event stored first, got %+v (duplicate %v)", stored, duplicate)
+	}
+	if store.calls != 1 {
+		t.Fatalf("expected the duplicate to be found in memory, the store was called %d times", store.calls)
+	}
+
+	// view is the most recently used, so click is evicted by purchase
+	insert("click")
+	insert("view")
+	insert("purchase")
+	if _, duplicate := insert("click"); duplicate {
+		t.Fatal("expected the least recently used event to be evicted")
+	}
+
+	now = now.Add(time.Minute)
+	if _, duplicate := insert("purchase"); duplicate {
+		t.Fatal("expected the event to expire with its window")
+	}
+}
@@ -0,0 +1,4 @@
+// Package e2e holds the end-to-end tests of the HTTP APIs against a real
+// Postgres started with testcontainers. Like the tests of internal/database
+// they need Docker; run them with make itest.
+package e2e
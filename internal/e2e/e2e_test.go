@@ -0,0 +1,152 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/server"
+	"github.com/arimatakao/simple-events-handler/pkg/client"
+)
+
+var (
+	apiURL   string
+	adminURL string
+)
+
+// TestMain starts Postgres with the schema of the docker compose setup and
+// serves the public and admin APIs in front of it.
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	container, err := postgres.Run(ctx,
+		"postgres:latest",
+		postgres.WithDatabase("events"),
+		postgres.WithUsername("user"),
+		postgres.WithPassword("password"),
+		postgres.WithInitScripts(filepath.Join("..", "..", "other", "init_tables.sql")),
+		testcontainers.WithWaitStrategy(
+			wait.ForLog("database system is ready to accept connections").
+				WithOccurrence(2).
+				WithStartupTimeout(30*time.Second)),
+	)
+	if err != nil {
+		log.Fatalf("could not start postgres container: %v", err)
+	}
+	host, err := container.Host(ctx)
+	if err != nil {
+		log.Fatalf("could not get postgres host: %v", err)
+	}
+	port, err := container.MappedPort(ctx, "5432/tcp")
+	if err != nil {
+		log.Fatalf("could not get postgres port: %v", err)
+	}
+
+	cfg := config.Default()
+	cfg.Server.BasePath = "/api"
+	cfg.DB.Host, cfg.DB.Port = host, port.Int()
+	cfg.DB.Database, cfg.DB.Username, cfg.DB.Password, cfg.DB.Schema = "events", "user", "password", "public"
+	database.Configure(cfg.DB)
+	db := database.New()
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	api := httptest.NewServer(server.NewServer(logger, cfg, server.Options{DB: db}).Handler)
+	admin := httptest.NewServer(server.NewAdminServer(logger, cfg, server.AdminOptions{
+		DB:         db,
+		EventStore: database.NewEventStore(),
+	}).Handler)
+	apiURL, adminURL = api.URL+"/api", admin.URL
+
+	code := m.Run()
+
+	api.Close()
+	admin.Close()
+	_ = db.Close()
+	if err := container.Terminate(ctx); err != nil {
+		log.Fatalf("could not teardown postgres container: %v", err)
+	}
+	if code != 0 {
+		log.Fatalf("tests failed with code %d", code)
+	}
+}
+
+func TestIngestAndQuery(t *testing.T) {
+	ctx := context.Background()
+	c := client.New(apiURL)
+	const user = 2001
+
+	if err := c.AddEvent(ctx, client.NewEvent{UserID: user, Action: "view", Metadata: map[string]string{"page": "/pricing"}}); err != nil {
+		t.Fatalf("add event: %v", err)
+	}
+	events, err := c.GetEvents(ctx, client.UserID(user))
+	if err != nil {
+		t.Fatalf("get events: %v", err)
+	}
+	if len(events) != 1 || events[0].Action != "view" || events[0].MetadataPage == nil || *events[0].MetadataPage != "/pricing" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	err = c.AddEvent(ctx, client.NewEvent{UserID: 0, Action: "view"})
+	if !client.IsCode(err, "validation_failed") {
+		t.Fatalf("expected a validation problem, got %v", err)
+	}
+}
+
+func TestBatchDedupeAndMaintenance(t *testing.T) {
+	ctx := context.Background()
+	c := client.New(apiURL)
+	const user = 2002
+	batch := []client.NewEvent{
+		{UserID: user, Action: "purchase", IdempotencyKey: "order-1"},
+		{UserID: user, Action: "purchase", IdempotencyKey: "order-2", CreatedAt: time.Now().Add(-time.Hour)},
+	}
+
+	// Sending the batch twice stores it once
+	for range 2 {
+		if err := c.AddEventsBatch(ctx, batch); err != nil {
+			t.Fatalf("add batch: %v", err)
+		}
+	}
+	if n := adminCall(t, http.MethodGet, "/events/count?user_id="+strconv.Itoa(user), "count"); n != 2 {
+		t.Fatalf("expected 2 events, got %d", n)
+	}
+	if n := adminCall(t, http.MethodDelete, "/events?user_id="+strconv.Itoa(user), "deleted"); n != 2 {
+		t.Fatalf("expected 2 events deleted, got %d", n)
+	}
+	if events, err := c.GetEvents(ctx, client.UserID(user)); err != nil || len(events) != 0 {
+		t.Fatalf("expected no events left, got %+v, %v", events, err)
+	}
+}
+
+// adminCall sends a request to the admin API and returns the number in the
+// field of its JSON response.
+func adminCall(t *testing.T, method, path, field string) int64 {
+	t.Helper()
+	req, err := http.NewRequest(method, adminURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	var body map[string]int64
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&body) != nil {
+		t.Fatalf("%s %s: unexpected status %d", method, path, resp.StatusCode)
+	}
+	return body[field]
+}
@@ -0,0 +1,601 @@
+// Package eventsctl implements the operator CLI of cmd/eventsctl. Every
+// command goes through the HTTP APIs: events are read from the public API
+// with pkg/client, and maintenance commands call the admin listener with
+// the admin token.
+package eventsctl
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/pkg/client"
+)
+
+const usage = `Usage: eventsctl [global flags] COMMAND [flags]
+
+Commands:
+  query          print events as JSON lines (public API)
+  count          count events by filter
+  delete         delete events by filter, after confirmation
+  aggregate      run the aggregation now
+  subscriptions  list | get ID | create | delete ID | deliveries ID
+  projects       list | create NAME
+  apikeys        list PROJECT | create PROJECT [-name NAME] | revoke ID
+  audit          list admin operations, newest first
+  snapshot       write the events of a window with their aggregates to a file
+  restore        restore a snapshot FILE, - for stdin
+
+Global flags:
+`
+
+// cli holds the global settings and streams of a run.
+type cli struct {
+	api    string
+	admin  string
+	token  string
+	apiKey string
+	actor  string
+	http   *http.Client
+	// stream sends the snapshots, which take longer than -timeout
+	stream  *http.Client
+	stdin   *bufio.Reader
+	stdout  io.Writer
+	stderr  io.Writer
+	timeout time.Duration
+}
+
+// Run executes the command line args (without the program name) and
+// returns the exit status.
+func Run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	c := &cli{stdin: bufio.NewReader(stdin), stdout: stdout, stderr: stderr}
+	fs := flag.NewFlagSet("eventsctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.StringVar(&c.api, "api", envOr("EVENTSCTL_API_URL", "http://localhost:8080/api"), "public API base URL, including the base path (EVENTSCTL_API_URL)")
+	fs.StringVar(&c.admin, "admin", envOr("EVENTSCTL_ADMIN_URL", "http://localhost:8090"), "admin listener URL (EVENTSCTL_ADMIN_URL)")
+	fs.StringVar(&c.token, "token", os.Getenv("ADMIN_TOKEN"), "admin token (ADMIN_TOKEN)")
+	fs.StringVar(&c.apiKey, "api-key", os.Getenv("EVENTSCTL_API_KEY"), "project API key used by query (EVENTSCTL_API_KEY)")
+	fs.StringVar(&c.actor, "actor", envOr("EVENTSCTL_ACTOR", os.Getenv("USER")), "operator name recorded in the audit log of admin operations (EVENTSCTL_ACTOR, default $USER)")
+	fs.DurationVar(&c.timeout, "timeout", 30*time.Second, "deadline of a single request, but for snapshot and restore")
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	c.http = &http.Client{Timeout: c.timeout}
+	c.stream = &http.Client{}
+
+	commands := map[string]func(context.Context, []string) error{
+		"query":         c.query,
+		"count":         c.count,
+		"delete":        c.delete,
+		"aggregate":     c.aggregate,
+		"subscriptions": c.subscriptions,
+		"projects":      c.projects,
+		"apikeys":       c.apiKeys,
+		"audit":         c.audit,
+		"snapshot":      c.snapshot,
+		"restore":       c.restore,
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n", fs.Arg(0))
+		fs.Usage()
+		return 2
+	}
+	err := cmd(ctx, fs.Args()[1:])
+	switch {
+	case errors.Is(err, flag.ErrHelp), errors.Is(err, errUsage):
+		return 2
+	case err != nil:
+		fmt.Fprintf(stderr, "eventsctl: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// errUsage is returned by commands after printing their usage.
+var errUsage = errors.New("usage")
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (c *cli) flags(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	return fs
+}
+
+// filterFlags registers the event filter flags shared by several commands.
+type filterFlags struct {
+	projectID int64
+	userID    int64
+	action    string
+	from      string
+	to        string
+}
+
+// register adds the filter flags to fs. The admin commands filter on the
+// action and project as well; query is scoped by its API key instead.
+func (f *filterFlags) register(fs *flag.FlagSet, admin bool) {
+	fs.Int64Var(&f.userID, "user", 0, "only the events of this user id")
+	if admin {
+		fs.StringVar(&f.action, "action", "", "only the events with this action")
+		fs.Int64Var(&f.projectID, "project", 0, "only the events of this project id")
+	}
+	fs.StringVar(&f.from, "from", "", "only the events created at or after this RFC 3339 time")
+	fs.StringVar(&f.to, "to", "", "only the events created before this RFC 3339 time")
+}
+
+func (f *filterFlags) values() url.Values {
+	v := url.Values{}
+	if f.projectID != 0 {
+		v.Set("project_id", strconv.FormatInt(f.projectID, 10))
+	}
+	if f.userID != 0 {
+		v.Set("user_id", strconv.FormatInt(f.userID, 10))
+	}
+	if f.action != "" {
+		v.Set("action", f.action)
+	}
+	if f.from != "" {
+		v.Set("from", f.from)
+	}
+	if f.to != "" {
+		v.Set("to", f.to)
+	}
+	return v
+}
+
+func (c *cli) query(ctx context.Context, args []string) error {
+	fs := c.flags("query")
+	var f filterFlags
+	f.register(fs, false)
+	window := fs.Duration("page-window", 24*time.Hour, "time span fetched per request when -from is set")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	api := client.New(c.api, client.WithHTTPClient(c.http), client.WithAPIKey(c.apiKey), client.WithPageWindow(*window))
+	var opts []client.QueryOption
+	if f.userID != 0 {
+		opts = append(opts, client.UserID(f.userID))
+	}
+	for _, p := range []struct {
+		value string
+		opt   func(time.Time) client.QueryOption
+	}{{f.from, client.From}, {f.to, client.To}} {
+		if p.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, p.value)
+		if err != nil {
+			return fmt.Errorf("invalid time %q: %v", p.value, err)
+		}
+		opts = append(opts, p.opt(t))
+	}
+
+	enc := json.NewEncoder(c.stdout)
+	// Without a start there is no range to page through
+	if f.from == "" {
+		events, err := api.GetEvents(ctx, opts...)
+		if err != nil {
+			return err
+		}
+		for _, e := range events {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for e, err := range api.Events(ctx, opts...) {
+		if err != nil {
+			return err
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) count(ctx context.Context, args []string) error {
+	fs := c.flags("count")
+	var f filterFlags
+	f.register(fs, true)
+	exact := fs.Bool("exact", false, "count the events rather than the aggregates of the complete periods")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := f.values()
+	if *exact {
+		filter.Set("exact", "true")
+	}
+	n, err := c.countEvents(ctx, filter)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, n)
+	return nil
+}
+
+func (c *cli) countEvents(ctx context.Context, filter url.Values) (int64, error) {
+	var out struct {
+		Count int64 `json:"count"`
+	}
+	err := c.call(ctx, http.MethodGet, "/events/count?"+filter.Encode(), nil, &out)
+	return out.Count, err
+}
+
+func (c *cli) delete(ctx context.Context, args []string) error {
+	fs := c.flags("delete")
+	var f filterFlags
+	f.register(fs, true)
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	filter := f.values()
+	if len(filter) == 0 {
+		fmt.Fprintln(c.stderr, "delete requires at least one of -project, -user, -action, -from and -to")
+		return errUsage
+	}
+
+	if !*yes {
+		n, err := c.countEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stderr, "Delete %d events matching %s? [y/N] ", n, filter.Encode())
+		answer, _ := c.stdin.ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return errors.New("aborted")
+		}
+	}
+
+	var out struct {
+		Deleted int64 `json:"deleted"`
+	}
+	if err := c.call(ctx, http.MethodDelete, "/events?"+filter.Encode(), nil, &out); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "%d events deleted\n", out.Deleted)
+	return nil
+}
+
+func (c *cli) aggregate(ctx context.Context, args []string) error {
+	if err := c.flags("aggregate").Parse(args); err != nil {
+		return err
+	}
+	if err := c.call(ctx, http.MethodPost, "/aggregate", nil, nil); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, "aggregation started")
+	return nil
+}
+
+func (c *cli) subscriptions(ctx context.Context, args []string) error {
+	const subUsage = "usage: eventsctl subscriptions list | get ID | create -url URL [flags] | delete ID | deliveries ID [-limit N]"
+	if len(args) == 0 {
+		fmt.Fprintln(c.stderr, subUsage)
+		return errUsage
+	}
+	withID := func() (string, error) {
+		if len(args) < 2 {
+			fmt.Fprintln(c.stderr, subUsage)
+			return "", errUsage
+		}
+		if _, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+			return "", fmt.Errorf("invalid subscription id %q", args[1])
+		}
+		return args[1], nil
+	}
+
+	var out json.RawMessage
+	switch args[0] {
+	case "list":
+		if err := c.call(ctx, http.MethodGet, "/subscriptions", nil, &out); err != nil {
+			return err
+		}
+	case "get":
+		id, err := withID()
+		if err != nil {
+			return err
+		}
+		if err := c.call(ctx, http.MethodGet, "/subscriptions/"+id, nil, &out); err != nil {
+			return err
+		}
+	case "create":
+		fs := c.flags("subscriptions create")
+		target := fs.String("url", "", "URL receiving the deliveries (required)")
+		secret := fs.String("secret", "", "secret signing the deliveries; generated when empty")
+		actions := fs.String("actions", "", "comma separated actions to deliver; every action when empty")
+		users := fs.String("users", "", "comma separated user ids to deliver; every user when empty")
+		inactive := fs.Bool("inactive", false, "create the subscription paused")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *target == "" {
+			fmt.Fprintln(c.stderr, "subscriptions create requires -url")
+			return errUsage
+		}
+		body := map[string]any{"url": *target, "secret": *secret, "active": !*inactive}
+		if *actions != "" {
+			body["actions"] = strings.Split(*actions, ",")
+		}
+		if *users != "" {
+			var ids []int64
+			for _, v := range strings.Split(*users, ",") {
+				id, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid user id %q", v)
+				}
+				ids = append(ids, id)
+			}
+			body["user_ids"] = ids
+		}
+		if err := c.call(ctx, http.MethodPost, "/subscriptions", body, &out); err != nil {
+			return err
+		}
+	case "delete":
+		id, err := withID()
+		if err != nil {
+			return err
+		}
+		if err := c.call(ctx, http.MethodDelete, "/subscriptions/"+id, nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "subscription %s deleted\n", id)
+		return nil
+	case "deliveries":
+		id, err := withID()
+		if err != nil {
+			return err
+		}
+		fs := c.flags("subscriptions deliveries")
+		limit := fs.Int("limit", 100, "number of recent deliveries")
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		if err := c.call(ctx, http.MethodGet, "/subscriptions/"+id+"/deliveries?limit="+strconv.Itoa(*limit), nil, &out); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintln(c.stderr, subUsage)
+		return errUsage
+	}
+	return c.print(out)
+}
+
+func (c *cli) projects(ctx context.Context, args []string) error {
+	const projectsUsage = "usage: eventsctl projects list | create NAME"
+	var out json.RawMessage
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		if err := c.call(ctx, http.MethodGet, "/projects", nil, &out); err != nil {
+			return err
+		}
+	case len(args) == 2 && args[0] == "create":
+		if err := c.call(ctx, http.MethodPost, "/projects", map[string]string{"name": args[1]}, &out); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintln(c.stderr, projectsUsage)
+		return errUsage
+	}
+	return c.print(out)
+}
+
+// apiKeys manages the API keys of projects. The key itself is only printed
+// by create.
+func (c *cli) apiKeys(ctx context.Context, args []string) error {
+	const keysUsage = "usage: eventsctl apikeys list PROJECT | create PROJECT [-name NAME] | revoke ID"
+	if len(args) < 2 {
+		fmt.Fprintln(c.stderr, keysUsage)
+		return errUsage
+	}
+	if _, err := strconv.ParseInt(args[1], 10, 64); err != nil {
+		return fmt.Errorf("invalid id %q", args[1])
+	}
+
+	var out json.RawMessage
+	switch args[0] {
+	case "list":
+		if err := c.call(ctx, http.MethodGet, "/projects/"+args[1]+"/keys", nil, &out); err != nil {
+			return err
+		}
+	case "create":
+		fs := c.flags("apikeys create")
+		name := fs.String("name", "", "label of the key, e.g. the service using it")
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		if err := c.call(ctx, http.MethodPost, "/projects/"+args[1]+"/keys", map[string]string{"name": *name}, &out); err != nil {
+			return err
+		}
+	case "revoke":
+		if err := c.call(ctx, http.MethodDelete, "/keys/"+args[1], nil, nil); err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "API key %s revoked\n", args[1])
+		return nil
+	default:
+		fmt.Fprintln(c.stderr, keysUsage)
+		return errUsage
+	}
+	return c.print(out)
+}
+
+// audit prints the audit log of the admin listener.
+func (c *cli) audit(ctx context.Context, args []string) error {
+	fs := c.flags("audit")
+	by := fs.String("by", "", "only the operations of this actor")
+	action := fs.String("action", "", `only this operation, e.g. "DELETE /events"`)
+	limit := fs.Int("limit", 0, "maximum number of entries (server default 100)")
+	before := fs.Int64("before", 0, "only the entries older than this id, to page through the log")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	v := url.Values{}
+	if *by != "" {
+		v.Set("actor", *by)
+	}
+	if *action != "" {
+		v.Set("action", *action)
+	}
+	if *limit != 0 {
+		v.Set("limit", strconv.Itoa(*limit))
+	}
+	if *before != 0 {
+		v.Set("before", strconv.FormatInt(*before, 10))
+	}
+	path := "/audit"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+
+	var out json.RawMessage
+	if err := c.call(ctx, http.MethodGet, path, nil, &out); err != nil {
+		return err
+	}
+	return c.print(out)
+}
+
+// snapshot writes a snapshot of a window of events to a file, or to
+// stdout without -o. It fails when the snapshot ends before its trailer.
+func (c *cli) snapshot(ctx context.Context, args []string) error {
+	fs := c.flags("snapshot")
+	from := fs.String("from", "", "only the events created at or after this RFC 3339 time")
+	to := fs.String("to", "", "only the events created before this RFC 3339 time, default now")
+	output := fs.String("o", "", "file written, stdout when empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	v := url.Values{}
+	if *from != "" {
+		v.Set("from", *from)
+	}
+	if *to != "" {
+		v.Set("to", *to)
+	}
+	path := "/snapshot"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+
+	resp, err := c.send(ctx, c.stream, http.MethodGet, path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out := c.stdout
+	var file *os.File
+	if *output != "" {
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	w := bufio.NewWriter(out)
+	// The last record is the trailer of a complete snapshot
+	var last []byte
+	r := bufio.NewReader(resp.Body)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+			last = line
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read snapshot: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if file != nil {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+	var trailer struct {
+		Kind    string `json:"kind"`
+		Trailer *struct {
+			Events, Tags, Aggregates int64
+		} `json:"trailer"`
+	}
+	if json.Unmarshal(last, &trailer) != nil || trailer.Kind != "trailer" || trailer.Trailer == nil {
+		return errors.New("the snapshot ended before its trailer, it is incomplete")
+	}
+	if *output != "" {
+		t := trailer.Trailer
+		fmt.Fprintf(c.stderr, "snapshot of %d events, %d tags and %d aggregate rows written to %s\n", t.Events, t.Tags, t.Aggregates, *output)
+	}
+	return nil
+}
+
+// restore sends a snapshot file, or stdin for -, to be restored in a
+// single transaction.
+func (c *cli) restore(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		fmt.Fprintln(c.stderr, "usage: eventsctl restore FILE|-")
+		return errUsage
+	}
+	var body io.Reader = c.stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		body = f
+	}
+
+	resp, err := c.send(ctx, c.stream, http.MethodPost, "/snapshot/restore", body, "application/x-ndjson")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return c.print(out)
+}
+
+// print writes a JSON response indented.
+func (c *cli) print(raw json.RawMessage) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(raw)
+}
@@ -0,0 +1,166 @@
+package eventsctl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeAdmin answers the admin routes used by the CLI and records the
+// requests it received.
+type fakeAdmin struct {
+	requests []string
+	body     map[string]any
+	actor    string
+}
+
+func (f *fakeAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.requests = append(f.requests, r.Method+" "+r.URL.RequestURI())
+	f.actor = r.Header.Get("X-Actor")
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"status":401,"code":"unauthorized","detail":"missing or invalid admin token"}`))
+		return
+	}
+	switch r.Method + " " + r.URL.Path {
+	case "GET /events/count":
+		_, _ = w.Write([]byte(`{"count":12}`))
+	case "DELETE /events":
+		_, _ = w.Write([]byte(`{"deleted":12}`))
+	case "POST /aggregate":
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status":"started"}`))
+	case "POST /subscriptions":
+		_ = json.NewDecoder(r.Body).Decode(&f.body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":3,"url":"https://example.com/hook"}`))
+	case "GET /audit":
+		_, _ = w.Write([]byte(`{"entries":[{"id":9,"actor":"alice","action":"DELETE /keys/:id","status":204}]}`))
+	case "GET /snapshot":
+		_, _ = w.Write([]byte(`{"kind":"header","header":{"version":1}}` + "\n" + `{"kind":"event","event":{"id":7}}` + "\n"))
+		// A snapshot of a range is cut before its trailer
+		if r.URL.Query().Get("from") == "" {
+			_, _ = w.Write([]byte(`{"kind":"trailer","trailer":{"events":1}}` + "\n"))
+		}
+	case "POST /snapshot/restore":
+		body, _ := io.ReadAll(r.Body)
+		f.body = map[string]any{"lines": float64(bytes.Count(body, []byte("\n"))), "type": r.Header.Get("Content-Type")}
+		_, _ = w.Write([]byte(`{"projects":0,"events":1,"tags":0,"aggregates":0,"skipped":0}`))
+	case "DELETE /subscriptions/3", "DELETE /keys/5":
+		w.WriteHeader(http.StatusNoContent)
+	case "POST /projects":
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":2,"name":"shop"}`))
+	case "POST /projects/2/keys":
+		_ = json.NewDecoder(r.Body).Decode(&f.body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"id":5,"project_id":2,"key":"seh_secret"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name           string
+		args           []string
+		stdin          string
+		expectStatus   int
+		expectOut      string
+		expectErr      string
+		expectRequests []string
+	}{
+		{name: "count", args: []string{"count", "-user", "42", "-action", "click"}, expectOut: "12\n", expectRequests: []string{"GET /events/count?action=click&user_id=42"}},
+		{name: "count exactly", args: []string{"count", "-exact", "-action", "click"}, expectOut: "12\n", expectRequests: []string{"GET /events/count?action=click&exact=true"}},
+		{
+			name:           "delete confirmed",
+			args:           []string{"delete", "-user", "42"},
+			stdin:          "y\n",
+			expectOut:      "12 events deleted",
+			expectErr:      "Delete 12 events matching user_id=42?",
+			expectRequests: []string{"GET /events/count?user_id=42", "DELETE /events?user_id=42"},
+		},
+		{name: "delete declined", args: []string{"delete", "-user", "42"}, stdin: "n\n", expectStatus: 1, expectErr: "aborted", expectRequests: []string{"GET /events/count?user_id=42"}},
+		{name: "delete without confirmation", args: []string{"delete", "-yes", "-from", "2025-01-01T00:00:00Z"}, expectOut: "12 events deleted", expectRequests: []string{"DELETE /events?from=2025-01-01T00%3A00%3A00Z"}},
+		{name: "delete a project", args: []string{"delete", "-yes", "-project", "2"}, expectOut: "12 events deleted", expectRequests: []string{"DELETE /events?project_id=2"}},
+		{name: "delete without filter", args: []string{"delete", "-yes"}, expectStatus: 2, expectErr: "requires at least one"},
+		{name: "aggregate", args: []string{"aggregate"}, expectOut: "aggregation started", expectRequests: []string{"POST /aggregate"}},
+		{name: "create subscription", args: []string{"subscriptions", "create", "-url", "https://example.com/hook", "-actions", "click,view", "-users", "1,2"}, expectOut: `"id": 3`, expectRequests: []string{"POST /subscriptions"}},
+		{name: "delete subscription", args: []string{"subscriptions", "delete", "3"}, expectOut: "subscription 3 deleted", expectRequests: []string{"DELETE /subscriptions/3"}},
+		{name: "create project", args: []string{"projects", "create", "shop"}, expectOut: `"name": "shop"`, expectRequests: []string{"POST /projects"}},
+		{name: "create API key", args: []string{"apikeys", "create", "2", "-name", "backend"}, expectOut: `"key": "seh_secret"`, expectRequests: []string{"POST /projects/2/keys"}},
+		{name: "revoke API key", args: []string{"apikeys", "revoke", "5"}, expectOut: "API key 5 revoked", expectRequests: []string{"DELETE /keys/5"}},
+		{name: "audit", args: []string{"-actor", "alice", "audit", "-by", "alice", "-limit", "10"}, expectOut: `"actor": "alice"`, expectRequests: []string{"GET /audit?actor=alice&limit=10"}},
+		{name: "snapshot", args: []string{"snapshot"}, expectOut: `{"kind":"trailer","trailer":{"events":1}}`, expectRequests: []string{"GET /snapshot"}},
+		{name: "truncated snapshot", args: []string{"snapshot", "-from", "2025-01-01T00:00:00Z"}, expectStatus: 1, expectErr: "incomplete", expectRequests: []string{"GET /snapshot?from=2025-01-01T00%3A00%3A00Z"}},
+		{name: "restore", args: []string{"restore", "-"}, stdin: "{\"kind\":\"header\"}\n{\"kind\":\"trailer\"}\n", expectOut: `"events": 1`, expectRequests: []string{"POST /snapshot/restore"}},
+		{name: "restore without file", args: []string{"restore"}, expectStatus: 2, expectErr: "usage: eventsctl restore"},
+		{name: "API keys without project", args: []string{"apikeys", "list"}, expectStatus: 2, expectErr: "usage: eventsctl apikeys"},
+		{name: "bad subscription id", args: []string{"subscriptions", "get", "x"}, expectStatus: 1, expectErr: "invalid subscription id"},
+		{name: "wrong token", args: []string{"-token", "wrong", "aggregate"}, expectStatus: 1, expectErr: "401 unauthorized", expectRequests: []string{"POST /aggregate"}},
+		{name: "unknown command", args: []string{"frobnicate"}, expectStatus: 2, expectErr: "unknown command"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := &fakeAdmin{}
+			srv := httptest.NewServer(admin)
+			defer srv.Close()
+
+			var stdout, stderr bytes.Buffer
+			args := append([]string{"-admin", srv.URL, "-token", "secret"}, tt.args...)
+			status := Run(context.Background(), args, strings.NewReader(tt.stdin), &stdout, &stderr)
+
+			if status != tt.expectStatus {
+				t.Fatalf("expected status %d got %d, stderr: %s", tt.expectStatus, status, stderr.String())
+			}
+			if !strings.Contains(stdout.String(), tt.expectOut) || !strings.Contains(stderr.String(), tt.expectErr) {
+				t.Fatalf("unexpected output %q, stderr %q", stdout.String(), stderr.String())
+			}
+			if strings.Join(admin.requests, ", ") != strings.Join(tt.expectRequests, ", ") {
+				t.Fatalf("expected requests %v got %v", tt.expectRequests, admin.requests)
+			}
+			if tt.name == "audit" && admin.actor != "alice" {
+				t.Fatalf("expected the actor to be sent, got %q", admin.actor)
+			}
+			if tt.name == "restore" && (admin.body["lines"] != 2.0 || admin.body["type"] != "application/x-ndjson") {
+				t.Fatalf("unexpected restore body %v", admin.body)
+			}
+			if tt.name == "create API key" && admin.body["name"] != "backend" {
+				t.Fatalf("unexpected API key body %v", admin.body)
+			}
+			if tt.name == "create subscription" {
+				if admin.body["active"] != true || len(admin.body["actions"].([]any)) != 2 || len(admin.body["user_ids"].([]any)) != 2 {
+					t.Fatalf("unexpected subscription body %v", admin.body)
+				}
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/events" || r.URL.Query().Get("user_id") != "7" || r.Header.Get("X-API-Key") != "seh_key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`[{"id":2,"user_id":7,"action":"view","created_at":"2025-01-01T10:00:00Z"},{"id":1,"user_id":7,"action":"click","created_at":"2025-01-01T09:00:00Z"}]`))
+	}))
+	defer api.Close()
+
+	var stdout, stderr bytes.Buffer
+	status := Run(context.Background(), []string{"-api", api.URL + "/api", "-api-key", "seh_key", "query", "-user", "7"}, strings.NewReader(""), &stdout, &stderr)
+	if status != 0 {
+		t.Fatalf("unexpected status %d: %s", status, stderr.String())
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"id":2`) {
+		t.Fatalf("expected 2 JSON lines, got %q", stdout.String())
+	}
+}
@@ -0,0 +1,120 @@
+// Package expiry deletes the events sent with a ttl_seconds once they
+// expire. GET /events leaves them out from their expiry on, so the janitor
+// only reclaims their space.
+package expiry
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+var expiredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "events_expired_total",
+	Help: "Events deleted once past their ttl_seconds",
+})
+
+func init() {
+	prometheus.MustRegister(expiredTotal)
+}
+
+// Store deletes the expired events, a batch at a time.
+type Store interface {
+	DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error)
+}
+
+// Janitor deletes the expired events at every interval.
+type Janitor struct {
+	l         *slog.Logger
+	stores    []Store
+	batchSize int
+	interval  int
+	now       func() time.Time
+	cron      *cron.Cron
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// New creates a janitor of the events of every store, one per shard when
+// the events are sharded.
+func New(logger *slog.Logger, cfg config.TTLConfig, stores ...Store) (*Janitor, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &Janitor{
+		l:         logger,
+		stores:    stores,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.IntervalSeconds,
+		now:       time.Now,
+		cron:      cron.New(cron.WithSeconds()),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	// The cron scheduler skips a tick while the previous run still deletes
+	spec := "@every " + strconv.Itoa(cfg.IntervalSeconds) + "s"
+	if _, err := j.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(j.run))); err != nil {
+		cancel()
+		return nil, err
+	}
+	return j, nil
+}
+
+func (j *Janitor) run() {
+	n, err := j.DeleteExpired(j.ctx)
+	if err != nil && j.ctx.Err() == nil {
+		j.l.Error("expired events deletion failed", "deleted", n, "error", err)
+		return
+	}
+	if n > 0 {
+		j.l.Info("expired events deleted", "deleted", n)
+	}
+}
+
+// Start schedules the deletion.
+func (j *Janitor) Start() {
+	j.cron.Start()
+	j.l.Info("expired events deletion started", "interval_seconds", j.interval)
+}
+
+// Stop cancels the running deletion, whose current batch is rolled back,
+// and waits for it, or for ctx to be done.
+func (j *Janitor) Stop(ctx context.Context) error {
+	stopped := j.cron.Stop()
+	j.cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DeleteExpired deletes every event expired by now from each store, in
+// batches, and returns how many were deleted. A failing store does not
+// hold back the others.
+func (j *Janitor) DeleteExpired(ctx context.Context) (int64, error) {
+	now := j.now()
+	var total int64
+	var errs []error
+	for _, store := range j.stores {
+		for {
+			n, err := store.DeleteExpired(ctx, now, j.batchSize)
+			total += n
+			expiredTotal.Add(float64(n))
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			if n < int64(j.batchSize) {
+				break
+			}
+		}
+	}
+	return total, errors.Join(errs...)
+}
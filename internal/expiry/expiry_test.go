@@ -0,0 +1,93 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// fakeStore holds events expiring at the given times and fails once failAt
+// batches were deleted, when set.
+type fakeStore struct {
+	expiries []time.Time
+	batches  int
+	failAt   int
+}
+
+func (f *fakeStore) DeleteExpired(ctx context.Context, now time.Time, limit int) (int64, error) {
+	if f.failAt > 0 && f.batches == f.failAt {
+		return 0, errors.New("connection refused")
+	}
+	f.batches++
+	var kept []time.Time
+	var deleted int64
+	for _, t := range f.expiries {
+		if !t.After(now) && deleted < int64(limit) {
+			deleted++
+			continue
+		}
+		kept = append(kept, t)
+	}
+	f.expiries = kept
+	return deleted, nil
+}
+
+func TestDeleteExpired(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Minute)
+	live := now.Add(time.Minute)
+
+	tests := []struct {
+		name          string
+		stores        []*fakeStore
+		expectDeleted int64
+		expectBatches []int
+		expectKept    []int
+		expectErr     bool
+	}{
+		{name: "nothing expired", stores: []*fakeStore{{expiries: []time.Time{live}}}, expectBatches: []int{1}, expectKept: []int{1}},
+		{name: "expiring now", stores: []*fakeStore{{expiries: []time.Time{now, live}}}, expectDeleted: 1, expectBatches: []int{1}, expectKept: []int{1}},
+		{name: "every batch until a partial one", stores: []*fakeStore{{expiries: []time.Time{expired, expired, expired, expired, live}}}, expectDeleted: 4, expectBatches: []int{3}, expectKept: []int{1}},
+		{name: "every store", stores: []*fakeStore{{expiries: []time.Time{expired}}, {expiries: []time.Time{expired, live}}}, expectDeleted: 2, expectBatches: []int{1, 1}, expectKept: []int{0, 1}},
+		{
+			name:          "failed store does not stop the others",
+			stores:        []*fakeStore{{expiries: []time.Time{expired, expired, expired}, failAt: 1}, {expiries: []time.Time{expired}}},
+			expectDeleted: 3,
+			expectBatches: []int{1, 1},
+			expectKept:    []int{1, 0},
+			expectErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores := make([]Store, len(tt.stores))
+			for i, s := range tt.stores {
+				stores[i] = s
+			}
+			j, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.TTLConfig{IntervalSeconds: 60, BatchSize: 2}, stores...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j.now = func() time.Time { return now }
+
+			deleted, err := j.DeleteExpired(context.Background())
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if deleted != tt.expectDeleted {
+				t.Fatalf("expected %d deleted, got %d", tt.expectDeleted, deleted)
+			}
+			for i, store := range tt.stores {
+				if store.batches != tt.expectBatches[i] || len(store.expiries) != tt.expectKept[i] {
+					t.Fatalf("store %d: expected %d batches and %d kept, got %d and %d", i, tt.expectBatches[i], tt.expectKept[i], store.batches, len(store.expiries))
+				}
+			}
+		})
+	}
+}
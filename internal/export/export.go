@@ -0,0 +1,456 @@
+// Package export writes the events of fixed time windows to S3-compatible
+// storage as Parquet or gzipped CSV files, for loading into a data
+// warehouse. Every window gets its own directory with the data files and a
+// manifest.json written last: a window is complete once its manifest
+// exists, and exporting it again replaces its files.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var (
+	windowsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "export_windows_total",
+			Help: "Export windows by result: exported, skipped (already exported) or failed",
+		},
+		[]string{"result"},
+	)
+	rowsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "export_rows_total",
+			Help: "Events written to export files",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(windowsTotal, rowsTotal)
+}
+
+// Source reads the events of a time range.
+type Source interface {
+	Each(ctx context.Context, from, to time.Time, fn func(database.Event) error) error
+}
+
+// objectStore is the part of the S3 API used by the exporter.
+type objectStore interface {
+	PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error)
+}
+
+// Manifest describes the files of an exported window.
+type Manifest struct {
+	WindowStart time.Time `json:"window_start"`
+	WindowEnd   time.Time `json:"window_end"`
+	Format      string    `json:"format"`
+	Rows        int64     `json:"rows"`
+	Files       []File    `json:"files"`
+	ExportedAt  time.Time `json:"exported_at"`
+}
+
+type File struct {
+	Key    string `json:"key"`
+	Rows   int64  `json:"rows"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// Exporter writes windows to a bucket, on schedule and on demand. Runs are
+// executed one at a time and kept in memory for status queries.
+type Exporter struct {
+	l        *slog.Logger
+	s3       objectStore
+	events   Source
+	bucket   string
+	prefix   string
+	format   string
+	window   time.Duration
+	lookback int
+	settle   time.Duration
+	maxRows  int64
+	now      func() time.Time
+
+	cron     *cron.Cron
+	schedule cron.Schedule
+
+	mu     sync.Mutex
+	runs   map[string]*Run
+	order  []string
+	closed bool
+	lastID int64
+
+	queue  chan *Run
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// New creates an exporter for cfg using the default AWS credential chain.
+func New(logger *slog.Logger, cfg config.ExportConfig, events Source) (*Exporter, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+		o.UsePathStyle = cfg.UsePathStyle
+	})
+	return newExporter(logger, cfg, client, events)
+}
+
+func newExporter(logger *slog.Logger, cfg config.ExportConfig, store objectStore, events Source) (*Exporter, error) {
+	var schedule cron.Schedule
+	if cfg.Schedule != "" {
+		var err error
+		if schedule, err = cron.ParseStandard(cfg.Schedule); err != nil {
+			return nil, fmt.Errorf("invalid EXPORT_SCHEDULE: %w", err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Exporter{
+		l:        logger.With("bucket", cfg.Bucket),
+		s3:       store,
+		events:   events,
+		bucket:   cfg.Bucket,
+		prefix:   cfg.Prefix,
+		format:   cfg.Format,
+		window:   time.Duration(cfg.WindowMinutes) * time.Minute,
+		lookback: cfg.LookbackWindows,
+		settle:   time.Duration(cfg.SettleSeconds) * time.Second,
+		maxRows:  int64(cfg.MaxRowsPerFile),
+		now:      time.Now,
+		cron:     cron.New(cron.WithLocation(time.UTC)),
+		schedule: schedule,
+		runs:     make(map[string]*Run),
+		queue:    make(chan *Run, maxRuns),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Window is the time range [Start, End).
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+// dir is the key prefix of the files of w, e.g.
+// events/dt=2025-01-01/20250101T000000Z-20250102T000000Z/
+func (e *Exporter) dir(w Window) string {
+	const layout = "20060102T150405Z"
+	return fmt.Sprintf("%sdt=%s/%s-%s/", e.prefix, w.Start.Format("2006-01-02"), w.Start.Format(layout), w.End.Format(layout))
+}
+
+// windows splits [from, to) into windows, widening it to window boundaries.
+func (e *Exporter) windows(from, to time.Time) []Window {
+	var out []Window
+	for start := from.UTC().Truncate(e.window); start.Before(to); start = start.Add(e.window) {
+		out = append(out, Window{Start: start, End: start.Add(e.window)})
+	}
+	return out
+}
+
+// lastComplete returns the end of the newest window that ended at least
+// the settle delay ago.
+func (e *Exporter) lastComplete() time.Time {
+	return e.now().UTC().Add(-e.settle).Truncate(e.window)
+}
+
+// ExportWindow writes the events of w and then its manifest. A window that
+// already has a manifest is skipped unless force is set; skipped reports
+// it. Files of a previous export of the window that are not overwritten are
+// deleted once the new manifest is written.
+func (e *Exporter) ExportWindow(ctx context.Context, w Window, force bool) (m Manifest, skipped bool, err error) {
+	dir := e.dir(w)
+	previous, found, err := e.readManifest(ctx, dir+"manifest.json")
+	if err != nil {
+		windowsTotal.WithLabelValues("failed").Inc()
+		return Manifest{}, false, err
+	}
+	if found && !force {
+		windowsTotal.WithLabelValues("skipped").Inc()
+		return previous, true, nil
+	}
+
+	m, err = e.export(ctx, w, dir)
+	if err != nil {
+		windowsTotal.WithLabelValues("failed").Inc()
+		return Manifest{}, false, err
+	}
+	windowsTotal.WithLabelValues("exported").Inc()
+	rowsTotal.Add(float64(m.Rows))
+
+	kept := make(map[string]bool, len(m.Files))
+	for _, f := range m.Files {
+		kept[f.Key] = true
+	}
+	for _, f := range previous.Files {
+		if kept[f.Key] {
+			continue
+		}
+		if _, err := e.s3.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(e.bucket), Key: aws.String(f.Key)}); err != nil {
+			e.l.Warn("failed to delete a file of the previous export", "key", f.Key, "error", err)
+		}
+	}
+	return m, false, nil
+}
+
+func (e *Exporter) export(ctx context.Context, w Window, dir string) (Manifest, error) {
+	m := Manifest{WindowStart: w.Start, WindowEnd: w.End, Format: e.format, Files: []File{}}
+
+	var cur *part
+	flush := func() error {
+		if cur == nil {
+			return nil
+		}
+		f, err := e.upload(ctx, cur)
+		cur = nil
+		if err != nil {
+			return err
+		}
+		m.Files = append(m.Files, f)
+		return nil
+	}
+	err := e.events.Each(ctx, w.Start, w.End, func(ev database.Event) error {
+		if cur == nil {
+			var err error
+			if cur, err = e.newPart(fmt.Sprintf("%spart-%05d.%s", dir, len(m.Files), e.extension())); err != nil {
+				return err
+			}
+		}
+		if err := cur.write(ev); err != nil {
+			return err
+		}
+		m.Rows++
+		if cur.rows >= e.maxRows {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if cur != nil {
+		cur.discard()
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	m.ExportedAt = e.now().UTC()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return Manifest{}, err
+	}
+	if _, err := e.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(e.bucket),
+		Key:         aws.String(dir + "manifest.json"),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	}); err != nil {
+		return Manifest{}, fmt.Errorf("upload manifest: %w", err)
+	}
+	return m, nil
+}
+
+func (e *Exporter) readManifest(ctx context.Context, key string) (Manifest, bool, error) {
+	out, err := e.s3.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(e.bucket), Key: aws.String(key)})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return Manifest{}, false, nil
+	}
+	if err != nil {
+		return Manifest{}, false, fmt.Errorf("read manifest: %w", err)
+	}
+	defer out.Body.Close()
+
+	var m Manifest
+	if err := json.NewDecoder(out.Body).Decode(&m); err != nil {
+		return Manifest{}, false, fmt.Errorf("read manifest %s: %w", key, err)
+	}
+	return m, true, nil
+}
+
+func (e *Exporter) extension() string {
+	if e.format == "csv" {
+		return "csv.gz"
+	}
+	return "parquet"
+}
+
+func (e *Exporter) upload(ctx context.Context, p *part) (File, error) {
+	defer p.discard()
+	if err := p.close(); err != nil {
+		return File{}, err
+	}
+	if _, err := p.file.Seek(0, io.SeekStart); err != nil {
+		return File{}, err
+	}
+
+	contentType := "application/vnd.apache.parquet"
+	if e.format == "csv" {
+		contentType = "application/gzip"
+	}
+	if _, err := e.s3.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:        aws.String(e.bucket),
+		Key:           aws.String(p.key),
+		Body:          p.file,
+		ContentLength: aws.Int64(p.size.n),
+		ContentType:   aws.String(contentType),
+	}); err != nil {
+		return File{}, fmt.Errorf("upload %s: %w", p.key, err)
+	}
+	return File{Key: p.key, Rows: p.rows, Bytes: p.size.n, SHA256: hex.EncodeToString(p.hash.Sum(nil))}, nil
+}
+
+// part is a data file being written to a temporary file before its upload.
+type part struct {
+	key   string
+	file  *os.File
+	hash  hash.Hash
+	size  *countingWriter
+	rows  int64
+	write func(database.Event) error
+	close func() error
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// row is the Parquet schema of the exported events.
+type row struct {
+	ID           int64   `parquet:"id"`
+	UserID       int64   `parquet:"user_id"`
+	Action       string  `parquet:"action,dict"`
+	MetadataPage *string `parquet:"metadata_page,optional"`
+	CreatedAt    int64   `parquet:"created_at,timestamp(microsecond)"`
+}
+
+func (e *Exporter) newPart(key string) (*part, error) {
+	f, err := os.CreateTemp("", "events-export-*")
+	if err != nil {
+		return nil, fmt.Errorf("create export file: %w", err)
+	}
+	p := &part{key: key, file: f, hash: sha256.New()}
+	p.size = &countingWriter{w: io.MultiWriter(f, p.hash)}
+	buf := bufio.NewWriterSize(p.size, 1<<20)
+
+	if e.format == "csv" {
+		gz := gzip.NewWriter(buf)
+		cw := csv.NewWriter(gz)
+		if err := cw.Write([]string{"id", "user_id", "action", "metadata_page", "created_at"}); err != nil {
+			p.discard()
+			return nil, err
+		}
+		p.write = func(ev database.Event) error {
+			page := ""
+			if ev.MetadataPage != nil {
+				page = *ev.MetadataPage
+			}
+			p.rows++
+			return cw.Write([]string{
+				strconv.FormatInt(ev.ID, 10),
+				strconv.FormatInt(ev.UserID, 10),
+				ev.Action,
+				page,
+				ev.CreatedAt.UTC().Format(time.RFC3339Nano),
+			})
+		}
+		p.close = func() error {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			return buf.Flush()
+		}
+		return p, nil
+	}
+
+	pw := parquet.NewGenericWriter[row](buf, parquet.Compression(&parquet.Zstd))
+	rows := make([]row, 0, 1024)
+	writeRows := func() error {
+		if len(rows) == 0 {
+			return nil
+		}
+		_, err := pw.Write(rows)
+		rows = rows[:0]
+		return err
+	}
+	p.write = func(ev database.Event) error {
+		p.rows++
+		rows = append(rows, row{ID: ev.ID, UserID: ev.UserID, Action: ev.Action, MetadataPage: ev.MetadataPage, CreatedAt: ev.CreatedAt.UnixMicro()})
+		if len(rows) == cap(rows) {
+			return writeRows()
+		}
+		return nil
+	}
+	p.close = func() error {
+		if err := writeRows(); err != nil {
+			return err
+		}
+		if err := pw.Close(); err != nil {
+			return err
+		}
+		return buf.Flush()
+	}
+	return p, nil
+}
+
+// discard removes the temporary file.
+func (p *part) discard() {
+	p.file.Close()
+	_ = os.Remove(p.file.Name())
+}
@@ -0,0 +1,223 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/parquet-go/parquet-go"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeS3 struct {
+	objects map[string][]byte
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, opts ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.objects[aws.ToString(in.Key)] = data
+	return &s3.PutObjectOutput{}, nil
+}
+func (f *fakeS3) GetObject(ctx context.Context, in *s3.GetObjectInput, opts ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	data, ok := f.objects[aws.ToString(in.Key)]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data))}, nil
+}
+func (f *fakeS3) DeleteObject(ctx context.Context, in *s3.DeleteObjectInput, opts ...func(*s3.Options)) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.ToString(in.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+type fakeSource struct {
+	events []database.Event
+	err    error
+}
+
+func (f *fakeSource) Each(ctx context.Context, from, to time.Time, fn func(database.Event) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, e := range f.events {
+		if !e.CreatedAt.Before(from) && e.CreatedAt.Before(to) {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newTestExporter(t *testing.T, format string, maxRows int, events []database.Event) (*Exporter, *fakeS3) {
+	t.Helper()
+	store := &fakeS3{objects: map[string][]byte{}}
+	e, err := newExporter(slog.New(slog.NewTextHandler(io.Discard, nil)), config.ExportConfig{
+		Bucket:         "warehouse",
+		Prefix:         "events/",
+		Format:         format,
+		WindowMinutes:  60,
+		MaxRowsPerFile: maxRows,
+	}, store, &fakeSource{events: events})
+	if err != nil {
+		t.Fatalf("new exporter: %v", err)
+	}
+	return e, store
+}
+
+func TestExportWindow(t *testing.T) {
+	start := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+	page := "/pricing"
+	events := []database.Event{
+		{ID: 1, UserID: 7, Action: "click", MetadataPage: &page, CreatedAt: start.Add(time.Minute)},
+		{ID: 2, UserID: 8, Action: "view", CreatedAt: start.Add(2 * time.Minute)},
+		{ID: 3, UserID: 7, Action: "view", CreatedAt: start.Add(3 * time.Minute)},
+		{ID: 4, UserID: 9, Action: "click", CreatedAt: start.Add(time.Hour)},
+	}
+	w := Window{Start: start, End: start.Add(time.Hour)}
+	dir := "events/dt=2025-01-01/20250101T100000Z-20250101T110000Z/"
+
+	t.Run("csv", func(t *testing.T) {
+		e, store := newTestExporter(t, "csv", 2, events)
+		m, skipped, err := e.ExportWindow(context.Background(), w, false)
+		if err != nil || skipped {
+			t.Fatalf("export: %v skipped %v", err, skipped)
+		}
+		if m.Rows != 3 || len(m.Files) != 2 || m.Files[0].Key != dir+"part-00000.csv.gz" || m.Files[1].Rows != 1 {
+			t.Fatalf("unexpected manifest %+v", m)
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(store.objects[dir+"part-00000.csv.gz"]))
+		if err != nil {
+			t.Fatalf("gzip: %v", err)
+		}
+		data, _ := io.ReadAll(gz)
+		expected := "id,user_id,action,metadata_page,created_at\n1,7,click,/pricing,2025-01-01T10:01:00Z\n2,8,view,,2025-01-01T10:02:00Z\n"
+		if string(data) != expected {
+			t.Fatalf("unexpected csv:\n%s", data)
+		}
+
+		var stored Manifest
+		if err := json.Unmarshal(store.objects[dir+"manifest.json"], &stored); err != nil || stored.Rows != 3 {
+			t.Fatalf("unexpected stored manifest %s: %v", store.objects[dir+"manifest.json"], err)
+		}
+	})
+
+	t.Run("parquet", func(t *testing.T) {
+		e, store := newTestExporter(t, "parquet", 100, events)
+		m, _, err := e.ExportWindow(context.Background(), w, false)
+		if err != nil || len(m.Files) != 1 {
+			t.Fatalf("export: %v %+v", err, m)
+		}
+		data := store.objects[dir+"part-00000.parquet"]
+		rows, err := parquet.Read[row](bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("read parquet: %v", err)
+		}
+		if len(rows) != 3 || rows[0].MetadataPage == nil || *rows[0].MetadataPage != page || rows[1].MetadataPage != nil || rows[2].CreatedAt != start.Add(3*time.Minute).UnixMicro() {
+			t.Fatalf("unexpected rows %+v", rows)
+		}
+	})
+
+	t.Run("re-runs", func(t *testing.T) {
+		e, store := newTestExporter(t, "csv", 2, events)
+		if _, _, err := e.ExportWindow(context.Background(), w, false); err != nil {
+			t.Fatalf("export: %v", err)
+		}
+
+		if _, skipped, err := e.ExportWindow(context.Background(), w, false); err != nil || !skipped {
+			t.Fatalf("expected the exported window to be skipped, got %v %v", skipped, err)
+		}
+
+		// Fewer rows now fit in a single file: the second one is removed
+		e.maxRows = 10
+		m, skipped, err := e.ExportWindow(context.Background(), w, true)
+		if err != nil || skipped || len(m.Files) != 1 {
+			t.Fatalf("forced export: %v %v %+v", err, skipped, m)
+		}
+		if _, ok := store.objects[dir+"part-00001.csv.gz"]; ok {
+			t.Fatalf("expected the stale file to be deleted")
+		}
+	})
+
+	t.Run("failed read leaves no manifest", func(t *testing.T) {
+		e, store := newTestExporter(t, "csv", 2, events)
+		e.events = &fakeSource{err: errors.New("db down")}
+		if _, _, err := e.ExportWindow(context.Background(), w, false); err == nil {
+			t.Fatalf("expected an error")
+		}
+		if _, ok := store.objects[dir+"manifest.json"]; ok {
+			t.Fatalf("expected no manifest")
+		}
+	})
+}
+
+func TestSubmit(t *testing.T) {
+	now := time.Date(2025, 1, 2, 0, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		from, to  time.Time
+		expectErr error
+	}{
+		{name: "complete windows", from: now.Add(-3 * time.Hour), to: now.Add(-time.Hour)},
+		{name: "window not complete yet", from: now.Add(-time.Hour), to: now, expectErr: ErrInvalidRange},
+		{name: "reversed", from: now.Add(-time.Hour), to: now.Add(-2 * time.Hour), expectErr: ErrInvalidRange},
+		{name: "too many windows", from: now.Add(-2000 * time.Hour), to: now.Add(-time.Hour), expectErr: ErrInvalidRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _ := newTestExporter(t, "csv", 10, nil)
+			e.now = func() time.Time { return now }
+			run, err := e.Submit(tt.from, tt.to, false)
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) {
+					t.Fatalf("expected %v got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil || run.Status != RunQueued {
+				t.Fatalf("unexpected run %+v: %v", run, err)
+			}
+
+			e.Start()
+			deadline := time.Now().Add(2 * time.Second)
+			for got := mustGet(t, e, run.ID); !got.finished(); got = mustGet(t, e, run.ID) {
+				if time.Now().After(deadline) {
+					t.Fatalf("run did not finish: %+v", got)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if err := e.Stop(context.Background()); err != nil {
+				t.Fatalf("stop: %v", err)
+			}
+			// 21:30 to 23:30 is widened to the windows of 21:00, 22:00 and 23:00
+			if got := mustGet(t, e, run.ID); got.Status != RunSucceeded || len(got.Windows) != 3 {
+				t.Fatalf("expected 3 exported windows got %+v", got)
+			}
+		})
+	}
+}
+
+func mustGet(t *testing.T, e *Exporter, id string) Run {
+	t.Helper()
+	run, err := e.Get(id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	return run
+}
@@ -0,0 +1,231 @@
+package export
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+var (
+	// ErrNotFound is returned for unknown or forgotten run ids.
+	ErrNotFound = errors.New("export run not found")
+	// ErrBusy is returned by Submit while too many runs are pending.
+	ErrBusy = errors.New("too many pending export runs")
+	// ErrClosed is returned by Submit once Stop was called.
+	ErrClosed = errors.New("exporter is shutting down")
+	// ErrInvalidRange is returned by Submit for ranges that cannot be exported.
+	ErrInvalidRange = errors.New("invalid export range")
+)
+
+const (
+	// maxRuns bounds the runs kept in memory and the pending ones.
+	maxRuns = 100
+	// maxWindows bounds the windows of a single run.
+	maxWindows = 1000
+)
+
+type RunStatus string
+
+const (
+	RunQueued    RunStatus = "queued"
+	RunRunning   RunStatus = "running"
+	RunSucceeded RunStatus = "succeeded"
+	RunFailed    RunStatus = "failed"
+)
+
+// Run exports a range of windows.
+type Run struct {
+	ID      string    `json:"id"`
+	Trigger string    `json:"trigger"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	// Force exports again the windows that already have a manifest.
+	Force      bool           `json:"force"`
+	Status     RunStatus      `json:"status"`
+	Windows    []WindowResult `json:"windows"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+type WindowResult struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Skipped bool      `json:"skipped"`
+	Rows    int64     `json:"rows"`
+	Files   int       `json:"files"`
+}
+
+func (r *Run) finished() bool {
+	return r.Status == RunSucceeded || r.Status == RunFailed
+}
+
+// Submit queues the export of the complete windows overlapping [from, to).
+func (e *Exporter) Submit(from, to time.Time, force bool) (Run, error) {
+	if !from.Before(to) {
+		return Run{}, fmt.Errorf("%w: from must be before to", ErrInvalidRange)
+	}
+	if last := e.lastComplete(); to.After(last) {
+		return Run{}, fmt.Errorf("%w: the last complete window ends at %s", ErrInvalidRange, last.Format(time.RFC3339))
+	}
+	if n := len(e.windows(from, to)); n > maxWindows {
+		return Run{}, fmt.Errorf("%w: %d windows, at most %d per run", ErrInvalidRange, n, maxWindows)
+	}
+	return e.submit("api", from, to, force)
+}
+
+func (e *Exporter) submit(trigger string, from, to time.Time, force bool) (Run, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return Run{}, ErrClosed
+	}
+
+	id := max(time.Now().UnixNano(), e.lastID+1)
+	e.lastID = id
+	run := &Run{
+		ID:        strconv.FormatInt(id, 10),
+		Trigger:   trigger,
+		From:      from.UTC(),
+		To:        to.UTC(),
+		Force:     force,
+		Status:    RunQueued,
+		Windows:   []WindowResult{},
+		CreatedAt: time.Now().UTC(),
+	}
+	select {
+	case e.queue <- run:
+	default:
+		return Run{}, ErrBusy
+	}
+	e.add(run)
+	return *run, nil
+}
+
+// add registers run and forgets the oldest finished runs above maxRuns.
+// e.mu must be held.
+func (e *Exporter) add(run *Run) {
+	e.runs[run.ID] = run
+	e.order = append(e.order, run.ID)
+	for i := 0; len(e.runs) > maxRuns && i < len(e.order); {
+		if old := e.runs[e.order[i]]; old.finished() {
+			delete(e.runs, old.ID)
+			e.order = append(e.order[:i], e.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// Get returns a snapshot of a run.
+func (e *Exporter) Get(id string) (Run, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	run, ok := e.runs[id]
+	if !ok {
+		return Run{}, ErrNotFound
+	}
+	return *run, nil
+}
+
+// List returns snapshots of the known runs, newest first.
+func (e *Exporter) List() []Run {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	out := make([]Run, 0, len(e.order))
+	for i := len(e.order) - 1; i >= 0; i-- {
+		out = append(out, *e.runs[e.order[i]])
+	}
+	return out
+}
+
+// Start runs the queued runs in the background and, with a schedule,
+// queues the export of the last complete windows at each tick.
+func (e *Exporter) Start() {
+	go e.run()
+	if e.schedule != nil {
+		e.cron.Schedule(e.schedule, cron.FuncJob(e.scheduled))
+		e.cron.Start()
+	}
+	e.l.Info("exporter started", "scheduled", e.schedule != nil)
+}
+
+// Stop cancels the running export and fails the queued ones, waiting at
+// most until ctx is done. An interrupted window has no new manifest and is
+// exported again by the next scheduled run.
+func (e *Exporter) Stop(ctx context.Context) error {
+	<-e.cron.Stop().Done()
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.queue)
+	}
+	e.mu.Unlock()
+	e.cancel()
+
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *Exporter) scheduled() {
+	end := e.lastComplete()
+	start := end.Add(-time.Duration(e.lookback) * e.window)
+	if _, err := e.submit("schedule", start, end, false); err != nil {
+		e.l.Warn("scheduled export not queued", "error", err)
+	}
+}
+
+func (e *Exporter) run() {
+	defer close(e.done)
+	for run := range e.queue {
+		if e.ctx.Err() != nil {
+			e.finish(run, errors.New("interrupted by shutdown"))
+			continue
+		}
+		e.process(run)
+	}
+}
+
+func (e *Exporter) process(run *Run) {
+	e.mu.Lock()
+	started := time.Now().UTC()
+	run.Status = RunRunning
+	run.StartedAt = &started
+	e.mu.Unlock()
+
+	for _, w := range e.windows(run.From, run.To) {
+		m, skipped, err := e.ExportWindow(e.ctx, w, run.Force)
+		if err != nil {
+			e.finish(run, fmt.Errorf("window %s: %w", w.Start.Format(time.RFC3339), err))
+			return
+		}
+		e.mu.Lock()
+		run.Windows = append(run.Windows, WindowResult{Start: w.Start, End: w.End, Skipped: skipped, Rows: m.Rows, Files: len(m.Files)})
+		e.mu.Unlock()
+	}
+	e.finish(run, nil)
+}
+
+func (e *Exporter) finish(run *Run, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	finished := time.Now().UTC()
+	run.FinishedAt = &finished
+	run.Status = RunSucceeded
+	if err != nil {
+		run.Status = RunFailed
+		run.Error = err.Error()
+		e.l.Error("export failed", "run_id", run.ID, "trigger", run.Trigger, "error", err)
+		return
+	}
+	e.l.Info("export finished", "run_id", run.ID, "trigger", run.Trigger, "windows", len(run.Windows))
+}
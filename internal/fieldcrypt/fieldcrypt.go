@@ -0,0 +1,97 @@
+// Package fieldcrypt encrypts single values, such as event metadata, with
+// AES-256-GCM before they are stored.
+package fieldcrypt
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// prefix marks encrypted values, so that values stored before encryption
+// was enabled are still read as they are.
+const prefix = "enc:v1:"
+
+// ErrCiphertext is returned for encrypted values that cannot be decrypted.
+var ErrCiphertext = errors.New("invalid ciphertext")
+
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// New returns a Cipher using a 32 bytes key.
+func New(key []byte) (*Cipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Load returns the Cipher of the configuration, decrypting the key with KMS
+// when it is given as a KMS ciphertext, or nil when encryption is disabled.
+func Load(ctx context.Context, cfg config.PrivacyConfig) (*Cipher, error) {
+	var key []byte
+	var err error
+	switch {
+	case cfg.MetadataKey != "":
+		key, err = base64.StdEncoding.DecodeString(cfg.MetadataKey)
+	case cfg.MetadataKMSKey != "":
+		var blob []byte
+		if blob, err = base64.StdEncoding.DecodeString(cfg.MetadataKMSKey); err == nil {
+			key, err = DecryptKMS(ctx, cfg.KMSRegion, cfg.KMSEndpoint, blob)
+		}
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load metadata key: %w", err)
+	}
+	return New(key)
+}
+
+// Encrypt returns the encrypted value, with a random nonce, as text.
+func (c *Cipher) Encrypt(plaintext string) string {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(plaintext)+c.aead.Overhead())
+	_, _ = rand.Read(nonce)
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return prefix + base64.RawStdEncoding.EncodeToString(sealed)
+}
+
+// Encrypted reports whether value was returned by Encrypt.
+func Encrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Decrypt returns the plaintext of a value returned by Encrypt. Values
+// without the prefix of encrypted values are returned unchanged.
+func (c *Cipher) Decrypt(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, prefix)
+	if !ok {
+		return value, nil
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < c.aead.NonceSize() {
+		return "", ErrCiphertext
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", ErrCiphertext
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,78 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestCipher(t *testing.T) {
+	c, err := New(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	if _, err := New([]byte("short")); err == nil {
+		t.Fatal("expected short keys to be rejected")
+	}
+
+	a, b := c.Encrypt("/account/settings"), c.Encrypt("/account/settings")
+	if !strings.HasPrefix(a, prefix) || strings.Contains(a, "account") || a == b {
+		t.Fatalf("expected distinct opaque ciphertexts, got %q and %q", a, b)
+	}
+	if !Encrypted(a) || Encrypted("/account/settings") {
+		t.Fatalf("expected only ciphertexts to be reported as encrypted")
+	}
+	if got, err := c.Decrypt(a); err != nil || got != "/account/settings" {
+		t.Fatalf("expected the plaintext back, got %q, %v", got, err)
+	}
+	// Values stored before encryption was enabled
+	if got, err := c.Decrypt("/pricing"); err != nil || got != "/pricing" {
+		t.Fatalf("expected plain values unchanged, got %q, %v", got, err)
+	}
+
+	tampered := a[:len(a)-2] + "AA"
+	if _, err := c.Decrypt(tampered); !errors.Is(err, ErrCiphertext) {
+		t.Fatalf("expected ErrCiphertext for a tampered value, got %v", err)
+	}
+	other, _ := New(bytes.Repeat([]byte{8}, 32))
+	if _, err := other.Decrypt(a); !errors.Is(err, ErrCiphertext) {
+		t.Fatalf("expected ErrCiphertext with another key, got %v", err)
+	}
+}
+
+func TestDecryptKMS(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct{ CiphertextBlob []byte }
+		_ = json.NewDecoder(r.Body).Decode(&in)
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || !strings.Contains(r.Header.Get("Authorization"), "/eu-west-1/kms/aws4_request") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if string(in.CiphertextBlob) != "wrapped" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"__type":"InvalidCiphertextException","message":"bad blob"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string][]byte{"KeyId": []byte("k"), "Plaintext": key})
+	}))
+	defer srv.Close()
+	creds := aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+		return aws.Credentials{AccessKeyID: "AKID", SecretAccessKey: "SECRET"}, nil
+	})
+
+	got, err := decryptKMS(context.Background(), srv.Client(), creds, "eu-west-1", srv.URL, []byte("wrapped"))
+	if err != nil || !bytes.Equal(got, key) {
+		t.Fatalf("expected the data key, got %x, %v", got, err)
+	}
+	if _, err := decryptKMS(context.Background(), srv.Client(), creds, "eu-west-1", srv.URL, []byte("other")); err == nil || !strings.Contains(err.Error(), "InvalidCiphertextException") {
+		t.Fatalf("expected the KMS error, got %v", err)
+	}
+}
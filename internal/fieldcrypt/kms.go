@@ -0,0 +1,89 @@
+package fieldcrypt
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// DecryptKMS decrypts a data key with the AWS KMS Decrypt operation, using
+// the default AWS credential chain. The KMS key is identified by the
+// ciphertext itself.
+func DecryptKMS(ctx context.Context, region, endpoint string, blob []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+	if endpoint == "" {
+		endpoint = "https://kms." + awsCfg.Region + ".amazonaws.com"
+	}
+	return decryptKMS(ctx, http.DefaultClient, awsCfg.Credentials, awsCfg.Region, endpoint, blob)
+}
+
+// decryptKMS calls the KMS JSON API directly; the SDK client of KMS is
+// not worth a dependency for a single call at startup.
+func decryptKMS(ctx context.Context, client *http.Client, creds aws.CredentialsProvider, region, endpoint string, blob []byte) ([]byte, error) {
+	body, err := json.Marshal(map[string][]byte{"CiphertextBlob": blob})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+
+	credentials, err := creds.Retrieve(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("retrieve aws credentials: %w", err)
+	}
+	sum := sha256.Sum256(body)
+	if err := v4.NewSigner().SignHTTP(ctx, credentials, req, hex.EncodeToString(sum[:]), "kms", region, time.Now()); err != nil {
+		return nil, fmt.Errorf("sign kms request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var kmsErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &kmsErr)
+		return nil, fmt.Errorf("kms decrypt: status %d: %s %s", resp.StatusCode, kmsErr.Type, kmsErr.Message)
+	}
+
+	var out struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("kms decrypt: decode response: %w", err)
+	}
+	return out.Plaintext, nil
+}
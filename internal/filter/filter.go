@@ -0,0 +1,297 @@
+// Package filter parses the filter expressions of GET /events, such as
+//
+//	action == "click" && metadata.page =~ "^/checkout"
+//
+// and compiles them into a parameterized SQL condition on the events table.
+//
+// A comparison is a field, an operator and a literal. Fields are action and
+// metadata.page (strings: ==, !=, =~ and !~ for POSIX regular
+// expressions), id, user_id and schema_version (integers: ==, !=, <, <=,
+// >, >=), created_at (an RFC3339 time in a string: ==, !=, <, <=, >, >=)
+// and tag (a string: == for the events carrying the tag, != for the
+// others).
+// Strings are double quoted with Go escapes. Comparisons combine with &&, ||
+// and !, && binding tighter than ||, and parentheses. A missing
+// metadata.page compares as "".
+package filter
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxLength bounds the source of an expression, in bytes.
+	MaxLength = 1024
+	// MaxComparisons bounds the comparisons of an expression, so that the
+	// condition stays cheap to plan.
+	MaxComparisons = 32
+)
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindInt
+	kindTime
+	kindTag
+)
+
+// fields maps the fields of an expression to their type and column. Tags
+// are looked up in event_tags instead.
+var fields = map[string]struct {
+	kind   kind
+	column string
+}{
+	"id":             {kindInt, "id"},
+	"user_id":        {kindInt, "user_id"},
+	"action":         {kindString, "action"},
+	"metadata.page":  {kindString, "COALESCE(metadata_page, '')"},
+	"created_at":     {kindTime, "created_at"},
+	"schema_version": {kindInt, "schema_version"},
+	"tag":            {kindTag, ""},
+}
+
+// operators maps the comparison operators to SQL, by the field types
+// accepting them.
+var operators = map[string]struct {
+	sql   string
+	kinds []kind
+}{
+	"==": {"=", []kind{kindString, kindInt, kindTime, kindTag}},
+	"!=": {"<>", []kind{kindString, kindInt, kindTime, kindTag}},
+	"<":  {"<", []kind{kindInt, kindTime}},
+	"<=": {"<=", []kind{kindInt, kindTime}},
+	">":  {">", []kind{kindInt, kindTime}},
+	">=": {">=", []kind{kindInt, kindTime}},
+	"=~": {"~", []kind{kindString}},
+	"!~": {"!~", []kind{kindString}},
+}
+
+// Error is a syntax or type error, at a byte offset of the expression.
+type Error struct {
+	Pos int
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Msg, e.Pos)
+}
+
+// node is a comparison, or a combination of nodes.
+type node struct {
+	op          string // &&, || or ! for combinations
+	left, right *node
+
+	field string
+	value any
+}
+
+// Expr is a parsed expression.
+type Expr struct {
+	src  string
+	root *node
+}
+
+// String returns the source of the expression.
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Uses reports whether the expression compares field.
+func (e *Expr) Uses(field string) bool {
+	var walk func(n *node) bool
+	walk = func(n *node) bool {
+		if n == nil {
+			return false
+		}
+		if n.field == field {
+			return true
+		}
+		return walk(n.left) || walk(n.right)
+	}
+	return walk(e.root)
+}
+
+// SQL returns the condition of the expression, with its values as
+// arguments numbered from $next.
+func (e *Expr) SQL(next int) (string, []any) {
+	var b strings.Builder
+	var args []any
+	var write func(n *node)
+	write = func(n *node) {
+		switch n.op {
+		case "&&", "||":
+			b.WriteByte('(')
+			write(n.left)
+			if n.op == "&&" {
+				b.WriteString(" AND ")
+			} else {
+				b.WriteString(" OR ")
+			}
+			write(n.right)
+			b.WriteByte(')')
+		case "!":
+			b.WriteString("NOT ")
+			write(n.left)
+		default:
+			args = append(args, n.value)
+			if n.field == "tag" {
+				if n.op == "!=" {
+					b.WriteString("NOT ")
+				}
+				fmt.Fprintf(&b, "EXISTS (SELECT 1 FROM event_tags WHERE event_tags.event_id = events.id AND event_tags.tag = $%d)", next+len(args)-1)
+				return
+			}
+			fmt.Fprintf(&b, "(%s %s $%d)", fields[n.field].column, operators[n.op].sql, next+len(args)-1)
+		}
+	}
+	write(e.root)
+	return b.String(), args
+}
+
+// Parse parses and type checks an expression.
+func Parse(src string) (*Expr, error) {
+	if len(src) > MaxLength {
+		return nil, &Error{Pos: MaxLength, Msg: fmt.Sprintf("expression longer than %d bytes", MaxLength)}
+	}
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("unexpected %s", t)}
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+type parser struct {
+	tokens      []token
+	i           int
+	comparisons int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) or() (*node, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is(tokOp, "||") {
+		p.next()
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &node{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (*node, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().is(tokOp, "&&") {
+		p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &node{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (*node, error) {
+	t := p.next()
+	switch {
+	case t.is(tokOp, "!"):
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &node{op: "!", left: n}, nil
+	case t.is(tokOp, "("):
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); !closing.is(tokOp, ")") {
+			return nil, &Error{Pos: closing.pos, Msg: fmt.Sprintf("expected ) instead of %s", closing)}
+		}
+		return n, nil
+	case t.kind == tokIdent:
+		return p.comparison(t)
+	}
+	return nil, &Error{Pos: t.pos, Msg: fmt.Sprintf("expected a field instead of %s", t)}
+}
+
+func (p *parser) comparison(field token) (*node, error) {
+	f, ok := fields[field.text]
+	if !ok {
+		return nil, &Error{Pos: field.pos, Msg: fmt.Sprintf("unknown field %s, expected one of %s", field.text, strings.Join(slices.Sorted(maps.Keys(fields)), ", "))}
+	}
+	if p.comparisons++; p.comparisons > MaxComparisons {
+		return nil, &Error{Pos: field.pos, Msg: fmt.Sprintf("more than %d comparisons", MaxComparisons)}
+	}
+
+	opTok := p.next()
+	op, ok := operators[opTok.text]
+	if opTok.kind != tokOp || !ok {
+		return nil, &Error{Pos: opTok.pos, Msg: fmt.Sprintf("expected a comparison operator instead of %s", opTok)}
+	}
+	if !slices.Contains(op.kinds, f.kind) {
+		return nil, &Error{Pos: opTok.pos, Msg: fmt.Sprintf("%s cannot be compared with %s", field.text, opTok.text)}
+	}
+
+	v := p.next()
+	n := &node{op: opTok.text, field: field.text}
+	switch {
+	case f.kind == kindInt && v.kind == tokNumber:
+		i, err := strconv.ParseInt(v.text, 10, 64)
+		if err != nil {
+			return nil, &Error{Pos: v.pos, Msg: fmt.Sprintf("%s is out of range", v.text)}
+		}
+		n.value = i
+	case (f.kind == kindString || f.kind == kindTag) && v.kind == tokString:
+		if opTok.text == "=~" || opTok.text == "!~" {
+			if _, err := regexp.Compile(v.value); err != nil {
+				return nil, &Error{Pos: v.pos, Msg: fmt.Sprintf("invalid regular expression: %s", err)}
+			}
+		}
+		n.value = v.value
+	case f.kind == kindTime && v.kind == tokString:
+		t, err := time.Parse(time.RFC3339, v.value)
+		if err != nil {
+			return nil, &Error{Pos: v.pos, Msg: fmt.Sprintf("%s must be compared with an RFC3339 time", field.text)}
+		}
+		n.value = t
+	default:
+		expected := map[kind]string{kindString: "a string", kindInt: "an integer", kindTime: "a time string", kindTag: "a string"}[f.kind]
+		return nil, &Error{Pos: v.pos, Msg: fmt.Sprintf("expected %s instead of %s", expected, v)}
+	}
+	return n, nil
+}
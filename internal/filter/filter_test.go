@@ -0,0 +1,101 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		expectSQL string
+		expectErr string
+		args      []any
+	}{
+		{
+			name:      "comparison",
+			src:       `action == "click"`,
+			expectSQL: `(action = $3)`,
+			args:      []any{"click"},
+		},
+		{
+			name:      "and binds tighter than or",
+			src:       `action == "click" && metadata.page =~ "^/checkout" || user_id >= 42`,
+			expectSQL: `(((action = $3) AND (COALESCE(metadata_page, '') ~ $4)) OR (user_id >= $5))`,
+			args:      []any{"click", "^/checkout", int64(42)},
+		},
+		{
+			name:      "parentheses and negation",
+			src:       `!(action != "view" || id < -1)`,
+			expectSQL: `NOT ((action <> $3) OR (id < $4))`,
+			args:      []any{"view", int64(-1)},
+		},
+		{
+			name:      "time and escapes",
+			src:       `created_at>"2025-03-10T00:00:00Z"&&metadata.page!~"\"q\""`,
+			expectSQL: `((created_at > $3) AND (COALESCE(metadata_page, '') !~ $4))`,
+			args:      []any{time.Date(2025, 3, 10, 0, 0, 0, 0, time.UTC), `"q"`},
+		},
+		{
+			name:      "schema version",
+			src:       `schema_version >= 2`,
+			expectSQL: `(schema_version >= $3)`,
+			args:      []any{int64(2)},
+		},
+		{
+			name:      "tags",
+			src:       `tag == "vip" && tag != "bot-traffic"`,
+			expectSQL: `(EXISTS (SELECT 1 FROM event_tags WHERE event_tags.event_id = events.id AND event_tags.tag = $3) AND NOT EXISTS (SELECT 1 FROM event_tags WHERE event_tags.event_id = events.id AND event_tags.tag = $4))`,
+			args:      []any{"vip", "bot-traffic"},
+		},
+		{name: "regex on a tag", src: `tag =~ "bot"`, expectErr: "tag cannot be compared with =~"},
+		{name: "unknown field", src: `page == "/"`, expectErr: "unknown field page, expected one of action, created_at, id, metadata.page, schema_version, tag, user_id"},
+		{name: "regex on an integer", src: `user_id =~ "1"`, expectErr: "user_id cannot be compared with =~ at position 8"},
+		{name: "order on a string", src: `action < "b"`, expectErr: "action cannot be compared with <"},
+		{name: "string for an integer", src: `user_id == "1"`, expectErr: "expected an integer"},
+		{name: "bad time", src: `created_at < "yesterday"`, expectErr: "RFC3339"},
+		{name: "bad regex", src: `action =~ "("`, expectErr: "invalid regular expression"},
+		{name: "unterminated string", src: `action == "click`, expectErr: "unterminated string at position 10"},
+		{name: "unbalanced", src: `(action == "a"`, expectErr: "expected ) instead of end of expression"},
+		{name: "trailing", src: `action == "a" "b"`, expectErr: `unexpected "\"b\""`},
+		{name: "single equal", src: `action = "a"`, expectErr: "unexpected character '='"},
+		{name: "empty", src: ``, expectErr: "expected a field instead of end of expression"},
+		{name: "too many comparisons", src: strings.Repeat(`id == 1 || `, MaxComparisons) + `id == 1`, expectErr: "more than 32 comparisons"},
+		{name: "too long", src: `action == "` + strings.Repeat("a", MaxLength) + `"`, expectErr: "longer than 1024 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := Parse(tt.src)
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Fatalf("expected error %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			sql, args := e.SQL(3)
+			if sql != tt.expectSQL {
+				t.Fatalf("expected %s, got %s", tt.expectSQL, sql)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Fatalf("expected arguments %#v, got %#v", tt.args, args)
+			}
+		})
+	}
+}
+
+func TestUses(t *testing.T) {
+	e, err := Parse(`action == "a" || !(metadata.page == "/")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !e.Uses("metadata.page") || !e.Uses("action") || e.Uses("user_id") {
+		t.Fatalf("unexpected fields of %s", e)
+	}
+}
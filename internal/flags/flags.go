@@ -0,0 +1,217 @@
+// Package flags resolves the feature flags controlling optional API
+// behaviors, so that they can be rolled out project by project. A flag is
+// enabled for a project by its override for the project, else by its
+// global override, else by its default from the configuration. Overrides
+// are set on the admin listener and read again periodically, so that every
+// instance sees them.
+package flags
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Names of the flags, listed in config.FeatureFlagNames.
+const (
+	// StrictValidation rejects unknown JSON fields and ambiguous times,
+	// like STRICT_JSON and STRICT_TIME_PARSING.
+	StrictValidation = "strict_validation"
+	// AsyncIngest acknowledges single events once they are in the ingest
+	// buffer. It needs INGEST_ASYNC, which creates the buffer.
+	AsyncIngest = "async_ingest"
+	// ResponseEnvelope wraps the events of GET /events in an object.
+	ResponseEnvelope = "response_envelope"
+)
+
+// ErrUnknownFlag is returned for names missing from
+// config.FeatureFlagNames.
+var ErrUnknownFlag = errors.New("unknown feature flag")
+
+// refreshTimeout bounds a read of the overrides.
+const refreshTimeout = 10 * time.Second
+
+// Store keeps the overrides.
+type Store interface {
+	ListFeatureFlags(ctx context.Context) ([]database.FeatureFlag, error)
+	SetFeatureFlag(ctx context.Context, f database.FeatureFlag) (database.FeatureFlag, error)
+	DeleteFeatureFlag(ctx context.Context, name string, projectID int64) error
+}
+
+// Flag describes a flag on the admin listener: its default, its overrides
+// and whether it is enabled for the project it was listed for.
+type Flag struct {
+	Name      string                 `json:"name"`
+	Enabled   bool                   `json:"enabled"`
+	Default   bool                   `json:"default"`
+	Overrides []database.FeatureFlag `json:"overrides"`
+}
+
+type key struct {
+	name      string
+	projectID int64
+}
+
+// Set holds the defaults and the last overrides read from the store.
+type Set struct {
+	l        *slog.Logger
+	store    Store
+	defaults map[string]bool
+	interval int
+	cron     *cron.Cron
+
+	mu        sync.RWMutex
+	overrides map[key]database.FeatureFlag
+}
+
+// New returns a set enabling the defaults, and reading the overrides every
+// refreshSeconds once started.
+func New(logger *slog.Logger, defaults []string, refreshSeconds int, store Store) (*Set, error) {
+	s := &Set{
+		l:         logger,
+		store:     store,
+		defaults:  map[string]bool{},
+		interval:  refreshSeconds,
+		cron:      cron.New(cron.WithSeconds()),
+		overrides: map[key]database.FeatureFlag{},
+	}
+	for _, name := range defaults {
+		if !Known(name) {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownFlag, name)
+		}
+		s.defaults[name] = true
+	}
+	spec := "@every " + strconv.Itoa(refreshSeconds) + "s"
+	if _, err := s.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(s.run))); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Known reports whether name is a flag.
+func Known(name string) bool {
+	return slices.Contains(config.FeatureFlagNames, name)
+}
+
+// Enabled reports whether the flag is enabled for the project.
+func (s *Set) Enabled(projectID int64, name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.enabled(projectID, name)
+}
+
+func (s *Set) enabled(projectID int64, name string) bool {
+	if f, ok := s.overrides[key{name, projectID}]; ok {
+		return f.Enabled
+	}
+	if f, ok := s.overrides[key{name, 0}]; ok {
+		return f.Enabled
+	}
+	return s.defaults[name]
+}
+
+// List describes every flag, enabled or not for the project, 0 describing
+// the flags of the projects without overrides.
+func (s *Set) List(projectID int64) []Flag {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := make([]Flag, 0, len(config.FeatureFlagNames))
+	for _, name := range config.FeatureFlagNames {
+		f := Flag{Name: name, Enabled: s.enabled(projectID, name), Default: s.defaults[name], Overrides: []database.FeatureFlag{}}
+		for k, o := range s.overrides {
+			if k.name == name {
+				f.Overrides = append(f.Overrides, o)
+			}
+		}
+		slices.SortFunc(f.Overrides, func(a, b database.FeatureFlag) int { return cmp.Compare(a.ProjectID, b.ProjectID) })
+		flags = append(flags, f)
+	}
+	return flags
+}
+
+// Set stores an override, applied at once by this instance and by the
+// others at their next refresh.
+func (s *Set) Set(ctx context.Context, f database.FeatureFlag) (database.FeatureFlag, error) {
+	if !Known(f.Name) {
+		return database.FeatureFlag{}, fmt.Errorf("%w: %s", ErrUnknownFlag, f.Name)
+	}
+	stored, err := s.store.SetFeatureFlag(ctx, f)
+	if err != nil {
+		return database.FeatureFlag{}, err
+	}
+	s.mu.Lock()
+	s.overrides[key{stored.Name, stored.ProjectID}] = stored
+	s.mu.Unlock()
+	return stored, nil
+}
+
+// Delete removes an override, or returns database.ErrFeatureFlagNotFound.
+func (s *Set) Delete(ctx context.Context, name string, projectID int64) error {
+	if !Known(name) {
+		return fmt.Errorf("%w: %s", ErrUnknownFlag, name)
+	}
+	if err := s.store.DeleteFeatureFlag(ctx, name, projectID); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.overrides, key{name, projectID})
+	s.mu.Unlock()
+	return nil
+}
+
+// Refresh replaces the overrides with the ones of the store. Overrides of
+// flags that no longer exist are ignored.
+func (s *Set) Refresh(ctx context.Context) error {
+	stored, err := s.store.ListFeatureFlags(ctx)
+	if err != nil {
+		return err
+	}
+	overrides := make(map[key]database.FeatureFlag, len(stored))
+	for _, f := range stored {
+		if Known(f.Name) {
+			overrides[key{f.Name, f.ProjectID}] = f
+		}
+	}
+	s.mu.Lock()
+	s.overrides = overrides
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Set) run() {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout)
+	defer cancel()
+	if err := s.Refresh(ctx); err != nil {
+		s.l.Error("failed to read the feature flags", "error", err)
+	}
+}
+
+// Start reads the overrides, keeping the defaults when the store is not
+// available, and schedules their refresh.
+func (s *Set) Start() {
+	s.run()
+	s.cron.Start()
+	s.l.Info("feature flags started", "refresh_seconds", s.interval, "defaults", len(s.defaults))
+}
+
+// Stop stops the refresh and waits for the running one, or for ctx to be
+// done.
+func (s *Set) Stop(ctx context.Context) error {
+	select {
+	case <-s.cron.Stop().Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
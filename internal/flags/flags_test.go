@@ -0,0 +1,142 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeStore keeps the overrides in memory.
+type fakeStore struct {
+	flags []database.FeatureFlag
+	err   error
+}
+
+func (f *fakeStore) ListFeatureFlags(ctx context.Context) ([]database.FeatureFlag, error) {
+	return f.flags, f.err
+}
+
+func (f *fakeStore) SetFeatureFlag(ctx context.Context, flag database.FeatureFlag) (database.FeatureFlag, error) {
+	if f.err != nil {
+		return database.FeatureFlag{}, f.err
+	}
+	f.flags = append(f.flags, flag)
+	return flag, nil
+}
+
+func (f *fakeStore) DeleteFeatureFlag(ctx context.Context, name string, projectID int64) error {
+	for i, flag := range f.flags {
+		if flag.Name == name && flag.ProjectID == projectID {
+			f.flags = append(f.flags[:i], f.flags[i+1:]...)
+			return nil
+		}
+	}
+	return database.ErrFeatureFlagNotFound
+}
+
+func newSet(t *testing.T, store Store, defaults ...string) *Set {
+	t.Helper()
+	s, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), defaults, 30, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestNames(t *testing.T) {
+	for _, name := range []string{StrictValidation, AsyncIngest, ResponseEnvelope} {
+		if !Known(name) {
+			t.Errorf("%s is missing from config.FeatureFlagNames", name)
+		}
+	}
+	if len(config.FeatureFlagNames) != 3 {
+		t.Errorf("expected 3 flags, got %v", config.FeatureFlagNames)
+	}
+	if _, err := New(slog.Default(), []string{"dark_mode"}, 30, &fakeStore{}); !errors.Is(err, ErrUnknownFlag) {
+		t.Errorf("expected ErrUnknownFlag, got %v", err)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	store := &fakeStore{flags: []database.FeatureFlag{
+		{Name: ResponseEnvelope, ProjectID: 0, Enabled: true},
+		{Name: ResponseEnvelope, ProjectID: 2, Enabled: false},
+		{Name: StrictValidation, ProjectID: 3, Enabled: true},
+		{Name: "removed_flag", ProjectID: 0, Enabled: true},
+	}}
+	s := newSet(t, store, AsyncIngest)
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		flag      string
+		projectID int64
+		expected  bool
+	}{
+		{name: "default on", flag: AsyncIngest, projectID: 1, expected: true},
+		{name: "default off", flag: StrictValidation, projectID: 1, expected: false},
+		{name: "project override", flag: StrictValidation, projectID: 3, expected: true},
+		{name: "global override", flag: ResponseEnvelope, projectID: 1, expected: true},
+		{name: "project override over global override", flag: ResponseEnvelope, projectID: 2, expected: false},
+		{name: "unknown flag", flag: "removed_flag", projectID: 1, expected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := s.Enabled(tt.projectID, tt.flag); got != tt.expected {
+				t.Errorf("expected %v got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestSetAndDelete(t *testing.T) {
+	store := &fakeStore{}
+	s := newSet(t, store)
+	ctx := context.Background()
+
+	if _, err := s.Set(ctx, database.FeatureFlag{Name: StrictValidation, ProjectID: 4, Enabled: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Enabled(4, StrictValidation) || s.Enabled(1, StrictValidation) {
+		t.Fatal("expected the override to apply to project 4 only")
+	}
+	flags := s.List(4)
+	if len(flags) != 3 || flags[0].Name != StrictValidation || !flags[0].Enabled || len(flags[0].Overrides) != 1 {
+		t.Fatalf("unexpected flags: %+v", flags)
+	}
+	if _, err := s.Set(ctx, database.FeatureFlag{Name: "dark_mode", Enabled: true}); !errors.Is(err, ErrUnknownFlag) {
+		t.Fatalf("expected ErrUnknownFlag, got %v", err)
+	}
+
+	if err := s.Delete(ctx, StrictValidation, 4); err != nil {
+		t.Fatal(err)
+	}
+	if s.Enabled(4, StrictValidation) {
+		t.Fatal("expected the override to be removed")
+	}
+	if err := s.Delete(ctx, StrictValidation, 4); !errors.Is(err, database.ErrFeatureFlagNotFound) {
+		t.Fatalf("expected ErrFeatureFlagNotFound, got %v", err)
+	}
+}
+
+func TestRefreshFailureKeepsOverrides(t *testing.T) {
+	store := &fakeStore{flags: []database.FeatureFlag{{Name: StrictValidation, Enabled: true}}}
+	s := newSet(t, store)
+	if err := s.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store.err = errors.New("connection refused")
+	if err := s.Refresh(context.Background()); err == nil {
+		t.Fatal("expected an error")
+	}
+	if !s.Enabled(1, StrictValidation) {
+		t.Fatal("expected the last overrides to be kept")
+	}
+}
@@ -0,0 +1,260 @@
+// Package importer loads events from CSV or NDJSON files through the
+// database batch insert (COPY) path. Every record is validated with the
+// rules of POST /events; invalid records are counted and reported by line
+// instead of stopping the import.
+package importer
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+type Format string
+
+const (
+	// CSV files start with a header row. The user_id and action columns are
+	// required; metadata holds a JSON object, and any other non-empty column
+	// becomes a metadata key.
+	CSV Format = "csv"
+	// NDJSON files hold one POST /events body per line.
+	NDJSON Format = "ndjson"
+)
+
+// maxErrors bounds the invalid records kept in Stats.Errors.
+const maxErrors = 100
+
+// ParseFormat accepts csv, ndjson and its aliases jsonl and json.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "csv":
+		return CSV, nil
+	case "ndjson", "jsonl", "json":
+		return NDJSON, nil
+	default:
+		return "", fmt.Errorf("unsupported format %q, expected csv or ndjson", s)
+	}
+}
+
+// FormatFromName infers the format from the extension of a file name.
+func FormatFromName(name string) (Format, error) {
+	ext := strings.TrimPrefix(filepath.Ext(name), ".")
+	if ext == "" {
+		return "", fmt.Errorf("cannot infer the format of %q, set it explicitly", name)
+	}
+	return ParseFormat(ext)
+}
+
+type Options struct {
+	// ProjectID receives the events; zero is the default project.
+	ProjectID int64
+	// BatchSize is the number of events per insert.
+	BatchSize int
+	// BatchTimeout bounds the retries of a single insert.
+	BatchTimeout time.Duration
+	// DryRun validates every record without writing anything.
+	DryRun bool
+	// Progress, when set, is called after every batch.
+	Progress func(Stats)
+}
+
+// Stats describes an import in progress or finished.
+type Stats struct {
+	Read     int `json:"read"`
+	Imported int `json:"imported"`
+	Invalid  int `json:"invalid"`
+	// Errors lists the first invalid records, e.g. "line 12: action is required".
+	Errors []string `json:"errors,omitempty"`
+}
+
+func (s *Stats) invalid(line int, err error) {
+	s.Invalid++
+	if len(s.Errors) < maxErrors {
+		s.Errors = append(s.Errors, fmt.Sprintf("line %d: %v", line, err))
+	}
+}
+
+// recordReader yields validated events with the line they were read from.
+// It returns io.EOF at the end of the input and wraps ingest.ErrInvalid for
+// records that are skipped.
+type recordReader func() (ingest.Event, int, error)
+
+// Import reads every record of r and inserts the valid ones in batches. It
+// stops at the first insert that still fails after its retries or when the
+// input cannot be read; the returned stats then tell how far it got.
+func Import(ctx context.Context, db database.Eventter, r io.Reader, format Format, opts Options) (Stats, error) {
+	var next recordReader
+	switch format {
+	case CSV:
+		var err error
+		if next, err = csvReader(r); err != nil {
+			return Stats{}, err
+		}
+	case NDJSON:
+		next = ndjsonReader(r)
+	default:
+		return Stats{}, fmt.Errorf("unsupported format %q", format)
+	}
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1000
+	}
+	if opts.BatchTimeout <= 0 {
+		opts.BatchTimeout = 30 * time.Second
+	}
+
+	var stats Stats
+	batch := make([]ingest.Event, 0, opts.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if !opts.DryRun {
+			storeCtx, cancel := context.WithTimeout(ctx, opts.BatchTimeout)
+			err := ingest.Store(storeCtx, db, "import", batch)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+		stats.Imported += len(batch)
+		batch = batch[:0]
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+		return nil
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		e, line, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if errors.Is(err, ingest.ErrInvalid) {
+			stats.Read++
+			stats.invalid(line, err)
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Read++
+		e.ProjectID = opts.ProjectID
+		batch = append(batch, e)
+		if len(batch) == opts.BatchSize {
+			if err := flush(); err != nil {
+				return stats, err
+			}
+		}
+	}
+	return stats, flush()
+}
+
+func ndjsonReader(r io.Reader) recordReader {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	line := 0
+	return func() (ingest.Event, int, error) {
+		for sc.Scan() {
+			line++
+			data := sc.Bytes()
+			if len(strings.TrimSpace(string(data))) == 0 {
+				continue
+			}
+			e, err := ingest.DecodeJSON(data)
+			return e, line, err
+		}
+		if err := sc.Err(); err != nil {
+			return ingest.Event{}, line, fmt.Errorf("read line %d: %w", line+1, err)
+		}
+		return ingest.Event{}, line, io.EOF
+	}
+}
+
+func csvReader(r io.Reader) (recordReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read csv header: %w", err)
+	}
+	columns := make([]string, len(header))
+	userID, action := -1, -1
+	for i, name := range header {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		switch columns[i] {
+		case "user_id":
+			userID = i
+		case "action":
+			action = i
+		}
+	}
+	if userID < 0 || action < 0 {
+		return nil, fmt.Errorf("csv header must contain the user_id and action columns, got %v", columns)
+	}
+
+	return func() (ingest.Event, int, error) {
+		record, err := cr.Read()
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return ingest.Event{}, parseErr.StartLine, err
+			}
+			return ingest.Event{}, 0, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(record) != len(columns) {
+			return ingest.Event{}, line, fmt.Errorf("%w: expected %d columns got %d", ingest.ErrInvalid, len(columns), len(record))
+		}
+
+		var e ingest.Event
+		for i, value := range record {
+			switch i {
+			case userID:
+				if e.UserID, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64); err != nil {
+					return ingest.Event{}, line, fmt.Errorf("%w: user_id %q is not an integer", ingest.ErrInvalid, value)
+				}
+			case action:
+				e.Action = value
+			default:
+				if value == "" {
+					continue
+				}
+				if e.Metadata == nil {
+					e.Metadata = map[string]string{}
+				}
+				if columns[i] != "metadata" {
+					e.Metadata[columns[i]] = value
+					continue
+				}
+				var m map[string]string
+				if err := json.Unmarshal([]byte(value), &m); err != nil {
+					return ingest.Event{}, line, fmt.Errorf("%w: metadata: %v", ingest.ErrInvalid, err)
+				}
+				for k, v := range m {
+					e.Metadata[k] = v
+				}
+			}
+		}
+		if err := e.Validate(); err != nil {
+			return ingest.Event{}, line, fmt.Errorf("%w: %w", ingest.ErrInvalid, err)
+		}
+		return e, line, nil
+	}, nil
+}
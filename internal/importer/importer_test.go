@@ -0,0 +1,158 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeDB struct {
+	database.Eventter
+	err     error
+	batches [][]database.NewEvent
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.batches = append(f.batches, events)
+	return nil
+}
+
+func TestImport(t *testing.T) {
+	tests := []struct {
+		name           string
+		format         Format
+		input          string
+		dryRun         bool
+		expectErr      string
+		expectRead     int
+		expectImported int
+		expectInvalid  []string
+		expectBatches  int
+		expectMetadata map[string]string
+	}{
+		{
+			name:           "csv",
+			format:         CSV,
+			input:          "user_id,action,page,metadata\n" + `1,click,/home,"{""ref"":""ad""}"` + "\n2,view,,\n3,scroll,/about,\n",
+			expectRead:     3,
+			expectImported: 3,
+			expectBatches:  2,
+			expectMetadata: map[string]string{"page": "/home", "ref": "ad"},
+		},
+		{
+			name:           "csv with invalid rows",
+			format:         CSV,
+			input:          "action,user_id\nclick,1\nclick,abc\n,2\nclick,3,extra\n",
+			expectRead:     4,
+			expectImported: 1,
+			expectInvalid:  []string{"line 3: invalid event: user_id \"abc\"", "line 4: invalid event: action is required", "line 5: invalid event: expected 2 columns got 3"},
+			expectBatches:  1,
+		},
+		{
+			name:      "csv without the required columns",
+			format:    CSV,
+			input:     "id,action\n1,click\n",
+			expectErr: "user_id and action columns",
+		},
+		{
+			name:           "ndjson",
+			format:         NDJSON,
+			input:          "{\"user_id\":1,\"action\":\"click\",\"metadata\":{\"page\":\"/home\"}}\n\n{\"user_id\":0,\"action\":\"click\"}\nnot json\n{\"user_id\":2,\"action\":\"view\"}\n",
+			expectRead:     4,
+			expectImported: 2,
+			expectInvalid:  []string{"line 3: invalid event: user_id must be a positive integer", "line 4: invalid event"},
+			expectBatches:  1,
+			expectMetadata: map[string]string{"page": "/home"},
+		},
+		{
+			name:           "dry run",
+			format:         NDJSON,
+			input:          "{\"user_id\":1,\"action\":\"click\"}\n{\"user_id\":2,\"action\":\"view\"}\n",
+			dryRun:         true,
+			expectRead:     2,
+			expectImported: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeDB{}
+			progress := 0
+			stats, err := Import(context.Background(), db, strings.NewReader(tt.input), tt.format, Options{
+				BatchSize: 2,
+				DryRun:    tt.dryRun,
+				Progress:  func(Stats) { progress++ },
+			})
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Fatalf("expected error containing %q got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("import: %v", err)
+			}
+
+			if stats.Read != tt.expectRead || stats.Imported != tt.expectImported || stats.Invalid != len(tt.expectInvalid) {
+				t.Fatalf("unexpected stats %+v", stats)
+			}
+			for i, want := range tt.expectInvalid {
+				if !strings.HasPrefix(stats.Errors[i], want) {
+					t.Fatalf("expected error %d to start with %q got %q", i, want, stats.Errors[i])
+				}
+			}
+			if len(db.batches) != tt.expectBatches {
+				t.Fatalf("expected %d batches got %d", tt.expectBatches, len(db.batches))
+			}
+			if progress != (tt.expectImported+1)/2 {
+				t.Fatalf("expected progress after every batch, got %d calls", progress)
+			}
+			if tt.expectMetadata != nil {
+				got := db.batches[0][0].Metadata
+				if len(got) != len(tt.expectMetadata) {
+					t.Fatalf("expected metadata %v got %v", tt.expectMetadata, got)
+				}
+				for k, v := range tt.expectMetadata {
+					if got[k] != v {
+						t.Fatalf("expected metadata %v got %v", tt.expectMetadata, got)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestImportStoreFailure(t *testing.T) {
+	db := &fakeDB{err: errors.New("db down")}
+	input := "{\"user_id\":1,\"action\":\"click\"}\n{\"user_id\":2,\"action\":\"view\"}\n"
+	stats, err := Import(context.Background(), db, strings.NewReader(input), NDJSON, Options{
+		BatchSize:    1,
+		BatchTimeout: 50 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatalf("expected the import to stop when the database is down")
+	}
+	if stats.Read != 1 || stats.Imported != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFormatFromName(t *testing.T) {
+	for name, want := range map[string]Format{"events.csv": CSV, "dump.NDJSON": NDJSON, "x.jsonl": NDJSON} {
+		if got, err := FormatFromName(name); err != nil || got != want {
+			t.Fatalf("%s: expected %s got %s (%v)", name, want, got, err)
+		}
+	}
+	for _, name := range []string{"events", "events.xml"} {
+		if _, err := FormatFromName(name); err == nil {
+			t.Fatalf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var (
+	// ErrNotFound is returned for unknown or forgotten job ids.
+	ErrNotFound = errors.New("import job not found")
+	// ErrBusy is returned by Submit while too many jobs are pending.
+	ErrBusy = errors.New("too many pending import jobs")
+	// ErrClosed is returned by Submit once Stop was called.
+	ErrClosed = errors.New("importer is shutting down")
+)
+
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Job is an uploaded file imported in the background.
+type Job struct {
+	ID         string     `json:"id"`
+	ProjectID  int64      `json:"project_id"`
+	File       string     `json:"file"`
+	Format     Format     `json:"format"`
+	Status     JobStatus  `json:"status"`
+	Stats      Stats      `json:"stats"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+
+	path string
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed
+}
+
+var jobsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "import_jobs_total",
+		Help: "Finished import jobs by result: succeeded or failed",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(jobsTotal)
+}
+
+// Jobs runs uploaded imports one at a time. Jobs live in memory: the ones
+// still queued or running when the process stops are marked failed and have
+// to be uploaded again.
+type Jobs struct {
+	l         *slog.Logger
+	db        database.Eventter
+	dir       string
+	batchSize int
+	maxJobs   int
+
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	order  []string
+	closed bool
+	lastID int64
+
+	queue  chan *Job
+	cancel context.CancelFunc
+	ctx    context.Context
+	done   chan struct{}
+}
+
+// NewJobs creates the upload directory of cfg. Files left there by a
+// previous process are removed.
+func NewJobs(logger *slog.Logger, cfg config.ImportConfig, db database.Eventter) (*Jobs, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create import directory: %w", err)
+	}
+	stale, err := filepath.Glob(filepath.Join(cfg.Dir, "*.upload"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range stale {
+		_ = os.Remove(path)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Jobs{
+		l:         logger,
+		db:        db,
+		dir:       cfg.Dir,
+		batchSize: cfg.BatchSize,
+		maxJobs:   cfg.MaxJobs,
+		jobs:      make(map[string]*Job),
+		queue:     make(chan *Job, cfg.MaxJobs),
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// Submit stores r in the upload directory and queues its import into the
+// project.
+func (j *Jobs) Submit(projectID int64, name string, format Format, r io.Reader) (Job, error) {
+	j.mu.Lock()
+	if j.closed {
+		j.mu.Unlock()
+		return Job{}, ErrClosed
+	}
+	if j.pending() >= j.maxJobs {
+		j.mu.Unlock()
+		return Job{}, ErrBusy
+	}
+	id := max(time.Now().UnixNano(), j.lastID+1)
+	j.lastID = id
+	job := &Job{
+		ID:        strconv.FormatInt(id, 10),
+		ProjectID: projectID,
+		File:      filepath.Base(name),
+		Format:    format,
+		Status:    JobQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	job.path = filepath.Join(j.dir, job.ID+".upload")
+	j.mu.Unlock()
+
+	if err := j.save(job.path, r); err != nil {
+		return Job{}, err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		_ = os.Remove(job.path)
+		return Job{}, ErrClosed
+	}
+	// Concurrent uploads may have taken the remaining slots meanwhile
+	select {
+	case j.queue <- job:
+	default:
+		_ = os.Remove(job.path)
+		return Job{}, ErrBusy
+	}
+	j.add(job)
+	return *job, nil
+}
+
+func (j *Jobs) save(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("store upload: %w", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("store upload: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("store upload: %w", err)
+	}
+	return nil
+}
+
+// pending counts the jobs queued or running. j.mu must be held.
+func (j *Jobs) pending() int {
+	n := 0
+	for _, job := range j.jobs {
+		if !job.finished() {
+			n++
+		}
+	}
+	return n
+}
+
+// add registers job and forgets the oldest finished jobs above maxJobs.
+// j.mu must be held.
+func (j *Jobs) add(job *Job) {
+	j.jobs[job.ID] = job
+	j.order = append(j.order, job.ID)
+	for i := 0; len(j.jobs) > j.maxJobs && i < len(j.order); {
+		if old := j.jobs[j.order[i]]; old.finished() {
+			delete(j.jobs, old.ID)
+			j.order = append(j.order[:i], j.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// Get returns a snapshot of a job.
+func (j *Jobs) Get(id string) (Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	return *job, nil
+}
+
+// Start runs queued jobs in the background.
+func (j *Jobs) Start() {
+	go j.run()
+}
+
+// Stop cancels the running job and fails the queued ones, waiting for the
+// worker at most until ctx is done.
+func (j *Jobs) Stop(ctx context.Context) error {
+	j.mu.Lock()
+	if !j.closed {
+		j.closed = true
+		close(j.queue)
+	}
+	j.mu.Unlock()
+	j.cancel()
+
+	select {
+	case <-j.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (j *Jobs) run() {
+	defer close(j.done)
+	for job := range j.queue {
+		if j.ctx.Err() != nil {
+			j.finish(job, Stats{}, errors.New("interrupted by shutdown"))
+			continue
+		}
+		j.process(job)
+	}
+}
+
+func (j *Jobs) process(job *Job) {
+	j.mu.Lock()
+	started := time.Now().UTC()
+	job.Status = JobRunning
+	job.StartedAt = &started
+	j.mu.Unlock()
+
+	f, err := os.Open(job.path)
+	if err != nil {
+		j.finish(job, Stats{}, err)
+		return
+	}
+	defer f.Close()
+
+	stats, err := Import(j.ctx, j.db, f, job.Format, Options{
+		ProjectID: job.ProjectID,
+		BatchSize: j.batchSize,
+		Progress: func(s Stats) {
+			j.mu.Lock()
+			job.Stats = s
+			j.mu.Unlock()
+		},
+	})
+	if errors.Is(err, context.Canceled) {
+		err = errors.New("interrupted by shutdown")
+	}
+	j.finish(job, stats, err)
+}
+
+func (j *Jobs) finish(job *Job, stats Stats, err error) {
+	_ = os.Remove(job.path)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	finished := time.Now().UTC()
+	job.Stats = stats
+	job.FinishedAt = &finished
+	job.Status = JobSucceeded
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+	}
+	jobsTotal.WithLabelValues(string(job.Status)).Inc()
+
+	if err != nil {
+		j.l.Error("import job failed", "id", job.ID, "file", job.File, "imported", stats.Imported, "error", err)
+		return
+	}
+	j.l.Info("import job finished", "id", job.ID, "file", job.File, "imported", stats.Imported, "invalid", stats.Invalid)
+}
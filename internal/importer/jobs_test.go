@@ -0,0 +1,100 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func newJobs(t *testing.T, maxJobs int) *Jobs {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	j, err := NewJobs(logger, config.ImportConfig{Dir: t.TempDir(), BatchSize: 10, MaxJobs: maxJobs}, &fakeDB{})
+	if err != nil {
+		t.Fatalf("new jobs: %v", err)
+	}
+	return j
+}
+
+func waitFinished(t *testing.T, j *Jobs, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := j.Get(id)
+		if err != nil {
+			t.Fatalf("get: %v", err)
+		}
+		if job.finished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return Job{}
+}
+
+func TestJobs(t *testing.T) {
+	j := newJobs(t, 2)
+	j.Start()
+	defer j.Stop(context.Background())
+
+	job, err := j.Submit(0, "events.csv", CSV, strings.NewReader("user_id,action\n1,click\n0,view\n"))
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if job.Status != JobQueued {
+		t.Fatalf("expected a queued job got %+v", job)
+	}
+
+	job = waitFinished(t, j, job.ID)
+	if job.Status != JobSucceeded || job.Stats.Imported != 1 || job.Stats.Invalid != 1 || job.FinishedAt == nil {
+		t.Fatalf("unexpected job %+v", job)
+	}
+	if _, err := os.Stat(job.path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the upload to be removed, stat: %v", err)
+	}
+
+	failed, _ := j.Submit(0, "events.csv", CSV, strings.NewReader("id\n1\n"))
+	if failed = waitFinished(t, j, failed.ID); failed.Status != JobFailed || failed.Error == "" {
+		t.Fatalf("expected a failed job got %+v", failed)
+	}
+
+	// Finished jobs are forgotten, oldest first, above the limit
+	third, _ := j.Submit(0, "events.csv", CSV, strings.NewReader("user_id,action\n1,click\n"))
+	waitFinished(t, j, third.ID)
+	if _, err := j.Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected the oldest job to be forgotten, got %v", err)
+	}
+}
+
+func TestJobsBusy(t *testing.T) {
+	// Without a worker the first job stays queued
+	j := newJobs(t, 1)
+	if _, err := j.Submit(0, "a.ndjson", NDJSON, strings.NewReader("")); err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if _, err := j.Submit(0, "b.ndjson", NDJSON, strings.NewReader("")); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy got %v", err)
+	}
+
+	// Stop fails the queued job
+	j.Start()
+	if err := j.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	for _, job := range j.jobs {
+		if job.Status != JobFailed {
+			t.Fatalf("expected the queued job to fail on shutdown, got %+v", job)
+		}
+	}
+	if _, err := j.Submit(0, "c.ndjson", NDJSON, strings.NewReader("")); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed got %v", err)
+	}
+}
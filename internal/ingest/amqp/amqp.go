@@ -0,0 +1,223 @@
+// Package amqp consumes events from a RabbitMQ queue. Messages are acked
+// once stored. Malformed messages are rejected to the dead-letter exchange;
+// messages that fail to store are requeued until the database accepts them.
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	amqp091 "github.com/rabbitmq/amqp091-go"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const source = "amqp"
+
+type Consumer struct {
+	l       *slog.Logger
+	cfg     config.AMQPConfig
+	db      database.Eventter
+	maxWait time.Duration
+	// storeTimeout bounds the retries of a batch before its messages are
+	// requeued.
+	storeTimeout time.Duration
+
+	stopFetch context.CancelFunc
+	stopStore context.CancelFunc
+	done      chan struct{}
+}
+
+// New creates a consumer for cfg. It connects on Start and reconnects when
+// the connection to the broker is lost.
+func New(logger *slog.Logger, cfg config.AMQPConfig, db database.Eventter) (*Consumer, error) {
+	// Fail fast on a wrong URL or an incompatible queue declaration
+	conn, err := amqp091.Dial(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("connect to rabbitmq: %w", err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("open channel: %w", err)
+	}
+	if err := declare(ch, cfg); err != nil {
+		return nil, err
+	}
+
+	return newConsumer(logger, cfg, db), nil
+}
+
+func newConsumer(logger *slog.Logger, cfg config.AMQPConfig, db database.Eventter) *Consumer {
+	return &Consumer{
+		l:            logger.With("source", source, "queue", cfg.Queue),
+		cfg:          cfg,
+		db:           db,
+		maxWait:      time.Duration(cfg.BatchWaitMillis) * time.Millisecond,
+		storeTimeout: 10 * time.Second,
+		done:         make(chan struct{}),
+	}
+}
+
+// declare creates the durable queue, routing rejected messages to the
+// dead-letter exchange when one is configured.
+func declare(ch *amqp091.Channel, cfg config.AMQPConfig) error {
+	args := amqp091.Table{}
+	if cfg.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = cfg.DeadLetterExchange
+		if cfg.DeadLetterRoutingKey != "" {
+			args["x-dead-letter-routing-key"] = cfg.DeadLetterRoutingKey
+		}
+	}
+	if _, err := ch.QueueDeclare(cfg.Queue, true, false, false, false, args); err != nil {
+		return fmt.Errorf("declare queue %s: %w", cfg.Queue, err)
+	}
+	return nil
+}
+
+// Start consumes in the background until Stop is called.
+func (c *Consumer) Start() {
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	c.stopFetch, c.stopStore = stopFetch, stopStore
+
+	go func() {
+		defer close(c.done)
+		backoff := time.Second
+		for fetchCtx.Err() == nil {
+			if err := c.consume(fetchCtx, storeCtx); err != nil {
+				c.l.Error("rabbitmq consumer interrupted, reconnecting", "retry_in", backoff.String(), "error", err)
+				select {
+				case <-fetchCtx.Done():
+				case <-time.After(backoff):
+				}
+				backoff = min(backoff*2, 30*time.Second)
+				continue
+			}
+			backoff = time.Second
+		}
+	}()
+	c.l.Info("rabbitmq consumer started")
+}
+
+// Stop stops consuming and waits for the batch in progress. When ctx
+// expires first, its unacknowledged messages are requeued by the broker.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.stopFetch()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.stopStore()
+		<-c.done
+	}
+	c.stopStore()
+	return nil
+}
+
+// consume runs one connection until it breaks or fetchCtx is done.
+func (c *Consumer) consume(fetchCtx, storeCtx context.Context) error {
+	conn, err := amqp091.Dial(c.cfg.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := declare(ch, c.cfg); err != nil {
+		return err
+	}
+	if err := ch.Qos(c.cfg.Prefetch, 0, false); err != nil {
+		return err
+	}
+	deliveries, err := ch.Consume(c.cfg.Queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		batch, open := c.collect(fetchCtx, deliveries)
+		if len(batch) > 0 {
+			c.process(storeCtx, batch)
+		}
+		if !open {
+			return fmt.Errorf("delivery channel closed")
+		}
+		if fetchCtx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// collect waits for a first delivery, then gathers more until the batch
+// reaches the prefetch count or maxWait has passed.
+func (c *Consumer) collect(ctx context.Context, deliveries <-chan amqp091.Delivery) ([]amqp091.Delivery, bool) {
+	var batch []amqp091.Delivery
+	select {
+	case <-ctx.Done():
+		return nil, true
+	case d, ok := <-deliveries:
+		if !ok {
+			return nil, false
+		}
+		batch = append(batch, d)
+	}
+
+	timer := time.NewTimer(c.maxWait)
+	defer timer.Stop()
+	for len(batch) < c.cfg.Prefetch {
+		select {
+		case <-ctx.Done():
+			return batch, true
+		case <-timer.C:
+			return batch, true
+		case d, ok := <-deliveries:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, d)
+		}
+	}
+	return batch, true
+}
+
+// process stores the valid deliveries of a batch and settles every one of
+// them.
+func (c *Consumer) process(ctx context.Context, batch []amqp091.Delivery) {
+	events := make([]ingest.Event, 0, len(batch))
+	valid := make([]amqp091.Delivery, 0, len(batch))
+	for _, d := range batch {
+		e, err := ingest.DecodeJSON(d.Body)
+		if err != nil {
+			c.l.Warn("dead-lettering invalid message", "delivery_tag", d.DeliveryTag, "error", err)
+			_ = d.Nack(false, false)
+			continue
+		}
+		events = append(events, e)
+		valid = append(valid, d)
+	}
+	ingest.CountInvalid(source, len(batch)-len(valid))
+
+	ctx, cancel := context.WithTimeout(ctx, c.storeTimeout)
+	defer cancel()
+	if err := ingest.Store(ctx, c.db, source, events); err != nil {
+		c.l.Error("failed to store batch", "messages", len(valid), "error", err)
+		// The messages are valid, so they are kept until the database is
+		// back rather than dead-lettered
+		for _, d := range valid {
+			_ = d.Nack(false, true)
+		}
+		return
+	}
+	for _, d := range valid {
+		if err := d.Ack(false); err != nil {
+			c.l.Warn("ack failed, the message may be stored twice", "delivery_tag", d.DeliveryTag, "error", err)
+		}
+	}
+}
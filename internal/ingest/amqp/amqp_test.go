@@ -0,0 +1,84 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	amqp091 "github.com/rabbitmq/amqp091-go"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeAcknowledger records how every delivery tag was settled.
+type fakeAcknowledger map[uint64]string
+
+func (a fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a[tag] = "ack"
+	return nil
+}
+func (a fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	if requeue {
+		a[tag] = "requeue"
+	} else {
+		a[tag] = "dead-letter"
+	}
+	return nil
+}
+func (a fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+type fakeDB struct {
+	database.Eventter
+	err error
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	return f.err
+}
+
+func TestProcess(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name   string
+		dbErr  error
+		expect map[uint64]string
+	}{
+		{
+			name:   "stored",
+			expect: map[uint64]string{1: "ack", 2: "dead-letter", 3: "ack"},
+		},
+		{
+			name:   "store failure requeues redeliveries too",
+			dbErr:  errors.New("db down"),
+			expect: map[uint64]string{1: "requeue", 2: "dead-letter", 3: "requeue"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ack := fakeAcknowledger{}
+			batch := []amqp091.Delivery{
+				{Acknowledger: ack, DeliveryTag: 1, Body: []byte(`{"user_id":1,"action":"click"}`)},
+				{Acknowledger: ack, DeliveryTag: 2, Body: []byte(`{"user_id":"x"}`)},
+				{Acknowledger: ack, DeliveryTag: 3, Redelivered: true, Body: []byte(`{"user_id":2,"action":"view"}`)},
+			}
+
+			c := newConsumer(logger, config.AMQPConfig{Queue: "events"}, &fakeDB{err: tt.dbErr})
+			c.storeTimeout = 20 * time.Millisecond
+			c.process(context.Background(), batch)
+
+			for tag, want := range tt.expect {
+				if ack[tag] != want {
+					t.Fatalf("delivery %d: expected %s got %q", tag, want, ack[tag])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+// Package buffer implements the write-behind mode of POST /events. Accepted
+// events are queued in a fixed-size in-memory ring and a background flusher
+// inserts them in batches through the COPY path, so that an ingest spike
+// turns into a few large inserts instead of one connection per request.
+//
+// Queued events are lost if the process dies before they are flushed.
+package buffer
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const source = "http"
+
+var (
+	// ErrFull is returned by Enqueue when the ring has no free slot.
+	ErrFull = errors.New("ingest buffer is full")
+	// ErrClosed is returned by Enqueue once Stop has been called.
+	ErrClosed = errors.New("ingest buffer is closed")
+)
+
+var (
+	depth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_buffer_depth",
+		Help: "Events waiting in the write-behind buffer",
+	})
+	capacity = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ingest_buffer_capacity",
+		Help: "Size of the write-behind buffer",
+	})
+	dropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingest_buffer_dropped_total",
+			Help: "Events not stored by the write-behind buffer: rejected because it was full, or lost when a flush was abandoned on shutdown",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(depth, capacity, dropped)
+}
+
+// DeadLetterer keeps batches that could not be stored.
+type DeadLetterer interface {
+	Add(source string, events []ingest.Event, cause error) error
+}
+
+type Buffer struct {
+	l         *slog.Logger
+	db        database.Eventter
+	batchSize int
+	interval  time.Duration
+	// wait bounds how long Enqueue blocks for a free slot.
+	wait time.Duration
+	// dl, when set, receives the batches still failing after maxRetry.
+	dl       DeadLetterer
+	maxRetry time.Duration
+
+	mu     sync.Mutex
+	ring   []ingest.Event
+	head   int
+	n      int
+	closed bool
+	// freed is closed and replaced each time slots are freed, waking up the
+	// callers waiting in Enqueue.
+	freed chan struct{}
+
+	// ready wakes the flusher as soon as a full batch is queued.
+	ready     chan struct{}
+	stopping  chan struct{}
+	stopStore context.CancelFunc
+	done      chan struct{}
+}
+
+func New(logger *slog.Logger, cfg config.BufferConfig, db database.Eventter) *Buffer {
+	capacity.Set(float64(cfg.Size))
+	return &Buffer{
+		l:         logger.With("component", "ingest buffer"),
+		db:        db,
+		batchSize: cfg.FlushBatchSize,
+		interval:  time.Duration(cfg.FlushIntervalMillis) * time.Millisecond,
+		wait:      time.Duration(cfg.EnqueueWaitMillis) * time.Millisecond,
+		ring:      make([]ingest.Event, cfg.Size),
+		freed:     make(chan struct{}),
+		ready:     make(chan struct{}, 1),
+		stopping:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Enqueue queues e for the next flush, to be stored with the current time.
+// When the buffer is full it waits up to the configured enqueue wait (or
+// until ctx is done) for a slot before returning ErrFull.
+func (b *Buffer) Enqueue(ctx context.Context, e ingest.Event) error {
+	if e.AcceptedAt.IsZero() {
+		e.AcceptedAt = time.Now().UTC()
+	}
+	var timeout <-chan time.Time
+	for {
+		freed, err := b.push(e)
+		if !errors.Is(err, ErrFull) {
+			return err
+		}
+		if timeout == nil {
+			if b.wait <= 0 {
+				dropped.WithLabelValues("full").Inc()
+				return ErrFull
+			}
+			timer := time.NewTimer(b.wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-freed:
+		case <-timeout:
+			dropped.WithLabelValues("full").Inc()
+			return ErrFull
+		case <-ctx.Done():
+			dropped.WithLabelValues("full").Inc()
+			return ErrFull
+		}
+	}
+}
+
+// push adds e to the ring. When the ring is full it returns ErrFull and the
+// channel closed once slots are freed.
+func (b *Buffer) push(e ingest.Event) (<-chan struct{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+	if b.n == len(b.ring) {
+		return b.freed, ErrFull
+	}
+	b.ring[(b.head+b.n)%len(b.ring)] = e
+	b.n++
+	depth.Set(float64(b.n))
+
+	if b.n >= b.batchSize {
+		select {
+		case b.ready <- struct{}{}:
+		default:
+		}
+	}
+	return nil, nil
+}
+
+// Len returns the number of queued events.
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.n
+}
+
+// take removes up to max events from the head of the ring.
+func (b *Buffer) take(max int) []ingest.Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	n := min(b.n, max)
+	batch := make([]ingest.Event, n)
+	for i := range batch {
+		slot := (b.head + i) % len(b.ring)
+		batch[i] = b.ring[slot]
+		b.ring[slot] = ingest.Event{}
+	}
+	b.head = (b.head + n) % len(b.ring)
+	b.n -= n
+	depth.Set(float64(b.n))
+
+	if n > 0 {
+		close(b.freed)
+		b.freed = make(chan struct{})
+	}
+	return batch
+}
+
+// DeadLetterTo hands the batches that could not be stored within maxRetry
+// to dl, instead of retrying them until shutdown. It must be called before
+// Start.
+func (b *Buffer) DeadLetterTo(dl DeadLetterer, maxRetry time.Duration) {
+	b.dl, b.maxRetry = dl, maxRetry
+}
+
+// Start runs the flusher until Stop is called.
+func (b *Buffer) Start() {
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	b.stopStore = stopStore
+
+	go func() {
+		defer close(b.done)
+		b.run(storeCtx)
+	}()
+	b.l.Info("ingest buffer started", "size", len(b.ring), "flush_batch_size", b.batchSize, "flush_interval", b.interval.String())
+}
+
+// Stop rejects new events and flushes the queued ones. When ctx expires
+// first, the events not yet stored are dropped.
+func (b *Buffer) Stop(ctx context.Context) error {
+	b.mu.Lock()
+	b.closed = true
+	b.mu.Unlock()
+	close(b.stopping)
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		b.stopStore()
+		<-b.done
+	}
+	b.stopStore()
+	return nil
+}
+
+func (b *Buffer) run(ctx context.Context) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stopping:
+			b.flush(ctx)
+			return
+		case <-ticker.C:
+		case <-b.ready:
+		}
+		b.flush(ctx)
+	}
+}
+
+// flush stores everything queued so far in batches. A failed batch is
+// retried by ingest.Store until ctx is cancelled or, with a dead-letter
+// store, until maxRetry has passed, while new events keep queueing until
+// the ring is full.
+func (b *Buffer) flush(ctx context.Context) {
+	for {
+		batch := b.take(b.batchSize)
+		if len(batch) == 0 {
+			return
+		}
+		if err := b.store(ctx, batch); err != nil {
+			b.fail(batch, err)
+		}
+		if len(batch) < b.batchSize {
+			return
+		}
+	}
+}
+
+func (b *Buffer) store(ctx context.Context, batch []ingest.Event) error {
+	if b.dl != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.maxRetry)
+		defer cancel()
+	}
+	return ingest.Store(ctx, b.db, source, batch)
+}
+
+func (b *Buffer) fail(batch []ingest.Event, err error) {
+	if b.dl != nil {
+		dlErr := b.dl.Add(source, batch, err)
+		if dlErr == nil {
+			return
+		}
+		b.l.Error("failed to dead-letter events", "events", len(batch), "error", dlErr)
+	}
+	b.l.Error("dropping buffered events", "events", len(batch), "error", err)
+	dropped.WithLabelValues("flush_failed").Add(float64(len(batch)))
+}
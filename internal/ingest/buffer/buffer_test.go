@@ -0,0 +1,193 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+type fakeDB struct {
+	database.Eventter
+	mu      sync.Mutex
+	err     error
+	batches [][]database.NewEvent
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.batches = append(f.batches, events)
+	return nil
+}
+
+func (f *fakeDB) stored() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, b := range f.batches {
+		n += len(b)
+	}
+	return n
+}
+
+func newBuffer(db database.Eventter, size, batch int, interval time.Duration) *Buffer {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(logger, config.BufferConfig{
+		Async:               true,
+		Size:                size,
+		FlushBatchSize:      batch,
+		FlushIntervalMillis: int(interval / time.Millisecond),
+	}, db)
+}
+
+func TestEnqueueFull(t *testing.T) {
+	b := newBuffer(&fakeDB{}, 3, 2, time.Hour)
+	for i := range 3 {
+		if err := b.Enqueue(context.Background(), ingest.Event{UserID: int64(i + 1), Action: "click"}); err != nil {
+			t.Fatalf("enqueue %d: %v", i, err)
+		}
+	}
+	if err := b.Enqueue(context.Background(), ingest.Event{UserID: 4, Action: "click"}); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull got %v", err)
+	}
+
+	// Taking frees slots and wraps around the ring
+	if got := b.take(2); len(got) != 2 || got[0].UserID != 1 || got[1].UserID != 2 {
+		t.Fatalf("unexpected batch %+v", got)
+	}
+	_ = b.Enqueue(context.Background(), ingest.Event{UserID: 4, Action: "click"})
+	if got := b.take(10); len(got) != 2 || got[0].UserID != 3 || got[1].UserID != 4 {
+		t.Fatalf("unexpected batch %+v", got)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expected empty buffer got %d", b.Len())
+	}
+}
+
+func TestEnqueueWait(t *testing.T) {
+	b := newBuffer(&fakeDB{}, 1, 1, time.Hour)
+	b.wait = 50 * time.Millisecond
+	_ = b.Enqueue(context.Background(), ingest.Event{UserID: 1, Action: "click"})
+
+	// Nothing is freed within the wait
+	start := time.Now()
+	if err := b.Enqueue(context.Background(), ingest.Event{UserID: 2, Action: "click"}); !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull got %v", err)
+	}
+	if waited := time.Since(start); waited < b.wait {
+		t.Fatalf("expected Enqueue to wait %s, returned after %s", b.wait, waited)
+	}
+
+	// A slot freed during the wait is taken
+	b.wait = time.Second
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		b.take(1)
+	}()
+	if err := b.Enqueue(context.Background(), ingest.Event{UserID: 3, Action: "click"}); err != nil {
+		t.Fatalf("expected the event to be queued once a slot was freed, got %v", err)
+	}
+	if got := b.take(1); len(got) != 1 || got[0].UserID != 3 {
+		t.Fatalf("unexpected batch %+v", got)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	db := &fakeDB{}
+	b := newBuffer(db, 100, 4, time.Hour)
+	b.Start()
+
+	// A full batch is flushed without waiting for the interval
+	for i := range 4 {
+		_ = b.Enqueue(context.Background(), ingest.Event{UserID: int64(i + 1), Action: "click"})
+	}
+	deadline := time.Now().Add(time.Second)
+	for db.stored() < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if db.stored() != 4 {
+		t.Fatalf("expected a full batch to be flushed, stored %d", db.stored())
+	}
+
+	// Stop flushes the rest in batches of at most 4
+	for i := range 6 {
+		_ = b.Enqueue(context.Background(), ingest.Event{UserID: int64(i + 1), Action: "view"})
+	}
+	if err := b.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	if db.stored() != 10 {
+		t.Fatalf("expected 10 stored got %d", db.stored())
+	}
+	for _, batch := range db.batches {
+		if len(batch) > 4 {
+			t.Fatalf("batch of %d exceeds the flush batch size", len(batch))
+		}
+	}
+	if err := b.Enqueue(context.Background(), ingest.Event{UserID: 1, Action: "click"}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed got %v", err)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	db := &fakeDB{err: errors.New("db down")}
+	b := newBuffer(db, 10, 5, time.Hour)
+	b.Start()
+	_ = b.Enqueue(context.Background(), ingest.Event{UserID: 1, Action: "click"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		_ = b.Stop(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Stop did not return after its context expired")
+	}
+	if b.Len() != 0 {
+		t.Fatalf("expected the buffer to be emptied, %d left", b.Len())
+	}
+}
+
+type fakeDeadLetter struct {
+	events []ingest.Event
+}
+
+func (f *fakeDeadLetter) Add(source string, events []ingest.Event, cause error) error {
+	f.events = append(f.events, events...)
+	return nil
+}
+
+func TestDeadLetter(t *testing.T) {
+	dl := &fakeDeadLetter{}
+	b := newBuffer(&fakeDB{err: errors.New("db down")}, 10, 5, time.Hour)
+	b.DeadLetterTo(dl, 20*time.Millisecond)
+	accepted := time.Now()
+	_ = b.Enqueue(context.Background(), ingest.Event{UserID: 1, Action: "click"})
+	_ = b.Enqueue(context.Background(), ingest.Event{UserID: 2, Action: "click"})
+
+	// The batch is dead-lettered once its retries are exhausted instead of
+	// blocking the flusher until shutdown
+	b.flush(context.Background())
+	if len(dl.events) != 2 {
+		t.Fatalf("expected 2 dead-lettered events got %d", len(dl.events))
+	}
+	// They keep the time they were accepted
+	if got := dl.events[0].AcceptedAt; got.Before(accepted) || got.After(time.Now()) {
+		t.Fatalf("expected the accept time of the event, got %v", got)
+	}
+}
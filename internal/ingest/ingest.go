@@ -0,0 +1,215 @@
+// Package ingest holds what the message-queue ingestion sources share with
+// each other and with POST /events: the event validation rules and the
+// batched write to the database.
+package ingest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
+)
+
+// Source is a queue consumer feeding events into the database.
+type Source interface {
+	// Start consumes in the background.
+	Start()
+	// Stop stops consuming and waits for in-flight messages to be stored
+	// and acknowledged, at most until ctx is done.
+	Stop(ctx context.Context) error
+}
+
+// Event is the payload accepted by every ingestion source. Its JSON form is
+// the body of POST /events.
+type Event struct {
+	UserID   int64             `json:"user_id" avro:"user_id"`
+	Action   string            `json:"action" avro:"action"`
+	Metadata map[string]string `json:"metadata" avro:"metadata"`
+	// ProjectID is set by the API from the request's API key; queue
+	// messages without it go to the default project.
+	ProjectID int64 `json:"project_id,omitempty"`
+	// TTLSeconds, when set, removes the event that long after it is
+	// created.
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+	// SchemaVersion is the version of the shape of the event, 1 when
+	// missing.
+	SchemaVersion int `json:"schema_version,omitempty" avro:"schema_version"`
+	// AcceptedAt, when set, is the time the event was accepted, which it
+	// is stored with instead of the time of the insert. It is not part of
+	// the payload.
+	AcceptedAt time.Time `json:"-"`
+}
+
+// Validate applies the same rules as POST /events, including the ones
+// installed with SetRules.
+func (e Event) Validate() error {
+	if e.UserID <= 0 {
+		return NewFieldError("user_id", "out_of_range", "user_id must be a positive integer")
+	}
+	if e.Action == "" {
+		return NewFieldError("action", "required", "action is required")
+	}
+	if e.TTLSeconds < 0 {
+		return NewFieldError("ttl_seconds", "out_of_range", "ttl_seconds must be 0 or a positive integer")
+	}
+	if e.SchemaVersion < 0 {
+		return NewFieldError("schema_version", "out_of_range", "schema_version must be a positive integer")
+	}
+	if r := rules.Load(); r != nil {
+		if err := r.CheckAction(e.Action); err != nil {
+			return err
+		}
+		if err := r.CheckMetadata(e.Metadata); err != nil {
+			return err
+		}
+		return r.CheckSchema(e.SchemaVersion, e.Metadata)
+	}
+	return nil
+}
+
+// TTL is the lifetime of the event, 0 when it is kept.
+func (e Event) TTL() time.Duration {
+	return time.Duration(e.TTLSeconds) * time.Second
+}
+
+// ErrInvalid marks messages that can never be stored; sources drop or
+// dead-letter them instead of retrying.
+var ErrInvalid = errors.New("invalid event")
+
+// DecodeJSON parses and validates a JSON encoded event.
+func DecodeJSON(data []byte) (Event, error) {
+	var e Event
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Event{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := e.Validate(); err != nil {
+		return Event{}, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return e, nil
+}
+
+// EventFromProto converts an AddEvent message of the canonical event model.
+// deliver_at is only honored by POST /events.
+func EventFromProto(m *eventsv1.AddEvent) Event {
+	return Event{
+		UserID:        m.GetUserId(),
+		Action:        m.GetAction(),
+		Metadata:      m.GetMetadata(),
+		ProjectID:     m.GetProjectId(),
+		TTLSeconds:    int(m.GetTtlSeconds()),
+		SchemaVersion: int(m.GetSchemaVersion()),
+	}
+}
+
+// DecodeProtobuf parses and validates an AddEvent message of the canonical
+// event model.
+func DecodeProtobuf(data []byte) (Event, error) {
+	var m eventsv1.AddEvent
+	if err := proto.Unmarshal(data, &m); err != nil {
+		return Event{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	e := EventFromProto(&m)
+	if err := e.Validate(); err != nil {
+		return Event{}, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return e, nil
+}
+
+// Decoder turns a message payload into a validated event.
+type Decoder func(data []byte) (Event, error)
+
+// NewDecoder returns the decoder for format, json, avro or protobuf. Avro
+// payloads are read with the record schema in avroSchemaFile; the Confluent
+// wire format header (magic byte and schema id) is skipped when present.
+// Protobuf payloads are AddEvent messages of proto/events/v1/events.proto.
+func NewDecoder(format, avroSchemaFile string) (Decoder, error) {
+	switch format {
+	case "json":
+		return DecodeJSON, nil
+	case "protobuf":
+		return DecodeProtobuf, nil
+	case "avro":
+		data, err := os.ReadFile(avroSchemaFile)
+		if err != nil {
+			return nil, fmt.Errorf("read avro schema: %w", err)
+		}
+		schema, err := avro.Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parse avro schema %s: %w", avroSchemaFile, err)
+		}
+		return func(data []byte) (Event, error) {
+			// user_id is a positive long, so a plain record never starts with 0
+			if len(data) > 5 && data[0] == 0 {
+				data = data[5:]
+			}
+			var e Event
+			if err := avro.Unmarshal(schema, data, &e); err != nil {
+				return Event{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+			}
+			if err := e.Validate(); err != nil {
+				return Event{}, fmt.Errorf("%w: %w", ErrInvalid, err)
+			}
+			return e, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported payload format %q", format)
+	}
+}
+
+var messagesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ingest_messages_total",
+		Help: "Messages handled by the ingestion sources: stored, invalid (dropped) or failed (write attempt retried)",
+	},
+	[]string{"source", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(messagesTotal)
+}
+
+// CountInvalid records messages a source dropped because they could not be
+// decoded or validated.
+func CountInvalid(source string, n int) {
+	messagesTotal.WithLabelValues(source, "invalid").Add(float64(n))
+}
+
+// Store writes a batch of events through the database batch insert path.
+// Failed writes are retried with backoff until they succeed or ctx is done,
+// so that a source acknowledges messages only once they are persisted.
+func Store(ctx context.Context, db database.Eventter, source string, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	batch := make([]database.NewEvent, len(events))
+	for i, e := range events {
+		batch[i] = database.NewEvent{ProjectID: e.ProjectID, UserID: e.UserID, Action: e.Action, Metadata: e.Metadata, CreatedAt: e.AcceptedAt, TTL: e.TTL(), SchemaVersion: e.SchemaVersion}
+	}
+
+	backoff := 100 * time.Millisecond
+	for {
+		err := db.InsertEvents(ctx, batch)
+		if err == nil {
+			messagesTotal.WithLabelValues(source, "stored").Add(float64(len(batch)))
+			return nil
+		}
+		messagesTotal.WithLabelValues(source, "failed").Add(float64(len(batch)))
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("store %d events: %w", len(batch), err)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 5*time.Second)
+	}
+}
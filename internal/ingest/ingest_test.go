@@ -0,0 +1,160 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
+)
+
+// fakeDB records the batches passed to InsertEvents and fails the first
+// failures calls.
+type fakeDB struct {
+	failures int
+	batches  [][]database.NewEvent
+}
+
+func (f *fakeDB) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return 0, nil
+}
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("db down")
+	}
+	f.batches = append(f.batches, events)
+	return nil
+}
+func (f *fakeDB) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	return nil, nil
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   string
+		expectErr bool
+	}{
+		{name: "valid", payload: `{"user_id":1,"action":"click","metadata":{"page":"/"}}`},
+		{name: "malformed", payload: `{"user_id":`, expectErr: true},
+		{name: "missing action", payload: `{"user_id":1}`, expectErr: true},
+		{name: "non positive user", payload: `{"user_id":0,"action":"click"}`, expectErr: true},
+		{name: "negative ttl", payload: `{"user_id":1,"action":"click","ttl_seconds":-1}`, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := DecodeJSON([]byte(tt.payload))
+			if tt.expectErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("expected ErrInvalid got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e.UserID != 1 || e.Action != "click" || e.Metadata["page"] != "/" {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		})
+	}
+}
+
+func TestAvroDecoder(t *testing.T) {
+	schemaFile := filepath.Join("..", "..", "other", "event.avsc")
+	decode, err := NewDecoder("avro", schemaFile)
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v", err)
+	}
+
+	data, err := os.ReadFile(schemaFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := avro.Marshal(avro.MustParse(string(data)), Event{UserID: 42, Action: "view"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, p := range map[string][]byte{
+		"plain":     payload,
+		"confluent": append([]byte{0, 0, 0, 0, 7}, payload...),
+	} {
+		e, err := decode(p)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if e.UserID != 42 || e.Action != "view" {
+			t.Fatalf("%s: unexpected event %+v", name, e)
+		}
+	}
+}
+
+func TestDecodeProtobuf(t *testing.T) {
+	marshal := func(m *eventsv1.AddEvent) []byte {
+		data, err := proto.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name      string
+		payload   []byte
+		expectErr bool
+	}{
+		{name: "valid", payload: marshal(&eventsv1.AddEvent{UserId: 42, Action: "view", Metadata: map[string]string{"page": "/"}, TtlSeconds: 60, ProjectId: 3})},
+		{name: "malformed", payload: []byte{0x08}, expectErr: true},
+		{name: "missing action", payload: marshal(&eventsv1.AddEvent{UserId: 1}), expectErr: true},
+		{name: "negative ttl", payload: marshal(&eventsv1.AddEvent{UserId: 1, Action: "view", TtlSeconds: -1}), expectErr: true},
+	}
+
+	decode, err := NewDecoder("protobuf", "")
+	if err != nil {
+		t.Fatalf("failed to create decoder: %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := decode(tt.payload)
+			if tt.expectErr {
+				if !errors.Is(err, ErrInvalid) {
+					t.Fatalf("expected ErrInvalid got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if e.UserID != 42 || e.Action != "view" || e.Metadata["page"] != "/" || e.TTLSeconds != 60 || e.ProjectID != 3 {
+				t.Fatalf("unexpected event %+v", e)
+			}
+		})
+	}
+}
+
+func TestStoreRetries(t *testing.T) {
+	db := &fakeDB{failures: 2}
+	err := Store(context.Background(), db, "test", []Event{{UserID: 1, Action: "click"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(db.batches) != 1 || len(db.batches[0]) != 1 {
+		t.Fatalf("expected one stored batch, got %v", db.batches)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	db = &fakeDB{failures: 1000}
+	if err := Store(ctx, db, "test", []Event{{UserID: 1, Action: "click"}}); err == nil {
+		t.Fatal("expected error once the context is done")
+	}
+}
@@ -0,0 +1,215 @@
+// Package kafka consumes events from a Kafka topic as a consumer group
+// member. Offsets are committed only after a batch has been stored, so a
+// crash redelivers the uncommitted messages (at-least-once).
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kafkago "github.com/segmentio/kafka-go"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const source = "kafka"
+
+var consumerLag = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "ingest_kafka_consumer_lag",
+		Help: "Messages between the committed offset of the consumer group and the end of the topic",
+	},
+	[]string{"topic"},
+)
+
+func init() {
+	prometheus.MustRegister(consumerLag)
+}
+
+// reader is the part of *kafkago.Reader used by the consumer.
+type reader interface {
+	FetchMessage(ctx context.Context) (kafkago.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Stats() kafkago.ReaderStats
+	Close() error
+}
+
+type Consumer struct {
+	l         *slog.Logger
+	r         reader
+	newReader func() reader
+	db        database.Eventter
+	decode    ingest.Decoder
+	topic     string
+	size      int
+	maxWait   time.Duration
+	// backoff is the first delay before rejoining the group after a failure
+	backoff time.Duration
+
+	stopFetch context.CancelFunc
+	stopStore context.CancelFunc
+	done      chan struct{}
+}
+
+// New creates a consumer for cfg. It does not connect until Start.
+func New(logger *slog.Logger, cfg config.KafkaConfig, db database.Eventter) (*Consumer, error) {
+	decode, err := ingest.NewDecoder(cfg.Format, cfg.AvroSchemaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	newReader := func() reader {
+		return kafkago.NewReader(kafkago.ReaderConfig{
+			Brokers:  cfg.Brokers,
+			Topic:    cfg.Topic,
+			GroupID:  cfg.GroupID,
+			MaxBytes: 10e6,
+		})
+	}
+
+	return newConsumer(logger, newReader, db, decode, cfg), nil
+}
+
+func newConsumer(logger *slog.Logger, newReader func() reader, db database.Eventter, decode ingest.Decoder, cfg config.KafkaConfig) *Consumer {
+	return &Consumer{
+		l:         logger.With("source", source, "topic", cfg.Topic),
+		r:         newReader(),
+		newReader: newReader,
+		db:        db,
+		decode:    decode,
+		topic:     cfg.Topic,
+		size:      cfg.BatchSize,
+		maxWait:   time.Duration(cfg.BatchWaitMillis) * time.Millisecond,
+		backoff:   time.Second,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start consumes in the background until Stop is called.
+func (c *Consumer) Start() {
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	c.stopFetch, c.stopStore = stopFetch, stopStore
+
+	go func() {
+		defer close(c.done)
+		c.run(fetchCtx, storeCtx)
+	}()
+	c.l.Info("kafka consumer started")
+}
+
+// Stop stops fetching and waits for the batch in progress to be stored and
+// committed. When ctx expires first, the batch is abandoned and will be
+// redelivered to the next consumer.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.stopFetch()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.stopStore()
+		<-c.done
+	}
+	c.stopStore()
+	return c.r.Close()
+}
+
+// run consumes batches until fetchCtx is done. When a fetch, a store or a
+// commit fails, the reader is replaced after a growing delay: the new group
+// member resumes from the committed offsets, so the failed batch is
+// redelivered.
+func (c *Consumer) run(fetchCtx, storeCtx context.Context) {
+	backoff := c.backoff
+	for {
+		err := c.next(fetchCtx, storeCtx)
+		consumerLag.WithLabelValues(c.topic).Set(float64(c.r.Stats().Lag))
+		if err == nil {
+			backoff = c.backoff
+			continue
+		}
+		if fetchCtx.Err() != nil {
+			if !errors.Is(err, context.Canceled) {
+				c.l.Error("kafka consumer stopped", "error", err)
+			}
+			return
+		}
+
+		c.l.Error("kafka consumer interrupted, rejoining the group", "retry_in", backoff.String(), "error", err)
+		select {
+		case <-fetchCtx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+		if err := c.r.Close(); err != nil {
+			c.l.Warn("failed to close kafka reader", "error", err)
+		}
+		c.r = c.newReader()
+	}
+}
+
+// next fetches a batch, then stores and commits it.
+func (c *Consumer) next(fetchCtx, storeCtx context.Context) error {
+	msgs, err := c.fetchBatch(fetchCtx)
+	if len(msgs) > 0 {
+		if err := c.process(storeCtx, msgs); err != nil {
+			return fmt.Errorf("batch of %d messages will be redelivered: %w", len(msgs), err)
+		}
+	}
+	return err
+}
+
+// fetchBatch blocks for the first message, then collects more until the
+// batch is full or maxWait has passed since the first one.
+func (c *Consumer) fetchBatch(ctx context.Context) ([]kafkago.Message, error) {
+	first, err := c.r.FetchMessage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	msgs := []kafkago.Message{first}
+
+	waitCtx, cancel := context.WithTimeout(ctx, c.maxWait)
+	defer cancel()
+	for len(msgs) < c.size {
+		m, err := c.r.FetchMessage(waitCtx)
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				break
+			}
+			return msgs, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+// process stores the valid events of a batch and commits all of its
+// offsets. Invalid messages are logged and skipped: retrying them cannot
+// succeed.
+func (c *Consumer) process(ctx context.Context, msgs []kafkago.Message) error {
+	events := make([]ingest.Event, 0, len(msgs))
+	invalid := 0
+	for _, m := range msgs {
+		e, err := c.decode(m.Value)
+		if err != nil {
+			invalid++
+			c.l.Warn("dropping invalid message", "partition", m.Partition, "offset", m.Offset, "error", err)
+			continue
+		}
+		events = append(events, e)
+	}
+	ingest.CountInvalid(source, invalid)
+
+	if err := ingest.Store(ctx, c.db, source, events); err != nil {
+		return err
+	}
+	if err := c.r.CommitMessages(ctx, msgs...); err != nil {
+		return fmt.Errorf("commit offsets: %w", err)
+	}
+	return nil
+}
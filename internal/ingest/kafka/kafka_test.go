@@ -0,0 +1,126 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// fakeReader is a partition whose fetched and uncommitted messages are
+// delivered again to the next reader, like to a new group member.
+type fakeReader struct {
+	mu         sync.Mutex
+	msgs       []kafkago.Message
+	fetched    []kafkago.Message
+	committed  []kafkago.Message
+	commitErrs int
+}
+
+// rejoin returns the reader of a new group member.
+func (r *fakeReader) rejoin() reader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.fetched, r.msgs...)
+	r.fetched = nil
+	return r
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafkago.Message, error) {
+	r.mu.Lock()
+	if len(r.msgs) > 0 {
+		m := r.msgs[0]
+		r.msgs = r.msgs[1:]
+		r.fetched = append(r.fetched, m)
+		r.mu.Unlock()
+		return m, nil
+	}
+	r.mu.Unlock()
+	<-ctx.Done()
+	return kafkago.Message{}, ctx.Err()
+}
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.commitErrs > 0 {
+		r.commitErrs--
+		return errors.New("rebalance in progress")
+	}
+	r.committed = append(r.committed, msgs...)
+	r.fetched = r.fetched[len(msgs):]
+	return nil
+}
+func (r *fakeReader) Stats() kafkago.ReaderStats { return kafkago.ReaderStats{} }
+func (r *fakeReader) Close() error               { return nil }
+
+type fakeDB struct {
+	database.Eventter
+	mu     sync.Mutex
+	err    error
+	stored []database.NewEvent
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	f.stored = append(f.stored, events...)
+	return nil
+}
+
+func TestConsumer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.KafkaConfig{Topic: "events", BatchSize: 2, BatchWaitMillis: 10}
+
+	tests := []struct {
+		name            string
+		dbErr           error
+		commitErrs      int
+		expectStored    int
+		expectCommitted int
+	}{
+		{name: "valid and invalid messages are committed", expectStored: 2, expectCommitted: 3},
+		{name: "nothing is committed while the database fails", dbErr: errors.New("db down")},
+		// The first batch is stored twice: at-least-once
+		{name: "consumption resumes after a failed commit", commitErrs: 1, expectStored: 3, expectCommitted: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeReader{msgs: []kafkago.Message{
+				{Offset: 1, Value: []byte(`{"user_id":1,"action":"click"}`)},
+				{Offset: 2, Value: []byte(`not json`)},
+				{Offset: 3, Value: []byte(`{"user_id":2,"action":"view"}`)},
+			}, commitErrs: tt.commitErrs}
+			db := &fakeDB{err: tt.dbErr}
+			c := newConsumer(logger, r.rejoin, db, ingest.DecodeJSON, cfg)
+			c.backoff = time.Millisecond
+			c.Start()
+			time.Sleep(100 * time.Millisecond)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			if err := c.Stop(ctx); err != nil {
+				t.Fatalf("unexpected stop error: %v", err)
+			}
+
+			if len(db.stored) != tt.expectStored {
+				t.Fatalf("expected %d stored events got %d", tt.expectStored, len(db.stored))
+			}
+			if len(r.committed) != tt.expectCommitted {
+				t.Fatalf("expected %d committed messages got %d", tt.expectCommitted, len(r.committed))
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package ingest
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// maxLabeledActions bounds the action label of the metrics, since clients
+// choose the actions; the events of later actions are reported as "other".
+const maxLabeledActions = 100
+
+var (
+	eventsIngested = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_ingested_total",
+			Help: "Events stored, by action, whatever the ingestion path",
+		},
+		[]string{"action"},
+	)
+	ingestErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "events_ingest_errors_total",
+			Help: "Events whose insert failed, by action; a retried batch counts every attempt",
+		},
+		[]string{"action"},
+	)
+	batchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "events_batch_size",
+		Help:    "Events per stored batch: batch requests, queue messages, write-behind flushes and imports",
+		Buckets: []float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(eventsIngested, ingestErrors, batchSize)
+}
+
+// Instrumented is a Service counting the events stored through it by
+// action, so that an action dropping to zero, usually after a broken client
+// release, can be alerted on. Every ingestion path stores its events
+// through it.
+type Instrumented struct {
+	database.Service
+
+	mu     sync.Mutex
+	labels map[string]string
+}
+
+func NewInstrumented(svc database.Service) *Instrumented {
+	return &Instrumented{Service: svc, labels: make(map[string]string)}
+}
+
+// label returns the action label of action.
+func (s *Instrumented) label(action string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.labels[action]; ok {
+		return l
+	}
+	l := "other"
+	if len(s.labels) < maxLabeledActions {
+		l = action
+	}
+	s.labels[action] = l
+	return l
+}
+
+func (s *Instrumented) count(action string, err error) {
+	if err != nil {
+		ingestErrors.WithLabelValues(s.label(action)).Inc()
+		return
+	}
+	eventsIngested.WithLabelValues(s.label(action)).Inc()
+}
+
+func (s *Instrumented) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	id, err := s.Service.InsertEvent(ctx, projectID, userID, action, metadata)
+	s.count(action, err)
+	return id, err
+}
+
+// InsertEventOnce counts the events stored, not their duplicates.
+func (s *Instrumented) InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error) {
+	stored, duplicate, err := s.Service.InsertEventOnce(ctx, e, window)
+	if !duplicate {
+		s.count(e.Action, err)
+	}
+	return stored, duplicate, err
+}
+
+// InsertEvents counts every event of a stored batch, including those
+// skipped for a dedupe key already stored.
+func (s *Instrumented) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	if len(events) == 0 {
+		return s.Service.InsertEvents(ctx, events)
+	}
+	err := s.Service.InsertEvents(ctx, events)
+	if err == nil {
+		batchSize.Observe(float64(len(events)))
+	}
+
+	counts := make(map[string]int)
+	for _, e := range events {
+		counts[s.label(e.Action)]++
+	}
+	counter := eventsIngested
+	if err != nil {
+		counter = ingestErrors
+	}
+	for l, n := range counts {
+		counter.WithLabelValues(l).Add(float64(n))
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// serviceDB stands for the whole Service, storing through the fakeDB.
+type serviceDB struct {
+	database.Service
+	db *fakeDB
+}
+
+func (s serviceDB) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return s.db.InsertEvent(ctx, projectID, userID, action, metadata)
+}
+
+func (s serviceDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	return s.db.InsertEvents(ctx, events)
+}
+
+func TestInstrumented(t *testing.T) {
+	db := &fakeDB{}
+	s := NewInstrumented(serviceDB{db: db})
+	ctx := context.Background()
+
+	if _, err := s.InsertEvent(ctx, 0, 1, "metrics-signup", nil); err != nil {
+		t.Fatal(err)
+	}
+	batch := []database.NewEvent{{UserID: 1, Action: "metrics-signup"}, {UserID: 2, Action: "metrics-click"}}
+	if err := s.InsertEvents(ctx, batch); err != nil {
+		t.Fatal(err)
+	}
+	db.failures = 1
+	if err := s.InsertEvents(ctx, batch); err == nil {
+		t.Fatal("expected the batch to fail")
+	}
+
+	if n := testutil.ToFloat64(eventsIngested.WithLabelValues("metrics-signup")); n != 2 {
+		t.Fatalf("expected 2 signups stored got %v", n)
+	}
+	if n := testutil.ToFloat64(ingestErrors.WithLabelValues("metrics-click")); n != 1 {
+		t.Fatalf("expected 1 click failed got %v", n)
+	}
+
+	// Actions beyond the bound share a label
+	for i := range maxLabeledActions {
+		s.label(fmt.Sprint("metrics-", i))
+	}
+	if l := s.label("metrics-new"); l != "other" {
+		t.Fatalf("expected a new action past the bound labelled other got %q", l)
+	}
+	if l := s.label("metrics-signup"); l != "metrics-signup" {
+		t.Fatalf("expected a known action to keep its label got %q", l)
+	}
+}
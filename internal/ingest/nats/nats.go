@@ -0,0 +1,185 @@
+// Package nats consumes events from a NATS JetStream stream through a
+// durable pull consumer. Messages are acked once stored, naked for
+// redelivery when the database fails and terminated when they are invalid.
+package nats
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const source = "nats"
+
+// fetcher is the part of jetstream.Consumer used by the workers.
+type fetcher interface {
+	Fetch(batch int, opts ...jetstream.FetchOpt) (jetstream.MessageBatch, error)
+}
+
+type Consumer struct {
+	l           *slog.Logger
+	nc          *natsgo.Conn
+	cons        fetcher
+	db          database.Eventter
+	concurrency int
+	size        int
+	maxWait     time.Duration
+	// storeTimeout stays below the ack wait, so a batch is naked before the
+	// server redelivers it on its own.
+	storeTimeout time.Duration
+
+	stopFetch context.CancelFunc
+	stopStore context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New connects to NATS and creates or updates the durable consumer.
+func New(logger *slog.Logger, cfg config.NATSConfig, db database.Eventter) (*Consumer, error) {
+	nc, err := natsgo.Connect(cfg.URL, natsgo.Name("simple-events-handler"), natsgo.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("connect to nats: %w", err)
+	}
+	js, err := jetstream.New(nc)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("create jetstream context: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cons, err := js.CreateOrUpdateConsumer(ctx, cfg.Stream, jetstream.ConsumerConfig{
+		Durable:       cfg.Durable,
+		FilterSubject: cfg.Subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		AckWait:       time.Duration(cfg.AckWaitSeconds) * time.Second,
+		MaxAckPending: cfg.Concurrency * cfg.BatchSize,
+	})
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("create consumer %s on stream %s: %w", cfg.Durable, cfg.Stream, err)
+	}
+
+	c := newConsumer(logger, cons, db, cfg)
+	c.nc = nc
+	return c, nil
+}
+
+func newConsumer(logger *slog.Logger, cons fetcher, db database.Eventter, cfg config.NATSConfig) *Consumer {
+	return &Consumer{
+		l:            logger.With("source", source, "stream", cfg.Stream, "durable", cfg.Durable),
+		cons:         cons,
+		db:           db,
+		concurrency:  cfg.Concurrency,
+		size:         cfg.BatchSize,
+		maxWait:      time.Duration(cfg.BatchWaitMillis) * time.Millisecond,
+		storeTimeout: time.Duration(cfg.AckWaitSeconds) * time.Second / 2,
+	}
+}
+
+// Start runs the fetch workers until Stop is called.
+func (c *Consumer) Start() {
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	c.stopFetch, c.stopStore = stopFetch, stopStore
+
+	for range c.concurrency {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.work(fetchCtx, storeCtx)
+		}()
+	}
+	c.l.Info("nats consumer started", "workers", c.concurrency)
+}
+
+// Stop stops fetching and waits for the batches in progress. When ctx
+// expires first they are abandoned; the server redelivers them after the
+// ack wait.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.stopFetch()
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.stopStore()
+		<-done
+	}
+	c.stopStore()
+	if c.nc != nil {
+		c.nc.Close()
+	}
+	return nil
+}
+
+func (c *Consumer) work(fetchCtx, storeCtx context.Context) {
+	for fetchCtx.Err() == nil {
+		batch, err := c.cons.Fetch(c.size, jetstream.FetchMaxWait(c.maxWait))
+		if err != nil {
+			c.l.Warn("fetch failed", "error", err)
+			select {
+			case <-fetchCtx.Done():
+			case <-time.After(c.maxWait):
+			}
+			continue
+		}
+
+		var msgs []jetstream.Msg
+		for m := range batch.Messages() {
+			msgs = append(msgs, m)
+		}
+		if err := batch.Error(); err != nil && err != natsgo.ErrTimeout {
+			c.l.Warn("fetch interrupted", "error", err)
+		}
+		if len(msgs) > 0 {
+			c.process(storeCtx, msgs)
+		}
+	}
+}
+
+// process stores the valid messages of a batch, then acks them, or naks
+// them when the database failed. Invalid messages are terminated so they
+// are not redelivered.
+func (c *Consumer) process(ctx context.Context, msgs []jetstream.Msg) {
+	events := make([]ingest.Event, 0, len(msgs))
+	valid := make([]jetstream.Msg, 0, len(msgs))
+	for _, m := range msgs {
+		e, err := ingest.DecodeJSON(m.Data())
+		if err != nil {
+			c.l.Warn("dropping invalid message", "subject", m.Subject(), "error", err)
+			_ = m.TermWithReason(err.Error())
+			continue
+		}
+		events = append(events, e)
+		valid = append(valid, m)
+	}
+	ingest.CountInvalid(source, len(msgs)-len(valid))
+
+	ctx, cancel := context.WithTimeout(ctx, c.storeTimeout)
+	defer cancel()
+	if err := ingest.Store(ctx, c.db, source, events); err != nil {
+		c.l.Error("failed to store batch, it will be redelivered", "messages", len(valid), "error", err)
+		for _, m := range valid {
+			_ = m.NakWithDelay(c.maxWait)
+		}
+		return
+	}
+	for _, m := range valid {
+		if err := m.Ack(); err != nil {
+			c.l.Warn("ack failed, the message may be stored twice", "subject", m.Subject(), "error", err)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeMsg struct {
+	jetstream.Msg
+	data   string
+	result string
+}
+
+func (m *fakeMsg) Data() []byte                           { return []byte(m.data) }
+func (m *fakeMsg) Subject() string                        { return "events.test" }
+func (m *fakeMsg) Ack() error                             { m.result = "ack"; return nil }
+func (m *fakeMsg) NakWithDelay(delay time.Duration) error { m.result = "nak"; return nil }
+func (m *fakeMsg) TermWithReason(reason string) error     { m.result = "term"; return nil }
+
+type fakeBatch struct {
+	msgs chan jetstream.Msg
+}
+
+func (b *fakeBatch) Messages() <-chan jetstream.Msg { return b.msgs }
+func (b *fakeBatch) Error() error                   { return nil }
+
+// fakeFetcher delivers msgs in the first batch and empty batches afterwards.
+type fakeFetcher struct {
+	mu   sync.Mutex
+	msgs []*fakeMsg
+}
+
+func (f *fakeFetcher) Fetch(batch int, opts ...jetstream.FetchOpt) (jetstream.MessageBatch, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b := &fakeBatch{msgs: make(chan jetstream.Msg, len(f.msgs))}
+	for _, m := range f.msgs {
+		b.msgs <- m
+	}
+	f.msgs = nil
+	close(b.msgs)
+	time.Sleep(time.Millisecond)
+	return b, nil
+}
+
+type fakeDB struct {
+	database.Eventter
+	err error
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	return f.err
+}
+
+func TestConsumer(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	cfg := config.NATSConfig{Concurrency: 2, BatchSize: 10, BatchWaitMillis: 10, AckWaitSeconds: 1}
+
+	tests := []struct {
+		name          string
+		dbErr         error
+		expectValid   string
+		expectInvalid string
+	}{
+		{name: "stored messages are acked", expectValid: "ack", expectInvalid: "term"},
+		{name: "messages are naked while the database fails", dbErr: errors.New("db down"), expectValid: "nak", expectInvalid: "term"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			valid := &fakeMsg{data: `{"user_id":1,"action":"click"}`}
+			invalid := &fakeMsg{data: `{"action":"click"}`}
+			f := &fakeFetcher{msgs: []*fakeMsg{valid, invalid}}
+
+			c := newConsumer(logger, f, &fakeDB{err: tt.dbErr}, cfg)
+			c.Start()
+			time.Sleep(50 * time.Millisecond)
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			if err := c.Stop(ctx); err != nil {
+				t.Fatalf("unexpected stop error: %v", err)
+			}
+
+			if valid.result != tt.expectValid {
+				t.Fatalf("expected valid message %s got %q", tt.expectValid, valid.result)
+			}
+			if invalid.result != tt.expectInvalid {
+				t.Fatalf("expected invalid message %s got %q", tt.expectInvalid, invalid.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Package pubsub consumes events from a Google Cloud Pub/Sub subscription.
+// The client delivers messages one by one under its flow control settings;
+// they are grouped into batches for the database and acked once stored,
+// nacked (redelivered) when the store fails and acked right away when they
+// are invalid.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	gpubsub "cloud.google.com/go/pubsub/v2"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const source = "pubsub"
+
+// message is a received message and how to settle it.
+type message struct {
+	id   string
+	data []byte
+	ack  func()
+	nack func()
+}
+
+type Consumer struct {
+	l       *slog.Logger
+	client  *gpubsub.Client
+	sub     *gpubsub.Subscriber
+	db      database.Eventter
+	size    int
+	maxWait time.Duration
+
+	msgs      chan message
+	stopFetch context.CancelFunc
+	stopStore context.CancelFunc
+	received  chan struct{}
+	done      chan struct{}
+}
+
+// New creates a subscriber for cfg using Application Default Credentials.
+func New(logger *slog.Logger, cfg config.PubSubConfig, db database.Eventter) (*Consumer, error) {
+	client, err := gpubsub.NewClient(context.Background(), cfg.ProjectID)
+	if err != nil {
+		return nil, fmt.Errorf("create pubsub client: %w", err)
+	}
+
+	sub := client.Subscriber(cfg.Subscription)
+	sub.ReceiveSettings.MaxOutstandingMessages = cfg.MaxOutstandingMessages
+	sub.ReceiveSettings.MaxOutstandingBytes = cfg.MaxOutstandingBytes
+	sub.ReceiveSettings.NumGoroutines = cfg.NumGoroutines
+
+	c := newConsumer(logger, db, cfg)
+	c.client, c.sub = client, sub
+	return c, nil
+}
+
+func newConsumer(logger *slog.Logger, db database.Eventter, cfg config.PubSubConfig) *Consumer {
+	return &Consumer{
+		l:        logger.With("source", source, "subscription", cfg.Subscription),
+		db:       db,
+		size:     cfg.BatchSize,
+		maxWait:  time.Duration(cfg.BatchWaitMillis) * time.Millisecond,
+		msgs:     make(chan message, cfg.BatchSize),
+		received: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start receives in the background until Stop is called.
+func (c *Consumer) Start() {
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	c.stopFetch, c.stopStore = stopFetch, stopStore
+
+	go func() {
+		defer close(c.received)
+		c.receive(fetchCtx)
+	}()
+	go func() {
+		defer close(c.done)
+		c.batch(storeCtx)
+	}()
+	c.l.Info("pubsub consumer started")
+}
+
+// Stop stops receiving and waits for the messages in progress. When ctx
+// expires first they are nacked and redelivered.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.stopFetch()
+	<-c.received
+	close(c.msgs)
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.stopStore()
+		<-c.done
+	}
+	c.stopStore()
+	if c.client != nil {
+		return c.client.Close()
+	}
+	return nil
+}
+
+// receive hands every delivered message to the batching loop, restarting
+// the stream when it fails for another reason than Stop.
+func (c *Consumer) receive(ctx context.Context) {
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := c.sub.Receive(ctx, func(ctx context.Context, m *gpubsub.Message) {
+			c.msgs <- message{id: m.ID, data: m.Data, ack: m.Ack, nack: m.Nack}
+		})
+		if err == nil || errors.Is(err, context.Canceled) {
+			continue
+		}
+		c.l.Error("pubsub receive failed, restarting", "retry_in", backoff.String(), "error", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// batch groups received messages and stores them, until the channel is
+// closed by Stop.
+func (c *Consumer) batch(ctx context.Context) {
+	for {
+		first, ok := <-c.msgs
+		if !ok {
+			return
+		}
+		batch := []message{first}
+
+		timer := time.NewTimer(c.maxWait)
+	collect:
+		for len(batch) < c.size {
+			select {
+			case m, ok := <-c.msgs:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, m)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		c.process(ctx, batch)
+	}
+}
+
+func (c *Consumer) process(ctx context.Context, batch []message) {
+	events := make([]ingest.Event, 0, len(batch))
+	valid := make([]message, 0, len(batch))
+	for _, m := range batch {
+		e, err := ingest.DecodeJSON(m.data)
+		if err != nil {
+			c.l.Warn("dropping invalid message", "message_id", m.id, "error", err)
+			m.ack()
+			continue
+		}
+		events = append(events, e)
+		valid = append(valid, m)
+	}
+	ingest.CountInvalid(source, len(batch)-len(valid))
+
+	// Give up after a while so that the messages are redelivered, possibly
+	// to another instance, instead of holding the flow control budget
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if err := ingest.Store(ctx, c.db, source, events); err != nil {
+		c.l.Error("failed to store batch, it will be redelivered", "messages", len(valid), "error", err)
+		for _, m := range valid {
+			m.nack()
+		}
+		return
+	}
+	for _, m := range valid {
+		m.ack()
+	}
+}
@@ -0,0 +1,83 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeDB struct {
+	database.Eventter
+	err     error
+	batches int
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	f.batches++
+	return f.err
+}
+
+func TestBatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name          string
+		dbErr         error
+		expectValid   string
+		expectInvalid string
+		expectBatches int
+	}{
+		{name: "stored messages are acked", expectValid: "ack", expectInvalid: "ack", expectBatches: 2},
+		{name: "messages are nacked when the store fails", dbErr: errors.New("db down"), expectValid: "nack", expectInvalid: "ack"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeDB{err: tt.dbErr}
+			c := newConsumer(logger, db, config.PubSubConfig{BatchSize: 2, BatchWaitMillis: 10})
+
+			var mu sync.Mutex
+			results := map[string]string{}
+			settle := func(id, result string) func() {
+				return func() {
+					mu.Lock()
+					defer mu.Unlock()
+					results[id] = result
+				}
+			}
+			go func() {
+				for _, m := range []struct{ id, data string }{
+					{"1", `{"user_id":1,"action":"click"}`},
+					{"2", `{"user_id":1}`},
+					{"3", `{"user_id":2,"action":"view"}`},
+				} {
+					c.msgs <- message{id: m.id, data: []byte(m.data), ack: settle(m.id, "ack"), nack: settle(m.id, "nack")}
+				}
+				close(c.msgs)
+			}()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.dbErr != nil {
+				cancel()
+			}
+			defer cancel()
+			c.batch(ctx)
+
+			if results["2"] != tt.expectInvalid {
+				t.Fatalf("expected invalid message %s got %q", tt.expectInvalid, results["2"])
+			}
+			if results["1"] != tt.expectValid {
+				t.Fatalf("expected valid message %s got %q", tt.expectValid, results["1"])
+			}
+			if tt.dbErr == nil && db.batches != tt.expectBatches {
+				t.Fatalf("expected %d batches got %d", tt.expectBatches, db.batches)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+// Package redis consumes events from a Redis stream as a member of a
+// consumer group (XREADGROUP). Entries are acknowledged once stored; entries
+// left pending by a failed store or a crashed consumer are reclaimed with
+// XAUTOCLAIM after they have been idle for a while.
+//
+// Producers add the JSON event in the "event" field:
+//
+//	XADD events * event '{"user_id":1,"action":"click"}'
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const (
+	source = "redis"
+	// field holds the JSON encoded event in a stream entry.
+	field = "event"
+)
+
+// client is the part of the Redis API used by the consumer.
+type client interface {
+	XReadGroup(ctx context.Context, a *goredis.XReadGroupArgs) *goredis.XStreamSliceCmd
+	XAutoClaim(ctx context.Context, a *goredis.XAutoClaimArgs) *goredis.XAutoClaimCmd
+	XAck(ctx context.Context, stream, group string, ids ...string) *goredis.IntCmd
+	Close() error
+}
+
+type Consumer struct {
+	l         *slog.Logger
+	rdb       client
+	db        database.Eventter
+	stream    string
+	group     string
+	consumer  string
+	size      int64
+	block     time.Duration
+	claimIdle time.Duration
+
+	stopFetch context.CancelFunc
+	stopStore context.CancelFunc
+	done      chan struct{}
+}
+
+// New connects to Redis and creates the consumer group (and the stream)
+// when they do not exist yet.
+func New(logger *slog.Logger, redisCfg config.RedisConfig, cfg config.RedisStreamConfig, db database.Eventter) (*Consumer, error) {
+	opts, err := goredis.ParseURL(redisCfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("parse redis url: %w", err)
+	}
+	rdb := goredis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// New entries only: the group starts at the end of an existing stream
+	err = rdb.XGroupCreateMkStream(ctx, cfg.Stream, cfg.Group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		_ = rdb.Close()
+		return nil, fmt.Errorf("create consumer group %s on %s: %w", cfg.Group, cfg.Stream, err)
+	}
+
+	consumer := cfg.Consumer
+	if consumer == "" {
+		if consumer, err = os.Hostname(); err != nil {
+			_ = rdb.Close()
+			return nil, fmt.Errorf("REDIS_STREAM_CONSUMER not set and hostname unavailable: %w", err)
+		}
+	}
+
+	cfg.Consumer = consumer
+	return newConsumer(logger, rdb, db, cfg), nil
+}
+
+func newConsumer(logger *slog.Logger, rdb client, db database.Eventter, cfg config.RedisStreamConfig) *Consumer {
+	return &Consumer{
+		l:         logger.With("source", source, "stream", cfg.Stream, "group", cfg.Group, "consumer", cfg.Consumer),
+		rdb:       rdb,
+		db:        db,
+		stream:    cfg.Stream,
+		group:     cfg.Group,
+		consumer:  cfg.Consumer,
+		size:      int64(cfg.BatchSize),
+		block:     time.Duration(cfg.BlockMillis) * time.Millisecond,
+		claimIdle: time.Duration(cfg.ClaimIdleSeconds) * time.Second,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start consumes in the background until Stop is called.
+func (c *Consumer) Start() {
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	c.stopFetch, c.stopStore = stopFetch, stopStore
+
+	go func() {
+		defer close(c.done)
+		c.run(fetchCtx, storeCtx)
+	}()
+	c.l.Info("redis stream consumer started")
+}
+
+// Stop stops reading and waits for the batch in progress. When ctx expires
+// first, the batch stays pending and is reclaimed later.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.stopFetch()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		c.stopStore()
+		<-c.done
+	}
+	c.stopStore()
+	return c.rdb.Close()
+}
+
+func (c *Consumer) run(fetchCtx, storeCtx context.Context) {
+	backoff := time.Second
+	nextClaim := time.Now()
+	for fetchCtx.Err() == nil {
+		var (
+			msgs []goredis.XMessage
+			err  error
+		)
+		if time.Now().After(nextClaim) {
+			msgs, err = c.claim(fetchCtx)
+			nextClaim = time.Now().Add(c.claimIdle / 2)
+		} else {
+			msgs, err = c.read(fetchCtx)
+		}
+		if err != nil {
+			if fetchCtx.Err() != nil {
+				return
+			}
+			c.l.Warn("redis read failed", "retry_in", backoff.String(), "error", err)
+			select {
+			case <-fetchCtx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+
+		if len(msgs) > 0 {
+			c.process(storeCtx, msgs)
+		}
+	}
+}
+
+// read returns new entries, waiting up to block for them.
+func (c *Consumer) read(ctx context.Context) ([]goredis.XMessage, error) {
+	streams, err := c.rdb.XReadGroup(ctx, &goredis.XReadGroupArgs{
+		Group:    c.group,
+		Consumer: c.consumer,
+		Streams:  []string{c.stream, ">"},
+		Count:    c.size,
+		Block:    c.block,
+	}).Result()
+	if errors.Is(err, goredis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []goredis.XMessage
+	for _, s := range streams {
+		msgs = append(msgs, s.Messages...)
+	}
+	return msgs, nil
+}
+
+// claim takes over entries pending for longer than claimIdle, whether they
+// belong to a crashed consumer or failed to store here.
+func (c *Consumer) claim(ctx context.Context) ([]goredis.XMessage, error) {
+	msgs, _, err := c.rdb.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+		Stream:   c.stream,
+		Group:    c.group,
+		Consumer: c.consumer,
+		MinIdle:  c.claimIdle,
+		Start:    "0-0",
+		Count:    c.size,
+	}).Result()
+	if len(msgs) > 0 {
+		c.l.Info("reclaimed pending entries", "entries", len(msgs))
+	}
+	return msgs, err
+}
+
+// process stores the valid entries and acknowledges them together with the
+// invalid ones, which can never be stored. When the store fails nothing is
+// acknowledged and the entries are reclaimed after claimIdle.
+func (c *Consumer) process(ctx context.Context, msgs []goredis.XMessage) {
+	events := make([]ingest.Event, 0, len(msgs))
+	ids := make([]string, 0, len(msgs))
+	var invalid []string
+	for _, m := range msgs {
+		e, err := decode(m)
+		if err != nil {
+			c.l.Warn("dropping invalid entry", "id", m.ID, "error", err)
+			invalid = append(invalid, m.ID)
+			continue
+		}
+		events = append(events, e)
+		ids = append(ids, m.ID)
+	}
+	ingest.CountInvalid(source, len(invalid))
+
+	storeCtx, cancel := context.WithTimeout(ctx, c.claimIdle/2)
+	defer cancel()
+	if err := ingest.Store(storeCtx, c.db, source, events); err != nil {
+		c.l.Error("failed to store batch, it will be reclaimed", "entries", len(ids), "error", err)
+		ids = nil
+	}
+
+	ids = append(ids, invalid...)
+	if len(ids) == 0 {
+		return
+	}
+	ackCtx, cancelAck := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelAck()
+	if err := c.rdb.XAck(ackCtx, c.stream, c.group, ids...).Err(); err != nil {
+		c.l.Warn("ack failed, the entries may be stored twice", "entries", len(ids), "error", err)
+	}
+}
+
+func decode(m goredis.XMessage) (ingest.Event, error) {
+	v, ok := m.Values[field].(string)
+	if !ok {
+		return ingest.Event{}, fmt.Errorf("%w: missing %q field", ingest.ErrInvalid, field)
+	}
+	return ingest.DecodeJSON([]byte(v))
+}
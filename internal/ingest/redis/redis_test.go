@@ -0,0 +1,104 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeClient struct {
+	acked []string
+}
+
+func (f *fakeClient) XReadGroup(ctx context.Context, a *goredis.XReadGroupArgs) *goredis.XStreamSliceCmd {
+	return goredis.NewXStreamSliceCmdResult(nil, goredis.Nil)
+}
+func (f *fakeClient) XAutoClaim(ctx context.Context, a *goredis.XAutoClaimArgs) *goredis.XAutoClaimCmd {
+	return goredis.NewXAutoClaimCmd(ctx)
+}
+func (f *fakeClient) XAck(ctx context.Context, stream, group string, ids ...string) *goredis.IntCmd {
+	f.acked = append(f.acked, ids...)
+	return goredis.NewIntResult(int64(len(ids)), nil)
+}
+func (f *fakeClient) Close() error { return nil }
+
+type fakeDB struct {
+	database.Eventter
+	err    error
+	stored int
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	if f.err == nil {
+		f.stored += len(events)
+	}
+	return f.err
+}
+
+func entry(id string, values map[string]any) goredis.XMessage {
+	return goredis.XMessage{ID: id, Values: values}
+}
+
+func TestProcess(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name         string
+		dbErr        error
+		expectAcked  []string
+		expectStored int
+	}{
+		{
+			name:         "stored and invalid entries are acked",
+			expectAcked:  []string{"1-0", "3-0", "2-0", "4-0"},
+			expectStored: 2,
+		},
+		{
+			name:        "failed entries stay pending",
+			dbErr:       errors.New("db down"),
+			expectAcked: []string{"2-0", "4-0"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeClient{}
+			db := &fakeDB{err: tt.dbErr}
+			c := newConsumer(logger, f, db, config.RedisStreamConfig{
+				Stream:           "events",
+				Group:            "g",
+				Consumer:         "c",
+				ClaimIdleSeconds: 60,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			c.process(ctx, []goredis.XMessage{
+				entry("1-0", map[string]any{"event": `{"user_id":1,"action":"click"}`}),
+				entry("2-0", map[string]any{"event": `{"user_id":-1,"action":"click"}`}),
+				entry("3-0", map[string]any{"event": `{"user_id":2,"action":"view"}`}),
+				entry("4-0", map[string]any{"payload": `{"user_id":3,"action":"view"}`}),
+			})
+
+			if len(f.acked) != len(tt.expectAcked) {
+				t.Fatalf("expected acked %v got %v", tt.expectAcked, f.acked)
+			}
+			for i, id := range tt.expectAcked {
+				if f.acked[i] != id {
+					t.Fatalf("expected acked %v got %v", tt.expectAcked, f.acked)
+				}
+			}
+			if db.stored != tt.expectStored {
+				t.Fatalf("expected %d stored got %d", tt.expectStored, db.stored)
+			}
+		})
+	}
+}
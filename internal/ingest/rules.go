@@ -0,0 +1,253 @@
+package ingest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// ErrActionNotAllowed marks events whose action breaks the configured
+// naming rules. The API answers them with 422 rather than 400.
+var ErrActionNotAllowed = errors.New("action not allowed")
+
+// FieldError is a validation failure of one field of an otherwise well
+// formed event, so that clients can point at the faulty field.
+type FieldError struct {
+	// Field is the JSON name of the field, e.g. action or
+	// metadata.referrer; it is empty when the rule spans several fields.
+	Field string
+	// Code is the machine-readable reason: required, invalid,
+	// out_of_range, too_long, too_many, not_allowed or in_future.
+	Code string
+	// Message tells what the value must look like.
+	Message string
+
+	// err is the sentinel matched with errors.Is, e.g. ErrActionNotAllowed
+	err error
+}
+
+// NewFieldError returns the error of field failing the code rule.
+func NewFieldError(field, code, message string) *FieldError {
+	return &FieldError{Field: field, Code: code, Message: message}
+}
+
+func (e *FieldError) Error() string {
+	if e.err != nil {
+		return e.err.Error() + ": " + e.Message
+	}
+	return e.Message
+}
+
+func (e *FieldError) Unwrap() error { return e.err }
+
+// NestField prefixes the field of the FieldError held by err with path, e.g.
+// events[2], for errors about an element of a list. Other errors are
+// returned as is.
+func NestField(err error, path string) error {
+	var fe *FieldError
+	if !errors.As(err, &fe) {
+		return err
+	}
+	nested := *fe
+	nested.Field = path
+	if fe.Field != "" {
+		nested.Field += "." + fe.Field
+	}
+	return &nested
+}
+
+// Rules are the validation rules configured by the operator, on top of the
+// ones every event must follow.
+type Rules struct {
+	actions   map[string]bool
+	prefixes  []string
+	pattern   *regexp.Regexp
+	maxLength int
+
+	// limits holds the metadata and timestamp limits
+	limits config.ValidationConfig
+	// schemas are the registered schema versions, by version
+	schemas map[int]config.SchemaVersionConfig
+}
+
+// NewRules compiles cfg.
+func NewRules(cfg config.ValidationConfig) (*Rules, error) {
+	r := &Rules{maxLength: cfg.MaxActionLength, limits: cfg}
+	if cfg.ActionPattern != "" {
+		var err error
+		if r.pattern, err = regexp.Compile(`^(?:` + cfg.ActionPattern + `)$`); err != nil {
+			return nil, fmt.Errorf("action pattern: %w", err)
+		}
+	}
+	for _, a := range cfg.AllowedActions {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok {
+			r.prefixes = append(r.prefixes, prefix)
+			continue
+		}
+		if r.actions == nil {
+			r.actions = make(map[string]bool)
+		}
+		r.actions[a] = true
+	}
+	for _, v := range cfg.SchemaVersions {
+		if r.schemas == nil {
+			r.schemas = make(map[int]config.SchemaVersionConfig)
+		}
+		r.schemas[v.Version] = v
+	}
+	return r, nil
+}
+
+// CheckAction reports whether action follows the rules.
+func (r *Rules) CheckAction(action string) error {
+	if r.maxLength > 0 && len(action) > r.maxLength {
+		return &FieldError{Field: "action", Code: "too_long", Message: fmt.Sprintf("action must be at most %d bytes", r.maxLength), err: ErrActionNotAllowed}
+	}
+	if r.pattern != nil && !r.pattern.MatchString(action) {
+		return &FieldError{Field: "action", Code: "invalid", Message: fmt.Sprintf("action %q must match %s", action, r.pattern), err: ErrActionNotAllowed}
+	}
+	if r.actions == nil && r.prefixes == nil {
+		return nil
+	}
+	if r.actions[action] {
+		return nil
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(action, p) {
+			return nil
+		}
+	}
+	return &FieldError{Field: "action", Code: "not_allowed", Message: fmt.Sprintf("action %q is not in the allowlist", action), err: ErrActionNotAllowed}
+}
+
+// CheckMetadata reports whether metadata is within the configured limits.
+func (r *Rules) CheckMetadata(metadata map[string]string) error {
+	l := r.limits
+	if l.MaxMetadataKeys > 0 && len(metadata) > l.MaxMetadataKeys {
+		return NewFieldError("metadata", "too_many", fmt.Sprintf("metadata has %d keys, at most %d are allowed", len(metadata), l.MaxMetadataKeys))
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	total := 0
+	for _, k := range keys {
+		v := metadata[k]
+		if l.MaxMetadataKeyLength > 0 && len(k) > l.MaxMetadataKeyLength {
+			return NewFieldError("metadata", "too_long", fmt.Sprintf("metadata key starting with %q is %d bytes long, at most %d are allowed", k[:min(len(k), 32)], len(k), l.MaxMetadataKeyLength))
+		}
+		if l.MaxMetadataValueLength > 0 && len(v) > l.MaxMetadataValueLength {
+			return NewFieldError("metadata."+k, "too_long", fmt.Sprintf("metadata value of %q is %d bytes long, at most %d are allowed", k, len(v), l.MaxMetadataValueLength))
+		}
+		total += len(k) + len(v)
+	}
+	if l.MaxMetadataBytes > 0 && total > l.MaxMetadataBytes {
+		return NewFieldError("metadata", "too_long", fmt.Sprintf("metadata is %d bytes long, at most %d are allowed", total, l.MaxMetadataBytes))
+	}
+	return nil
+}
+
+// CheckSchema reports whether metadata follows the registered schema
+// version, 1 when 0. Any version is accepted while none is registered, and
+// version 1 unless registered.
+func (r *Rules) CheckSchema(version int, metadata map[string]string) error {
+	if r.schemas == nil {
+		return nil
+	}
+	version = max(version, 1)
+	schema, ok := r.schemas[version]
+	if !ok {
+		if version == 1 {
+			return nil
+		}
+		return NewFieldError("schema_version", "invalid", fmt.Sprintf("schema_version %d is not registered", version))
+	}
+	for _, k := range schema.RequiredMetadata {
+		if _, ok := metadata[k]; !ok {
+			return NewFieldError("metadata."+k, "required", fmt.Sprintf("metadata.%s is required by schema version %d", k, version))
+		}
+	}
+	if len(schema.AllowedMetadata) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !slices.Contains(schema.AllowedMetadata, k) {
+			return NewFieldError("metadata."+k, "not_allowed", fmt.Sprintf("metadata.%s is not part of schema version %d", k, version))
+		}
+	}
+	return nil
+}
+
+// ErrClockSkew marks client timestamps too far in the future.
+var ErrClockSkew = errors.New("timestamp too far in the future")
+
+var clientTimestamps = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "ingest_client_timestamps_total",
+		Help: "Timestamps sent by clients that were rejected or clamped for being in the future, or were late",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(clientTimestamps)
+}
+
+// AdjustCreatedAt applies the clock skew rules installed with SetRules to a
+// timestamp sent by a client: a time too far in the future is rejected with
+// ErrClockSkew, or replaced with now when clamping is configured. late
+// reports a time older than the late event threshold.
+func AdjustCreatedAt(t, now time.Time) (adjusted time.Time, late bool, err error) {
+	r := rules.Load()
+	if r == nil {
+		return t, false, nil
+	}
+	l := r.limits
+	if skew := t.Sub(now); l.MaxFutureSkewSeconds > 0 && skew > time.Duration(l.MaxFutureSkewSeconds)*time.Second {
+		if !l.ClampFutureTimestamps {
+			clientTimestamps.WithLabelValues("rejected").Inc()
+			return t, false, &FieldError{Field: "created_at", Code: "in_future", err: ErrClockSkew, Message: fmt.Sprintf("%s is %s ahead of the server clock, at most %ds are allowed",
+				t.Format(time.RFC3339), skew.Round(time.Second), l.MaxFutureSkewSeconds)}
+		}
+		clientTimestamps.WithLabelValues("clamped").Inc()
+		return now, false, nil
+	}
+	if l.LateEventSeconds > 0 && now.Sub(t) > time.Duration(l.LateEventSeconds)*time.Second {
+		clientTimestamps.WithLabelValues("late").Inc()
+		return t, true, nil
+	}
+	return t, false, nil
+}
+
+var rules atomic.Pointer[Rules]
+
+// SetRules installs the rules applied by Event.Validate; nil removes them.
+// It is safe to call while events are validated, e.g. on reload.
+func SetRules(r *Rules) {
+	rules.Store(r)
+}
+
+// CheckAction applies the action rules installed with SetRules to action,
+// for the actions not sent with an event, e.g. the new name of a rename.
+func CheckAction(action string) error {
+	if r := rules.Load(); r != nil {
+		return r.CheckAction(action)
+	}
+	return nil
+}
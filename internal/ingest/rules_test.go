@@ -0,0 +1,119 @@
+package ingest
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func TestRules(t *testing.T) {
+	r, err := NewRules(config.ValidationConfig{
+		AllowedActions:  []string{"view", "purchase", "github.*"},
+		ActionPattern:   `[a-z][a-z0-9_.]*`,
+		MaxActionLength: 16,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetRules(r)
+	t.Cleanup(func() { SetRules(nil) })
+
+	tests := []struct {
+		action  string
+		allowed bool
+	}{
+		{action: "view", allowed: true},
+		{action: "github.push", allowed: true},
+		{action: "github.pull_request_review", allowed: false},
+		{action: "View", allowed: false},
+		{action: "view ", allowed: false},
+		{action: "checkout", allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			_, err := DecodeJSON([]byte(`{"user_id":1,"action":"` + tt.action + `"}`))
+			if tt.allowed && err != nil {
+				t.Fatalf("expected %q to be allowed, got %v", tt.action, err)
+			}
+			if !tt.allowed && (!errors.Is(err, ErrInvalid) || !errors.Is(err, ErrActionNotAllowed)) {
+				t.Fatalf("expected %q to be rejected, got %v", tt.action, err)
+			}
+		})
+	}
+
+	SetRules(nil)
+	if err := (Event{UserID: 1, Action: "Checkout"}).Validate(); err != nil {
+		t.Fatalf("expected the rules to be removed, got %v", err)
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	r, err := NewRules(config.ValidationConfig{MaxMetadataKeys: 3, MaxMetadataKeyLength: 8, MaxMetadataValueLength: 16, MaxMetadataBytes: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		err      string
+	}{
+		{name: "none"},
+		{name: "within the limits", metadata: map[string]string{"page": "/docs", "ref": "home"}},
+		{name: "too many keys", metadata: map[string]string{"a": "", "b": "", "c": "", "d": ""}, err: "metadata has 4 keys, at most 3 are allowed"},
+		{name: "long key", metadata: map[string]string{"referrer_url": "x"}, err: `metadata key starting with "referrer_url" is 12 bytes long, at most 8 are allowed`},
+		{name: "long value", metadata: map[string]string{"page": "/docs/getting-started"}, err: `metadata value of "page" is 21 bytes long, at most 16 are allowed`},
+		{name: "too large", metadata: map[string]string{"page": "/docs/install", "ref": "/docs/intro"}, err: "metadata is 31 bytes long, at most 30 are allowed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.CheckMetadata(tt.metadata)
+			if tt.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestSchemaVersions(t *testing.T) {
+	r, err := NewRules(config.ValidationConfig{SchemaVersions: []config.SchemaVersionConfig{
+		{Version: 2, RequiredMetadata: []string{"page"}, AllowedMetadata: []string{"page", "ref"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		version  int
+		metadata map[string]string
+		err      string
+	}{
+		{name: "version 1 unregistered", version: 1, metadata: map[string]string{"anything": "x"}},
+		{name: "no version is 1"},
+		{name: "registered", version: 2, metadata: map[string]string{"page": "/docs", "ref": "home"}},
+		{name: "missing required key", version: 2, metadata: map[string]string{"ref": "home"}, err: "metadata.page is required by schema version 2"},
+		{name: "key not allowed", version: 2, metadata: map[string]string{"page": "/docs", "utm": "x"}, err: "metadata.utm is not part of schema version 2"},
+		{name: "unknown version", version: 3, err: "schema_version 3 is not registered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := r.CheckSchema(tt.version, tt.metadata)
+			if tt.err == "" && err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("expected %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	if err := (Event{UserID: 1, Action: "view", SchemaVersion: -1}).Validate(); err == nil {
+		t.Fatal("expected a negative schema_version to be rejected")
+	}
+}
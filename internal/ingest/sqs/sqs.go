@@ -0,0 +1,281 @@
+// Package sqs drains an AWS SQS queue with a pool of long-polling workers.
+// A message is deleted only once its event is stored; until then it stays
+// invisible for the visibility timeout and reappears for another attempt,
+// so a redrive policy on the queue can move repeatedly failing messages to
+// a dead-letter queue.
+package sqs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const source = "sqs"
+
+// Metrics follow the names of the CloudWatch SQS metrics so dashboards
+// built for one read naturally for the other.
+var (
+	messagesReceived = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingest_sqs_number_of_messages_received_total",
+			Help: "Messages returned by ReceiveMessage",
+		},
+		[]string{"queue"},
+	)
+	emptyReceives = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingest_sqs_number_of_empty_receives_total",
+			Help: "ReceiveMessage calls that returned no message",
+		},
+		[]string{"queue"},
+	)
+	messagesDeleted = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingest_sqs_number_of_messages_deleted_total",
+			Help: "Messages deleted after being stored or found invalid",
+		},
+		[]string{"queue"},
+	)
+	messagesRetried = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ingest_sqs_number_of_messages_retried_total",
+			Help: "Messages left on the queue for another attempt after a failed store",
+		},
+		[]string{"queue"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(messagesReceived, emptyReceives, messagesDeleted, messagesRetried)
+}
+
+// client is the part of the SQS API used by the workers.
+type client interface {
+	ReceiveMessage(ctx context.Context, in *awssqs.ReceiveMessageInput, opts ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error)
+	DeleteMessageBatch(ctx context.Context, in *awssqs.DeleteMessageBatchInput, opts ...func(*awssqs.Options)) (*awssqs.DeleteMessageBatchOutput, error)
+	ChangeMessageVisibilityBatch(ctx context.Context, in *awssqs.ChangeMessageVisibilityBatchInput, opts ...func(*awssqs.Options)) (*awssqs.ChangeMessageVisibilityBatchOutput, error)
+}
+
+type Consumer struct {
+	l          *slog.Logger
+	client     client
+	db         database.Eventter
+	queueURL   string
+	queue      string
+	workers    int
+	wait       int32
+	visibility int32
+
+	stopFetch context.CancelFunc
+	stopStore context.CancelFunc
+	wg        sync.WaitGroup
+}
+
+// New creates a worker pool for cfg using the default AWS credential chain.
+func New(logger *slog.Logger, cfg config.SQSConfig, db database.Eventter) (*Consumer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if cfg.Region != "" {
+		opts = append(opts, awsconfig.WithRegion(cfg.Region))
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("load aws config: %w", err)
+	}
+
+	c := awssqs.NewFromConfig(awsCfg, func(o *awssqs.Options) {
+		if cfg.Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.Endpoint)
+		}
+	})
+	return newConsumer(logger, c, db, cfg), nil
+}
+
+func newConsumer(logger *slog.Logger, c client, db database.Eventter, cfg config.SQSConfig) *Consumer {
+	queue := path.Base(cfg.QueueURL)
+	return &Consumer{
+		l:          logger.With("source", source, "queue", queue),
+		client:     c,
+		db:         db,
+		queueURL:   cfg.QueueURL,
+		queue:      queue,
+		workers:    cfg.Workers,
+		wait:       int32(cfg.WaitSeconds),
+		visibility: int32(cfg.VisibilityTimeoutSeconds),
+	}
+}
+
+// Start runs the polling workers until Stop is called.
+func (c *Consumer) Start() {
+	fetchCtx, stopFetch := context.WithCancel(context.Background())
+	storeCtx, stopStore := context.WithCancel(context.Background())
+	c.stopFetch, c.stopStore = stopFetch, stopStore
+
+	for range c.workers {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.work(fetchCtx, storeCtx)
+		}()
+	}
+	c.l.Info("sqs consumer started", "workers", c.workers)
+}
+
+// Stop stops polling and waits for the batches in progress. When ctx
+// expires first they are abandoned and reappear after the visibility
+// timeout.
+func (c *Consumer) Stop(ctx context.Context) error {
+	c.stopFetch()
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		c.stopStore()
+		<-done
+	}
+	c.stopStore()
+	return nil
+}
+
+func (c *Consumer) work(fetchCtx, storeCtx context.Context) {
+	backoff := time.Second
+	for fetchCtx.Err() == nil {
+		out, err := c.client.ReceiveMessage(fetchCtx, &awssqs.ReceiveMessageInput{
+			QueueUrl:                    aws.String(c.queueURL),
+			MaxNumberOfMessages:         10,
+			WaitTimeSeconds:             c.wait,
+			VisibilityTimeout:           c.visibility,
+			MessageSystemAttributeNames: []types.MessageSystemAttributeName{types.MessageSystemAttributeNameApproximateReceiveCount},
+		})
+		if err != nil {
+			if fetchCtx.Err() != nil {
+				return
+			}
+			c.l.Warn("receive failed", "retry_in", backoff.String(), "error", err)
+			select {
+			case <-fetchCtx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, 30*time.Second)
+			continue
+		}
+		backoff = time.Second
+
+		if len(out.Messages) == 0 {
+			emptyReceives.WithLabelValues(c.queue).Inc()
+			continue
+		}
+		messagesReceived.WithLabelValues(c.queue).Add(float64(len(out.Messages)))
+		c.process(storeCtx, out.Messages)
+	}
+}
+
+// process stores the valid messages and deletes them together with the
+// invalid ones, which can never be stored. When the store fails, the
+// messages are made visible again after a delay growing with their receive
+// count.
+func (c *Consumer) process(ctx context.Context, msgs []types.Message) {
+	events := make([]ingest.Event, 0, len(msgs))
+	valid := make([]types.Message, 0, len(msgs))
+	var invalid []types.Message
+	for _, m := range msgs {
+		e, err := ingest.DecodeJSON([]byte(aws.ToString(m.Body)))
+		if err != nil {
+			c.l.Warn("deleting invalid message", "message_id", aws.ToString(m.MessageId), "error", err)
+			invalid = append(invalid, m)
+			continue
+		}
+		events = append(events, e)
+		valid = append(valid, m)
+	}
+	ingest.CountInvalid(source, len(invalid))
+
+	// Store before the messages become visible to other workers again
+	storeCtx, cancel := context.WithTimeout(ctx, time.Duration(c.visibility)*time.Second/2)
+	defer cancel()
+	if err := ingest.Store(storeCtx, c.db, source, events); err != nil {
+		c.l.Error("failed to store batch, it will be retried", "messages", len(valid), "error", err)
+		c.retryLater(valid)
+		c.delete(invalid)
+		return
+	}
+	c.delete(append(valid, invalid...))
+}
+
+func (c *Consumer) delete(msgs []types.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	entries := make([]types.DeleteMessageBatchRequestEntry, len(msgs))
+	for i, m := range msgs {
+		entries[i] = types.DeleteMessageBatchRequestEntry{Id: aws.String(strconv.Itoa(i)), ReceiptHandle: m.ReceiptHandle}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := c.client.DeleteMessageBatch(ctx, &awssqs.DeleteMessageBatchInput{QueueUrl: aws.String(c.queueURL), Entries: entries})
+	if err != nil {
+		c.l.Warn("delete failed, the messages may be stored twice", "messages", len(msgs), "error", err)
+		return
+	}
+	for _, f := range out.Failed {
+		c.l.Warn("delete failed, the message may be stored twice", "entry", aws.ToString(f.Id), "error", aws.ToString(f.Message))
+	}
+	messagesDeleted.WithLabelValues(c.queue).Add(float64(len(out.Successful)))
+}
+
+// retryLater shortens the visibility timeout of the messages to an
+// exponential backoff based on how often they were received, instead of
+// letting them wait for the full timeout.
+func (c *Consumer) retryLater(msgs []types.Message) {
+	if len(msgs) == 0 {
+		return
+	}
+	entries := make([]types.ChangeMessageVisibilityBatchRequestEntry, len(msgs))
+	for i, m := range msgs {
+		entries[i] = types.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			ReceiptHandle:     m.ReceiptHandle,
+			VisibilityTimeout: retryDelay(m, c.visibility),
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := c.client.ChangeMessageVisibilityBatch(ctx, &awssqs.ChangeMessageVisibilityBatchInput{QueueUrl: aws.String(c.queueURL), Entries: entries}); err != nil {
+		c.l.Warn("failed to reschedule messages, they reappear after the visibility timeout", "error", err)
+	}
+	messagesRetried.WithLabelValues(c.queue).Add(float64(len(msgs)))
+}
+
+// retryDelay is 2^(receives-1) seconds, capped by the visibility timeout.
+func retryDelay(m types.Message, visibility int32) int32 {
+	receives, _ := strconv.Atoi(m.Attributes[string(types.MessageSystemAttributeNameApproximateReceiveCount)])
+	delay := int32(1)
+	for i := 1; i < receives && delay < visibility; i++ {
+		delay *= 2
+	}
+	return min(delay, visibility)
+}
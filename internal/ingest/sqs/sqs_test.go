@@ -0,0 +1,120 @@
+package sqs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awssqs "github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeClient struct {
+	deleted     []string
+	rescheduled map[string]int32
+}
+
+func (f *fakeClient) ReceiveMessage(ctx context.Context, in *awssqs.ReceiveMessageInput, opts ...func(*awssqs.Options)) (*awssqs.ReceiveMessageOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+func (f *fakeClient) DeleteMessageBatch(ctx context.Context, in *awssqs.DeleteMessageBatchInput, opts ...func(*awssqs.Options)) (*awssqs.DeleteMessageBatchOutput, error) {
+	out := &awssqs.DeleteMessageBatchOutput{}
+	for _, e := range in.Entries {
+		f.deleted = append(f.deleted, aws.ToString(e.ReceiptHandle))
+		out.Successful = append(out.Successful, types.DeleteMessageBatchResultEntry{Id: e.Id})
+	}
+	return out, nil
+}
+func (f *fakeClient) ChangeMessageVisibilityBatch(ctx context.Context, in *awssqs.ChangeMessageVisibilityBatchInput, opts ...func(*awssqs.Options)) (*awssqs.ChangeMessageVisibilityBatchOutput, error) {
+	for _, e := range in.Entries {
+		f.rescheduled[aws.ToString(e.ReceiptHandle)] = e.VisibilityTimeout
+	}
+	return &awssqs.ChangeMessageVisibilityBatchOutput{}, nil
+}
+
+type fakeDB struct {
+	database.Eventter
+	err error
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	return f.err
+}
+
+func message(handle, body, receives string) types.Message {
+	return types.Message{
+		MessageId:     aws.String(handle),
+		ReceiptHandle: aws.String(handle),
+		Body:          aws.String(body),
+		Attributes:    map[string]string{"ApproximateReceiveCount": receives},
+	}
+}
+
+func TestProcess(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name              string
+		dbErr             error
+		expectDeleted     []string
+		expectRescheduled map[string]int32
+	}{
+		{
+			name:              "stored and invalid messages are deleted",
+			expectDeleted:     []string{"a", "c", "b"},
+			expectRescheduled: map[string]int32{},
+		},
+		{
+			name:              "failed messages are rescheduled with backoff",
+			dbErr:             errors.New("db down"),
+			expectDeleted:     []string{"b"},
+			expectRescheduled: map[string]int32{"a": 1, "c": 4},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeClient{rescheduled: map[string]int32{}}
+			c := newConsumer(logger, f, &fakeDB{err: tt.dbErr}, config.SQSConfig{
+				QueueURL:                 "https://sqs.eu-west-1.amazonaws.com/123/events",
+				VisibilityTimeoutSeconds: 30,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			c.process(ctx, []types.Message{
+				message("a", `{"user_id":1,"action":"click"}`, "1"),
+				message("b", `{"user_id":-1,"action":"click"}`, "1"),
+				message("c", `{"user_id":2,"action":"view"}`, "3"),
+			})
+
+			if len(f.deleted) != len(tt.expectDeleted) {
+				t.Fatalf("expected deleted %v got %v", tt.expectDeleted, f.deleted)
+			}
+			for i, h := range tt.expectDeleted {
+				if f.deleted[i] != h {
+					t.Fatalf("expected deleted %v got %v", tt.expectDeleted, f.deleted)
+				}
+			}
+			if len(f.rescheduled) != len(tt.expectRescheduled) {
+				t.Fatalf("expected rescheduled %v got %v", tt.expectRescheduled, f.rescheduled)
+			}
+			for h, v := range tt.expectRescheduled {
+				if f.rescheduled[h] != v {
+					t.Fatalf("expected rescheduled %v got %v", tt.expectRescheduled, f.rescheduled)
+				}
+			}
+			if c.queue != "events" {
+				t.Fatalf("expected queue name events got %q", c.queue)
+			}
+		})
+	}
+}
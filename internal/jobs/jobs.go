@@ -0,0 +1,356 @@
+// Package jobs runs the background jobs of the projects, such as large
+// exports, user erasures and aggregate backfills. Jobs are queued in the
+// jobs table and claimed by the workers of every instance; a job reports
+// its progress while it runs, and the file it writes, its artifact, can be
+// downloaded once it succeeded.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var (
+	// ErrUnknownKind is returned by Submit for the kinds without a handler.
+	ErrUnknownKind = errors.New("unknown job kind")
+	// ErrInvalidParams wraps the validation errors of the params of a job.
+	ErrInvalidParams = errors.New("invalid job params")
+	// ErrNoArtifact is returned for the jobs without a downloadable file.
+	ErrNoArtifact = errors.New("job has no artifact")
+)
+
+const (
+	// maxAttempts bounds the runs of a job whose instance stopped during
+	// the run, so that a job crashing its instance is not run forever.
+	maxAttempts = 3
+	// pollInterval is how often an idle worker looks for queued jobs.
+	pollInterval = time.Second
+	// cleanupInterval is how often the expired jobs are deleted.
+	cleanupInterval = time.Minute
+)
+
+var jobsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "background_jobs_total",
+		Help: "Finished background jobs by kind and result: succeeded or failed",
+	},
+	[]string{"kind", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(jobsTotal)
+}
+
+// Store keeps the jobs, such as a database.JobStore.
+type Store interface {
+	CreateJob(ctx context.Context, projectID int64, kind string, params json.RawMessage) (database.Job, error)
+	GetJob(ctx context.Context, id int64) (database.Job, error)
+	ClaimJob(ctx context.Context, staleBefore time.Time) (database.Job, bool, error)
+	ReportJob(ctx context.Context, id, done, total int64) error
+	FinishJob(ctx context.Context, id int64, status database.JobStatus, jobErr, artifact string) error
+	ReleaseJob(ctx context.Context, id int64) error
+	DeleteFinishedJobs(ctx context.Context, before time.Time) ([]database.Job, error)
+}
+
+// Handler runs the jobs of a kind.
+type Handler interface {
+	// Validate checks the params of a job before it is queued.
+	Validate(params json.RawMessage) error
+	// Run does the work of job, reporting its progress and writing its
+	// artifact through t, until ctx is done.
+	Run(ctx context.Context, job database.Job, t *Task) error
+}
+
+// Task is the running job given to a Handler.
+type Task struct {
+	dir      string
+	job      database.Job
+	done     atomic.Int64
+	total    atomic.Int64
+	artifact string
+}
+
+// Progress records that done units of work out of total are done. It is
+// cheap: the progress is stored with the heartbeat of the job.
+func (t *Task) Progress(done, total int64) {
+	t.done.Store(done)
+	t.total.Store(total)
+}
+
+// CreateArtifact creates the file of the job, named name when downloaded.
+// A job has a single artifact, removed when the job fails.
+func (t *Task) CreateArtifact(name string) (*os.File, error) {
+	if t.artifact != "" {
+		return nil, fmt.Errorf("job %d already created its artifact %s", t.job.ID, t.artifact)
+	}
+	f, err := os.Create(artifactPath(t.dir, t.job.ID, name))
+	if err != nil {
+		return nil, err
+	}
+	t.artifact = name
+	return f, nil
+}
+
+func artifactPath(dir string, id int64, name string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d-%s", id, filepath.Base(name)))
+}
+
+// Pool runs the queued jobs with its workers.
+type Pool struct {
+	l         *slog.Logger
+	store     Store
+	handlers  map[string]Handler
+	dir       string
+	workers   int
+	stale     time.Duration
+	retention time.Duration
+	now       func() time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates the artifact directory of cfg and a pool running the jobs of
+// the kinds of handlers.
+func New(logger *slog.Logger, cfg config.JobsConfig, store Store, handlers map[string]Handler) (*Pool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create jobs directory: %w", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Pool{
+		l:         logger,
+		store:     store,
+		handlers:  handlers,
+		dir:       cfg.Dir,
+		workers:   cfg.Workers,
+		stale:     time.Duration(cfg.StaleSeconds) * time.Second,
+		retention: time.Duration(cfg.RetentionHours) * time.Hour,
+		now:       time.Now,
+		ctx:       ctx,
+		cancel:    cancel,
+	}, nil
+}
+
+// Submit validates the params of a job of kind and queues it.
+func (p *Pool) Submit(ctx context.Context, projectID int64, kind string, params json.RawMessage) (database.Job, error) {
+	h, ok := p.handlers[kind]
+	if !ok {
+		return database.Job{}, fmt.Errorf("%w: %q", ErrUnknownKind, kind)
+	}
+	if len(params) == 0 {
+		params = json.RawMessage(`{}`)
+	}
+	if err := h.Validate(params); err != nil {
+		return database.Job{}, fmt.Errorf("%w: %w", ErrInvalidParams, err)
+	}
+	return p.store.CreateJob(ctx, projectID, kind, params)
+}
+
+func (p *Pool) Get(ctx context.Context, id int64) (database.Job, error) {
+	return p.store.GetJob(ctx, id)
+}
+
+// ArtifactPath returns the file written by a succeeded job.
+func (p *Pool) ArtifactPath(job database.Job) (string, error) {
+	if job.Status != database.JobSucceeded || job.Artifact == "" {
+		return "", ErrNoArtifact
+	}
+	return artifactPath(p.dir, job.ID, job.Artifact), nil
+}
+
+// Start runs the workers and the deletion of the expired jobs.
+func (p *Pool) Start() {
+	for range p.workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.work()
+		}()
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.cleanup()
+	}()
+	p.l.Info("background jobs started", "workers", p.workers)
+}
+
+// Stop cancels the running jobs, which are queued again for the next
+// instance, and waits for the workers, or for ctx to be done.
+func (p *Pool) Stop(ctx context.Context) error {
+	p.cancel()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) work() {
+	for {
+		ran, err := p.runNext(p.ctx)
+		if err != nil && p.ctx.Err() == nil {
+			p.l.Error("failed to claim a background job", "error", err)
+		}
+		if ran && err == nil {
+			continue
+		}
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// runNext claims a job and runs it. It reports whether a job was claimed.
+func (p *Pool) runNext(ctx context.Context) (bool, error) {
+	job, ok, err := p.store.ClaimJob(ctx, p.now().Add(-p.stale))
+	if err != nil || !ok {
+		return false, err
+	}
+
+	h, known := p.handlers[job.Kind]
+	switch {
+	case !known:
+		p.finish(job, nil, fmt.Errorf("%w: %q", ErrUnknownKind, job.Kind))
+		return true, nil
+	case job.Attempts > maxAttempts:
+		p.finish(job, nil, fmt.Errorf("stopped %d times while running", job.Attempts-1))
+		return true, nil
+	}
+
+	p.l.Info("background job started", "id", job.ID, "kind", job.Kind, "attempt", job.Attempts)
+	t := &Task{dir: p.dir, job: job}
+	heartbeat, stopHeartbeat := context.WithCancel(context.Background())
+	beating := make(chan struct{})
+	go func() {
+		defer close(beating)
+		p.beat(heartbeat, t)
+	}()
+	err = h.Run(ctx, job, t)
+	stopHeartbeat()
+	<-beating
+
+	if ctx.Err() != nil {
+		p.release(job, t)
+		return true, nil
+	}
+	p.finish(job, t, err)
+	return true, nil
+}
+
+// beat stores the progress of t, which keeps its job claimed, until ctx
+// is done.
+func (p *Pool) beat(ctx context.Context, t *Task) {
+	ticker := time.NewTicker(p.stale / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.store.ReportJob(ctx, t.job.ID, t.done.Load(), t.total.Load()); err != nil && ctx.Err() == nil {
+				p.l.Warn("failed to report background job progress", "id", t.job.ID, "error", err)
+			}
+		}
+	}
+}
+
+// release queues a job interrupted by shutdown again.
+func (p *Pool) release(job database.Job, t *Task) {
+	p.removeArtifact(job.ID, t.artifact)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.store.ReleaseJob(ctx, job.ID); err != nil {
+		p.l.Error("failed to release background job", "id", job.ID, "error", err)
+		return
+	}
+	p.l.Info("background job interrupted by shutdown, queued again", "id", job.ID, "kind", job.Kind)
+}
+
+// finish records the outcome of job. t is nil for the jobs not run.
+func (p *Pool) finish(job database.Job, t *Task, runErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	status, msg, artifact := database.JobSucceeded, "", ""
+	if t != nil {
+		artifact = t.artifact
+		if err := p.store.ReportJob(ctx, job.ID, t.done.Load(), t.total.Load()); err != nil {
+			p.l.Warn("failed to report background job progress", "id", job.ID, "error", err)
+		}
+	}
+	if runErr != nil {
+		status, msg = database.JobFailed, runErr.Error()
+		p.removeArtifact(job.ID, artifact)
+		artifact = ""
+	}
+	jobsTotal.WithLabelValues(job.Kind, string(status)).Inc()
+	if err := p.store.FinishJob(ctx, job.ID, status, msg, artifact); err != nil {
+		p.l.Error("failed to finish background job", "id", job.ID, "status", status, "error", err)
+		return
+	}
+	if runErr != nil {
+		p.l.Error("background job failed", "id", job.ID, "kind", job.Kind, "error", runErr)
+		return
+	}
+	p.l.Info("background job finished", "id", job.ID, "kind", job.Kind)
+}
+
+func (p *Pool) removeArtifact(id int64, name string) {
+	if name == "" {
+		return
+	}
+	if err := os.Remove(artifactPath(p.dir, id, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		p.l.Warn("failed to remove background job artifact", "id", id, "error", err)
+	}
+}
+
+// cleanup deletes the jobs finished more than the retention ago, and their
+// artifacts, until the pool stops.
+func (p *Pool) cleanup() {
+	ticker := time.NewTicker(cleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+			p.deleteExpired(p.ctx)
+		}
+	}
+}
+
+func (p *Pool) deleteExpired(ctx context.Context) {
+	jobs, err := p.store.DeleteFinishedJobs(ctx, p.now().Add(-p.retention))
+	if err != nil {
+		if ctx.Err() == nil {
+			p.l.Error("failed to delete expired background jobs", "error", err)
+		}
+		return
+	}
+	for _, job := range jobs {
+		p.removeArtifact(job.ID, job.Artifact)
+	}
+}
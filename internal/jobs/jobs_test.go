@@ -0,0 +1,258 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// memStore keeps the jobs in memory and claims them in id order.
+type memStore struct {
+	jobs     map[int64]*database.Job
+	nextID   int64
+	released []int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{jobs: map[int64]*database.Job{}}
+}
+
+func (m *memStore) CreateJob(ctx context.Context, projectID int64, kind string, params json.RawMessage) (database.Job, error) {
+	m.nextID++
+	j := &database.Job{ID: m.nextID, ProjectID: projectID, Kind: kind, Params: params, Status: database.JobQueued}
+	m.jobs[j.ID] = j
+	return *j, nil
+}
+
+func (m *memStore) GetJob(ctx context.Context, id int64) (database.Job, error) {
+	j, ok := m.jobs[id]
+	if !ok {
+		return database.Job{}, database.ErrJobNotFound
+	}
+	return *j, nil
+}
+
+func (m *memStore) ClaimJob(ctx context.Context, staleBefore time.Time) (database.Job, bool, error) {
+	for id := int64(1); id <= m.nextID; id++ {
+		if j, ok := m.jobs[id]; ok && j.Status == database.JobQueued {
+			j.Status = database.JobRunning
+			j.Attempts++
+			return *j, true, nil
+		}
+	}
+	return database.Job{}, false, nil
+}
+
+func (m *memStore) ReportJob(ctx context.Context, id, done, total int64) error {
+	m.jobs[id].Done, m.jobs[id].Total = done, total
+	return nil
+}
+
+func (m *memStore) FinishJob(ctx context.Context, id int64, status database.JobStatus, jobErr, artifact string) error {
+	j := m.jobs[id]
+	j.Status, j.Error, j.Artifact = status, jobErr, artifact
+	finished := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	j.FinishedAt = &finished
+	return nil
+}
+
+func (m *memStore) ReleaseJob(ctx context.Context, id int64) error {
+	m.jobs[id].Status = database.JobQueued
+	m.jobs[id].Attempts--
+	m.released = append(m.released, id)
+	return nil
+}
+
+func (m *memStore) DeleteFinishedJobs(ctx context.Context, before time.Time) ([]database.Job, error) {
+	var deleted []database.Job
+	for id, j := range m.jobs {
+		if j.FinishedAt != nil && j.FinishedAt.Before(before) {
+			deleted = append(deleted, *j)
+			delete(m.jobs, id)
+		}
+	}
+	return deleted, nil
+}
+
+// funcHandler runs jobs with run and accepts the params holding "ok".
+type funcHandler struct {
+	run func(ctx context.Context, t *Task) error
+}
+
+func (h funcHandler) Validate(params json.RawMessage) error {
+	if !strings.Contains(string(params), "ok") {
+		return errors.New("params must be ok")
+	}
+	return nil
+}
+
+func (h funcHandler) Run(ctx context.Context, job database.Job, t *Task) error {
+	return h.run(ctx, t)
+}
+
+func writeArtifact(ctx context.Context, t *Task) error {
+	f, err := t.CreateArtifact("out.txt")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	t.Progress(3, 3)
+	_, err = f.WriteString("done")
+	return err
+}
+
+func newPool(t *testing.T, store Store, handlers map[string]Handler) *Pool {
+	t.Helper()
+	p, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.JobsConfig{Dir: t.TempDir(), Workers: 1, StaleSeconds: 60, RetentionHours: 24}, store, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSubmit(t *testing.T) {
+	store := newMemStore()
+	p := newPool(t, store, map[string]Handler{"ok": funcHandler{}})
+
+	if _, err := p.Submit(context.Background(), 1, "missing", nil); !errors.Is(err, ErrUnknownKind) {
+		t.Fatalf("expected ErrUnknownKind, got %v", err)
+	}
+	if _, err := p.Submit(context.Background(), 1, "ok", json.RawMessage(`{}`)); !errors.Is(err, ErrInvalidParams) {
+		t.Fatalf("expected ErrInvalidParams, got %v", err)
+	}
+	job, err := p.Submit(context.Background(), 7, "ok", json.RawMessage(`{"ok":true}`))
+	if err != nil || job.Status != database.JobQueued || job.ProjectID != 7 {
+		t.Fatalf("expected a queued job of project 7, got %+v: %v", job, err)
+	}
+}
+
+func TestRunNext(t *testing.T) {
+	tests := []struct {
+		name           string
+		run            func(ctx context.Context, t *Task) error
+		kind           string
+		attempts       int
+		cancel         bool
+		expectStatus   database.JobStatus
+		expectError    string
+		expectArtifact bool
+		expectReleased bool
+	}{
+		{name: "succeeded with an artifact", run: writeArtifact, kind: "ok", expectStatus: database.JobSucceeded, expectArtifact: true},
+		{
+			name: "failed run removes its artifact",
+			run: func(ctx context.Context, t *Task) error {
+				if err := writeArtifact(ctx, t); err != nil {
+					return err
+				}
+				return errors.New("disk full")
+			},
+			kind:         "ok",
+			expectStatus: database.JobFailed,
+			expectError:  "disk full",
+		},
+		{name: "unknown kind", kind: "gone", expectStatus: database.JobFailed, expectError: "unknown job kind"},
+		{name: "too many attempts", run: writeArtifact, kind: "ok", attempts: maxAttempts, expectStatus: database.JobFailed, expectError: "stopped 3 times"},
+		{
+			name: "shutdown queues the job again",
+			run: func(ctx context.Context, t *Task) error {
+				if err := writeArtifact(ctx, t); err != nil {
+					return err
+				}
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			kind:           "ok",
+			cancel:         true,
+			expectStatus:   database.JobQueued,
+			expectReleased: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newMemStore()
+			p := newPool(t, store, map[string]Handler{"ok": funcHandler{run: tt.run}})
+			job, _ := store.CreateJob(context.Background(), 1, tt.kind, json.RawMessage(`{"ok":true}`))
+			store.jobs[job.ID].Attempts = tt.attempts
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			ran, err := p.runNext(ctx)
+			if err != nil || !ran {
+				t.Fatalf("expected a job to run, got %v: %v", ran, err)
+			}
+
+			got := store.jobs[job.ID]
+			if got.Status != tt.expectStatus || !strings.Contains(got.Error, tt.expectError) {
+				t.Fatalf("expected %s %q, got %s %q", tt.expectStatus, tt.expectError, got.Status, got.Error)
+			}
+			if (len(store.released) > 0) != tt.expectReleased {
+				t.Fatalf("expected released %v, got %v", tt.expectReleased, store.released)
+			}
+			path, err := p.ArtifactPath(*got)
+			if (err == nil) != tt.expectArtifact {
+				t.Fatalf("expected artifact %v, got %q: %v", tt.expectArtifact, path, err)
+			}
+			if tt.expectArtifact {
+				if b, err := os.ReadFile(path); err != nil || string(b) != "done" || got.Done != 3 {
+					t.Fatalf("unexpected artifact %q after %d: %v", b, got.Done, err)
+				}
+			}
+			// Only the artifact of a succeeded job is kept
+			files, _ := os.ReadDir(p.dir)
+			if len(files) != map[bool]int{true: 1}[tt.expectArtifact] {
+				t.Fatalf("unexpected files %v", files)
+			}
+		})
+	}
+
+	t.Run("nothing queued", func(t *testing.T) {
+		p := newPool(t, newMemStore(), nil)
+		if ran, err := p.runNext(context.Background()); ran || err != nil {
+			t.Fatalf("expected no job to run, got %v: %v", ran, err)
+		}
+	})
+}
+
+func TestDeleteExpired(t *testing.T) {
+	store := newMemStore()
+	p := newPool(t, store, map[string]Handler{"ok": funcHandler{run: writeArtifact}})
+	job, _ := store.CreateJob(context.Background(), 1, "ok", json.RawMessage(`{"ok":true}`))
+	if _, err := p.runNext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	queued, _ := store.CreateJob(context.Background(), 1, "ok", json.RawMessage(`{"ok":true}`))
+
+	finished := *store.jobs[job.ID].FinishedAt
+	p.now = func() time.Time { return finished.Add(23 * time.Hour) }
+	p.deleteExpired(context.Background())
+	if _, err := store.GetJob(context.Background(), job.ID); err != nil {
+		t.Fatalf("expected the job to be kept within the retention: %v", err)
+	}
+
+	p.now = func() time.Time { return finished.Add(25 * time.Hour) }
+	p.deleteExpired(context.Background())
+	if _, err := store.GetJob(context.Background(), job.ID); !errors.Is(err, database.ErrJobNotFound) {
+		t.Fatalf("expected the job to be deleted, got %v", err)
+	}
+	if _, err := store.GetJob(context.Background(), queued.ID); err != nil {
+		t.Fatalf("expected the queued job to be kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(p.dir, "1-out.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the artifact to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,417 @@
+package jobs
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// The kinds of the jobs run by the handlers of this package.
+const (
+	KindExport    = "export"
+	KindEraseUser = "erase_user"
+	KindBackfill  = "backfill_hours"
+	KindRename    = "rename_action"
+	KindDualWrite = "verify_dual_write"
+)
+
+// EventStreamer reads the events of a project, such as a database.Service.
+type EventStreamer interface {
+	StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error
+}
+
+// ExportParams selects the events of [From, To) of the project, of UserID
+// when set, written as ndjson (the default) or csv.
+type ExportParams struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	UserID *int64    `json:"user_id,omitempty"`
+	Format string    `json:"format,omitempty"`
+}
+
+// Exporter writes the events selected by ExportParams to the artifact
+// events.ndjson or events.csv, newest first.
+type Exporter struct {
+	events EventStreamer
+	count  database.EventMaintainer
+}
+
+func NewExporter(events EventStreamer, count database.EventMaintainer) *Exporter {
+	return &Exporter{events: events, count: count}
+}
+
+func (e *Exporter) Validate(raw json.RawMessage) error {
+	var p ExportParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	return p.validate()
+}
+
+func (p ExportParams) validate() error {
+	if p.From.IsZero() || p.To.IsZero() || !p.From.Before(p.To) {
+		return ingest.NewFieldError("to", "out_of_range", "from and to are required, and to must be after from")
+	}
+	if p.Format != "" && p.Format != "ndjson" && p.Format != "csv" {
+		return ingest.NewFieldError("format", "invalid", "format must be ndjson or csv")
+	}
+	return nil
+}
+
+func (e *Exporter) Run(ctx context.Context, job database.Job, t *Task) error {
+	var p ExportParams
+	if err := json.Unmarshal(job.Params, &p); err != nil {
+		return err
+	}
+	total, err := e.count.Count(ctx, database.EventFilter{ProjectID: &job.ProjectID, UserID: p.UserID, From: p.From, To: p.To})
+	if err != nil {
+		return err
+	}
+	t.Progress(0, total)
+
+	format := p.Format
+	if format == "" {
+		format = "ndjson"
+	}
+	f, err := t.CreateArtifact("events." + format)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	write := func(ev database.Event) error {
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+		if err := cw.Write([]string{"id", "user_id", "action", "metadata_page", "created_at"}); err != nil {
+			return err
+		}
+		write = func(ev database.Event) error {
+			var page string
+			if ev.MetadataPage != nil {
+				page = *ev.MetadataPage
+			}
+			return cw.Write([]string{strconv.FormatInt(ev.ID, 10), strconv.FormatInt(ev.UserID, 10), ev.Action, page, ev.CreatedAt.UTC().Format(time.RFC3339Nano)})
+		}
+	}
+
+	// The end of StreamEvents is inclusive, timestamps have microseconds
+	end := p.To.Add(-time.Microsecond)
+	var done int64
+	err = e.events.StreamEvents(ctx, job.ProjectID, p.UserID, &p.From, &end, 0, func(ev database.Event) error {
+		if err := write(ev); err != nil {
+			return err
+		}
+		done++
+		t.Progress(done, max(total, done))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if cw != nil {
+		if cw.Flush(); cw.Error() != nil {
+			return cw.Error()
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// EraseParams selects the user whose events are erased.
+type EraseParams struct {
+	UserID int64 `json:"user_id"`
+}
+
+// Eraser deletes every event of a user of the project, for data subject
+// erasure requests.
+type Eraser struct {
+	events database.EventMaintainer
+}
+
+func NewEraser(events database.EventMaintainer) *Eraser {
+	return &Eraser{events: events}
+}
+
+func (e *Eraser) Validate(raw json.RawMessage) error {
+	var p EraseParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if p.UserID <= 0 {
+		return ingest.NewFieldError("user_id", "out_of_range", "user_id must be a positive integer")
+	}
+	return nil
+}
+
+// allTime bounds the creation times of every event.
+var allTime = database.EventFilter{From: time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+func (e *Eraser) Run(ctx context.Context, job database.Job, t *Task) error {
+	var p EraseParams
+	if err := json.Unmarshal(job.Params, &p); err != nil {
+		return err
+	}
+	f := allTime
+	f.ProjectID, f.UserID = &job.ProjectID, &p.UserID
+	n, err := e.events.Delete(ctx, f)
+	t.Progress(n, n)
+	return err
+}
+
+// BackfillParams selects the hours recounted, [From, To) widened to whole
+// UTC hours.
+type BackfillParams struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// HourCounter counts the hourly aggregates again, such as a
+// database.BackfillStore.
+type HourCounter interface {
+	RecountHours(ctx context.Context, from, to time.Time) error
+}
+
+// Backfiller counts the hourly aggregates of a range again, a day at a
+// time, so that a failed job keeps the days done.
+type Backfiller struct {
+	store HourCounter
+	now   func() time.Time
+}
+
+func NewBackfiller(store HourCounter) *Backfiller {
+	return &Backfiller{store: store, now: time.Now}
+}
+
+func (b *Backfiller) Validate(raw json.RawMessage) error {
+	var p BackfillParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if p.From.IsZero() || p.To.IsZero() || !p.From.Before(p.To) {
+		return ingest.NewFieldError("to", "out_of_range", "from and to are required, and to must be after from")
+	}
+	if p.To.After(b.now()) {
+		return ingest.NewFieldError("to", "out_of_range", "to must not be in the future")
+	}
+	return nil
+}
+
+func (b *Backfiller) Run(ctx context.Context, job database.Job, t *Task) error {
+	var p BackfillParams
+	if err := json.Unmarshal(job.Params, &p); err != nil {
+		return err
+	}
+	from := p.From.UTC().Truncate(time.Hour)
+	to := p.To.UTC().Add(time.Hour - time.Nanosecond).Truncate(time.Hour)
+	days := int64((to.Sub(from) + 24*time.Hour - 1) / (24 * time.Hour))
+	t.Progress(0, days)
+	for day := int64(0); day < days; day++ {
+		start := from.Add(time.Duration(day) * 24 * time.Hour)
+		end := start.Add(24 * time.Hour)
+		if end.After(to) {
+			end = to
+		}
+		if err := b.store.RecountHours(ctx, start, end); err != nil {
+			return fmt.Errorf("recount the hours from %s: %w", start.Format(time.RFC3339), err)
+		}
+		t.Progress(day+1, days)
+	}
+	return nil
+}
+
+// RenameParams renames the action From of the events of the project to To.
+type RenameParams struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ActionRenamer renames the action of stored events with their aggregates,
+// such as a database.RenameStore.
+type ActionRenamer interface {
+	CountAction(ctx context.Context, projectID int64, action string) (int64, error)
+	RenameActions(ctx context.Context, projectID int64, from, to string, limit int) (int64, error)
+}
+
+// renameBatch is the number of events renamed by each UPDATE, so that the
+// locks are held briefly and a failed job keeps the batches done.
+const renameBatch = 1000
+
+// Renamer renames an action across the events of a project, after the
+// product renamed it.
+type Renamer struct {
+	store ActionRenamer
+}
+
+func NewRenamer(store ActionRenamer) *Renamer {
+	return &Renamer{store: store}
+}
+
+func (r *Renamer) Validate(raw json.RawMessage) error {
+	var p RenameParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if p.From == "" {
+		return ingest.NewFieldError("from", "required", "from is required")
+	}
+	if p.To == "" {
+		return ingest.NewFieldError("to", "required", "to is required")
+	}
+	if p.From == p.To {
+		return ingest.NewFieldError("to", "invalid", "to must differ from from")
+	}
+	// The new name must be accepted like the actions of new events
+	if err := ingest.CheckAction(p.To); err != nil {
+		var fe *ingest.FieldError
+		if errors.As(err, &fe) {
+			renamed := *fe
+			renamed.Field = "to"
+			return &renamed
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Renamer) Run(ctx context.Context, job database.Job, t *Task) error {
+	var p RenameParams
+	if err := json.Unmarshal(job.Params, &p); err != nil {
+		return err
+	}
+	total, err := r.store.CountAction(ctx, job.ProjectID, p.From)
+	if err != nil {
+		return err
+	}
+	t.Progress(0, total)
+	var done int64
+	for {
+		n, err := r.store.RenameActions(ctx, job.ProjectID, p.From, p.To, renameBatch)
+		if err != nil {
+			return fmt.Errorf("rename %q after %d events: %w", p.From, done, err)
+		}
+		if n == 0 {
+			return nil
+		}
+		done += n
+		t.Progress(done, max(total, done))
+	}
+}
+
+// DualWriteParams selects the days compared, [From, To) split in days from
+// From. From defaults to the start of the dual write and To to now. With
+// Repair, the events missing from events_v2 are copied and the copies of
+// deleted events removed before each day is compared.
+type DualWriteParams struct {
+	From   time.Time `json:"from"`
+	To     time.Time `json:"to"`
+	Repair bool      `json:"repair,omitempty"`
+}
+
+// DualWriteChecker compares the events with their copies in events_v2,
+// such as a database.DualWriteStore.
+type DualWriteChecker interface {
+	GetDualWrite(ctx context.Context) (database.DualWrite, error)
+	CountDualWrite(ctx context.Context, from, to time.Time) (events, copies int64, err error)
+	RepairDualWrite(ctx context.Context, from, to time.Time) (copied, deleted int64, err error)
+}
+
+// maxReportedDays bounds the days listed in the error of a failed
+// verification.
+const maxReportedDays = 10
+
+// DualWriteVerifier checks that events_v2 holds as many events as events,
+// a day at a time, while the dual write is enabled. It fails with the days
+// that differ, so that the reads move to events_v2 only once a job
+// succeeded.
+type DualWriteVerifier struct {
+	store DualWriteChecker
+	now   func() time.Time
+}
+
+func NewDualWriteVerifier(store DualWriteChecker) *DualWriteVerifier {
+	return &DualWriteVerifier{store: store, now: time.Now}
+}
+
+func (v *DualWriteVerifier) Validate(raw json.RawMessage) error {
+	var p DualWriteParams
+	if err := json.Unmarshal(raw, &p); err != nil {
+		return err
+	}
+	if !p.From.IsZero() && !p.To.IsZero() && !p.From.Before(p.To) {
+		return ingest.NewFieldError("to", "out_of_range", "to must be after from")
+	}
+	return nil
+}
+
+func (v *DualWriteVerifier) Run(ctx context.Context, job database.Job, t *Task) error {
+	var p DualWriteParams
+	if err := json.Unmarshal(job.Params, &p); err != nil {
+		return err
+	}
+	state, err := v.store.GetDualWrite(ctx)
+	if err != nil {
+		return err
+	}
+	if !state.Enabled {
+		return errors.New("the dual write is disabled")
+	}
+	from, to := p.From, p.To
+	if from.IsZero() && state.StartedAt != nil {
+		from = *state.StartedAt
+	}
+	if to.IsZero() {
+		to = v.now()
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("nothing to compare from %s to %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	days := int64((to.Sub(from) + 24*time.Hour - 1) / (24 * time.Hour))
+	t.Progress(0, days)
+	var differ []string
+	for day := int64(0); day < days; day++ {
+		start := from.Add(time.Duration(day) * 24 * time.Hour)
+		end := start.Add(24 * time.Hour)
+		if end.After(to) {
+			end = to
+		}
+		if p.Repair {
+			if _, _, err := v.store.RepairDualWrite(ctx, start, end); err != nil {
+				return fmt.Errorf("repair the copies from %s: %w", start.Format(time.RFC3339), err)
+			}
+		}
+		events, copies, err := v.store.CountDualWrite(ctx, start, end)
+		if err != nil {
+			return fmt.Errorf("count the events from %s: %w", start.Format(time.RFC3339), err)
+		}
+		if events != copies {
+			differ = append(differ, fmt.Sprintf("%s: %d events, %d copies", start.Format(time.RFC3339), events, copies))
+		}
+		t.Progress(day+1, days)
+	}
+	if len(differ) > 0 {
+		listed := differ[:min(len(differ), maxReportedDays)]
+		return fmt.Errorf("%d of %d days differ: %s", len(differ), days, strings.Join(listed, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,356 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// fakeEvents streams events and counts and deletes them, recording the
+// last filter.
+type fakeEvents struct {
+	events []database.Event
+	end    time.Time
+	filter database.EventFilter
+}
+
+func (f *fakeEvents) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	f.end = *end
+	for _, e := range f.events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeEvents) Count(ctx context.Context, filter database.EventFilter) (int64, error) {
+	f.filter = filter
+	return int64(len(f.events)), nil
+}
+
+func (f *fakeEvents) Delete(ctx context.Context, filter database.EventFilter) (int64, error) {
+	f.filter = filter
+	return int64(len(f.events)), nil
+}
+
+func TestExporter(t *testing.T) {
+	page := "/home"
+	created := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	events := []database.Event{
+		{ID: 2, UserID: 5, Action: "click", MetadataPage: &page, CreatedAt: created},
+		{ID: 1, UserID: 5, Action: "view", CreatedAt: created},
+	}
+
+	tests := []struct {
+		name       string
+		params     string
+		expectErr  string
+		expectFile string
+		expectBody string
+	}{
+		{name: "missing range", params: `{}`, expectErr: "to must be after from"},
+		{name: "reversed range", params: `{"from":"2025-02-01T00:00:00Z","to":"2025-01-01T00:00:00Z"}`, expectErr: "to must be after from"},
+		{name: "unknown format", params: `{"from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z","format":"xml"}`, expectErr: "format must be"},
+		{
+			name:       "ndjson by default",
+			params:     `{"from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z"}`,
+			expectFile: "events.ndjson",
+			expectBody: `{"id":2,"user_id":5,"action":"click","metadata_page":"/home","created_at":"2025-01-02T03:04:05Z"}` + "\n",
+		},
+		{
+			name:       "csv",
+			params:     `{"from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z","user_id":5,"format":"csv"}`,
+			expectFile: "events.csv",
+			expectBody: "id,user_id,action,metadata_page,created_at\n2,5,click,/home,2025-01-02T03:04:05Z\n1,5,view,,2025-01-02T03:04:05Z\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := &fakeEvents{events: events}
+			e := NewExporter(src, src)
+			err := e.Validate(json.RawMessage(tt.params))
+			if tt.expectErr != "" {
+				var fe *ingest.FieldError
+				if !errors.As(err, &fe) || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Fatalf("expected a field error %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			task := &Task{dir: t.TempDir(), job: database.Job{ID: 9, ProjectID: 3}}
+			if err := e.Run(context.Background(), database.Job{ID: 9, ProjectID: 3, Params: json.RawMessage(tt.params)}, task); err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if task.artifact != tt.expectFile || task.done.Load() != 2 || task.total.Load() != 2 {
+				t.Fatalf("unexpected task %q %d/%d", task.artifact, task.done.Load(), task.total.Load())
+			}
+			b, err := os.ReadFile(artifactPath(task.dir, 9, task.artifact))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(string(b), tt.expectBody) {
+				t.Fatalf("unexpected artifact:\n%s", b)
+			}
+			if *src.filter.ProjectID != 3 || !src.end.Equal(time.Date(2025, 1, 31, 23, 59, 59, 999999000, time.UTC)) {
+				t.Fatalf("unexpected range %+v to %s", src.filter, src.end)
+			}
+		})
+	}
+}
+
+func TestEraser(t *testing.T) {
+	src := &fakeEvents{events: make([]database.Event, 4)}
+	e := NewEraser(src)
+	if err := e.Validate(json.RawMessage(`{"user_id":0}`)); err == nil {
+		t.Fatal("expected a missing user to be rejected")
+	}
+
+	task := &Task{}
+	if err := e.Run(context.Background(), database.Job{ProjectID: 3, Params: json.RawMessage(`{"user_id":5}`)}, task); err != nil {
+		t.Fatal(err)
+	}
+	if *src.filter.ProjectID != 3 || *src.filter.UserID != 5 || task.done.Load() != 4 {
+		t.Fatalf("unexpected erasure %+v, %d done", src.filter, task.done.Load())
+	}
+}
+
+// fakeHours records the ranges recounted and fails at failAt when set.
+type fakeHours struct {
+	ranges [][2]time.Time
+	failAt int
+}
+
+func (f *fakeHours) RecountHours(ctx context.Context, from, to time.Time) error {
+	if f.failAt > 0 && len(f.ranges) == f.failAt {
+		return errors.New("connection refused")
+	}
+	f.ranges = append(f.ranges, [2]time.Time{from, to})
+	return nil
+}
+
+func TestBackfiller(t *testing.T) {
+	now := time.Date(2025, 6, 10, 0, 0, 0, 0, time.UTC)
+	day := func(d, h int) time.Time { return time.Date(2025, 6, d, h, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name         string
+		params       string
+		failAt       int
+		expectErr    bool
+		expectRanges [][2]time.Time
+		expectDone   int64
+	}{
+		{name: "future", params: `{"from":"2025-06-01T00:00:00Z","to":"2025-06-11T00:00:00Z"}`, expectErr: true},
+		{name: "within an hour", params: `{"from":"2025-06-01T10:20:00Z","to":"2025-06-01T10:40:00Z"}`, expectRanges: [][2]time.Time{{day(1, 10), day(1, 11)}}, expectDone: 1},
+		{
+			name:         "a day at a time",
+			params:       `{"from":"2025-06-01T10:00:00Z","to":"2025-06-03T12:30:00Z"}`,
+			expectRanges: [][2]time.Time{{day(1, 10), day(2, 10)}, {day(2, 10), day(3, 10)}, {day(3, 10), day(3, 13)}},
+			expectDone:   3,
+		},
+		{
+			name:         "failed day keeps the days done",
+			params:       `{"from":"2025-06-01T00:00:00Z","to":"2025-06-04T00:00:00Z"}`,
+			failAt:       1,
+			expectErr:    true,
+			expectRanges: [][2]time.Time{{day(1, 0), day(2, 0)}},
+			expectDone:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeHours{failAt: tt.failAt}
+			b := NewBackfiller(store)
+			b.now = func() time.Time { return now }
+			task := &Task{}
+			err := b.Validate(json.RawMessage(tt.params))
+			if err == nil {
+				err = b.Run(context.Background(), database.Job{Params: json.RawMessage(tt.params)}, task)
+			}
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if len(store.ranges) != len(tt.expectRanges) || task.done.Load() != tt.expectDone {
+				t.Fatalf("expected %v, got %v with %d done", tt.expectRanges, store.ranges, task.done.Load())
+			}
+			for i, r := range tt.expectRanges {
+				if !store.ranges[i][0].Equal(r[0]) || !store.ranges[i][1].Equal(r[1]) {
+					t.Fatalf("expected %v, got %v", tt.expectRanges, store.ranges)
+				}
+			}
+		})
+	}
+}
+
+// fakeRenamer has left events of the action to rename, renamed batch by
+// batch, and fails at the batch failAt when set.
+type fakeRenamer struct {
+	left    int64
+	batches int
+	failAt  int
+}
+
+func (f *fakeRenamer) CountAction(ctx context.Context, projectID int64, action string) (int64, error) {
+	return f.left, nil
+}
+
+func (f *fakeRenamer) RenameActions(ctx context.Context, projectID int64, from, to string, limit int) (int64, error) {
+	if f.failAt > 0 && f.batches == f.failAt {
+		return 0, errors.New("connection refused")
+	}
+	f.batches++
+	n := min(f.left, int64(limit))
+	f.left -= n
+	return n, nil
+}
+
+func TestRenamer(t *testing.T) {
+	rules, err := ingest.NewRules(config.ValidationConfig{ActionPattern: `[a-z_]+`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest.SetRules(rules)
+	t.Cleanup(func() { ingest.SetRules(nil) })
+
+	tests := []struct {
+		name        string
+		params      string
+		expectField string
+		left        int64
+		failAt      int
+		expectErr   bool
+		expectDone  int64
+	}{
+		{name: "missing from", params: `{"to":"sign_up"}`, expectField: "from"},
+		{name: "same name", params: `{"from":"signup","to":"signup"}`, expectField: "to"},
+		{name: "name not allowed", params: `{"from":"signup","to":"Sign-Up"}`, expectField: "to"},
+		{name: "in batches", params: `{"from":"signup","to":"sign_up"}`, left: 2500, expectDone: 2500},
+		{name: "nothing to rename", params: `{"from":"signup","to":"sign_up"}`},
+		{name: "failed batch keeps the batches done", params: `{"from":"signup","to":"sign_up"}`, left: 2500, failAt: 2, expectErr: true, expectDone: 2000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeRenamer{left: tt.left, failAt: tt.failAt}
+			r := NewRenamer(store)
+			err := r.Validate(json.RawMessage(tt.params))
+			if tt.expectField != "" {
+				var fe *ingest.FieldError
+				if !errors.As(err, &fe) || fe.Field != tt.expectField {
+					t.Fatalf("expected a field error on %s, got %v", tt.expectField, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			task := &Task{}
+			err = r.Run(context.Background(), database.Job{ProjectID: 3, Params: json.RawMessage(tt.params)}, task)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if task.done.Load() != tt.expectDone || task.total.Load() != tt.left {
+				t.Fatalf("expected %d of %d done, got %d of %d", tt.expectDone, tt.left, task.done.Load(), task.total.Load())
+			}
+		})
+	}
+}
+
+// fakeDualWrite has as many copies as events on every day but the days in
+// missing, until they are repaired.
+type fakeDualWrite struct {
+	state    database.DualWrite
+	missing  map[time.Time]bool
+	counted  []time.Time
+	repaired int
+}
+
+func (f *fakeDualWrite) GetDualWrite(ctx context.Context) (database.DualWrite, error) {
+	return f.state, nil
+}
+
+func (f *fakeDualWrite) CountDualWrite(ctx context.Context, from, to time.Time) (int64, int64, error) {
+	f.counted = append(f.counted, from)
+	if f.missing[from] {
+		return 10, 7, nil
+	}
+	return 10, 10, nil
+}
+
+func (f *fakeDualWrite) RepairDualWrite(ctx context.Context, from, to time.Time) (int64, int64, error) {
+	f.repaired++
+	if f.missing[from] {
+		delete(f.missing, from)
+		return 3, 0, nil
+	}
+	return 0, 0, nil
+}
+
+func TestDualWriteVerifier(t *testing.T) {
+	now := time.Date(2025, 6, 10, 12, 0, 0, 0, time.UTC)
+	started := time.Date(2025, 6, 8, 12, 0, 0, 0, time.UTC)
+	day := func(d int) time.Time { return time.Date(2025, 6, d, 12, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name         string
+		params       string
+		disabled     bool
+		missing      []time.Time
+		expectField  string
+		expectErr    string
+		expectDays   int
+		expectRepair int
+	}{
+		{name: "reversed range", params: `{"from":"2025-06-02T00:00:00Z","to":"2025-06-01T00:00:00Z"}`, expectField: "to"},
+		{name: "disabled", params: `{}`, disabled: true, expectErr: "disabled"},
+		{name: "since the start", params: `{}`, expectDays: 2},
+		{name: "days differ", params: `{}`, missing: []time.Time{day(9)}, expectErr: "1 of 2 days differ: 2025-06-09T12:00:00Z: 10 events, 7 copies", expectDays: 2},
+		{name: "repaired", params: `{"from":"2025-06-05T12:00:00Z","repair":true}`, missing: []time.Time{day(5), day(9)}, expectDays: 5, expectRepair: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeDualWrite{state: database.DualWrite{Enabled: !tt.disabled, StartedAt: &started}, missing: map[time.Time]bool{}}
+			for _, d := range tt.missing {
+				store.missing[d] = true
+			}
+			v := NewDualWriteVerifier(store)
+			v.now = func() time.Time { return now }
+			err := v.Validate(json.RawMessage(tt.params))
+			if tt.expectField != "" {
+				var fe *ingest.FieldError
+				if !errors.As(err, &fe) || fe.Field != tt.expectField {
+					t.Fatalf("expected a field error on %s, got %v", tt.expectField, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			task := &Task{}
+			err = v.Run(context.Background(), database.Job{Params: json.RawMessage(tt.params)}, task)
+			if tt.expectErr == "" && err != nil || tt.expectErr != "" && (err == nil || !strings.Contains(err.Error(), tt.expectErr)) {
+				t.Fatalf("expected error %q, got %v", tt.expectErr, err)
+			}
+			if len(store.counted) != tt.expectDays || store.repaired != tt.expectRepair || task.done.Load() != int64(tt.expectDays) {
+				t.Fatalf("expected %d days and %d repairs, got %v, %d repairs and %d done", tt.expectDays, tt.expectRepair, store.counted, store.repaired, task.done.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// State is the readiness state reported to load balancers and orchestrators.
+type State int32
+
+const (
+	StateStarting State = iota
+	StateReady
+	StateStopping
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateReady:
+		return "ready"
+	case StateStopping:
+		return "stopping"
+	default:
+		return "unknown"
+	}
+}
+
+// StopFunc stops one component. It must return once ctx is done.
+type StopFunc func(ctx context.Context) error
+
+type stage struct {
+	name    string
+	timeout time.Duration
+	stop    StopFunc
+}
+
+// Manager tracks the readiness state of the application and shuts its
+// components down in registration order, each with its own timeout.
+type Manager struct {
+	logger *slog.Logger
+	state  atomic.Int32
+
+	mu     sync.Mutex
+	stages []stage
+}
+
+func New(logger *slog.Logger) *Manager {
+	return &Manager{logger: logger}
+}
+
+// State returns the current readiness state.
+func (m *Manager) State() State {
+	return State(m.state.Load())
+}
+
+// Ready reports whether the application accepts traffic.
+func (m *Manager) Ready() bool {
+	return m.State() == StateReady
+}
+
+// SetReady marks the application as ready to receive traffic.
+func (m *Manager) SetReady() {
+	m.state.Store(int32(StateReady))
+}
+
+// Add registers a shutdown stage. Stages run in the order they were added.
+func (m *Manager) Add(name string, timeout time.Duration, stop StopFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stages = append(m.stages, stage{name: name, timeout: timeout, stop: stop})
+}
+
+// NotReady returns a stage that flips readiness to stopping and then waits
+// for delay, giving load balancers time to stop routing new requests.
+func (m *Manager) NotReady(delay time.Duration) StopFunc {
+	return func(ctx context.Context) error {
+		m.state.Store(int32(StateStopping))
+		if delay <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Shutdown runs every stage in order. A failing or timed out stage does not
+// prevent the following ones from running; all errors are returned joined.
+func (m *Manager) Shutdown() error {
+	m.mu.Lock()
+	stages := append([]stage(nil), m.stages...)
+	m.mu.Unlock()
+
+	m.state.Store(int32(StateStopping))
+
+	var errs []error
+	for _, st := range stages {
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), st.timeout)
+		err := st.stop(ctx)
+		cancel()
+
+		if err != nil {
+			m.logger.Error("shutdown stage failed", "stage", st.name, "duration_sec", time.Since(start).Seconds(), "error", err)
+			errs = append(errs, fmt.Errorf("%s: %w", st.name, err))
+			continue
+		}
+		m.logger.Info("shutdown stage completed", "stage", st.name, "duration_sec", time.Since(start).Seconds())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,69 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManagerShutdown(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	m := New(logger)
+
+	if m.State() != StateStarting {
+		t.Fatalf("expected initial state starting got %s", m.State())
+	}
+	m.SetReady()
+	if !m.Ready() {
+		t.Fatalf("expected manager to be ready")
+	}
+
+	var order []string
+	record := func(name string) StopFunc {
+		return func(ctx context.Context) error {
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	m.Add("aggregator", time.Second, record("aggregator"))
+	m.Add("readiness", time.Second, func(ctx context.Context) error {
+		if err := m.NotReady(0)(ctx); err != nil {
+			return err
+		}
+		if m.Ready() {
+			t.Errorf("expected readiness to be flipped")
+		}
+		order = append(order, "readiness")
+		return nil
+	})
+	m.Add("stuck", 10*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		order = append(order, "stuck")
+		return ctx.Err()
+	})
+	m.Add("failing", time.Second, func(ctx context.Context) error {
+		order = append(order, "failing")
+		return errors.New("boom")
+	})
+	m.Add("database", time.Second, record("database"))
+
+	err := m.Shutdown()
+	if err == nil {
+		t.Fatalf("expected joined error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "failing: boom") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got := strings.Join(order, ","); got != "aggregator,readiness,stuck,failing,database" {
+		t.Fatalf("unexpected stage order: %s", got)
+	}
+	if m.State() != StateStopping {
+		t.Fatalf("expected final state stopping got %s", m.State())
+	}
+}
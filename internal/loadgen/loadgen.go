@@ -0,0 +1,272 @@
+// Package loadgen sends a mix of POST /events and GET /events requests to an
+// instance at a controlled rate and measures their latency, for capacity
+// planning and for comparing releases under the same load.
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations measured by a run.
+const (
+	OpAdd = "add"
+	OpGet = "get"
+)
+
+// Config describes the load.
+type Config struct {
+	// Target is the base URL of the API, e.g. http://localhost:8080/api.
+	Target string
+	// Rate is the number of requests per second over all workers; 0 sends
+	// as fast as the workers can.
+	Rate        float64
+	Concurrency int
+	Duration    time.Duration
+	// ReadRatio is the share of GET /events requests, from 0 to 1.
+	ReadRatio float64
+	// PayloadBytes is the length of the metadata page of the events sent.
+	PayloadBytes int
+	// Users is the number of distinct user ids events are sent for and
+	// queried by.
+	Users int
+	// Window is the time range of the GET /events queries, ending now.
+	Window time.Duration
+}
+
+// Validate checks that the load can be generated.
+func (c Config) Validate() error {
+	var errs []error
+	if u, err := url.Parse(c.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("target must be an http or https URL, got %q", c.Target))
+	}
+	if c.Rate < 0 {
+		errs = append(errs, fmt.Errorf("rate must not be negative"))
+	}
+	if c.Concurrency < 1 || c.Duration <= 0 || c.Users < 1 || c.Window <= 0 {
+		errs = append(errs, fmt.Errorf("concurrency, duration, users and window must be positive"))
+	}
+	if c.ReadRatio < 0 || c.ReadRatio > 1 {
+		errs = append(errs, fmt.Errorf("read ratio must be within 0-1, got %v", c.ReadRatio))
+	}
+	if c.PayloadBytes < 0 {
+		errs = append(errs, fmt.Errorf("payload bytes must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// Stats are the results of one operation.
+type Stats struct {
+	Requests int
+	// Errors counts the requests that failed or were answered with a
+	// status other than 2xx; Statuses breaks down the answered ones.
+	Errors    int
+	Statuses  map[int]int
+	latencies []time.Duration
+	sorted    bool
+}
+
+func (s *Stats) record(status int, d time.Duration, err error) {
+	s.Requests++
+	if err != nil || status/100 != 2 {
+		s.Errors++
+	}
+	if status != 0 {
+		if s.Statuses == nil {
+			s.Statuses = make(map[int]int)
+		}
+		s.Statuses[status]++
+	}
+	s.latencies = append(s.latencies, d)
+	s.sorted = false
+}
+
+func (s *Stats) merge(o *Stats) {
+	s.Requests += o.Requests
+	s.Errors += o.Errors
+	for status, n := range o.Statuses {
+		if s.Statuses == nil {
+			s.Statuses = make(map[int]int)
+		}
+		s.Statuses[status] += n
+	}
+	s.latencies = append(s.latencies, o.latencies...)
+	s.sorted = false
+}
+
+// Percentile returns the latency below which p percent of the requests
+// completed, by the nearest-rank method.
+func (s *Stats) Percentile(p float64) time.Duration {
+	if len(s.latencies) == 0 {
+		return 0
+	}
+	if !s.sorted {
+		slices.Sort(s.latencies)
+		s.sorted = true
+	}
+	rank := int(p/100*float64(len(s.latencies))+0.999999) - 1
+	return s.latencies[min(max(rank, 0), len(s.latencies)-1)]
+}
+
+// Report holds the stats of a run by operation.
+type Report struct {
+	Elapsed time.Duration
+	Ops     map[string]*Stats
+}
+
+// WriteTo prints the report as a table.
+func (r Report) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-4s %9s %7s %9s %9s %9s %9s %9s  %s\n", "op", "requests", "errors", "req/s", "p50", "p90", "p99", "max", "statuses")
+	for _, op := range []string{OpAdd, OpGet} {
+		s, ok := r.Ops[op]
+		if !ok || s.Requests == 0 {
+			continue
+		}
+		var statuses []string
+		for _, status := range slices.Sorted(maps.Keys(s.Statuses)) {
+			statuses = append(statuses, fmt.Sprintf("%d:%d", status, s.Statuses[status]))
+		}
+		fmt.Fprintf(&b, "%-4s %9d %7d %9.1f %9s %9s %9s %9s  %s\n", op, s.Requests, s.Errors,
+			float64(s.Requests)/r.Elapsed.Seconds(), round(s.Percentile(50)), round(s.Percentile(90)),
+			round(s.Percentile(99)), round(s.Percentile(100)), strings.Join(statuses, " "))
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
+
+// Run generates the load of cfg until its duration elapsed or ctx is done,
+// and returns the stats of the requests sent.
+func Run(ctx context.Context, cfg Config, client *http.Client) (Report, error) {
+	if err := cfg.Validate(); err != nil {
+		return Report{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, cfg.Duration)
+	defer cancel()
+
+	// Tokens are handed to the workers at the configured rate; a nil
+	// channel means no limit
+	var tokens chan struct{}
+	if cfg.Rate > 0 {
+		tokens = make(chan struct{})
+		go func() {
+			ticker := time.NewTicker(time.Duration(float64(time.Second) / cfg.Rate))
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+				select {
+				case tokens <- struct{}{}:
+				case <-ctx.Done():
+					return
+				default:
+					// Every worker is busy: the target is slower than the
+					// rate, the request is dropped rather than queued
+				}
+			}
+		}()
+	}
+
+	g := generator{cfg: cfg, client: client, target: strings.TrimRight(cfg.Target, "/")}
+	results := make([]map[string]*Stats, cfg.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		results[i] = map[string]*Stats{OpAdd: {}, OpGet: {}}
+		wg.Add(1)
+		go func(stats map[string]*Stats) {
+			defer wg.Done()
+			for {
+				if tokens != nil {
+					select {
+					case <-ctx.Done():
+						return
+					case <-tokens:
+					}
+				} else if ctx.Err() != nil {
+					return
+				}
+				op, status, d, err := g.request(ctx)
+				// Requests cut short by the end of the run are not counted
+				if ctx.Err() != nil {
+					return
+				}
+				stats[op].record(status, d, err)
+			}
+		}(results[i])
+	}
+	wg.Wait()
+
+	report := Report{Elapsed: time.Since(start), Ops: map[string]*Stats{OpAdd: {}, OpGet: {}}}
+	for _, stats := range results {
+		for op, s := range stats {
+			report.Ops[op].merge(s)
+		}
+	}
+	return report, nil
+}
+
+type generator struct {
+	cfg    Config
+	client *http.Client
+	target string
+}
+
+// request sends one request of the mix.
+func (g generator) request(ctx context.Context) (op string, status int, d time.Duration, err error) {
+	userID := rand.Int64N(int64(g.cfg.Users)) + 1
+	var req *http.Request
+	if rand.Float64() < g.cfg.ReadRatio {
+		op = OpGet
+		now := time.Now().UTC()
+		q := url.Values{
+			"user_id": {strconv.FormatInt(userID, 10)},
+			"from":    {now.Add(-g.cfg.Window).Format(time.RFC3339)},
+			"to":      {now.Format(time.RFC3339)},
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, g.target+"/events?"+q.Encode(), nil)
+	} else {
+		op = OpAdd
+		body, _ := json.Marshal(map[string]any{
+			"user_id":  userID,
+			"action":   "loadgen",
+			"metadata": map[string]string{"page": "/" + strings.Repeat("x", g.cfg.PayloadBytes)},
+		})
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, g.target+"/events", bytes.NewReader(body))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if err != nil {
+		return op, 0, 0, err
+	}
+
+	start := time.Now()
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return op, 0, time.Since(start), err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return op, resp.StatusCode, time.Since(start), nil
+}
@@ -0,0 +1,88 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPercentile(t *testing.T) {
+	var s Stats
+	for i := 100; i >= 1; i-- {
+		s.record(http.StatusOK, time.Duration(i)*time.Millisecond, nil)
+	}
+
+	tests := []struct {
+		p      float64
+		expect time.Duration
+	}{
+		{p: 50, expect: 50 * time.Millisecond},
+		{p: 99, expect: 99 * time.Millisecond},
+		{p: 100, expect: 100 * time.Millisecond},
+		{p: 0, expect: time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := s.Percentile(tt.p); got != tt.expect {
+			t.Fatalf("p%v: expected %v got %v", tt.p, tt.expect, got)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var adds, gets atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/events":
+			adds.Add(1)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodGet && r.URL.Path == "/api/events" && r.URL.Query().Get("user_id") != "":
+			gets.Add(1)
+			_, _ = w.Write([]byte("[]"))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := Config{
+		Target:       srv.URL + "/api",
+		Rate:         200,
+		Concurrency:  4,
+		Duration:     300 * time.Millisecond,
+		ReadRatio:    0.5,
+		PayloadBytes: 64,
+		Users:        10,
+		Window:       time.Hour,
+	}
+	report, err := Run(context.Background(), cfg, srv.Client())
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+
+	add, get := report.Ops[OpAdd], report.Ops[OpGet]
+	if add.Requests == 0 || get.Requests == 0 || add.Errors+get.Errors != 0 {
+		t.Fatalf("expected both operations without errors, got %+v %+v", add, get)
+	}
+	if add.Statuses[http.StatusCreated] != add.Requests || int64(add.Requests) > adds.Load() || int64(get.Requests) > gets.Load() {
+		t.Fatalf("unexpected statuses %v, %d adds and %d gets served", add.Statuses, adds.Load(), gets.Load())
+	}
+	// 200 req/s for 0.3s, with some slack for slow machines
+	if total := add.Requests + get.Requests; total > 70 {
+		t.Fatalf("expected the rate to be limited, got %d requests", total)
+	}
+
+	var out bytes.Buffer
+	if _, err := report.WriteTo(&out); err != nil || !strings.Contains(out.String(), "p99") || !strings.Contains(out.String(), "201:") {
+		t.Fatalf("unexpected report %q: %v", out.String(), err)
+	}
+
+	cfg.ReadRatio = 2
+	if _, err := Run(context.Background(), cfg, srv.Client()); err == nil {
+		t.Fatal("expected an invalid read ratio to be refused")
+	}
+}
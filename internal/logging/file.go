@@ -0,0 +1,199 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// backupTimeFormat names the backups after the time of their rotation, in
+// UTC, so that their names sort in age order.
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// File appends the logs to a file, which it rotates once it would grow past
+// its maximum size: the file is renamed after the time of the rotation,
+// e.g. api-2025-01-02T15-04-05.000.log, optionally gzipped, and the oldest
+// backups beyond the maximum are removed. A write is never split across
+// files, so that every file holds whole lines.
+type File struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	compress   bool
+	now        func() time.Time
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+
+	// mill compresses and prunes the backups in the background, one
+	// rotation at a time
+	millMu sync.Mutex
+	mill   sync.WaitGroup
+}
+
+// OpenFile opens, or creates, the log file of cfg with its directory.
+func OpenFile(cfg config.LogFileConfig) (*File, error) {
+	f := &File{
+		path:       cfg.Path,
+		maxSize:    int64(cfg.MaxSizeMB) << 20,
+		maxBackups: cfg.MaxBackups,
+		compress:   cfg.Compress,
+		now:        time.Now,
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return nil, fmt.Errorf("create log directory: %w", err)
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("open log file: %w", err)
+	}
+	f.f, f.size = file, info.Size()
+	return nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.f == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.f.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file aside and starts a new one, f.mu held. When the
+// file cannot be moved, it is reopened to be rotated at the next write.
+func (f *File) rotate() error {
+	if err := f.f.Close(); err != nil {
+		return fmt.Errorf("close log file: %w", err)
+	}
+	f.f = nil
+	ext := filepath.Ext(f.path)
+	backup := strings.TrimSuffix(f.path, ext) + "-" + f.now().UTC().Format(backupTimeFormat) + ext
+	if err := os.Rename(f.path, backup); err != nil {
+		// Keep logging to the file, past its size, rather than losing logs
+		return f.open()
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.mill.Add(1)
+	go func() {
+		defer f.mill.Done()
+		f.millMu.Lock()
+		defer f.millMu.Unlock()
+		if f.compress {
+			// A backup left uncompressed is still pruned below
+			_ = compress(backup)
+		}
+		f.prune()
+	}()
+	return nil
+}
+
+// compress replaces path with its gzipped copy.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// backups returns the backups of the file, oldest first.
+func (f *File) backups() []string {
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(filepath.Base(f.path), ext) + "-"
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || (!strings.HasSuffix(name, ext) && !strings.HasSuffix(name, ext+".gz")) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+		if _, err := time.Parse(backupTimeFormat, stamp); err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// prune removes the oldest backups beyond maxBackups; 0 keeps them all.
+func (f *File) prune() {
+	if f.maxBackups == 0 {
+		return
+	}
+	names := f.backups()
+	for len(names) > f.maxBackups {
+		os.Remove(filepath.Join(filepath.Dir(f.path), names[0]))
+		names = names[1:]
+	}
+}
+
+// Close closes the file once the backups are compressed and pruned.
+func (f *File) Close() error {
+	f.mu.Lock()
+	var err error
+	if f.f != nil {
+		err = f.f.Close()
+		f.f = nil
+	}
+	f.mu.Unlock()
+	f.mill.Wait()
+	return err
+}
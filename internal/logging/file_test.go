@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func TestFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "logs", "api.log")
+	f, err := OpenFile(config.LogFileConfig{Path: path, MaxSizeMB: 1, MaxBackups: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.maxSize = 100
+	now := time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC)
+	f.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	// 40 bytes lines: 2 per file, 5 files of which 2 are kept as backups
+	line := strings.Repeat("x", 39) + "\n"
+	for range 10 {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := os.ReadFile(path)
+	if err != nil || string(current) != line+line {
+		t.Fatalf("expected the current file to hold the last 2 lines, got %q, %v", current, err)
+	}
+	backups := f.backups()
+	want := []string{"api-2025-01-02T15-04-08.000.log.gz", "api-2025-01-02T15-04-09.000.log.gz"}
+	if strings.Join(backups, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected backups %v got %v", want, backups)
+	}
+	gz, err := os.Open(filepath.Join(dir, "logs", backups[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gz.Close()
+	zr, err := gzip.NewReader(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(zr)
+	if err != nil || string(content) != line+line {
+		t.Fatalf("expected whole lines in the backup, got %q, %v", content, err)
+	}
+
+	if _, err := f.Write([]byte(line)); err == nil {
+		t.Fatal("expected writes to fail once closed")
+	}
+}
+
+func TestFileAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+	if err := os.WriteFile(path, []byte("before\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenFile(config.LogFileConfig{Path: path, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("after\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(path); string(content) != "before\nafter\n" {
+		t.Fatalf("expected the logs appended, got %q", content)
+	}
+}
@@ -0,0 +1,186 @@
+// Package microbatch coalesces the calls made at about the same time into
+// one, for operations much cheaper in bulk, such as single-row inserts made
+// by concurrent requests.
+//
+// The first call of a batch waits for at most the window; the batch is run
+// earlier once it holds size calls. Each caller gets its own result.
+package microbatch
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Result is the outcome of one call of a batch.
+type Result[R any] struct {
+	Value R
+	Err   error
+}
+
+// RunFunc runs a batch and returns the result of every item, in order.
+type RunFunc[T, R any] func(ctx context.Context, items []T) []Result[R]
+
+// The states of a call
+const (
+	pending int32 = iota
+	// started: the call is in a running batch
+	started
+	// abandoned: the call is left out of its batch
+	abandoned
+)
+
+type call[T, R any] struct {
+	ctx    context.Context
+	item   T
+	state  atomic.Int32
+	result Result[R]
+	done   chan struct{}
+}
+
+type Batcher[T, R any] struct {
+	window time.Duration
+	size   int
+	run    RunFunc[T, R]
+
+	mu      sync.Mutex
+	pending []*call[T, R]
+	timer   *time.Timer
+	stopped bool
+	running sync.WaitGroup
+}
+
+func New[T, R any](window time.Duration, size int, run RunFunc[T, R]) *Batcher[T, R] {
+	return &Batcher[T, R]{window: window, size: size, run: run}
+}
+
+// Do adds item to the next batch and returns its result. When ctx is done
+// before the batch started, Do returns at once and the item is left out of
+// the batch; once it started, Do waits for its result, which ctx does not
+// cancel, so that an item the batch stores is never reported failed.
+func (b *Batcher[T, R]) Do(ctx context.Context, item T) (R, error) {
+	c := &call[T, R]{ctx: ctx, item: item, done: make(chan struct{})}
+
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		r := b.run(ctx, []T{item})[0]
+		return r.Value, r.Err
+	}
+	b.pending = append(b.pending, c)
+	switch {
+	case len(b.pending) >= b.size:
+		b.flushLocked()
+	case len(b.pending) == 1:
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		if c.state.CompareAndSwap(pending, abandoned) {
+			var zero R
+			return zero, ctx.Err()
+		}
+		<-c.done
+	}
+	return c.result.Value, c.result.Err
+}
+
+func (b *Batcher[T, R]) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+// flushLocked runs the pending calls in the background, b.mu held. A timer
+// firing after its batch was run by size flushes the next batch early, which
+// is harmless.
+func (b *Batcher[T, R]) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.pending) == 0 {
+		return
+	}
+	calls := b.pending
+	b.pending = nil
+	b.running.Add(1)
+	go func() {
+		defer b.running.Done()
+		b.runCalls(calls)
+	}()
+}
+
+func (b *Batcher[T, R]) runCalls(calls []*call[T, R]) {
+	live := calls[:0:0]
+	for _, c := range calls {
+		if err := c.ctx.Err(); err != nil {
+			if c.state.CompareAndSwap(pending, abandoned) {
+				c.result.Err = err
+				close(c.done)
+			}
+			continue
+		}
+		if c.state.CompareAndSwap(pending, started) {
+			live = append(live, c)
+		}
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	items := make([]T, len(live))
+	for i, c := range live {
+		items[i] = c.item
+	}
+	ctx, cancel := batchContext(live)
+	defer cancel()
+	results := b.run(ctx, items)
+	for i, c := range live {
+		c.result = results[i]
+		close(c.done)
+	}
+}
+
+// batchContext returns a context carrying the values of the first call,
+// which is not canceled with any of the calls, and with the latest deadline
+// of the calls, if they all have one.
+func batchContext[T, R any](calls []*call[T, R]) (context.Context, context.CancelFunc) {
+	ctx := context.WithoutCancel(calls[0].ctx)
+	var latest time.Time
+	for _, c := range calls {
+		deadline, ok := c.ctx.Deadline()
+		if !ok {
+			return context.WithCancel(ctx)
+		}
+		if deadline.After(latest) {
+			latest = deadline
+		}
+	}
+	return context.WithDeadline(ctx, latest)
+}
+
+// Stop runs the pending calls and waits for the running batches. Later
+// calls are run alone.
+func (b *Batcher[T, R]) Stop(ctx context.Context) error {
+	b.mu.Lock()
+	b.stopped = true
+	b.flushLocked()
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,146 @@
+package microbatch
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// doubler records the batches it runs and doubles their items, failing on
+// negative ones.
+type doubler struct {
+	mu      sync.Mutex
+	batches [][]int
+}
+
+func (d *doubler) run(ctx context.Context, items []int) []Result[int] {
+	d.mu.Lock()
+	d.batches = append(d.batches, items)
+	d.mu.Unlock()
+
+	results := make([]Result[int], len(items))
+	for i, n := range items {
+		if n < 0 {
+			results[i].Err = errors.New("negative")
+			continue
+		}
+		results[i].Value = 2 * n
+	}
+	return results
+}
+
+func TestBatcher(t *testing.T) {
+	d := &doubler{}
+	b := New(time.Hour, 3, d.run)
+	ctx := context.Background()
+
+	// A full batch runs without waiting for the window
+	var wg sync.WaitGroup
+	results := make([]Result[int], 3)
+	for i, n := range []int{1, -1, 3} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i].Value, results[i].Err = b.Do(ctx, n)
+		}()
+	}
+	wg.Wait()
+	if len(d.batches) != 1 || len(d.batches[0]) != 3 {
+		t.Fatalf("expected a single batch of 3, got %v", d.batches)
+	}
+	if results[0].Value != 2 || results[1].Err == nil || results[2].Value != 6 {
+		t.Fatalf("expected every caller to get its result, got %+v", results)
+	}
+
+	// Callers giving up are left out of the batch
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.Do(canceled, 4); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the canceled call to fail, got %v", err)
+	}
+
+	// Stop runs the waiting calls, and later calls run alone
+	done := make(chan Result[int])
+	go func() {
+		var r Result[int]
+		r.Value, r.Err = b.Do(ctx, 5)
+		done <- r
+	}()
+	for {
+		b.mu.Lock()
+		n := len(b.pending)
+		b.mu.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; r.Value != 10 {
+		t.Fatalf("expected the waiting call to run on stop, got %+v", r)
+	}
+	if v, err := b.Do(ctx, 6); err != nil || v != 12 {
+		t.Fatalf("expected the call after stop to run, got %d, %v", v, err)
+	}
+	if got := d.batches[1:]; len(got) != 2 || len(got[0]) != 1 || got[0][0] != 5 || got[1][0] != 6 {
+		t.Fatalf("expected the canceled call left out, got %v", d.batches)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	d := &doubler{}
+	b := New(50*time.Millisecond, 100, d.run)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for n := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := b.Do(ctx, n); err != nil || v != 2*n {
+				t.Errorf("expected %d got %d, %v", 2*n, v, err)
+			}
+		}()
+	}
+	wg.Wait()
+	total := 0
+	for _, batch := range d.batches {
+		total += len(batch)
+	}
+	if total != 5 || len(d.batches) == 5 {
+		t.Fatalf("expected the calls of the window coalesced, got %v", d.batches)
+	}
+}
+
+func TestCancelAfterStart(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	b := New(time.Hour, 1, func(ctx context.Context, items []int) []Result[int] {
+		close(started)
+		<-release
+		return []Result[int]{{Value: 2 * items[0]}}
+	})
+
+	// A caller giving up once its batch started gets the result of the batch
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan Result[int])
+	go func() {
+		var r Result[int]
+		r.Value, r.Err = b.Do(ctx, 7)
+		done <- r
+	}()
+	<-started
+	cancel()
+	select {
+	case r := <-done:
+		t.Fatalf("expected the call to wait for its batch, got %+v", r)
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+	if r := <-done; r.Err != nil || r.Value != 14 {
+		t.Fatalf("expected the result of the batch, got %+v", r)
+	}
+}
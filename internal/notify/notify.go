@@ -0,0 +1,81 @@
+// Package notify sends operational notifications, such as alerts, to a
+// Slack incoming webhook or as JSON to any HTTP endpoint.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Message is a notification: Title and Text are rendered for people,
+// Payload is sent as is to machines.
+type Message struct {
+	Title   string
+	Text    string
+	Payload any
+}
+
+// Sender delivers notifications to one channel.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// sendTimeout bounds a single delivery.
+const sendTimeout = 10 * time.Second
+
+// Slack posts the title and text of the messages to an incoming webhook.
+type Slack struct {
+	url    string
+	client *http.Client
+}
+
+func NewSlack(url string) *Slack {
+	return &Slack{url: url, client: &http.Client{Timeout: sendTimeout}}
+}
+
+func (s *Slack) Send(ctx context.Context, m Message) error {
+	return post(ctx, s.client, s.url, map[string]string{"text": "*" + m.Title + "*\n" + m.Text})
+}
+
+// Webhook posts the payload of the messages as JSON.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: sendTimeout}}
+}
+
+func (w *Webhook) Send(ctx context.Context, m Message) error {
+	return post(ctx, w.client, w.url, m.Payload)
+}
+
+// post sends v as JSON to url and expects a 2xx response.
+func post(ctx context.Context, client *http.Client, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s responded with status %d: %s", req.URL.Host, resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
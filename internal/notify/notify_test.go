@@ -0,0 +1,44 @@
+package notify
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSenders(t *testing.T) {
+	var body string
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("no_service\n"))
+	}))
+	defer srv.Close()
+
+	m := Message{Title: "Spike of purchase", Text: "120 events", Payload: map[string]int{"current": 120}}
+	ctx := context.Background()
+
+	if err := NewSlack(srv.URL).Send(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"text":"*Spike of purchase*\n120 events"}` {
+		t.Fatalf("unexpected slack body %s", body)
+	}
+	if err := NewWebhook(srv.URL).Send(ctx, m); err != nil {
+		t.Fatal(err)
+	}
+	if body != `{"current":120}` {
+		t.Fatalf("unexpected webhook body %s", body)
+	}
+
+	status = http.StatusNotFound
+	err := NewWebhook(srv.URL).Send(ctx, m)
+	if err == nil || !strings.Contains(err.Error(), "status 404: no_service") {
+		t.Fatalf("expected the status and body in the error, got %v", err)
+	}
+}
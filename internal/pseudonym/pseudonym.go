@@ -0,0 +1,55 @@
+// Package pseudonym replaces user ids with keyed hashes, so that stored
+// events hold no direct identifiers while the events of a user can still be
+// looked up by its original id.
+package pseudonym
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"slices"
+	"strconv"
+)
+
+// Hasher maps user ids to pseudonyms with HMAC-SHA256.
+type Hasher struct {
+	secrets [][]byte
+}
+
+// New returns a Hasher hashing with the first secret. The other secrets are
+// previous ones, kept so that events hashed before a rotation are found.
+func New(secrets []string) *Hasher {
+	h := &Hasher{}
+	for _, s := range secrets {
+		h.secrets = append(h.secrets, []byte(s))
+	}
+	return h
+}
+
+// Hash returns the pseudonym of a user id under the current secret. It is
+// a positive int64, so that it fits the user_id column.
+func (h *Hasher) Hash(userID int64) int64 {
+	return hash(h.secrets[0], userID)
+}
+
+// Candidates returns the pseudonyms of a user id under every secret,
+// current first.
+func (h *Hasher) Candidates(userID int64) []int64 {
+	ids := make([]int64, 0, len(h.secrets))
+	for _, s := range h.secrets {
+		if id := hash(s, userID); !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func hash(secret []byte, userID int64) int64 {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strconv.FormatInt(userID, 10)))
+	id := int64(binary.BigEndian.Uint64(mac.Sum(nil)) >> 1)
+	if id == 0 {
+		return 1
+	}
+	return id
+}
@@ -0,0 +1,27 @@
+package pseudonym
+
+import "testing"
+
+func TestHasher(t *testing.T) {
+	current := New([]string{"0123456789abcdef"})
+	rotated := New([]string{"fedcba9876543210", "0123456789abcdef"})
+
+	id := current.Hash(42)
+	if id <= 0 || id == 42 || id != current.Hash(42) {
+		t.Fatalf("expected a stable positive pseudonym, got %d", id)
+	}
+	if current.Hash(43) == id {
+		t.Fatal("expected users to have distinct pseudonyms")
+	}
+	if rotated.Hash(42) == id {
+		t.Fatal("expected a new secret to produce new pseudonyms")
+	}
+
+	candidates := rotated.Candidates(42)
+	if len(candidates) != 2 || candidates[0] != rotated.Hash(42) || candidates[1] != id {
+		t.Fatalf("expected the pseudonyms of both secrets, got %v", candidates)
+	}
+	if c := New([]string{"0123456789abcdef", "0123456789abcdef"}).Candidates(42); len(c) != 1 {
+		t.Fatalf("expected duplicate secrets to produce one candidate, got %v", c)
+	}
+}
@@ -0,0 +1,114 @@
+package querycache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type entry struct {
+	key     key
+	events  []database.Event
+	expires time.Time
+}
+
+// lru keeps up to size results in memory, dropping the least recently used
+// first.
+type lru struct {
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mu sync.Mutex
+	// recent holds *entry values, most recently used first
+	recent  *list.List
+	entries map[key]*list.Element
+}
+
+func newLRU(ttl time.Duration, size int, now func() time.Time) *lru {
+	return &lru{
+		ttl:     ttl,
+		size:    size,
+		now:     now,
+		recent:  list.New(),
+		entries: make(map[key]*list.Element),
+	}
+}
+
+func (l *lru) get(ctx context.Context, k key) ([]database.Event, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.entries[k]
+	if !ok {
+		return nil, false
+	}
+	if !l.now().Before(el.Value.(*entry).expires) {
+		l.drop(el)
+		return nil, false
+	}
+	l.recent.MoveToFront(el)
+	return el.Value.(*entry).events, true
+}
+
+func (l *lru) put(ctx context.Context, k key, events []database.Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.entries[k]; ok {
+		l.drop(el)
+	}
+	l.entries[k] = l.recent.PushFront(&entry{key: k, events: events, expires: l.now().Add(l.ttl)})
+	for l.recent.Len() > l.size {
+		l.drop(l.recent.Back())
+	}
+}
+
+func (l *lru) remove(ctx context.Context, k key) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.entries[k]; ok {
+		l.drop(el)
+	}
+}
+
+func (l *lru) invalidate(ctx context.Context, events []database.NewEvent, now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dropped := 0
+	for el := l.recent.Front(); el != nil; {
+		next := el.Next()
+		if el.Value.(*entry).key.holdsAny(events, now) {
+			l.drop(el)
+			dropped++
+		}
+		el = next
+	}
+	return dropped
+}
+
+func (l *lru) flush(ctx context.Context, projectID *int64) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dropped := 0
+	for el := l.recent.Front(); el != nil; {
+		next := el.Next()
+		if projectID == nil || el.Value.(*entry).key.projectID == project(*projectID) {
+			l.drop(el)
+			dropped++
+		}
+		el = next
+	}
+	return dropped
+}
+
+func (l *lru) drop(el *list.Element) {
+	l.recent.Remove(el)
+	delete(l.entries, el.Value.(*entry).key)
+}
@@ -0,0 +1,311 @@
+// Package querycache answers repeated event queries from a cache, for
+// dashboards sending the same GET /events every few seconds.
+//
+// Results are kept for a TTL, keyed on the query filters, in memory or in
+// Redis. An insert through the cache drops the cached results whose window
+// holds the new event, so that writes are seen at once: in memory, the
+// writes of the instance; in Redis, shared by every instance, the writes of
+// all of them. Deletes and renames, which do not go through the cache,
+// flush the results of their projects with Flush. Only limited queries are
+// cached, so that the memory used stays bounded.
+package querycache
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var (
+	requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "query_cache_requests_total",
+			Help: "Event queries looked up in the query cache, by result: hit or miss",
+		},
+		[]string{"result"},
+	)
+	invalidations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "query_cache_invalidations_total",
+			Help: "Cached query results dropped because an event was inserted in their window",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(requests, invalidations)
+}
+
+// key is the normalized filter of a query: times are compared as instants,
+// whatever their location, and 0 is the default project.
+type key struct {
+	projectID int64
+	userID    int64
+	hasUser   bool
+	start     int64
+	hasStart  bool
+	end       int64
+	hasEnd    bool
+	limit     int
+}
+
+func newKey(projectID int64, userID *int64, start, end *time.Time, limit int) key {
+	k := key{projectID: project(projectID), limit: limit}
+	if userID != nil {
+		k.userID, k.hasUser = *userID, true
+	}
+	if start != nil {
+		k.start, k.hasStart = start.UnixNano(), true
+	}
+	if end != nil {
+		k.end, k.hasEnd = end.UnixNano(), true
+	}
+	return k
+}
+
+// project returns the project of id, 0 meaning the default one.
+func project(id int64) int64 {
+	if id == 0 {
+		return database.DefaultProjectID
+	}
+	return id
+}
+
+// holds reports whether an event of the user created at t matches the
+// query.
+func (k key) holds(projectID, userID int64, t time.Time) bool {
+	if k.projectID != projectID || (k.hasUser && k.userID != userID) {
+		return false
+	}
+	n := t.UnixNano()
+	return (!k.hasStart || n >= k.start) && (!k.hasEnd || n <= k.end)
+}
+
+// holdsAny reports whether one of events, stored at now when they have no
+// creation time, matches the query.
+func (k key) holdsAny(events []database.NewEvent, now time.Time) bool {
+	for _, e := range events {
+		t := e.CreatedAt
+		if t.IsZero() {
+			t = now
+		}
+		if k.holds(project(e.ProjectID), e.UserID, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// store keeps the cached results until their TTL expires.
+type store interface {
+	get(ctx context.Context, k key) ([]database.Event, bool)
+	put(ctx context.Context, k key, events []database.Event)
+	remove(ctx context.Context, k key)
+	// invalidate drops the results holding one of events and returns how
+	// many were dropped.
+	invalidate(ctx context.Context, events []database.NewEvent, now time.Time) int
+	// flush drops the results of the project, of every project when nil,
+	// and returns how many were dropped.
+	flush(ctx context.Context, projectID *int64) int
+}
+
+// Cache is a database.Service caching the results of GetEvents and
+// StreamEvents. Reads including the archived events are not cached.
+type Cache struct {
+	database.Service
+
+	store store
+	now   func() time.Time
+
+	mu sync.Mutex
+	// reading holds the queries being read from the database; an insert in
+	// their window marks them stale, so that their result is not cached
+	reading map[*read]bool
+}
+
+type read struct {
+	key key
+}
+
+// New wraps svc with an in-memory cache of up to size results kept for
+// ttl.
+func New(svc database.Service, ttl time.Duration, size int) *Cache {
+	c := newCache(svc)
+	c.store = newLRU(ttl, size, func() time.Time { return c.now() })
+	return c
+}
+
+func newCache(svc database.Service) *Cache {
+	return &Cache{
+		Service: svc,
+		now:     time.Now,
+		reading: make(map[*read]bool),
+	}
+}
+
+func (c *Cache) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	if limit <= 0 || database.ArchiveIncluded(ctx) {
+		return c.Service.GetEvents(ctx, projectID, userID, start, end, limit)
+	}
+	k := newKey(projectID, userID, start, end, limit)
+	events, r, ok := c.get(ctx, k)
+	if ok {
+		return slices.Clone(events), nil
+	}
+	events, err := c.Service.GetEvents(ctx, projectID, userID, start, end, limit)
+	if err != nil {
+		c.put(ctx, r, nil)
+		return nil, err
+	}
+	c.put(ctx, r, events)
+	return slices.Clone(events), nil
+}
+
+// StreamEvents reads the whole result of a limited query before it is
+// cached, even when fn stops early; every event is still passed to fn as
+// soon as it is read.
+func (c *Cache) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	if limit <= 0 || database.ArchiveIncluded(ctx) {
+		return c.Service.StreamEvents(ctx, projectID, userID, start, end, limit, fn)
+	}
+	k := newKey(projectID, userID, start, end, limit)
+	cached, r, ok := c.get(ctx, k)
+	if ok {
+		for _, e := range cached {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	events := make([]database.Event, 0)
+	var fnErr error
+	err := c.Service.StreamEvents(ctx, projectID, userID, start, end, limit, func(e database.Event) error {
+		events = append(events, e)
+		if fnErr == nil {
+			fnErr = fn(e)
+		}
+		return nil
+	})
+	if err != nil {
+		c.put(ctx, r, nil)
+		return err
+	}
+	c.put(ctx, r, events)
+	return fnErr
+}
+
+func (c *Cache) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	id, err := c.Service.InsertEvent(ctx, projectID, userID, action, metadata)
+	if err == nil {
+		c.invalidate(ctx, database.NewEvent{ProjectID: projectID, UserID: userID})
+	}
+	return id, err
+}
+
+func (c *Cache) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	err := c.Service.InsertEvents(ctx, events)
+	// Part of a failed batch may have been stored
+	c.invalidate(ctx, events...)
+	return err
+}
+
+func (c *Cache) InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error) {
+	stored, duplicate, err := c.Service.InsertEventOnce(ctx, e, window)
+	if err == nil && !duplicate {
+		c.invalidate(ctx, e)
+	}
+	return stored, duplicate, err
+}
+
+// Flush drops the results of the project, of every project when projectID
+// is nil. Deletes and renames change results whatever their window, so the
+// writes other than inserts flush the results of their projects.
+func (c *Cache) Flush(ctx context.Context, projectID *int64) {
+	c.mu.Lock()
+	for r := range c.reading {
+		if projectID == nil || r.key.projectID == project(*projectID) {
+			c.reading[r] = true
+		}
+	}
+	c.mu.Unlock()
+
+	invalidations.Add(float64(c.store.flush(ctx, projectID)))
+}
+
+// EventStore is a database.EventMaintainer flushing the results of the
+// projects it deletes events of.
+type EventStore struct {
+	database.EventMaintainer
+	cache *Cache
+}
+
+// EventStore wraps the maintenance operations of store, so that the events
+// deleted leave the cache.
+func (c *Cache) EventStore(store database.EventMaintainer) *EventStore {
+	return &EventStore{EventMaintainer: store, cache: c}
+}
+
+func (s *EventStore) Delete(ctx context.Context, f database.EventFilter) (int64, error) {
+	n, err := s.EventMaintainer.Delete(ctx, f)
+	// Part of a failed deletion may be committed, e.g. on another shard
+	if n > 0 || err != nil {
+		s.cache.Flush(ctx, f.ProjectID)
+	}
+	return n, err
+}
+
+// get returns the cached result of k or, on a miss, the read to pass to
+// put once the result is read.
+func (c *Cache) get(ctx context.Context, k key) ([]database.Event, *read, bool) {
+	if events, ok := c.store.get(ctx, k); ok {
+		requests.WithLabelValues("hit").Inc()
+		return events, nil, true
+	}
+	requests.WithLabelValues("miss").Inc()
+
+	r := &read{key: k}
+	c.mu.Lock()
+	c.reading[r] = false
+	c.mu.Unlock()
+	return nil, r, false
+}
+
+// put caches the events of r, unless the query failed (nil events) or an
+// event was inserted in its window meanwhile. The result is stored before
+// r is checked: an insert marking r later drops it from the store.
+func (c *Cache) put(ctx context.Context, r *read, events []database.Event) {
+	if events != nil {
+		c.store.put(ctx, r.key, events)
+	}
+
+	c.mu.Lock()
+	stale := c.reading[r]
+	delete(c.reading, r)
+	c.mu.Unlock()
+
+	if stale && events != nil {
+		c.store.remove(ctx, r.key)
+	}
+}
+
+// invalidate drops the results whose window holds one of events.
+func (c *Cache) invalidate(ctx context.Context, events ...database.NewEvent) {
+	now := c.now()
+
+	c.mu.Lock()
+	for r := range c.reading {
+		if r.key.holdsAny(events, now) {
+			c.reading[r] = true
+		}
+	}
+	c.mu.Unlock()
+
+	invalidations.Add(float64(c.store.invalidate(ctx, events, now)))
+}
@@ -0,0 +1,256 @@
+package querycache
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeDB answers every query with events and counts the queries; during
+// runs inside the read, as if it happened while Postgres answered.
+type fakeDB struct {
+	database.Service
+	events  []database.Event
+	queries int
+	during  func()
+}
+
+func (f *fakeDB) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	f.queries++
+	if f.during != nil {
+		f.during()
+	}
+	return f.events, nil
+}
+
+func (f *fakeDB) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	events, _ := f.GetEvents(ctx, projectID, userID, start, end, limit)
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	return nil
+}
+
+// stores creates a cache of each store.
+var stores = []struct {
+	name string
+	new  func(db *fakeDB, now func() time.Time) *Cache
+	// evicts is set by the stores bounded in size, here to 2 results
+	evicts bool
+}{
+	{
+		name: "memory",
+		new: func(db *fakeDB, now func() time.Time) *Cache {
+			c := New(db, time.Minute, 2)
+			c.now = now
+			return c
+		},
+		evicts: true,
+	},
+	{
+		name: "redis",
+		new: func(db *fakeDB, now func() time.Time) *Cache {
+			c := newCache(db)
+			c.now = now
+			c.store = &redisStore{rdb: newFakeRedis(now), ttl: time.Minute, now: now}
+			return c
+		},
+	},
+}
+
+func TestCache(t *testing.T) {
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			testCache(t, tt.new, tt.evicts)
+		})
+	}
+}
+
+// fakeMaintainer reports that it deleted deleted events, or fails with err.
+type fakeMaintainer struct {
+	deleted int64
+	err     error
+}
+
+func (f fakeMaintainer) Count(ctx context.Context, filter database.EventFilter) (int64, error) {
+	return 0, nil
+}
+
+func (f fakeMaintainer) Delete(ctx context.Context, filter database.EventFilter) (int64, error) {
+	return f.deleted, f.err
+}
+
+func TestFlush(t *testing.T) {
+	for _, tt := range stores {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakeDB{events: []database.Event{{ID: 1}}}
+			c := tt.new(db, time.Now)
+			ctx := context.Background()
+			query := func(projectID int64) {
+				t.Helper()
+				if _, err := c.GetEvents(ctx, projectID, nil, nil, nil, 10); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expectQueries := func(n int) {
+				t.Helper()
+				if db.queries != n {
+					t.Fatalf("expected %d database queries got %d", n, db.queries)
+				}
+			}
+			query(0)
+			query(7)
+			expectQueries(2)
+
+			// Deleting nothing keeps the results, a deletion drops the ones
+			// of its project, a failed one too
+			project := int64(7)
+			if _, err := c.EventStore(fakeMaintainer{}).Delete(ctx, database.EventFilter{ProjectID: &project}); err != nil {
+				t.Fatal(err)
+			}
+			query(7)
+			expectQueries(2)
+			if _, err := c.EventStore(fakeMaintainer{deleted: 1}).Delete(ctx, database.EventFilter{ProjectID: &project}); err != nil {
+				t.Fatal(err)
+			}
+			query(0)
+			query(7)
+			expectQueries(3)
+			if _, err := c.EventStore(fakeMaintainer{err: errors.New("down")}).Delete(ctx, database.EventFilter{ProjectID: &project}); err == nil {
+				t.Fatal("expected the error of the deletion")
+			}
+			query(7)
+			expectQueries(4)
+
+			// Without a project every result is dropped
+			c.Flush(ctx, nil)
+			query(0)
+			query(7)
+			expectQueries(6)
+		})
+	}
+}
+
+func TestArchiveNotCached(t *testing.T) {
+	db := &fakeDB{events: []database.Event{{ID: 1}}}
+	c := New(db, time.Minute, 2)
+	ctx := database.WithArchive(context.Background())
+	for range 2 {
+		if _, err := c.GetEvents(ctx, 0, nil, nil, nil, 10); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.StreamEvents(ctx, 0, nil, nil, nil, 10, func(database.Event) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.queries != 4 {
+		t.Fatalf("expected every query to read the database, got %d queries", db.queries)
+	}
+}
+
+func testCache(t *testing.T, newCache func(db *fakeDB, now func() time.Time) *Cache, evicts bool) {
+	now := time.Unix(1700000000, 0)
+	db := &fakeDB{events: []database.Event{{ID: 2}, {ID: 1}}}
+	c := newCache(db, func() time.Time { return now })
+
+	user := int64(1)
+	from, to := now.Add(-time.Hour), now.Add(time.Hour)
+	query := func(projectID int64, limit int) {
+		t.Helper()
+		events, err := c.GetEvents(context.Background(), projectID, &user, &from, &to, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 {
+			t.Fatalf("expected 2 events got %d", len(events))
+		}
+	}
+	expectQueries := func(n int) {
+		t.Helper()
+		if db.queries != n {
+			t.Fatalf("expected %d database queries got %d", n, db.queries)
+		}
+	}
+	insert := func(e database.NewEvent) {
+		t.Helper()
+		if err := c.InsertEvents(context.Background(), []database.NewEvent{e}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	query(0, 10)
+	query(database.DefaultProjectID, 10)
+	expectQueries(1)
+
+	// The same times in another location are the same query
+	utcFrom, utcTo := from.UTC(), to.UTC()
+	if _, err := c.GetEvents(context.Background(), 0, &user, &utcFrom, &utcTo, 10); err != nil {
+		t.Fatal(err)
+	}
+	expectQueries(1)
+
+	var streamed int
+	if err := c.StreamEvents(context.Background(), 0, &user, &from, &to, 10, func(database.Event) error {
+		streamed++
+		return nil
+	}); err != nil || streamed != 2 {
+		t.Fatalf("expected 2 cached events streamed got %d (%v)", streamed, err)
+	}
+	expectQueries(1)
+
+	// Unlimited queries are not cached
+	query(0, 0)
+	query(0, 0)
+	expectQueries(3)
+
+	// Events out of the range, of another user or another project keep the
+	// result
+	insert(database.NewEvent{UserID: 1, CreatedAt: now.Add(-2 * time.Hour)})
+	insert(database.NewEvent{UserID: 2})
+	insert(database.NewEvent{ProjectID: 7, UserID: 1})
+	query(0, 10)
+	expectQueries(3)
+
+	// An event stored now is in the range
+	insert(database.NewEvent{UserID: 1})
+	query(0, 10)
+	expectQueries(4)
+
+	// An event stored while the result was read keeps it out of the cache
+	db.during = func() {
+		db.during = nil
+		insert(database.NewEvent{UserID: 1})
+	}
+	query(0, 20)
+	query(0, 20)
+	expectQueries(6)
+
+	queries := 6
+	if evicts {
+		// The result of limit 30 is the least recently used when the one
+		// of limit 10 is cached, so it is evicted
+		query(0, 30)
+		query(0, 20)
+		query(0, 10)
+		query(0, 20)
+		expectQueries(8)
+		query(0, 30)
+		expectQueries(9)
+		queries = 9
+	}
+
+	query(0, 20)
+	expectQueries(queries)
+	now = now.Add(time.Minute)
+	query(0, 20)
+	expectQueries(queries + 1)
+}
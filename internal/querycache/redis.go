@@ -0,0 +1,238 @@
+package querycache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+const (
+	resultPrefix = "events:querycache:result:"
+	indexPrefix  = "events:querycache:index:"
+)
+
+var redisErrors = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "query_cache_redis_errors_total",
+		Help: "Query cache operations that failed in Redis; a failed lookup is a miss",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(redisErrors)
+}
+
+// redisClient is the part of the Redis API used by the cache.
+type redisClient interface {
+	Get(ctx context.Context, key string) *goredis.StringCmd
+	Set(ctx context.Context, key string, value any, expiration time.Duration) *goredis.StatusCmd
+	Del(ctx context.Context, keys ...string) *goredis.IntCmd
+	PExpire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd
+	ZAdd(ctx context.Context, key string, members ...goredis.Z) *goredis.IntCmd
+	ZRangeByScore(ctx context.Context, key string, opt *goredis.ZRangeBy) *goredis.StringSliceCmd
+	ZRem(ctx context.Context, key string, members ...any) *goredis.IntCmd
+	ZRemRangeByScore(ctx context.Context, key, min, max string) *goredis.IntCmd
+	Scan(ctx context.Context, cursor uint64, match string, count int64) *goredis.ScanCmd
+}
+
+var _ redisClient = (*goredis.Client)(nil)
+
+// NewShared wraps svc with a cache kept in Redis, shared by every instance,
+// of results kept for ttl. Redis evicts the results itself when it runs out
+// of memory, given an eviction policy.
+func NewShared(svc database.Service, rdb *goredis.Client, ttl time.Duration) *Cache {
+	c := newCache(svc)
+	c.store = &redisStore{rdb: rdb, ttl: ttl, now: func() time.Time { return c.now() }}
+	return c
+}
+
+// redisStore keeps each result under its own key, expiring with the TTL.
+// The keys of a project are indexed in a sorted set scored by their
+// expiry, which invalidations go through.
+type redisStore struct {
+	rdb redisClient
+	ttl time.Duration
+	now func() time.Time
+}
+
+// member encodes the filter of k, 0 values of absent filters marked with
+// a dash, e.g. 1:42:-:1700000000000000000:100.
+func (k key) member() string {
+	field := func(v int64, ok bool) string {
+		if !ok {
+			return "-"
+		}
+		return strconv.FormatInt(v, 10)
+	}
+	return fmt.Sprintf("%d:%s:%s:%s:%d", k.projectID, field(k.userID, k.hasUser), field(k.start, k.hasStart), field(k.end, k.hasEnd), k.limit)
+}
+
+func parseMember(s string) (key, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 5 {
+		return key{}, fmt.Errorf("invalid query cache key %q", s)
+	}
+	var k key
+	var err error
+	field := func(s string, v *int64, ok *bool) {
+		if s == "-" || err != nil {
+			return
+		}
+		*v, err = strconv.ParseInt(s, 10, 64)
+		*ok = true
+	}
+	var hasProject bool
+	field(parts[0], &k.projectID, &hasProject)
+	field(parts[1], &k.userID, &k.hasUser)
+	field(parts[2], &k.start, &k.hasStart)
+	field(parts[3], &k.end, &k.hasEnd)
+	if err == nil {
+		k.limit, err = strconv.Atoi(parts[4])
+	}
+	if err != nil || !hasProject {
+		return key{}, fmt.Errorf("invalid query cache key %q", s)
+	}
+	return k, nil
+}
+
+func indexKey(projectID int64) string {
+	return indexPrefix + strconv.FormatInt(projectID, 10)
+}
+
+func (r *redisStore) get(ctx context.Context, k key) ([]database.Event, bool) {
+	data, err := r.rdb.Get(ctx, resultPrefix+k.member()).Bytes()
+	if err != nil {
+		if !errors.Is(err, goredis.Nil) {
+			redisErrors.Inc()
+		}
+		return nil, false
+	}
+	var events []database.Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		redisErrors.Inc()
+		return nil, false
+	}
+	return events, true
+}
+
+func (r *redisStore) put(ctx context.Context, k key, events []database.Event) {
+	data, err := json.Marshal(events)
+	if err != nil {
+		redisErrors.Inc()
+		return
+	}
+	now := r.now()
+	member := k.member()
+	index := indexKey(k.projectID)
+	// The result is indexed first, so that it is never stored without a
+	// way to invalidate it
+	errs := []error{
+		r.rdb.ZAdd(ctx, index, goredis.Z{Score: float64(now.Add(r.ttl).UnixMilli()), Member: member}).Err(),
+		r.rdb.PExpire(ctx, index, r.ttl).Err(),
+	}
+	if errors.Join(errs...) == nil {
+		errs = append(errs,
+			r.rdb.Set(ctx, resultPrefix+member, data, r.ttl).Err(),
+			r.rdb.ZRemRangeByScore(ctx, index, "-inf", strconv.FormatInt(now.UnixMilli(), 10)).Err(),
+		)
+	}
+	if errors.Join(errs...) != nil {
+		redisErrors.Inc()
+	}
+}
+
+func (r *redisStore) remove(ctx context.Context, k key) {
+	if err := r.rdb.Del(ctx, resultPrefix+k.member()).Err(); err != nil {
+		redisErrors.Inc()
+	}
+}
+
+func (r *redisStore) invalidate(ctx context.Context, events []database.NewEvent, now time.Time) int {
+	projects := make(map[int64]bool)
+	for _, e := range events {
+		projects[project(e.ProjectID)] = true
+	}
+
+	dropped := 0
+	for projectID := range projects {
+		index := indexKey(projectID)
+		members, err := r.rdb.ZRangeByScore(ctx, index, &goredis.ZRangeBy{
+			Min: strconv.FormatInt(now.UnixMilli(), 10),
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			redisErrors.Inc()
+			continue
+		}
+
+		var keys []string
+		var held []any
+		for _, m := range members {
+			k, err := parseMember(m)
+			if err != nil || k.holdsAny(events, now) {
+				keys = append(keys, resultPrefix+m)
+				held = append(held, m)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		if err := r.rdb.Del(ctx, keys...).Err(); err != nil {
+			redisErrors.Inc()
+			continue
+		}
+		if err := r.rdb.ZRem(ctx, index, held...).Err(); err != nil {
+			redisErrors.Inc()
+		}
+		dropped += len(keys)
+	}
+	return dropped
+}
+
+func (r *redisStore) flush(ctx context.Context, projectID *int64) int {
+	var indexes []string
+	if projectID != nil {
+		indexes = []string{indexKey(project(*projectID))}
+	} else {
+		var cursor uint64
+		for {
+			keys, next, err := r.rdb.Scan(ctx, cursor, indexPrefix+"*", 100).Result()
+			if err != nil {
+				redisErrors.Inc()
+				return 0
+			}
+			indexes = append(indexes, keys...)
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+
+	dropped := 0
+	for _, index := range indexes {
+		members, err := r.rdb.ZRangeByScore(ctx, index, &goredis.ZRangeBy{Min: "-inf", Max: "+inf"}).Result()
+		if err != nil {
+			redisErrors.Inc()
+			continue
+		}
+		keys := []string{index}
+		for _, m := range members {
+			keys = append(keys, resultPrefix+m)
+		}
+		if err := r.rdb.Del(ctx, keys...).Err(); err != nil {
+			redisErrors.Inc()
+			continue
+		}
+		dropped += len(members)
+	}
+	return dropped
+}
@@ -0,0 +1,129 @@
+package querycache
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+)
+
+// fakeRedis keeps strings and sorted sets in memory, expiring the strings
+// on the clock of the test.
+type fakeRedis struct {
+	now     func() time.Time
+	strings map[string]string
+	expires map[string]time.Time
+	zsets   map[string]map[string]float64
+}
+
+func newFakeRedis(now func() time.Time) *fakeRedis {
+	return &fakeRedis{
+		now:     now,
+		strings: make(map[string]string),
+		expires: make(map[string]time.Time),
+		zsets:   make(map[string]map[string]float64),
+	}
+}
+
+func (f *fakeRedis) Get(ctx context.Context, key string) *goredis.StringCmd {
+	v, ok := f.strings[key]
+	if !ok || !f.now().Before(f.expires[key]) {
+		return goredis.NewStringResult("", goredis.Nil)
+	}
+	return goredis.NewStringResult(v, nil)
+}
+
+func (f *fakeRedis) Set(ctx context.Context, key string, value any, expiration time.Duration) *goredis.StatusCmd {
+	f.strings[key] = string(value.([]byte))
+	f.expires[key] = f.now().Add(expiration)
+	return goredis.NewStatusResult("OK", nil)
+}
+
+func (f *fakeRedis) Del(ctx context.Context, keys ...string) *goredis.IntCmd {
+	for _, k := range keys {
+		delete(f.strings, k)
+		delete(f.zsets, k)
+	}
+	return goredis.NewIntResult(int64(len(keys)), nil)
+}
+
+func (f *fakeRedis) PExpire(ctx context.Context, key string, expiration time.Duration) *goredis.BoolCmd {
+	return goredis.NewBoolResult(true, nil)
+}
+
+func (f *fakeRedis) ZAdd(ctx context.Context, key string, members ...goredis.Z) *goredis.IntCmd {
+	if f.zsets[key] == nil {
+		f.zsets[key] = make(map[string]float64)
+	}
+	for _, m := range members {
+		f.zsets[key][m.Member.(string)] = m.Score
+	}
+	return goredis.NewIntResult(int64(len(members)), nil)
+}
+
+func (f *fakeRedis) ZRangeByScore(ctx context.Context, key string, opt *goredis.ZRangeBy) *goredis.StringSliceCmd {
+	min, _ := strconv.ParseFloat(opt.Min, 64)
+	var members []string
+	for m, score := range f.zsets[key] {
+		if score >= min {
+			members = append(members, m)
+		}
+	}
+	return goredis.NewStringSliceResult(members, nil)
+}
+
+func (f *fakeRedis) ZRem(ctx context.Context, key string, members ...any) *goredis.IntCmd {
+	for _, m := range members {
+		delete(f.zsets[key], m.(string))
+	}
+	return goredis.NewIntResult(int64(len(members)), nil)
+}
+
+func (f *fakeRedis) ZRemRangeByScore(ctx context.Context, key, min, max string) *goredis.IntCmd {
+	upper, _ := strconv.ParseFloat(max, 64)
+	for m, score := range f.zsets[key] {
+		if score <= upper {
+			delete(f.zsets[key], m)
+		}
+	}
+	return goredis.NewIntResult(0, nil)
+}
+
+// Scan returns every matching sorted set at once.
+func (f *fakeRedis) Scan(ctx context.Context, cursor uint64, match string, count int64) *goredis.ScanCmd {
+	var keys []string
+	for k := range f.zsets {
+		if strings.HasPrefix(k, strings.TrimSuffix(match, "*")) {
+			keys = append(keys, k)
+		}
+	}
+	cmd := goredis.NewScanCmd(ctx, nil)
+	cmd.SetVal(keys, 0)
+	return cmd
+}
+
+func TestMember(t *testing.T) {
+	start, end := time.Unix(1700000000, 0), time.Unix(1700003600, 0)
+	user := int64(42)
+	for _, k := range []key{
+		newKey(0, nil, nil, nil, 100),
+		newKey(3, &user, &start, nil, 10),
+		newKey(3, nil, &start, &end, 10),
+	} {
+		parsed, err := parseMember(k.member())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed != k {
+			t.Fatalf("expected %+v got %+v from %q", k, parsed, k.member())
+		}
+	}
+	for _, s := range []string{"", "1:2:3:4", "-:1:-:-:10", "1:x:-:-:10"} {
+		if _, err := parseMember(s); err == nil {
+			t.Fatalf("expected %q to be rejected", s)
+		}
+	}
+}
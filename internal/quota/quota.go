@@ -0,0 +1,458 @@
+// Package quota counts the events ingested and the queries served with each
+// API key and enforces the daily and monthly quotas of the configuration.
+//
+// Usage is counted in memory and added to the api_key_usage table on every
+// flush, which also reloads the totals of all instances. An instance thus
+// sees the usage of the others with up to one flush interval of lag.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Kinds of usage.
+const (
+	Events  = "events"
+	Queries = "queries"
+)
+
+// maxLabeledKeys bounds the api_key label of the metrics; the usage of
+// later keys is reported as "other".
+const maxLabeledKeys = 100
+
+var (
+	usageTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_usage_total",
+			Help: "Events and queries counted against the quotas of API keys",
+		},
+		[]string{"api_key", "kind"},
+	)
+	rejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_key_quota_rejections_total",
+			Help: "Requests rejected because the API key exceeded a quota",
+		},
+		[]string{"api_key", "kind"},
+	)
+	sharedErrors = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_key_quota_shared_errors_total",
+			Help: "Reservations that failed in the shared counters and were checked against the usage known to the instance",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(usageTotal, rejectionsTotal, sharedErrors)
+}
+
+// sharedTimeout bounds a reservation in the shared counters, which delays
+// the request.
+const sharedTimeout = time.Second
+
+// Store keeps the usage shared by all instances.
+type Store interface {
+	AddUsage(ctx context.Context, deltas []database.UsageDelta) error
+	Usage(ctx context.Context, keyIDs []int64, day time.Time) (map[int64]database.Usage, error)
+}
+
+// Shared counts the usage of every instance in one place, so that quotas
+// hold across instances without waiting for a flush.
+type Shared interface {
+	// Reserve adds n to the usage of kind by the key on day and in its
+	// month, unless a positive n would exceed the daily or monthly limit
+	// (0 for none); it then returns the period exceeded, "day" or "month".
+	// A counter missing from the shared store starts from base.
+	Reserve(ctx context.Context, keyID int64, kind string, day time.Time, n int64, base database.Usage, daily, monthly int) (exceeded string, err error)
+}
+
+// ExceededError is returned by Reserve when a quota would be exceeded.
+type ExceededError struct {
+	Kind string
+	// Period is "day" or "month".
+	Period string
+	Limit  int
+	// Reset is when the period ends and the quota is available again.
+	Reset time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("%s quota of %d %s per %s exceeded", e.Kind, e.Limit, e.Kind, e.Period)
+}
+
+// Period is the usage of an API key over a day or a month.
+type Period struct {
+	Start   time.Time `json:"start"`
+	Reset   time.Time `json:"reset"`
+	Events  int64     `json:"events"`
+	Queries int64     `json:"queries"`
+	// Quotas of 0 are unlimited.
+	EventsQuota  int `json:"events_quota"`
+	QueriesQuota int `json:"queries_quota"`
+}
+
+// Report is the usage of an API key on the current UTC day and month.
+type Report struct {
+	APIKeyID int64  `json:"api_key_id"`
+	Day      Period `json:"day"`
+	Month    Period `json:"month"`
+}
+
+// synced is the usage of a key loaded from the store.
+type synced struct {
+	day time.Time
+	database.Usage
+}
+
+type Meter struct {
+	l        *slog.Logger
+	store    Store
+	shared   Shared
+	cfg      config.QuotaConfig
+	interval time.Duration
+	now      func() time.Time
+
+	mu     sync.Mutex
+	synced map[int64]synced
+	// pending is counted since the last flush and inflight is being
+	// written by the current one, both by key and day.
+	pending  map[int64]map[time.Time]database.Counts
+	inflight map[int64]map[time.Time]database.Counts
+	labels   map[int64]string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(logger *slog.Logger, cfg config.QuotaConfig, store Store) *Meter {
+	return &Meter{
+		l:        logger.With("component", "quota"),
+		store:    store,
+		cfg:      cfg,
+		interval: time.Duration(cfg.FlushIntervalSeconds) * time.Second,
+		now:      time.Now,
+		synced:   make(map[int64]synced),
+		pending:  make(map[int64]map[time.Time]database.Counts),
+		labels:   make(map[int64]string),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// ShareWith checks the quotas against the usage counted in shared by every
+// instance. The usage is still flushed to the store, which reports it; when
+// shared fails, the quotas are checked against the usage known to the
+// instance.
+func (m *Meter) ShareWith(shared Shared) {
+	m.shared = shared
+}
+
+func (m *Meter) today() time.Time {
+	return m.now().UTC().Truncate(24 * time.Hour)
+}
+
+func monthStart(day time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func add(c *database.Counts, d database.Counts) {
+	c.Events += d.Events
+	c.Queries += d.Queries
+}
+
+func get(c database.Counts, kind string) int64 {
+	if kind == Events {
+		return c.Events
+	}
+	return c.Queries
+}
+
+func counts(kind string, n int64) database.Counts {
+	if kind == Events {
+		return database.Counts{Events: n}
+	}
+	return database.Counts{Queries: n}
+}
+
+// used returns the usage of a key on day and in its month so far, m.mu held.
+func (m *Meter) used(keyID int64, day time.Time) database.Usage {
+	u := m.local(keyID, day)
+	s := m.stored(keyID, day)
+	add(&u.Day, s.Day)
+	add(&u.Month, s.Month)
+	return u
+}
+
+// stored returns the usage of a key on day and in its month last loaded
+// from the store, m.mu held.
+func (m *Meter) stored(keyID int64, day time.Time) database.Usage {
+	var u database.Usage
+	if s, ok := m.synced[keyID]; ok {
+		if s.day.Equal(day) {
+			u = s.Usage
+		} else if monthStart(s.day).Equal(monthStart(day)) && s.day.Before(day) {
+			u.Month = s.Month
+		}
+	}
+	return u
+}
+
+// local returns the usage of a key not in the store yet, m.mu held.
+func (m *Meter) local(keyID int64, day time.Time) database.Usage {
+	var u database.Usage
+	month := monthStart(day)
+	for _, local := range []map[int64]map[time.Time]database.Counts{m.pending, m.inflight} {
+		for d, c := range local[keyID] {
+			if d.Equal(day) {
+				add(&u.Day, c)
+			}
+			if monthStart(d).Equal(month) && !d.After(day) {
+				add(&u.Month, c)
+			}
+		}
+	}
+	return u
+}
+
+// label returns the api_key label of a key, m.mu held.
+func (m *Meter) label(keyID int64) string {
+	if l, ok := m.labels[keyID]; ok {
+		return l
+	}
+	l := "other"
+	if len(m.labels) < maxLabeledKeys {
+		l = strconv.FormatInt(keyID, 10)
+	}
+	m.labels[keyID] = l
+	return l
+}
+
+func (m *Meter) limits(kind string) (daily, monthly int) {
+	if kind == Events {
+		return m.cfg.DailyEvents, m.cfg.MonthlyEvents
+	}
+	return m.cfg.DailyQueries, m.cfg.MonthlyQueries
+}
+
+// Reserve counts n events or queries of kind for the key, or returns an
+// *ExceededError without counting them when that would exceed a quota.
+func (m *Meter) Reserve(keyID int64, kind string, n int64) error {
+	day := m.today()
+	daily, monthly := m.limits(kind)
+
+	exceeded, shared := m.reserveShared(keyID, kind, day, n, daily, monthly)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !shared && (daily > 0 || monthly > 0) {
+		u := m.used(keyID, day)
+		switch {
+		case daily > 0 && get(u.Day, kind)+n > int64(daily):
+			exceeded = "day"
+		case monthly > 0 && get(u.Month, kind)+n > int64(monthly):
+			exceeded = "month"
+		}
+	}
+	switch exceeded {
+	case "day":
+		rejectionsTotal.WithLabelValues(m.label(keyID), kind).Inc()
+		return &ExceededError{Kind: kind, Period: "day", Limit: daily, Reset: day.AddDate(0, 0, 1)}
+	case "month":
+		rejectionsTotal.WithLabelValues(m.label(keyID), kind).Inc()
+		return &ExceededError{Kind: kind, Period: "month", Limit: monthly, Reset: monthStart(day).AddDate(0, 1, 0)}
+	}
+
+	m.addPending(keyID, day, counts(kind, n))
+	usageTotal.WithLabelValues(m.label(keyID), kind).Add(float64(n))
+	return nil
+}
+
+// reserveShared reserves n in the shared counters, if any, and reports
+// whether they answered.
+func (m *Meter) reserveShared(keyID int64, kind string, day time.Time, n int64, daily, monthly int) (exceeded string, ok bool) {
+	if m.shared == nil {
+		return "", false
+	}
+	m.mu.Lock()
+	base := m.stored(keyID, day)
+	m.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), sharedTimeout)
+	defer cancel()
+	exceeded, err := m.shared.Reserve(ctx, keyID, kind, day, n, base, daily, monthly)
+	if err != nil {
+		sharedErrors.Inc()
+		return "", false
+	}
+	return exceeded, true
+}
+
+// Release gives back usage reserved for a request that failed.
+func (m *Meter) Release(keyID int64, kind string, n int64) {
+	day := m.today()
+	m.reserveShared(keyID, kind, day, -n, 0, 0)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addPending(keyID, day, counts(kind, -n))
+}
+
+// addPending adds c to the pending usage of the key on day, m.mu held.
+func (m *Meter) addPending(keyID int64, day time.Time, c database.Counts) {
+	days, ok := m.pending[keyID]
+	if !ok {
+		days = make(map[time.Time]database.Counts)
+		m.pending[keyID] = days
+	}
+	total := days[day]
+	add(&total, c)
+	days[day] = total
+}
+
+// Usage reports the usage of a key, including what this instance did not
+// flush yet.
+func (m *Meter) Usage(ctx context.Context, keyID int64) (Report, error) {
+	day := m.today()
+	stored, err := m.store.Usage(ctx, []int64{keyID}, day)
+	if err != nil {
+		return Report{}, err
+	}
+
+	m.mu.Lock()
+	u := m.local(keyID, day)
+	m.mu.Unlock()
+	add(&u.Day, stored[keyID].Day)
+	add(&u.Month, stored[keyID].Month)
+
+	month := monthStart(day)
+	return Report{
+		APIKeyID: keyID,
+		Day: Period{
+			Start: day, Reset: day.AddDate(0, 0, 1),
+			Events: u.Day.Events, Queries: u.Day.Queries,
+			EventsQuota: m.cfg.DailyEvents, QueriesQuota: m.cfg.DailyQueries,
+		},
+		Month: Period{
+			Start: month, Reset: month.AddDate(0, 1, 0),
+			Events: u.Month.Events, Queries: u.Month.Queries,
+			EventsQuota: m.cfg.MonthlyEvents, QueriesQuota: m.cfg.MonthlyQueries,
+		},
+	}, nil
+}
+
+// Start flushes the usage every interval until Stop is called.
+func (m *Meter) Start() {
+	go func() {
+		defer close(m.done)
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+			if err := m.flush(ctx); err != nil {
+				m.l.Warn("failed to flush API key usage", "error", err)
+			}
+			cancel()
+		}
+	}()
+}
+
+// Stop flushes the usage counted since the last flush.
+func (m *Meter) Stop(ctx context.Context) error {
+	close(m.stop)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return m.flush(ctx)
+}
+
+// flush adds the pending usage to the store and reloads the totals of the
+// keys used by this instance. Usage that failed to be written stays pending.
+func (m *Meter) flush(ctx context.Context) error {
+	m.mu.Lock()
+	m.inflight, m.pending = m.pending, make(map[int64]map[time.Time]database.Counts)
+	var deltas []database.UsageDelta
+	for id, days := range m.inflight {
+		for day, c := range days {
+			if c != (database.Counts{}) {
+				deltas = append(deltas, database.UsageDelta{APIKeyID: id, Day: day, Counts: c})
+			}
+		}
+	}
+	ids := make([]int64, 0, len(m.synced)+len(m.inflight))
+	for id := range m.synced {
+		ids = append(ids, id)
+	}
+	for id := range m.inflight {
+		if _, ok := m.synced[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	m.mu.Unlock()
+
+	if err := m.store.AddUsage(ctx, deltas); err != nil {
+		m.mu.Lock()
+		for id, days := range m.inflight {
+			for day, c := range days {
+				m.addPending(id, day, c)
+			}
+		}
+		m.inflight = nil
+		m.mu.Unlock()
+		return fmt.Errorf("add usage: %w", err)
+	}
+	if len(ids) == 0 {
+		m.mu.Lock()
+		m.inflight = nil
+		m.mu.Unlock()
+		return nil
+	}
+
+	day := m.today()
+	usage, err := m.store.Usage(ctx, ids, day)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		// Keep the written usage counted until the next reload
+		for id, days := range m.inflight {
+			s, ok := m.synced[id]
+			if !ok {
+				s.day = day
+			}
+			for d, c := range days {
+				if d.Equal(s.day) {
+					add(&s.Day, c)
+				}
+				if monthStart(d).Equal(monthStart(s.day)) && !d.After(s.day) {
+					add(&s.Month, c)
+				}
+			}
+			m.synced[id] = s
+		}
+		m.inflight = nil
+		return fmt.Errorf("load usage: %w", err)
+	}
+	m.inflight = nil
+	for _, id := range ids {
+		m.synced[id] = synced{day: day, Usage: usage[id]}
+	}
+	return nil
+}
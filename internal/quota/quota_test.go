@@ -0,0 +1,260 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// memStore keeps the usage by key and day, like the api_key_usage table.
+type memStore struct {
+	mu   sync.Mutex
+	days map[int64]map[time.Time]database.Counts
+	err  error
+}
+
+func (s *memStore) AddUsage(ctx context.Context, deltas []database.UsageDelta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	for _, d := range deltas {
+		if s.days[d.APIKeyID] == nil {
+			s.days[d.APIKeyID] = make(map[time.Time]database.Counts)
+		}
+		c := s.days[d.APIKeyID][d.Day]
+		add(&c, d.Counts)
+		s.days[d.APIKeyID][d.Day] = c
+	}
+	return nil
+}
+
+func (s *memStore) Usage(ctx context.Context, keyIDs []int64, day time.Time) (map[int64]database.Usage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, s.err
+	}
+	usage := make(map[int64]database.Usage)
+	for _, id := range keyIDs {
+		var u database.Usage
+		for d, c := range s.days[id] {
+			if d.Equal(day) {
+				add(&u.Day, c)
+			}
+			if monthStart(d).Equal(monthStart(day)) && !d.After(day) {
+				add(&u.Month, c)
+			}
+		}
+		usage[id] = u
+	}
+	return usage, nil
+}
+
+func TestMeter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := &memStore{days: map[int64]map[time.Time]database.Counts{}}
+	cfg := config.QuotaConfig{DailyEvents: 10, MonthlyEvents: 18, FlushIntervalSeconds: 10}
+	now := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+	newMeter := func() *Meter {
+		m := New(logger, cfg, store)
+		m.now = func() time.Time { return now }
+		return m
+	}
+	ctx := context.Background()
+
+	a, b := newMeter(), newMeter()
+	b.Start()
+	if err := a.Reserve(1, Events, 6); err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	a.Release(1, Events, 1)
+	if err := a.Reserve(1, Events, 6); err == nil {
+		t.Fatal("expected the daily quota to be exceeded")
+	}
+	// Queries are unlimited
+	if err := a.Reserve(1, Queries, 1000); err != nil {
+		t.Fatalf("reserve queries: %v", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	// Another instance sees the usage after its own flush
+	if err := b.Reserve(1, Events, 5); err != nil {
+		t.Fatalf("reserve on b: %v", err)
+	}
+	if err := b.flush(ctx); err != nil {
+		t.Fatalf("flush b: %v", err)
+	}
+	var exceeded *ExceededError
+	if err := b.Reserve(1, Events, 1); !errors.As(err, &exceeded) || exceeded.Period != "day" || !exceeded.Reset.Equal(time.Date(2025, 1, 31, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the daily quota exceeded until midnight, got %v", err)
+	}
+	// Other keys have their own quota
+	if err := b.Reserve(2, Events, 10); err != nil {
+		t.Fatalf("reserve key 2: %v", err)
+	}
+
+	// The next day the monthly quota is left
+	now = now.Add(24 * time.Hour)
+	if err := b.Reserve(1, Events, 6); err != nil {
+		t.Fatalf("reserve the next day: %v", err)
+	}
+	if err := b.Reserve(1, Events, 3); !errors.As(err, &exceeded) || exceeded.Period != "month" || exceeded.Limit != 18 {
+		t.Fatalf("expected the monthly quota exceeded, got %v", err)
+	}
+
+	// Failed flushes keep the usage pending
+	store.err = errors.New("db down")
+	if err := b.flush(ctx); err == nil {
+		t.Fatal("expected the flush to fail")
+	}
+	report, err := a.Usage(ctx, 1)
+	if err == nil {
+		t.Fatalf("expected the report to fail, got %+v", report)
+	}
+	store.err = nil
+	if err := b.Stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	report, err = a.Usage(ctx, 1)
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	if report.Day.Events != 6 || report.Month.Events != 16 || report.Month.Queries != 1000 || report.Day.EventsQuota != 10 || report.Month.EventsQuota != 18 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	if !report.Month.Reset.Equal(time.Date(2025, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected month reset %v", report.Month.Reset)
+	}
+}
+
+// memShared counts the usage by key, kind and day like the Redis counters,
+// for a single month.
+type memShared struct {
+	mu     sync.Mutex
+	days   map[string]int64
+	months map[string]int64
+	err    error
+}
+
+func (s *memShared) Reserve(ctx context.Context, keyID int64, kind string, day time.Time, n int64, base database.Usage, daily, monthly int) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return "", s.err
+	}
+	dayKey := fmt.Sprint(keyID, kind, day)
+	monthKey := fmt.Sprint(keyID, kind, monthStart(day))
+	if _, ok := s.days[dayKey]; !ok {
+		s.days[dayKey] = get(base.Day, kind)
+	}
+	if _, ok := s.months[monthKey]; !ok {
+		s.months[monthKey] = get(base.Month, kind)
+	}
+	switch {
+	case n > 0 && daily > 0 && s.days[dayKey]+n > int64(daily):
+		return "day", nil
+	case n > 0 && monthly > 0 && s.months[monthKey]+n > int64(monthly):
+		return "month", nil
+	}
+	s.days[dayKey] += n
+	s.months[monthKey] += n
+	return "", nil
+}
+
+func TestSharedMeter(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	store := &memStore{days: map[int64]map[time.Time]database.Counts{}}
+	shared := &memShared{days: map[string]int64{}, months: map[string]int64{}}
+	cfg := config.QuotaConfig{DailyEvents: 10, FlushIntervalSeconds: 10}
+	now := time.Date(2025, 1, 30, 12, 0, 0, 0, time.UTC)
+	newMeter := func() *Meter {
+		m := New(logger, cfg, store)
+		m.now = func() time.Time { return now }
+		return m
+	}
+	ctx := context.Background()
+
+	// Usage stored before the counters were shared is their start
+	a := newMeter()
+	if err := a.Reserve(1, Events, 4); err != nil {
+		t.Fatalf("reserve: %v", err)
+	}
+	if err := a.flush(ctx); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+	a.ShareWith(shared)
+	b := newMeter()
+	b.ShareWith(shared)
+	if err := b.flush(ctx); err != nil {
+		t.Fatalf("flush b: %v", err)
+	}
+
+	// Instances see the usage of each other without flushing
+	if err := a.Reserve(1, Events, 3); err != nil {
+		t.Fatalf("reserve on a: %v", err)
+	}
+	if err := b.Reserve(1, Events, 3); err != nil {
+		t.Fatalf("reserve on b: %v", err)
+	}
+	var exceeded *ExceededError
+	if err := a.Reserve(1, Events, 1); !errors.As(err, &exceeded) || exceeded.Period != "day" {
+		t.Fatalf("expected the daily quota exceeded, got %v", err)
+	}
+	b.Release(1, Events, 1)
+	if err := a.Reserve(1, Events, 1); err != nil {
+		t.Fatalf("expected the released usage to be available, got %v", err)
+	}
+
+	// Without the shared counters an instance checks what it knows: b
+	// never loaded the usage of the key, so it only knows its own
+	shared.err = errors.New("redis down")
+	if err := b.Reserve(1, Events, 8); err != nil {
+		t.Fatalf("reserve without the shared counters: %v", err)
+	}
+	if err := b.Reserve(1, Events, 1); !errors.As(err, &exceeded) {
+		t.Fatalf("expected the quota checked locally, got %v", err)
+	}
+
+	// The usage is still flushed to the store for the reports
+	if err := a.flush(ctx); err != nil {
+		t.Fatalf("flush a: %v", err)
+	}
+	if err := b.flush(ctx); err != nil {
+		t.Fatalf("flush b: %v", err)
+	}
+	report, err := a.Usage(ctx, 1)
+	if err != nil {
+		t.Fatalf("usage: %v", err)
+	}
+	if report.Day.Events != 18 {
+		t.Fatalf("expected 18 events reported, got %+v", report.Day)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	m := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.QuotaConfig{FlushIntervalSeconds: 1}, &memStore{})
+	for id := range int64(maxLabeledKeys) {
+		if l := m.label(id + 1); l == "other" {
+			t.Fatalf("expected key %d to have its own label", id+1)
+		}
+	}
+	if l := m.label(maxLabeledKeys + 1); l != "other" {
+		t.Fatalf("expected later keys to share a label, got %q", l)
+	}
+	if l := m.label(1); l != "1" {
+		t.Fatalf("expected labels to be stable, got %q", l)
+	}
+}
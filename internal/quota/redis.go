@@ -0,0 +1,68 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// reserveScript adds ARGV[1] to the day (KEYS[1]) and month (KEYS[2])
+// counters unless a positive amount exceeds the daily (ARGV[2]) or monthly
+// (ARGV[3]) limit, 0 for none, and returns 1 or 2 for the period exceeded,
+// 0 otherwise. Missing counters start from ARGV[4] and ARGV[5] and expire at
+// the Unix milliseconds ARGV[6] and ARGV[7].
+var reserveScript = goredis.NewScript(`
+local n = tonumber(ARGV[1])
+redis.call('SET', KEYS[1], ARGV[4], 'NX', 'PXAT', ARGV[6])
+redis.call('SET', KEYS[2], ARGV[5], 'NX', 'PXAT', ARGV[7])
+if n > 0 then
+	local daily, monthly = tonumber(ARGV[2]), tonumber(ARGV[3])
+	if daily > 0 and tonumber(redis.call('GET', KEYS[1])) + n > daily then
+		return 1
+	end
+	if monthly > 0 and tonumber(redis.call('GET', KEYS[2])) + n > monthly then
+		return 2
+	end
+end
+redis.call('INCRBY', KEYS[1], n)
+redis.call('INCRBY', KEYS[2], n)
+return 0
+`)
+
+// RedisCounter shares the usage of the API keys in Redis, under
+// events:quota:<key>:<kind>:<day or month> counters kept a day past their
+// period.
+type RedisCounter struct {
+	rdb goredis.Scripter
+}
+
+func NewRedisCounter(rdb *goredis.Client) *RedisCounter {
+	return &RedisCounter{rdb: rdb}
+}
+
+func (r *RedisCounter) Reserve(ctx context.Context, keyID int64, kind string, day time.Time, n int64, base database.Usage, daily, monthly int) (string, error) {
+	month := monthStart(day)
+	keys := []string{
+		fmt.Sprintf("events:quota:%d:%s:%s", keyID, kind, day.Format(time.DateOnly)),
+		fmt.Sprintf("events:quota:%d:%s:%s", keyID, kind, month.Format("2006-01")),
+	}
+	exceeded, err := reserveScript.Run(ctx, r.rdb, keys,
+		n, daily, monthly,
+		get(base.Day, kind), get(base.Month, kind),
+		day.AddDate(0, 0, 2).UnixMilli(), month.AddDate(0, 1, 1).UnixMilli(),
+	).Int()
+	if err != nil {
+		return "", fmt.Errorf("reserve usage in redis: %w", err)
+	}
+	switch exceeded {
+	case 1:
+		return "day", nil
+	case 2:
+		return "month", nil
+	}
+	return "", nil
+}
@@ -0,0 +1,235 @@
+// Package recorder keeps sanitized copies of the requests of the public API
+// (DEBUG_RECORD_REQUESTS), so that the requests of a client hitting a bug
+// can be inspected and replayed against the handlers on the admin listener.
+//
+// The last requests are kept in a ring buffer, and every one is appended to
+// a file as a JSON line when configured. Headers, query parameters and the
+// fields of JSON bodies whose name looks like a secret are redacted before
+// a request is kept.
+package recorder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// Redacted replaces the values of the secrets.
+const Redacted = "[redacted]"
+
+// sensitiveNames are the parts of the names of headers, query parameters
+// and body fields holding secrets.
+var sensitiveNames = []string{"secret", "token", "password", "key", "auth", "signature", "cookie"}
+
+// Request is a sanitized copy of a request and the status it was answered
+// with.
+type Request struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Method and URL, the path with its query
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Body is base64 encoded when BodyEncoding is base64, for bodies that
+	// are not UTF-8 text.
+	Body         string `json:"body,omitempty"`
+	BodyEncoding string `json:"body_encoding,omitempty"`
+	// Truncated is set when the body was cut after the limit.
+	Truncated bool   `json:"truncated,omitempty"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// BodyBytes returns the body as sent, redactions and truncation aside.
+func (r Request) BodyBytes() ([]byte, error) {
+	if r.BodyEncoding == "base64" {
+		return base64.StdEncoding.DecodeString(r.Body)
+	}
+	return []byte(r.Body), nil
+}
+
+// Recorder keeps the last requests in memory, and all of them in its file
+// when it has one. It is safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	ring    []Request
+	next    int
+	lastID  int64
+	file    *os.File
+	maxBody int
+	now     func() time.Time
+}
+
+// New returns the recorder of cfg, opening its file for appending.
+func New(cfg config.DebugConfig) (*Recorder, error) {
+	r := &Recorder{ring: make([]Request, 0, cfg.RecordRequests), maxBody: cfg.RecordMaxBodyKB << 10, now: time.Now}
+	if cfg.RecordFile != "" {
+		f, err := os.OpenFile(cfg.RecordFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open request recording file: %w", err)
+		}
+		r.file = f
+	}
+	return r, nil
+}
+
+// MaxBodyBytes is the length after which bodies are cut.
+func (r *Recorder) MaxBodyBytes() int {
+	return r.maxBody
+}
+
+// Record sanitizes req and keeps it under the next id. body holds up to
+// MaxBodyBytes of the body, truncated when there was more. A failure to
+// append to the file is returned once the request is kept in memory.
+func (r *Recorder) Record(req *http.Request, body []byte, truncated bool, status int, requestID string) error {
+	rec := Request{
+		Method:    req.Method,
+		URL:       sanitizeURL(req.URL),
+		Headers:   sanitizeHeaders(req.Header),
+		Truncated: truncated,
+		Status:    status,
+		RequestID: requestID,
+	}
+	body = sanitizeBody(body)
+	if utf8.Valid(body) {
+		rec.Body = string(body)
+	} else {
+		rec.Body, rec.BodyEncoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	rec.ID, rec.Time = r.lastID, r.now().UTC()
+	if len(r.ring) < cap(r.ring) {
+		r.ring = append(r.ring, rec)
+	} else {
+		r.ring[r.next] = rec
+		r.next = (r.next + 1) % len(r.ring)
+	}
+	if r.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.Write(append(line, '\n'))
+	return err
+}
+
+// List returns up to limit of the requests kept in memory, newest first.
+func (r *Recorder) List(limit int) []Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	requests := make([]Request, 0, min(limit, len(r.ring)))
+	for i := range r.ring {
+		if len(requests) == limit {
+			break
+		}
+		// The newest is just before next once the ring is full
+		requests = append(requests, r.ring[(r.next-1-i+2*len(r.ring))%len(r.ring)])
+	}
+	return requests
+}
+
+// Get returns the request id when it is still kept in memory.
+func (r *Recorder) Get(id int64) (Request, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := slices.IndexFunc(r.ring, func(req Request) bool { return req.ID == id })
+	if i < 0 {
+		return Request{}, false
+	}
+	return r.ring[i], true
+}
+
+// Close closes the file.
+func (r *Recorder) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func sensitive(name string) bool {
+	name = strings.ToLower(name)
+	return slices.ContainsFunc(sensitiveNames, func(s string) bool { return strings.Contains(name, s) })
+}
+
+func sanitizeHeaders(h http.Header) map[string]string {
+	headers := make(map[string]string, len(h))
+	for k, v := range h {
+		if sensitive(k) {
+			headers[k] = Redacted
+			continue
+		}
+		headers[k] = strings.Join(v, ", ")
+	}
+	return headers
+}
+
+func sanitizeURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	q := u.Query()
+	for k := range q {
+		if sensitive(k) {
+			q[k] = []string{Redacted}
+		}
+	}
+	return u.Path + "?" + q.Encode()
+}
+
+// sanitizeBody redacts the sensitive fields of a JSON body, at any depth.
+// Other bodies are kept as they are.
+func sanitizeBody(body []byte) []byte {
+	var v any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if dec.Decode(&v) != nil || dec.More() {
+		return body
+	}
+	redacted := false
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			for k, child := range v {
+				if sensitive(k) {
+					v[k] = Redacted
+					redacted = true
+					continue
+				}
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(v)
+	if !redacted {
+		return body
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return body
+	}
+	return b
+}
@@ -0,0 +1,97 @@
+package recorder
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func TestRecord(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "requests.jsonl")
+	r, err := New(config.DebugConfig{RecordRequests: 2, RecordFile: file, RecordMaxBodyKB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/events?api_key=abc&limit=5", nil)
+	req.Header.Set("Authorization", "Bearer sek_123")
+	req.Header.Set("X-Signature", "t=1,v1=abcd")
+	req.Header.Set("Content-Type", "application/json")
+	body := `{"user_id":1,"action":"login","metadata":{"page":"/home","password":"hunter2"}}`
+	if err := r.Record(req, []byte(body), false, http.StatusCreated, "req-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := r.Get(1)
+	if !ok {
+		t.Fatal("expected request 1 to be kept")
+	}
+	if got.Headers["Authorization"] != Redacted || got.Headers["X-Signature"] != Redacted || got.Headers["Content-Type"] != "application/json" {
+		t.Fatalf("unexpected headers %v", got.Headers)
+	}
+	if got.URL != "/api/events?api_key=%5Bredacted%5D&limit=5" {
+		t.Fatalf("unexpected url %q", got.URL)
+	}
+	if strings.Contains(got.Body, "hunter2") || !strings.Contains(got.Body, `"page":"/home"`) || got.Status != http.StatusCreated {
+		t.Fatalf("unexpected request %+v", got)
+	}
+
+	// Bodies other than JSON are kept as sent, binary ones in base64
+	if err := r.Record(httptest.NewRequest(http.MethodGet, "/api/beacon.gif", nil), []byte{0xff, 0xfe}, true, http.StatusOK, ""); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = r.Get(2)
+	if b, err := got.BodyBytes(); err != nil || len(b) != 2 || b[0] != 0xff || got.BodyEncoding != "base64" || !got.Truncated {
+		t.Fatalf("unexpected binary body %+v: %v", got, err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var lines int
+	for s := bufio.NewScanner(f); s.Scan(); lines++ {
+		var rec Request
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil || rec.ID != int64(lines+1) {
+			t.Fatalf("unexpected line %s: %v", s.Bytes(), err)
+		}
+	}
+	if lines != 2 {
+		t.Fatalf("expected 2 lines, got %d", lines)
+	}
+}
+
+func TestRing(t *testing.T) {
+	r, err := New(config.DebugConfig{RecordRequests: 3, RecordMaxBodyKB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 5 {
+		if err := r.Record(httptest.NewRequest(http.MethodGet, "/api/events", nil), nil, false, http.StatusOK, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ids []int64
+	for _, req := range r.List(10) {
+		ids = append(ids, req.ID)
+	}
+	if len(ids) != 3 || ids[0] != 5 || ids[1] != 4 || ids[2] != 3 {
+		t.Fatalf("expected the 3 newest requests, newest first, got %v", ids)
+	}
+	if got := r.List(1); len(got) != 1 || got[0].ID != 5 {
+		t.Fatalf("expected the newest request, got %+v", got)
+	}
+	if _, ok := r.Get(2); ok {
+		t.Fatal("expected request 2 to be dropped")
+	}
+}
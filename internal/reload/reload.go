@@ -0,0 +1,93 @@
+package reload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// Func applies the runtime settings of a freshly loaded configuration.
+// Settings that require new sockets or connections (ports, TLS, database)
+// are never reloaded.
+type Func func(cfg *config.Config) error
+
+type hook struct {
+	name string
+	fn   Func
+}
+
+// Reloader re-reads the configuration and hands it to every registered hook,
+// so operational tweaks don't require a restart.
+type Reloader struct {
+	logger *slog.Logger
+	path   string
+
+	mu    sync.Mutex
+	hooks []hook
+}
+
+// New returns a Reloader loading the configuration from path (may be empty,
+// in which case only the environment is used, like at startup).
+func New(logger *slog.Logger, path string) *Reloader {
+	return &Reloader{logger: logger, path: path}
+}
+
+// Register adds a hook run on every reload.
+func (r *Reloader) Register(name string, fn Func) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hooks = append(r.hooks, hook{name: name, fn: fn})
+}
+
+// Reload loads and validates the configuration and applies it. An invalid
+// configuration is rejected as a whole and nothing is changed.
+func (r *Reloader) Reload() error {
+	cfg, err := config.Load(r.path)
+	if err != nil {
+		return err
+	}
+	return r.Apply(cfg)
+}
+
+// Apply runs every hook with cfg. All hooks run even if some fail.
+func (r *Reloader) Apply(cfg *config.Config) error {
+	r.mu.Lock()
+	hooks := append([]hook(nil), r.hooks...)
+	r.mu.Unlock()
+
+	var errs []error
+	for _, h := range hooks {
+		if err := h.fn(cfg); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", h.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// WatchSignals reloads the configuration on every SIGHUP until ctx is done.
+func (r *Reloader) WatchSignals(ctx context.Context) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	defer signal.Stop(sig)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sig:
+			r.logger.Info("SIGHUP received, reloading configuration")
+			if err := r.Reload(); err != nil {
+				r.logger.Error("configuration reload failed", "error", err.Error())
+				continue
+			}
+			r.logger.Info("configuration reloaded")
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package reload
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func TestReload(t *testing.T) {
+	t.Setenv("DB_DATABASE", "events")
+	t.Setenv("DB_USERNAME", "username")
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("failed to write config: %v", err)
+		}
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	r := New(logger, path)
+
+	var levels []string
+	r.Register("level", func(cfg *config.Config) error {
+		levels = append(levels, cfg.Log.Level)
+		return nil
+	})
+	r.Register("failing", func(cfg *config.Config) error {
+		return errors.New("boom")
+	})
+
+	write("log:\n  level: debug\n")
+	err := r.Reload()
+	if err == nil || !strings.Contains(err.Error(), "failing: boom") {
+		t.Fatalf("expected hook error, got %v", err)
+	}
+	if len(levels) != 1 || levels[0] != "debug" {
+		t.Fatalf("expected level hook to run with debug, got %v", levels)
+	}
+
+	// an invalid file is rejected as a whole
+	write("log:\n  level: verbose\n")
+	if err := r.Reload(); err == nil || !strings.Contains(err.Error(), "LOG_LEVEL") {
+		t.Fatalf("expected validation error, got %v", err)
+	}
+	if len(levels) != 1 {
+		t.Fatalf("expected hooks not to run for invalid config, got %v", levels)
+	}
+}
@@ -0,0 +1,350 @@
+// Package replay publishes historical events again to a sink, for
+// downstream consumers that lost data: the deliveries of a webhook
+// subscription are scheduled again, or the events are published to a Kafka
+// topic. Replays run one at a time in the background and do not move the
+// position of the sinks.
+package replay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var (
+	// ErrNotFound is returned for unknown or forgotten replay ids.
+	ErrNotFound = errors.New("replay not found")
+	// ErrBusy is returned by Submit while too many replays are pending.
+	ErrBusy = errors.New("too many pending replays")
+	// ErrClosed is returned by Submit once Stop was called.
+	ErrClosed = errors.New("replays are shutting down")
+	// ErrInvalid is returned by Submit for requests that cannot be replayed.
+	ErrInvalid = errors.New("invalid replay")
+)
+
+const (
+	// maxRuns bounds the replays kept in memory and the pending ones.
+	maxRuns = 100
+	// batchSize is the number of events published at once.
+	batchSize = 500
+)
+
+const (
+	SinkWebhook = "webhook"
+	SinkKafka   = "kafka"
+)
+
+var eventsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "replay_events_total",
+		Help: "Events replayed by sink",
+	},
+	[]string{"sink"},
+)
+
+func init() {
+	prometheus.MustRegister(eventsTotal)
+}
+
+// Source reads the events matching a filter in id order, like
+// database.EventStream.
+type Source interface {
+	Filter(ctx context.Context, f database.EventFilter, fn func(database.Event) error) error
+}
+
+// Subscriptions schedules deliveries to webhook subscriptions, like
+// database.SubscriptionStore.
+type Subscriptions interface {
+	GetSubscription(ctx context.Context, id int64) (database.Subscription, error)
+	EnqueueDeliveries(ctx context.Context, subscriptionID int64, eventIDs []int64) (int64, error)
+}
+
+// Publisher publishes events to a Kafka topic, like the Kafka sink.
+type Publisher interface {
+	Topic() string
+	PublishTo(ctx context.Context, topic string, events []database.Event) error
+}
+
+// Targets are the sinks events can be replayed to. A nil target is not
+// configured.
+type Targets struct {
+	Subscriptions Subscriptions
+	Kafka         Publisher
+}
+
+// Request selects the events created in [From, To), optionally of a single
+// user and action, and the sink they are replayed to: a webhook
+// subscription, or a Kafka topic (the topic of the Kafka sink when empty).
+type Request struct {
+	UserID         *int64    `json:"user_id,omitempty"`
+	Action         string    `json:"action,omitempty"`
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	Sink           string    `json:"sink"`
+	SubscriptionID int64     `json:"subscription_id,omitempty"`
+	Topic          string    `json:"topic,omitempty"`
+}
+
+type Status string
+
+const (
+	StatusQueued    Status = "queued"
+	StatusRunning   Status = "running"
+	StatusSucceeded Status = "succeeded"
+	StatusFailed    Status = "failed"
+)
+
+type Run struct {
+	ID      string  `json:"id"`
+	Request Request `json:"request"`
+	Status  Status  `json:"status"`
+	// Matched counts the events read, Published the messages published or
+	// the deliveries scheduled. Deliveries are only scheduled for events
+	// matching the filters of the subscription.
+	Matched    int64      `json:"matched"`
+	Published  int64      `json:"published"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+func (r *Run) finished() bool {
+	return r.Status == StatusSucceeded || r.Status == StatusFailed
+}
+
+// Replayer runs replays one at a time and keeps them in memory for status
+// queries.
+type Replayer struct {
+	l       *slog.Logger
+	events  Source
+	targets Targets
+
+	mu     sync.Mutex
+	runs   map[string]*Run
+	order  []string
+	closed bool
+	lastID int64
+	queue  chan *Run
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func New(logger *slog.Logger, events Source, targets Targets) *Replayer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Replayer{
+		l:       logger,
+		events:  events,
+		targets: targets,
+		runs:    make(map[string]*Run),
+		queue:   make(chan *Run, maxRuns),
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+// Submit validates req and queues the replay.
+func (r *Replayer) Submit(ctx context.Context, req Request) (Run, error) {
+	if req.From.IsZero() || req.To.IsZero() || !req.From.Before(req.To) {
+		return Run{}, fmt.Errorf("%w: from and to are required and from must be before to", ErrInvalid)
+	}
+	switch req.Sink {
+	case SinkWebhook:
+		if r.targets.Subscriptions == nil {
+			return Run{}, fmt.Errorf("%w: outbound webhooks are not enabled", ErrInvalid)
+		}
+		if req.SubscriptionID == 0 || req.Topic != "" {
+			return Run{}, fmt.Errorf("%w: the webhook sink requires subscription_id and takes no topic", ErrInvalid)
+		}
+		_, err := r.targets.Subscriptions.GetSubscription(ctx, req.SubscriptionID)
+		if errors.Is(err, database.ErrSubscriptionNotFound) {
+			return Run{}, fmt.Errorf("%w: subscription %d not found", ErrInvalid, req.SubscriptionID)
+		}
+		if err != nil {
+			return Run{}, err
+		}
+	case SinkKafka:
+		if r.targets.Kafka == nil {
+			return Run{}, fmt.Errorf("%w: the kafka sink is not configured", ErrInvalid)
+		}
+		if req.SubscriptionID != 0 {
+			return Run{}, fmt.Errorf("%w: the kafka sink takes no subscription_id", ErrInvalid)
+		}
+		if req.Topic == "" {
+			req.Topic = r.targets.Kafka.Topic()
+		}
+	default:
+		return Run{}, fmt.Errorf("%w: sink must be %s or %s", ErrInvalid, SinkWebhook, SinkKafka)
+	}
+	req.From, req.To = req.From.UTC(), req.To.UTC()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return Run{}, ErrClosed
+	}
+
+	id := max(time.Now().UnixNano(), r.lastID+1)
+	r.lastID = id
+	run := &Run{
+		ID:        strconv.FormatInt(id, 10),
+		Request:   req,
+		Status:    StatusQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	select {
+	case r.queue <- run:
+	default:
+		return Run{}, ErrBusy
+	}
+	r.add(run)
+	return *run, nil
+}
+
+// add registers run and forgets the oldest finished runs above maxRuns.
+// r.mu must be held.
+func (r *Replayer) add(run *Run) {
+	r.runs[run.ID] = run
+	r.order = append(r.order, run.ID)
+	for i := 0; len(r.runs) > maxRuns && i < len(r.order); {
+		if old := r.runs[r.order[i]]; old.finished() {
+			delete(r.runs, old.ID)
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// Get returns a snapshot of a replay.
+func (r *Replayer) Get(id string) (Run, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	run, ok := r.runs[id]
+	if !ok {
+		return Run{}, ErrNotFound
+	}
+	return *run, nil
+}
+
+// List returns snapshots of the known replays, newest first.
+func (r *Replayer) List() []Run {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Run, 0, len(r.order))
+	for i := len(r.order) - 1; i >= 0; i-- {
+		out = append(out, *r.runs[r.order[i]])
+	}
+	return out
+}
+
+// Start runs the queued replays in the background.
+func (r *Replayer) Start() {
+	go r.run()
+}
+
+// Stop cancels the running replay and fails the queued ones, waiting at
+// most until ctx is done. Events published before the cancellation stay
+// published.
+func (r *Replayer) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	r.cancel()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Replayer) run() {
+	defer close(r.done)
+	for run := range r.queue {
+		if r.ctx.Err() != nil {
+			r.finish(run, errors.New("interrupted by shutdown"))
+			continue
+		}
+		r.process(run)
+	}
+}
+
+func (r *Replayer) process(run *Run) {
+	r.mu.Lock()
+	started := time.Now().UTC()
+	run.Status = StatusRunning
+	run.StartedAt = &started
+	req := run.Request
+	r.mu.Unlock()
+
+	filter := database.EventFilter{UserID: req.UserID, Action: req.Action, From: req.From, To: req.To}
+	batch := make([]database.Event, 0, batchSize)
+	flush := func() error {
+		published, err := r.publish(req, batch)
+		eventsTotal.WithLabelValues(req.Sink).Add(float64(published))
+		r.mu.Lock()
+		run.Matched += int64(len(batch))
+		run.Published += published
+		r.mu.Unlock()
+		batch = batch[:0]
+		return err
+	}
+
+	err := r.events.Filter(r.ctx, filter, func(e database.Event) error {
+		batch = append(batch, e)
+		if len(batch) < batchSize {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	r.finish(run, err)
+}
+
+// publish sends a batch to the sink of req and returns the number of
+// messages published or deliveries scheduled.
+func (r *Replayer) publish(req Request, events []database.Event) (int64, error) {
+	if req.Sink == SinkWebhook {
+		ids := make([]int64, len(events))
+		for i, e := range events {
+			ids[i] = e.ID
+		}
+		return r.targets.Subscriptions.EnqueueDeliveries(r.ctx, req.SubscriptionID, ids)
+	}
+	if err := r.targets.Kafka.PublishTo(r.ctx, req.Topic, events); err != nil {
+		return 0, err
+	}
+	return int64(len(events)), nil
+}
+
+func (r *Replayer) finish(run *Run, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	finished := time.Now().UTC()
+	run.FinishedAt = &finished
+	run.Status = StatusSucceeded
+	if err != nil {
+		run.Status = StatusFailed
+		run.Error = err.Error()
+		r.l.Error("replay failed", "replay_id", run.ID, "sink", run.Request.Sink, "published", run.Published, "error", err)
+		return
+	}
+	r.l.Info("replay finished", "replay_id", run.ID, "sink", run.Request.Sink, "matched", run.Matched, "published", run.Published)
+}
@@ -0,0 +1,143 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeSource struct {
+	events []database.Event
+}
+
+func (f *fakeSource) Filter(ctx context.Context, filter database.EventFilter, fn func(database.Event) error) error {
+	for _, e := range f.events {
+		if e.CreatedAt.Before(filter.From) || !e.CreatedAt.Before(filter.To) {
+			continue
+		}
+		if (filter.UserID != nil && e.UserID != *filter.UserID) || (filter.Action != "" && e.Action != filter.Action) {
+			continue
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fakeSubscriptions struct {
+	enqueued []int64
+}
+
+func (f *fakeSubscriptions) GetSubscription(ctx context.Context, id int64) (database.Subscription, error) {
+	if id != 3 {
+		return database.Subscription{}, database.ErrSubscriptionNotFound
+	}
+	return database.Subscription{ID: id}, nil
+}
+func (f *fakeSubscriptions) EnqueueDeliveries(ctx context.Context, subscriptionID int64, eventIDs []int64) (int64, error) {
+	f.enqueued = append(f.enqueued, eventIDs...)
+	return int64(len(eventIDs)), nil
+}
+
+type fakePublisher struct {
+	err    error
+	topics map[string]int
+}
+
+func (f *fakePublisher) Topic() string { return "events-stored" }
+func (f *fakePublisher) PublishTo(ctx context.Context, topic string, events []database.Event) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.topics[topic] += len(events)
+	return nil
+}
+
+func TestReplay(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var events []database.Event
+	for i := range 1200 {
+		action := "click"
+		if i%2 == 1 {
+			action = "view"
+		}
+		events = append(events, database.Event{ID: int64(i + 1), UserID: int64(i % 3), Action: action, CreatedAt: start.Add(time.Duration(i) * time.Second)})
+	}
+	user := int64(1)
+
+	tests := []struct {
+		name            string
+		req             Request
+		publishErr      error
+		expectErr       error
+		expectStatus    Status
+		expectPublished int64
+		expectTopic     string
+	}{
+		{name: "kafka default topic", req: Request{From: start, To: start.Add(time.Hour), Sink: SinkKafka}, expectStatus: StatusSucceeded, expectPublished: 1200, expectTopic: "events-stored"},
+		{name: "kafka filtered to another topic", req: Request{UserID: &user, Action: "view", From: start, To: start.Add(time.Hour), Sink: SinkKafka, Topic: "replay"}, expectStatus: StatusSucceeded, expectPublished: 200, expectTopic: "replay"},
+		{name: "webhook time range", req: Request{From: start, To: start.Add(10 * time.Second), Sink: SinkWebhook, SubscriptionID: 3}, expectStatus: StatusSucceeded, expectPublished: 10},
+		{name: "kafka down", req: Request{From: start, To: start.Add(time.Hour), Sink: SinkKafka}, publishErr: errors.New("broker unavailable"), expectStatus: StatusFailed},
+		{name: "unknown subscription", req: Request{From: start, To: start.Add(time.Hour), Sink: SinkWebhook, SubscriptionID: 4}, expectErr: ErrInvalid},
+		{name: "webhook without subscription", req: Request{From: start, To: start.Add(time.Hour), Sink: SinkWebhook}, expectErr: ErrInvalid},
+		{name: "missing range", req: Request{Sink: SinkKafka}, expectErr: ErrInvalid},
+		{name: "unknown sink", req: Request{From: start, To: start.Add(time.Hour), Sink: "s3"}, expectErr: ErrInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subs := &fakeSubscriptions{}
+			kafka := &fakePublisher{err: tt.publishErr, topics: map[string]int{}}
+			r := New(slog.New(slog.NewTextHandler(io.Discard, nil)), &fakeSource{events: events}, Targets{Subscriptions: subs, Kafka: kafka})
+
+			run, err := r.Submit(context.Background(), tt.req)
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) {
+					t.Fatalf("expected %v got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil || run.Status != StatusQueued {
+				t.Fatalf("unexpected run %+v: %v", run, err)
+			}
+
+			r.Start()
+			deadline := time.Now().Add(2 * time.Second)
+			for got := mustGet(t, r, run.ID); !got.finished(); got = mustGet(t, r, run.ID) {
+				if time.Now().After(deadline) {
+					t.Fatalf("replay did not finish: %+v", got)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			if err := r.Stop(context.Background()); err != nil {
+				t.Fatalf("stop: %v", err)
+			}
+
+			got := mustGet(t, r, run.ID)
+			if got.Status != tt.expectStatus || got.Published != tt.expectPublished {
+				t.Fatalf("expected %s with %d published, got %+v", tt.expectStatus, tt.expectPublished, got)
+			}
+			if tt.expectTopic != "" && kafka.topics[tt.expectTopic] != int(tt.expectPublished) {
+				t.Fatalf("expected %d events on %s, got %v", tt.expectPublished, tt.expectTopic, kafka.topics)
+			}
+			if tt.req.Sink == SinkWebhook && len(subs.enqueued) != int(tt.expectPublished) {
+				t.Fatalf("expected %d deliveries, got %d", tt.expectPublished, len(subs.enqueued))
+			}
+		})
+	}
+}
+
+func mustGet(t *testing.T, r *Replayer, id string) Run {
+	t.Helper()
+	run, err := r.Get(id)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	return run
+}
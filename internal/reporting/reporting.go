@@ -0,0 +1,77 @@
+package reporting
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// ErrorReporter sends panics and server errors to an external error tracker,
+// so production crashes are not only visible in logs.
+type ErrorReporter interface {
+	// CapturePanic reports a recovered panic with the stack of the panicking goroutine.
+	CapturePanic(ctx context.Context, req *http.Request, recovered any, stack []byte)
+	// CaptureError reports an error that caused a 5xx response.
+	CaptureError(ctx context.Context, req *http.Request, err error)
+	// Flush waits until buffered reports are sent or the timeout expires.
+	Flush(timeout time.Duration) bool
+}
+
+// New returns a Sentry reporter when a DSN is configured and a no-op
+// reporter otherwise.
+func New(cfg config.ErrorReportingConfig) (ErrorReporter, error) {
+	if cfg.SentryDSN == "" {
+		return Nop{}, nil
+	}
+
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn:              cfg.SentryDSN,
+		Environment:      cfg.Environment,
+		AttachStacktrace: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("init sentry client: %w", err)
+	}
+	return &sentryReporter{client: client}, nil
+}
+
+// Nop discards every report.
+type Nop struct{}
+
+func (Nop) CapturePanic(context.Context, *http.Request, any, []byte) {}
+func (Nop) CaptureError(context.Context, *http.Request, error)       {}
+func (Nop) Flush(time.Duration) bool                                 { return true }
+
+type sentryReporter struct {
+	client *sentry.Client
+}
+
+// hub returns a hub scoped to a single request, so request data of
+// concurrent requests never leaks between reports.
+func (r *sentryReporter) hub(req *http.Request) *sentry.Hub {
+	scope := sentry.NewScope()
+	if req != nil {
+		scope.SetRequest(req)
+		scope.SetTag("method", req.Method)
+	}
+	return sentry.NewHub(r.client, scope)
+}
+
+func (r *sentryReporter) CapturePanic(ctx context.Context, req *http.Request, recovered any, stack []byte) {
+	hub := r.hub(req)
+	hub.Scope().SetExtra("stack", string(stack))
+	hub.RecoverWithContext(ctx, recovered)
+}
+
+func (r *sentryReporter) CaptureError(ctx context.Context, req *http.Request, err error) {
+	r.hub(req).CaptureException(err)
+}
+
+func (r *sentryReporter) Flush(timeout time.Duration) bool {
+	return r.client.Flush(timeout)
+}
@@ -0,0 +1,95 @@
+package reports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// slack posts reports to an incoming webhook.
+type slack struct {
+	url    string
+	client *http.Client
+}
+
+func newSlack(url string) *slack {
+	return &slack{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *slack) Send(ctx context.Context, r Report) error {
+	body, err := json.Marshal(map[string]string{"text": "*" + r.Subject + "*\n" + r.Text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("slack responded with status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// mailer sends reports as plain text emails.
+type mailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+	to   []string
+	// sendMail is smtp.SendMail, replaced in tests.
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newMailer(cfg config.SMTPConfig) *mailer {
+	m := &mailer{
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		from:     cfg.From,
+		to:       cfg.To,
+		sendMail: smtp.SendMail,
+	}
+	if cfg.Username != "" {
+		m.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	return m
+}
+
+// Send ignores ctx once the connection is made: net/smtp has no context
+// support.
+func (m *mailer) Send(ctx context.Context, r Report) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.sendMail(m.addr, m.auth, m.from, m.to, m.message(r))
+}
+
+func (m *mailer) message(r Report) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", r.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(r.Text, "\n", "\r\n"))
+	return b.Bytes()
+}
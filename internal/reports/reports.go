@@ -0,0 +1,179 @@
+// Package reports sends summaries of the last complete day or week (total
+// events, top actions, active users) to a Slack incoming webhook and to
+// email recipients on a schedule. Summaries are read from the aggregate
+// tables filled by the aggregator.
+package reports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+var sentTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "reports_sent_total",
+		Help: "Reports by channel (slack, email) and result (sent, failed)",
+	},
+	[]string{"channel", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(sentTotal)
+}
+
+// sendTimeout bounds the summary query and the delivery of a report.
+const sendTimeout = time.Minute
+
+// Source totals the aggregates of a period.
+type Source interface {
+	Summary(ctx context.Context, from, to time.Time, top int) (database.Summary, error)
+}
+
+// Report is a rendered summary.
+type Report struct {
+	Subject string
+	Text    string
+}
+
+// sender delivers reports to one channel.
+type sender interface {
+	Send(ctx context.Context, r Report) error
+}
+
+// Scheduler sends the report of the last complete period at every tick of
+// the schedule.
+type Scheduler struct {
+	l        *slog.Logger
+	source   Source
+	period   string
+	top      int
+	senders  map[string]sender
+	now      func() time.Time
+	cron     *cron.Cron
+	schedule cron.Schedule
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// New creates a scheduler sending to the channels configured in cfg.
+func New(logger *slog.Logger, cfg config.ReportsConfig, source Source) (*Scheduler, error) {
+	schedule, err := cron.ParseStandard(cfg.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REPORT_SCHEDULE: %w", err)
+	}
+
+	senders := map[string]sender{}
+	if cfg.SlackWebhookURL != "" {
+		senders["slack"] = newSlack(cfg.SlackWebhookURL)
+	}
+	if len(cfg.SMTP.To) > 0 {
+		senders["email"] = newMailer(cfg.SMTP)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Scheduler{
+		l:        logger,
+		source:   source,
+		period:   cfg.Period,
+		top:      cfg.TopActions,
+		senders:  senders,
+		now:      time.Now,
+		cron:     cron.New(cron.WithLocation(time.UTC)),
+		schedule: schedule,
+		ctx:      ctx,
+		cancel:   cancel,
+	}, nil
+}
+
+// Start schedules the reports.
+func (s *Scheduler) Start() {
+	s.cron.Schedule(s.schedule, cron.FuncJob(func() {
+		ctx, cancel := context.WithTimeout(s.ctx, sendTimeout)
+		defer cancel()
+		if err := s.Send(ctx); err != nil {
+			s.l.Error("report not sent", "error", err)
+		}
+	}))
+	s.cron.Start()
+	s.l.Info("reports scheduled", "period", s.period, "channels", len(s.senders))
+}
+
+// Stop cancels the report being sent and waits for it, or for ctx to be
+// done.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	stopped := s.cron.Stop()
+	s.cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send sends the report of the last complete period to every channel. A
+// failed channel does not prevent the others from receiving the report.
+func (s *Scheduler) Send(ctx context.Context) error {
+	from, to := lastPeriod(s.period, s.now())
+	sum, err := s.source.Summary(ctx, from, to, s.top)
+	if err != nil {
+		return fmt.Errorf("read summary: %w", err)
+	}
+	report := render(s.period, sum)
+
+	var errs []error
+	for channel, snd := range s.senders {
+		if err := snd.Send(ctx, report); err != nil {
+			sentTotal.WithLabelValues(channel, "failed").Inc()
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+			continue
+		}
+		sentTotal.WithLabelValues(channel, "sent").Inc()
+		s.l.Info("report sent", "channel", channel, "from", from, "to", to)
+	}
+	return errors.Join(errs...)
+}
+
+// lastPeriod returns the last day, or week starting on Monday, that ended
+// before now, in UTC.
+func lastPeriod(period string, now time.Time) (from, to time.Time) {
+	now = now.UTC()
+	to = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if period == "weekly" {
+		// Days since Monday
+		to = to.AddDate(0, 0, -(int(to.Weekday())+6)%7)
+		return to.AddDate(0, 0, -7), to
+	}
+	return to.AddDate(0, 0, -1), to
+}
+
+func render(period string, sum database.Summary) Report {
+	const day = "2006-01-02"
+	subject := "Daily events report for " + sum.From.Format(day)
+	if period == "weekly" {
+		subject = fmt.Sprintf("Weekly events report for %s to %s", sum.From.Format(day), sum.To.AddDate(0, 0, -1).Format(day))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Total events: %d\n", sum.TotalEvents)
+	fmt.Fprintf(&b, "Active users: %d\n", sum.ActiveUsers)
+	if len(sum.TopActions) == 0 {
+		b.WriteString("Top actions: none\n")
+	} else {
+		b.WriteString("Top actions:\n")
+		for i, a := range sum.TopActions {
+			fmt.Fprintf(&b, "%d. %s: %d\n", i+1, a.Action, a.Count)
+		}
+	}
+	return Report{Subject: subject, Text: b.String()}
+}
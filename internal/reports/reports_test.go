@@ -0,0 +1,120 @@
+package reports
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeSource struct {
+	from, to time.Time
+}
+
+func (f *fakeSource) Summary(ctx context.Context, from, to time.Time, top int) (database.Summary, error) {
+	f.from, f.to = from, to
+	return database.Summary{
+		From:        from,
+		To:          to,
+		TotalEvents: 1200,
+		ActiveUsers: 42,
+		TopActions:  []database.ActionCount{{Action: "click", Count: 1000}, {Action: "view", Count: 200}},
+	}, nil
+}
+
+func TestLastPeriod(t *testing.T) {
+	tests := []struct {
+		name     string
+		period   string
+		now      time.Time
+		from, to string
+	}{
+		{name: "daily", period: "daily", now: time.Date(2025, 1, 8, 7, 0, 0, 0, time.UTC), from: "2025-01-07", to: "2025-01-08"},
+		{name: "daily converts to utc", period: "daily", now: time.Date(2025, 1, 8, 1, 0, 0, 0, time.FixedZone("CET", 3600)), from: "2025-01-07", to: "2025-01-08"},
+		{name: "weekly on monday", period: "weekly", now: time.Date(2025, 1, 6, 7, 0, 0, 0, time.UTC), from: "2024-12-30", to: "2025-01-06"},
+		{name: "weekly on sunday", period: "weekly", now: time.Date(2025, 1, 12, 7, 0, 0, 0, time.UTC), from: "2024-12-30", to: "2025-01-06"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := lastPeriod(tt.period, tt.now)
+			if from.Format(time.DateOnly) != tt.from || to.Format(time.DateOnly) != tt.to {
+				t.Fatalf("expected %s to %s got %s to %s", tt.from, tt.to, from, to)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	var slackText string
+	slackStatus := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		slackText = body["text"]
+		w.WriteHeader(slackStatus)
+	}))
+	defer srv.Close()
+
+	source := &fakeSource{}
+	s, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.ReportsConfig{
+		Period:          "weekly",
+		Schedule:        "0 7 * * 1",
+		TopActions:      5,
+		SlackWebhookURL: srv.URL,
+		SMTP:            config.SMTPConfig{Host: "mail.example.com", Port: 587, From: "reports@example.com", To: []string{"a@example.com", "b@example.com"}},
+	}, source)
+	if err != nil {
+		t.Fatalf("new: %v", err)
+	}
+	s.now = func() time.Time { return time.Date(2025, 1, 8, 7, 0, 0, 0, time.UTC) }
+
+	var mail string
+	m := s.senders["email"].(*mailer)
+	m.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		if addr != "mail.example.com:587" || len(to) != 2 {
+			t.Fatalf("unexpected recipients %s %v", addr, to)
+		}
+		mail = string(msg)
+		return nil
+	}
+
+	if err := s.Send(context.Background()); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if !source.from.Equal(time.Date(2024, 12, 30, 0, 0, 0, 0, time.UTC)) || !source.to.Equal(time.Date(2025, 1, 6, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected period %s to %s", source.from, source.to)
+	}
+	if !strings.Contains(slackText, "*Weekly events report for 2024-12-30 to 2025-01-05*") || !strings.Contains(slackText, "1. click: 1000\n") {
+		t.Fatalf("unexpected slack text:\n%s", slackText)
+	}
+	if !strings.Contains(mail, "To: a@example.com, b@example.com\r\n") || !strings.Contains(mail, "Active users: 42\r\n") {
+		t.Fatalf("unexpected mail:\n%s", mail)
+	}
+
+	// A failing channel does not prevent the other from receiving the report
+	slackStatus = http.StatusForbidden
+	mail = ""
+	if err := s.Send(context.Background()); err == nil || !strings.Contains(err.Error(), "slack") {
+		t.Fatalf("expected a slack error, got %v", err)
+	}
+	if mail == "" {
+		t.Fatalf("expected the email to be sent")
+	}
+
+	m.sendMail = func(string, smtp.Auth, string, []string, []byte) error { return errors.New("connection refused") }
+	slackStatus = http.StatusOK
+	if err := s.Send(context.Background()); err == nil || !strings.Contains(err.Error(), "email") {
+		t.Fatalf("expected an email error, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package residency
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// EventStore runs the maintenance operations of the admin API on the
+// database of the project of the filter, or on every database when the
+// filter has no project.
+type EventStore struct {
+	router *Router
+	stores map[string]database.EventMaintainer
+}
+
+// NewEventStore routes like router, with the store of each of its regions,
+// by name, and primary for the primary database.
+func NewEventStore(router *Router, primary database.EventMaintainer, regions map[string]database.EventMaintainer) *EventStore {
+	stores := map[string]database.EventMaintainer{"": primary}
+	for name, s := range regions {
+		stores[name] = s
+	}
+	return &EventStore{router: router, stores: stores}
+}
+
+func (s *EventStore) Count(ctx context.Context, f database.EventFilter) (int64, error) {
+	if f.ProjectID != nil {
+		return s.stores[s.router.Region(*f.ProjectID)].Count(ctx, f)
+	}
+	var total int64
+	for _, store := range s.stores {
+		n, err := store.Count(ctx, f)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Delete removes the matching events of every database, even when one
+// fails, and returns how many were removed along with the failures.
+func (s *EventStore) Delete(ctx context.Context, f database.EventFilter) (int64, error) {
+	if f.ProjectID != nil {
+		return s.stores[s.router.Region(*f.ProjectID)].Delete(ctx, f)
+	}
+	var total int64
+	var errs []error
+	for _, store := range s.stores {
+		n, err := store.Delete(ctx, f)
+		total += n
+		errs = append(errs, err)
+	}
+	return total, errors.Join(errs...)
+}
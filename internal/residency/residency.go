@@ -0,0 +1,159 @@
+// Package residency keeps the events of some projects in databases of
+// their own, e.g. in the region their data must stay in.
+//
+// Every query is made for a single project, so it goes to the database of
+// the project alone; the events of the projects without a region stay in
+// the primary database, along with the projects, API keys and every other
+// table. Moving a project to another region moves none of its events:
+// they must be copied offline, e.g. with a snapshot.
+package residency
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+)
+
+// Router is a Service storing the events of each project in the database
+// of its region.
+type Router struct {
+	primary database.Service
+	regions map[string]database.Service
+	// projects maps project ids to their region
+	projects map[int64]string
+}
+
+var _ database.Service = (*Router)(nil)
+
+// New routes the events of projects to the regions, by name; the other
+// projects are served by primary. Every region of projects must be in
+// regions.
+func New(primary database.Service, regions map[string]database.Service, projects map[int64]string) (*Router, error) {
+	for project, region := range projects {
+		if _, ok := regions[region]; !ok {
+			return nil, fmt.Errorf("project %d is in the unknown region %q", project, region)
+		}
+	}
+	return &Router{primary: primary, regions: regions, projects: projects}, nil
+}
+
+// Region returns the region of the project, "" for the primary database.
+func (r *Router) Region(projectID int64) string {
+	if projectID == 0 {
+		projectID = database.DefaultProjectID
+	}
+	return r.projects[projectID]
+}
+
+func (r *Router) of(projectID int64) database.Service {
+	if region := r.Region(projectID); region != "" {
+		return r.regions[region]
+	}
+	return r.primary
+}
+
+// Health reports the health of the primary database, and of every region
+// under region_<name>_<key>. It is up when every database is.
+func (r *Router) Health() map[string]string {
+	stats := maps.Clone(r.primary.Health())
+	stats["regions"] = strconv.Itoa(len(r.regions))
+	for _, name := range slices.Sorted(maps.Keys(r.regions)) {
+		for k, v := range r.regions[name].Health() {
+			stats["region_"+name+"_"+k] = v
+		}
+		if status := stats["region_"+name+"_status"]; status != "up" && stats["status"] == "up" {
+			stats["status"] = status
+		}
+	}
+	return stats
+}
+
+// Close closes the primary database and every region.
+func (r *Router) Close() error {
+	errs := []error{r.primary.Close()}
+	for _, s := range r.regions {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Router) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return r.of(projectID).InsertEvent(ctx, projectID, userID, action, metadata)
+}
+
+func (r *Router) InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error) {
+	return r.of(e.ProjectID).InsertEventOnce(ctx, e, window)
+}
+
+// InsertEvents stores the events of each database in one batch, the
+// databases in parallel. A batch spanning regions is not atomic: when a
+// database fails, the events of the others may be stored.
+func (r *Router) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	batches := map[string][]database.NewEvent{}
+	for _, e := range events {
+		region := r.Region(e.ProjectID)
+		batches[region] = append(batches[region], e)
+	}
+	return r.each(func(region string, s database.Service) error {
+		if len(batches[region]) == 0 {
+			return nil
+		}
+		return s.InsertEvents(ctx, batches[region])
+	})
+}
+
+func (r *Router) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	return r.of(projectID).GetEvents(ctx, projectID, userID, start, end, limit)
+}
+
+func (r *Router) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	return r.of(projectID).StreamEvents(ctx, projectID, userID, start, end, limit, fn)
+}
+
+func (r *Router) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	return r.of(projectID).FilterEvents(ctx, projectID, expr, userID, start, end, limit, fn)
+}
+
+// AggregateEvents aggregates the events of every database into its own
+// aggregates tables.
+func (r *Router) AggregateEvents(seconds int) error {
+	return r.each(func(_ string, s database.Service) error {
+		return s.AggregateEvents(seconds)
+	})
+}
+
+// each calls fn with the primary database, named "", and every region in
+// parallel and returns their errors.
+func (r *Router) each(fn func(region string, s database.Service) error) error {
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for region, s := range r.all() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := fn(region, s); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// all returns the primary database, named "", and the regions.
+func (r *Router) all() map[string]database.Service {
+	all := map[string]database.Service{"": r.primary}
+	maps.Copy(all, r.regions)
+	return all
+}
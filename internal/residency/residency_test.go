@@ -0,0 +1,168 @@
+package residency
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// memDB stores the events of a database in memory, failing every call with
+// err when set.
+type memDB struct {
+	database.Service
+	mu     sync.Mutex
+	events []database.NewEvent
+	status string
+	err    error
+}
+
+func (m *memDB) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	err := m.InsertEvents(ctx, []database.NewEvent{{ProjectID: projectID, UserID: userID, Action: action}})
+	return int64(len(m.events)), err
+}
+
+func (m *memDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.events = append(m.events, events...)
+	return nil
+}
+
+func (m *memDB) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var events []database.Event
+	for i, e := range m.events {
+		if e.ProjectID == projectID {
+			events = append(events, database.Event{ID: int64(i + 1), UserID: e.UserID, Action: e.Action})
+		}
+	}
+	return events, m.err
+}
+
+func (m *memDB) Health() map[string]string {
+	return map[string]string{"status": m.status}
+}
+
+func (m *memDB) Close() error { return nil }
+
+// memStore counts the calls of the maintenance operations.
+type memStore struct {
+	counted, deleted int
+}
+
+func (s *memStore) Count(ctx context.Context, f database.EventFilter) (int64, error) {
+	s.counted++
+	return 2, nil
+}
+
+func (s *memStore) Delete(ctx context.Context, f database.EventFilter) (int64, error) {
+	s.deleted++
+	return 1, nil
+}
+
+func newRouter(t *testing.T) (*Router, *memDB, map[string]*memDB) {
+	t.Helper()
+	primary := &memDB{status: "up"}
+	dbs := map[string]*memDB{"eu": {status: "up"}, "us": {status: "up"}}
+	r, err := New(primary, map[string]database.Service{"eu": dbs["eu"], "us": dbs["us"]}, map[int64]string{3: "eu", 4: "eu", 5: "us"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r, primary, dbs
+}
+
+func TestRouter(t *testing.T) {
+	r, primary, dbs := newRouter(t)
+	ctx := context.Background()
+
+	var events []database.NewEvent
+	for project := range int64(6) {
+		events = append(events, database.NewEvent{ProjectID: project, UserID: 1, Action: "view"})
+	}
+	if err := r.InsertEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.InsertEvent(ctx, 5, 2, "click", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Projects 0 (the default project), 1 and 2 have no region
+	expect := map[*memDB][]int64{primary: {0, 1, 2}, dbs["eu"]: {3, 4}, dbs["us"]: {5, 5}}
+	for db, projects := range expect {
+		if len(db.events) != len(projects) {
+			t.Fatalf("expected the events of projects %v, got %+v", projects, db.events)
+		}
+		for i, e := range db.events {
+			if e.ProjectID != projects[i] {
+				t.Fatalf("expected the events of projects %v, got %+v", projects, db.events)
+			}
+		}
+	}
+
+	got, err := r.GetEvents(ctx, 5, nil, nil, nil, 0)
+	if err != nil || len(got) != 2 {
+		t.Fatalf("expected the 2 events of project 5 from its region, got %v, %v", got, err)
+	}
+	got, err = r.GetEvents(ctx, 3, nil, nil, nil, 0)
+	if err != nil || len(got) != 1 {
+		t.Fatalf("expected the event of project 3 from its region, got %v, %v", got, err)
+	}
+}
+
+func TestUnknownRegion(t *testing.T) {
+	_, err := New(&memDB{}, map[string]database.Service{"eu": &memDB{}}, map[int64]string{3: "us"})
+	if err == nil {
+		t.Fatal("expected an error for a project in an unknown region")
+	}
+}
+
+func TestFailingRegion(t *testing.T) {
+	r, primary, dbs := newRouter(t)
+	down := errors.New("region down")
+	dbs["us"].err = down
+	dbs["us"].status = "down"
+
+	events := []database.NewEvent{{ProjectID: 1, UserID: 1, Action: "view"}, {ProjectID: 5, UserID: 1, Action: "view"}}
+	if err := r.InsertEvents(context.Background(), events); !errors.Is(err, down) {
+		t.Fatalf("expected the batch to fail with the region, got %v", err)
+	}
+	if len(primary.events) != 1 {
+		t.Fatal("expected the events of the healthy database stored")
+	}
+	if _, err := r.GetEvents(context.Background(), 3, nil, nil, nil, 0); err != nil {
+		t.Fatalf("expected the other regions to be read, got %v", err)
+	}
+
+	health := r.Health()
+	if health["status"] != "down" || health["region_us_status"] != "down" || health["region_eu_status"] != "up" || health["regions"] != "2" {
+		t.Fatalf("unexpected health %v", health)
+	}
+}
+
+func TestEventStore(t *testing.T) {
+	r, _, _ := newRouter(t)
+	primary, eu, us := &memStore{}, &memStore{}, &memStore{}
+	s := NewEventStore(r, primary, map[string]database.EventMaintainer{"eu": eu, "us": us})
+	ctx := context.Background()
+
+	project := int64(4)
+	n, err := s.Count(ctx, database.EventFilter{ProjectID: &project})
+	if err != nil || n != 2 || eu.counted != 1 || primary.counted != 0 || us.counted != 0 {
+		t.Fatalf("expected project 4 counted in its region only, got %d, %v", n, err)
+	}
+
+	// A user is erased from every database
+	user := int64(1)
+	n, err = s.Delete(ctx, database.EventFilter{UserID: &user})
+	if err != nil || n != 3 || primary.deleted != 1 || eu.deleted != 1 || us.deleted != 1 {
+		t.Fatalf("expected the events deleted from every database, got %d, %v", n, err)
+	}
+}
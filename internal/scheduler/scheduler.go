@@ -0,0 +1,121 @@
+// Package scheduler delivers the events posted with a future deliver_at:
+// they wait in pending_events and are moved to the events table, created at
+// their delivery time, on the first tick after it, so that the queries, the
+// aggregates and the sinks see them only from then on.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robfig/cron/v3"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+var deliveredTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "scheduled_events_delivered_total",
+	Help: "Scheduled events moved from pending_events to events",
+})
+
+func init() {
+	prometheus.MustRegister(deliveredTotal)
+}
+
+// Store moves the due events to the events table, a batch at a time.
+type Store interface {
+	DeliverEvents(ctx context.Context, now time.Time, limit int) (int64, error)
+}
+
+// Scheduler delivers the due events at every interval.
+type Scheduler struct {
+	l         *slog.Logger
+	stores    []Store
+	batchSize int
+	interval  int
+	now       func() time.Time
+	cron      *cron.Cron
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// New creates a scheduler of the pending events of every store, one per
+// shard when the events are sharded.
+func New(logger *slog.Logger, cfg config.ScheduledConfig, stores ...Store) (*Scheduler, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Scheduler{
+		l:         logger,
+		stores:    stores,
+		batchSize: cfg.BatchSize,
+		interval:  cfg.IntervalSeconds,
+		now:       time.Now,
+		cron:      cron.New(cron.WithSeconds()),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+	// The cron scheduler skips a tick while the previous run still delivers
+	spec := "@every " + strconv.Itoa(cfg.IntervalSeconds) + "s"
+	if _, err := s.cron.AddJob(spec, cron.NewChain(cron.SkipIfStillRunning(cron.DiscardLogger)).Then(cron.FuncJob(s.run))); err != nil {
+		cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Scheduler) run() {
+	n, err := s.Deliver(s.ctx)
+	if err != nil && s.ctx.Err() == nil {
+		s.l.Error("scheduled events delivery failed", "delivered", n, "error", err)
+		return
+	}
+	if n > 0 {
+		s.l.Info("scheduled events delivered", "delivered", n)
+	}
+}
+
+// Start schedules the delivery.
+func (s *Scheduler) Start() {
+	s.cron.Start()
+	s.l.Info("scheduled events delivery started", "interval_seconds", s.interval)
+}
+
+// Stop cancels the running delivery, whose current batch is rolled back,
+// and waits for it, or for ctx to be done.
+func (s *Scheduler) Stop(ctx context.Context) error {
+	stopped := s.cron.Stop()
+	s.cancel()
+	select {
+	case <-stopped.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Deliver moves every event due by now from each store, in batches, and
+// returns how many were moved. A failing store does not hold back the
+// others.
+func (s *Scheduler) Deliver(ctx context.Context) (int64, error) {
+	now := s.now()
+	var total int64
+	var errs []error
+	for _, store := range s.stores {
+		for {
+			n, err := store.DeliverEvents(ctx, now, s.batchSize)
+			total += n
+			deliveredTotal.Add(float64(n))
+			if err != nil {
+				errs = append(errs, err)
+				break
+			}
+			if n < int64(s.batchSize) {
+				break
+			}
+		}
+	}
+	return total, errors.Join(errs...)
+}
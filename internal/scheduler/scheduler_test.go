@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// fakeStore holds events to deliver at the given times and fails once
+// failAt batches were moved, when set.
+type fakeStore struct {
+	pending []time.Time
+	batches int
+	failAt  int
+}
+
+func (f *fakeStore) DeliverEvents(ctx context.Context, now time.Time, limit int) (int64, error) {
+	if f.failAt > 0 && f.batches == f.failAt {
+		return 0, errors.New("connection refused")
+	}
+	f.batches++
+	var kept []time.Time
+	var moved int64
+	for _, t := range f.pending {
+		if !t.After(now) && moved < int64(limit) {
+			moved++
+			continue
+		}
+		kept = append(kept, t)
+	}
+	f.pending = kept
+	return moved, nil
+}
+
+func TestDeliver(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	due := now.Add(-time.Second)
+	later := now.Add(time.Hour)
+
+	tests := []struct {
+		name          string
+		stores        []*fakeStore
+		expectMoved   int64
+		expectBatches []int
+		expectKept    []int
+		expectErr     bool
+	}{
+		{name: "nothing due", stores: []*fakeStore{{pending: []time.Time{later}}}, expectBatches: []int{1}, expectKept: []int{1}},
+		{name: "due at now", stores: []*fakeStore{{pending: []time.Time{now, later}}}, expectMoved: 1, expectBatches: []int{1}, expectKept: []int{1}},
+		{name: "every batch until a partial one", stores: []*fakeStore{{pending: []time.Time{due, due, due, due, due, later}}}, expectMoved: 5, expectBatches: []int{3}, expectKept: []int{1}},
+		{name: "every store", stores: []*fakeStore{{pending: []time.Time{due}}, {pending: []time.Time{due, due, later}}}, expectMoved: 3, expectBatches: []int{1, 2}, expectKept: []int{0, 1}},
+		{
+			name:          "failed store does not stop the others",
+			stores:        []*fakeStore{{pending: []time.Time{due, due, due}, failAt: 1}, {pending: []time.Time{due}}},
+			expectMoved:   3,
+			expectBatches: []int{1, 1},
+			expectKept:    []int{1, 0},
+			expectErr:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stores := make([]Store, len(tt.stores))
+			for i, s := range tt.stores {
+				stores[i] = s
+			}
+			s, err := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.ScheduledConfig{IntervalSeconds: 5, BatchSize: 2}, stores...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.now = func() time.Time { return now }
+
+			moved, err := s.Deliver(context.Background())
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("expected error %v, got %v", tt.expectErr, err)
+			}
+			if moved != tt.expectMoved {
+				t.Fatalf("expected %d moved, got %d", tt.expectMoved, moved)
+			}
+			for i, store := range tt.stores {
+				if store.batches != tt.expectBatches[i] || len(store.pending) != tt.expectKept[i] {
+					t.Fatalf("store %d: expected %d batches and %d kept, got %d and %d", i, tt.expectBatches[i], tt.expectKept[i], store.batches, len(store.pending))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Package schema upgrades the events read back to the latest registered
+// version of the event schema (UPGRADE_SCHEMA_ON_READ), so that readers see
+// one shape whatever version the producers sent.
+//
+// Each registered version upgrades the events of the version before it:
+// their actions are renamed and, without a metadata page, they are given
+// its default page. An event passes through every version above its own in
+// order. Events are upgraded on the way out only: stored events keep their
+// version, which is the one filters compare.
+package schema
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+)
+
+// Registry holds the registered versions, in increasing order.
+type Registry struct {
+	versions []config.SchemaVersionConfig
+}
+
+// NewRegistry returns the registry of versions, in any order.
+func NewRegistry(versions []config.SchemaVersionConfig) *Registry {
+	sorted := slices.Clone(versions)
+	slices.SortFunc(sorted, func(a, b config.SchemaVersionConfig) int { return a.Version - b.Version })
+	return &Registry{versions: sorted}
+}
+
+// Upgrade returns e upgraded to the latest version. Events without a
+// version are of version 1.
+func (r *Registry) Upgrade(e database.Event) database.Event {
+	version := max(e.SchemaVersion, 1)
+	for _, v := range r.versions {
+		if v.Version <= version {
+			continue
+		}
+		if renamed, ok := v.RenameActions[e.Action]; ok {
+			e.Action = renamed
+		}
+		if e.MetadataPage == nil && v.DefaultPage != "" {
+			page := v.DefaultPage
+			e.MetadataPage = &page
+		}
+		version = v.Version
+	}
+	e.SchemaVersion = version
+	return e
+}
+
+// Upgrader upgrades the events read through the wrapped service.
+type Upgrader struct {
+	database.Service
+	registry atomic.Pointer[Registry]
+}
+
+// NewUpgrader wraps svc so that the events it returns are upgraded with r.
+func NewUpgrader(svc database.Service, r *Registry) *Upgrader {
+	u := &Upgrader{Service: svc}
+	u.registry.Store(r)
+	return u
+}
+
+// Set replaces the registry, e.g. when the configuration is reloaded.
+func (u *Upgrader) Set(r *Registry) {
+	u.registry.Store(r)
+}
+
+func (u *Upgrader) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	events, err := u.Service.GetEvents(ctx, projectID, userID, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	r := u.registry.Load()
+	for i := range events {
+		events[i] = r.Upgrade(events[i])
+	}
+	return events, nil
+}
+
+func (u *Upgrader) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	r := u.registry.Load()
+	return u.Service.StreamEvents(ctx, projectID, userID, start, end, limit, func(e database.Event) error {
+		return fn(r.Upgrade(e))
+	})
+}
+
+func (u *Upgrader) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	r := u.registry.Load()
+	return u.Service.FilterEvents(ctx, projectID, expr, userID, start, end, limit, func(e database.Event) error {
+		return fn(r.Upgrade(e))
+	})
+}
@@ -0,0 +1,94 @@
+package schema
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeDB answers every query with events.
+type fakeDB struct {
+	database.Service
+	events []database.Event
+}
+
+func (f *fakeDB) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	return append([]database.Event(nil), f.events...), nil
+}
+
+func (f *fakeDB) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	for _, e := range f.events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestUpgrade(t *testing.T) {
+	r := NewRegistry([]config.SchemaVersionConfig{
+		{Version: 3, RenameActions: map[string]string{"tap": "press"}},
+		{Version: 2, RenameActions: map[string]string{"click": "tap"}, DefaultPage: "/"},
+	})
+	home := "/home"
+
+	tests := []struct {
+		name          string
+		event         database.Event
+		expectAction  string
+		expectPage    string
+		expectVersion int
+	}{
+		{name: "without a version", event: database.Event{Action: "click"}, expectAction: "press", expectPage: "/", expectVersion: 3},
+		{name: "through every version", event: database.Event{Action: "click", MetadataPage: &home, SchemaVersion: 1}, expectAction: "press", expectPage: "/home", expectVersion: 3},
+		{name: "from the middle", event: database.Event{Action: "click", SchemaVersion: 2}, expectAction: "click", expectVersion: 3},
+		{name: "already latest", event: database.Event{Action: "tap", SchemaVersion: 3}, expectAction: "tap", expectVersion: 3},
+		{name: "unregistered newer", event: database.Event{Action: "tap", SchemaVersion: 5}, expectAction: "tap", expectVersion: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := r.Upgrade(tt.event)
+			page := ""
+			if got.MetadataPage != nil {
+				page = *got.MetadataPage
+			}
+			if got.Action != tt.expectAction || page != tt.expectPage || got.SchemaVersion != tt.expectVersion {
+				t.Fatalf("expected %s %q v%d, got %s %q v%d", tt.expectAction, tt.expectPage, tt.expectVersion, got.Action, page, got.SchemaVersion)
+			}
+		})
+	}
+}
+
+func TestUpgrader(t *testing.T) {
+	db := &fakeDB{events: []database.Event{{ID: 1, Action: "click"}, {ID: 2, Action: "view", SchemaVersion: 2}}}
+	u := NewUpgrader(db, NewRegistry([]config.SchemaVersionConfig{{Version: 2, RenameActions: map[string]string{"click": "tap"}}}))
+
+	events, err := u.GetEvents(context.Background(), 1, nil, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].Action != "tap" || events[0].SchemaVersion != 2 || events[1].Action != "view" {
+		t.Fatalf("unexpected events %+v", events)
+	}
+	if db.events[0].Action != "click" {
+		t.Fatal("expected the stored events to be left alone")
+	}
+
+	// A reload applies to the next reads
+	u.Set(NewRegistry(nil))
+	var streamed []database.Event
+	err = u.StreamEvents(context.Background(), 1, nil, nil, nil, 0, func(e database.Event) error {
+		streamed = append(streamed, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamed[0].Action != "click" || streamed[0].SchemaVersion != 1 {
+		t.Fatalf("unexpected events %+v", streamed)
+	}
+}
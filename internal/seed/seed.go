@@ -0,0 +1,153 @@
+// Package seed generates realistic event data for local development and
+// demo environments. The output only depends on the configuration and the
+// seed, so two runs with the same flags produce the same events.
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Config describes the data to generate.
+type Config struct {
+	Events int
+	Users  int
+	// Actions maps each action to its relative weight.
+	Actions map[string]int
+	// Events are spread evenly over [Until - Span, Until).
+	Until     time.Time
+	Span      time.Duration
+	BatchSize int
+	Seed      uint64
+}
+
+// DefaultActions is the action mix of a typical product.
+var DefaultActions = map[string]int{"view": 60, "click": 25, "signup": 5, "purchase": 3, "leave": 7}
+
+// ParseActions reads a mix like "view=60,click=25,purchase=3".
+func ParseActions(s string) (map[string]int, error) {
+	actions := make(map[string]int)
+	for _, part := range strings.Split(s, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		w, err := strconv.Atoi(weight)
+		if !ok || name == "" || err != nil || w <= 0 {
+			return nil, fmt.Errorf("invalid action weight %q, want action=positive integer", part)
+		}
+		actions[name] += w
+	}
+	return actions, nil
+}
+
+// Validate checks that the data can be generated.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Events < 1 || c.Users < 1 || c.BatchSize < 1 {
+		errs = append(errs, fmt.Errorf("events, users and batch size must be positive"))
+	}
+	if len(c.Actions) == 0 {
+		errs = append(errs, fmt.Errorf("at least one action is required"))
+	}
+	if c.Span <= 0 {
+		errs = append(errs, fmt.Errorf("span must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// pages are the metadata pages of the generated events.
+var pages = []string{"/", "/pricing", "/docs", "/docs/getting-started", "/blog", "/signup", "/checkout", "/account"}
+
+// Summary describes the generated events.
+type Summary struct {
+	Events      int
+	ActiveUsers int
+	ByAction    map[string]int
+	From        time.Time
+	To          time.Time
+}
+
+func (s Summary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d events of %d users from %s to %s\n", s.Events, s.ActiveUsers, s.From.Format(time.RFC3339), s.To.Format(time.RFC3339))
+	actions := slices.Collect(maps.Keys(s.ByAction))
+	// Most frequent first
+	slices.SortFunc(actions, func(a, b string) int {
+		if s.ByAction[a] != s.ByAction[b] {
+			return s.ByAction[b] - s.ByAction[a]
+		}
+		return strings.Compare(a, b)
+	})
+	for _, a := range actions {
+		fmt.Fprintf(&b, "  %-12s %8d (%.1f%%)\n", a, s.ByAction[a], 100*float64(s.ByAction[a])/float64(s.Events))
+	}
+	return b.String()
+}
+
+// Generate produces the events in creation order and passes them to insert
+// in batches, stopping at the first error; insert must not keep the slice.
+// User activity follows a Zipf distribution, so a few users produce most of
+// the events as in real traffic; user ids range from 1 to Users. The
+// summary counts the events generated, including a batch that failed.
+func Generate(cfg Config, insert func([]database.NewEvent) error) (Summary, error) {
+	if err := cfg.Validate(); err != nil {
+		return Summary{}, err
+	}
+	r := rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x5eed))
+	zipf := rand.NewZipf(r, 1.2, 1, uint64(cfg.Users-1))
+
+	// Actions are drawn by cumulative weight, in a fixed order so that the
+	// output does not depend on map iteration
+	names := slices.Sorted(maps.Keys(cfg.Actions))
+	cumulative := make([]int, len(names))
+	total := 0
+	for i, a := range names {
+		total += cfg.Actions[a]
+		cumulative[i] = total
+	}
+
+	start := cfg.Until.Add(-cfg.Span).UTC()
+	step := float64(cfg.Span) / float64(cfg.Events)
+	sum := Summary{ByAction: make(map[string]int), From: start, To: cfg.Until.UTC()}
+	users := make(map[int64]bool)
+
+	batch := make([]database.NewEvent, 0, cfg.BatchSize)
+	for i := range cfg.Events {
+		// Evenly spread with jitter, so events stay in creation order
+		offset := time.Duration((float64(i) + r.Float64()) * step)
+		userID := int64(zipf.Uint64()) + 1
+		pick := r.IntN(total)
+		action := names[0]
+		for j, c := range cumulative {
+			if pick < c {
+				action = names[j]
+				break
+			}
+		}
+
+		batch = append(batch, database.NewEvent{
+			UserID:    userID,
+			Action:    action,
+			Metadata:  map[string]string{"page": pages[r.IntN(len(pages))]},
+			CreatedAt: start.Add(offset),
+		})
+		users[userID] = true
+		sum.ByAction[action]++
+		sum.Events++
+		sum.ActiveUsers = len(users)
+
+		if len(batch) == cfg.BatchSize || i == cfg.Events-1 {
+			if err := insert(batch); err != nil {
+				return sum, err
+			}
+			batch = batch[:0]
+		}
+	}
+	return sum, nil
+}
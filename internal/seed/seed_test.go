@@ -0,0 +1,93 @@
+package seed
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+func TestParseActions(t *testing.T) {
+	tests := []struct {
+		in        string
+		expect    map[string]int
+		expectErr bool
+	}{
+		{in: "view=60,click=25, purchase=3", expect: map[string]int{"view": 60, "click": 25, "purchase": 3}},
+		{in: "view=1,view=2", expect: map[string]int{"view": 3}},
+		{in: "view", expectErr: true},
+		{in: "view=0", expectErr: true},
+		{in: "=3", expectErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseActions(tt.in)
+		if (err != nil) != tt.expectErr || (!tt.expectErr && !reflect.DeepEqual(got, tt.expect)) {
+			t.Fatalf("%q: expected %v (error %v), got %v, %v", tt.in, tt.expect, tt.expectErr, got, err)
+		}
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	until := time.Date(2025, 1, 8, 0, 0, 0, 0, time.UTC)
+	cfg := Config{
+		Events:    1000,
+		Users:     50,
+		Actions:   map[string]int{"view": 90, "purchase": 10},
+		Until:     until,
+		Span:      7 * 24 * time.Hour,
+		BatchSize: 300,
+		Seed:      42,
+	}
+	run := func() ([]database.NewEvent, []int, Summary) {
+		var events []database.NewEvent
+		var batches []int
+		sum, err := Generate(cfg, func(batch []database.NewEvent) error {
+			batches = append(batches, len(batch))
+			events = append(events, batch...)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("generate: %v", err)
+		}
+		return events, batches, sum
+	}
+
+	events, batches, sum := run()
+	if !reflect.DeepEqual(batches, []int{300, 300, 300, 100}) || len(events) != 1000 || sum.Events != 1000 {
+		t.Fatalf("unexpected batches %v for %d events", batches, len(events))
+	}
+	again, _, _ := run()
+	if !reflect.DeepEqual(events, again) {
+		t.Fatal("expected the same seed to generate the same events")
+	}
+
+	counts := map[int64]int{}
+	for i, e := range events {
+		if e.UserID < 1 || e.UserID > 50 || e.Metadata["page"] == "" {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		if e.CreatedAt.Before(until.Add(-cfg.Span)) || !e.CreatedAt.Before(until) || (i > 0 && e.CreatedAt.Before(events[i-1].CreatedAt)) {
+			t.Fatalf("event %d out of range or order: %v", i, e.CreatedAt)
+		}
+		counts[e.UserID]++
+	}
+	if sum.ByAction["view"] < 850 || sum.ByAction["purchase"] < 60 || sum.ActiveUsers != len(counts) {
+		t.Fatalf("unexpected summary %+v", sum)
+	}
+	// Skewed activity: the first user is by far the most active
+	if counts[1] < 5*counts[25] {
+		t.Fatalf("expected skewed activity, user 1 has %d events and user 25 %d", counts[1], counts[25])
+	}
+
+	cfg.Seed = 43
+	if other, _, _ := run(); reflect.DeepEqual(events, other) {
+		t.Fatal("expected another seed to generate other events")
+	}
+
+	failed := errors.New("db down")
+	if _, err := Generate(cfg, func([]database.NewEvent) error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("expected the insert error, got %v", err)
+	}
+}
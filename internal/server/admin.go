@@ -0,0 +1,396 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/lifecycle"
+	"github.com/arimatakao/simple-events-handler/internal/reporting"
+	"github.com/arimatakao/simple-events-handler/internal/ui"
+)
+
+// AdminOptions holds the runtime handles operated through the admin listener.
+type AdminOptions struct {
+	// DB defaults to database.New() when nil.
+	DB        database.Service
+	Reporter  reporting.ErrorReporter
+	Readiness ReadinessChecker
+	// LogLevel is changed by PUT /log/level without a restart.
+	LogLevel *slog.LevelVar
+	// DeadLetters, when set, is inspected and replayed under /deadletter.
+	DeadLetters DeadLetters
+	// Subscriptions, when set, manages outbound webhooks under /subscriptions.
+	Subscriptions Subscriptions
+	// AlertRules, when set, manages threshold alert rules under
+	// /alerts/rules.
+	AlertRules AlertRules
+	// Exports, when set, runs exports to object storage under /exports.
+	Exports Exports
+	// Replays, when set, publishes historical events again under /replay.
+	Replays Replays
+	// EventStore, when set, counts and deletes events under /events.
+	EventStore EventStore
+	// Stats, when set, serves GET /stats/timeseries to the UI.
+	Stats Stats
+	// DeepCheckers run on GET /health?deep=true.
+	DeepCheckers []DeepChecker
+	// Started is the start time of the instance, for its uptime on GET
+	// /status. Defaults to the creation of the admin server.
+	Started time.Time
+	// Status describes the subsystems on GET /status, by name.
+	Status map[string]StatusReporter
+	// Aggregator, when set, runs the aggregation on POST /aggregate.
+	Aggregator Aggregator
+	// Projects, when set, manages projects and their API keys under
+	// /projects and /keys.
+	Projects Projects
+	// Audit, when set, records the admin operations that may change state
+	// and lists them on GET /audit.
+	Audit AuditLog
+	// Flags, when set, manages the feature flags under /flags.
+	Flags FeatureFlags
+	// Jobs, when set, queues and reports background jobs of any kind and
+	// project under /jobs.
+	Jobs Jobs
+	// Recorder, when set, lists the requests recorded by the public API
+	// under /debug/requests, replayed against ReplayTarget, the handler of
+	// the public API.
+	Recorder     RequestRecorder
+	ReplayTarget http.Handler
+	// DualWrites, when set, switches the copy of the events to events_v2
+	// under /migrations/dual-write.
+	DualWrites DualWrites
+	// Snapshots, when set, copies and restores windows of events under
+	// /snapshot.
+	Snapshots Snapshots
+}
+
+// NewAdminServer returns the internal listener serving operational endpoints.
+// It is kept separate from the public API so that operators can firewall it
+// off instead of putting authentication in front of it.
+func NewAdminServer(logger *slog.Logger, cfg *config.Config, opts AdminOptions) *http.Server {
+	s := &Server{
+		l:           logger,
+		db:          opts.DB,
+		reporter:    opts.Reporter,
+		readiness:   opts.Readiness,
+		logLevel:    opts.LogLevel,
+		deadLetters: opts.DeadLetters,
+
+		subscriptions: opts.Subscriptions,
+		alertRules:    opts.AlertRules,
+		exports:       opts.Exports,
+		replays:       opts.Replays,
+		eventStore:    opts.EventStore,
+		stats:         opts.Stats,
+		aggregator:    opts.Aggregator,
+		deepCheckers:  opts.DeepCheckers,
+		started:       opts.Started,
+		statuses:      opts.Status,
+		projects:      opts.Projects,
+		audit:         opts.Audit,
+		flags:         opts.Flags,
+		jobs:          opts.Jobs,
+		recorder:      opts.Recorder,
+		replayTarget:  opts.ReplayTarget,
+		dualWrites:    opts.DualWrites,
+		snapshots:     opts.Snapshots,
+
+		adminToken: cfg.Admin.Token,
+		strictJSON: cfg.Server.StrictJSON,
+
+		strictTimeParsing:  cfg.Server.StrictTimeParsing,
+		defaultEventsLimit: cfg.Server.DefaultEventsLimit,
+		maxEventsLimit:     cfg.Server.MaxEventsLimit,
+		streamFlushMillis:  cfg.Server.EventsFlushIntervalMillis,
+	}
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.setIPFilter(cfg.Admin.AllowCIDRs, cfg.Admin.DenyCIDRs)
+	s.setRequestLogSettings(cfg.Log)
+
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Admin.Port),
+		Handler:           s.RegisterAdminRoutes(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+func (s *Server) RegisterAdminRoutes() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	// The admin listener is reached directly, never through a proxy
+	_ = r.SetTrustedProxies(nil)
+	r.Use(s.RequestLogMiddleware())
+	r.Use(gin.CustomRecovery(s.recoveryHandler))
+	r.Use(s.IPFilterMiddleware())
+	r.NoRoute(noRouteHandler)
+
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	// The files of the UI hold no data, the page sends the admin token
+	r.GET("/ui", func(c *gin.Context) { c.Redirect(http.StatusMovedPermanently, "/ui/") })
+	r.GET("/ui/*file", gin.WrapH(ui.Handler("/ui")))
+	r.GET("/health", s.HealthHandler)
+	r.GET("/ready", s.ReadyHandler)
+
+	// Audited before authentication, so that rejected attempts are kept
+	admin := r.Group("/", s.AuditMiddleware(), s.AdminAuthMiddleware())
+	admin.GET("/status", s.StatusHandler)
+	admin.GET("/log/level", s.GetLogLevelHandler)
+	admin.PUT("/log/level", s.SetLogLevelHandler)
+	admin.GET("/deadletter", s.ListDeadLettersHandler)
+	admin.GET("/deadletter/:id", s.GetDeadLetterHandler)
+	admin.POST("/deadletter/:id/retry", s.RetryDeadLetterHandler)
+	admin.DELETE("/deadletter/:id", s.DiscardDeadLetterHandler)
+	admin.POST("/subscriptions", s.CreateSubscriptionHandler)
+	admin.GET("/subscriptions", s.ListSubscriptionsHandler)
+	admin.GET("/subscriptions/:id", s.GetSubscriptionHandler)
+	admin.PUT("/subscriptions/:id", s.UpdateSubscriptionHandler)
+	admin.DELETE("/subscriptions/:id", s.DeleteSubscriptionHandler)
+	admin.GET("/subscriptions/:id/deliveries", s.ListDeliveriesHandler)
+	admin.POST("/alerts/rules", s.CreateAlertRuleHandler)
+	admin.GET("/alerts/rules", s.ListAlertRulesHandler)
+	admin.GET("/alerts/rules/:id", s.GetAlertRuleHandler)
+	admin.PUT("/alerts/rules/:id", s.UpdateAlertRuleHandler)
+	admin.DELETE("/alerts/rules/:id", s.DeleteAlertRuleHandler)
+	admin.GET("/alerts/rules/:id/firings", s.ListAlertFiringsHandler)
+	admin.POST("/exports", s.CreateExportHandler)
+	admin.GET("/exports", s.ListExportsHandler)
+	admin.GET("/exports/:id", s.GetExportHandler)
+	admin.POST("/replay", s.CreateReplayHandler)
+	admin.GET("/replay", s.ListReplaysHandler)
+	admin.GET("/replay/:id", s.GetReplayHandler)
+	admin.GET("/events", s.AdminProjectMiddleware(), s.GetEventsHandler)
+	admin.GET("/events/count", s.CountEventsHandler)
+	admin.DELETE("/events", s.DeleteEventsHandler)
+	admin.POST("/aggregate", s.TriggerAggregationHandler)
+	admin.POST("/projects", s.CreateProjectHandler)
+	admin.GET("/projects", s.ListProjectsHandler)
+	admin.POST("/projects/:id/keys", s.CreateAPIKeyHandler)
+	admin.GET("/projects/:id/keys", s.ListAPIKeysHandler)
+	admin.DELETE("/keys/:id", s.RevokeAPIKeyHandler)
+	admin.GET("/audit", s.ListAuditHandler)
+	admin.GET("/flags", s.ListFeatureFlagsHandler)
+	admin.PUT("/flags/:name", s.SetFeatureFlagHandler)
+	admin.DELETE("/flags/:name", s.DeleteFeatureFlagHandler)
+	admin.GET("/stats/timeseries", s.AdminProjectMiddleware(), s.TimeSeriesHandler)
+	admin.POST("/jobs", s.CreateJobHandler)
+	admin.GET("/jobs/:id", s.GetAnyJobHandler)
+	admin.POST("/actions/rename", s.RenameActionHandler)
+	admin.GET("/debug/requests", s.ListRecordedRequestsHandler)
+	admin.GET("/debug/requests/:id", s.GetRecordedRequestHandler)
+	admin.POST("/debug/requests/:id/replay", s.ReplayRecordedRequestHandler)
+	admin.POST("/debug/requests/replay", s.ReplayRequestHandler)
+	admin.GET("/migrations/dual-write", s.GetDualWriteHandler)
+	admin.PUT("/migrations/dual-write", s.SetDualWriteHandler)
+	admin.GET("/snapshot", s.SnapshotHandler)
+	admin.POST("/snapshot/restore", s.RestoreSnapshotHandler)
+
+	// Profiling endpoints, e.g. go tool pprof http://host:8090/debug/pprof/profile?seconds=30
+	debug := r.Group("/debug/pprof", s.AdminAuthMiddleware())
+	debug.GET("/*profile", s.PprofHandler)
+	debug.POST("/symbol", gin.WrapF(pprof.Symbol))
+
+	return r
+}
+
+// ReadyHandler reports whether the instance should receive traffic. It turns
+// unavailable as soon as graceful shutdown starts, while /health keeps
+// describing the database.
+func (s *Server) ReadyHandler(c *gin.Context) {
+	if s.readiness == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+		return
+	}
+
+	status := http.StatusOK
+	if !s.readiness.Ready() {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"status": s.readiness.State().String()})
+}
+
+// AdminProjectMiddleware scopes the public API handlers served on the
+// admin listener to the project of the project_id parameter, the default
+// project when missing.
+func (s *Server) AdminProjectMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := database.DefaultProjectID
+		if v := c.Query("project_id"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 {
+				abortWithInvalid(c, ingest.NewFieldError("project_id", "out_of_range", "project_id must be a positive integer"))
+				return
+			}
+			id = n
+		}
+		c.Set(projectKey, id)
+		c.Next()
+	}
+}
+
+// AdminAuthMiddleware requires the configured admin token as a bearer token.
+// When no token is configured the admin port itself is the only guard.
+func (s *Server) AdminAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.adminToken == "" {
+			c.Set(adminKey, true)
+			c.Next()
+			return
+		}
+
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, "missing or invalid admin token")
+			return
+		}
+		c.Set(adminKey, true)
+		c.Next()
+	}
+}
+
+type LogLevelRequest struct {
+	Level string `json:"level" binding:"required"`
+}
+
+func (s *Server) GetLogLevelHandler(c *gin.Context) {
+	if s.logLevel == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "runtime log level is not configurable")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"level": s.logLevel.Level().String()})
+}
+
+// SetLogLevelHandler changes the level of the application logger, e.g. to
+// turn on debug logging during an incident without redeploying.
+func (s *Server) SetLogLevelHandler(c *gin.Context) {
+	if s.logLevel == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "runtime log level is not configurable")
+		return
+	}
+
+	var req LogLevelRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(req.Level)); err != nil {
+		abortWithInvalid(c, ingest.NewFieldError("level", "invalid", "level must be one of debug, info, warn, error"))
+		return
+	}
+
+	previous := s.logLevel.Level()
+	s.logLevel.Set(level)
+	s.l.Warn("log level changed", "from", previous.String(), "to", level.String())
+
+	c.JSON(http.StatusOK, gin.H{"level": level.String()})
+}
+
+func (s *Server) PprofHandler(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("profile"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// Index serves both the listing and named profiles (heap, goroutine, ...)
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+func (s *Server) HealthHandler(c *gin.Context) {
+	// The database may not accept connections yet while the instance starts
+	if s.readiness != nil && s.readiness.State() == lifecycle.StateStarting {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": lifecycle.StateStarting.String()})
+		return
+	}
+
+	deep := false
+	if v := c.Query("deep"); v != "" {
+		var err error
+		if deep, err = strconv.ParseBool(v); err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "deep must be a boolean")
+			return
+		}
+	}
+
+	stats := s.db.Health()
+
+	status := http.StatusOK
+	if stats["status"] != "up" {
+		status = http.StatusServiceUnavailable
+	}
+	if !deep {
+		c.JSON(status, stats)
+		return
+	}
+
+	body := gin.H{}
+	for k, v := range stats {
+		body[k] = v
+	}
+	ctx, cancel := context.WithTimeout(c.Request.Context(), deepCheckTimeout)
+	defer cancel()
+	checks := []database.CheckResult{}
+	for _, checker := range s.deepCheckers {
+		checks = append(checks, checker.DeepCheck(ctx)...)
+	}
+	for _, check := range checks {
+		if check.Status != "ok" {
+			status = http.StatusServiceUnavailable
+			body["status"] = "down"
+		}
+	}
+	body["checks"] = checks
+	c.JSON(status, body)
+}
+
+// deepCheckTimeout bounds the checks of a deep health check together.
+const deepCheckTimeout = 5 * time.Second
+
+// StatusHandler summarizes the state of the instance for operator
+// dashboards: its uptime, the health of the database and the state of each
+// subsystem. A subsystem whose state cannot be read reports its error
+// instead, without failing the whole document.
+func (s *Server) StatusHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), statusTimeout)
+	defer cancel()
+
+	body := gin.H{
+		"started_at":     s.started.UTC().Format(time.RFC3339),
+		"uptime_seconds": int64(time.Since(s.started).Seconds()),
+		"database":       s.db.Health(),
+	}
+	for name, reporter := range s.statuses {
+		state, err := reporter.Status(ctx)
+		if err != nil {
+			s.l.Warn("failed to read subsystem status", "subsystem", name, "error", err)
+			state = gin.H{"error": err.Error()}
+		}
+		body[name] = state
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+// statusTimeout bounds the reads of the subsystem states together.
+const statusTimeout = 5 * time.Second
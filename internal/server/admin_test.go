@@ -0,0 +1,319 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/lifecycle"
+)
+
+func readyManager(logger *slog.Logger) *lifecycle.Manager {
+	m := lifecycle.New(logger)
+	m.SetReady()
+	return m
+}
+
+// fakeCheck is a DeepChecker returning its results.
+type fakeCheck []database.CheckResult
+
+func (f fakeCheck) DeepCheck(ctx context.Context) []database.CheckResult {
+	return f
+}
+
+func TestAdminRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		health         map[string]string
+		adminToken     string
+		readiness      ReadinessChecker
+		deepCheckers   []DeepChecker
+		statuses       map[string]StatusReporter
+		authHeader     string
+		method         string
+		body           string
+		path           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{
+			name:           "health up",
+			health:         map[string]string{"status": "up"},
+			path:           "/health",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"status":"up"`,
+		},
+		{
+			name:           "health down",
+			health:         map[string]string{"status": "down", "error": "db down"},
+			path:           "/health",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectBody:     `"status":"down"`,
+		},
+		{
+			name:           "health while starting",
+			health:         map[string]string{"status": "up"},
+			readiness:      lifecycle.New(logger),
+			path:           "/health",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectBody:     `"status":"starting"`,
+		},
+		{
+			name:   "deep health",
+			health: map[string]string{"status": "up"},
+			deepCheckers: []DeepChecker{fakeCheck{
+				database.NewCheckResult("events_table", nil),
+				database.NewCheckResult("aggregation", errors.New("no run since the start")),
+			}},
+			path:           "/health?deep=true",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectBody:     `"checks":[{"name":"events_table","status":"ok"},{"name":"aggregation","status":"failed","error":"no run since the start"}],"status":"down"`,
+		},
+		{
+			name:           "deep health passing",
+			health:         map[string]string{"status": "up"},
+			deepCheckers:   []DeepChecker{fakeCheck{database.NewCheckResult("events_table", nil)}},
+			path:           "/health?deep=1",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"status":"up"`,
+		},
+		{
+			name:           "deep health not a boolean",
+			path:           "/health?deep=yes",
+			expectedStatus: http.StatusBadRequest,
+			expectBody:     CodeInvalidRequest,
+		},
+		{
+			name:   "status",
+			health: map[string]string{"status": "up"},
+			statuses: map[string]StatusReporter{
+				"ingest_buffer": StatusFunc(func(ctx context.Context) (any, error) {
+					return map[string]int{"depth": 3}, nil
+				}),
+			},
+			path:           "/status",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"database":{"status":"up"},"ingest_buffer":{"depth":3},"started_at":"2025-01-02T15:04:05Z","uptime_seconds":`,
+		},
+		{
+			name:   "status failed subsystem",
+			health: map[string]string{"status": "up"},
+			statuses: map[string]StatusReporter{
+				"webhook_deliveries": StatusFunc(func(ctx context.Context) (any, error) {
+					return nil, errors.New("connection refused")
+				}),
+			},
+			path:           "/status",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"webhook_deliveries":{"error":"connection refused"}`,
+		},
+		{
+			name:           "status requires token",
+			adminToken:     "secret",
+			path:           "/status",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "ready",
+			readiness:      readyManager(logger),
+			path:           "/ready",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"status":"ready"`,
+		},
+		{
+			name:           "not ready while starting",
+			readiness:      lifecycle.New(logger),
+			path:           "/ready",
+			expectedStatus: http.StatusServiceUnavailable,
+			expectBody:     `"status":"starting"`,
+		},
+		{
+			name:           "get log level",
+			path:           "/log/level",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"level":"INFO"`,
+		},
+		{
+			name:           "set log level",
+			method:         http.MethodPut,
+			body:           `{"level":"debug"}`,
+			path:           "/log/level",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"level":"DEBUG"`,
+		},
+		{
+			name:           "set invalid log level",
+			method:         http.MethodPut,
+			body:           `{"level":"verbose"}`,
+			path:           "/log/level",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     CodeValidationFailed,
+		},
+		{
+			name:           "set log level requires token",
+			adminToken:     "secret",
+			method:         http.MethodPut,
+			body:           `{"level":"debug"}`,
+			path:           "/log/level",
+			expectedStatus: http.StatusUnauthorized,
+		},
+		{
+			name:           "metrics",
+			path:           "/metrics",
+			expectedStatus: http.StatusOK,
+			expectBody:     "go_goroutines",
+		},
+		{
+			name:           "pprof index without token configured",
+			path:           "/debug/pprof/",
+			expectedStatus: http.StatusOK,
+			expectBody:     "goroutine",
+		},
+		{
+			name:           "pprof named profile",
+			path:           "/debug/pprof/heap?debug=1",
+			expectedStatus: http.StatusOK,
+			expectBody:     "heap profile",
+		},
+		{
+			name:           "pprof missing token",
+			adminToken:     "secret",
+			path:           "/debug/pprof/",
+			expectedStatus: http.StatusUnauthorized,
+			expectBody:     "unauthorized",
+		},
+		{
+			name:           "pprof with token",
+			adminToken:     "secret",
+			authHeader:     "Bearer secret",
+			path:           "/debug/pprof/cmdline",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "metrics do not require token",
+			adminToken:     "secret",
+			path:           "/metrics",
+			expectedStatus: http.StatusOK,
+			expectBody:     "go_goroutines",
+		},
+		{
+			name:           "ui does not require token",
+			adminToken:     "secret",
+			path:           "/ui/",
+			expectedStatus: http.StatusOK,
+			expectBody:     "<title>simple-events-handler</title>",
+		},
+		{
+			name:           "ui script",
+			path:           "/ui/app.js",
+			expectedStatus: http.StatusOK,
+			expectBody:     `api("/events?"`,
+		},
+		{
+			name:           "ui without trailing slash",
+			path:           "/ui",
+			expectedStatus: http.StatusMovedPermanently,
+		},
+		{
+			name:           "events require token",
+			adminToken:     "secret",
+			path:           "/events?from=2025-03-01T00:00:00Z&to=2025-03-02T00:00:00Z",
+			expectedStatus: http.StatusUnauthorized,
+			expectBody:     CodeUnauthorized,
+		},
+		{
+			name:           "events of an invalid project",
+			path:           "/events?project_id=0&from=2025-03-01T00:00:00Z&to=2025-03-02T00:00:00Z",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"project_id"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				l:          logger,
+				db:         &mockDB{health: tt.health},
+				adminToken: tt.adminToken,
+				readiness:  tt.readiness,
+				logLevel:   new(slog.LevelVar),
+
+				deepCheckers: tt.deepCheckers,
+				started:      time.Date(2025, 1, 2, 15, 4, 5, 0, time.UTC),
+				statuses:     tt.statuses,
+			}
+			router := s.RegisterAdminRoutes()
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			req := httptest.NewRequest(method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+// TestAdminRequestLog ensures the requests of the admin listener are logged
+// except on the excluded paths.
+func TestAdminRequestLog(t *testing.T) {
+	var logs strings.Builder
+	s := &Server{
+		l:        slog.New(slog.NewTextHandler(&logs, nil)),
+		db:       &mockDB{health: map[string]string{"status": "up"}},
+		logLevel: new(slog.LevelVar),
+	}
+	s.setRequestLogSettings(config.LogConfig{ExcludePaths: []string{"/health"}})
+	router := s.RegisterAdminRoutes()
+
+	for _, path := range []string{"/health", "/status"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if strings.Contains(logs.String(), "path=/health") {
+		t.Fatalf("expected /health not to be logged, got %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), "path=/status") {
+		t.Fatalf("expected /status to be logged, got %q", logs.String())
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := &mockDB{getResults: []database.Event{{ID: 7, UserID: 42, Action: "view"}}}
+	s := &Server{l: logger, db: db, adminToken: "secret", defaultEventsLimit: 100}
+	router := s.RegisterAdminRoutes()
+
+	req := httptest.NewRequest(http.MethodGet, "/events?project_id=3&user_id=42&from=2025-03-01T00:00:00Z&to=2025-03-02T00:00:00Z", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"id":7`) {
+		t.Fatalf("expected the events, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if db.getProjectID != 3 || db.getUserID == nil || *db.getUserID != 42 || db.getLimit != 101 {
+		t.Fatalf("expected the events of user 42 in project 3, limited, got project %d, user %v, limit %d", db.getProjectID, db.getUserID, db.getLimit)
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// AlertRules is the store of threshold alert rules, operated through the
+// admin listener.
+type AlertRules interface {
+	CreateAlertRule(ctx context.Context, r database.AlertRule) (database.AlertRule, error)
+	ListAlertRules(ctx context.Context, activeOnly bool) ([]database.AlertRule, error)
+	GetAlertRule(ctx context.Context, id int64) (database.AlertRule, error)
+	UpdateAlertRule(ctx context.Context, r database.AlertRule) (database.AlertRule, error)
+	DeleteAlertRule(ctx context.Context, id int64) error
+	ListAlertFirings(ctx context.Context, ruleID int64, limit int) ([]database.AlertFiring, error)
+}
+
+const (
+	// maxAlertWindowSeconds bounds the events counted by a rule evaluation
+	maxAlertWindowSeconds = 24 * 60 * 60
+
+	defaultFiringsLimit = 100
+	maxFiringsLimit     = 1000
+)
+
+// AlertRuleRequest fires when more than Threshold events of Action are
+// stored within WindowSeconds in the project, or for a single user with
+// PerUser. The project defaults to the default project.
+type AlertRuleRequest struct {
+	Name          string `json:"name" binding:"required"`
+	ProjectID     int64  `json:"project_id"`
+	Action        string `json:"action" binding:"required"`
+	PerUser       bool   `json:"per_user"`
+	Threshold     *int64 `json:"threshold" binding:"required"`
+	WindowSeconds int    `json:"window_seconds" binding:"required"`
+	Active        *bool  `json:"active"`
+}
+
+func (r AlertRuleRequest) rule() (database.AlertRule, error) {
+	if *r.Threshold < 0 {
+		return database.AlertRule{}, ingest.NewFieldError("threshold", "out_of_range", "threshold must not be negative")
+	}
+	if r.WindowSeconds < 1 || r.WindowSeconds > maxAlertWindowSeconds {
+		return database.AlertRule{}, ingest.NewFieldError("window_seconds", "out_of_range", fmt.Sprintf("window_seconds must be between 1 and %d", maxAlertWindowSeconds))
+	}
+	if r.ProjectID < 0 {
+		return database.AlertRule{}, ingest.NewFieldError("project_id", "out_of_range", "project_id must be a positive integer")
+	}
+	rule := database.AlertRule{
+		Name:          r.Name,
+		ProjectID:     r.ProjectID,
+		Action:        r.Action,
+		PerUser:       r.PerUser,
+		Threshold:     *r.Threshold,
+		WindowSeconds: r.WindowSeconds,
+		Active:        true,
+	}
+	if rule.ProjectID == 0 {
+		rule.ProjectID = database.DefaultProjectID
+	}
+	if r.Active != nil {
+		rule.Active = *r.Active
+	}
+	return rule, nil
+}
+
+// requireAlertRules answers 404 when alerting is not enabled.
+func (s *Server) requireAlertRules(c *gin.Context) bool {
+	if s.alertRules == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "alerting is not enabled")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithAlertRuleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrAlertRuleNotFound):
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case errors.Is(err, database.ErrProjectNotFound):
+		abortWithInvalid(c, ingest.NewFieldError("project_id", "not_found", err.Error()))
+		return
+	}
+	s.l.Error("alert rule operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access alert rules")
+}
+
+// bindAlertRule reads the rule body, answering 400 when it is malformed and
+// 422 when it is invalid.
+func (s *Server) bindAlertRule(c *gin.Context) (database.AlertRule, bool) {
+	var req AlertRuleRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return database.AlertRule{}, false
+	}
+	rule, err := req.rule()
+	if err != nil {
+		abortWithInvalid(c, err)
+		return database.AlertRule{}, false
+	}
+	return rule, true
+}
+
+func alertRuleID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, database.ErrAlertRuleNotFound.Error())
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) CreateAlertRuleHandler(c *gin.Context) {
+	if !s.requireAlertRules(c) {
+		return
+	}
+	rule, ok := s.bindAlertRule(c)
+	if !ok {
+		return
+	}
+	created, err := s.alertRules.CreateAlertRule(c.Request.Context(), rule)
+	if err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/alerts/rules/%d", created.ID))
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) ListAlertRulesHandler(c *gin.Context) {
+	if !s.requireAlertRules(c) {
+		return
+	}
+	rules, err := s.alertRules.ListAlertRules(c.Request.Context(), false)
+	if err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+func (s *Server) GetAlertRuleHandler(c *gin.Context) {
+	if !s.requireAlertRules(c) {
+		return
+	}
+	id, ok := alertRuleID(c)
+	if !ok {
+		return
+	}
+	rule, err := s.alertRules.GetAlertRule(c.Request.Context(), id)
+	if err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// UpdateAlertRuleHandler replaces a rule. Its open firings are resolved, so
+// that the new condition fires again.
+func (s *Server) UpdateAlertRuleHandler(c *gin.Context) {
+	if !s.requireAlertRules(c) {
+		return
+	}
+	id, ok := alertRuleID(c)
+	if !ok {
+		return
+	}
+	rule, ok := s.bindAlertRule(c)
+	if !ok {
+		return
+	}
+	rule.ID = id
+
+	updated, err := s.alertRules.UpdateAlertRule(c.Request.Context(), rule)
+	if err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteAlertRuleHandler removes a rule together with its firings.
+func (s *Server) DeleteAlertRuleHandler(c *gin.Context) {
+	if !s.requireAlertRules(c) {
+		return
+	}
+	id, ok := alertRuleID(c)
+	if !ok {
+		return
+	}
+	if err := s.alertRules.DeleteAlertRule(c.Request.Context(), id); err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListAlertFiringsHandler returns the latest firings of a rule, newest
+// first, e.g. /alerts/rules/1/firings?limit=20.
+func (s *Server) ListAlertFiringsHandler(c *gin.Context) {
+	if !s.requireAlertRules(c) {
+		return
+	}
+	id, ok := alertRuleID(c)
+	if !ok {
+		return
+	}
+	limit := defaultFiringsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be an integer")
+			return
+		}
+		if n < 1 || n > maxFiringsLimit {
+			abortWithInvalid(c, ingest.NewFieldError("limit", "out_of_range", fmt.Sprintf("limit must be between 1 and %d", maxFiringsLimit)))
+			return
+		}
+		limit = n
+	}
+
+	ctx := c.Request.Context()
+	if _, err := s.alertRules.GetAlertRule(ctx, id); err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	firings, err := s.alertRules.ListAlertFirings(ctx, id, limit)
+	if err != nil {
+		s.abortWithAlertRuleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"firings": firings})
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeAlertRules struct {
+	rules  map[int64]database.AlertRule
+	nextID int64
+	err    error
+}
+
+func (f *fakeAlertRules) CreateAlertRule(ctx context.Context, r database.AlertRule) (database.AlertRule, error) {
+	if f.err != nil {
+		return database.AlertRule{}, f.err
+	}
+	if r.ProjectID != database.DefaultProjectID {
+		return database.AlertRule{}, database.ErrProjectNotFound
+	}
+	f.nextID++
+	r.ID = f.nextID
+	f.rules[r.ID] = r
+	return r, nil
+}
+func (f *fakeAlertRules) ListAlertRules(ctx context.Context, activeOnly bool) ([]database.AlertRule, error) {
+	var out []database.AlertRule
+	for _, r := range f.rules {
+		out = append(out, r)
+	}
+	return out, f.err
+}
+func (f *fakeAlertRules) GetAlertRule(ctx context.Context, id int64) (database.AlertRule, error) {
+	r, ok := f.rules[id]
+	if !ok {
+		return database.AlertRule{}, database.ErrAlertRuleNotFound
+	}
+	return r, nil
+}
+func (f *fakeAlertRules) UpdateAlertRule(ctx context.Context, r database.AlertRule) (database.AlertRule, error) {
+	if _, ok := f.rules[r.ID]; !ok {
+		return database.AlertRule{}, database.ErrAlertRuleNotFound
+	}
+	f.rules[r.ID] = r
+	return r, nil
+}
+func (f *fakeAlertRules) DeleteAlertRule(ctx context.Context, id int64) error {
+	if _, ok := f.rules[id]; !ok {
+		return database.ErrAlertRuleNotFound
+	}
+	delete(f.rules, id)
+	return nil
+}
+func (f *fakeAlertRules) ListAlertFirings(ctx context.Context, ruleID int64, limit int) ([]database.AlertFiring, error) {
+	return []database.AlertFiring{{ID: 5, RuleID: ruleID, UserID: 42, Count: 12}}, nil
+}
+
+func TestAlertRuleRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const rule = `{"name":"brute force","action":"login_failed","per_user":true,"threshold":10,"window_seconds":300}`
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		storeErr       error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+		expectRules    int
+	}{
+		{name: "create", method: http.MethodPost, path: "/alerts/rules", body: rule, expectedStatus: http.StatusCreated, expectBody: `"project_id":1,"action":"login_failed","per_user":true,"threshold":10,"window_seconds":300,"active":true`, expectRules: 2},
+		{name: "create with a zero threshold", method: http.MethodPost, path: "/alerts/rules", body: `{"name":"any error","action":"error","threshold":0,"window_seconds":60}`, expectedStatus: http.StatusCreated, expectBody: `"threshold":0`, expectRules: 2},
+		{name: "create without threshold", method: http.MethodPost, path: "/alerts/rules", body: `{"name":"any error","action":"error","window_seconds":60}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed, expectRules: 1},
+		{name: "create with a negative threshold", method: http.MethodPost, path: "/alerts/rules", body: `{"name":"x","action":"error","threshold":-1,"window_seconds":60}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"threshold"`, expectRules: 1},
+		{name: "create with a long window", method: http.MethodPost, path: "/alerts/rules", body: `{"name":"x","action":"error","threshold":1,"window_seconds":86401}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"window_seconds"`, expectRules: 1},
+		{name: "create in an unknown project", method: http.MethodPost, path: "/alerts/rules", body: `{"name":"x","project_id":7,"action":"error","threshold":1,"window_seconds":60}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"project_id"`, expectRules: 1},
+		{name: "create while the database is down", storeErr: fmt.Errorf("db down"), method: http.MethodPost, path: "/alerts/rules", body: rule, expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable, expectRules: 1},
+		{name: "list", method: http.MethodGet, path: "/alerts/rules", expectedStatus: http.StatusOK, expectBody: `"name":"checkout errors"`, expectRules: 1},
+		{name: "get", method: http.MethodGet, path: "/alerts/rules/1", expectedStatus: http.StatusOK, expectBody: `"active":true`, expectRules: 1},
+		{name: "get unknown", method: http.MethodGet, path: "/alerts/rules/2", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectRules: 1},
+		{name: "update", method: http.MethodPut, path: "/alerts/rules/1", body: `{"name":"checkout errors","action":"checkout_error","threshold":50,"window_seconds":60,"active":false}`, expectedStatus: http.StatusOK, expectBody: `"active":false`, expectRules: 1},
+		{name: "update unknown", method: http.MethodPut, path: "/alerts/rules/2", body: rule, expectedStatus: http.StatusNotFound, expectRules: 1},
+		{name: "delete", method: http.MethodDelete, path: "/alerts/rules/1", expectedStatus: http.StatusNoContent},
+		{name: "firings", method: http.MethodGet, path: "/alerts/rules/1/firings?limit=10", expectedStatus: http.StatusOK, expectBody: `"user_id":42,"count":12`, expectRules: 1},
+		{name: "firings with a bad limit", method: http.MethodGet, path: "/alerts/rules/1/firings?limit=0", expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed, expectRules: 1},
+		{name: "firings of an unknown rule", method: http.MethodGet, path: "/alerts/rules/2/firings", expectedStatus: http.StatusNotFound, expectRules: 1},
+		{name: "not enabled", unconfigured: true, method: http.MethodGet, path: "/alerts/rules", expectedStatus: http.StatusNotFound, expectBody: "not enabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &fakeAlertRules{
+				rules:  map[int64]database.AlertRule{1: {ID: 1, Name: "checkout errors", ProjectID: 1, Action: "checkout_error", Threshold: 100, WindowSeconds: 60, Active: true}},
+				nextID: 1,
+				err:    tt.storeErr,
+			}
+			s := &Server{l: logger, db: &mockDB{}, alertRules: rules}
+			if tt.unconfigured {
+				s.alertRules = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if !tt.unconfigured && len(rules.rules) != tt.expectRules {
+				t.Fatalf("expected %d rules got %d", tt.expectRules, len(rules.rules))
+			}
+		})
+	}
+}
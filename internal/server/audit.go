@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/logging"
+)
+
+// AuditLog records the privileged operations of the admin listener.
+type AuditLog interface {
+	Record(ctx context.Context, e database.AuditEntry) error
+	ListAudit(ctx context.Context, f database.AuditFilter) ([]database.AuditEntry, error)
+}
+
+const (
+	// ActorHeader names the operator of an admin request. The admin token
+	// is shared, so it is informational; eventsctl sends the local user.
+	ActorHeader = "X-Actor"
+	// RequestIDHeader correlates an admin request with its audit entry. It
+	// is generated when the client does not send one.
+	RequestIDHeader = "X-Request-ID"
+
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+
+	// Bounds of the recorded request
+	maxAuditBody       = 64 << 10
+	maxAuditValueBytes = 200
+	maxAuditFields     = 20
+)
+
+// sensitiveFields are redacted from audit payloads.
+var sensitiveFields = []string{"secret", "token", "password", "key"}
+
+// AuditMiddleware records every admin request that may change state, that
+// is every method but GET, HEAD and OPTIONS, including the rejected ones.
+// A failure to record is logged and does not fail the request, which has
+// already been served.
+func (s *Server) AuditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := assignRequestID(c)
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if s.audit == nil {
+			c.Next()
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			body, _ = io.ReadAll(io.LimitReader(c.Request.Body, maxAuditBody))
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+		}
+
+		c.Next()
+
+		action := c.FullPath()
+		if action == "" {
+			action = c.Request.URL.Path
+		}
+		entry := database.AuditEntry{
+			Actor:      truncate(c.GetHeader(ActorHeader)),
+			RemoteAddr: c.ClientIP(),
+			RequestID:  requestID,
+			Action:     c.Request.Method + " " + action,
+			Status:     c.Writer.Status(),
+			Payload:    summarizePayload(c, body),
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := s.audit.Record(ctx, entry); err != nil {
+			s.l.Error("failed to record audit entry", "action", entry.Action, "request_id", requestID, "error", err)
+		}
+	}
+}
+
+// assignRequestID keeps the X-Request-ID of the client, or makes one up,
+// echoes it in the response and puts it in the context of the request for
+// the logs of the lower layers. Called again for the same request, it
+// returns the ID already assigned.
+func assignRequestID(c *gin.Context) string {
+	if requestID := c.Writer.Header().Get(RequestIDHeader); requestID != "" {
+		return requestID
+	}
+	requestID := c.GetHeader(RequestIDHeader)
+	if requestID == "" || len(requestID) > 100 {
+		requestID = newRequestID()
+	}
+	c.Header(RequestIDHeader, requestID)
+	c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), requestID))
+	return requestID
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// summarizePayload keeps the path and query parameters and the top-level
+// fields of a JSON object body, truncated, with secrets redacted.
+func summarizePayload(c *gin.Context, body []byte) map[string]string {
+	payload := make(map[string]string)
+	set := func(k, v string) {
+		if len(payload) >= maxAuditFields {
+			return
+		}
+		for _, f := range sensitiveFields {
+			if strings.Contains(strings.ToLower(k), f) {
+				v = "[redacted]"
+				break
+			}
+		}
+		payload[k] = truncate(v)
+	}
+	for _, p := range c.Params {
+		set(p.Key, p.Value)
+	}
+	for k, v := range c.Request.URL.Query() {
+		set(k, strings.Join(v, ","))
+	}
+
+	var fields map[string]json.RawMessage
+	if len(bytes.TrimSpace(body)) == 0 {
+		return payload
+	}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		set("body", strconv.Itoa(len(body))+" bytes")
+		return payload
+	}
+	for k, raw := range fields {
+		var str string
+		if json.Unmarshal(raw, &str) == nil {
+			set(k, str)
+			continue
+		}
+		set(k, string(raw))
+	}
+	return payload
+}
+
+func truncate(v string) string {
+	if len(v) <= maxAuditValueBytes {
+		return v
+	}
+	return v[:maxAuditValueBytes] + "..."
+}
+
+// ListAuditHandler lists the audit log newest first, optionally filtered by
+// actor and action. Older pages are read with before set to the last id.
+func (s *Server) ListAuditHandler(c *gin.Context) {
+	if s.audit == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "the audit log is not configured")
+		return
+	}
+	f := database.AuditFilter{Actor: c.Query("actor"), Action: c.Query("action"), Limit: defaultAuditLimit}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be an integer")
+			return
+		}
+		if n < 1 || n > maxAuditLimit {
+			abortWithInvalid(c, ingest.NewFieldError("limit", "out_of_range", fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)))
+			return
+		}
+		f.Limit = n
+	}
+	if v := c.Query("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "before must be an integer")
+			return
+		}
+		if id < 1 {
+			abortWithInvalid(c, ingest.NewFieldError("before", "out_of_range", "before must be a positive id"))
+			return
+		}
+		f.Before = id
+	}
+
+	entries, err := s.audit.ListAudit(c.Request.Context(), f)
+	if err != nil {
+		s.l.Error("failed to list audit entries", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to list audit entries")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
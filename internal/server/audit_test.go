@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeAudit struct {
+	entries []database.AuditEntry
+	filter  database.AuditFilter
+	err     error
+}
+
+func (f *fakeAudit) Record(ctx context.Context, e database.AuditEntry) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.entries = append(f.entries, e)
+	return nil
+}
+
+func (f *fakeAudit) ListAudit(ctx context.Context, filter database.AuditFilter) ([]database.AuditEntry, error) {
+	f.filter = filter
+	return f.entries, f.err
+}
+
+func TestAuditMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	audit := &fakeAudit{}
+	projects := &fakeProjects{}
+	s := &Server{l: logger, db: &mockDB{}, projects: projects, audit: audit, adminToken: "secret"}
+	router := s.RegisterAdminRoutes()
+
+	send := func(method, path, token, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodPost, "/projects", "secret", `{"name":"shop","token":"hunter2"}`, map[string]string{ActorHeader: "alice", RequestIDHeader: "req-1"})
+	if rr.Code != http.StatusCreated || rr.Header().Get(RequestIDHeader) != "req-1" {
+		t.Fatalf("unexpected response %d with request id %q", rr.Code, rr.Header().Get(RequestIDHeader))
+	}
+	// The handler still reads the whole body
+	if len(projects.projects) != 1 || projects.projects[0].Name != "shop" {
+		t.Fatalf("expected the project to be created, got %+v", projects.projects)
+	}
+	if len(audit.entries) != 1 {
+		t.Fatalf("expected one audit entry, got %+v", audit.entries)
+	}
+	e := audit.entries[0]
+	if e.Actor != "alice" || e.RequestID != "req-1" || e.Action != "POST /projects" || e.Status != http.StatusCreated || e.RemoteAddr == "" {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+	if e.Payload["name"] != "shop" || e.Payload["token"] != "[redacted]" {
+		t.Fatalf("unexpected payload %v", e.Payload)
+	}
+
+	// Reads are not audited, rejected attempts are
+	if rr := send(http.MethodGet, "/projects", "secret", "", nil); rr.Code != http.StatusOK || rr.Header().Get(RequestIDHeader) == "" {
+		t.Fatalf("expected a generated request id, got status %d", rr.Code)
+	}
+	if rr := send(http.MethodDelete, "/keys/3?reason=leaked", "wrong", "", nil); rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401, got %d", rr.Code)
+	}
+	if len(audit.entries) != 2 {
+		t.Fatalf("expected two audit entries, got %+v", audit.entries)
+	}
+	e = audit.entries[1]
+	if e.Action != "DELETE /keys/:id" || e.Status != http.StatusUnauthorized || e.Payload["id"] != "3" || e.Payload["reason"] != "leaked" || e.RequestID == "" {
+		t.Fatalf("unexpected audit entry %+v", e)
+	}
+	if len(projects.revoked) != 0 {
+		t.Fatal("expected the unauthorized revocation to be rejected")
+	}
+
+	// A failing audit log does not fail the operation
+	audit.err = errors.New("connection refused")
+	if rr := send(http.MethodDelete, "/keys/3", "secret", "", nil); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+}
+
+func TestListAuditHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		query          string
+		expectedStatus int
+		expectFilter   database.AuditFilter
+	}{
+		{name: "defaults", expectedStatus: http.StatusOK, expectFilter: database.AuditFilter{Limit: defaultAuditLimit}},
+		{name: "filters", query: "?actor=alice&action=DELETE+/events&before=42&limit=5", expectedStatus: http.StatusOK, expectFilter: database.AuditFilter{Actor: "alice", Action: "DELETE /events", Before: 42, Limit: 5}},
+		{name: "limit too large", query: "?limit=5000", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "invalid before", query: "?before=x", expectedStatus: http.StatusBadRequest},
+		{name: "not configured", unconfigured: true, expectedStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audit := &fakeAudit{entries: []database.AuditEntry{{ID: 1, Actor: "alice", Action: "POST /aggregate", Status: http.StatusAccepted}}}
+			s := &Server{l: logger, db: &mockDB{}, audit: audit}
+			if tt.unconfigured {
+				s.audit = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/audit"+tt.query, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			if audit.filter != tt.expectFilter || !strings.Contains(rr.Body.String(), `"entries":[{"id":1`) {
+				t.Fatalf("unexpected filter %+v and body %s", audit.filter, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+const (
+	// maxBatchEvents bounds the events of a POST /events/batch request.
+	maxBatchEvents = 1000
+	// maxDedupeKeyLength bounds the dedupe keys chosen by senders.
+	maxDedupeKeyLength = 200
+)
+
+// BatchEvent is an event of POST /events/batch. Senders forwarding events
+// stored elsewhere keep their original time in CreatedAt and set DedupeKey,
+// so that sending the same batch again does not count the events twice.
+type BatchEvent struct {
+	ingest.Event
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	DedupeKey string     `json:"dedupe_key,omitempty"`
+}
+
+type BatchEventsRequest struct {
+	Events []BatchEvent `json:"events"`
+}
+
+func (r BatchEventsRequest) Validate() error {
+	if len(r.Events) == 0 || len(r.Events) > maxBatchEvents {
+		return ingest.NewFieldError("events", "out_of_range", fmt.Sprintf("events must hold between 1 and %d events", maxBatchEvents))
+	}
+	for i, e := range r.Events {
+		if err := e.Validate(); err != nil {
+			return fmt.Errorf("events[%d]: %w", i, ingest.NestField(err, fmt.Sprintf("events[%d]", i)))
+		}
+		if len(e.DedupeKey) > maxDedupeKeyLength {
+			err := ingest.NewFieldError("dedupe_key", "too_long", fmt.Sprintf("dedupe_key must be at most %d bytes", maxDedupeKeyLength))
+			return fmt.Errorf("events[%d]: %w", i, ingest.NestField(err, fmt.Sprintf("events[%d]", i)))
+		}
+	}
+	return nil
+}
+
+// BatchEventsHandler stores a batch of events synchronously, bypassing the
+// write-behind queue, so that a 200 means every event is stored. Events
+// whose dedupe key was already stored are skipped. When a federation token
+// is configured it is required as a bearer token, and the events are stored
+// in their project_id, as forwarded by the edges, rather than in the project
+// of the request.
+func (s *Server) BatchEventsHandler(c *gin.Context) {
+	federated := s.federationToken != ""
+	if federated {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.federationToken)) != 1 {
+			abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, "missing or invalid federation token")
+			return
+		}
+	}
+
+	var req BatchEventsRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	// Device clocks can be wrong: timestamps far in the future are rejected
+	// or clamped, late ones are stored and reported
+	now := time.Now()
+	var late int
+	var oldest time.Time
+	for i, e := range req.Events {
+		if e.CreatedAt == nil {
+			continue
+		}
+		t, isLate, err := ingest.AdjustCreatedAt(*e.CreatedAt, now)
+		if err != nil {
+			abortWithInvalid(c, fmt.Errorf("events[%d]: created_at: %w", i, ingest.NestField(err, fmt.Sprintf("events[%d]", i))))
+			return
+		}
+		if isLate {
+			late++
+			if oldest.IsZero() || t.Before(oldest) {
+				oldest = t
+			}
+		}
+		req.Events[i].CreatedAt = &t
+	}
+	if late > 0 {
+		s.l.Warn("late events in batch", "events", late, "oldest", oldest, "project_id", projectID(c))
+	}
+
+	projectIDs := make([]int64, len(req.Events))
+	userIDs := make([]int64, len(req.Events))
+	for i, e := range req.Events {
+		projectIDs[i], userIDs[i] = projectID(c), e.UserID
+		if federated && e.ProjectID != 0 {
+			projectIDs[i] = e.ProjectID
+		}
+	}
+	if !s.checkProjectUsers(c, projectIDs, userIDs) {
+		return
+	}
+
+	if !s.reserve(c, quota.Events, int64(len(req.Events))) {
+		return
+	}
+
+	events := make([]database.NewEvent, len(req.Events))
+	for i, e := range req.Events {
+		events[i] = database.NewEvent{ProjectID: projectIDs[i], UserID: e.UserID, Action: e.Action, Metadata: e.Metadata, DedupeKey: e.DedupeKey, TTL: e.TTL(), SchemaVersion: e.SchemaVersion}
+		if e.CreatedAt != nil {
+			events[i].CreatedAt = *e.CreatedAt
+		}
+	}
+	if err := s.db.InsertEvents(c.Request.Context(), events); err != nil {
+		s.release(c, quota.Events, int64(len(events)))
+		s.l.Error("failed to insert event batch", "events", len(events), "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to insert events")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": len(events)})
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+func TestBatchEventsHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	tooMany := `{"events":[` + strings.Repeat(`{"user_id":1,"action":"view"},`, maxBatchEvents) + `{"user_id":1,"action":"view"}]}`
+
+	tests := []struct {
+		name           string
+		token          string
+		auth           string
+		body           string
+		insertErr      error
+		expectedStatus int
+		expectBatch    int
+		expectProject  int64
+	}{
+		{
+			name:           "forwarded events",
+			body:           `{"events":[{"user_id":7,"action":"view","metadata":{"page":"/docs"},"created_at":"2025-01-01T10:00:00Z","dedupe_key":"edge-1:41"},{"user_id":8,"action":"click"}]}`,
+			expectedStatus: http.StatusOK,
+			expectBatch:    2,
+		},
+		{name: "token required", token: "secret", body: `{"events":[{"user_id":7,"action":"view"}]}`, expectedStatus: http.StatusUnauthorized},
+		{name: "token given", token: "secret", auth: "Bearer secret", body: `{"events":[{"user_id":7,"action":"view"}]}`, expectedStatus: http.StatusOK, expectBatch: 1, expectProject: 1},
+		{name: "project kept with the token", token: "secret", auth: "Bearer secret", body: `{"events":[{"project_id":3,"user_id":7,"action":"view","ttl_seconds":60,"schema_version":2}]}`, expectedStatus: http.StatusOK, expectBatch: 1, expectProject: 3},
+		{name: "project ignored without a token", body: `{"events":[{"project_id":3,"user_id":7,"action":"view"}]}`, expectedStatus: http.StatusOK, expectBatch: 1, expectProject: 1},
+		{name: "empty batch", body: `{"events":[]}`, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "too many events", body: tooMany, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "invalid event", body: `{"events":[{"user_id":7,"action":"view"},{"user_id":0,"action":"view"}]}`, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "malformed", body: `{"events":`, expectedStatus: http.StatusBadRequest},
+		{name: "database down", body: `{"events":[{"user_id":7,"action":"view"}]}`, insertErr: fmt.Errorf("db down"), expectedStatus: http.StatusInternalServerError, expectBatch: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{insertErr: tt.insertErr}
+			s := &Server{l: logger, db: db, federationToken: tt.token}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events/batch", s.BatchEventsHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/events/batch", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if len(db.lastBatch) != tt.expectBatch {
+				t.Fatalf("expected %d events inserted got %d", tt.expectBatch, len(db.lastBatch))
+			}
+			if tt.expectProject != 0 && db.lastBatch[0].ProjectID != tt.expectProject {
+				t.Fatalf("expected project %d got %d", tt.expectProject, db.lastBatch[0].ProjectID)
+			}
+			if tt.name == "project kept with the token" && (db.lastBatch[0].TTL != time.Minute || db.lastBatch[0].SchemaVersion != 2) {
+				t.Fatalf("unexpected event %+v", db.lastBatch[0])
+			}
+			if tt.name == "forwarded events" {
+				e := db.lastBatch[0]
+				if e.DedupeKey != "edge-1:41" || !e.CreatedAt.Equal(time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)) || e.Metadata["page"] != "/docs" {
+					t.Fatalf("unexpected event %+v", e)
+				}
+				if !db.lastBatch[1].CreatedAt.IsZero() || !strings.Contains(rr.Body.String(), `"received":2`) {
+					t.Fatalf("unexpected second event %+v or body %s", db.lastBatch[1], rr.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestBatchClockSkew(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	body := `{"events":[{"user_id":7,"action":"view","created_at":"2025-01-01T10:00:00Z"},{"user_id":7,"action":"view","created_at":"` + future + `"}]}`
+
+	for _, clamp := range []bool{false, true} {
+		rules, err := ingest.NewRules(config.ValidationConfig{MaxFutureSkewSeconds: 300, ClampFutureTimestamps: clamp, LateEventSeconds: 86400})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ingest.SetRules(rules)
+		t.Cleanup(func() { ingest.SetRules(nil) })
+
+		db := &mockDB{}
+		s := &Server{l: logger, db: db}
+		gin.SetMode(gin.TestMode)
+		router := gin.New()
+		router.POST("/events/batch", s.BatchEventsHandler)
+
+		req := httptest.NewRequest(http.MethodPost, "/events/batch", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if !clamp {
+			if rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "events[1]: created_at: timestamp too far in the future") || db.lastBatch != nil {
+				t.Fatalf("expected the future event to be rejected, got %d: %s", rr.Code, rr.Body.String())
+			}
+			continue
+		}
+		if rr.Code != http.StatusOK || len(db.lastBatch) != 2 {
+			t.Fatalf("expected the batch to be stored, got %d: %s", rr.Code, rr.Body.String())
+		}
+		// The late event keeps its time, the future one gets the server's
+		if !db.lastBatch[0].CreatedAt.Equal(time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)) || time.Since(db.lastBatch[1].CreatedAt) > time.Minute {
+			t.Fatalf("unexpected timestamps %v and %v", db.lastBatch[0].CreatedAt, db.lastBatch[1].CreatedAt)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// transparentGIF is a 1x1 transparent GIF image.
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// maxBeaconBytes bounds the body of POST /beacon.
+const maxBeaconBytes = 64 << 10
+
+// beaconEvent builds an event from query or form values. Parameters other
+// than user_id, action and api_key (e.g. page) become metadata, except the
+// ones starting with an underscore, which are left for cache busting.
+func beaconEvent(values url.Values) (ingest.Event, error) {
+	var e ingest.Event
+	if v := values.Get("user_id"); v != "" {
+		uid, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return ingest.Event{}, fmt.Errorf("user_id must be an integer")
+		}
+		e.UserID = uid
+	}
+	e.Action = values.Get("action")
+	for key, vs := range values {
+		if key == "user_id" || key == "action" || key == "api_key" || strings.HasPrefix(key, "_") || len(vs) == 0 {
+			continue
+		}
+		if e.Metadata == nil {
+			e.Metadata = make(map[string]string)
+		}
+		e.Metadata[key] = vs[0]
+	}
+	return e, e.Validate()
+}
+
+// BeaconGIFHandler records the event described by the query string and
+// answers with a 1x1 GIF, so that it can be used as an <img> tracking pixel.
+func (s *Server) BeaconGIFHandler(c *gin.Context) {
+	e, err := beaconEvent(c.Request.URL.Query())
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if _, ok := s.storeEvent(c, e); !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-store, max-age=0")
+	c.Data(http.StatusOK, "image/gif", transparentGIF)
+}
+
+// BeaconHandler records an event sent with navigator.sendBeacon. The body is
+// either a form with the parameters of /beacon.gif or a POST /events JSON
+// body; the JSON is read whatever the content type, since sendBeacon sends
+// strings as text/plain to avoid a CORS preflight.
+func (s *Server) BeaconHandler(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBeaconBytes)
+
+	var e ingest.Event
+	switch c.ContentType() {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := c.Request.ParseMultipartForm(maxBeaconBytes); err != nil && err != http.ErrNotMultipart {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		var err error
+		if e, err = beaconEvent(c.Request.PostForm); err != nil {
+			abortWithInvalid(c, err)
+			return
+		}
+	default:
+		data, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if s.strictJSONFor(c) {
+			if err := checkUnknownFields(data, &e); err != nil {
+				abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+				return
+			}
+		}
+		if err := json.Unmarshal(data, &e); err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if err := e.Validate(); err != nil {
+			abortWithInvalid(c, err)
+			return
+		}
+	}
+
+	if _, ok := s.storeEvent(c, e); !ok {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBeaconHandlers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		contentType    string
+		body           string
+		insertErr      error
+		expectedStatus int
+		expectInsert   bool
+		expectMeta     map[string]string
+	}{
+		{
+			name:           "pixel",
+			method:         http.MethodGet,
+			path:           "/beacon.gif?user_id=7&action=view&page=%2Fpricing&_=1700000000",
+			expectedStatus: http.StatusOK,
+			expectInsert:   true,
+			expectMeta:     map[string]string{"page": "/pricing"},
+		},
+		{name: "pixel without action", method: http.MethodGet, path: "/beacon.gif?user_id=7", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "pixel with a bad user_id", method: http.MethodGet, path: "/beacon.gif?user_id=x&action=view", expectedStatus: http.StatusBadRequest},
+		{name: "pixel while the database is down", method: http.MethodGet, path: "/beacon.gif?user_id=7&action=view", insertErr: fmt.Errorf("db down"), expectedStatus: http.StatusInternalServerError, expectInsert: true},
+		{
+			name:           "sendBeacon string",
+			method:         http.MethodPost,
+			path:           "/beacon",
+			contentType:    "text/plain;charset=UTF-8",
+			body:           `{"user_id":7,"action":"leave","metadata":{"page":"/docs"}}`,
+			expectedStatus: http.StatusNoContent,
+			expectInsert:   true,
+			expectMeta:     map[string]string{"page": "/docs"},
+		},
+		{
+			name:           "sendBeacon form",
+			method:         http.MethodPost,
+			path:           "/beacon",
+			contentType:    "application/x-www-form-urlencoded",
+			body:           "user_id=7&action=leave&page=%2Fdocs",
+			expectedStatus: http.StatusNoContent,
+			expectInsert:   true,
+			expectMeta:     map[string]string{"page": "/docs"},
+		},
+		{name: "sendBeacon malformed", method: http.MethodPost, path: "/beacon", contentType: "text/plain", body: "{", expectedStatus: http.StatusBadRequest},
+		{name: "sendBeacon invalid", method: http.MethodPost, path: "/beacon", contentType: "text/plain", body: `{"user_id":0,"action":"leave"}`, expectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{insertErr: tt.insertErr}
+			s := &Server{l: logger, db: db}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/beacon.gif", s.BeaconGIFHandler)
+			router.POST("/beacon", s.BeaconHandler)
+
+			req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader([]byte(tt.body)))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if db.insertCalled != tt.expectInsert {
+				t.Fatalf("expected insert called %v got %v", tt.expectInsert, db.insertCalled)
+			}
+			if tt.expectedStatus == http.StatusOK {
+				if ct := rr.Header().Get("Content-Type"); ct != "image/gif" || !strings.HasPrefix(rr.Body.String(), "GIF89a") {
+					t.Fatalf("expected a gif, got %q", ct)
+				}
+			}
+			if tt.expectMeta != nil {
+				if db.lastUserID != 7 || len(db.lastMeta) != len(tt.expectMeta) {
+					t.Fatalf("unexpected event %d %v", db.lastUserID, db.lastMeta)
+				}
+				for k, v := range tt.expectMeta {
+					if db.lastMeta[k] != v {
+						t.Fatalf("expected metadata %v got %v", tt.expectMeta, db.lastMeta)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+// bindJSON binds the JSON body into obj like ShouldBindJSON. In strict mode
+// a body holding fields obj does not declare is rejected, so that a client
+// sending userid instead of user_id gets an error instead of losing data.
+func (s *Server) bindJSON(c *gin.Context, obj any) error {
+	if !s.strictJSONFor(c) {
+		return c.ShouldBindJSON(obj)
+	}
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	if err := checkUnknownFields(body, obj); err != nil {
+		return err
+	}
+	return binding.JSON.BindBody(body, obj)
+}
+
+// checkUnknownFields returns an error listing every field of the JSON
+// document data that obj does not declare, with its path, e.g.
+// events[1].userid. A document that is not valid JSON is left to the
+// decoding to report.
+func checkUnknownFields(data []byte, obj any) error {
+	unknown := unknownFields(data, reflect.TypeOf(obj), "")
+	if len(unknown) == 0 {
+		return nil
+	}
+	return fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+func unknownFields(data []byte, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// Types decoding themselves accept what they like
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(data, &object) != nil {
+			return nil
+		}
+		keys := make([]string, 0, len(object))
+		for k := range object {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		fields := jsonFields(t)
+		var unknown []string
+		for _, k := range keys {
+			name := k
+			if path != "" {
+				name = path + "." + k
+			}
+			field, ok := lookupField(fields, k)
+			if !ok {
+				unknown = append(unknown, name)
+				continue
+			}
+			unknown = append(unknown, unknownFields(object[k], field, name)...)
+		}
+		return unknown
+
+	case reflect.Slice, reflect.Array:
+		var items []json.RawMessage
+		if json.Unmarshal(data, &items) != nil {
+			return nil
+		}
+		var unknown []string
+		for i, item := range items {
+			unknown = append(unknown, unknownFields(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+		return unknown
+	}
+	return nil
+}
+
+// jsonFields returns the types of the fields of the struct type t by JSON
+// name, including the promoted fields of embedded structs.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				for k, v := range jsonFields(embedded) {
+					if _, ok := fields[k]; !ok {
+						fields[k] = v
+					}
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// lookupField finds the field of a JSON key the way encoding/json does: an
+// exact match first, then a case-insensitive one.
+func lookupField(fields map[string]reflect.Type, key string) (reflect.Type, bool) {
+	if t, ok := fields[key]; ok {
+		return t, true
+	}
+	for name, t := range fields {
+		if strings.EqualFold(name, key) {
+			return t, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+)
+
+func TestStrictJSON(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		strict         bool
+		strictFlag     bool
+		path           string
+		body           string
+		expectedStatus int
+		expectDetail   string
+	}{
+		{name: "unknown field ignored", path: "/events", body: `{"user_id":1,"action":"view","referer":"x"}`, expectedStatus: http.StatusCreated},
+		{name: "known fields", strict: true, path: "/events", body: `{"user_id":1,"action":"view","metadata":{"anything":"goes"}}`, expectedStatus: http.StatusCreated},
+		{name: "field names are case-insensitive", strict: true, path: "/events", body: `{"User_ID":1,"action":"view"}`, expectedStatus: http.StatusCreated},
+		{name: "every unknown field listed", strict: true, path: "/events", body: `{"userid":1,"action":"view","referer":"x"}`, expectedStatus: http.StatusBadRequest, expectDetail: "unknown fields: referer, userid"},
+		{name: "nested unknown fields", strict: true, path: "/events/batch", body: `{"events":[{"user_id":1,"action":"view","created_at":"2025-01-01T10:00:00Z"},{"user_id":1,"action":"view","dedupekey":"a"}]}`, expectedStatus: http.StatusBadRequest, expectDetail: "unknown fields: events[1].dedupekey"},
+		{name: "unknown field rejected by the flag", strictFlag: true, path: "/events", body: `{"userid":1,"action":"view"}`, expectedStatus: http.StatusBadRequest, expectDetail: "unknown fields: userid"},
+		{name: "beacon", strict: true, path: "/beacon", body: `{"user_id":1,"acton":"view"}`, expectedStatus: http.StatusBadRequest, expectDetail: "unknown fields: acton"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{insertID: 1}, strictJSON: tt.strict, flags: &fakeFlags{enabled: map[string]bool{flags.StrictValidation: tt.strictFlag}}}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.AddEventHandler)
+			router.POST("/events/batch", s.BatchEventsHandler)
+			router.POST("/beacon", s.BeaconHandler)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectDetail == "" {
+				return
+			}
+			var p Problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Detail != tt.expectDetail {
+				t.Fatalf("expected detail %q got %q", tt.expectDetail, p.Detail)
+			}
+			assertProblem(t, rr, CodeInvalidRequest)
+		})
+	}
+}
+
+// BenchmarkBindJSON decodes POST /events bodies; run it with -tags sonic or
+// -tags go_json to compare the JSON codecs.
+func BenchmarkBindJSON(b *testing.B) {
+	s := &Server{}
+	body := []byte(`{"user_id":42,"action":"view","metadata":{"page":"/pricing","referrer":"https://example.com/blog","campaign":"spring"}}`)
+	gin.SetMode(gin.TestMode)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body))
+		var req AddEventRequest
+		if err := s.bindJSON(c, &req); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
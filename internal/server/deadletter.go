@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/deadletter"
+)
+
+// DeadLetters is the store of batches that could not be inserted, operated
+// through the admin listener.
+type DeadLetters interface {
+	List() ([]deadletter.Entry, error)
+	Get(id string) (deadletter.Entry, error)
+	Retry(ctx context.Context, id string) error
+	Discard(id string) error
+}
+
+// requireDeadLetters answers 404 when no dead-letter store is configured.
+func (s *Server) requireDeadLetters(c *gin.Context) bool {
+	if s.deadLetters == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "dead-letter store is not configured")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithDeadLetterError(c *gin.Context, err error) {
+	if errors.Is(err, deadletter.ErrNotFound) {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	s.l.Error("dead-letter operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithProblem(c, http.StatusInternalServerError, CodeInternal, err.Error())
+}
+
+// ListDeadLettersHandler lists the dead-lettered batches without their events.
+func (s *Server) ListDeadLettersHandler(c *gin.Context) {
+	if !s.requireDeadLetters(c) {
+		return
+	}
+	entries, err := s.deadLetters.List()
+	if err != nil {
+		s.abortWithDeadLetterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
+
+func (s *Server) GetDeadLetterHandler(c *gin.Context) {
+	if !s.requireDeadLetters(c) {
+		return
+	}
+	e, err := s.deadLetters.Get(c.Param("id"))
+	if err != nil {
+		s.abortWithDeadLetterError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, e)
+}
+
+// RetryDeadLetterHandler inserts the events of a batch and removes it.
+func (s *Server) RetryDeadLetterHandler(c *gin.Context) {
+	if !s.requireDeadLetters(c) {
+		return
+	}
+	id := c.Param("id")
+	if _, err := s.deadLetters.Get(id); err != nil {
+		s.abortWithDeadLetterError(c, err)
+		return
+	}
+	if err := s.deadLetters.Retry(c.Request.Context(), id); err != nil {
+		s.l.Error("dead-letter retry failed", "id", id, "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to insert dead-lettered events")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// DiscardDeadLetterHandler removes a batch without storing it.
+func (s *Server) DiscardDeadLetterHandler(c *gin.Context) {
+	if !s.requireDeadLetters(c) {
+		return
+	}
+	if err := s.deadLetters.Discard(c.Param("id")); err != nil {
+		s.abortWithDeadLetterError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/deadletter"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+type fakeDeadLetters struct {
+	entries  map[string]deadletter.Entry
+	retryErr error
+}
+
+func (f *fakeDeadLetters) List() ([]deadletter.Entry, error) {
+	var out []deadletter.Entry
+	for _, e := range f.entries {
+		e.Events = nil
+		out = append(out, e)
+	}
+	return out, nil
+}
+func (f *fakeDeadLetters) Get(id string) (deadletter.Entry, error) {
+	e, ok := f.entries[id]
+	if !ok {
+		return deadletter.Entry{}, deadletter.ErrNotFound
+	}
+	return e, nil
+}
+func (f *fakeDeadLetters) Retry(ctx context.Context, id string) error {
+	if f.retryErr != nil {
+		return f.retryErr
+	}
+	delete(f.entries, id)
+	return nil
+}
+func (f *fakeDeadLetters) Discard(id string) error {
+	if _, ok := f.entries[id]; !ok {
+		return deadletter.ErrNotFound
+	}
+	delete(f.entries, id)
+	return nil
+}
+
+func TestDeadLetterRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		retryErr       error
+		method         string
+		path           string
+		expectedStatus int
+		expectBody     string
+		expectLeft     int
+	}{
+		{name: "list", method: http.MethodGet, path: "/deadletter", expectedStatus: http.StatusOK, expectBody: `"count":2`, expectLeft: 1},
+		{name: "get", method: http.MethodGet, path: "/deadletter/1", expectedStatus: http.StatusOK, expectBody: `"action":"click"`, expectLeft: 1},
+		{name: "get unknown", method: http.MethodGet, path: "/deadletter/2", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectLeft: 1},
+		{name: "retry", method: http.MethodPost, path: "/deadletter/1/retry", expectedStatus: http.StatusNoContent},
+		{name: "retry while the database is down", retryErr: fmt.Errorf("db down"), method: http.MethodPost, path: "/deadletter/1/retry", expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable, expectLeft: 1},
+		{name: "retry unknown", method: http.MethodPost, path: "/deadletter/2/retry", expectedStatus: http.StatusNotFound, expectLeft: 1},
+		{name: "discard", method: http.MethodDelete, path: "/deadletter/1", expectedStatus: http.StatusNoContent},
+		{name: "not configured", unconfigured: true, method: http.MethodGet, path: "/deadletter", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := &fakeDeadLetters{
+				entries: map[string]deadletter.Entry{
+					"1": {ID: "1", Source: "http", Count: 2, Events: []deadletter.Event{{Event: ingest.Event{UserID: 1, Action: "click"}}, {Event: ingest.Event{UserID: 2, Action: "view"}}}},
+				},
+				retryErr: tt.retryErr,
+			}
+			s := &Server{l: logger, db: &mockDB{}, deadLetters: dl}
+			if tt.unconfigured {
+				s.deadLetters = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if !tt.unconfigured && len(dl.entries) != tt.expectLeft {
+				t.Fatalf("expected %d entries left got %d", tt.expectLeft, len(dl.entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/recorder"
+)
+
+// RequestRecorder keeps sanitized copies of the requests of the public API,
+// such as a recorder.Recorder.
+type RequestRecorder interface {
+	MaxBodyBytes() int
+	Record(req *http.Request, body []byte, truncated bool, status int, requestID string) error
+	List(limit int) []recorder.Request
+	Get(id int64) (recorder.Request, bool)
+}
+
+const (
+	defaultRecordedLimit = 100
+	// maxReplayBody bounds the response body returned by a replay
+	maxReplayBody = 1 << 20
+)
+
+// replayedKey marks the requests replayed from the admin listener in their
+// context, so that they are not recorded again.
+type replayedKey struct{}
+
+// RecordMiddleware records the requests of the public API with the status
+// they were answered with. The body is read up to the limit of the
+// recorder and handed to the handlers whole.
+func (s *Server) RecordMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.recorder == nil || c.Request.Context().Value(replayedKey{}) != nil {
+			c.Next()
+			return
+		}
+
+		var body []byte
+		var truncated bool
+		if c.Request.Body != nil {
+			limit := s.recorder.MaxBodyBytes()
+			body, _ = io.ReadAll(io.LimitReader(c.Request.Body, int64(limit)+1))
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), c.Request.Body), c.Request.Body}
+			if len(body) > limit {
+				body, truncated = body[:limit], true
+			}
+		}
+
+		c.Next()
+
+		requestID := c.Writer.Header().Get(RequestIDHeader)
+		if err := s.recorder.Record(c.Request, body, truncated, c.Writer.Status(), requestID); err != nil {
+			s.l.Error("failed to record request", "request_id", requestID, "error", err)
+		}
+	}
+}
+
+// requireRecorder answers 404 when the requests are not recorded.
+func (s *Server) requireRecorder(c *gin.Context) bool {
+	if s.recorder == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "request recording is not configured")
+		return false
+	}
+	return true
+}
+
+// ListRecordedRequestsHandler lists the recorded requests kept in memory,
+// newest first.
+func (s *Server) ListRecordedRequestsHandler(c *gin.Context) {
+	if !s.requireRecorder(c) {
+		return
+	}
+	limit := defaultRecordedLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be an integer")
+			return
+		}
+		if n < 1 {
+			abortWithInvalid(c, ingest.NewFieldError("limit", "out_of_range", "limit must be a positive integer"))
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, gin.H{"requests": s.recorder.List(limit)})
+}
+
+func (s *Server) GetRecordedRequestHandler(c *gin.Context) {
+	if req, ok := s.lookupRecordedRequest(c); ok {
+		c.JSON(http.StatusOK, req)
+	}
+}
+
+// ReplayRecordOptions overrides the headers of a replayed request, e.g. the
+// Authorization redacted when it was recorded.
+type ReplayRecordOptions struct {
+	Headers map[string]string `json:"headers"`
+}
+
+// ReplayRecordRequest replays a request given in full, e.g. a line of the
+// recording file.
+type ReplayRecordRequest struct {
+	ReplayRecordOptions
+	Request *recorder.Request `json:"request" binding:"required"`
+}
+
+// ReplayRecordedRequestHandler serves a recorded request again and answers
+// with the response of the public API.
+func (s *Server) ReplayRecordedRequestHandler(c *gin.Context) {
+	req, ok := s.lookupRecordedRequest(c)
+	if !ok {
+		return
+	}
+	var opts ReplayRecordOptions
+	if c.Request.ContentLength != 0 {
+		if err := s.bindJSON(c, &opts); err != nil {
+			abortWithInvalid(c, err)
+			return
+		}
+	}
+	s.replay(c, req, opts)
+}
+
+// ReplayRequestHandler serves the request of the body and answers with the
+// response of the public API.
+func (s *Server) ReplayRequestHandler(c *gin.Context) {
+	if !s.requireRecorder(c) {
+		return
+	}
+	var req ReplayRecordRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if req.Request.Method == "" || !strings.HasPrefix(req.Request.URL, "/") {
+		abortWithInvalid(c, ingest.NewFieldError("request", "invalid", "request needs a method and a url starting with /"))
+		return
+	}
+	s.replay(c, *req.Request, req.ReplayRecordOptions)
+}
+
+// replay serves rec with the handler of the public API, without the
+// headers redacted when it was recorded unless opts sets them. A request
+// whose credentials were redacted is refused unless opts sets new ones, as
+// it would run in the default project or be rejected.
+func (s *Server) replay(c *gin.Context, rec recorder.Request, opts ReplayRecordOptions) {
+	if s.replayTarget == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "request replay is not configured")
+		return
+	}
+	if missing := redactedCredentials(rec, opts); len(missing) > 0 {
+		abortWithInvalid(c, ingest.NewFieldError("headers", "required",
+			fmt.Sprintf("the credentials of the request were redacted (%s), give them in headers", strings.Join(missing, ", "))))
+		return
+	}
+	body, err := rec.BodyBytes()
+	if err != nil {
+		abortWithInvalid(c, ingest.NewFieldError("request.body", "invalid", "body is not valid base64"))
+		return
+	}
+	ctx := context.WithValue(c.Request.Context(), replayedKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, rec.Method, rec.URL, bytes.NewReader(body))
+	if err != nil {
+		abortWithInvalid(c, ingest.NewFieldError("request", "invalid", err.Error()))
+		return
+	}
+	for k, v := range rec.Headers {
+		if v != recorder.Redacted {
+			req.Header.Set(k, v)
+		}
+	}
+	for k, v := range opts.Headers {
+		req.Header.Set(k, v)
+	}
+	req.RemoteAddr = c.Request.RemoteAddr
+
+	rr := httptest.NewRecorder()
+	s.replayTarget.ServeHTTP(rr, req)
+	s.l.Info("request replayed", "method", rec.Method, "url", rec.URL, "recorded_id", rec.ID, "status", rr.Code)
+
+	headers := make(map[string]string, len(rr.Header()))
+	for k, v := range rr.Header() {
+		headers[k] = strings.Join(v, ", ")
+	}
+	respBody := rr.Body.Bytes()
+	truncated := len(respBody) > maxReplayBody
+	if truncated {
+		respBody = respBody[:maxReplayBody]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"status":    rr.Code,
+		"headers":   headers,
+		"body":      string(respBody),
+		"truncated": truncated,
+	})
+}
+
+// credentialHeaders carry the keys the public API authenticates with.
+var credentialHeaders = []string{"Authorization", APIKeyHeader}
+
+// redactedCredentials returns the headers and the api_key query parameter of
+// rec redacted when it was recorded that opts does not set again.
+func redactedCredentials(rec recorder.Request, opts ReplayRecordOptions) []string {
+	given := func(name string) bool {
+		for k := range opts.Headers {
+			if strings.EqualFold(k, name) {
+				return true
+			}
+		}
+		return false
+	}
+	var missing []string
+	for k, v := range rec.Headers {
+		if v == recorder.Redacted && slices.ContainsFunc(credentialHeaders, func(h string) bool { return strings.EqualFold(k, h) }) && !given(k) {
+			missing = append(missing, k)
+		}
+	}
+	slices.Sort(missing)
+	if u, err := url.Parse(rec.URL); err == nil && u.Query().Get("api_key") == recorder.Redacted && !slices.ContainsFunc(credentialHeaders, given) {
+		missing = append(missing, "api_key")
+	}
+	return missing
+}
+
+// lookupRecordedRequest answers the errors itself and reports whether the
+// request of the id parameter is still kept.
+func (s *Server) lookupRecordedRequest(c *gin.Context) (recorder.Request, bool) {
+	if !s.requireRecorder(c) {
+		return recorder.Request{}, false
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "request id must be an integer")
+		return recorder.Request{}, false
+	}
+	req, ok := s.recorder.Get(id)
+	if !ok {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, fmt.Sprintf("request %d is not kept anymore", id))
+		return recorder.Request{}, false
+	}
+	return req, true
+}
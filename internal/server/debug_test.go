@@ -0,0 +1,109 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/recorder"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec, err := recorder.New(config.DebugConfig{RecordRequests: 10, RecordMaxBodyKB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The public API echoes the body and whether it was authorized
+	s := &Server{l: logger, db: &mockDB{}, recorder: rec}
+	gin.SetMode(gin.TestMode)
+	api := gin.New()
+	api.Use(s.RecordMiddleware())
+	api.POST("/api/events", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		if c.GetHeader("Authorization") == "" && c.GetHeader(APIKeyHeader) == "" {
+			c.String(http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		c.String(http.StatusCreated, "%s", body)
+	})
+	s.replayTarget = api
+
+	req := httptest.NewRequest(http.MethodPost, "/api/events", strings.NewReader(`{"action":"login","token":"abc"}`))
+	req.Header.Set("Authorization", "Bearer sek_123")
+	rr := httptest.NewRecorder()
+	api.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated || rr.Body.String() != `{"action":"login","token":"abc"}` {
+		t.Fatalf("expected the handler to get the whole body, got %d %s", rr.Code, rr.Body.String())
+	}
+	// Requests authenticated with an API key, in a header and in the query
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodPost, "/api/events", strings.NewReader(`{}`)),
+		httptest.NewRequest(http.MethodPost, "/api/events?api_key=k_123", strings.NewReader(`{}`)),
+	} {
+		if req.URL.RawQuery == "" {
+			req.Header.Set(APIKeyHeader, "k_123")
+		}
+		api.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	admin := s.RegisterAdminRoutes()
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "list", method: http.MethodGet, path: "/debug/requests", expectedStatus: http.StatusOK, expectBody: `"status":201`},
+		{name: "list bad limit", method: http.MethodGet, path: "/debug/requests?limit=0", expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "get", method: http.MethodGet, path: "/debug/requests/1", expectedStatus: http.StatusOK, expectBody: `"Authorization":"[redacted]"`},
+		{name: "get unknown", method: http.MethodGet, path: "/debug/requests/9", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{name: "get bad id", method: http.MethodGet, path: "/debug/requests/x", expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{name: "replay without the redacted header", method: http.MethodPost, path: "/debug/requests/1/replay", expectedStatus: http.StatusUnprocessableEntity, expectBody: "Authorization"},
+		{name: "replay with a header", method: http.MethodPost, path: "/debug/requests/1/replay", body: `{"headers":{"Authorization":"Bearer sek_123"}}`, expectedStatus: http.StatusOK, expectBody: `"status":201`},
+		{name: "replay without the redacted API key", method: http.MethodPost, path: "/debug/requests/2/replay", expectedStatus: http.StatusUnprocessableEntity, expectBody: "X-Api-Key"},
+		{name: "replay with another header than the API key", method: http.MethodPost, path: "/debug/requests/2/replay", body: `{"headers":{"Content-Type":"application/json"}}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: "X-Api-Key"},
+		{name: "replay with an API key", method: http.MethodPost, path: "/debug/requests/2/replay", body: `{"headers":{"X-API-Key":"k_test"}}`, expectedStatus: http.StatusOK, expectBody: `"status":201`},
+		{name: "replay without the redacted api_key query", method: http.MethodPost, path: "/debug/requests/3/replay", expectedStatus: http.StatusUnprocessableEntity, expectBody: "api_key"},
+		{name: "replay the api_key query with an API key", method: http.MethodPost, path: "/debug/requests/3/replay", body: `{"headers":{"X-API-Key":"k_test"}}`, expectedStatus: http.StatusOK, expectBody: `"status":201`},
+		{name: "replay a given request", method: http.MethodPost, path: "/debug/requests/replay", body: `{"request":{"method":"POST","url":"/api/events","body":"{}"},"headers":{"Authorization":"Bearer sek_123"}}`, expectedStatus: http.StatusOK, expectBody: `"body":"{}"`},
+		{name: "replay a request without url", method: http.MethodPost, path: "/debug/requests/replay", body: `{"request":{"method":"POST"}}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			admin.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+		})
+	}
+
+	// Replays are not recorded again
+	if got := rec.List(10); len(got) != 3 {
+		t.Fatalf("expected only the original requests to be recorded, got %d", len(got))
+	}
+
+	s.recorder = nil
+	rr = httptest.NewRecorder()
+	s.RegisterAdminRoutes().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/requests", nil))
+	if rr.Code != http.StatusNotFound || !strings.Contains(rr.Body.String(), "not configured") {
+		t.Fatalf("expected 404 without a recorder, got %d %s", rr.Code, rr.Body.String())
+	}
+}
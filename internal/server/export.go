@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/export"
+)
+
+// Exports runs the exports of events to object storage, operated through
+// the admin listener.
+type Exports interface {
+	Submit(from, to time.Time, force bool) (export.Run, error)
+	Get(id string) (export.Run, error)
+	List() []export.Run
+}
+
+// ExportRequest selects the windows to export. The range is widened to
+// window boundaries.
+type ExportRequest struct {
+	From  time.Time `json:"from" binding:"required"`
+	To    time.Time `json:"to" binding:"required"`
+	Force bool      `json:"force"`
+}
+
+// requireExports answers 404 when the export is not configured.
+func (s *Server) requireExports(c *gin.Context) bool {
+	if s.exports == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "export is not configured")
+		return false
+	}
+	return true
+}
+
+// CreateExportHandler queues an export run and answers 202 with it.
+func (s *Server) CreateExportHandler(c *gin.Context) {
+	if !s.requireExports(c) {
+		return
+	}
+	var req ExportRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+
+	run, err := s.exports.Submit(req.From, req.To, req.Force)
+	switch {
+	case errors.Is(err, export.ErrInvalidRange):
+		abortWithFieldErrors(c, CodeValidationFailed, err.Error(), []FieldError{{Code: "out_of_range", Message: err.Error()}})
+		return
+	case errors.Is(err, export.ErrBusy), errors.Is(err, export.ErrClosed):
+		c.Header("Retry-After", "60")
+		abortWithProblem(c, http.StatusServiceUnavailable, CodeOverloaded, err.Error())
+		return
+	case err != nil:
+		s.l.Error("failed to submit export", "error", err)
+		_ = c.Error(err)
+		abortWithProblem(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+
+	c.Header("Location", path.Join(c.Request.URL.Path, run.ID))
+	c.JSON(http.StatusAccepted, run)
+}
+
+// ListExportsHandler lists the recent export runs, newest first.
+func (s *Server) ListExportsHandler(c *gin.Context) {
+	if !s.requireExports(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"runs": s.exports.List()})
+}
+
+func (s *Server) GetExportHandler(c *gin.Context) {
+	if !s.requireExports(c) {
+		return
+	}
+	run, err := s.exports.Get(c.Param("id"))
+	if err != nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
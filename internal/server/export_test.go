@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/export"
+)
+
+type fakeExports struct {
+	err  error
+	runs map[string]export.Run
+}
+
+func (f *fakeExports) Submit(from, to time.Time, force bool) (export.Run, error) {
+	if f.err != nil {
+		return export.Run{}, f.err
+	}
+	run := export.Run{ID: "2", Trigger: "api", From: from, To: to, Force: force, Status: export.RunQueued}
+	f.runs[run.ID] = run
+	return run, nil
+}
+func (f *fakeExports) Get(id string) (export.Run, error) {
+	run, ok := f.runs[id]
+	if !ok {
+		return export.Run{}, export.ErrNotFound
+	}
+	return run, nil
+}
+func (f *fakeExports) List() []export.Run {
+	var out []export.Run
+	for _, run := range f.runs {
+		out = append(out, run)
+	}
+	return out
+}
+
+func TestExportRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const body = `{"from":"2025-01-01T00:00:00Z","to":"2025-01-02T00:00:00Z"}`
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		submitErr      error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "submit", method: http.MethodPost, path: "/exports", body: body, expectedStatus: http.StatusAccepted, expectBody: `"status":"queued"`},
+		{name: "submit without range", method: http.MethodPost, path: "/exports", body: `{"force":true}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "submit an incomplete window", submitErr: fmt.Errorf("%w: not complete", export.ErrInvalidRange), method: http.MethodPost, path: "/exports", body: body, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "submit while busy", submitErr: export.ErrBusy, method: http.MethodPost, path: "/exports", body: body, expectedStatus: http.StatusServiceUnavailable, expectBody: CodeOverloaded},
+		{name: "list", method: http.MethodGet, path: "/exports", expectedStatus: http.StatusOK, expectBody: `"runs":[`},
+		{name: "get", method: http.MethodGet, path: "/exports/1", expectedStatus: http.StatusOK, expectBody: `"status":"succeeded"`},
+		{name: "get unknown", method: http.MethodGet, path: "/exports/3", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{name: "not configured", unconfigured: true, method: http.MethodGet, path: "/exports", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exports := &fakeExports{err: tt.submitErr, runs: map[string]export.Run{"1": {ID: "1", Status: export.RunSucceeded}}}
+			s := &Server{l: logger, db: &mockDB{}, exports: exports}
+			if tt.unconfigured {
+				s.exports = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusAccepted && rr.Header().Get("Location") != "/exports/2" {
+				t.Fatalf("unexpected location %q", rr.Header().Get("Location"))
+			}
+		})
+	}
+}
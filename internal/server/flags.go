@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// FeatureFlags tells which optional behaviors are enabled for a project,
+// and manages their overrides through the admin listener.
+type FeatureFlags interface {
+	Enabled(projectID int64, name string) bool
+	List(projectID int64) []flags.Flag
+	Set(ctx context.Context, f database.FeatureFlag) (database.FeatureFlag, error)
+	Delete(ctx context.Context, name string, projectID int64) error
+}
+
+// FeatureFlagRequest overrides a flag for a project, or for every project
+// without a project_id.
+type FeatureFlagRequest struct {
+	Enabled   *bool `json:"enabled" binding:"required"`
+	ProjectID int64 `json:"project_id"`
+}
+
+// flag reports whether the flag is enabled for the project of the request.
+func (s *Server) flag(c *gin.Context, name string) bool {
+	return s.flags != nil && s.flags.Enabled(projectID(c), name)
+}
+
+// strictJSONFor reports whether the JSON bodies of the request are rejected
+// when they hold unknown fields.
+func (s *Server) strictJSONFor(c *gin.Context) bool {
+	return s.strictJSON || s.flag(c, flags.StrictValidation)
+}
+
+// strictTimesFor reports whether the times of the request must be RFC3339
+// with a time zone.
+func (s *Server) strictTimesFor(c *gin.Context) bool {
+	return s.strictTimeParsing || s.flag(c, flags.StrictValidation)
+}
+
+// asyncIngest reports whether the events of the request go through the
+// queue. Without flags, every event does when a queue is set.
+func (s *Server) asyncIngest(c *gin.Context) bool {
+	return s.queue != nil && (s.flags == nil || s.flag(c, flags.AsyncIngest))
+}
+
+// requireFeatureFlags answers 404 when flags are not managed.
+func (s *Server) requireFeatureFlags(c *gin.Context) bool {
+	if s.flags == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "feature flags are not available")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithFeatureFlagError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, flags.ErrUnknownFlag), errors.Is(err, database.ErrFeatureFlagNotFound):
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case errors.Is(err, database.ErrProjectNotFound):
+		abortWithInvalid(c, ingest.NewFieldError("project_id", "not_found", err.Error()))
+		return
+	}
+	s.l.Error("feature flag operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access feature flags")
+}
+
+// ListFeatureFlagsHandler describes every flag, enabled or not for the
+// project of the project_id parameter, for every project without
+// overrides when missing.
+func (s *Server) ListFeatureFlagsHandler(c *gin.Context) {
+	if !s.requireFeatureFlags(c) {
+		return
+	}
+	id, err := projectIDQuery(c)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	var projectID int64
+	if id != nil {
+		projectID = *id
+	}
+	c.JSON(http.StatusOK, gin.H{"flags": s.flags.List(projectID)})
+}
+
+func (s *Server) SetFeatureFlagHandler(c *gin.Context) {
+	if !s.requireFeatureFlags(c) {
+		return
+	}
+	var req FeatureFlagRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if req.ProjectID < 0 {
+		abortWithInvalid(c, ingest.NewFieldError("project_id", "out_of_range", "project_id must be a positive integer"))
+		return
+	}
+	f, err := s.flags.Set(c.Request.Context(), database.FeatureFlag{Name: c.Param("name"), ProjectID: req.ProjectID, Enabled: *req.Enabled})
+	if err != nil {
+		s.abortWithFeatureFlagError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, f)
+}
+
+// DeleteFeatureFlagHandler removes the override of the project of the
+// project_id parameter, the global override when missing.
+func (s *Server) DeleteFeatureFlagHandler(c *gin.Context) {
+	if !s.requireFeatureFlags(c) {
+		return
+	}
+	id, err := projectIDQuery(c)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	var projectID int64
+	if id != nil {
+		projectID = *id
+	}
+	if err := s.flags.Delete(c.Request.Context(), c.Param("name"), projectID); err != nil {
+		s.abortWithFeatureFlagError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
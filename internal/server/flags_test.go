@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+)
+
+// fakeFlags enables the same flags for every project, and knows projects 1
+// and 2 only.
+type fakeFlags struct {
+	enabled   map[string]bool
+	overrides []database.FeatureFlag
+	err       error
+}
+
+func (f *fakeFlags) Enabled(projectID int64, name string) bool {
+	return f.enabled[name]
+}
+
+func (f *fakeFlags) List(projectID int64) []flags.Flag {
+	list := []flags.Flag{}
+	for _, name := range []string{flags.StrictValidation, flags.AsyncIngest, flags.ResponseEnvelope} {
+		list = append(list, flags.Flag{Name: name, Enabled: f.enabled[name], Overrides: f.overrides})
+	}
+	return list
+}
+
+func (f *fakeFlags) Set(ctx context.Context, flag database.FeatureFlag) (database.FeatureFlag, error) {
+	switch {
+	case f.err != nil:
+		return database.FeatureFlag{}, f.err
+	case !flags.Known(flag.Name):
+		return database.FeatureFlag{}, flags.ErrUnknownFlag
+	case flag.ProjectID > 2:
+		return database.FeatureFlag{}, database.ErrProjectNotFound
+	}
+	f.overrides = append(f.overrides, flag)
+	return flag, nil
+}
+
+func (f *fakeFlags) Delete(ctx context.Context, name string, projectID int64) error {
+	for i, o := range f.overrides {
+		if o.Name == name && o.ProjectID == projectID {
+			f.overrides = append(f.overrides[:i], f.overrides[i+1:]...)
+			return nil
+		}
+	}
+	return database.ErrFeatureFlagNotFound
+}
+
+func TestFeatureFlagRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name            string
+		unconfigured    bool
+		storeErr        error
+		method          string
+		path            string
+		body            string
+		expectedStatus  int
+		expectBody      string
+		expectOverrides int
+	}{
+		{name: "list", method: http.MethodGet, path: "/flags", expectedStatus: http.StatusOK, expectBody: `{"name":"strict_validation","enabled":true,"default":false,"overrides":[{"name":"async_ingest","project_id":2,"enabled":false`, expectOverrides: 1},
+		{name: "list for an invalid project", method: http.MethodGet, path: "/flags?project_id=0", expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"project_id"`, expectOverrides: 1},
+		{name: "set globally", method: http.MethodPut, path: "/flags/response_envelope", body: `{"enabled":true}`, expectedStatus: http.StatusOK, expectBody: `{"name":"response_envelope","enabled":true,`, expectOverrides: 2},
+		{name: "set for a project", method: http.MethodPut, path: "/flags/strict_validation", body: `{"enabled":false,"project_id":1}`, expectedStatus: http.StatusOK, expectBody: `"project_id":1`, expectOverrides: 2},
+		{name: "set for an unknown project", method: http.MethodPut, path: "/flags/strict_validation", body: `{"enabled":true,"project_id":3}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"project_id"`, expectOverrides: 1},
+		{name: "set without enabled", method: http.MethodPut, path: "/flags/strict_validation", body: `{"project_id":1}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"enabled"`, expectOverrides: 1},
+		{name: "set an unknown flag", method: http.MethodPut, path: "/flags/dark_mode", body: `{"enabled":true}`, expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectOverrides: 1},
+		{name: "set while the database is down", storeErr: errors.New("connection refused"), method: http.MethodPut, path: "/flags/strict_validation", body: `{"enabled":true}`, expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable, expectOverrides: 1},
+		{name: "delete", method: http.MethodDelete, path: "/flags/async_ingest?project_id=2", expectedStatus: http.StatusNoContent},
+		{name: "delete a missing override", method: http.MethodDelete, path: "/flags/async_ingest", expectedStatus: http.StatusNotFound, expectOverrides: 1},
+		{name: "not available", unconfigured: true, method: http.MethodGet, path: "/flags", expectedStatus: http.StatusNotFound, expectBody: "not available"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ff := &fakeFlags{
+				enabled:   map[string]bool{flags.StrictValidation: true},
+				overrides: []database.FeatureFlag{{Name: flags.AsyncIngest, ProjectID: 2, Enabled: false}},
+				err:       tt.storeErr,
+			}
+			s := &Server{l: logger, db: &mockDB{}, flags: ff}
+			if tt.unconfigured {
+				s.flags = nil
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/flags", s.ListFeatureFlagsHandler)
+			router.PUT("/flags/:name", s.SetFeatureFlagHandler)
+			router.DELETE("/flags/:name", s.DeleteFeatureFlagHandler)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if !tt.unconfigured && len(ff.overrides) != tt.expectOverrides {
+				t.Fatalf("expected %d overrides got %+v", tt.expectOverrides, ff.overrides)
+			}
+		})
+	}
+}
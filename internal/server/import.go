@@ -0,0 +1,101 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/importer"
+)
+
+// Importer runs uploaded files as background import jobs.
+type Importer interface {
+	Submit(projectID int64, name string, format importer.Format, r io.Reader) (importer.Job, error)
+	Get(id string) (importer.Job, error)
+}
+
+// requireImporter answers 404 when uploads are not configured.
+func (s *Server) requireImporter(c *gin.Context) bool {
+	if s.importer == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "file import is not configured")
+		return false
+	}
+	return true
+}
+
+// ImportEventsHandler accepts a CSV or NDJSON file in the "file" field of a
+// multipart form and answers 202 with the job that imports it. The format
+// is taken from the "format" field or else from the file name.
+func (s *Server) ImportEventsHandler(c *gin.Context) {
+	if !s.requireImporter(c) {
+		return
+	}
+	if s.maxUploadBytes > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.maxUploadBytes)
+	}
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			abortWithProblem(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, err.Error())
+			return
+		}
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "a multipart form with a \"file\" field is required")
+		return
+	}
+
+	var format importer.Format
+	if v := c.PostForm("format"); v != "" {
+		format, err = importer.ParseFormat(v)
+	} else {
+		format, err = importer.FormatFromName(fh.Filename)
+	}
+	if err != nil {
+		abortWithFieldErrors(c, CodeValidationFailed, err.Error(), []FieldError{{Field: "format", Code: "invalid", Message: err.Error()}})
+		return
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	defer f.Close()
+
+	job, err := s.importer.Submit(projectID(c), fh.Filename, format, f)
+	switch {
+	case errors.Is(err, importer.ErrBusy), errors.Is(err, importer.ErrClosed):
+		c.Header("Retry-After", "60")
+		abortWithProblem(c, http.StatusServiceUnavailable, CodeOverloaded, err.Error())
+		return
+	case err != nil:
+		s.l.Error("failed to submit import job", "error", err)
+		_ = c.Error(err)
+		abortWithProblem(c, http.StatusInternalServerError, CodeInternal, err.Error())
+		return
+	}
+
+	c.Header("Location", path.Join(c.Request.URL.Path, job.ID))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GetImportJobHandler reports the status and progress of an import job.
+// Jobs of other projects are reported as not found.
+func (s *Server) GetImportJobHandler(c *gin.Context) {
+	if !s.requireImporter(c) {
+		return
+	}
+	job, err := s.importer.Get(c.Param("id"))
+	if err == nil && job.ProjectID != projectID(c) {
+		err = importer.ErrNotFound
+	}
+	if err != nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
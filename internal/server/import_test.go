@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/importer"
+)
+
+type fakeImporter struct {
+	err     error
+	format  importer.Format
+	content string
+}
+
+func (f *fakeImporter) Submit(projectID int64, name string, format importer.Format, r io.Reader) (importer.Job, error) {
+	if f.err != nil {
+		return importer.Job{}, f.err
+	}
+	data, _ := io.ReadAll(r)
+	f.format, f.content = format, string(data)
+	return importer.Job{ID: "42", ProjectID: projectID, File: name, Format: format, Status: importer.JobQueued}, nil
+}
+
+func (f *fakeImporter) Get(id string) (importer.Job, error) {
+	if id != "42" {
+		return importer.Job{}, importer.ErrNotFound
+	}
+	return importer.Job{ID: "42", ProjectID: 1, Status: importer.JobSucceeded, Stats: importer.Stats{Read: 2, Imported: 2}}, nil
+}
+
+func multipartBody(t *testing.T, filename, content, format string) (*bytes.Buffer, string) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	w := multipart.NewWriter(body)
+	if format != "" {
+		_ = w.WriteField("format", format)
+	}
+	if filename != "" {
+		part, err := w.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatalf("create form file: %v", err)
+		}
+		_, _ = part.Write([]byte(content))
+	}
+	_ = w.Close()
+	return body, w.FormDataContentType()
+}
+
+func TestImportEventsHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	content := "user_id,action\n1,click\n2,view\n"
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		submitErr      error
+		filename       string
+		format         string
+		maxUpload      int64
+		expectedStatus int
+		expectBody     string
+		expectFormat   importer.Format
+	}{
+		{name: "csv upload", filename: "events.csv", expectedStatus: http.StatusAccepted, expectBody: `"status":"queued"`, expectFormat: importer.CSV},
+		{name: "explicit format", filename: "export.txt", format: "ndjson", expectedStatus: http.StatusAccepted, expectFormat: importer.NDJSON},
+		{name: "unknown format", filename: "export.txt", expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "missing file", expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{name: "too large", filename: "events.csv", maxUpload: 16, expectedStatus: http.StatusRequestEntityTooLarge, expectBody: CodePayloadTooLarge},
+		{name: "too many pending jobs", filename: "events.csv", submitErr: importer.ErrBusy, expectedStatus: http.StatusServiceUnavailable, expectBody: CodeOverloaded},
+		{name: "not configured", unconfigured: true, filename: "events.csv", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imp := &fakeImporter{err: tt.submitErr}
+			s := &Server{l: logger, db: &mockDB{}, importer: imp, maxUploadBytes: 1 << 20}
+			if tt.unconfigured {
+				s.importer = nil
+			}
+			if tt.maxUpload > 0 {
+				s.maxUploadBytes = tt.maxUpload
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events/import", s.ImportEventsHandler)
+
+			body, contentType := multipartBody(t, tt.filename, content, tt.format)
+			req := httptest.NewRequest(http.MethodPost, "/events/import", body)
+			req.Header.Set("Content-Type", contentType)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectedStatus != http.StatusAccepted {
+				return
+			}
+			if imp.format != tt.expectFormat || imp.content != content {
+				t.Fatalf("unexpected submission %q %q", imp.format, imp.content)
+			}
+			if loc := rr.Header().Get("Location"); loc != "/events/import/42" {
+				t.Fatalf("unexpected Location %q", loc)
+			}
+		})
+	}
+}
+
+func TestGetImportJobHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &Server{l: logger, db: &mockDB{}, importer: &fakeImporter{}}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/events/import/:id", s.GetImportJobHandler)
+
+	for path, want := range map[string]int{"/events/import/42": http.StatusOK, "/events/import/7": http.StatusNotFound} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != want {
+			t.Fatalf("%s: expected status %d got %d, body: %s", path, want, rr.Code, rr.Body.String())
+		}
+		if want == http.StatusOK && !strings.Contains(rr.Body.String(), `"imported":2`) {
+			t.Fatalf("expected the job stats, got: %s", rr.Body.String())
+		}
+	}
+}
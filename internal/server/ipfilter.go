@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// ipFilter restricts a listener to the clients of allowed networks. Denied
+// networks win over allowed ones; an empty allow list allows every client
+// that is not denied.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// newIPFilter returns nil when both lists are empty.
+func newIPFilter(allow, deny []string) (*ipFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	var err error
+	if f.allow, err = config.ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = config.ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *ipFilter) allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// setIPFilter swaps in the allow and deny lists for new requests. Invalid
+// lists are logged and leave the previous ones in place.
+func (s *Server) setIPFilter(allow, deny []string) {
+	f, err := newIPFilter(allow, deny)
+	if err != nil {
+		s.l.Error("invalid client network lists, keeping the previous ones", "error", err)
+		return
+	}
+	s.ipFilter.Store(f)
+}
+
+// IPFilterMiddleware rejects with 403 the clients whose address is not
+// allowed. It is registered on the engine, before routing, so that unmatched
+// routes are not served to them either. The address is the one of the
+// connection unless it comes from a trusted proxy.
+func (s *Server) IPFilterMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		f := s.ipFilter.Load()
+		if f == nil {
+			c.Next()
+			return
+		}
+		addr, err := netip.ParseAddr(c.ClientIP())
+		if err != nil || !f.allows(addr) {
+			abortWithProblem(c, http.StatusForbidden, CodeForbidden, "the client address is not allowed")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestIPFilterMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		allow, deny    []string
+		trustedProxies []string
+		remoteAddr     string
+		forwardedFor   string
+		expectedStatus int
+	}{
+		{name: "no lists", remoteAddr: "203.0.113.9:1234", expectedStatus: http.StatusOK},
+		{name: "allowed network", allow: []string{"10.0.0.0/8"}, remoteAddr: "10.1.2.3:1234", expectedStatus: http.StatusOK},
+		{name: "outside the allowed networks", allow: []string{"10.0.0.0/8", "192.168.1.7"}, remoteAddr: "192.168.1.8:1234", expectedStatus: http.StatusForbidden},
+		{name: "deny wins", allow: []string{"10.0.0.0/8"}, deny: []string{"10.9.0.0/16"}, remoteAddr: "10.9.1.1:1234", expectedStatus: http.StatusForbidden},
+		{name: "denied IPv6", deny: []string{"2001:db8::/32"}, remoteAddr: "[2001:db8::1]:1234", expectedStatus: http.StatusForbidden},
+		{name: "IPv4-mapped address", allow: []string{"10.0.0.0/8"}, remoteAddr: "[::ffff:10.0.0.1]:1234", expectedStatus: http.StatusOK},
+		{name: "forwarded for by an untrusted client", allow: []string{"10.0.0.0/8"}, remoteAddr: "203.0.113.9:1234", forwardedFor: "10.0.0.1", expectedStatus: http.StatusForbidden},
+		{name: "forwarded for by a trusted proxy", allow: []string{"10.0.0.0/8"}, trustedProxies: []string{"172.16.0.0/12"}, remoteAddr: "172.16.0.2:1234", forwardedFor: "10.0.0.1", expectedStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger}
+			s.setIPFilter(tt.allow, tt.deny)
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			if err := router.SetTrustedProxies(tt.trustedProxies); err != nil {
+				t.Fatal(err)
+			}
+			router.Use(s.IPFilterMiddleware())
+			router.NoRoute(noRouteHandler)
+			router.GET("/events", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/events", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwardedFor)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d", tt.expectedStatus, rr.Code)
+			}
+			if rr.Code == http.StatusForbidden {
+				assertProblem(t, rr, CodeForbidden)
+			}
+		})
+	}
+
+	// Unmatched routes are filtered too, and invalid lists keep the previous ones
+	s := &Server{l: logger}
+	s.setIPFilter([]string{"10.0.0.0/8"}, nil)
+	s.setIPFilter([]string{"not a network"}, nil)
+	router := gin.New()
+	router.Use(s.IPFilterMiddleware())
+	router.NoRoute(noRouteHandler)
+	req := httptest.NewRequest(http.MethodGet, "/unknown", nil)
+	req.RemoteAddr = "203.0.113.9:1234"
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected the unmatched route to be filtered, got status %d", rr.Code)
+	}
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/jobs"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+// Jobs runs the background jobs of the projects, such as a jobs.Pool.
+type Jobs interface {
+	Submit(ctx context.Context, projectID int64, kind string, params json.RawMessage) (database.Job, error)
+	Get(ctx context.Context, id int64) (database.Job, error)
+	ArtifactPath(job database.Job) (string, error)
+}
+
+// JobRequest queues a job of any kind for a project through the admin
+// listener, the default project when ProjectID is missing.
+type JobRequest struct {
+	Kind      string          `json:"kind" binding:"required"`
+	ProjectID int64           `json:"project_id"`
+	Params    json.RawMessage `json:"params"`
+}
+
+// requireJobs answers 404 when background jobs are not configured.
+func (s *Server) requireJobs(c *gin.Context) bool {
+	if s.jobs == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "background jobs are not configured")
+		return false
+	}
+	return true
+}
+
+// CreateExportJobHandler queues the export of the events of the project to
+// a downloadable file and answers 202 with the job.
+func (s *Server) CreateExportJobHandler(c *gin.Context) {
+	if !s.requireJobs(c) {
+		return
+	}
+	var req jobs.ExportParams
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if !s.reserve(c, quota.Queries, 1) {
+		return
+	}
+	params, _ := json.Marshal(req)
+	s.submitJob(c, path.Join(path.Dir(c.FullPath()), "jobs"), projectID(c), jobs.KindExport, params)
+}
+
+// CreateJobHandler queues a job of any kind on the admin listener.
+func (s *Server) CreateJobHandler(c *gin.Context) {
+	if !s.requireJobs(c) {
+		return
+	}
+	var req JobRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if req.ProjectID == 0 {
+		req.ProjectID = database.DefaultProjectID
+	}
+	s.submitJob(c, "/jobs", req.ProjectID, req.Kind, req.Params)
+}
+
+// RenameActionRequest renames an action across the events of a project,
+// the default project when ProjectID is missing.
+type RenameActionRequest struct {
+	jobs.RenameParams
+	ProjectID int64 `json:"project_id"`
+}
+
+// RenameActionHandler queues the rename of an action across the stored
+// events and their aggregates on the admin listener, and answers 202 with
+// the job.
+func (s *Server) RenameActionHandler(c *gin.Context) {
+	if !s.requireJobs(c) {
+		return
+	}
+	var req RenameActionRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if req.ProjectID == 0 {
+		req.ProjectID = database.DefaultProjectID
+	}
+	params, _ := json.Marshal(req.RenameParams)
+	s.submitJob(c, "/jobs", req.ProjectID, jobs.KindRename, params)
+}
+
+// submitJob queues the job and answers 202 with it, located under
+// jobsPath.
+func (s *Server) submitJob(c *gin.Context, jobsPath string, projectID int64, kind string, params json.RawMessage) {
+	job, err := s.jobs.Submit(c.Request.Context(), projectID, kind, params)
+	switch {
+	case errors.Is(err, jobs.ErrUnknownKind):
+		abortWithInvalid(c, ingest.NewFieldError("kind", "invalid", err.Error()))
+		return
+	case errors.Is(err, jobs.ErrInvalidParams):
+		abortWithInvalid(c, err)
+		return
+	case err != nil:
+		s.l.Error("failed to submit background job", "kind", kind, "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to submit background job")
+		return
+	}
+
+	c.Header("Location", path.Join(jobsPath, strconv.FormatInt(job.ID, 10)))
+	c.JSON(http.StatusAccepted, job)
+}
+
+// GetJobHandler reports the status and progress of a job of the project;
+// the jobs of other projects are reported as not found.
+func (s *Server) GetJobHandler(c *gin.Context) {
+	if job, ok := s.lookupJob(c, true); ok {
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// GetAnyJobHandler reports a job of any project on the admin listener.
+func (s *Server) GetAnyJobHandler(c *gin.Context) {
+	if job, ok := s.lookupJob(c, false); ok {
+		c.JSON(http.StatusOK, job)
+	}
+}
+
+// GetJobArtifactHandler downloads the file written by a job of the
+// project, once it succeeded.
+func (s *Server) GetJobArtifactHandler(c *gin.Context) {
+	job, ok := s.lookupJob(c, true)
+	if !ok {
+		return
+	}
+	file, err := s.jobs.ArtifactPath(job)
+	if err != nil {
+		abortWithProblem(c, http.StatusConflict, CodeConflict, "job "+string(job.Status)+" has no downloadable file")
+		return
+	}
+	c.FileAttachment(file, job.Artifact)
+}
+
+// lookupJob answers the errors itself and reports whether the job of the
+// id parameter was found, in the project of the request when scoped.
+func (s *Server) lookupJob(c *gin.Context, scoped bool) (database.Job, bool) {
+	if !s.requireJobs(c) {
+		return database.Job{}, false
+	}
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "job id must be an integer")
+		return database.Job{}, false
+	}
+	job, err := s.jobs.Get(c.Request.Context(), id)
+	if err == nil && scoped && job.ProjectID != projectID(c) {
+		err = database.ErrJobNotFound
+	}
+	switch {
+	case errors.Is(err, database.ErrJobNotFound):
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return database.Job{}, false
+	case err != nil:
+		s.l.Error("failed to read background job", "id", id, "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to read background job")
+		return database.Job{}, false
+	}
+	return job, true
+}
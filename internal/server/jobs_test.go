@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/jobs"
+)
+
+// fakeJobs knows job 1 of the default project, succeeded with the file of
+// dir, and job 2 of project 7, still running.
+type fakeJobs struct {
+	dir       string
+	submitted string
+	err       error
+}
+
+func (f *fakeJobs) Submit(ctx context.Context, projectID int64, kind string, params json.RawMessage) (database.Job, error) {
+	if f.err != nil {
+		return database.Job{}, f.err
+	}
+	f.submitted = fmt.Sprintf("%d %s %s", projectID, kind, params)
+	return database.Job{ID: 42, ProjectID: projectID, Kind: kind, Params: params, Status: database.JobQueued}, nil
+}
+
+func (f *fakeJobs) Get(ctx context.Context, id int64) (database.Job, error) {
+	switch id {
+	case 1:
+		return database.Job{ID: 1, ProjectID: database.DefaultProjectID, Kind: jobs.KindExport, Status: database.JobSucceeded, Done: 2, Total: 2, Artifact: "events.ndjson"}, nil
+	case 2:
+		return database.Job{ID: 2, ProjectID: 7, Kind: jobs.KindExport, Status: database.JobRunning, Done: 1, Total: 2}, nil
+	}
+	return database.Job{}, database.ErrJobNotFound
+}
+
+func (f *fakeJobs) ArtifactPath(job database.Job) (string, error) {
+	if job.Status != database.JobSucceeded {
+		return "", jobs.ErrNoArtifact
+	}
+	return filepath.Join(f.dir, job.Artifact), nil
+}
+
+func TestCreateExportJobHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name            string
+		unconfigured    bool
+		submitErr       error
+		body            string
+		expectedStatus  int
+		expectBody      string
+		expectSubmitted string
+	}{
+		{
+			name:            "queued",
+			body:            `{"from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z","format":"csv"}`,
+			expectedStatus:  http.StatusAccepted,
+			expectBody:      `"status":"queued"`,
+			expectSubmitted: `1 export {"from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z","format":"csv"}`,
+		},
+		{name: "malformed body", body: `{"from":`, expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{
+			name:           "invalid params",
+			body:           `{}`,
+			submitErr:      fmt.Errorf("%w: %w", jobs.ErrInvalidParams, jobs.NewExporter(nil, nil).Validate(json.RawMessage(`{}`))),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"to"`,
+		},
+		{name: "database down", body: `{}`, submitErr: database.ErrCircuitOpen, expectedStatus: http.StatusServiceUnavailable, expectBody: CodeDBUnavailable},
+		{name: "not configured", unconfigured: true, body: `{}`, expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &fakeJobs{err: tt.submitErr}
+			s := &Server{l: logger, db: &mockDB{}, jobs: j}
+			if tt.unconfigured {
+				s.jobs = nil
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/api/exports", s.CreateExportJobHandler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/exports", strings.NewReader(tt.body)))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if j.submitted != tt.expectSubmitted {
+				t.Fatalf("expected submission %q, got %q", tt.expectSubmitted, j.submitted)
+			}
+			if tt.expectedStatus == http.StatusAccepted {
+				if loc := rr.Header().Get("Location"); loc != "/api/jobs/42" {
+					t.Fatalf("unexpected Location %q", loc)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateJobHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name            string
+		body            string
+		submitErr       error
+		expectedStatus  int
+		expectSubmitted string
+	}{
+		{name: "default project", body: `{"kind":"erase_user","params":{"user_id":5}}`, expectedStatus: http.StatusAccepted, expectSubmitted: `1 erase_user {"user_id":5}`},
+		{name: "other project", body: `{"kind":"erase_user","project_id":7,"params":{"user_id":5}}`, expectedStatus: http.StatusAccepted, expectSubmitted: `7 erase_user {"user_id":5}`},
+		{name: "missing kind", body: `{"params":{}}`, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "unknown kind", body: `{"kind":"reindex"}`, submitErr: fmt.Errorf("%w: %q", jobs.ErrUnknownKind, "reindex"), expectedStatus: http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &fakeJobs{err: tt.submitErr}
+			s := &Server{l: logger, db: &mockDB{}, jobs: j}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/jobs", s.CreateJobHandler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(tt.body)))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if j.submitted != tt.expectSubmitted {
+				t.Fatalf("expected submission %q, got %q", tt.expectSubmitted, j.submitted)
+			}
+			if tt.expectedStatus == http.StatusAccepted {
+				if loc := rr.Header().Get("Location"); loc != "/jobs/42" {
+					t.Fatalf("unexpected Location %q", loc)
+				}
+			}
+		})
+	}
+}
+
+func TestRenameActionHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name            string
+		body            string
+		submitErr       error
+		expectedStatus  int
+		expectBody      string
+		expectSubmitted string
+	}{
+		{name: "default project", body: `{"from":"signup","to":"sign_up"}`, expectedStatus: http.StatusAccepted, expectBody: `"kind":"rename_action"`, expectSubmitted: `1 rename_action {"from":"signup","to":"sign_up"}`},
+		{name: "other project", body: `{"from":"signup","to":"sign_up","project_id":7}`, expectedStatus: http.StatusAccepted, expectSubmitted: `7 rename_action {"from":"signup","to":"sign_up"}`},
+		{name: "malformed body", body: `{"from":`, expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{
+			name:           "invalid params",
+			body:           `{"from":"signup","to":"signup"}`,
+			submitErr:      fmt.Errorf("%w: %w", jobs.ErrInvalidParams, jobs.NewRenamer(nil).Validate(json.RawMessage(`{"from":"signup","to":"signup"}`))),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"to"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := &fakeJobs{err: tt.submitErr}
+			s := &Server{l: logger, db: &mockDB{}, jobs: j}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/actions/rename", s.RenameActionHandler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/actions/rename", strings.NewReader(tt.body)))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if j.submitted != tt.expectSubmitted {
+				t.Fatalf("expected submission %q, got %q", tt.expectSubmitted, j.submitted)
+			}
+			if tt.expectedStatus == http.StatusAccepted {
+				if loc := rr.Header().Get("Location"); loc != "/jobs/42" {
+					t.Fatalf("unexpected Location %q", loc)
+				}
+			}
+		})
+	}
+}
+
+func TestGetJobHandlers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "events.ndjson"), []byte(`{"id":1}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{l: logger, db: &mockDB{}, jobs: &fakeJobs{dir: dir}}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/api/jobs/:id", s.GetJobHandler)
+	router.GET("/api/jobs/:id/artifact", s.GetJobArtifactHandler)
+	router.GET("/jobs/:id", s.GetAnyJobHandler)
+
+	tests := []struct {
+		path           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{path: "/api/jobs/1", expectedStatus: http.StatusOK, expectBody: `"status":"succeeded"`},
+		{path: "/api/jobs/1/artifact", expectedStatus: http.StatusOK, expectBody: `{"id":1}`},
+		{path: "/api/jobs/2", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{path: "/api/jobs/2/artifact", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{path: "/api/jobs/3", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{path: "/api/jobs/x", expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{path: "/jobs/2", expectedStatus: http.StatusOK, expectBody: `"done":1,"total":2`},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rr.Code != tt.expectedStatus {
+			t.Fatalf("%s: expected status %d got %d, body: %s", tt.path, tt.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if !strings.Contains(rr.Body.String(), tt.expectBody) {
+			t.Fatalf("%s: expected body to contain %q, got: %s", tt.path, tt.expectBody, rr.Body.String())
+		}
+	}
+
+	// Still running in its own project
+	scoped := gin.New()
+	scoped.Use(func(c *gin.Context) { c.Set(projectKey, int64(7)) })
+	scoped.GET("/api/jobs/:id/artifact", s.GetJobArtifactHandler)
+	rr := httptest.NewRecorder()
+	scoped.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/jobs/2/artifact", nil))
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected status %d got %d, body: %s", http.StatusConflict, rr.Code, rr.Body.String())
+	}
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// concurrencyLimiter caps the number of requests served at once. Requests
+// above the cap are shed immediately rather than queued, protecting the
+// database pool during spikes and making overload behavior predictable.
+type concurrencyLimiter struct {
+	inFlight   atomic.Int64
+	limit      atomic.Int64
+	retryAfter atomic.Int64
+
+	inFlightGauge prometheus.Gauge
+	shedCounter   prometheus.Counter
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{
+		inFlightGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of API requests currently being served",
+		}),
+		shedCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "http_requests_shed_total",
+			Help: "Total number of API requests rejected because the in-flight limit was reached",
+		}),
+	}
+}
+
+// configure applies new limits; it is safe to call while serving.
+func (l *concurrencyLimiter) configure(cfg config.ServerConfig) {
+	l.limit.Store(int64(cfg.MaxInFlightRequests))
+	l.retryAfter.Store(int64(cfg.ShedRetryAfterSeconds))
+}
+
+// ConcurrencyLimitMiddleware rejects requests with 503 and Retry-After once
+// the in-flight limit is reached. A zero limit disables shedding.
+func (s *Server) ConcurrencyLimitMiddleware() gin.HandlerFunc {
+	l := s.limiter
+	return func(c *gin.Context) {
+		n := l.inFlight.Add(1)
+		defer l.inFlight.Add(-1)
+
+		if limit := l.limit.Load(); limit > 0 && n > limit {
+			l.shedCounter.Inc()
+			c.Header("Retry-After", strconv.FormatInt(l.retryAfter.Load(), 10))
+			abortWithProblem(c, http.StatusServiceUnavailable, CodeOverloaded, "too many requests in flight, retry later")
+			return
+		}
+
+		l.inFlightGauge.Inc()
+		defer l.inFlightGauge.Dec()
+		c.Next()
+	}
+}
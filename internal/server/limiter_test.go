@@ -0,0 +1,64 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func TestConcurrencyLimitMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &Server{l: logger, limiter: newConcurrencyLimiter()}
+	s.limiter.configure(config.ServerConfig{MaxInFlightRequests: 2, ShedRetryAfterSeconds: 3})
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(s.ConcurrencyLimitMiddleware())
+	router.GET("/slow", func(c *gin.Context) {
+		entered <- struct{}{}
+		<-release
+		c.Status(http.StatusOK)
+	})
+
+	// occupy every slot
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/slow", nil))
+		}()
+		<-entered
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if ra := rr.Header().Get("Retry-After"); ra != "3" {
+		t.Fatalf("expected Retry-After 3 got %q", ra)
+	}
+	assertProblem(t, rr, CodeOverloaded)
+
+	close(release)
+	wg.Wait()
+
+	// slots are released once requests finish
+	go func() { <-entered }()
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d after release got %d", http.StatusOK, rr.Code)
+	}
+}
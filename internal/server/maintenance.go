@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// EventStore counts and deletes events by filter, operated through the
+// admin listener.
+type EventStore interface {
+	Count(ctx context.Context, f database.EventFilter) (int64, error)
+	Delete(ctx context.Context, f database.EventFilter) (int64, error)
+}
+
+// Aggregator runs the aggregation on demand.
+type Aggregator interface {
+	// Trigger starts an aggregation unless one is running and reports
+	// whether it did.
+	Trigger() bool
+}
+
+// requireEventStore answers 404 when event maintenance is not available.
+func (s *Server) requireEventStore(c *gin.Context) bool {
+	if s.eventStore == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "event maintenance is not configured")
+		return false
+	}
+	return true
+}
+
+// eventFilter reads the project_id, user_id, action, from and to query
+// parameters. The range defaults to every event created until now, of every
+// project. filtered reports whether any parameter was given.
+func eventFilter(c *gin.Context) (f database.EventFilter, filtered bool, err error) {
+	f.From, f.To = time.Unix(0, 0).UTC(), time.Now().UTC()
+	if f.ProjectID, err = projectIDQuery(c); err != nil {
+		return f, false, err
+	}
+	if v := c.Query("user_id"); v != "" {
+		uid, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, false, fmt.Errorf("user_id must be an integer")
+		}
+		f.UserID = &uid
+	}
+	f.Action = c.Query("action")
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		v := c.Query(p.name)
+		if v == "" {
+			continue
+		}
+		if *p.t, err = time.Parse(time.RFC3339, v); err != nil {
+			return f, false, fmt.Errorf("%s must be an RFC 3339 time", p.name)
+		}
+	}
+	if !f.From.Before(f.To) {
+		return f, false, ingest.NewFieldError("from", "out_of_range", "from must be before to")
+	}
+	filtered = f.ProjectID != nil || f.UserID != nil || f.Action != "" || c.Query("from") != "" || c.Query("to") != ""
+	return f, filtered, nil
+}
+
+// CountEventsHandler counts the events created in [from, to), optionally of
+// a single user and action. The complete aggregation periods of the range
+// are read from the aggregates, unless exact=true.
+func (s *Server) CountEventsHandler(c *gin.Context) {
+	if !s.requireEventStore(c) {
+		return
+	}
+	f, _, err := eventFilter(c)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	ctx := c.Request.Context()
+	if v := c.Query("exact"); v != "" {
+		exact, err := strconv.ParseBool(v)
+		if err != nil {
+			abortWithInvalid(c, ingest.NewFieldError("exact", "invalid", "exact must be true or false"))
+			return
+		}
+		if exact {
+			ctx = database.WithExactCount(ctx)
+		}
+	}
+
+	n, err := s.eventStore.Count(ctx, f)
+	if err != nil {
+		s.l.Error("failed to count events", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to count events")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": n})
+}
+
+// DeleteEventsHandler deletes the events matching the same filters as
+// CountEventsHandler. At least one filter is required, so that a bare
+// DELETE cannot empty the table.
+func (s *Server) DeleteEventsHandler(c *gin.Context) {
+	if !s.requireEventStore(c) {
+		return
+	}
+	f, filtered, err := eventFilter(c)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if !filtered {
+		abortWithInvalid(c, ingest.NewFieldError("", "required", "at least one of project_id, user_id, action, from and to is required"))
+		return
+	}
+
+	n, err := s.eventStore.Delete(c.Request.Context(), f)
+	if err != nil {
+		s.l.Error("failed to delete events", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to delete events")
+		return
+	}
+	s.l.Warn("events deleted", "deleted", n, "project_id", f.ProjectID, "user_id", f.UserID, "action", f.Action, "from", f.From, "to", f.To)
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
+
+// TriggerAggregationHandler starts an aggregation run outside of the
+// schedule and answers 202; the run is logged like the scheduled ones.
+func (s *Server) TriggerAggregationHandler(c *gin.Context) {
+	if s.aggregator == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "aggregation is not configured")
+		return
+	}
+	if !s.aggregator.Trigger() {
+		abortWithProblem(c, http.StatusConflict, CodeConflict, "an aggregation is already running")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"status": "started"})
+}
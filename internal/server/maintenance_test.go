@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeEventStore struct {
+	filters []database.EventFilter
+	exact   bool
+}
+
+func (f *fakeEventStore) Count(ctx context.Context, filter database.EventFilter) (int64, error) {
+	f.filters = append(f.filters, filter)
+	f.exact = database.ExactCount(ctx)
+	return 12, nil
+}
+func (f *fakeEventStore) Delete(ctx context.Context, filter database.EventFilter) (int64, error) {
+	f.filters = append(f.filters, filter)
+	return 3, nil
+}
+
+type fakeAggregator struct {
+	running bool
+}
+
+func (f *fakeAggregator) Trigger() bool {
+	return !f.running
+}
+
+func TestMaintenanceRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name            string
+		unconfigured    bool
+		running         bool
+		method          string
+		path            string
+		expectedStatus  int
+		expectBody      string
+		expectUserID    int64
+		expectAction    string
+		expectProjectID int64
+		expectExact     bool
+	}{
+		{name: "count everything", method: http.MethodGet, path: "/events/count", expectedStatus: http.StatusOK, expectBody: `"count":12`},
+		{name: "count a user", method: http.MethodGet, path: "/events/count?user_id=42&action=click&from=2025-01-01T00:00:00Z", expectedStatus: http.StatusOK, expectBody: `"count":12`, expectUserID: 42, expectAction: "click"},
+		{name: "count exactly", method: http.MethodGet, path: "/events/count?exact=true", expectedStatus: http.StatusOK, expectBody: `"count":12`, expectExact: true},
+		{name: "count with a bad exact", method: http.MethodGet, path: "/events/count?exact=maybe", expectedStatus: http.StatusUnprocessableEntity, expectBody: "exact must be true or false"},
+		{name: "count with a bad user_id", method: http.MethodGet, path: "/events/count?user_id=x", expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{name: "count an empty range", method: http.MethodGet, path: "/events/count?from=2025-01-02T00:00:00Z&to=2025-01-01T00:00:00Z", expectedStatus: http.StatusUnprocessableEntity, expectBody: "from must be before to"},
+		{name: "delete a user", method: http.MethodDelete, path: "/events?user_id=42", expectedStatus: http.StatusOK, expectBody: `"deleted":3`, expectUserID: 42},
+		{name: "delete a project", method: http.MethodDelete, path: "/events?project_id=2", expectedStatus: http.StatusOK, expectBody: `"deleted":3`, expectProjectID: 2},
+		{name: "delete with a bad project_id", method: http.MethodDelete, path: "/events?project_id=0", expectedStatus: http.StatusUnprocessableEntity, expectBody: "project_id must be"},
+		{name: "delete without filter", method: http.MethodDelete, path: "/events", expectedStatus: http.StatusUnprocessableEntity, expectBody: "at least one"},
+		{name: "delete not configured", unconfigured: true, method: http.MethodDelete, path: "/events?user_id=42", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+		{name: "aggregate", method: http.MethodPost, path: "/aggregate", expectedStatus: http.StatusAccepted, expectBody: "started"},
+		{name: "aggregate while running", running: true, method: http.MethodPost, path: "/aggregate", expectedStatus: http.StatusConflict, expectBody: CodeConflict},
+		{name: "aggregate not configured", unconfigured: true, method: http.MethodPost, path: "/aggregate", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &fakeEventStore{}
+			s := &Server{l: logger, db: &mockDB{}, eventStore: store, aggregator: &fakeAggregator{running: tt.running}}
+			if tt.unconfigured {
+				s.eventStore, s.aggregator = nil, nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if store.exact != tt.expectExact {
+				t.Fatalf("expected an exact count %v", tt.expectExact)
+			}
+			if tt.expectUserID != 0 {
+				f := store.filters[0]
+				if f.UserID == nil || *f.UserID != tt.expectUserID || f.Action != tt.expectAction || !f.From.Before(f.To) {
+					t.Fatalf("unexpected filter %+v", f)
+				}
+			}
+			if tt.expectProjectID != 0 {
+				if f := store.filters[0]; f.ProjectID == nil || *f.ProjectID != tt.expectProjectID {
+					t.Fatalf("unexpected filter %+v", f)
+				}
+			}
+		})
+	}
+}
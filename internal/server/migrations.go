@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// DualWrites switches the copy of the events to events_v2 during its
+// migration, such as a database.DualWriteStore.
+type DualWrites interface {
+	GetDualWrite(ctx context.Context) (database.DualWrite, error)
+	SetDualWrite(ctx context.Context, enabled bool) (database.DualWrite, error)
+}
+
+// DualWriteRequest enables or disables the dual write.
+type DualWriteRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// requireDualWrites answers 404 when the dual write is not available.
+func (s *Server) requireDualWrites(c *gin.Context) bool {
+	if s.dualWrites == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "dual write is not configured")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithDualWriteError(c *gin.Context, err error) {
+	if errors.Is(err, database.ErrDualWriteNotInstalled) {
+		abortWithProblem(c, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	s.l.Error("dual write operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access the dual write")
+}
+
+// GetDualWriteHandler reports whether the events are copied to events_v2,
+// and since when.
+func (s *Server) GetDualWriteHandler(c *gin.Context) {
+	if !s.requireDualWrites(c) {
+		return
+	}
+	d, err := s.dualWrites.GetDualWrite(c.Request.Context())
+	if err != nil {
+		s.abortWithDualWriteError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// SetDualWriteHandler starts or stops the copy of the events to events_v2.
+// It applies to every instance at once, in the transaction of each write.
+func (s *Server) SetDualWriteHandler(c *gin.Context) {
+	if !s.requireDualWrites(c) {
+		return
+	}
+	var req DualWriteRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	d, err := s.dualWrites.SetDualWrite(c.Request.Context(), *req.Enabled)
+	if err != nil {
+		s.abortWithDualWriteError(c, err)
+		return
+	}
+	s.l.Info("dual write switched", "name", d.Name, "enabled", d.Enabled)
+	c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeDualWrites keeps the state of the dual write, or fails with err.
+type fakeDualWrites struct {
+	state database.DualWrite
+	err   error
+}
+
+func (f *fakeDualWrites) GetDualWrite(ctx context.Context) (database.DualWrite, error) {
+	return f.state, f.err
+}
+
+func (f *fakeDualWrites) SetDualWrite(ctx context.Context, enabled bool) (database.DualWrite, error) {
+	if f.err != nil {
+		return database.DualWrite{}, f.err
+	}
+	f.state.Enabled, f.state.StartedAt = enabled, nil
+	if enabled {
+		started := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+		f.state.StartedAt = &started
+	}
+	return f.state, nil
+}
+
+func TestDualWriteRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		storeErr       error
+		method         string
+		body           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "get", method: http.MethodGet, expectedStatus: http.StatusOK, expectBody: `{"name":"events_v2","enabled":false,`},
+		{name: "enable", method: http.MethodPut, body: `{"enabled":true}`, expectedStatus: http.StatusOK, expectBody: `"enabled":true,"started_at":"2025-06-01T00:00:00Z"`},
+		{name: "disable", method: http.MethodPut, body: `{"enabled":false}`, expectedStatus: http.StatusOK, expectBody: `"enabled":false,"updated_at"`},
+		{name: "without enabled", method: http.MethodPut, body: `{}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"enabled"`},
+		{name: "not installed", storeErr: database.ErrDualWriteNotInstalled, method: http.MethodPut, body: `{"enabled":true}`, expectedStatus: http.StatusConflict, expectBody: "other/dual_write.sql"},
+		{name: "database down", storeErr: errors.New("connection refused"), method: http.MethodGet, expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable},
+		{name: "not configured", unconfigured: true, method: http.MethodGet, expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{}, dualWrites: &fakeDualWrites{state: database.DualWrite{Name: "events_v2"}, err: tt.storeErr}}
+			if tt.unconfigured {
+				s.dualWrites = nil
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/migrations/dual-write", s.GetDualWriteHandler)
+			router.PUT("/migrations/dual-write", s.SetDualWriteHandler)
+
+			req := httptest.NewRequest(tt.method, "/migrations/dual-write", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+		})
+	}
+}
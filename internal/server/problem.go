@@ -0,0 +1,189 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// problemTypeBase is the documentation anchor used to build the "type" URI
+// of every problem; the code is appended as a fragment-like suffix.
+const problemTypeBase = "https://github.com/arimatakao/simple-events-handler#error-code-"
+
+// Machine-readable error codes returned in the "code" field of problems.
+// Clients should branch on these instead of on the human readable texts.
+const (
+	CodeInvalidRequest   = "invalid_request"
+	CodeValidationFailed = "validation_failed"
+	CodeActionNotAllowed = "action_not_allowed"
+	CodeUnknownUser      = "unknown_user"
+	CodeInvalidUserID    = "invalid_user_id"
+	CodeInvalidTimeRange = "invalid_time_range"
+	CodeDBUnavailable    = "db_unavailable"
+	CodeTimeout          = "timeout"
+	CodeOverloaded       = "overloaded"
+	CodeBufferFull       = "buffer_full"
+	CodePayloadTooLarge  = "payload_too_large"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeConflict         = "conflict"
+	CodeQuotaExceeded    = "quota_exceeded"
+	CodeInternal         = "internal_error"
+)
+
+var problemTitles = map[string]string{
+	CodeInvalidRequest:   "Malformed request",
+	CodeValidationFailed: "Validation failed",
+	CodeActionNotAllowed: "Action not allowed",
+	CodeUnknownUser:      "Unknown user",
+	CodeInvalidUserID:    "Invalid user_id",
+	CodeInvalidTimeRange: "Invalid time range",
+	CodeDBUnavailable:    "Database unavailable",
+	CodeTimeout:          "Request timed out",
+	CodeOverloaded:       "Server overloaded",
+	CodeBufferFull:       "Ingest buffer full",
+	CodePayloadTooLarge:  "Payload too large",
+	CodeUnauthorized:     "Unauthorized",
+	CodeForbidden:        "Forbidden",
+	CodeNotFound:         "Not found",
+	CodeMethodNotAllowed: "Method not allowed",
+	CodeConflict:         "Conflict",
+	CodeQuotaExceeded:    "Quota exceeded",
+	CodeInternal:         "Internal server error",
+}
+
+// Problem is an RFC 7807 problem details object extended with a stable code.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	// Errors lists the fields failing validation in 422 responses.
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a field of a request failing validation. Code is one of
+// required, invalid, out_of_range, too_long, too_many, not_allowed and
+// in_future; Field is omitted when the rule spans several fields.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ProblemContentType is the media type of problem responses.
+const ProblemContentType = "application/problem+json"
+
+// NewProblem builds a problem for code. The title defaults to the HTTP status
+// text for codes without a registered title.
+func NewProblem(status int, code, detail string) Problem {
+	title, ok := problemTitles[code]
+	if !ok {
+		title = http.StatusText(status)
+	}
+	return Problem{
+		Type:   problemTypeBase + code,
+		Title:  title,
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// abortWithProblem writes an application/problem+json response and stops
+// the handler chain.
+func abortWithProblem(c *gin.Context, status int, code, detail string) {
+	p := NewProblem(status, code, detail)
+	if c.Request != nil && c.Request.URL != nil {
+		p.Instance = c.Request.URL.Path
+	}
+	c.Header("Content-Type", ProblemContentType)
+	c.AbortWithStatusJSON(status, p)
+}
+
+// abortWithInvalid rejects a request that failed validation. A request
+// that could be parsed but breaks a rule gets 422 with the failing fields,
+// and the action_not_allowed code when its action breaks the configured
+// naming rules; one that could not be parsed at all gets 400.
+func abortWithInvalid(c *gin.Context, err error) {
+	fields := fieldErrors(err)
+	if fields == nil {
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+	code := CodeValidationFailed
+	if errors.Is(err, ingest.ErrActionNotAllowed) {
+		code = CodeActionNotAllowed
+	}
+	abortWithFieldErrors(c, code, err.Error(), fields)
+}
+
+// abortWithFieldErrors writes a 422 problem listing fields.
+func abortWithFieldErrors(c *gin.Context, code, detail string, fields []FieldError) {
+	p := NewProblem(http.StatusUnprocessableEntity, code, detail)
+	p.Errors = fields
+	if c.Request != nil && c.Request.URL != nil {
+		p.Instance = c.Request.URL.Path
+	}
+	c.Header("Content-Type", ProblemContentType)
+	c.AbortWithStatusJSON(p.Status, p)
+}
+
+// fieldErrors returns the fields failing validation in err, from binding
+// tags or an *ingest.FieldError, or nil when err is not a validation
+// failure.
+func fieldErrors(err error) []FieldError {
+	var verrs validator.ValidationErrors
+	if errors.As(err, &verrs) {
+		fields := make([]FieldError, len(verrs))
+		for i, fe := range verrs {
+			// The namespace starts with the request type, e.g.
+			// BatchEventsRequest.events[0].action
+			_, field, _ := strings.Cut(fe.Namespace(), ".")
+			fields[i] = FieldError{Field: field, Code: fe.Tag(), Message: field + " is " + fe.Tag()}
+			if fe.Tag() != "required" {
+				fields[i].Code = "invalid"
+				fields[i].Message = fmt.Sprintf("%s breaks the %s rule", field, fe.Tag())
+			}
+		}
+		return fields
+	}
+	var fe *ingest.FieldError
+	if errors.As(err, &fe) {
+		return []FieldError{{Field: fe.Field, Code: fe.Code, Message: fe.Message}}
+	}
+	return nil
+}
+
+func init() {
+	// Validation errors name the fields as clients send them
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(f reflect.StructField) string {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "" || name == "-" {
+				return f.Name
+			}
+			return name
+		})
+	}
+}
+
+func noRouteHandler(c *gin.Context) {
+	abortWithProblem(c, http.StatusNotFound, CodeNotFound, "no route matches "+c.Request.URL.Path)
+}
+
+func noMethodHandler(c *gin.Context) {
+	abortWithProblem(c, http.StatusMethodNotAllowed, CodeMethodNotAllowed, c.Request.Method+" is not allowed on "+c.Request.URL.Path)
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// APIKeyAuthenticator resolves an API key and its project. It returns
+// database.ErrAPIKeyNotFound for unknown and revoked keys.
+type APIKeyAuthenticator interface {
+	Authenticate(ctx context.Context, key string) (database.APIKey, error)
+}
+
+// Projects is the store of projects and their API keys, operated through
+// the admin listener.
+type Projects interface {
+	CreateProject(ctx context.Context, name string) (database.Project, error)
+	ListProjects(ctx context.Context) ([]database.Project, error)
+	CreateAPIKey(ctx context.Context, projectID int64, name string) (database.APIKey, error)
+	ListAPIKeys(ctx context.Context, projectID int64) ([]database.APIKey, error)
+	RevokeAPIKey(ctx context.Context, id int64) error
+}
+
+// APIKeyHeader carries the project API key on the public API. Clients that
+// cannot set headers, like tracking pixels, pass the api_key query
+// parameter instead.
+const APIKeyHeader = "X-API-Key"
+
+// projectKey and apiKeyIDKey are the gin context keys of the authenticated
+// project and API key ids; adminKey marks the requests authenticated by
+// the admin listener.
+const (
+	projectKey  = "project_id"
+	apiKeyIDKey = "api_key_id"
+	adminKey    = "admin"
+)
+
+// ProjectMiddleware authenticates the API key of the request and scopes the
+// request to its project. Requests without a key belong to the default
+// project unless keys are required.
+func (s *Server) ProjectMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(APIKeyHeader)
+		if key == "" {
+			key = c.Query("api_key")
+		}
+		if key == "" || s.apiKeys == nil {
+			if s.requireAPIKey {
+				abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, "missing API key")
+				return
+			}
+			c.Next()
+			return
+		}
+
+		k, err := s.apiKeys.Authenticate(c.Request.Context(), key)
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, "invalid API key")
+			return
+		}
+		if err != nil {
+			s.l.Error("failed to authenticate API key", "error", err)
+			_ = c.Error(err)
+			abortWithDBError(c, err, "failed to authenticate API key")
+			return
+		}
+		c.Set(projectKey, k.ProjectID)
+		c.Set(apiKeyIDKey, k.ID)
+		c.Next()
+	}
+}
+
+// projectID returns the project the request is scoped to.
+func projectID(c *gin.Context) int64 {
+	if id, ok := c.Get(projectKey); ok {
+		return id.(int64)
+	}
+	return database.DefaultProjectID
+}
+
+// apiKeyID returns the id of the API key of the request, if it carried one.
+func apiKeyID(c *gin.Context) (int64, bool) {
+	if id, ok := c.Get(apiKeyIDKey); ok {
+		return id.(int64), true
+	}
+	return 0, false
+}
+
+// ProjectRequest creates a project or an API key; the name of a key is a
+// free-form label.
+type ProjectRequest struct {
+	Name string `json:"name"`
+}
+
+// requireProjects answers 404 when projects are not managed by this instance.
+func (s *Server) requireProjects(c *gin.Context) bool {
+	if s.projects == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "projects are not configured")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithProjectError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrProjectNotFound), errors.Is(err, database.ErrAPIKeyNotFound):
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case errors.Is(err, database.ErrProjectExists):
+		abortWithProblem(c, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	s.l.Error("project operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access projects")
+}
+
+func pathID(c *gin.Context, notFound error) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, notFound.Error())
+		return 0, false
+	}
+	return id, true
+}
+
+func (s *Server) CreateProjectHandler(c *gin.Context) {
+	if !s.requireProjects(c) {
+		return
+	}
+	var req ProjectRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if req.Name == "" || len(req.Name) > 100 {
+		abortWithInvalid(c, ingest.NewFieldError("name", "out_of_range", "name must hold between 1 and 100 bytes"))
+		return
+	}
+
+	p, err := s.projects.CreateProject(c.Request.Context(), req.Name)
+	if err != nil {
+		s.abortWithProjectError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, p)
+}
+
+func (s *Server) ListProjectsHandler(c *gin.Context) {
+	if !s.requireProjects(c) {
+		return
+	}
+	projects, err := s.projects.ListProjects(c.Request.Context())
+	if err != nil {
+		s.abortWithProjectError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"projects": projects})
+}
+
+// CreateAPIKeyHandler issues a key for the project. The response is the only
+// place the key is returned.
+func (s *Server) CreateAPIKeyHandler(c *gin.Context) {
+	if !s.requireProjects(c) {
+		return
+	}
+	id, ok := pathID(c, database.ErrProjectNotFound)
+	if !ok {
+		return
+	}
+	var req ProjectRequest
+	// The name is optional, so is the body
+	if c.Request.ContentLength != 0 {
+		if err := s.bindJSON(c, &req); err != nil {
+			abortWithInvalid(c, err)
+			return
+		}
+	}
+
+	key, err := s.projects.CreateAPIKey(c.Request.Context(), id, req.Name)
+	if err != nil {
+		s.abortWithProjectError(c, err)
+		return
+	}
+	s.l.Warn("API key created", "id", key.ID, "project_id", key.ProjectID, "prefix", key.Prefix)
+	c.JSON(http.StatusCreated, key)
+}
+
+func (s *Server) ListAPIKeysHandler(c *gin.Context) {
+	if !s.requireProjects(c) {
+		return
+	}
+	id, ok := pathID(c, database.ErrProjectNotFound)
+	if !ok {
+		return
+	}
+	keys, err := s.projects.ListAPIKeys(c.Request.Context(), id)
+	if err != nil {
+		s.abortWithProjectError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// RevokeAPIKeyHandler stops accepting a key immediately.
+func (s *Server) RevokeAPIKeyHandler(c *gin.Context) {
+	if !s.requireProjects(c) {
+		return
+	}
+	id, ok := pathID(c, database.ErrAPIKeyNotFound)
+	if !ok {
+		return
+	}
+	if err := s.projects.RevokeAPIKey(c.Request.Context(), id); err != nil {
+		s.abortWithProjectError(c, err)
+		return
+	}
+	s.l.Warn("API key revoked", "id", id)
+	c.Status(http.StatusNoContent)
+}
+
+// projectIDQuery reads the optional project_id parameter of the admin event
+// routes.
+func projectIDQuery(c *gin.Context) (*int64, error) {
+	v := c.Query("project_id")
+	if v == "" {
+		return nil, nil
+	}
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("project_id must be an integer")
+	}
+	if id <= 0 {
+		return nil, ingest.NewFieldError("project_id", "out_of_range", "project_id must be a positive integer")
+	}
+	return &id, nil
+}
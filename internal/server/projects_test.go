@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeProjects accepts the key "key-7", id 3, for project 7.
+type fakeProjects struct {
+	projects []database.Project
+	revoked  []int64
+	err      error
+}
+
+func (f *fakeProjects) Authenticate(ctx context.Context, key string) (database.APIKey, error) {
+	if f.err != nil {
+		return database.APIKey{}, f.err
+	}
+	if key != "key-7" {
+		return database.APIKey{}, database.ErrAPIKeyNotFound
+	}
+	return database.APIKey{ID: 3, ProjectID: 7, Prefix: "seh_0123"}, nil
+}
+func (f *fakeProjects) CreateProject(ctx context.Context, name string) (database.Project, error) {
+	for _, p := range f.projects {
+		if p.Name == name {
+			return database.Project{}, database.ErrProjectExists
+		}
+	}
+	p := database.Project{ID: int64(len(f.projects) + 1), Name: name}
+	f.projects = append(f.projects, p)
+	return p, nil
+}
+func (f *fakeProjects) ListProjects(ctx context.Context) ([]database.Project, error) {
+	return f.projects, nil
+}
+func (f *fakeProjects) CreateAPIKey(ctx context.Context, projectID int64, name string) (database.APIKey, error) {
+	if projectID != 7 {
+		return database.APIKey{}, database.ErrProjectNotFound
+	}
+	return database.APIKey{ID: 3, ProjectID: 7, Name: name, Prefix: "seh_0123", Key: "key-7"}, nil
+}
+func (f *fakeProjects) ListAPIKeys(ctx context.Context, projectID int64) ([]database.APIKey, error) {
+	return []database.APIKey{{ID: 3, ProjectID: projectID, Prefix: "seh_0123"}}, nil
+}
+func (f *fakeProjects) RevokeAPIKey(ctx context.Context, id int64) error {
+	if id != 3 {
+		return database.ErrAPIKeyNotFound
+	}
+	f.revoked = append(f.revoked, id)
+	return nil
+}
+
+func TestProjectMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name            string
+		require         bool
+		authErr         error
+		header          string
+		query           string
+		expectedStatus  int
+		expectProjectID int64
+	}{
+		{name: "no key", expectedStatus: http.StatusCreated, expectProjectID: database.DefaultProjectID},
+		{name: "header key", header: "key-7", expectedStatus: http.StatusCreated, expectProjectID: 7},
+		{name: "query key", query: "?api_key=key-7", expectedStatus: http.StatusCreated, expectProjectID: 7},
+		{name: "invalid key", header: "key-8", expectedStatus: http.StatusUnauthorized},
+		{name: "required key", require: true, header: "key-7", expectedStatus: http.StatusCreated, expectProjectID: 7},
+		{name: "missing required key", require: true, expectedStatus: http.StatusUnauthorized},
+		{name: "store down", header: "key-7", authErr: errors.New("connection refused"), expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{insertID: 1}
+			s := &Server{l: logger, db: db, apiKeys: &fakeProjects{err: tt.authErr}, requireAPIKey: tt.require}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.ProjectMiddleware(), s.AddEventHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/events"+tt.query, strings.NewReader(`{"user_id":1,"action":"view"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set(APIKeyHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnauthorized {
+				assertProblem(t, rr, CodeUnauthorized)
+			}
+			if db.insertCalled != (tt.expectProjectID != 0) || db.lastProjectID != tt.expectProjectID {
+				t.Fatalf("expected the event stored in project %d, got %d (stored %v)", tt.expectProjectID, db.lastProjectID, db.insertCalled)
+			}
+		})
+	}
+}
+
+func TestProjectScopedRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := &mockDB{}
+	s := &Server{l: logger, db: db, apiKeys: &fakeProjects{}, importer: &fakeImporter{}}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(s.ProjectMiddleware())
+	router.GET("/events", s.GetEventsHandler)
+	router.POST("/events/batch", s.BatchEventsHandler)
+	router.GET("/beacon.gif", s.BeaconGIFHandler)
+	router.GET("/events/import/:id", s.GetImportJobHandler)
+
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(APIKeyHeader, "key-7")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(http.MethodGet, "/events?from=2025-01-01&to=2025-01-02", ""); rr.Code != http.StatusOK || db.getProjectID != 7 {
+		t.Fatalf("expected events of project 7, got status %d and project %d", rr.Code, db.getProjectID)
+	}
+	if rr := send(http.MethodPost, "/events/batch", `{"events":[{"user_id":1,"action":"view"}]}`); rr.Code != http.StatusOK || db.lastBatch[0].ProjectID != 7 {
+		t.Fatalf("expected the batch stored in project 7, got status %d and %+v", rr.Code, db.lastBatch)
+	}
+	// The key of a tracking pixel is not kept as metadata
+	if rr := send(http.MethodGet, "/beacon.gif?user_id=1&action=view&page=/&api_key=key-7", ""); rr.Code != http.StatusOK || db.lastProjectID != 7 || db.lastMeta["api_key"] != "" {
+		t.Fatalf("unexpected beacon event in project %d with metadata %v", db.lastProjectID, db.lastMeta)
+	}
+	// Job 42 belongs to the default project
+	if rr := send(http.MethodGet, "/events/import/42", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected the job of another project to be hidden, got status %d", rr.Code)
+	}
+}
+
+func TestProjectAdminRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "create project", method: http.MethodPost, path: "/projects", body: `{"name":"shop"}`, expectedStatus: http.StatusCreated, expectBody: `"name":"shop"`},
+		{name: "duplicate project", method: http.MethodPost, path: "/projects", body: `{"name":"default"}`, expectedStatus: http.StatusConflict, expectBody: CodeConflict},
+		{name: "unnamed project", method: http.MethodPost, path: "/projects", body: `{}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "list projects", method: http.MethodGet, path: "/projects", expectedStatus: http.StatusOK, expectBody: `"projects":[{"id":1`},
+		{name: "create key", method: http.MethodPost, path: "/projects/7/keys", body: `{"name":"backend"}`, expectedStatus: http.StatusCreated, expectBody: `"key":"key-7"`},
+		{name: "create key without body", method: http.MethodPost, path: "/projects/7/keys", expectedStatus: http.StatusCreated, expectBody: `"prefix":"seh_0123"`},
+		{name: "create key of unknown project", method: http.MethodPost, path: "/projects/9/keys", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{name: "list keys", method: http.MethodGet, path: "/projects/7/keys", expectedStatus: http.StatusOK, expectBody: `"keys":[{"id":3`},
+		{name: "revoke key", method: http.MethodDelete, path: "/keys/3", expectedStatus: http.StatusNoContent},
+		{name: "revoke unknown key", method: http.MethodDelete, path: "/keys/4", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{name: "not configured", unconfigured: true, method: http.MethodGet, path: "/projects", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			projects := &fakeProjects{projects: []database.Project{{ID: 1, Name: "default"}}}
+			s := &Server{l: logger, db: &mockDB{}, projects: projects}
+			if tt.unconfigured {
+				s.projects = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,364 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+// SavedQueries is the store of the saved queries of the projects.
+type SavedQueries interface {
+	CreateSavedQuery(ctx context.Context, q database.SavedQuery) (database.SavedQuery, error)
+	ListSavedQueries(ctx context.Context, projectID int64) ([]database.SavedQuery, error)
+	GetSavedQuery(ctx context.Context, projectID int64, name string) (database.SavedQuery, error)
+	UpdateSavedQuery(ctx context.Context, q database.SavedQuery) (database.SavedQuery, error)
+	DeleteSavedQuery(ctx context.Context, projectID int64, name string) error
+}
+
+const (
+	defaultQueryRangeSeconds = 24 * 60 * 60
+	maxQueryRangeSeconds     = 366 * 24 * 60 * 60
+)
+
+// savedQueryName keeps the names of saved queries usable in paths as they
+// are.
+var savedQueryName = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// groupings are the values of group_by: the events are counted by field, or
+// by hour or day of creation.
+var groupings = []string{"action", "user_id", "metadata.page", "hour", "day"}
+
+// SavedQueryRequest defines a saved query. The name of an update is the
+// one of its path.
+type SavedQueryRequest struct {
+	Name         string `json:"name"`
+	Filter       string `json:"filter"`
+	UserID       *int64 `json:"user_id"`
+	RangeSeconds int    `json:"range_seconds"`
+	GroupBy      string `json:"group_by"`
+	Format       string `json:"format"`
+	Limit        *int   `json:"limit"`
+}
+
+func (s *Server) savedQuery(r SavedQueryRequest) (database.SavedQuery, error) {
+	if !savedQueryName.MatchString(r.Name) {
+		return database.SavedQuery{}, ingest.NewFieldError("name", "invalid", "name must be 1 to 64 letters, digits, '_', '.' or '-'")
+	}
+	if r.Filter != "" {
+		if _, err := filter.Parse(r.Filter); err != nil {
+			return database.SavedQuery{}, ingest.NewFieldError("filter", "invalid", "filter: "+err.Error())
+		}
+	}
+	if r.UserID != nil && *r.UserID <= 0 {
+		return database.SavedQuery{}, ingest.NewFieldError("user_id", "out_of_range", "user_id must be a positive integer")
+	}
+	if r.RangeSeconds == 0 {
+		r.RangeSeconds = defaultQueryRangeSeconds
+	}
+	if r.RangeSeconds < 1 || r.RangeSeconds > maxQueryRangeSeconds {
+		return database.SavedQuery{}, ingest.NewFieldError("range_seconds", "out_of_range", fmt.Sprintf("range_seconds must be between 1 and %d", maxQueryRangeSeconds))
+	}
+	if r.GroupBy != "" && !slices.Contains(groupings, r.GroupBy) {
+		return database.SavedQuery{}, ingest.NewFieldError("group_by", "invalid", "group_by must be one of action, user_id, metadata.page, hour, day")
+	}
+	if r.Format == "" {
+		r.Format = formatJSON
+	}
+	if r.Format != formatJSON && r.Format != formatCSV {
+		return database.SavedQuery{}, ingest.NewFieldError("format", "invalid", "format must be json or csv")
+	}
+	if r.Limit != nil && (*r.Limit < 0 || (s.maxEventsLimit > 0 && *r.Limit > s.maxEventsLimit)) {
+		return database.SavedQuery{}, ingest.NewFieldError("limit", "out_of_range", fmt.Sprintf("limit must be 0 (every result) or a positive integer up to %d", s.maxEventsLimit))
+	}
+	return database.SavedQuery{
+		Name:         r.Name,
+		Filter:       r.Filter,
+		UserID:       r.UserID,
+		RangeSeconds: r.RangeSeconds,
+		GroupBy:      r.GroupBy,
+		Format:       r.Format,
+		Limit:        r.Limit,
+	}, nil
+}
+
+// requireSavedQueries answers 404 when saved queries are not available.
+func (s *Server) requireSavedQueries(c *gin.Context) bool {
+	if s.savedQueries == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "saved queries are not available")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithSavedQueryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, database.ErrSavedQueryNotFound):
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case errors.Is(err, database.ErrSavedQueryExists):
+		abortWithProblem(c, http.StatusConflict, CodeConflict, err.Error())
+		return
+	}
+	s.l.Error("saved query operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access saved queries")
+}
+
+// bindSavedQuery reads the query body, answering 400 when it is malformed
+// and 422 when it is invalid. name overrides the name of the body unless
+// empty.
+func (s *Server) bindSavedQuery(c *gin.Context, name string) (database.SavedQuery, bool) {
+	var req SavedQueryRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return database.SavedQuery{}, false
+	}
+	if name != "" {
+		req.Name = name
+	}
+	q, err := s.savedQuery(req)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return database.SavedQuery{}, false
+	}
+	q.ProjectID = projectID(c)
+	return q, true
+}
+
+func (s *Server) CreateSavedQueryHandler(c *gin.Context) {
+	if !s.requireSavedQueries(c) {
+		return
+	}
+	q, ok := s.bindSavedQuery(c, "")
+	if !ok {
+		return
+	}
+	created, err := s.savedQueries.CreateSavedQuery(c.Request.Context(), q)
+	if err != nil {
+		s.abortWithSavedQueryError(c, err)
+		return
+	}
+	c.Header("Location", c.FullPath()+"/"+created.Name)
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) ListSavedQueriesHandler(c *gin.Context) {
+	if !s.requireSavedQueries(c) {
+		return
+	}
+	queries, err := s.savedQueries.ListSavedQueries(c.Request.Context(), projectID(c))
+	if err != nil {
+		s.abortWithSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"queries": queries})
+}
+
+func (s *Server) GetSavedQueryHandler(c *gin.Context) {
+	if !s.requireSavedQueries(c) {
+		return
+	}
+	q, err := s.savedQueries.GetSavedQuery(c.Request.Context(), projectID(c), c.Param("name"))
+	if err != nil {
+		s.abortWithSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, q)
+}
+
+// UpdateSavedQueryHandler replaces the definition of a query.
+func (s *Server) UpdateSavedQueryHandler(c *gin.Context) {
+	if !s.requireSavedQueries(c) {
+		return
+	}
+	q, ok := s.bindSavedQuery(c, c.Param("name"))
+	if !ok {
+		return
+	}
+	updated, err := s.savedQueries.UpdateSavedQuery(c.Request.Context(), q)
+	if err != nil {
+		s.abortWithSavedQueryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+func (s *Server) DeleteSavedQueryHandler(c *gin.Context) {
+	if !s.requireSavedQueries(c) {
+		return
+	}
+	if err := s.savedQueries.DeleteSavedQuery(c.Request.Context(), projectID(c), c.Param("name")); err != nil {
+		s.abortWithSavedQueryError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// RunSavedQueryHandler answers GET /queries/:name/run with the result of a
+// saved query: its events like GET /events, or their counts by group. The
+// range ends now and spans range_seconds unless the request passes from or
+// to.
+func (s *Server) RunSavedQueryHandler(c *gin.Context) {
+	if !s.requireSavedQueries(c) {
+		return
+	}
+	q, err := s.savedQueries.GetSavedQuery(c.Request.Context(), projectID(c), c.Param("name"))
+	if err != nil {
+		s.abortWithSavedQueryError(c, err)
+		return
+	}
+
+	req := GetEventsRequest{Strict: s.strictTimesFor(c)}
+	end := time.Now().UTC()
+	if v := c.Query("to"); v != "" {
+		t, err := req.parseTime(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidTimeRange, fmt.Sprintf("invalid to parameter: %s", err))
+			return
+		}
+		end = *t
+	}
+	start := end.Add(-time.Duration(q.RangeSeconds) * time.Second)
+	if v := c.Query("from"); v != "" {
+		t, err := req.parseTime(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidTimeRange, fmt.Sprintf("invalid from parameter: %s", err))
+			return
+		}
+		start = *t
+	}
+	if start.After(end) {
+		err := ingest.NewFieldError("from", "out_of_range", "from must be before or equal to to")
+		abortWithFieldErrors(c, CodeInvalidTimeRange, err.Error(), fieldErrors(err))
+		return
+	}
+
+	var expr *filter.Expr
+	if q.Filter != "" {
+		if expr, err = filter.Parse(q.Filter); err != nil {
+			abortWithInvalid(c, ingest.NewFieldError("filter", "invalid", "filter: "+err.Error()))
+			return
+		}
+	}
+	limit := s.defaultEventsLimit
+	if q.Limit != nil {
+		limit = *q.Limit
+	}
+
+	if !s.reserve(c, quota.Queries, 1) {
+		return
+	}
+	if q.GroupBy == "" {
+		// Every event is only read on the admin listener: limit 0 returns
+		// at most EVENTS_MAX_LIMIT events here, and every group below
+		if limit == 0 {
+			limit = s.maxEventsLimit
+		}
+		s.streamEvents(c, q.Format, expr, q.UserID, &start, &end, limit)
+		return
+	}
+	s.groupEvents(c, q, expr, start, end, limit)
+}
+
+// QueryGroup counts the events of a group of a saved query.
+type QueryGroup struct {
+	Key    string `json:"key"`
+	Events int64  `json:"events"`
+}
+
+// groupKey returns the group of e by field, or by hour or day of creation.
+func groupKey(groupBy string, e database.Event) string {
+	switch groupBy {
+	case "action":
+		return e.Action
+	case "user_id":
+		return strconv.FormatInt(e.UserID, 10)
+	case "metadata.page":
+		if e.MetadataPage == nil {
+			return ""
+		}
+		return *e.MetadataPage
+	case "hour":
+		return e.CreatedAt.UTC().Truncate(time.Hour).Format(time.RFC3339)
+	}
+	t := e.CreatedAt.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+}
+
+// groupEvents counts the events of a saved query by its group while they
+// are read, like GET /events with limit=0. Groups of time are in
+// chronological order, the others come by decreasing count; at most limit
+// groups are returned unless 0.
+func (s *Server) groupEvents(c *gin.Context, q database.SavedQuery, expr *filter.Expr, start, end time.Time, limit int) {
+	counts := make(map[string]int64)
+	count := func(e database.Event) error {
+		counts[groupKey(q.GroupBy, e)]++
+		return nil
+	}
+	var err error
+	if expr != nil {
+		err = s.db.FilterEvents(c.Request.Context(), projectID(c), expr, q.UserID, &start, &end, 0, count)
+	} else {
+		err = s.db.StreamEvents(c.Request.Context(), projectID(c), q.UserID, &start, &end, 0, count)
+	}
+	switch {
+	case errors.Is(err, database.ErrFilterUnsupported):
+		s.release(c, quota.Queries, 1)
+		abortWithInvalid(c, ingest.NewFieldError("filter", "unsupported", err.Error()))
+		return
+	case err != nil:
+		s.release(c, quota.Queries, 1)
+		s.l.Error("failed to run saved query", "query", q.Name, "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to run saved query")
+		return
+	}
+
+	groups := make([]QueryGroup, 0, len(counts))
+	for k, n := range counts {
+		groups = append(groups, QueryGroup{Key: k, Events: n})
+	}
+	chronological := q.GroupBy == "hour" || q.GroupBy == "day"
+	slices.SortFunc(groups, func(a, b QueryGroup) int {
+		if n := cmp.Compare(b.Events, a.Events); !chronological && n != 0 {
+			return n
+		}
+		// RFC3339 times in UTC sort as strings
+		return cmp.Compare(a.Key, b.Key)
+	})
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+		c.Header("X-Result-Truncated", "true")
+	}
+
+	if q.Format == formatCSV {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		_ = w.Write([]string{q.GroupBy, "events"})
+		for _, g := range groups {
+			_ = w.Write([]string{g.Key, strconv.FormatInt(g.Events, 10)})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			s.l.Error("failed to write saved query result", "query", q.Name, "error", err)
+			_ = c.Error(err)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"name": q.Name, "from": start, "to": end, "group_by": q.GroupBy, "groups": groups})
+}
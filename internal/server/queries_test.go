@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeSavedQueries struct {
+	queries map[string]database.SavedQuery
+}
+
+func (f *fakeSavedQueries) CreateSavedQuery(ctx context.Context, q database.SavedQuery) (database.SavedQuery, error) {
+	if _, ok := f.queries[q.Name]; ok {
+		return database.SavedQuery{}, database.ErrSavedQueryExists
+	}
+	q.ID = int64(len(f.queries) + 1)
+	f.queries[q.Name] = q
+	return q, nil
+}
+func (f *fakeSavedQueries) ListSavedQueries(ctx context.Context, projectID int64) ([]database.SavedQuery, error) {
+	var out []database.SavedQuery
+	for _, q := range f.queries {
+		out = append(out, q)
+	}
+	return out, nil
+}
+func (f *fakeSavedQueries) GetSavedQuery(ctx context.Context, projectID int64, name string) (database.SavedQuery, error) {
+	q, ok := f.queries[name]
+	if !ok {
+		return database.SavedQuery{}, database.ErrSavedQueryNotFound
+	}
+	return q, nil
+}
+func (f *fakeSavedQueries) UpdateSavedQuery(ctx context.Context, q database.SavedQuery) (database.SavedQuery, error) {
+	if _, ok := f.queries[q.Name]; !ok {
+		return database.SavedQuery{}, database.ErrSavedQueryNotFound
+	}
+	f.queries[q.Name] = q
+	return q, nil
+}
+func (f *fakeSavedQueries) DeleteSavedQuery(ctx context.Context, projectID int64, name string) error {
+	if _, ok := f.queries[name]; !ok {
+		return database.ErrSavedQueryNotFound
+	}
+	delete(f.queries, name)
+	return nil
+}
+
+func TestSavedQueryRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	checkout, docs := "/checkout", "/docs"
+	events := []database.Event{
+		{ID: 3, UserID: 42, Action: "click", MetadataPage: &checkout, CreatedAt: time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)},
+		{ID: 2, UserID: 42, Action: "view", MetadataPage: &docs, CreatedAt: time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)},
+		{ID: 1, UserID: 7, Action: "view", CreatedAt: time.Date(2025, 3, 9, 23, 0, 0, 0, time.UTC)},
+	}
+	one := 1
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		filterErr      error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+		expectQueries  int
+		expectFilter   bool
+	}{
+		{name: "create", method: http.MethodPost, path: "/queries", body: `{"name":"checkout-clicks","filter":"action == \"click\"","group_by":"day"}`, expectedStatus: http.StatusCreated, expectBody: `"range_seconds":86400,"group_by":"day","format":"json"`, expectQueries: 3},
+		{name: "create a taken name", method: http.MethodPost, path: "/queries", body: `{"name":"views"}`, expectedStatus: http.StatusConflict, expectBody: CodeConflict, expectQueries: 2},
+		{name: "create without name", method: http.MethodPost, path: "/queries", body: `{"filter":"action == \"click\""}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"name"`, expectQueries: 2},
+		{name: "create with a name unfit for paths", method: http.MethodPost, path: "/queries", body: `{"name":"checkout/clicks"}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"name"`, expectQueries: 2},
+		{name: "create with an invalid filter", method: http.MethodPost, path: "/queries", body: `{"name":"x","filter":"action = \"click\""}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"filter"`, expectQueries: 2},
+		{name: "create with an unknown grouping", method: http.MethodPost, path: "/queries", body: `{"name":"x","group_by":"week"}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"group_by"`, expectQueries: 2},
+		{name: "create with an unknown format", method: http.MethodPost, path: "/queries", body: `{"name":"x","format":"xml"}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"format"`, expectQueries: 2},
+		{name: "create with a long range", method: http.MethodPost, path: "/queries", body: `{"name":"x","range_seconds":40000000}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"range_seconds"`, expectQueries: 2},
+		{name: "list", method: http.MethodGet, path: "/queries", expectedStatus: http.StatusOK, expectBody: `"name":"views"`, expectQueries: 2},
+		{name: "get", method: http.MethodGet, path: "/queries/views", expectedStatus: http.StatusOK, expectBody: `"group_by":"action"`, expectQueries: 2},
+		{name: "get unknown", method: http.MethodGet, path: "/queries/clicks", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectQueries: 2},
+		{name: "update", method: http.MethodPut, path: "/queries/views", body: `{"group_by":"hour","format":"csv"}`, expectedStatus: http.StatusOK, expectBody: `"name":"views","range_seconds":86400,"group_by":"hour","format":"csv"`, expectQueries: 2},
+		{name: "update unknown", method: http.MethodPut, path: "/queries/clicks", body: `{}`, expectedStatus: http.StatusNotFound, expectQueries: 2},
+		{name: "delete", method: http.MethodDelete, path: "/queries/views", expectedStatus: http.StatusNoContent, expectQueries: 1},
+		{name: "delete unknown", method: http.MethodDelete, path: "/queries/clicks", expectedStatus: http.StatusNotFound, expectQueries: 2},
+		{name: "run grouped", method: http.MethodGet, path: "/queries/views/run?from=2025-03-01T00:00:00Z&to=2025-03-11T00:00:00Z", expectedStatus: http.StatusOK, expectBody: `"group_by":"action","groups":[{"key":"view","events":2},{"key":"click","events":1}]`, expectQueries: 2, expectFilter: true},
+		{name: "run events as csv", method: http.MethodGet, path: "/queries/latest/run", expectedStatus: http.StatusOK, expectBody: "id,user_id,action,metadata_page,created_at\n3,42,click,/checkout,2025-03-10T12:00:00Z\n", expectQueries: 2},
+		{name: "run with from after to", method: http.MethodGet, path: "/queries/views/run?from=2025-03-11T00:00:00Z&to=2025-03-01T00:00:00Z", expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeInvalidTimeRange, expectQueries: 2},
+		{name: "run with an unsupported filter", filterErr: database.ErrFilterUnsupported, method: http.MethodGet, path: "/queries/views/run", expectedStatus: http.StatusUnprocessableEntity, expectBody: `"code":"unsupported"`, expectQueries: 2, expectFilter: true},
+		{name: "run while the database is down", filterErr: errors.New("connection refused"), method: http.MethodGet, path: "/queries/views/run", expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable, expectQueries: 2, expectFilter: true},
+		{name: "run unknown", method: http.MethodGet, path: "/queries/clicks/run", expectedStatus: http.StatusNotFound, expectQueries: 2},
+		{name: "not available", unconfigured: true, method: http.MethodGet, path: "/queries", expectedStatus: http.StatusNotFound, expectBody: "not available"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := &fakeSavedQueries{queries: map[string]database.SavedQuery{
+				"views":  {ID: 1, ProjectID: 1, Name: "views", Filter: `action != "leave"`, RangeSeconds: 86400, GroupBy: "action", Format: "json"},
+				"latest": {ID: 2, ProjectID: 1, Name: "latest", RangeSeconds: 3600, Format: "csv", Limit: &one},
+			}}
+			db := &mockDB{getResults: events, filterErr: tt.filterErr}
+			s := &Server{l: logger, db: db, savedQueries: queries, defaultEventsLimit: 1000}
+			if tt.unconfigured {
+				s.savedQueries = nil
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/queries", s.CreateSavedQueryHandler)
+			router.GET("/queries", s.ListSavedQueriesHandler)
+			router.GET("/queries/:name", s.GetSavedQueryHandler)
+			router.PUT("/queries/:name", s.UpdateSavedQueryHandler)
+			router.DELETE("/queries/:name", s.DeleteSavedQueryHandler)
+			router.GET("/queries/:name/run", s.RunSavedQueryHandler)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if !tt.unconfigured && len(queries.queries) != tt.expectQueries {
+				t.Fatalf("expected %d queries got %d", tt.expectQueries, len(queries.queries))
+			}
+			if (db.getFilter != nil) != tt.expectFilter {
+				t.Fatalf("expected filter %v, got %v", tt.expectFilter, db.getFilter)
+			}
+		})
+	}
+}
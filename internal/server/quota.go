@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+// Quotas meters the events and queries of API keys. Reserve returns a
+// *quota.ExceededError when a quota would be exceeded.
+type Quotas interface {
+	Reserve(keyID int64, kind string, n int64) error
+	Release(keyID int64, kind string, n int64)
+	Usage(ctx context.Context, keyID int64) (quota.Report, error)
+}
+
+// reserve counts n events or queries against the quotas of the API key of
+// the request; requests without a key are not metered. When a quota is
+// exceeded the problem response is written and reserve returns false.
+func (s *Server) reserve(c *gin.Context, kind string, n int64) bool {
+	keyID, ok := apiKeyID(c)
+	if !ok || s.quotas == nil {
+		return true
+	}
+	err := s.quotas.Reserve(keyID, kind, n)
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		retry := math.Ceil(time.Until(exceeded.Reset).Seconds())
+		c.Header("Retry-After", strconv.Itoa(max(int(retry), 1)))
+		abortWithProblem(c, http.StatusTooManyRequests, CodeQuotaExceeded, err.Error())
+		return false
+	}
+	return true
+}
+
+// release gives back what reserve counted for a request that failed.
+func (s *Server) release(c *gin.Context, kind string, n int64) {
+	if keyID, ok := apiKeyID(c); ok && s.quotas != nil {
+		s.quotas.Release(keyID, kind, n)
+	}
+}
+
+// UsageHandler reports the usage and quotas of the API key of the request.
+func (s *Server) UsageHandler(c *gin.Context) {
+	if s.quotas == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "quotas are not configured")
+		return
+	}
+	keyID, ok := apiKeyID(c)
+	if !ok {
+		abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, "usage is reported for API keys only")
+		return
+	}
+
+	report, err := s.quotas.Usage(c.Request.Context(), keyID)
+	if err != nil {
+		s.l.Error("failed to load API key usage", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to load usage")
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+// fakeQuotas allows limit units of each kind per key.
+type fakeQuotas struct {
+	limit int64
+	used  map[string]int64
+}
+
+func (f *fakeQuotas) Reserve(keyID int64, kind string, n int64) error {
+	if f.used[kind]+n > f.limit {
+		return &quota.ExceededError{Kind: kind, Period: "day", Limit: int(f.limit), Reset: time.Now().Add(time.Hour)}
+	}
+	f.used[kind] += n
+	return nil
+}
+func (f *fakeQuotas) Release(keyID int64, kind string, n int64) {
+	f.used[kind] -= n
+}
+func (f *fakeQuotas) Usage(ctx context.Context, keyID int64) (quota.Report, error) {
+	if keyID != 3 {
+		return quota.Report{}, errors.New("unexpected key")
+	}
+	return quota.Report{APIKeyID: keyID, Day: quota.Period{Events: f.used[quota.Events], EventsQuota: int(f.limit)}}, nil
+}
+
+func TestQuotas(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := &mockDB{insertID: 1}
+	quotas := &fakeQuotas{limit: 3, used: map[string]int64{}}
+	s := &Server{l: logger, db: db, apiKeys: &fakeProjects{}, quotas: quotas}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(s.ProjectMiddleware())
+	router.POST("/events", s.AddEventHandler)
+	router.POST("/events/batch", s.BatchEventsHandler)
+	router.GET("/events", s.GetEventsHandler)
+	router.GET("/usage", s.UsageHandler)
+
+	send := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(APIKeyHeader, key)
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+	event := `{"user_id":1,"action":"view"}`
+
+	if rr := send(http.MethodPost, "/events", "key-7", event); rr.Code != http.StatusCreated || quotas.used[quota.Events] != 1 {
+		t.Fatalf("expected the event to be counted, got status %d and usage %v", rr.Code, quotas.used)
+	}
+	// Requests without a key are not metered
+	if rr := send(http.MethodPost, "/events", "", event); rr.Code != http.StatusCreated || quotas.used[quota.Events] != 1 {
+		t.Fatalf("expected the event not to be counted, got status %d and usage %v", rr.Code, quotas.used)
+	}
+	// Failed inserts are not counted
+	db.insertErr = errors.New("connection refused")
+	if rr := send(http.MethodPost, "/events", "key-7", event); rr.Code != http.StatusInternalServerError || quotas.used[quota.Events] != 1 {
+		t.Fatalf("expected the failed event to be released, got status %d and usage %v", rr.Code, quotas.used)
+	}
+	db.insertErr = nil
+
+	rr := send(http.MethodPost, "/events/batch", "key-7", `{"events":[`+event+`,`+event+`,`+event+`]}`)
+	if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" || db.lastBatch != nil {
+		t.Fatalf("expected the batch over quota to be rejected, got status %d, body: %s", rr.Code, rr.Body.String())
+	}
+	assertProblem(t, rr, CodeQuotaExceeded)
+	if rr := send(http.MethodPost, "/events/batch", "key-7", `{"events":[`+event+`,`+event+`]}`); rr.Code != http.StatusOK || quotas.used[quota.Events] != 3 {
+		t.Fatalf("expected the batch to be counted, got status %d and usage %v", rr.Code, quotas.used)
+	}
+
+	if rr := send(http.MethodGet, "/events?from=2025-01-01&to=2025-01-02", "key-7", ""); rr.Code != http.StatusOK || quotas.used[quota.Queries] != 1 {
+		t.Fatalf("expected the query to be counted, got status %d and usage %v", rr.Code, quotas.used)
+	}
+
+	if rr := send(http.MethodGet, "/usage", "key-7", ""); rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"events":3`) {
+		t.Fatalf("unexpected usage response %d: %s", rr.Code, rr.Body.String())
+	}
+	rr = send(http.MethodGet, "/usage", "", "")
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected usage to require a key, got status %d", rr.Code)
+	}
+	assertProblem(t, rr, CodeUnauthorized)
+
+	s.quotas = nil
+	if rr := send(http.MethodGet, "/usage", "key-7", ""); rr.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 without quotas, got status %d", rr.Code)
+	}
+}
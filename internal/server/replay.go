@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/replay"
+)
+
+// Replays publishes historical events again to a sink, operated through
+// the admin listener.
+type Replays interface {
+	Submit(ctx context.Context, req replay.Request) (replay.Run, error)
+	Get(id string) (replay.Run, error)
+	List() []replay.Run
+}
+
+// ReplayRequest selects the events created in [from, to), optionally of a
+// single user and action, and the sink they are replayed to.
+type ReplayRequest struct {
+	UserID         *int64    `json:"user_id"`
+	Action         string    `json:"action"`
+	From           time.Time `json:"from" binding:"required"`
+	To             time.Time `json:"to" binding:"required"`
+	Sink           string    `json:"sink" binding:"required"`
+	SubscriptionID int64     `json:"subscription_id"`
+	Topic          string    `json:"topic"`
+}
+
+// requireReplays answers 404 when no sink can be replayed to.
+func (s *Server) requireReplays(c *gin.Context) bool {
+	if s.replays == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "replay is not configured")
+		return false
+	}
+	return true
+}
+
+// CreateReplayHandler queues a replay and answers 202 with it.
+func (s *Server) CreateReplayHandler(c *gin.Context) {
+	if !s.requireReplays(c) {
+		return
+	}
+	var req ReplayRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+
+	run, err := s.replays.Submit(c.Request.Context(), replay.Request{
+		UserID:         req.UserID,
+		Action:         req.Action,
+		From:           req.From,
+		To:             req.To,
+		Sink:           req.Sink,
+		SubscriptionID: req.SubscriptionID,
+		Topic:          req.Topic,
+	})
+	switch {
+	case errors.Is(err, replay.ErrInvalid):
+		abortWithFieldErrors(c, CodeValidationFailed, err.Error(), []FieldError{{Code: "invalid", Message: err.Error()}})
+		return
+	case errors.Is(err, replay.ErrBusy), errors.Is(err, replay.ErrClosed):
+		c.Header("Retry-After", "60")
+		abortWithProblem(c, http.StatusServiceUnavailable, CodeOverloaded, err.Error())
+		return
+	case err != nil:
+		s.l.Error("failed to submit replay", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to submit replay")
+		return
+	}
+
+	c.Header("Location", path.Join(c.Request.URL.Path, run.ID))
+	c.JSON(http.StatusAccepted, run)
+}
+
+// ListReplaysHandler lists the recent replays, newest first.
+func (s *Server) ListReplaysHandler(c *gin.Context) {
+	if !s.requireReplays(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replays": s.replays.List()})
+}
+
+func (s *Server) GetReplayHandler(c *gin.Context) {
+	if !s.requireReplays(c) {
+		return
+	}
+	run, err := s.replays.Get(c.Param("id"))
+	if err != nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, run)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/replay"
+)
+
+type fakeReplays struct {
+	err  error
+	runs map[string]replay.Run
+}
+
+func (f *fakeReplays) Submit(ctx context.Context, req replay.Request) (replay.Run, error) {
+	if f.err != nil {
+		return replay.Run{}, f.err
+	}
+	run := replay.Run{ID: "2", Request: req, Status: replay.StatusQueued}
+	f.runs[run.ID] = run
+	return run, nil
+}
+func (f *fakeReplays) Get(id string) (replay.Run, error) {
+	run, ok := f.runs[id]
+	if !ok {
+		return replay.Run{}, replay.ErrNotFound
+	}
+	return run, nil
+}
+func (f *fakeReplays) List() []replay.Run {
+	var out []replay.Run
+	for _, run := range f.runs {
+		out = append(out, run)
+	}
+	return out
+}
+
+func TestReplayRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const body = `{"user_id":7,"from":"2025-01-01T00:00:00Z","to":"2025-01-02T00:00:00Z","sink":"webhook","subscription_id":3}`
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		submitErr      error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "submit", method: http.MethodPost, path: "/replay", body: body, expectedStatus: http.StatusAccepted, expectBody: `"user_id":7`},
+		{name: "submit without sink", method: http.MethodPost, path: "/replay", body: `{"from":"2025-01-01T00:00:00Z","to":"2025-01-02T00:00:00Z"}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "submit an unknown subscription", submitErr: fmt.Errorf("%w: subscription 3 not found", replay.ErrInvalid), method: http.MethodPost, path: "/replay", body: body, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "submit while busy", submitErr: replay.ErrBusy, method: http.MethodPost, path: "/replay", body: body, expectedStatus: http.StatusServiceUnavailable, expectBody: CodeOverloaded},
+		{name: "list", method: http.MethodGet, path: "/replay", expectedStatus: http.StatusOK, expectBody: `"replays":[`},
+		{name: "get", method: http.MethodGet, path: "/replay/1", expectedStatus: http.StatusOK, expectBody: `"status":"succeeded"`},
+		{name: "get unknown", method: http.MethodGet, path: "/replay/3", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{name: "not configured", unconfigured: true, method: http.MethodPost, path: "/replay", body: body, expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			replays := &fakeReplays{err: tt.submitErr, runs: map[string]replay.Run{"1": {ID: "1", Status: replay.StatusSucceeded}}}
+			s := &Server{l: logger, db: &mockDB{}, replays: replays}
+			if tt.unconfigured {
+				s.replays = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusAccepted && rr.Header().Get("Location") != "/replay/2" {
+				t.Fatalf("unexpected location %q", rr.Header().Get("Location"))
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// recoveryHandler reports recovered panics to the error reporter and answers
+// with a problem instead of an empty 500.
+func (s *Server) recoveryHandler(c *gin.Context, recovered any) {
+	s.l.Error("panic recovered", "panic", fmt.Sprint(recovered), "path", c.FullPath())
+	if s.reporter != nil {
+		s.reporter.CapturePanic(c.Request.Context(), c.Request, recovered, debug.Stack())
+	}
+	abortWithProblem(c, http.StatusInternalServerError, CodeInternal, "")
+}
+
+// ErrorReportingMiddleware reports every 5xx response. Handlers attach the
+// underlying cause with c.Error; responses without one are reported with a
+// synthetic error naming the route and status. Panics unwind past this
+// middleware and are reported by the recovery handler instead.
+func (s *Server) ErrorReportingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		status := c.Writer.Status()
+		if s.reporter == nil || status < http.StatusInternalServerError {
+			return
+		}
+
+		ctx := c.Request.Context()
+		if len(c.Errors) == 0 {
+			s.reporter.CaptureError(ctx, c.Request, fmt.Errorf("%s %s responded with status %d", c.Request.Method, c.FullPath(), status))
+			return
+		}
+		for _, e := range c.Errors {
+			s.reporter.CaptureError(ctx, c.Request, e.Err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeReporter records reports instead of sending them.
+type fakeReporter struct {
+	panics []any
+	errs   []error
+}
+
+func (f *fakeReporter) CapturePanic(_ context.Context, _ *http.Request, recovered any, _ []byte) {
+	f.panics = append(f.panics, recovered)
+}
+func (f *fakeReporter) CaptureError(_ context.Context, _ *http.Request, err error) {
+	f.errs = append(f.errs, err)
+}
+func (f *fakeReporter) Flush(time.Duration) bool { return true }
+
+func TestErrorReporting(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		handler        gin.HandlerFunc
+		expectedStatus int
+		expectPanics   int
+		expectErrs     int
+	}{
+		{
+			name:           "success is not reported",
+			handler:        func(c *gin.Context) { c.Status(http.StatusOK) },
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "client error is not reported",
+			handler:        func(c *gin.Context) { c.Status(http.StatusBadRequest) },
+			expectedStatus: http.StatusBadRequest,
+		},
+		{
+			name: "server error with cause",
+			handler: func(c *gin.Context) {
+				_ = c.Error(errors.New("boom"))
+				abortWithProblem(c, http.StatusInternalServerError, CodeDBUnavailable, "")
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectErrs:     1,
+		},
+		{
+			name:           "server error without cause",
+			handler:        func(c *gin.Context) { c.Status(http.StatusBadGateway) },
+			expectedStatus: http.StatusBadGateway,
+			expectErrs:     1,
+		},
+		{
+			name:           "panic",
+			handler:        func(c *gin.Context) { panic("kaboom") },
+			expectedStatus: http.StatusInternalServerError,
+			expectPanics:   1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reporter := &fakeReporter{}
+			s := &Server{l: logger, reporter: reporter}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(gin.CustomRecovery(s.recoveryHandler))
+			router.Use(s.ErrorReportingMiddleware())
+			router.GET("/test", tt.handler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d", tt.expectedStatus, rr.Code)
+			}
+			if len(reporter.panics) != tt.expectPanics {
+				t.Fatalf("expected %d panics reported got %d", tt.expectPanics, len(reporter.panics))
+			}
+			if len(reporter.errs) != tt.expectErrs {
+				t.Fatalf("expected %d errors reported got %d", tt.expectErrs, len(reporter.errs))
+			}
+		})
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -11,37 +14,114 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/buffer"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
 )
 
 type AddEventRequest struct {
 	UserID   int64             `json:"user_id" binding:"required"`
 	Action   string            `json:"action" binding:"required"`
 	Metadata map[string]string `json:"metadata"`
+	// DeliverAt, when in the future, keeps the event pending until then
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// TTLSeconds, when set, removes the event that long after it is
+	// created
+	TTLSeconds int `json:"ttl_seconds,omitempty"`
+	// SchemaVersion is the version of the shape of the event, 1 when
+	// missing
+	SchemaVersion int `json:"schema_version,omitempty"`
 }
 
+// Validate applies the rules shared with the queue ingestion sources.
 func (a AddEventRequest) Validate() error {
-	if a.UserID <= 0 {
-		return fmt.Errorf("user_id must be a positive integer")
+	return a.event().Validate()
+}
+
+func (a AddEventRequest) event() ingest.Event {
+	return ingest.Event{UserID: a.UserID, Action: a.Action, Metadata: a.Metadata, TTLSeconds: a.TTLSeconds, SchemaVersion: a.SchemaVersion}
+}
+
+// AddEventRequestFromProto converts an AddEvent message of the canonical
+// event model. Its project_id is left out: the project is the one of the
+// API key.
+func AddEventRequestFromProto(m *eventsv1.AddEvent) AddEventRequest {
+	req := AddEventRequest{
+		UserID:        m.GetUserId(),
+		Action:        m.GetAction(),
+		Metadata:      m.GetMetadata(),
+		TTLSeconds:    int(m.GetTtlSeconds()),
+		SchemaVersion: int(m.GetSchemaVersion()),
 	}
-	if a.Action == "" {
-		return fmt.Errorf("action is required")
+	if m.GetDeliverAt() != nil {
+		deliverAt := m.GetDeliverAt().AsTime()
+		req.DeliverAt = &deliverAt
 	}
-	return nil
+	return req
 }
 
+// protobufContentType marks the bodies holding a message of the canonical
+// event model.
+const protobufContentType = "application/x-protobuf"
+
 type GetEventsRequest struct {
 	UserID *int64
 	From   string
 	To     string
+	// Strict accepts RFC3339 times only (STRICT_TIME_PARSING)
+	Strict bool
 }
 
-// parseTimeFlexible tries to unescape the input (handles values that were URL-encoded
-// multiple times like "%2520") and parse using several common time layouts.
-func (r GetEventsRequest) parseTimeFlexible(v string) (*time.Time, error) {
+// flexibleLayouts are the time layouts accepted besides RFC3339 when
+// parsing is not strict.
+var flexibleLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// flexibleTimes counts the times only understood by the flexible parser,
+// which is deprecated in favor of STRICT_TIME_PARSING.
+var flexibleTimes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "deprecated_time_format_total",
+		Help: "GET /events times that are not plain RFC3339: escaped more than once or in another layout",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(flexibleTimes)
+}
+
+// parseTime parses v as RFC3339, or with parseTimeFlexible unless the
+// request is strict.
+func (r GetEventsRequest) parseTime(v string) (*time.Time, error) {
 	if v == "" {
 		return nil, fmt.Errorf("empty time string")
 	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return &t, nil
+	}
+	if r.Strict {
+		hint := ""
+		if strings.Contains(v, " ") {
+			hint = ` (a "+" of the offset must be sent as %2B)`
+		}
+		return nil, fmt.Errorf("unrecognized time format: %q, the accepted layout is RFC3339, e.g. 2025-01-02T15:04:05Z%s", v, hint)
+	}
+	return r.parseTimeFlexible(v)
+}
 
+// parseTimeFlexible tries to unescape the input (handles values that were URL-encoded
+// multiple times like "%2520") and parse using several common time layouts.
+func (r GetEventsRequest) parseTimeFlexible(v string) (*time.Time, error) {
 	// Unescape up to a few times to handle double-encoding like %2520 -> %20 -> space
 	uv := v
 	for i := 0; i < 3; i++ {
@@ -59,44 +139,41 @@ func (r GetEventsRequest) parseTimeFlexible(v string) (*time.Time, error) {
 		return nil, fmt.Errorf("empty time after unescape")
 	}
 
-	layouts := []string{
-		time.RFC3339,
-		time.RFC3339Nano,
-		"2006-01-02 15:04:05",
-		"2006-01-02T15:04:05",
-		"2006-01-02",
+	if t, err := time.Parse(time.RFC3339, uv); err == nil {
+		flexibleTimes.WithLabelValues("escaped").Inc()
+		return &t, nil
 	}
-
-	for _, l := range layouts {
+	for _, l := range flexibleLayouts {
 		if t, err := time.Parse(l, uv); err == nil {
+			flexibleTimes.WithLabelValues("layout").Inc()
 			return &t, nil
 		}
 	}
-	return nil, fmt.Errorf("unrecognized time format: %q", v)
+	return nil, fmt.Errorf("unrecognized time format: %q, the accepted layouts are RFC3339 (e.g. 2025-01-02T15:04:05Z), %s", v, strings.Join(flexibleLayouts, ", "))
 }
 
 func (r *GetEventsRequest) Validate() (*time.Time, *time.Time, error) {
 	// user id (if present) must be positive
 	if r.UserID != nil && *r.UserID <= 0 {
-		return nil, nil, fmt.Errorf("user_id must be a positive integer")
+		return nil, nil, ingest.NewFieldError("user_id", "out_of_range", "user_id must be a positive integer")
 	}
 	if r.From == "" {
-		return nil, nil, fmt.Errorf("from paramater")
+		return nil, nil, ingest.NewFieldError("from", "required", "from parameter is required")
 	}
 
-	start, err := r.parseTimeFlexible(r.From)
+	start, err := r.parseTime(r.From)
 	if err != nil {
 		return nil, nil, fmt.Errorf("invalid from parameter: %w", err)
 	}
 
-	end, err := r.parseTimeFlexible(r.To)
+	end, err := r.parseTime(r.To)
 	if err != nil {
 		return nil, nil, fmt.Errorf("invalid to parameter: %w", err)
 	}
 
 	// from must not be after to
 	if start.After(*end) {
-		return nil, nil, fmt.Errorf("from must be before or equal to to")
+		return nil, nil, ingest.NewFieldError("from", "out_of_range", "from must be before or equal to to")
 	}
 
 	return start, end, nil
@@ -119,34 +196,225 @@ func (s *Server) RegisterRoutes(basePath string) http.Handler {
 		[]string{"path", "method"},
 	)
 
-	prometheus.MustRegister(httpRequests, httpDuration)
+	httpResponseSize := prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "http_response_size_bytes",
+			Help:    "Size of HTTP response bodies in bytes",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		},
+		[]string{"path", "method"},
+	)
+
+	if s.limiter == nil {
+		s.limiter = newConcurrencyLimiter()
+	}
+
+	prometheus.MustRegister(httpRequests, httpDuration, httpResponseSize, s.limiter.inFlightGauge, s.limiter.shedCounter)
 	s.httpRequestCounter = httpRequests
 	s.httpRequestDuration = httpDuration
+	s.httpResponseSize = httpResponseSize
+	s.basePath = basePath
 
 	gin.SetMode(gin.ReleaseMode)
 	r := gin.New()
-	r.Use(gin.Recovery())
+	r.HandleMethodNotAllowed = true
+	if err := r.SetTrustedProxies(s.trustedProxies); err != nil {
+		s.l.Error("invalid trusted proxies", "error", err)
+	}
+	// Registered on the engine, before recovery, so that unmatched routes
+	// and recovered panics are counted as well
+	r.Use(s.LogMetricsMiddleware())
+	r.Use(gin.CustomRecovery(s.recoveryHandler))
+	r.Use(s.IPFilterMiddleware())
+	r.NoRoute(noRouteHandler)
+	r.NoMethod(noMethodHandler)
+
+	if s.cors.Load() == nil {
+		s.setCORS(config.CORSConfig{})
+	}
+	r.Use(s.CORSMiddleware())
+
+	base := r.Group(basePath)
+	// First, so that the requests shed or rejected are recorded too
+	base.Use(s.RecordMiddleware())
+	base.Use(s.ConcurrencyLimitMiddleware())
+	base.Use(s.ErrorReportingMiddleware())
+	base.Use(s.ProjectMiddleware())
+	base.POST("/events", s.TimeoutMiddleware(s.ingestTimeout), s.SignatureMiddleware(), s.AddEventHandler)
+	base.GET("/events", s.TimeoutMiddleware(s.queryTimeout), s.GetEventsHandler)
+	// Events forwarded by edge deployments, see internal/sink/forward
+	base.POST("/events/batch", s.TimeoutMiddleware(s.ingestTimeout), s.SignatureMiddleware(), s.BatchEventsHandler)
+	// Uploads are bounded by the server read timeout rather than the ingest
+	// deadline; the import itself runs in the background
+	base.POST("/events/import", s.ImportEventsHandler)
+	base.GET("/events/import/:id", s.GetImportJobHandler)
+	base.POST("/events/:id/tags", s.AddEventTagsHandler)
+	base.GET("/events/:id/tags", s.ListEventTagsHandler)
+	base.DELETE("/events/:id/tags/:tag", s.RemoveEventTagHandler)
+	// Tracking pixel and navigator.sendBeacon endpoint for static pages
+	base.GET("/beacon.gif", s.TimeoutMiddleware(s.ingestTimeout), s.BeaconGIFHandler)
+	base.POST("/beacon", s.TimeoutMiddleware(s.ingestTimeout), s.BeaconHandler)
+	base.POST("/webhooks/:provider", s.TimeoutMiddleware(s.ingestTimeout), s.WebhookHandler)
+	base.GET("/usage", s.UsageHandler)
+	base.GET("/stats/retention", s.TimeoutMiddleware(s.queryTimeout), s.RetentionHandler)
+	base.GET("/stats/timeseries", s.TimeoutMiddleware(s.queryTimeout), s.TimeSeriesHandler)
+	base.GET("/users/:id/sessions", s.TimeoutMiddleware(s.queryTimeout), s.UserSessionsHandler)
+	base.POST("/queries", s.CreateSavedQueryHandler)
+	base.GET("/queries", s.ListSavedQueriesHandler)
+	base.GET("/queries/:name", s.GetSavedQueryHandler)
+	base.PUT("/queries/:name", s.UpdateSavedQueryHandler)
+	base.DELETE("/queries/:name", s.DeleteSavedQueryHandler)
+	base.GET("/queries/:name/run", s.TimeoutMiddleware(s.queryTimeout), s.RunSavedQueryHandler)
+	// Exports too large for GET /events run as background jobs
+	base.POST("/exports", s.CreateExportJobHandler)
+	base.GET("/jobs/:id", s.GetJobHandler)
+	base.GET("/jobs/:id/artifact", s.GetJobArtifactHandler)
+
+	return r
+}
+
+func (s *Server) LogMetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		method := c.Request.Method
+		requestID := assignRequestID(c)
+
+		c.Next()
+
+		path := routeLabel(c)
+
+		duration := time.Since(start).Seconds()
+		status := strconv.Itoa(c.Writer.Status())
+
+		s.logRequest(c, path, requestID, time.Since(start))
+
+		s.httpRequestCounter.WithLabelValues(path, method, status).Inc()
+		s.httpRequestDuration.WithLabelValues(path, method).Observe(duration)
+		s.httpResponseSize.WithLabelValues(path, method).Observe(float64(max(c.Writer.Size(), 0)))
+	}
+}
+
+// RequestLogMiddleware logs the requests as LogMetricsMiddleware does,
+// without recording metrics, for the listeners other than the API.
+func (s *Server) RequestLogMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := assignRequestID(c)
+
+		c.Next()
+
+		s.logRequest(c, routeLabel(c), requestID, time.Since(start))
+	}
+}
+
+// logRequest logs the request of c unless shouldLogRequest skips it.
+func (s *Server) logRequest(c *gin.Context, path, requestID string, duration time.Duration) {
+	if !s.shouldLogRequest(c.Request.URL.Path, c.Writer.Status(), duration) {
+		return
+	}
+	s.l.Info("HTTP request",
+		"method", c.Request.Method,
+		"path", path,
+		"status", strconv.Itoa(c.Writer.Status()),
+		"duration_sec", duration.Seconds(),
+		"client_ip", c.ClientIP(),
+		"request_id", requestID,
+	)
+}
+
+// unknownRoute labels requests that matched no route, so that scanners
+// hitting random URLs cannot explode the metrics cardinality.
+const unknownRoute = "unknown"
+
+// routeLabel returns the route template (e.g. /api/events/:id) of the
+// request rather than its concrete path.
+func routeLabel(c *gin.Context) string {
+	if p := c.FullPath(); p != "" {
+		return p
+	}
+	return unknownRoute
+}
+
+// requestLogSettings controls which requests LogMetricsMiddleware logs.
+type requestLogSettings struct {
+	sampleRate   uint64
+	slowRequest  time.Duration
+	excludePaths map[string]struct{}
+}
+
+func (s *Server) setRequestLogSettings(cfg config.LogConfig) {
+	settings := &requestLogSettings{
+		sampleRate:   uint64(max(cfg.RequestSampleRate, 1)),
+		slowRequest:  time.Duration(cfg.SlowRequestMillis) * time.Millisecond,
+		excludePaths: make(map[string]struct{}, len(cfg.ExcludePaths)),
+	}
+	for _, p := range cfg.ExcludePaths {
+		settings.excludePaths[p] = struct{}{}
+	}
+	s.logSettings.Store(settings)
+}
+
+// shouldLogRequest decides whether a request is logged: excluded paths,
+// with or without the base path, never are, errors and slow requests always
+// are, and successful requests are sampled 1 in sampleRate.
+func (s *Server) shouldLogRequest(path string, status int, duration time.Duration) bool {
+	settings := s.logSettings.Load()
+	if settings == nil {
+		return true
+	}
+	if _, ok := settings.excludePaths[path]; ok {
+		return false
+	}
+	if _, ok := settings.excludePaths[s.routePath(path)]; ok {
+		return false
+	}
+	if status >= http.StatusBadRequest {
+		return true
+	}
+	if settings.slowRequest > 0 && duration >= settings.slowRequest {
+		return true
+	}
+	if settings.sampleRate <= 1 {
+		return true
+	}
+	return s.requestCount.Add(1)%settings.sampleRate == 1
+}
+
+// routePath is path without the base path the routes are served under, or
+// path itself when it is outside of it.
+func (s *Server) routePath(path string) string {
+	base := strings.TrimSuffix(s.basePath, "/")
+	if rest, ok := strings.CutPrefix(path, base); ok && base != "" && strings.HasPrefix(rest, "/") {
+		return rest
+	}
+	return path
+}
+
+// setCORS builds the CORS middleware from cfg, falling back to defaults for
+// missing values, and swaps it in for new requests.
+func (s *Server) setCORS(c config.CORSConfig) {
+	origins, methods, headers := c.AllowOrigins, c.AllowMethods, c.AllowHeaders
 
 	// Ensure defaults if something is missing
-	if len(s.corsAllowOrigins) == 0 {
-		s.corsAllowOrigins = []string{"http://localhost:3000"}
+	if len(origins) == 0 {
+		origins = []string{"http://localhost:3000"}
 	}
-	if len(s.corsAllowMethods) == 0 {
-		s.corsAllowMethods = []string{"GET", "POST"}
+	if len(methods) == 0 {
+		methods = []string{"GET", "POST"}
 	}
-	if len(s.corsAllowHeaders) == 0 {
-		s.corsAllowHeaders = []string{"Accept", "Authorization", "Content-Type"}
+	if len(headers) == 0 {
+		headers = []string{"Accept", "Authorization", "Content-Type", "X-API-Key"}
 	}
 
 	cfg := cors.Config{
-		AllowMethods:     s.corsAllowMethods,
-		AllowHeaders:     s.corsAllowHeaders,
-		AllowCredentials: s.corsAllowCredentials,
+		AllowMethods:     methods,
+		AllowHeaders:     headers,
+		AllowCredentials: c.AllowCredentials,
 	}
 
 	// If origins contains "*" enable AllowAllOrigins, otherwise set AllowOrigins
 	isAllOriginAllowed := false
-	for _, o := range s.corsAllowOrigins {
+	for _, o := range origins {
 		if o == "*" {
 			isAllOriginAllowed = true
 			break
@@ -155,77 +423,177 @@ func (s *Server) RegisterRoutes(basePath string) http.Handler {
 	if isAllOriginAllowed {
 		cfg.AllowAllOrigins = true
 	} else {
-		cfg.AllowOrigins = s.corsAllowOrigins
+		cfg.AllowOrigins = origins
 	}
 
-	r.Use(cors.New(cfg))
-
-	base := r.Group(basePath)
-	base.Use(s.LogMetricsMiddleware())
-	base.POST("/events", s.AddEventHandler)
-	base.GET("/events", s.GetEventsHandler)
-
-	return r
+	h := cors.New(cfg)
+	s.cors.Store(&h)
 }
 
-func (s *Server) LogMetricsMiddleware() gin.HandlerFunc {
+// CORSMiddleware delegates to the current CORS handler, which may be replaced
+// by a configuration reload.
+func (s *Server) CORSMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		start := time.Now()
-		path := c.FullPath()
-		method := c.Request.Method
-
-		c.Next()
-
-		duration := time.Since(start).Seconds()
-		status := strconv.Itoa(c.Writer.Status())
-
-		s.l.Info("HTTP request",
-			"method", method,
-			"path", path,
-			"status", status,
-			"duration_sec", duration,
-			"client_ip", c.ClientIP(),
-		)
-
-		s.httpRequestCounter.WithLabelValues(path, method, status).Inc()
-		s.httpRequestDuration.WithLabelValues(path, method).Observe(duration)
+		(*s.cors.Load())(c)
 	}
 }
 
 func (s *Server) AddEventHandler(c *gin.Context) {
 	var req AddEventRequest
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+	// The body is an AddEvent message with the protobuf content type
+	if c.ContentType() == protobufContentType {
+		body, err := io.ReadAll(c.Request.Body)
+		var m eventsv1.AddEvent
+		if err == nil {
+			err = proto.Unmarshal(body, &m)
+		}
+		if err != nil {
+			abortWithInvalid(c, err)
+			return
+		}
+		req = AddEventRequestFromProto(&m)
+	} else if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
 		return
 	}
 
 	if err := req.Validate(); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "validation failed", "details": err.Error()})
+		abortWithInvalid(c, err)
+		return
+	}
+
+	if req.DeliverAt != nil {
+		if req.DeliverAt.After(time.Now().Add(s.maxDeliverDelay)) {
+			abortWithInvalid(c, ingest.NewFieldError("deliver_at", "out_of_range", fmt.Sprintf("deliver_at must be at most %d days ahead", int(s.maxDeliverDelay.Hours()/24))))
+			return
+		}
+		// An event due already is stored right away
+		if req.DeliverAt.After(time.Now()) {
+			s.scheduleEvent(c, req.event(), *req.DeliverAt)
+			return
+		}
+	}
+
+	res, ok := s.storeEvent(c, req.event())
+	if !ok {
 		return
 	}
+	switch {
+	case res.duplicate != nil:
+		c.JSON(http.StatusOK, res.duplicate)
+	case res.accepted:
+		c.Status(http.StatusAccepted)
+	default:
+		c.Status(http.StatusCreated)
+	}
+}
+
+// storeResult tells how storeEvent handled an event.
+type storeResult struct {
+	// accepted reports that the event was queued or spooled rather than
+	// stored
+	accepted bool
+	// duplicate is the identical event stored within the deduplication
+	// window, when the event was not stored again
+	duplicate *database.Event
+}
+
+// storeEvent inserts a validated event into the project of the request, or
+// enqueues it in write-behind mode. On failure the problem response is
+// written and ok is false.
+func (s *Server) storeEvent(c *gin.Context, e ingest.Event) (res storeResult, ok bool) {
+	e.ProjectID = projectID(c)
+	if !s.checkUsers(c, e.UserID) {
+		return res, false
+	}
+	if !s.reserve(c, quota.Events, 1) {
+		return res, false
+	}
+	if s.asyncIngest(c) {
+		err := s.queue.Enqueue(c.Request.Context(), e)
+		switch {
+		case errors.Is(err, buffer.ErrFull):
+			s.release(c, quota.Events, 1)
+			c.Header("Retry-After", "1")
+			abortWithProblem(c, http.StatusTooManyRequests, CodeBufferFull, "too many events waiting to be stored, retry later")
+			return res, false
+		case err != nil:
+			s.release(c, quota.Events, 1)
+			c.Header("Retry-After", "1")
+			abortWithProblem(c, http.StatusServiceUnavailable, CodeOverloaded, err.Error())
+			return res, false
+		}
+		return storeResult{accepted: true}, true
+	}
 
 	// Insert into DB
 	ctx := c.Request.Context()
-	_, err := s.db.InsertEvent(ctx, req.UserID, req.Action, req.Metadata)
+	var err error
+	if s.dedup != nil {
+		var stored database.Event
+		var duplicate bool
+		stored, duplicate, err = s.dedup.Insert(ctx, database.NewEvent{ProjectID: e.ProjectID, UserID: e.UserID, Action: e.Action, Metadata: e.Metadata, TTL: e.TTL(), SchemaVersion: e.SchemaVersion})
+		if err == nil && duplicate {
+			s.release(c, quota.Events, 1)
+			return storeResult{duplicate: &stored}, true
+		}
+	} else if e.TTLSeconds > 0 || e.SchemaVersion > 1 {
+		err = s.db.InsertEvents(ctx, []database.NewEvent{{ProjectID: e.ProjectID, UserID: e.UserID, Action: e.Action, Metadata: e.Metadata, TTL: e.TTL(), SchemaVersion: e.SchemaVersion}})
+	} else {
+		_, err = s.db.InsertEvent(ctx, e.ProjectID, e.UserID, e.Action, e.Metadata)
+	}
+	if err != nil && s.spool != nil {
+		serr := s.spool.Append(e)
+		if serr == nil {
+			s.l.Warn("insert failed, event spooled", "error", err)
+			return storeResult{accepted: true}, true
+		}
+		s.l.Error("failed to spool event", "error", serr)
+	}
 	if err != nil {
+		s.release(c, quota.Events, 1)
 		s.l.Error("failed to insert event", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert event"})
-		return
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to insert event")
+		return res, false
 	}
+	return res, true
+}
 
-	c.Status(http.StatusCreated)
+// scheduleEvent stores a validated event in the pending events of the
+// project of the request, to be delivered by the scheduler at deliverAt.
+// The write-behind queue, the deduplication and the spool apply to the
+// events when they are received only, so they are skipped.
+func (s *Server) scheduleEvent(c *gin.Context, e ingest.Event, deliverAt time.Time) {
+	e.ProjectID = projectID(c)
+	if !s.checkUsers(c, e.UserID) {
+		return
+	}
+	if !s.reserve(c, quota.Events, 1) {
+		return
+	}
+	deliverAt = deliverAt.UTC()
+	err := s.db.InsertEvents(c.Request.Context(), []database.NewEvent{{ProjectID: e.ProjectID, UserID: e.UserID, Action: e.Action, Metadata: e.Metadata, DeliverAt: deliverAt, TTL: e.TTL(), SchemaVersion: e.SchemaVersion}})
+	if err != nil {
+		s.release(c, quota.Events, 1)
+		s.l.Error("failed to schedule event", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to schedule event")
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"deliver_at": deliverAt})
 }
 
 func (s *Server) GetEventsHandler(c *gin.Context) {
 	// Build request from query params
-	var req GetEventsRequest
+	req := GetEventsRequest{Strict: s.strictTimesFor(c)}
 
 	// optional user_id
 	if v := c.Query("user_id"); v != "" {
 		uid, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user_id"})
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidUserID, "user_id must be an integer")
 			return
 		}
 		req.UserID = &uid
@@ -236,19 +604,68 @@ func (s *Server) GetEventsHandler(c *gin.Context) {
 
 	startPtr, endPtr, err := req.Validate()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid time format", "details": err.Error()})
+		// Times that cannot be parsed are malformed, the others break a rule
+		if fields := fieldErrors(err); fields != nil {
+			abortWithFieldErrors(c, CodeInvalidTimeRange, err.Error(), fields)
+			return
+		}
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidTimeRange, err.Error())
 		return
 	}
 
-	// Query DB
-	ctx := c.Request.Context()
-	events, err := s.db.GetEvents(ctx, req.UserID, startPtr, endPtr)
-	if err != nil {
-		s.l.Error("failed to query events", "error", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch events"})
-		return
+	// Results are bounded, unless the admin asks for every event with
+	// limit=0; the API keys export larger ranges with a job
+	limit := s.defaultEventsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be an integer")
+			return
+		}
+		admin := c.GetBool(adminKey)
+		if n < 0 || (n == 0 && !admin) || (s.maxEventsLimit > 0 && n > s.maxEventsLimit) {
+			msg := fmt.Sprintf("limit must be a positive integer up to %d", s.maxEventsLimit)
+			if admin {
+				msg = fmt.Sprintf("limit must be 0 (every event) or a positive integer up to %d", s.maxEventsLimit)
+			}
+			abortWithInvalid(c, ingest.NewFieldError("limit", "out_of_range", msg))
+			return
+		}
+		limit = n
+	}
+
+	// An expression for the fields without a parameter of their own
+	var expr *filter.Expr
+	if v := c.Query("filter"); v != "" {
+		if expr, err = filter.Parse(v); err != nil {
+			abortWithInvalid(c, ingest.NewFieldError("filter", "invalid", "filter: "+err.Error()))
+			return
+		}
 	}
 
-	// Return JSON array of events
-	c.JSON(http.StatusOK, events)
+	// The archived events are read from a table without the indexes of the
+	// events, so they are only read on request
+	if v := c.Query("include_archive"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			abortWithInvalid(c, ingest.NewFieldError("include_archive", "invalid", "include_archive must be true or false"))
+			return
+		}
+		if include {
+			c.Request = c.Request.WithContext(database.WithArchive(c.Request.Context()))
+		}
+	}
+
+	// Every event is read within the export deadline, the admin listener
+	// having no query deadline
+	if limit == 0 && s.exportTimeout > 0 {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), s.exportTimeout)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+	}
+
+	if !s.reserve(c, quota.Queries, 1) {
+		return
+	}
+	s.streamEvents(c, formatJSON, expr, req.UserID, startPtr, endPtr, limit)
 }
@@ -9,50 +9,148 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"log/slog"
 
+	"github.com/arimatakao/simple-events-handler/internal/config"
 	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/dedup"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/ingest/buffer"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/proto"
 )
 
 // mockDB implements the database.Service interface minimally for testing.
 type mockDB struct {
-	insertCalled bool
-	lastUserID   int64
-	lastAction   string
-	lastMeta     map[string]string
-	insertID     int64
-	insertErr    error
+	insertCalled  bool
+	lastProjectID int64
+	lastUserID    int64
+	lastAction    string
+	lastMeta      map[string]string
+	insertID      int64
+	insertErr     error
+	lastBatch     []database.NewEvent
+	// events stored by InsertEventOnce, by fingerprint
+	stored map[string]database.Event
 	// get events
-	getCalled  bool
-	getUserID  *int64
-	getStart   *time.Time
-	getEnd     *time.Time
-	getResults []database.Event
-	getErr     error
+	getCalled    bool
+	getProjectID int64
+	getUserID    *int64
+	getStart     *time.Time
+	getEnd       *time.Time
+	getLimit     int
+	getResults   []database.Event
+	getErr       error
+	getFilter    *filter.Expr
+	getArchive   bool
+	filterErr    error
+	// health
+	health map[string]string
 }
 
-func (m *mockDB) Health() map[string]string { return map[string]string{"status": "ok"} }
-func (m *mockDB) Close() error              { return nil }
-func (m *mockDB) InsertEvent(ctx context.Context, userID int64, action string, metadata map[string]string) (int64, error) {
+func (m *mockDB) Health() map[string]string {
+	if m.health != nil {
+		return m.health
+	}
+	return map[string]string{"status": "ok"}
+}
+func (m *mockDB) Close() error { return nil }
+func (m *mockDB) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
 	m.insertCalled = true
+	m.lastProjectID = projectID
 	m.lastUserID = userID
 	m.lastAction = action
 	m.lastMeta = metadata
 	return m.insertID, m.insertErr
 }
-func (m *mockDB) GetEvents(ctx context.Context, userID *int64, start *time.Time, end *time.Time) ([]database.Event, error) {
+func (m *mockDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	m.lastBatch = events
+	return m.insertErr
+}
+func (m *mockDB) InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error) {
+	if m.insertErr != nil {
+		return database.Event{}, false, m.insertErr
+	}
+	if existing, ok := m.stored[e.Fingerprint()]; ok {
+		return existing, true, nil
+	}
+	if m.stored == nil {
+		m.stored = make(map[string]database.Event)
+	}
+	m.insertID++
+	stored := database.Event{ID: m.insertID, UserID: e.UserID, Action: e.Action, CreatedAt: time.Now()}
+	m.stored[e.Fingerprint()] = stored
+	return stored, false, nil
+}
+func (m *mockDB) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
 	m.getCalled = true
+	m.getProjectID = projectID
 	m.getUserID = userID
 	m.getStart = start
 	m.getEnd = end
-	return m.getResults, m.getErr
+	m.getLimit = limit
+	m.getArchive = database.ArchiveIncluded(ctx)
+	if m.getErr != nil {
+		return nil, m.getErr
+	}
+	if limit > 0 && len(m.getResults) > limit {
+		return m.getResults[:limit], nil
+	}
+	return m.getResults, nil
+}
+func (m *mockDB) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	events, err := m.GetEvents(ctx, projectID, userID, start, end, limit)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (m *mockDB) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	m.getFilter = expr
+	if m.filterErr != nil {
+		return m.filterErr
+	}
+	return m.StreamEvents(ctx, projectID, userID, start, end, limit, fn)
 }
 func (m *mockDB) AggregateEvents(seconds int) error { return nil }
 
+// assertProblem checks that the response is an RFC 7807 problem with the expected code.
+func assertProblem(t *testing.T, rr *httptest.ResponseRecorder, code string) {
+	t.Helper()
+	if ct := rr.Header().Get("Content-Type"); ct != ProblemContentType {
+		t.Fatalf("expected content type %q got %q", ProblemContentType, ct)
+	}
+	var p Problem
+	if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+		t.Fatalf("failed to decode problem: %v", err)
+	}
+	if p.Code != code {
+		t.Fatalf("expected problem code %q got %q", code, p.Code)
+	}
+	if p.Status != rr.Code {
+		t.Fatalf("expected problem status %d got %d", rr.Code, p.Status)
+	}
+	if p.Type == "" || p.Title == "" {
+		t.Fatalf("expected problem type and title to be set, got %+v", p)
+	}
+}
+
 // TestAddEventHandler_Success ensures that a valid POST /events calls InsertEvent and returns 201.
 func TestAddEventHandler(t *testing.T) {
 	// silent logger
@@ -62,8 +160,10 @@ func TestAddEventHandler(t *testing.T) {
 		name           string
 		mockSetup      func() *mockDB
 		requestBody    []byte
+		contentType    string
 		expectedStatus int
 		expectDBCalled bool
+		expectCode     string
 	}{
 		{
 			name: "success",
@@ -77,6 +177,30 @@ func TestAddEventHandler(t *testing.T) {
 			expectedStatus: http.StatusCreated,
 			expectDBCalled: true,
 		},
+		{
+			name: "success with protobuf",
+			mockSetup: func() *mockDB {
+				return &mockDB{insertID: 42}
+			},
+			requestBody: func() []byte {
+				b, _ := proto.Marshal(&eventsv1.AddEvent{UserId: 1, Action: "click", Metadata: map[string]string{"page": "home"}})
+				return b
+			}(),
+			contentType:    protobufContentType,
+			expectedStatus: http.StatusCreated,
+			expectDBCalled: true,
+		},
+		{
+			name: "invalid protobuf",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			requestBody:    []byte{0x08},
+			contentType:    protobufContentType,
+			expectedStatus: http.StatusBadRequest,
+			expectDBCalled: false,
+			expectCode:     CodeInvalidRequest,
+		},
 		{
 			name: "invalid json",
 			mockSetup: func() *mockDB {
@@ -85,6 +209,7 @@ func TestAddEventHandler(t *testing.T) {
 			requestBody:    []byte("{bad json}"),
 			expectedStatus: http.StatusBadRequest,
 			expectDBCalled: false,
+			expectCode:     CodeInvalidRequest,
 		},
 		{
 			name: "validation: missing action",
@@ -95,8 +220,9 @@ func TestAddEventHandler(t *testing.T) {
 				b, _ := json.Marshal(AddEventRequest{UserID: 1, Action: "", Metadata: nil})
 				return b
 			}(),
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnprocessableEntity,
 			expectDBCalled: false,
+			expectCode:     CodeValidationFailed,
 		},
 		{
 			name: "validation: non-positive user id",
@@ -107,8 +233,32 @@ func TestAddEventHandler(t *testing.T) {
 				b, _ := json.Marshal(AddEventRequest{UserID: 0, Action: "click", Metadata: nil})
 				return b
 			}(),
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnprocessableEntity,
 			expectDBCalled: false,
+			expectCode:     CodeValidationFailed,
+		},
+		{
+			name: "validation: too many metadata keys",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			requestBody:    []byte(`{"user_id":1,"action":"click","metadata":{"a":"1","b":"2","c":"3"}}`),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectDBCalled: false,
+			expectCode:     CodeValidationFailed,
+		},
+		{
+			name: "validation: action breaking the naming rules",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			requestBody: func() []byte {
+				b, _ := json.Marshal(AddEventRequest{UserID: 1, Action: "Click", Metadata: nil})
+				return b
+			}(),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectDBCalled: false,
+			expectCode:     CodeActionNotAllowed,
 		},
 		{
 			name: "db insert error",
@@ -121,9 +271,17 @@ func TestAddEventHandler(t *testing.T) {
 			}(),
 			expectedStatus: http.StatusInternalServerError,
 			expectDBCalled: true,
+			expectCode:     CodeDBUnavailable,
 		},
 	}
 
+	rules, err := ingest.NewRules(config.ValidationConfig{ActionPattern: "[a-z_]+", MaxMetadataKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest.SetRules(rules)
+	t.Cleanup(func() { ingest.SetRules(nil) })
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mock := tt.mockSetup()
@@ -142,6 +300,9 @@ func TestAddEventHandler(t *testing.T) {
 				t.Fatalf("failed to create request: %v", err)
 			}
 			req.Header.Set("Content-Type", "application/json")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
 
 			rr := httptest.NewRecorder()
 			router.ServeHTTP(rr, req)
@@ -150,6 +311,10 @@ func TestAddEventHandler(t *testing.T) {
 				t.Fatalf("%s: expected status %d got %d, body: %s", tt.name, tt.expectedStatus, rr.Code, rr.Body.String())
 			}
 
+			if tt.expectCode != "" {
+				assertProblem(t, rr, tt.expectCode)
+			}
+
 			if tt.expectDBCalled && !mock.insertCalled {
 				t.Fatalf("%s: expected InsertEvent to be called", tt.name)
 			}
@@ -158,7 +323,7 @@ func TestAddEventHandler(t *testing.T) {
 			}
 
 			// additional checks for success case
-			if tt.name == "success" {
+			if tt.expectedStatus == http.StatusCreated {
 				if mock.lastUserID != 1 {
 					t.Fatalf("expected user id 1 got %d", mock.lastUserID)
 				}
@@ -173,6 +338,340 @@ func TestAddEventHandler(t *testing.T) {
 	}
 }
 
+func TestAddEventHandlerDeliverAt(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := func(deliverAt time.Time) []byte {
+		b, _ := json.Marshal(AddEventRequest{UserID: 1, Action: "click", DeliverAt: &deliverAt})
+		return b
+	}
+
+	tests := []struct {
+		name            string
+		body            []byte
+		insertErr       error
+		expectedStatus  int
+		expectScheduled bool
+		expectStored    bool
+		expectCode      string
+	}{
+		{name: "future event is scheduled", body: body(time.Now().Add(time.Hour)), expectedStatus: http.StatusAccepted, expectScheduled: true},
+		{name: "past event is stored right away", body: body(time.Now().Add(-time.Hour)), expectedStatus: http.StatusCreated, expectStored: true},
+		{name: "too far ahead", body: body(time.Now().Add(48 * time.Hour)), expectedStatus: http.StatusUnprocessableEntity, expectCode: CodeValidationFailed},
+		{name: "db error", body: body(time.Now().Add(time.Hour)), insertErr: fmt.Errorf("boom"), expectedStatus: http.StatusInternalServerError, expectScheduled: true, expectCode: CodeDBUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := &mockDB{insertErr: tt.insertErr}
+			s := &Server{l: logger, db: mock, maxDeliverDelay: 24 * time.Hour}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.AddEventHandler)
+
+			req := httptest.NewRequest("POST", "/events", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectCode != "" {
+				assertProblem(t, rr, tt.expectCode)
+			}
+			if mock.insertCalled != tt.expectStored {
+				t.Fatalf("expected InsertEvent called %v, got %v", tt.expectStored, mock.insertCalled)
+			}
+			scheduled := len(mock.lastBatch) == 1 && !mock.lastBatch[0].DeliverAt.IsZero()
+			if scheduled != tt.expectScheduled {
+				t.Fatalf("expected the event scheduled %v, got %+v", tt.expectScheduled, mock.lastBatch)
+			}
+		})
+	}
+}
+
+func TestAddEventHandlerTTL(t *testing.T) {
+	mock := &mockDB{}
+	s := &Server{l: slog.New(slog.NewTextHandler(io.Discard, nil)), db: mock, maxDeliverDelay: 24 * time.Hour}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/events", s.AddEventHandler)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post(`{"user_id":1,"action":"click","ttl_seconds":-1}`); rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected a negative ttl to be rejected, got %d", rr.Code)
+	}
+	if rr := post(`{"user_id":1,"action":"click","ttl_seconds":60}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(mock.lastBatch) != 1 || mock.lastBatch[0].TTL != time.Minute {
+		t.Fatalf("expected the event stored with its ttl, got %+v", mock.lastBatch)
+	}
+	deliverAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	if rr := post(`{"user_id":1,"action":"click","ttl_seconds":60,"deliver_at":"` + deliverAt + `"}`); rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(mock.lastBatch) != 1 || mock.lastBatch[0].TTL != time.Minute || mock.lastBatch[0].DeliverAt.IsZero() {
+		t.Fatalf("expected the event scheduled with its ttl, got %+v", mock.lastBatch)
+	}
+}
+
+func TestAddEventHandlerSchemaVersion(t *testing.T) {
+	rules, err := ingest.NewRules(config.ValidationConfig{SchemaVersions: []config.SchemaVersionConfig{{Version: 2, RequiredMetadata: []string{"page"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest.SetRules(rules)
+	t.Cleanup(func() { ingest.SetRules(nil) })
+
+	mock := &mockDB{}
+	s := &Server{l: slog.New(slog.NewTextHandler(io.Discard, nil)), db: mock}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/events", s.AddEventHandler)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := post(`{"user_id":1,"action":"click","schema_version":3}`); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `"field":"schema_version"`) {
+		t.Fatalf("expected an unregistered version to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := post(`{"user_id":1,"action":"click","schema_version":2}`); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), `"field":"metadata.page"`) {
+		t.Fatalf("expected a missing required key to be rejected, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if rr := post(`{"user_id":1,"action":"click","schema_version":2,"metadata":{"page":"/home"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(mock.lastBatch) != 1 || mock.lastBatch[0].SchemaVersion != 2 {
+		t.Fatalf("expected the event stored with its version, got %+v", mock.lastBatch)
+	}
+}
+
+// fakeQueue records events enqueued by the write-behind mode.
+type fakeQueue struct {
+	events []ingest.Event
+	err    error
+}
+
+func (q *fakeQueue) Enqueue(ctx context.Context, e ingest.Event) error {
+	if q.err != nil {
+		return q.err
+	}
+	q.events = append(q.events, e)
+	return nil
+}
+
+func TestValidationFieldErrors(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name         string
+		path         string
+		body         string
+		expectFields []FieldError
+	}{
+		{name: "binding tags", path: "/events", body: `{"metadata":{}}`, expectFields: []FieldError{
+			{Field: "user_id", Code: "required", Message: "user_id is required"},
+			{Field: "action", Code: "required", Message: "action is required"},
+		}},
+		{name: "event rules", path: "/events", body: `{"user_id":-1,"action":"view"}`, expectFields: []FieldError{
+			{Field: "user_id", Code: "out_of_range", Message: "user_id must be a positive integer"},
+		}},
+		{name: "batch element", path: "/events/batch", body: `{"events":[{"user_id":1,"action":"view"},{"user_id":1,"action":""}]}`, expectFields: []FieldError{
+			{Field: "events[1].action", Code: "required", Message: "action is required"},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{insertID: 1}}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.AddEventHandler)
+			router.POST("/events/batch", s.BatchEventsHandler)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("expected status 422 got %d, body: %s", rr.Code, rr.Body.String())
+			}
+			var p Problem
+			if err := json.Unmarshal(rr.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(p.Errors, tt.expectFields) {
+				t.Fatalf("expected fields %+v got %+v", tt.expectFields, p.Errors)
+			}
+		})
+	}
+}
+
+func TestAddEventHandlerAsync(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		queueErr       error
+		synchronous    bool
+		expectedStatus int
+		expectCode     string
+	}{
+		{name: "accepted", expectedStatus: http.StatusAccepted},
+		{name: "stored when the flag is off for the project", synchronous: true, expectedStatus: http.StatusCreated},
+		{name: "buffer full", queueErr: buffer.ErrFull, expectedStatus: http.StatusTooManyRequests, expectCode: CodeBufferFull},
+		{name: "shutting down", queueErr: buffer.ErrClosed, expectedStatus: http.StatusServiceUnavailable, expectCode: CodeOverloaded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{}
+			q := &fakeQueue{err: tt.queueErr}
+			s := &Server{l: logger, db: db, queue: q, flags: &fakeFlags{enabled: map[string]bool{flags.AsyncIngest: !tt.synchronous}}}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.AddEventHandler)
+
+			body := []byte(`{"user_id":1,"action":"click","metadata":{"page":"home"}}`)
+			req := httptest.NewRequest("POST", "/events", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectCode != "" {
+				if rr.Header().Get("Retry-After") == "" {
+					t.Fatalf("expected a Retry-After header")
+				}
+				assertProblem(t, rr, tt.expectCode)
+			}
+			if tt.synchronous {
+				if !db.insertCalled || len(q.events) != 0 {
+					t.Fatalf("expected the event to be stored, got %+v enqueued", q.events)
+				}
+				return
+			}
+			if db.insertCalled {
+				t.Fatalf("expected InsertEvent not to be called in async mode")
+			}
+			if tt.queueErr == nil && (len(q.events) != 1 || q.events[0].Metadata["page"] != "home") {
+				t.Fatalf("expected the event to be enqueued, got %+v", q.events)
+			}
+		})
+	}
+}
+
+// fakeSpool records the events spooled after a failed insert.
+type fakeSpool struct {
+	events []ingest.Event
+	err    error
+}
+
+func (f *fakeSpool) Append(e ingest.Event) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.events = append(f.events, e)
+	return nil
+}
+
+func TestAddEventHandlerSpool(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		insertErr      error
+		spoolErr       error
+		expectedStatus int
+		expectSpooled  int
+	}{
+		{name: "stored", expectedStatus: http.StatusCreated},
+		{name: "spooled when the insert fails", insertErr: fmt.Errorf("db down"), expectedStatus: http.StatusAccepted, expectSpooled: 1},
+		{name: "spool full", insertErr: fmt.Errorf("db down"), spoolErr: fmt.Errorf("spool is full"), expectedStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := &fakeSpool{err: tt.spoolErr}
+			s := &Server{l: logger, db: &mockDB{insertErr: tt.insertErr}, spool: sp}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.AddEventHandler)
+
+			req := httptest.NewRequest("POST", "/events", bytes.NewReader([]byte(`{"user_id":1,"action":"click"}`)))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if len(sp.events) != tt.expectSpooled {
+				t.Fatalf("expected %d spooled events got %d", tt.expectSpooled, len(sp.events))
+			}
+		})
+	}
+}
+
+func TestAddEventHandlerDedup(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	db := &mockDB{}
+	s := &Server{l: logger, db: db, dedup: dedup.New(db, time.Minute, 0)}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/events", s.AddEventHandler)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	if rr := send(`{"user_id":1,"action":"click","metadata":{"page":"/a","ref":"x"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d got %d, body: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	rr := send(`{"action":"click","user_id":1,"metadata":{"ref":"x","page":"/a"}}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the duplicate to be answered with %d, got %d, body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	var existing database.Event
+	if err := json.Unmarshal(rr.Body.Bytes(), &existing); err != nil {
+		t.Fatal(err)
+	}
+	if existing.ID != 1 {
+		t.Fatalf("expected the first event to be returned, got %+v", existing)
+	}
+	if rr := send(`{"user_id":1,"action":"click","metadata":{"page":"/b","ref":"x"}}`); rr.Code != http.StatusCreated {
+		t.Fatalf("expected other metadata to be stored, got status %d", rr.Code)
+	}
+	if len(db.stored) != 2 {
+		t.Fatalf("expected 2 events stored got %d", len(db.stored))
+	}
+}
+
 // TestGetEventsHandler covers GET /events behavior with various query parameters.
 func TestGetEventsHandler(t *testing.T) {
 	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
@@ -184,9 +683,13 @@ func TestGetEventsHandler(t *testing.T) {
 		name           string
 		mockSetup      func() *mockDB
 		query          string
+		strict         bool
 		expectedStatus int
 		expectDBCalled bool
 		expectResults  []database.Event
+		expectCode     string
+		expectFilter   string
+		expectArchive  bool
 	}{
 		{
 			name: "success with user",
@@ -206,6 +709,7 @@ func TestGetEventsHandler(t *testing.T) {
 			query:          "?user_id=bad&from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z",
 			expectedStatus: http.StatusBadRequest,
 			expectDBCalled: false,
+			expectCode:     CodeInvalidUserID,
 		},
 		{
 			name: "missing from",
@@ -213,8 +717,9 @@ func TestGetEventsHandler(t *testing.T) {
 				return &mockDB{}
 			},
 			query:          "?user_id=1&to=2020-01-02T00:00:00Z",
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnprocessableEntity,
 			expectDBCalled: false,
+			expectCode:     CodeInvalidTimeRange,
 		},
 		{
 			name: "invalid time format",
@@ -224,6 +729,28 @@ func TestGetEventsHandler(t *testing.T) {
 			query:          "?from=not-a-time&to=also-not-a-time",
 			expectedStatus: http.StatusBadRequest,
 			expectDBCalled: false,
+			expectCode:     CodeInvalidTimeRange,
+		},
+		{
+			name: "strict accepts RFC3339",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			query:          "?from=2020-01-01T00:00:00.5Z&to=" + url.QueryEscape("2020-01-02T00:00:00+02:00"),
+			strict:         true,
+			expectedStatus: http.StatusOK,
+			expectDBCalled: true,
+		},
+		{
+			name: "strict rejects other layouts",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			query:          "?from=2020-01-01&to=2020-01-02T00:00:00Z",
+			strict:         true,
+			expectedStatus: http.StatusBadRequest,
+			expectDBCalled: false,
+			expectCode:     CodeInvalidTimeRange,
 		},
 		{
 			name: "from after to",
@@ -231,8 +758,9 @@ func TestGetEventsHandler(t *testing.T) {
 				return &mockDB{}
 			},
 			query:          "?from=2020-01-02T00:00:00Z&to=2020-01-01T00:00:00Z",
-			expectedStatus: http.StatusBadRequest,
+			expectedStatus: http.StatusUnprocessableEntity,
 			expectDBCalled: false,
+			expectCode:     CodeInvalidTimeRange,
 		},
 		{
 			name: "db error",
@@ -242,6 +770,60 @@ func TestGetEventsHandler(t *testing.T) {
 			query:          "?from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z",
 			expectedStatus: http.StatusInternalServerError,
 			expectDBCalled: true,
+			expectCode:     CodeDBUnavailable,
+		},
+		{
+			name: "filter",
+			mockSetup: func() *mockDB {
+				return &mockDB{getResults: []database.Event{{ID: 1, UserID: 1, Action: "click", CreatedAt: now}}}
+			},
+			query:          "?from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z&filter=" + url.QueryEscape(`action == "click" && metadata.page =~ "^/checkout"`),
+			expectedStatus: http.StatusOK,
+			expectDBCalled: true,
+			expectResults:  []database.Event{{ID: 1, UserID: 1, Action: "click", CreatedAt: now}},
+			expectFilter:   `action == "click" && metadata.page =~ "^/checkout"`,
+		},
+		{
+			name: "invalid filter",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			query:          "?from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z&filter=" + url.QueryEscape(`page == "/"`),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectDBCalled: false,
+			expectCode:     CodeValidationFailed,
+		},
+		{
+			name: "filter not supported",
+			mockSetup: func() *mockDB {
+				return &mockDB{filterErr: fmt.Errorf("%w: metadata is encrypted", database.ErrFilterUnsupported)}
+			},
+			query:          "?from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z&filter=" + url.QueryEscape(`metadata.page == "/"`),
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectDBCalled: false,
+			expectCode:     CodeValidationFailed,
+			expectFilter:   `metadata.page == "/"`,
+		},
+		{
+			name: "include archive",
+			mockSetup: func() *mockDB {
+				return &mockDB{getResults: []database.Event{{ID: 1, UserID: 1, Action: "click", CreatedAt: earlier}}}
+			},
+			query:          "?from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z&include_archive=true",
+			expectedStatus: http.StatusOK,
+			expectDBCalled: true,
+			expectResults:  []database.Event{{ID: 1, UserID: 1, Action: "click", CreatedAt: earlier}},
+			expectArchive:  true,
+		},
+		{
+			name: "invalid include_archive",
+			mockSetup: func() *mockDB {
+				return &mockDB{}
+			},
+			query:          "?from=2020-01-01T00:00:00Z&to=2020-01-02T00:00:00Z&include_archive=maybe",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectDBCalled: false,
+			expectCode:     CodeValidationFailed,
 		},
 	}
 
@@ -250,8 +832,9 @@ func TestGetEventsHandler(t *testing.T) {
 			mock := tt.mockSetup()
 
 			s := &Server{
-				l:  logger,
-				db: mock,
+				l:                 logger,
+				db:                mock,
+				strictTimeParsing: tt.strict,
 			}
 
 			gin.SetMode(gin.TestMode)
@@ -270,12 +853,22 @@ func TestGetEventsHandler(t *testing.T) {
 				t.Fatalf("%s: expected status %d got %d, body: %s", tt.name, tt.expectedStatus, rr.Code, rr.Body.String())
 			}
 
+			if tt.expectCode != "" {
+				assertProblem(t, rr, tt.expectCode)
+			}
+
 			if tt.expectDBCalled && !mock.getCalled {
 				t.Fatalf("%s: expected GetEvents to be called", tt.name)
 			}
 			if !tt.expectDBCalled && mock.getCalled {
 				t.Fatalf("%s: expected GetEvents not to be called", tt.name)
 			}
+			if tt.expectFilter != "" && (mock.getFilter == nil || mock.getFilter.String() != tt.expectFilter) {
+				t.Fatalf("%s: expected filter %q, got %v", tt.name, tt.expectFilter, mock.getFilter)
+			}
+			if mock.getArchive != tt.expectArchive {
+				t.Fatalf("%s: expected archive included %v, got %v", tt.name, tt.expectArchive, mock.getArchive)
+			}
 
 			if tt.expectedStatus == http.StatusOK {
 				// decode response body
@@ -296,3 +889,234 @@ func TestGetEventsHandler(t *testing.T) {
 		})
 	}
 }
+
+func TestGetEventsLimit(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	results := []database.Event{{ID: 3, UserID: 1, Action: "view"}, {ID: 2, UserID: 1, Action: "view"}, {ID: 1, UserID: 1, Action: "view"}}
+
+	tests := []struct {
+		name            string
+		query           string
+		getErr          error
+		admin           bool
+		expectedStatus  int
+		expectLimit     int
+		expectEvents    int
+		expectTruncated bool
+	}{
+		{name: "default limit", expectedStatus: http.StatusOK, expectLimit: 3, expectEvents: 2, expectTruncated: true},
+		{name: "explicit limit", query: "&limit=5", expectedStatus: http.StatusOK, expectLimit: 6, expectEvents: 3},
+		{name: "above the maximum", query: "&limit=11", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "negative", query: "&limit=-1", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "not an integer", query: "&limit=ten", expectedStatus: http.StatusBadRequest},
+		{name: "every event on the API", query: "&limit=0", expectedStatus: http.StatusUnprocessableEntity},
+		{name: "every event on the admin listener", query: "&limit=0", admin: true, expectedStatus: http.StatusOK, expectEvents: 3},
+		{name: "query fails", query: "&limit=0", admin: true, getErr: fmt.Errorf("db down"), expectedStatus: http.StatusInternalServerError},
+		{name: "export deadline", query: "&limit=0", admin: true, getErr: context.DeadlineExceeded, expectedStatus: http.StatusGatewayTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{getResults: results, getErr: tt.getErr}
+			s := &Server{l: logger, db: db, defaultEventsLimit: 2, maxEventsLimit: 10, exportTimeout: time.Minute}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			if tt.admin {
+				router.Use(func(c *gin.Context) { c.Set(adminKey, true) })
+			}
+			router.GET("/events", s.GetEventsHandler)
+
+			req := httptest.NewRequest(http.MethodGet, "/events?from=2025-01-01T00:00:00Z&to=2025-01-02T00:00:00Z"+tt.query, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if db.getLimit != tt.expectLimit {
+				t.Fatalf("expected limit %d got %d", tt.expectLimit, db.getLimit)
+			}
+			if rr.Code != http.StatusOK {
+				return
+			}
+			var events []database.Event
+			if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+				t.Fatalf("invalid JSON %q: %v", rr.Body.String(), err)
+			}
+			if len(events) != tt.expectEvents {
+				t.Fatalf("expected %d events got %d", tt.expectEvents, len(events))
+			}
+			if truncated := rr.Header().Get("X-Result-Truncated") == "true"; truncated != tt.expectTruncated {
+				t.Fatalf("expected truncated %v got %v", tt.expectTruncated, truncated)
+			}
+		})
+	}
+}
+
+// TestShouldLogRequest covers request log sampling and path exclusion.
+func TestShouldLogRequest(t *testing.T) {
+	s := &Server{}
+	s.setRequestLogSettings(config.LogConfig{
+		RequestSampleRate: 3,
+		SlowRequestMillis: 1000,
+		ExcludePaths:      []string{"/health"},
+	})
+
+	if s.shouldLogRequest("/health", http.StatusInternalServerError, 2*time.Second) {
+		t.Fatalf("expected excluded path not to be logged")
+	}
+	s.basePath = "/api/"
+	if s.shouldLogRequest("/api/health", http.StatusOK, time.Millisecond) {
+		t.Fatalf("expected excluded path under the base path not to be logged")
+	}
+	if !s.shouldLogRequest("/apihealth", http.StatusInternalServerError, time.Millisecond) {
+		t.Fatalf("expected path outside of the base path to be logged")
+	}
+	if !s.shouldLogRequest("/api/events", http.StatusBadRequest, time.Millisecond) {
+		t.Fatalf("expected client errors to be logged")
+	}
+	if !s.shouldLogRequest("/api/events", http.StatusOK, 2*time.Second) {
+		t.Fatalf("expected slow requests to be logged")
+	}
+
+	logged := 0
+	for i := 0; i < 9; i++ {
+		if s.shouldLogRequest("/api/events", http.StatusCreated, time.Millisecond) {
+			logged++
+		}
+	}
+	if logged != 3 {
+		t.Fatalf("expected 3 of 9 successful requests to be logged got %d", logged)
+	}
+}
+
+// TestLogMetricsMiddlewareLabels ensures metrics are labelled with route
+// templates and that unmatched routes share a single label.
+func TestLogMetricsMiddlewareLabels(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s := &Server{
+		l: logger,
+		httpRequestCounter: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total"},
+			[]string{"path", "method", "status"}),
+		httpRequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_duration_seconds"},
+			[]string{"path", "method"}),
+		httpResponseSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: "test_size_bytes"},
+			[]string{"path", "method"}),
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(s.LogMetricsMiddleware())
+	router.NoRoute(noRouteHandler)
+	router.GET("/events/:id", func(c *gin.Context) { c.String(http.StatusOK, "hello") })
+
+	for _, path := range []string{"/events/1", "/events/2", "/wp-admin", "/.env"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if v := testutil.ToFloat64(s.httpRequestCounter.WithLabelValues("/events/:id", "GET", "200")); v != 2 {
+		t.Fatalf("expected 2 requests for route template got %v", v)
+	}
+	if v := testutil.ToFloat64(s.httpRequestCounter.WithLabelValues(unknownRoute, "GET", "404")); v != 2 {
+		t.Fatalf("expected 2 requests for unknown route got %v", v)
+	}
+	if n := testutil.CollectAndCount(s.httpRequestCounter); n != 2 {
+		t.Fatalf("expected 2 label sets got %d", n)
+	}
+	if n := testutil.CollectAndCount(s.httpResponseSize); n != 2 {
+		t.Fatalf("expected response sizes for 2 label sets got %d", n)
+	}
+}
+
+// TestParseTime covers the strict and flexible time parsing.
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		value     string
+		strict    bool
+		kind      string
+		expectErr string
+	}{
+		{value: "2020-01-01T00:00:00Z"},
+		{value: "2020-01-01T00:00:00Z", strict: true},
+		{value: "2020-01-01%2000:00:00", kind: "layout"},
+		{value: "2020-01-01T00%253A00%253A00Z", kind: "escaped"},
+		{value: "2020-01-01", strict: true, expectErr: "the accepted layout is RFC3339"},
+		{value: "2020-01-01T00:00:00 02:00", strict: true, expectErr: "must be sent as %2B"},
+		{value: "yesterday", expectErr: "the accepted layouts are RFC3339 (e.g. 2025-01-02T15:04:05Z), 2006-01-02 15:04:05, 2006-01-02T15:04:05, 2006-01-02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			before := map[string]float64{}
+			for _, k := range []string{"layout", "escaped"} {
+				before[k] = testutil.ToFloat64(flexibleTimes.WithLabelValues(k))
+			}
+
+			_, err := GetEventsRequest{Strict: tt.strict}.parseTime(tt.value)
+			if tt.expectErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.expectErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range before {
+				want := v
+				if k == tt.kind {
+					want++
+				}
+				if got := testutil.ToFloat64(flexibleTimes.WithLabelValues(k)); got != want {
+					t.Fatalf("expected deprecated_time_format_total{kind=%q} %v, got %v", k, want, got)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAddEventHandler(b *testing.B) {
+	s := &Server{l: slog.New(slog.NewTextHandler(io.Discard, nil)), db: &mockDB{insertID: 1}}
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/events", s.AddEventHandler)
+	body := []byte(`{"user_id":42,"action":"view","metadata":{"page":"/pricing","referrer":"https://example.com/blog"}}`)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		req := httptest.NewRequest(http.MethodPost, "/events", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusCreated {
+			b.Fatalf("expected status 201 got %d, body: %s", rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func BenchmarkGetEventsHandler(b *testing.B) {
+	page := "/pricing"
+	for _, size := range []int{10, 100, 1000, 10000} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			results := make([]database.Event, size)
+			for i := range results {
+				results[i] = database.Event{ID: int64(size - i), UserID: 42, Action: "view", MetadataPage: &page, CreatedAt: time.Unix(1700000000, 0).UTC()}
+			}
+			s := &Server{l: slog.New(slog.NewTextHandler(io.Discard, nil)), db: &mockDB{getResults: results}}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(adminKey, true) })
+			router.GET("/events", s.GetEventsHandler)
+			target := "/events?user_id=42&from=2023-01-01T00:00:00Z&to=2024-01-01T00:00:00Z&limit=0"
+
+			b.ReportAllocs()
+			for b.Loop() {
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+				if rr.Code != http.StatusOK {
+					b.Fatalf("expected status 200 got %d, body: %s", rr.Code, rr.Body.String())
+				}
+			}
+		})
+	}
+}
@@ -1,18 +1,23 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
-	"strconv"
-	"strings"
+	"sync/atomic"
 	"time"
 
-	_ "github.com/joho/godotenv/autoload"
+	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 
+	"github.com/arimatakao/simple-events-handler/internal/config"
 	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/lifecycle"
+	"github.com/arimatakao/simple-events-handler/internal/reload"
+	"github.com/arimatakao/simple-events-handler/internal/reporting"
+	"github.com/arimatakao/simple-events-handler/internal/signing"
 )
 
 type Server struct {
@@ -20,72 +25,273 @@ type Server struct {
 	l                   *slog.Logger
 	httpRequestCounter  *prometheus.CounterVec
 	httpRequestDuration *prometheus.HistogramVec
+	httpResponseSize    *prometheus.HistogramVec
 
-	db database.Service
+	db    database.Service
+	queue EventQueue
+	spool Spooler
+	dedup Deduplicator
 
-	corsAllowOrigins     []string
-	corsAllowMethods     []string
-	corsAllowHeaders     []string
-	corsAllowCredentials bool
+	// users verifies the user ids of the events, handled by userCheckMode
+	users         UserChecker
+	userCheckMode string
+	reporter      reporting.ErrorReporter
+
+	importer       Importer
+	maxUploadBytes int64
+	webhooks       Webhooks
+
+	// federationToken guards POST /events/batch when set
+	federationToken string
+
+	apiKeys       APIKeyAuthenticator
+	requireAPIKey bool
+	projects      Projects
+	quotas        Quotas
+	stats         Stats
+	sessions      Sessions
+	savedQueries  SavedQueries
+	eventTags     EventTags
+	jobs          Jobs
+	// flags enable optional behaviors per project
+	flags FeatureFlags
+	// recorder keeps the requests of the public API, which replayTarget
+	// serves again on the admin listener
+	recorder     RequestRecorder
+	replayTarget http.Handler
+	// dualWrites copies the events to events_v2 during its migration
+	dualWrites DualWrites
+	snapshots  Snapshots
+
+	// signatures verifies X-Signature when signing secrets are configured
+	signatures       *signing.Verifier
+	requireSignature bool
+
+	adminToken  string
+	readiness   ReadinessChecker
+	logLevel    *slog.LevelVar
+	deadLetters DeadLetters
+	audit       AuditLog
+
+	subscriptions Subscriptions
+	alertRules    AlertRules
+	exports       Exports
+	replays       Replays
+	eventStore    EventStore
+	aggregator    Aggregator
+	deepCheckers  []DeepChecker
+	// started and statuses describe the instance on GET /status
+	started  time.Time
+	statuses map[string]StatusReporter
+
+	ingestTimeout time.Duration
+	queryTimeout  time.Duration
+
+	strictTimeParsing bool
+	// GET /events returns defaultEventsLimit events unless the request asks
+	// for up to maxEventsLimit, or every event within exportTimeout on the
+	// admin listener
+	defaultEventsLimit int
+	maxEventsLimit     int
+	exportTimeout      time.Duration
+	// POST /events schedules events up to maxDeliverDelay ahead
+	maxDeliverDelay time.Duration
+	// streamFlushMillis is how often GET /events sends the events read so
+	// far
+	streamFlushMillis int
+	// strictJSON rejects JSON bodies holding unknown fields
+	strictJSON bool
+	// basePath is the prefix of the routes, set by RegisterRoutes
+	basePath string
+
+	// Settings replaced at runtime on configuration reload
+	logSettings  atomic.Pointer[requestLogSettings]
+	requestCount atomic.Uint64
+	cors         atomic.Pointer[gin.HandlerFunc]
+	limiter      *concurrencyLimiter
+	ipFilter     atomic.Pointer[ipFilter]
+
+	// trustedProxies are the networks whose X-Forwarded-For is trusted
+	trustedProxies []string
 }
 
-func splitAndTrim(s string) []string {
-	var out []string
-	for _, part := range strings.Split(s, ",") {
-		if t := strings.TrimSpace(part); t != "" {
-			out = append(out, t)
-		}
-	}
-	return out
+// DeepChecker runs checks of GET /health?deep=true, such as the schema of
+// the database or the freshness of the aggregates.
+type DeepChecker interface {
+	DeepCheck(ctx context.Context) []database.CheckResult
 }
 
-func NewServer(logger *slog.Logger) *http.Server {
-	port, _ := strconv.Atoi(os.Getenv("PORT"))
-	basePath := os.Getenv("BASE_PATH")
-	idleTimeout, _ := strconv.Atoi(os.Getenv("IDLE_TIMEOUT_SECONDS"))
-	readTimeout, _ := strconv.Atoi(os.Getenv("READ_TIMEOUT_SECONDS"))
-	writeTimeout, _ := strconv.Atoi(os.Getenv("WRITE_TIMEOUT_SECONDS"))
+// StatusReporter describes the state of a subsystem on GET /status, such
+// as the depth of a queue.
+type StatusReporter interface {
+	Status(ctx context.Context) (any, error)
+}
 
-	originsEnv := os.Getenv("CORS_ALLOW_ORIGINS")
-	if originsEnv == "" {
-		originsEnv = "http://localhost:3000"
-	}
-	methodsEnv := os.Getenv("CORS_ALLOW_METHODS")
-	if methodsEnv == "" {
-		methodsEnv = "GET,POST"
-	}
-	headersEnv := os.Getenv("CORS_ALLOW_HEADERS")
-	if headersEnv == "" {
-		headersEnv = "Accept,Authorization,Content-Type"
-	}
-	allowCreds := false
-	if v := os.Getenv("CORS_ALLOW_CREDENTIALS"); v != "" {
-		if b, err := strconv.ParseBool(v); err == nil {
-			allowCreds = b
-		}
-	}
+// StatusFunc adapts a function to a StatusReporter.
+type StatusFunc func(ctx context.Context) (any, error)
+
+func (f StatusFunc) Status(ctx context.Context) (any, error) {
+	return f(ctx)
+}
+
+// ReadinessChecker exposes the readiness state of the application.
+type ReadinessChecker interface {
+	Ready() bool
+	State() lifecycle.State
+}
+
+// EventQueue accepts events to be stored asynchronously. Enqueue returns
+// buffer.ErrFull when the event is rejected for backpressure.
+type EventQueue interface {
+	Enqueue(context.Context, ingest.Event) error
+}
 
+// Spooler keeps events that could not be inserted, to be stored later.
+type Spooler interface {
+	Append(ingest.Event) error
+}
+
+// Deduplicator stores an event unless an identical one was stored recently.
+type Deduplicator interface {
+	Insert(ctx context.Context, e database.NewEvent) (stored database.Event, duplicate bool, err error)
+}
+
+// UserChecker verifies with the user service that a user exists.
+type UserChecker interface {
+	Exists(ctx context.Context, projectID, userID int64) (bool, error)
+}
+
+// Options holds the dependencies of the public API server.
+type Options struct {
+	// DB defaults to database.New() when nil.
+	DB database.Service
+	// Queue, when set, switches POST /events to write-behind: events are
+	// enqueued and acknowledged with 202 instead of inserted synchronously.
+	Queue EventQueue
+	// Spool, when set, keeps the events whose synchronous insert failed;
+	// they are acknowledged with 202 instead of an error.
+	Spool Spooler
+	// Dedup, when set, stores the events inserted synchronously only once
+	// within its window; duplicates are answered with the event stored
+	// first.
+	Dedup Deduplicator
+	// Users, when set, verifies the user of the events sent to the API;
+	// the events of unknown users are handled as configured in
+	// cfg.UserCheck.Mode.
+	Users UserChecker
+	// Importer, when set, serves POST /events/import.
+	Importer Importer
+	// Webhooks, when set, serves POST /webhooks/:provider.
+	Webhooks Webhooks
+	// APIKeys, when set, scopes requests carrying an API key to its
+	// project; otherwise every request belongs to the default project.
+	APIKeys APIKeyAuthenticator
+	// Quotas, when set, meters and limits the requests made with API keys
+	// and serves GET /usage.
+	Quotas Quotas
+	// Stats, when set, serves the statistics under /stats.
+	Stats Stats
+	// Sessions, when set, serves GET /users/:id/sessions.
+	Sessions Sessions
+	// SavedQueries, when set, manages and runs the saved queries of the
+	// projects under /queries.
+	SavedQueries SavedQueries
+	// EventTags, when set, tags events under /events/:id/tags.
+	EventTags EventTags
+	// Jobs, when set, runs the exports of POST /exports and reports the
+	// jobs under /jobs.
+	Jobs Jobs
+	// Flags, when set, enable strict validation, asynchronous ingestion and
+	// the response envelope per project.
+	Flags FeatureFlags
+	// Recorder, when set, keeps sanitized copies of the requests.
+	Recorder RequestRecorder
+	Reporter reporting.ErrorReporter
+	// Reloader, when set, re-applies CORS, request log and concurrency limit
+	// settings on reload.
+	Reloader *reload.Reloader
+}
+
+func NewServer(logger *slog.Logger, cfg *config.Config, opts Options) *http.Server {
 	NewServer := &Server{
-		port: port,
+		port: cfg.Server.Port,
 		l:    logger,
 
-		db: database.New(),
+		db:    opts.DB,
+		queue: opts.Queue,
+		spool: opts.Spool,
+		dedup: opts.Dedup,
+
+		users:         opts.Users,
+		userCheckMode: cfg.UserCheck.Mode,
+		reporter:      opts.Reporter,
+
+		importer:       opts.Importer,
+		maxUploadBytes: int64(cfg.Import.MaxUploadMB) << 20,
+		webhooks:       opts.Webhooks,
+
+		federationToken: cfg.Federation.Token,
 
-		// set parsed CORS values
-		corsAllowOrigins:     splitAndTrim(originsEnv),
-		corsAllowMethods:     splitAndTrim(methodsEnv),
-		corsAllowHeaders:     splitAndTrim(headersEnv),
-		corsAllowCredentials: allowCreds,
+		apiKeys:       opts.APIKeys,
+		requireAPIKey: cfg.Auth.RequireAPIKey,
+		quotas:        opts.Quotas,
+		stats:         opts.Stats,
+		sessions:      opts.Sessions,
+		savedQueries:  opts.SavedQueries,
+		eventTags:     opts.EventTags,
+		jobs:          opts.Jobs,
+		flags:         opts.Flags,
+		recorder:      opts.Recorder,
+
+		requireSignature: cfg.Auth.RequireSignature,
+
+		ingestTimeout: time.Duration(cfg.Server.IngestRequestTimeoutSeconds) * time.Second,
+		queryTimeout:  time.Duration(cfg.Server.QueryRequestTimeoutSeconds) * time.Second,
+
+		strictTimeParsing:  cfg.Server.StrictTimeParsing,
+		defaultEventsLimit: cfg.Server.DefaultEventsLimit,
+		maxEventsLimit:     cfg.Server.MaxEventsLimit,
+		exportTimeout:      time.Duration(cfg.Server.EventsExportTimeoutSeconds) * time.Second,
+		maxDeliverDelay:    time.Duration(cfg.Scheduled.MaxDelayDays) * 24 * time.Hour,
+		streamFlushMillis:  cfg.Server.EventsFlushIntervalMillis,
+		strictJSON:         cfg.Server.StrictJSON,
+
+		limiter:        newConcurrencyLimiter(),
+		trustedProxies: cfg.Server.TrustedProxies,
+	}
+	if NewServer.db == nil {
+		NewServer.db = database.New()
+	}
+	if len(cfg.Auth.SigningSecrets) > 0 {
+		NewServer.signatures = signing.NewVerifier(cfg.Auth.SigningSecrets, time.Duration(cfg.Auth.SignatureWindowSeconds)*time.Second)
+	}
+	NewServer.applyRuntimeConfig(cfg)
+	if opts.Reloader != nil {
+		opts.Reloader.Register("api server", func(cfg *config.Config) error {
+			NewServer.applyRuntimeConfig(cfg)
+			return nil
+		})
 	}
 
 	// Declare Server config
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", NewServer.port),
-		Handler:      NewServer.RegisterRoutes(basePath),
-		IdleTimeout:  time.Duration(idleTimeout) * time.Second,
-		ReadTimeout:  time.Duration(readTimeout) * time.Second,
-		WriteTimeout: time.Duration(writeTimeout) * time.Second,
+		Handler:      NewServer.RegisterRoutes(cfg.Server.BasePath),
+		IdleTimeout:  time.Duration(cfg.Server.IdleTimeoutSeconds) * time.Second,
+		ReadTimeout:  time.Duration(cfg.Server.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout: time.Duration(cfg.Server.WriteTimeoutSeconds) * time.Second,
+	}
+	if cfg.TLS.HasStaticCert() {
+		server.TLSConfig = newTLSConfig()
 	}
 
 	return server
 }
+
+// applyRuntimeConfig installs the settings that may change without a restart.
+func (s *Server) applyRuntimeConfig(cfg *config.Config) {
+	s.setCORS(cfg.CORS)
+	s.setRequestLogSettings(cfg.Log)
+	s.limiter.configure(cfg.Server)
+	s.setIPFilter(cfg.Server.AllowCIDRs, cfg.Server.DenyCIDRs)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+	"github.com/arimatakao/simple-events-handler/internal/sessions"
+)
+
+// Sessions splits the events of users into sessions.
+type Sessions interface {
+	Recent(ctx context.Context, projectID, userID int64, start, end *time.Time, limit int) ([]sessions.Session, error)
+}
+
+const (
+	defaultSessionsLimit = 20
+	maxSessionsLimit     = 100
+)
+
+// UserSessionsHandler answers GET /users/:id/sessions with the latest
+// sessions of a user, newest first, optionally within from and to.
+func (s *Server) UserSessionsHandler(c *gin.Context) {
+	if s.sessions == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "sessions are not available")
+		return
+	}
+
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidUserID, "user id must be an integer")
+		return
+	}
+	if userID <= 0 {
+		abortWithInvalid(c, ingest.NewFieldError("user_id", "out_of_range", "user_id must be a positive integer"))
+		return
+	}
+
+	req := GetEventsRequest{Strict: s.strictTimesFor(c)}
+	var start, end *time.Time
+	if v := c.Query("from"); v != "" {
+		if start, err = req.parseTime(v); err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidTimeRange, fmt.Sprintf("invalid from parameter: %s", err))
+			return
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if end, err = req.parseTime(v); err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidTimeRange, fmt.Sprintf("invalid to parameter: %s", err))
+			return
+		}
+	}
+	if start != nil && end != nil && start.After(*end) {
+		err := ingest.NewFieldError("from", "out_of_range", "from must be before or equal to to")
+		abortWithFieldErrors(c, CodeInvalidTimeRange, err.Error(), fieldErrors(err))
+		return
+	}
+
+	limit := defaultSessionsLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be an integer")
+			return
+		}
+		if n < 1 || n > maxSessionsLimit {
+			abortWithInvalid(c, ingest.NewFieldError("limit", "out_of_range", fmt.Sprintf("limit must be between 1 and %d", maxSessionsLimit)))
+			return
+		}
+		limit = n
+	}
+
+	if !s.reserve(c, quota.Queries, 1) {
+		return
+	}
+	found, err := s.sessions.Recent(c.Request.Context(), projectID(c), userID, start, end, limit)
+	if err != nil {
+		s.l.Error("failed to read sessions", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to read sessions")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "sessions": found})
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/sessions"
+)
+
+// fakeSessions answers a single session and records the arguments.
+type fakeSessions struct {
+	userID     int64
+	start, end *time.Time
+	limit      int
+	err        error
+}
+
+func (f *fakeSessions) Recent(ctx context.Context, projectID, userID int64, start, end *time.Time, limit int) ([]sessions.Session, error) {
+	f.userID, f.start, f.end, f.limit = userID, start, end, limit
+	if f.err != nil {
+		return nil, f.err
+	}
+	start0 := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	return []sessions.Session{{ID: 4, Start: start0, End: start0.Add(time.Minute), DurationSeconds: 60, Events: 2}}, nil
+}
+
+func TestUserSessionsHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		sessions       *fakeSessions
+		path           string
+		expectedStatus int
+		expectBody     string
+		expectLimit    int
+		expectRange    bool
+	}{
+		{
+			name:           "latest sessions",
+			sessions:       &fakeSessions{},
+			path:           "/users/7/sessions",
+			expectedStatus: http.StatusOK,
+			expectBody:     `{"sessions":[{"id":4,"start":"2025-03-10T09:00:00Z","end":"2025-03-10T09:01:00Z","duration_seconds":60,"events":2}],"user_id":7}`,
+			expectLimit:    20,
+		},
+		{
+			name:           "within a range",
+			sessions:       &fakeSessions{},
+			path:           "/users/7/sessions?from=2025-03-01T00:00:00Z&to=2025-03-31T00:00:00Z&limit=5",
+			expectedStatus: http.StatusOK,
+			expectLimit:    5,
+			expectRange:    true,
+		},
+		{
+			name:           "user id not an integer",
+			sessions:       &fakeSessions{},
+			path:           "/users/abc/sessions",
+			expectedStatus: http.StatusBadRequest,
+			expectBody:     CodeInvalidUserID,
+		},
+		{
+			name:           "user id not positive",
+			sessions:       &fakeSessions{},
+			path:           "/users/0/sessions",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"user_id"`,
+		},
+		{
+			name:           "invalid time",
+			sessions:       &fakeSessions{},
+			path:           "/users/7/sessions?from=yesterday",
+			expectedStatus: http.StatusBadRequest,
+			expectBody:     CodeInvalidTimeRange,
+		},
+		{
+			name:           "from after to",
+			sessions:       &fakeSessions{},
+			path:           "/users/7/sessions?from=2025-03-31T00:00:00Z&to=2025-03-01T00:00:00Z",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"from"`,
+		},
+		{
+			name:           "limit out of range",
+			sessions:       &fakeSessions{},
+			path:           "/users/7/sessions?limit=101",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"limit"`,
+		},
+		{
+			name:           "database error",
+			sessions:       &fakeSessions{err: errors.New("connection refused")},
+			path:           "/users/7/sessions",
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "not available",
+			path:           "/users/7/sessions",
+			expectedStatus: http.StatusNotFound,
+			expectBody:     CodeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{}}
+			if tt.sessions != nil {
+				s.sessions = tt.sessions
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/users/:id/sessions", s.UserSessionsHandler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectLimit != 0 {
+				f := tt.sessions
+				if f.userID != 7 || f.limit != tt.expectLimit || (f.start != nil) != tt.expectRange || (f.end != nil) != tt.expectRange {
+					t.Fatalf("expected user 7, limit %d and range %v, got %+v", tt.expectLimit, tt.expectRange, f)
+				}
+			}
+		})
+	}
+}
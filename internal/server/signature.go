@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/signing"
+)
+
+// maxSignedBytes bounds the bodies read to verify their signature.
+const maxSignedBytes = 10 << 20
+
+// SignatureMiddleware verifies the X-Signature header of the request body
+// with the signing secrets. Signed requests are always verified, so that a
+// producer sending signatures is protected before the signatures are
+// required; unsigned ones are rejected when required.
+func (s *Server) SignatureMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.signatures == nil {
+			c.Next()
+			return
+		}
+		header := c.GetHeader(signing.Header)
+		if header == "" && !s.requireSignature {
+			c.Next()
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxSignedBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				abortWithProblem(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, err.Error())
+				return
+			}
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+			return
+		}
+		if err := s.signatures.Verify(header, body); err != nil {
+			abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, err.Error())
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
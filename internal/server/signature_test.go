@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/signing"
+)
+
+func TestSignatureMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const secret = "0123456789abcdef"
+	event := `{"user_id":1,"action":"view"}`
+
+	tests := []struct {
+		name           string
+		require        bool
+		body           string
+		signature      string
+		expectedStatus int
+	}{
+		{name: "signed", body: event, signature: signing.Sign(secret, time.Now(), []byte(event)), expectedStatus: http.StatusCreated},
+		{name: "unsigned allowed", body: event, expectedStatus: http.StatusCreated},
+		{name: "unsigned required", require: true, body: event, expectedStatus: http.StatusUnauthorized},
+		{name: "tampered body", body: `{"user_id":2,"action":"view"}`, signature: signing.Sign(secret, time.Now(), []byte(event)), expectedStatus: http.StatusUnauthorized},
+		{name: "outside the window", require: true, body: event, signature: signing.Sign(secret, time.Now().Add(-time.Hour), []byte(event)), expectedStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{insertID: 1}, signatures: signing.NewVerifier([]string{secret}, 5*time.Minute), requireSignature: tt.require}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.SignatureMiddleware(), s.AddEventHandler)
+
+			send := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/json")
+				if tt.signature != "" {
+					req.Header.Set(signing.Header, tt.signature)
+				}
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				return rr
+			}
+
+			rr := send()
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnauthorized {
+				assertProblem(t, rr, CodeUnauthorized)
+			}
+			// A signed request cannot be replayed
+			if tt.signature != "" && rr.Code == http.StatusCreated {
+				if rr := send(); rr.Code != http.StatusUnauthorized {
+					t.Fatalf("expected the replayed request to be rejected, got status %d", rr.Code)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// Snapshots copies the events of a window with their tags and aggregates,
+// and restores such copies, such as a database.SnapshotStore.
+type Snapshots interface {
+	Snapshot(ctx context.Context, from, to time.Time, fn func(database.SnapshotRecord) error) error
+	Restore(ctx context.Context, next func() (database.SnapshotRecord, error)) (database.RestoreResult, error)
+}
+
+// requireSnapshots answers 404 when snapshots are not available.
+func (s *Server) requireSnapshots(c *gin.Context) bool {
+	if s.snapshots == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "snapshots are not configured")
+		return false
+	}
+	return true
+}
+
+// SnapshotHandler streams a snapshot of the events created in [from, to),
+// every event created until now by default, as JSON lines. An error once
+// the stream started cuts it before its trailer, which Restore rejects.
+func (s *Server) SnapshotHandler(c *gin.Context) {
+	if !s.requireSnapshots(c) {
+		return
+	}
+	f, _, err := eventFilter(c)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if f.ProjectID != nil || f.UserID != nil || f.Action != "" {
+		abortWithInvalid(c, ingest.NewFieldError("", "invalid", "a snapshot holds every project, user and action: only from and to are accepted"))
+		return
+	}
+
+	w := bufio.NewWriter(c.Writer)
+	enc := json.NewEncoder(w)
+	started := false
+	err = s.snapshots.Snapshot(c.Request.Context(), f.From, f.To, func(r database.SnapshotRecord) error {
+		if !started {
+			started = true
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="snapshot-%s.ndjson"`, f.To.UTC().Format("20060102T150405Z")))
+			c.Status(http.StatusOK)
+		}
+		return enc.Encode(r)
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		s.l.Error("failed to write snapshot", "error", err)
+		_ = c.Error(err)
+		// Nothing reached the client while the records fit in the buffer
+		if !c.Writer.Written() {
+			c.Writer.Header().Del("Content-Disposition")
+			abortWithDBError(c, err, "failed to read the snapshot")
+		}
+	}
+}
+
+// RestoreSnapshotHandler restores the snapshot of the request body, written
+// by SnapshotHandler, and answers with the records restored.
+func (s *Server) RestoreSnapshotHandler(c *gin.Context) {
+	if !s.requireSnapshots(c) {
+		return
+	}
+	dec := json.NewDecoder(c.Request.Body)
+	line := 0
+	next := func() (database.SnapshotRecord, error) {
+		var r database.SnapshotRecord
+		line++
+		if err := dec.Decode(&r); err != nil {
+			if errors.Is(err, io.EOF) {
+				return r, io.EOF
+			}
+			return r, fmt.Errorf("%w: record %d: %v", database.ErrInvalidSnapshot, line, err)
+		}
+		return r, nil
+	}
+
+	res, err := s.snapshots.Restore(c.Request.Context(), next)
+	if errors.Is(err, database.ErrInvalidSnapshot) {
+		abortWithInvalid(c, ingest.NewFieldError("", "invalid", err.Error()))
+		return
+	}
+	if err != nil {
+		s.l.Error("failed to restore snapshot", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to restore the snapshot")
+		return
+	}
+	s.l.Info("snapshot restored", "events", res.Events, "skipped", res.Skipped, "aggregates", res.Aggregates)
+	c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeSnapshots writes a snapshot of one event, and restores snapshots
+// ending with a trailer, or fails with err.
+type fakeSnapshots struct {
+	err      error
+	from, to time.Time
+}
+
+func (f *fakeSnapshots) Snapshot(ctx context.Context, from, to time.Time, fn func(database.SnapshotRecord) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.from, f.to = from, to
+	records := []database.SnapshotRecord{
+		{Kind: database.SnapshotHeaderKind, Header: &database.SnapshotHeader{Version: database.SnapshotVersion, From: from, To: to}},
+		{Kind: database.SnapshotEventKind, Event: &database.SnapshotEvent{ID: 7, ProjectID: 1, UserID: 42, Action: "click", CreatedAt: from}},
+		{Kind: database.SnapshotTrailerKind, Trailer: &database.SnapshotCounts{Events: 1}},
+	}
+	for _, r := range records {
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeSnapshots) Restore(ctx context.Context, next func() (database.SnapshotRecord, error)) (database.RestoreResult, error) {
+	var res database.RestoreResult
+	var last string
+	for {
+		r, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+		if r.Kind == database.SnapshotEventKind {
+			res.Events++
+		}
+		last = r.Kind
+	}
+	if last != database.SnapshotTrailerKind {
+		return res, fmt.Errorf("%w: no trailer", database.ErrInvalidSnapshot)
+	}
+	return res, f.err
+}
+
+func TestSnapshotRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	snapshot := `{"kind":"header","header":{"version":1,"from":"2025-01-01T00:00:00Z","to":"2025-02-01T00:00:00Z","created_at":"0001-01-01T00:00:00Z"}}
+{"kind":"event","event":{"id":7,"project_id":1,"user_id":42,"action":"click","created_at":"2025-01-01T00:00:00Z","schema_version":0}}
+{"kind":"trailer","trailer":{"projects":0,"events":1,"tags":0,"aggregates":0}}
+`
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		storeErr       error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "snapshot", method: http.MethodGet, path: "/snapshot?from=2025-01-01T00:00:00Z&to=2025-02-01T00:00:00Z", expectedStatus: http.StatusOK, expectBody: snapshot},
+		{name: "snapshot of a project", method: http.MethodGet, path: "/snapshot?project_id=2", expectedStatus: http.StatusUnprocessableEntity, expectBody: "only from and to"},
+		{name: "snapshot of an invalid range", method: http.MethodGet, path: "/snapshot?from=2025-02-01T00:00:00Z&to=2025-01-01T00:00:00Z", expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"from"`},
+		{name: "snapshot while the database is down", storeErr: errors.New("connection refused"), method: http.MethodGet, path: "/snapshot", expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable},
+		{name: "restore", method: http.MethodPost, path: "/snapshot/restore", body: snapshot, expectedStatus: http.StatusOK, expectBody: `"events":1`},
+		{name: "restore a truncated snapshot", method: http.MethodPost, path: "/snapshot/restore", body: snapshot[:strings.Index(snapshot, `{"kind":"trailer"`)], expectedStatus: http.StatusUnprocessableEntity, expectBody: "no trailer"},
+		{name: "restore a malformed snapshot", method: http.MethodPost, path: "/snapshot/restore", body: snapshot[:20], expectedStatus: http.StatusUnprocessableEntity, expectBody: "record 1"},
+		{name: "restore while the database is down", storeErr: errors.New("connection refused"), method: http.MethodPost, path: "/snapshot/restore", body: snapshot, expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable},
+		{name: "not configured", unconfigured: true, method: http.MethodGet, path: "/snapshot", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{}, snapshots: &fakeSnapshots{err: tt.storeErr}}
+			if tt.unconfigured {
+				s.snapshots = nil
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/snapshot", s.SnapshotHandler)
+			router.POST("/snapshot/restore", s.RestoreSnapshotHandler)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+		})
+	}
+}
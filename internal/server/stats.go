@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+// Stats computes statistics over the events of a project.
+type Stats interface {
+	Retention(ctx context.Context, projectID int64, unit string, periods int) (database.Retention, error)
+	TimeSeries(ctx context.Context, projectID int64, action string, from, to time.Time, bucket time.Duration) ([]database.TimePoint, error)
+}
+
+const (
+	defaultRetentionPeriods = 8
+	maxRetentionPeriods     = 52
+
+	// maxTimeSeriesPoints bounds the buckets of a time series
+	maxTimeSeriesPoints = 1000
+)
+
+// RetentionHandler answers GET /stats/retention with the share of the users
+// of each cohort returning in the following periods.
+func (s *Server) RetentionHandler(c *gin.Context) {
+	if s.stats == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "statistics are not available")
+		return
+	}
+
+	unit := c.DefaultQuery("cohort", database.CohortWeek)
+	switch unit {
+	case database.CohortDay, database.CohortWeek, database.CohortMonth:
+	default:
+		abortWithInvalid(c, ingest.NewFieldError("cohort", "invalid", "cohort must be one of day, week, month"))
+		return
+	}
+	periods := defaultRetentionPeriods
+	if v := c.Query("periods"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "periods must be an integer")
+			return
+		}
+		if n < 1 || n > maxRetentionPeriods {
+			abortWithInvalid(c, ingest.NewFieldError("periods", "out_of_range", fmt.Sprintf("periods must be between 1 and %d", maxRetentionPeriods)))
+			return
+		}
+		periods = n
+	}
+
+	if !s.reserve(c, quota.Queries, 1) {
+		return
+	}
+	r, err := s.stats.Retention(c.Request.Context(), projectID(c), unit, periods)
+	if err != nil {
+		s.l.Error("failed to compute retention", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to compute retention")
+		return
+	}
+	c.JSON(http.StatusOK, r)
+}
+
+// parseBucket parses a bucket of a time series: a Go duration such as 1h or
+// 6h, or a number of days such as 1d. It must be a whole number of hours.
+func parseBucket(v string) (time.Duration, error) {
+	var d time.Duration
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("bucket must be a duration such as 1h or 1d")
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return 0, fmt.Errorf("bucket must be a duration such as 1h or 1d")
+		}
+	}
+	if d <= 0 || d%time.Hour != 0 {
+		return 0, ingest.NewFieldError("bucket", "invalid", "bucket must be a whole number of hours")
+	}
+	return d, nil
+}
+
+// TimeSeriesHandler answers GET /stats/timeseries with the events of an
+// action and their unique users per bucket, for charts.
+func (s *Server) TimeSeriesHandler(c *gin.Context) {
+	if s.stats == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "statistics are not available")
+		return
+	}
+
+	action := c.Query("action")
+	if action == "" {
+		abortWithInvalid(c, ingest.NewFieldError("action", "required", "action parameter is required"))
+		return
+	}
+	req := GetEventsRequest{Strict: s.strictTimesFor(c), From: c.Query("from"), To: c.Query("to")}
+	if req.To == "" {
+		req.To = time.Now().UTC().Format(time.RFC3339)
+	}
+	from, to, err := req.Validate()
+	if err != nil {
+		if fields := fieldErrors(err); fields != nil {
+			abortWithFieldErrors(c, CodeInvalidTimeRange, err.Error(), fields)
+			return
+		}
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidTimeRange, err.Error())
+		return
+	}
+	bucketParam := c.DefaultQuery("bucket", "1h")
+	bucket, err := parseBucket(bucketParam)
+	if err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if points := to.Sub(from.Truncate(bucket)) / bucket; points > maxTimeSeriesPoints {
+		abortWithInvalid(c, ingest.NewFieldError("bucket", "too_many", fmt.Sprintf("the range holds more than %d buckets, use a larger bucket", maxTimeSeriesPoints)))
+		return
+	}
+
+	if !s.reserve(c, quota.Queries, 1) {
+		return
+	}
+	points, err := s.stats.TimeSeries(c.Request.Context(), projectID(c), action, *from, *to, bucket)
+	if err != nil {
+		s.l.Error("failed to compute time series", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to compute time series")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"action": action, "bucket": bucketParam, "points": points})
+}
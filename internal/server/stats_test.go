@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeStats answers a single cohort or point and records the arguments.
+type fakeStats struct {
+	projectID int64
+	unit      string
+	periods   int
+	action    string
+	from, to  time.Time
+	bucket    time.Duration
+	err       error
+}
+
+func (f *fakeStats) Retention(ctx context.Context, projectID int64, unit string, periods int) (database.Retention, error) {
+	f.projectID, f.unit, f.periods = projectID, unit, periods
+	if f.err != nil {
+		return database.Retention{}, f.err
+	}
+	start := time.Date(2025, 3, 3, 0, 0, 0, 0, time.UTC)
+	return database.Retention{Cohort: unit, Periods: periods, Cohorts: []database.RetentionCohort{
+		{Start: start, Users: 4, Returning: []int64{4, 1}, Retention: []float64{1, 0.25}},
+	}}, nil
+}
+
+func (f *fakeStats) TimeSeries(ctx context.Context, projectID int64, action string, from, to time.Time, bucket time.Duration) ([]database.TimePoint, error) {
+	f.projectID, f.action, f.from, f.to, f.bucket = projectID, action, from, to, bucket
+	if f.err != nil {
+		return nil, f.err
+	}
+	return []database.TimePoint{{Start: from.Truncate(bucket), Events: 3, Users: 2}}, nil
+}
+
+func TestRetentionHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		stats          *fakeStats
+		query          string
+		expectedStatus int
+		expectBody     string
+		expectUnit     string
+		expectPeriods  int
+	}{
+		{
+			name:           "defaults",
+			stats:          &fakeStats{},
+			expectedStatus: http.StatusOK,
+			expectBody:     `{"cohort":"week","periods":8,"cohorts":[{"start":"2025-03-03T00:00:00Z","users":4,"returning":[4,1],"retention":[1,0.25]}]}`,
+			expectUnit:     "week",
+			expectPeriods:  8,
+		},
+		{
+			name:           "monthly cohorts",
+			stats:          &fakeStats{},
+			query:          "?cohort=month&periods=12",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"cohort":"month","periods":12`,
+			expectUnit:     "month",
+			expectPeriods:  12,
+		},
+		{
+			name:           "unknown cohort",
+			stats:          &fakeStats{},
+			query:          "?cohort=year",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"cohort"`,
+		},
+		{
+			name:           "periods not an integer",
+			stats:          &fakeStats{},
+			query:          "?periods=many",
+			expectedStatus: http.StatusBadRequest,
+			expectBody:     CodeInvalidRequest,
+		},
+		{
+			name:           "too many periods",
+			stats:          &fakeStats{},
+			query:          "?periods=53",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"periods"`,
+		},
+		{
+			name:           "database error",
+			stats:          &fakeStats{err: errors.New("connection refused")},
+			expectedStatus: http.StatusInternalServerError,
+		},
+		{
+			name:           "not available",
+			expectedStatus: http.StatusNotFound,
+			expectBody:     CodeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{}}
+			if tt.stats != nil {
+				s.stats = tt.stats
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/stats/retention", s.RetentionHandler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/retention"+tt.query, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectUnit != "" && (tt.stats.unit != tt.expectUnit || tt.stats.periods != tt.expectPeriods || tt.stats.projectID != database.DefaultProjectID) {
+				t.Fatalf("expected %s cohorts over %d periods of the default project, got %+v", tt.expectUnit, tt.expectPeriods, tt.stats)
+			}
+		})
+	}
+}
+
+func TestTimeSeriesHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		stats          *fakeStats
+		query          string
+		expectedStatus int
+		expectBody     string
+		expectBucket   time.Duration
+	}{
+		{
+			name:           "hourly",
+			stats:          &fakeStats{},
+			query:          "?action=purchase&from=2025-03-10T09:30:00Z&to=2025-03-10T12:00:00Z",
+			expectedStatus: http.StatusOK,
+			expectBody:     `{"action":"purchase","bucket":"1h","points":[{"start":"2025-03-10T09:00:00Z","events":3,"users":2}]}`,
+			expectBucket:   time.Hour,
+		},
+		{
+			name:           "daily",
+			stats:          &fakeStats{},
+			query:          "?action=purchase&from=2025-03-01T00:00:00Z&to=2025-03-10T00:00:00Z&bucket=1d",
+			expectedStatus: http.StatusOK,
+			expectBody:     `"bucket":"1d"`,
+			expectBucket:   24 * time.Hour,
+		},
+		{
+			name:           "missing action",
+			stats:          &fakeStats{},
+			query:          "?from=2025-03-10T00:00:00Z",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"action"`,
+		},
+		{
+			name:           "missing from",
+			stats:          &fakeStats{},
+			query:          "?action=purchase",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"from"`,
+		},
+		{
+			name:           "bucket not a duration",
+			stats:          &fakeStats{},
+			query:          "?action=purchase&from=2025-03-10T00:00:00Z&bucket=hourly",
+			expectedStatus: http.StatusBadRequest,
+			expectBody:     CodeInvalidRequest,
+		},
+		{
+			name:           "bucket shorter than an hour",
+			stats:          &fakeStats{},
+			query:          "?action=purchase&from=2025-03-10T00:00:00Z&bucket=15m",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"field":"bucket"`,
+		},
+		{
+			name:           "too many buckets",
+			stats:          &fakeStats{},
+			query:          "?action=purchase&from=2024-01-01T00:00:00Z&to=2025-01-01T00:00:00Z",
+			expectedStatus: http.StatusUnprocessableEntity,
+			expectBody:     `"code":"too_many"`,
+		},
+		{
+			name:           "not available",
+			query:          "?action=purchase&from=2025-03-10T00:00:00Z",
+			expectedStatus: http.StatusNotFound,
+			expectBody:     CodeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{}, strictTimeParsing: true}
+			if tt.stats != nil {
+				s.stats = tt.stats
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/stats/timeseries", s.TimeSeriesHandler)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/stats/timeseries"+tt.query, nil))
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectBucket != 0 && (tt.stats.action != "purchase" || tt.stats.bucket != tt.expectBucket) {
+				t.Fatalf("expected purchases in buckets of %s, got %+v", tt.expectBucket, tt.stats)
+			}
+		})
+	}
+}
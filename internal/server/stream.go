@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/codec/json"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/quota"
+)
+
+// streamBufferBytes is how much of the encoded array an eventStream holds
+// before sending it to the client.
+const streamBufferBytes = 32 << 10
+
+// eventStream writes events as a JSON array while they are read from the
+// database, so that the memory used by a response does not grow with the
+// number of events. The array is buffered and sent once the buffer is full
+// or the flush interval has passed since the last flush, so that clients
+// see progress on long queries. Until the first flush the response can
+// still become a problem and take headers. Events are encoded with the
+// codec of gin, chosen at build time (see "JSON codec" in the README), or
+// as CSV rows under a header. In an envelope, the array is the events
+// field of an object whose truncated field is written last.
+type eventStream struct {
+	w        gin.ResponseWriter
+	buf      bytes.Buffer
+	enc      json.Encoder
+	csv      *csv.Writer
+	envelope bool
+	interval time.Duration
+	// trailer is declared when the stream starts, for headers only known
+	// once every event was read
+	trailer string
+
+	lastFlush time.Time
+	events    int
+	started   bool
+	truncated bool
+}
+
+// Formats of the events returned by streamEvents. formatEnvelope is the
+// JSON format of the response_envelope feature flag.
+const (
+	formatJSON     = "json"
+	formatEnvelope = "envelope"
+	formatCSV      = "csv"
+)
+
+// csvHeader names the columns of the events written as CSV.
+var csvHeader = []string{"id", "user_id", "action", "metadata_page", "created_at"}
+
+func newEventStream(w gin.ResponseWriter, interval time.Duration, trailer string, format string) *eventStream {
+	s := &eventStream{w: w, envelope: format == formatEnvelope, interval: interval, trailer: trailer, lastFlush: time.Now()}
+	if format == formatCSV {
+		s.csv = csv.NewWriter(&s.buf)
+	} else {
+		s.enc = json.API.NewEncoder(&s.buf)
+	}
+	return s
+}
+
+// Write appends e to the array, or the rows.
+func (s *eventStream) Write(e database.Event) error {
+	if s.csv != nil {
+		if err := s.writeCSV(e); err != nil {
+			return err
+		}
+	} else {
+		if s.events == 0 {
+			s.open()
+		} else {
+			s.buf.WriteByte(',')
+		}
+		s.events++
+		if err := s.enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if s.buf.Len() >= streamBufferBytes || (s.interval > 0 && time.Since(s.lastFlush) >= s.interval) {
+		return s.flush(false)
+	}
+	return nil
+}
+
+// Started reports whether part of the array was sent, after which the
+// status and headers can no longer change.
+func (s *eventStream) Started() bool {
+	return s.started
+}
+
+func (s *eventStream) writeCSV(e database.Event) error {
+	if s.events == 0 {
+		if err := s.csv.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	s.events++
+	page := ""
+	if e.MetadataPage != nil {
+		page = *e.MetadataPage
+	}
+	if err := s.csv.Write([]string{
+		strconv.FormatInt(e.ID, 10),
+		strconv.FormatInt(e.UserID, 10),
+		e.Action,
+		page,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}); err != nil {
+		return err
+	}
+	s.csv.Flush()
+	return s.csv.Error()
+}
+
+func (s *eventStream) open() {
+	if s.envelope {
+		s.buf.WriteString(`{"events":`)
+	}
+	s.buf.WriteByte('[')
+}
+
+// Close ends the array and sends the rest of it.
+func (s *eventStream) Close() error {
+	if s.csv != nil {
+		if s.events == 0 {
+			if err := s.csv.Write(csvHeader); err != nil {
+				return err
+			}
+			s.csv.Flush()
+		}
+		return s.flush(true)
+	}
+	if s.events == 0 {
+		s.open()
+	}
+	s.buf.WriteByte(']')
+	if s.envelope {
+		s.buf.WriteString(`,"truncated":` + strconv.FormatBool(s.truncated) + `}`)
+	}
+	return s.flush(true)
+}
+
+func (s *eventStream) flush(last bool) error {
+	if !s.started {
+		if s.csv != nil {
+			s.w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		} else {
+			s.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		}
+		if !last && s.trailer != "" {
+			s.w.Header().Set("Trailer", s.trailer)
+		}
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+	if _, err := s.w.Write(s.buf.Bytes()); err != nil {
+		return err
+	}
+	s.buf.Reset()
+	s.w.Flush()
+	s.lastFlush = time.Now()
+	return nil
+}
+
+// errLimitReached stops reading events once the limit is exceeded.
+var errLimitReached = errors.New("limit reached")
+
+// streamEvents answers GET /events with at most limit events, 0 meaning
+// every event, matching expr unless nil, written in format while they are
+// read from the database. One more event is read to tell whether the limit
+// truncated the result, which is reported by X-Result-Truncated: a header,
+// or a trailer when the stream had started, and by the envelope of the
+// events when the response_envelope flag is enabled for the project. Once
+// the stream started the status can no longer change: a later failure,
+// e.g. the deadline of the request, leaves the JSON array unterminated and
+// sets the trailer.
+func (s *Server) streamEvents(c *gin.Context, format string, expr *filter.Expr, userID *int64, start, end *time.Time, limit int) {
+	if format == formatJSON && s.flag(c, flags.ResponseEnvelope) {
+		format = formatEnvelope
+	}
+	fetch := limit
+	if limit > 0 {
+		fetch = limit + 1
+	}
+	stream := newEventStream(c.Writer, time.Duration(s.streamFlushMillis)*time.Millisecond, "X-Result-Truncated", format)
+	truncated := false
+	write := func(e database.Event) error {
+		if limit > 0 && stream.events == limit {
+			truncated = true
+			return errLimitReached
+		}
+		return stream.Write(e)
+	}
+	var err error
+	if expr != nil {
+		err = s.db.FilterEvents(c.Request.Context(), projectID(c), expr, userID, start, end, fetch, write)
+	} else {
+		err = s.db.StreamEvents(c.Request.Context(), projectID(c), userID, start, end, fetch, write)
+	}
+	if errors.Is(err, errLimitReached) {
+		err = nil
+	}
+	switch {
+	case errors.Is(err, database.ErrFilterUnsupported):
+		s.release(c, quota.Queries, 1)
+		abortWithInvalid(c, ingest.NewFieldError("filter", "unsupported", err.Error()))
+		return
+	case err != nil && !stream.Started():
+		s.release(c, quota.Queries, 1)
+		s.l.Error("failed to query events", "error", err)
+		_ = c.Error(err)
+		abortWithDBError(c, err, "failed to fetch events")
+		return
+	case err != nil:
+		s.l.Error("failed to stream events", "error", err)
+		_ = c.Error(err)
+		c.Writer.Header().Set("X-Result-Truncated", "true")
+		c.Abort()
+		return
+	}
+	if truncated {
+		c.Writer.Header().Set("X-Result-Truncated", "true")
+		stream.truncated = true
+	}
+	if err := stream.Close(); err != nil {
+		s.l.Error("failed to stream events", "error", err)
+		_ = c.Error(err)
+		c.Abort()
+	}
+}
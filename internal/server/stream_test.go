@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/flags"
+)
+
+func TestStreamEvents(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	page := strings.Repeat("p", 100)
+	results := make([]database.Event, 1000)
+	for i := range results {
+		results[i] = database.Event{ID: int64(len(results) - i), UserID: 1, Action: "view", MetadataPage: &page, CreatedAt: time.Unix(1700000000, 0).UTC()}
+	}
+
+	tests := []struct {
+		name            string
+		query           string
+		expectEvents    int
+		expectTruncated string
+		expectTrailer   bool
+		envelope        bool
+	}{
+		{name: "every event", query: "&limit=0", expectEvents: 1000, expectTrailer: true},
+		{name: "truncated while streaming", query: "&limit=600", expectEvents: 600, expectTruncated: "true", expectTrailer: true},
+		{name: "complete while streaming", query: "&limit=1000", expectEvents: 1000, expectTrailer: true},
+		{name: "truncated in an envelope", query: "&limit=600", expectEvents: 600, expectTruncated: "true", expectTrailer: true, envelope: true},
+		{name: "complete in an envelope", query: "&limit=0", expectEvents: 1000, expectTrailer: true, envelope: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger, db: &mockDB{getResults: results}, defaultEventsLimit: 100, maxEventsLimit: 1000}
+			if tt.envelope {
+				s.flags = &fakeFlags{enabled: map[string]bool{flags.ResponseEnvelope: true}}
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(adminKey, true) })
+			router.GET("/events", s.GetEventsHandler)
+
+			req := httptest.NewRequest(http.MethodGet, "/events?from=2023-01-01T00:00:00Z&to=2024-01-01T00:00:00Z"+tt.query, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected status 200 got %d, body: %s", rr.Code, rr.Body.String())
+			}
+			if !rr.Flushed {
+				t.Fatal("expected the response to be flushed while streaming")
+			}
+			var events []database.Event
+			if tt.envelope {
+				var body struct {
+					Events    []database.Event `json:"events"`
+					Truncated bool             `json:"truncated"`
+				}
+				if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+					t.Fatalf("invalid JSON: %v", err)
+				}
+				if body.Truncated != (tt.expectTruncated == "true") {
+					t.Fatalf("expected truncated %q in the envelope, got %v", tt.expectTruncated, body.Truncated)
+				}
+				events = body.Events
+			} else if err := json.Unmarshal(rr.Body.Bytes(), &events); err != nil {
+				t.Fatalf("invalid JSON: %v", err)
+			}
+			if len(events) != tt.expectEvents || events[0].ID != 1000 {
+				t.Fatalf("expected %d events, newest first, got %d", tt.expectEvents, len(events))
+			}
+
+			res := rr.Result()
+			if declared := res.Header.Get("Trailer") == "X-Result-Truncated"; declared != tt.expectTrailer {
+				t.Fatalf("expected trailer declared %v, got header %q", tt.expectTrailer, res.Header.Get("Trailer"))
+			}
+			if got := res.Trailer.Get("X-Result-Truncated"); got != tt.expectTruncated {
+				t.Fatalf("expected X-Result-Truncated trailer %q got %q", tt.expectTruncated, got)
+			}
+		})
+	}
+}
+
+// interruptedDB fails once its events are streamed, like a query reaching
+// the deadline of the request.
+type interruptedDB struct {
+	*mockDB
+}
+
+func (db interruptedDB) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	if err := db.mockDB.StreamEvents(ctx, projectID, userID, start, end, limit, fn); err != nil {
+		return err
+	}
+	return context.DeadlineExceeded
+}
+
+func TestStreamEventsInterrupted(t *testing.T) {
+	page := strings.Repeat("p", 100)
+	results := make([]database.Event, 1000)
+	for i := range results {
+		results[i] = database.Event{ID: int64(len(results) - i), UserID: 1, Action: "view", MetadataPage: &page}
+	}
+	s := &Server{l: slog.New(slog.NewTextHandler(io.Discard, nil)), db: interruptedDB{&mockDB{getResults: results}}, defaultEventsLimit: 100, maxEventsLimit: 1000, exportTimeout: time.Minute}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(adminKey, true) })
+	router.GET("/events", s.GetEventsHandler)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/events?from=2023-01-01T00:00:00Z&to=2024-01-01T00:00:00Z&limit=0", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the status of the started stream, got %d", rr.Code)
+	}
+	if got := rr.Result().Trailer.Get("X-Result-Truncated"); got != "true" {
+		t.Fatalf("expected the X-Result-Truncated trailer of the interrupted stream, got %q", got)
+	}
+}
+
+// BenchmarkEventStream encodes GET /events responses of 1000 events; run it
+// with -tags sonic or -tags go_json to compare the JSON codecs.
+func BenchmarkEventStream(b *testing.B) {
+	page := "/pricing"
+	events := make([]database.Event, 1000)
+	for i := range events {
+		events[i] = database.Event{ID: int64(i + 1), UserID: 42, Action: "view", MetadataPage: &page, CreatedAt: time.Unix(1700000000, 0).UTC()}
+	}
+	gin.SetMode(gin.TestMode)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		stream := newEventStream(c.Writer, 0, "", formatJSON)
+		for _, e := range events {
+			if err := stream.Write(e); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := stream.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
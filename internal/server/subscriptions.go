@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// Subscriptions is the store of outbound webhook subscriptions, operated
+// through the admin listener.
+type Subscriptions interface {
+	CreateSubscription(ctx context.Context, sub database.Subscription) (database.Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]database.Subscription, error)
+	GetSubscription(ctx context.Context, id int64) (database.Subscription, error)
+	UpdateSubscription(ctx context.Context, sub database.Subscription) (database.Subscription, error)
+	DeleteSubscription(ctx context.Context, id int64) error
+	ListDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]database.Delivery, error)
+}
+
+const (
+	defaultDeliveriesLimit = 100
+	maxDeliveriesLimit     = 1000
+)
+
+// SubscriptionRequest registers a URL for the events matching the filters;
+// empty filters match every event. The secret signing the deliveries is
+// generated when omitted.
+type SubscriptionRequest struct {
+	URL     string   `json:"url" binding:"required"`
+	Secret  string   `json:"secret"`
+	Actions []string `json:"actions"`
+	UserIDs []int64  `json:"user_ids"`
+	Active  *bool    `json:"active"`
+}
+
+func (r SubscriptionRequest) subscription() (database.Subscription, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return database.Subscription{}, ingest.NewFieldError("url", "invalid", "url must be an absolute http or https URL")
+	}
+	for _, id := range r.UserIDs {
+		if id <= 0 {
+			return database.Subscription{}, ingest.NewFieldError("user_ids", "out_of_range", "user_ids must be positive integers")
+		}
+	}
+	sub := database.Subscription{URL: r.URL, Secret: r.Secret, Actions: r.Actions, UserIDs: r.UserIDs, Active: true}
+	if r.Active != nil {
+		sub.Active = *r.Active
+	}
+	return sub, nil
+}
+
+// requireSubscriptions answers 404 when outbound webhooks are not enabled.
+func (s *Server) requireSubscriptions(c *gin.Context) bool {
+	if s.subscriptions == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "webhook subscriptions are not configured")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithSubscriptionError(c *gin.Context, err error) {
+	if errors.Is(err, database.ErrSubscriptionNotFound) {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	s.l.Error("webhook subscription operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access webhook subscriptions")
+}
+
+// bindSubscription reads the subscription body, answering 400 when it is
+// malformed and 422 when it is invalid.
+func (s *Server) bindSubscription(c *gin.Context) (database.Subscription, bool) {
+	var req SubscriptionRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return database.Subscription{}, false
+	}
+	sub, err := req.subscription()
+	if err != nil {
+		abortWithInvalid(c, err)
+		return database.Subscription{}, false
+	}
+	return sub, true
+}
+
+func subscriptionID(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil || id <= 0 {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, database.ErrSubscriptionNotFound.Error())
+		return 0, false
+	}
+	return id, true
+}
+
+// CreateSubscriptionHandler registers a subscription. The response is the
+// only place its secret is returned.
+func (s *Server) CreateSubscriptionHandler(c *gin.Context) {
+	if !s.requireSubscriptions(c) {
+		return
+	}
+	sub, ok := s.bindSubscription(c)
+	if !ok {
+		return
+	}
+	if sub.Secret == "" {
+		secret := make([]byte, 32)
+		_, _ = rand.Read(secret)
+		sub.Secret = hex.EncodeToString(secret)
+	}
+
+	created, err := s.subscriptions.CreateSubscription(c.Request.Context(), sub)
+	if err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	c.Header("Location", fmt.Sprintf("/subscriptions/%d", created.ID))
+	c.JSON(http.StatusCreated, created)
+}
+
+func (s *Server) ListSubscriptionsHandler(c *gin.Context) {
+	if !s.requireSubscriptions(c) {
+		return
+	}
+	subs, err := s.subscriptions.ListSubscriptions(c.Request.Context())
+	if err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+func (s *Server) GetSubscriptionHandler(c *gin.Context) {
+	if !s.requireSubscriptions(c) {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	sub, err := s.subscriptions.GetSubscription(c.Request.Context(), id)
+	if err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sub)
+}
+
+// UpdateSubscriptionHandler replaces the URL, filters and state of a
+// subscription. The secret cannot be changed; rotate it by creating a new
+// subscription.
+func (s *Server) UpdateSubscriptionHandler(c *gin.Context) {
+	if !s.requireSubscriptions(c) {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	sub, ok := s.bindSubscription(c)
+	if !ok {
+		return
+	}
+	sub.ID = id
+	sub.Secret = ""
+
+	updated, err := s.subscriptions.UpdateSubscription(c.Request.Context(), sub)
+	if err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteSubscriptionHandler removes a subscription together with its
+// deliveries, pending ones included.
+func (s *Server) DeleteSubscriptionHandler(c *gin.Context) {
+	if !s.requireSubscriptions(c) {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	if err := s.subscriptions.DeleteSubscription(c.Request.Context(), id); err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListDeliveriesHandler returns the latest delivery attempts of a
+// subscription, newest first, e.g. /subscriptions/1/deliveries?limit=20.
+func (s *Server) ListDeliveriesHandler(c *gin.Context) {
+	if !s.requireSubscriptions(c) {
+		return
+	}
+	id, ok := subscriptionID(c)
+	if !ok {
+		return
+	}
+	limit := defaultDeliveriesLimit
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, "limit must be an integer")
+			return
+		}
+		if n < 1 || n > maxDeliveriesLimit {
+			abortWithInvalid(c, ingest.NewFieldError("limit", "out_of_range", fmt.Sprintf("limit must be between 1 and %d", maxDeliveriesLimit)))
+			return
+		}
+		limit = n
+	}
+
+	ctx := c.Request.Context()
+	if _, err := s.subscriptions.GetSubscription(ctx, id); err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	deliveries, err := s.subscriptions.ListDeliveries(ctx, id, limit)
+	if err != nil {
+		s.abortWithSubscriptionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type fakeSubscriptions struct {
+	subs   map[int64]database.Subscription
+	nextID int64
+	err    error
+}
+
+func (f *fakeSubscriptions) CreateSubscription(ctx context.Context, sub database.Subscription) (database.Subscription, error) {
+	if f.err != nil {
+		return database.Subscription{}, f.err
+	}
+	f.nextID++
+	sub.ID = f.nextID
+	f.subs[sub.ID] = sub
+	return sub, nil
+}
+func (f *fakeSubscriptions) ListSubscriptions(ctx context.Context) ([]database.Subscription, error) {
+	var out []database.Subscription
+	for _, sub := range f.subs {
+		sub.Secret = ""
+		out = append(out, sub)
+	}
+	return out, f.err
+}
+func (f *fakeSubscriptions) GetSubscription(ctx context.Context, id int64) (database.Subscription, error) {
+	sub, ok := f.subs[id]
+	if !ok {
+		return database.Subscription{}, database.ErrSubscriptionNotFound
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+func (f *fakeSubscriptions) UpdateSubscription(ctx context.Context, sub database.Subscription) (database.Subscription, error) {
+	old, ok := f.subs[sub.ID]
+	if !ok {
+		return database.Subscription{}, database.ErrSubscriptionNotFound
+	}
+	sub.Secret = old.Secret
+	f.subs[sub.ID] = sub
+	sub.Secret = ""
+	return sub, nil
+}
+func (f *fakeSubscriptions) DeleteSubscription(ctx context.Context, id int64) error {
+	if _, ok := f.subs[id]; !ok {
+		return database.ErrSubscriptionNotFound
+	}
+	delete(f.subs, id)
+	return nil
+}
+func (f *fakeSubscriptions) ListDeliveries(ctx context.Context, subscriptionID int64, limit int) ([]database.Delivery, error) {
+	return []database.Delivery{{ID: 3, SubscriptionID: subscriptionID, EventID: 9, Status: database.DeliveryPending, Attempts: 1}}, nil
+}
+
+func TestSubscriptionRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		storeErr       error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+		expectSubs     int
+	}{
+		{name: "create", method: http.MethodPost, path: "/subscriptions", body: `{"url":"https://example.com/hook","actions":["signup"]}`, expectedStatus: http.StatusCreated, expectBody: `"secret":"`, expectSubs: 2},
+		{name: "create with a secret", method: http.MethodPost, path: "/subscriptions", body: `{"url":"https://example.com/hook","secret":"s3cret"}`, expectedStatus: http.StatusCreated, expectBody: `"secret":"s3cret"`, expectSubs: 2},
+		{name: "create without url", method: http.MethodPost, path: "/subscriptions", body: `{"actions":["signup"]}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed, expectSubs: 1},
+		{name: "create with a relative url", method: http.MethodPost, path: "/subscriptions", body: `{"url":"/hook"}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed, expectSubs: 1},
+		{name: "create with a bad user id", method: http.MethodPost, path: "/subscriptions", body: `{"url":"http://example.com","user_ids":[0]}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed, expectSubs: 1},
+		{name: "create while the database is down", storeErr: fmt.Errorf("db down"), method: http.MethodPost, path: "/subscriptions", body: `{"url":"https://example.com/hook"}`, expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable, expectSubs: 1},
+		{name: "list", method: http.MethodGet, path: "/subscriptions", expectedStatus: http.StatusOK, expectBody: `"url":"https://example.com/old"`, expectSubs: 1},
+		{name: "get", method: http.MethodGet, path: "/subscriptions/1", expectedStatus: http.StatusOK, expectBody: `"active":true`, expectSubs: 1},
+		{name: "get unknown", method: http.MethodGet, path: "/subscriptions/2", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectSubs: 1},
+		{name: "get malformed id", method: http.MethodGet, path: "/subscriptions/x", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectSubs: 1},
+		{name: "update", method: http.MethodPut, path: "/subscriptions/1", body: `{"url":"https://example.com/new","active":false}`, expectedStatus: http.StatusOK, expectBody: `"active":false`, expectSubs: 1},
+		{name: "delete", method: http.MethodDelete, path: "/subscriptions/1", expectedStatus: http.StatusNoContent},
+		{name: "delete unknown", method: http.MethodDelete, path: "/subscriptions/2", expectedStatus: http.StatusNotFound, expectSubs: 1},
+		{name: "deliveries", method: http.MethodGet, path: "/subscriptions/1/deliveries?limit=10", expectedStatus: http.StatusOK, expectBody: `"status":"pending"`, expectSubs: 1},
+		{name: "deliveries with a bad limit", method: http.MethodGet, path: "/subscriptions/1/deliveries?limit=0", expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed, expectSubs: 1},
+		{name: "deliveries of an unknown subscription", method: http.MethodGet, path: "/subscriptions/2/deliveries", expectedStatus: http.StatusNotFound, expectSubs: 1},
+		{name: "not configured", unconfigured: true, method: http.MethodGet, path: "/subscriptions", expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subs := &fakeSubscriptions{
+				subs:   map[int64]database.Subscription{1: {ID: 1, URL: "https://example.com/old", Secret: "old", Active: true}},
+				nextID: 1,
+				err:    tt.storeErr,
+			}
+			s := &Server{l: logger, db: &mockDB{}, subscriptions: subs}
+			if tt.unconfigured {
+				s.subscriptions = nil
+			}
+			router := s.RegisterAdminRoutes()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if !tt.unconfigured && len(subs.subs) != tt.expectSubs {
+				t.Fatalf("expected %d subscriptions got %d", tt.expectSubs, len(subs.subs))
+			}
+			if tt.name == "update" && subs.subs[1].Secret != "old" {
+				t.Fatalf("expected the secret to be kept, got %q", subs.subs[1].Secret)
+			}
+		})
+	}
+}
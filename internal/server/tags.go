@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+// EventTags is the store of the tags put on events.
+type EventTags interface {
+	AddEventTags(ctx context.Context, projectID, eventID int64, tags []string) ([]string, error)
+	ListEventTags(ctx context.Context, projectID, eventID int64) ([]string, error)
+	RemoveEventTag(ctx context.Context, projectID, eventID int64, tag string) error
+}
+
+// maxTagsPerRequest bounds the tags of POST /events/:id/tags.
+const maxTagsPerRequest = 20
+
+// tagName keeps tags usable in paths and filter expressions as they are.
+var tagName = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// TagsRequest tags an event.
+type TagsRequest struct {
+	Tags []string `json:"tags" binding:"required"`
+}
+
+// requireEventTags answers 404 when tags are not available.
+func (s *Server) requireEventTags(c *gin.Context) bool {
+	if s.eventTags == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "event tags are not available")
+		return false
+	}
+	return true
+}
+
+func (s *Server) abortWithEventTagError(c *gin.Context, err error) {
+	if errors.Is(err, database.ErrEventNotFound) || errors.Is(err, database.ErrEventTagNotFound) {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	}
+	s.l.Error("event tag operation failed", "error", err)
+	_ = c.Error(err)
+	abortWithDBError(c, err, "failed to access event tags")
+}
+
+// AddEventTagsHandler answers POST /events/:id/tags with every tag of the
+// event once the tags of the body are added.
+func (s *Server) AddEventTagsHandler(c *gin.Context) {
+	if !s.requireEventTags(c) {
+		return
+	}
+	id, ok := pathID(c, database.ErrEventNotFound)
+	if !ok {
+		return
+	}
+	var req TagsRequest
+	if err := s.bindJSON(c, &req); err != nil {
+		abortWithInvalid(c, err)
+		return
+	}
+	if len(req.Tags) == 0 || len(req.Tags) > maxTagsPerRequest {
+		abortWithInvalid(c, ingest.NewFieldError("tags", "out_of_range", fmt.Sprintf("tags must hold 1 to %d tags", maxTagsPerRequest)))
+		return
+	}
+	for i, tag := range req.Tags {
+		if !tagName.MatchString(tag) {
+			abortWithInvalid(c, ingest.NewFieldError(fmt.Sprintf("tags[%d]", i), "invalid", "a tag must be 1 to 64 letters, digits, '_', '.', ':' or '-'"))
+			return
+		}
+	}
+
+	tags, err := s.eventTags.AddEventTags(c.Request.Context(), projectID(c), id, req.Tags)
+	if err != nil {
+		s.abortWithEventTagError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"event_id": id, "tags": tags})
+}
+
+func (s *Server) ListEventTagsHandler(c *gin.Context) {
+	if !s.requireEventTags(c) {
+		return
+	}
+	id, ok := pathID(c, database.ErrEventNotFound)
+	if !ok {
+		return
+	}
+	tags, err := s.eventTags.ListEventTags(c.Request.Context(), projectID(c), id)
+	if err != nil {
+		s.abortWithEventTagError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"event_id": id, "tags": tags})
+}
+
+func (s *Server) RemoveEventTagHandler(c *gin.Context) {
+	if !s.requireEventTags(c) {
+		return
+	}
+	id, ok := pathID(c, database.ErrEventNotFound)
+	if !ok {
+		return
+	}
+	if err := s.eventTags.RemoveEventTag(c.Request.Context(), projectID(c), id, c.Param("tag")); err != nil {
+		s.abortWithEventTagError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
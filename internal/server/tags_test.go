@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeEventTags knows event 1 of the default project only.
+type fakeEventTags struct {
+	tags []string
+	err  error
+}
+
+func (f *fakeEventTags) AddEventTags(ctx context.Context, projectID, eventID int64, tags []string) ([]string, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if eventID != 1 {
+		return nil, database.ErrEventNotFound
+	}
+	for _, tag := range tags {
+		if !slices.Contains(f.tags, tag) {
+			f.tags = append(f.tags, tag)
+		}
+	}
+	slices.Sort(f.tags)
+	return f.tags, nil
+}
+func (f *fakeEventTags) ListEventTags(ctx context.Context, projectID, eventID int64) ([]string, error) {
+	if eventID != 1 {
+		return nil, database.ErrEventNotFound
+	}
+	return f.tags, nil
+}
+func (f *fakeEventTags) RemoveEventTag(ctx context.Context, projectID, eventID int64, tag string) error {
+	i := slices.Index(f.tags, tag)
+	if eventID != 1 || i < 0 {
+		return database.ErrEventTagNotFound
+	}
+	f.tags = slices.Delete(f.tags, i, i+1)
+	return nil
+}
+
+func TestEventTagRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		storeErr       error
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectBody     string
+		expectTags     []string
+	}{
+		{name: "add", method: http.MethodPost, path: "/events/1/tags", body: `{"tags":["test","bot-traffic","test"]}`, expectedStatus: http.StatusOK, expectBody: `{"event_id":1,"tags":["bot-traffic","test","vip"]}`, expectTags: []string{"bot-traffic", "test", "vip"}},
+		{name: "add to an unknown event", method: http.MethodPost, path: "/events/2/tags", body: `{"tags":["test"]}`, expectedStatus: http.StatusNotFound, expectBody: CodeNotFound, expectTags: []string{"vip"}},
+		{name: "add to an invalid id", method: http.MethodPost, path: "/events/first/tags", body: `{"tags":["test"]}`, expectedStatus: http.StatusNotFound, expectTags: []string{"vip"}},
+		{name: "add no tags", method: http.MethodPost, path: "/events/1/tags", body: `{"tags":[]}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"tags"`, expectTags: []string{"vip"}},
+		{name: "add an invalid tag", method: http.MethodPost, path: "/events/1/tags", body: `{"tags":["ok","bot traffic"]}`, expectedStatus: http.StatusUnprocessableEntity, expectBody: `"field":"tags[1]"`, expectTags: []string{"vip"}},
+		{name: "add while the database is down", storeErr: errors.New("connection refused"), method: http.MethodPost, path: "/events/1/tags", body: `{"tags":["test"]}`, expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable, expectTags: []string{"vip"}},
+		{name: "list", method: http.MethodGet, path: "/events/1/tags", expectedStatus: http.StatusOK, expectBody: `"tags":["vip"]`, expectTags: []string{"vip"}},
+		{name: "remove", method: http.MethodDelete, path: "/events/1/tags/vip", expectedStatus: http.StatusNoContent, expectTags: []string{}},
+		{name: "remove a missing tag", method: http.MethodDelete, path: "/events/1/tags/test", expectedStatus: http.StatusNotFound, expectTags: []string{"vip"}},
+		{name: "not available", unconfigured: true, method: http.MethodGet, path: "/events/1/tags", expectedStatus: http.StatusNotFound, expectBody: "not available"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := &fakeEventTags{tags: []string{"vip"}, err: tt.storeErr}
+			s := &Server{l: logger, db: &mockDB{}, eventTags: tags}
+			if tt.unconfigured {
+				s.eventTags = nil
+			}
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events/:id/tags", s.AddEventTagsHandler)
+			router.GET("/events/:id/tags", s.ListEventTagsHandler)
+			router.DELETE("/events/:id/tags/:tag", s.RemoveEventTagHandler)
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if !tt.unconfigured && !slices.Equal(tags.tags, tt.expectTags) {
+				t.Fatalf("expected tags %v got %v", tt.expectTags, tags.tags)
+			}
+		})
+	}
+}
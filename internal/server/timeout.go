@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// TimeoutMiddleware cancels the request context after d, so one slow query
+// cannot hold a worker past the server WriteTimeout. If the handler gave up
+// without answering, a 504 problem is written. A zero d disables the deadline.
+func (s *Server) TimeoutMiddleware(d time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if d <= 0 {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		if !c.Writer.Written() && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			abortWithProblem(c, http.StatusGatewayTimeout, CodeTimeout, "request exceeded "+d.String())
+		}
+	}
+}
+
+// abortWithDBError answers a failed database call, distinguishing a request
+// that ran out of time and a database known to be down (circuit breaker
+// open, 503) from a failing query.
+func abortWithDBError(c *gin.Context, err error, detail string) {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) {
+		abortWithProblem(c, http.StatusGatewayTimeout, CodeTimeout, detail+": request timed out")
+		return
+	}
+	if errors.Is(err, database.ErrCircuitOpen) {
+		c.Header("Retry-After", "1")
+		abortWithProblem(c, http.StatusServiceUnavailable, CodeDBUnavailable, detail+": database temporarily unavailable")
+		return
+	}
+	abortWithProblem(c, http.StatusInternalServerError, CodeDBUnavailable, detail)
+}
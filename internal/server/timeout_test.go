@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		timeout        time.Duration
+		handler        gin.HandlerFunc
+		expectedStatus int
+		expectCode     string
+	}{
+		{
+			name:           "fast handler",
+			timeout:        time.Second,
+			handler:        func(c *gin.Context) { c.Status(http.StatusOK) },
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:    "handler gives up without answering",
+			timeout: 10 * time.Millisecond,
+			handler: func(c *gin.Context) {
+				<-c.Request.Context().Done()
+			},
+			expectedStatus: http.StatusGatewayTimeout,
+			expectCode:     CodeTimeout,
+		},
+		{
+			name:    "database call exceeds deadline",
+			timeout: 10 * time.Millisecond,
+			handler: func(c *gin.Context) {
+				<-c.Request.Context().Done()
+				abortWithDBError(c, fmt.Errorf("query: %w", c.Request.Context().Err()), "failed to fetch events")
+			},
+			expectedStatus: http.StatusGatewayTimeout,
+			expectCode:     CodeTimeout,
+		},
+		{
+			name:    "database failure within deadline",
+			timeout: time.Second,
+			handler: func(c *gin.Context) {
+				abortWithDBError(c, fmt.Errorf("boom"), "failed to fetch events")
+			},
+			expectedStatus: http.StatusInternalServerError,
+			expectCode:     CodeDBUnavailable,
+		},
+		{
+			name:    "circuit breaker open",
+			timeout: time.Second,
+			handler: func(c *gin.Context) {
+				abortWithDBError(c, database.ErrCircuitOpen, "failed to fetch events")
+			},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectCode:     CodeDBUnavailable,
+		},
+		{
+			name:    "disabled",
+			timeout: 0,
+			handler: func(c *gin.Context) {
+				if _, ok := c.Request.Context().Deadline(); ok {
+					c.Status(http.StatusInternalServerError)
+					return
+				}
+				c.Status(http.StatusOK)
+			},
+			expectedStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{l: logger}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.GET("/test", s.TimeoutMiddleware(tt.timeout), tt.handler)
+
+			req := httptest.NewRequest(http.MethodGet, "/test", nil).WithContext(context.Background())
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if tt.expectCode != "" {
+				assertProblem(t, rr, tt.expectCode)
+			}
+		})
+	}
+}
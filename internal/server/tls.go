@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// newTLSConfig returns the TLS settings used when the server terminates TLS
+// itself: TLS 1.2 as the minimum version and only AEAD cipher suites with
+// forward secrecy (TLS 1.3 suites are not configurable and always secure).
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{
+			tls.X25519,
+			tls.CurveP256,
+		},
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// EnableACME configures srv to obtain and renew its certificates from
+// Let's Encrypt for the configured domains, caching them on disk. The
+// returned manager must also answer HTTP-01 challenges, see NewRedirectServer.
+func EnableACME(srv *http.Server, cfg config.TLSConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Cache:      autocert.DirCache(cfg.ACMECacheDir),
+		Email:      cfg.ACMEEmail,
+	}
+
+	tlsCfg := newTLSConfig()
+	tlsCfg.GetCertificate = m.GetCertificate
+	tlsCfg.NextProtos = []string{"h2", "http/1.1", "acme-tls/1"}
+	srv.TLSConfig = tlsCfg
+
+	return m
+}
+
+// NewRedirectServer returns a plain HTTP server listening on port that
+// permanently redirects every request to the same URL on the HTTPS port.
+// When certManager is not nil, ACME HTTP-01 challenges are answered first.
+func NewRedirectServer(port, httpsPort int, certManager *autocert.Manager) *http.Server {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+
+	var h http.Handler = handler
+	if certManager != nil {
+		h = certManager.HTTPHandler(handler)
+	}
+
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           h,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
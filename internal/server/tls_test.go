@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectServer(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsPort int
+		target    string
+		expected  string
+	}{
+		{
+			name:      "default https port",
+			httpsPort: 443,
+			target:    "http://example.com/api/events?user_id=1",
+			expected:  "https://example.com/api/events?user_id=1",
+		},
+		{
+			name:      "custom https port",
+			httpsPort: 8443,
+			target:    "http://example.com:8080/api/events",
+			expected:  "https://example.com:8443/api/events",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := NewRedirectServer(8080, tt.httpsPort, nil)
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			rr := httptest.NewRecorder()
+			srv.Handler.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusPermanentRedirect {
+				t.Fatalf("expected status %d got %d", http.StatusPermanentRedirect, rr.Code)
+			}
+			if loc := rr.Header().Get("Location"); loc != tt.expected {
+				t.Fatalf("expected location %q got %q", tt.expected, loc)
+			}
+		})
+	}
+}
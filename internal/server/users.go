@@ -0,0 +1,67 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/usercheck"
+)
+
+// checkUsers verifies the users of the events about to be stored in the
+// project of the request. In reject mode an unknown user fails the request
+// with 422; in flag mode the events are stored and the response carries a
+// Warning header naming the unknown users. The events are accepted when the
+// user service fails, so that an outage of the service does not stop the
+// ingestion. It returns false when the problem response was written.
+func (s *Server) checkUsers(c *gin.Context, userIDs ...int64) bool {
+	projectIDs := make([]int64, len(userIDs))
+	for i := range projectIDs {
+		projectIDs[i] = projectID(c)
+	}
+	return s.checkProjectUsers(c, projectIDs, userIDs)
+}
+
+// checkProjectUsers is checkUsers for events of several projects, the user
+// userIDs[i] being checked in the project projectIDs[i].
+func (s *Server) checkProjectUsers(c *gin.Context, projectIDs, userIDs []int64) bool {
+	if s.users == nil {
+		return true
+	}
+
+	var unknown []string
+	checked := make(map[[2]int64]bool, len(userIDs))
+	for i, id := range userIDs {
+		if checked[[2]int64{projectIDs[i], id}] {
+			continue
+		}
+		checked[[2]int64{projectIDs[i], id}] = true
+		exists, err := s.users.Exists(c.Request.Context(), projectIDs[i], id)
+		if err != nil {
+			// The other users would most likely fail the same way, after
+			// as many timeouts
+			s.l.Warn("user check failed, events accepted", "user_id", id, "error", err)
+			break
+		}
+		if !exists {
+			unknown = append(unknown, strconv.FormatInt(id, 10))
+		}
+	}
+	if len(unknown) == 0 {
+		return true
+	}
+
+	detail := "unknown user_id " + strings.Join(unknown, ", ")
+	switch s.userCheckMode {
+	case usercheck.Reject:
+		abortWithProblem(c, http.StatusUnprocessableEntity, CodeUnknownUser, detail)
+		return false
+	case usercheck.Flag:
+		c.Header("Warning", fmt.Sprintf("199 - %q", detail))
+		s.l.Warn("events of unknown users stored", "user_ids", unknown, "project_id", projectID(c))
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/usercheck"
+)
+
+// fakeUsers knows the users of its map; user 500 makes it fail.
+type fakeUsers map[int64]bool
+
+func (f fakeUsers) Exists(ctx context.Context, projectID, userID int64) (bool, error) {
+	if userID == 500 {
+		return false, errors.New("user service down")
+	}
+	return f[userID], nil
+}
+
+func TestCheckUsers(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	users := fakeUsers{1: true, 2: true}
+
+	tests := []struct {
+		name           string
+		mode           string
+		path           string
+		body           string
+		expectedStatus int
+		expectWarning  string
+		expectStored   bool
+	}{
+		{name: "known user", mode: usercheck.Reject, path: "/events", body: `{"user_id":1,"action":"view"}`, expectedStatus: http.StatusCreated, expectStored: true},
+		{name: "rejected", mode: usercheck.Reject, path: "/events", body: `{"user_id":3,"action":"view"}`, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "flagged", mode: usercheck.Flag, path: "/events", body: `{"user_id":3,"action":"view"}`, expectedStatus: http.StatusCreated, expectWarning: `199 - "unknown user_id 3"`, expectStored: true},
+		{name: "allowed", mode: usercheck.Allow, path: "/events", body: `{"user_id":3,"action":"view"}`, expectedStatus: http.StatusCreated, expectStored: true},
+		{name: "service down", mode: usercheck.Reject, path: "/events", body: `{"user_id":500,"action":"view"}`, expectedStatus: http.StatusCreated, expectStored: true},
+		{name: "batch rejected", mode: usercheck.Reject, path: "/events/batch", body: `{"events":[{"user_id":1,"action":"view"},{"user_id":4,"action":"view"},{"user_id":3,"action":"view"},{"user_id":4,"action":"click"}]}`, expectedStatus: http.StatusUnprocessableEntity},
+		{name: "batch flagged", mode: usercheck.Flag, path: "/events/batch", body: `{"events":[{"user_id":1,"action":"view"},{"user_id":4,"action":"view"},{"user_id":3,"action":"view"},{"user_id":4,"action":"click"}]}`, expectedStatus: http.StatusOK, expectWarning: `199 - "unknown user_id 4, 3"`, expectStored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{insertID: 1}
+			s := &Server{l: logger, db: db, users: users, userCheckMode: tt.mode}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/events", s.AddEventHandler)
+			router.POST("/events/batch", s.BatchEventsHandler)
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if rr.Code == http.StatusUnprocessableEntity {
+				assertProblem(t, rr, CodeUnknownUser)
+			}
+			if got := rr.Header().Get("Warning"); got != tt.expectWarning {
+				t.Fatalf("expected Warning %q got %q", tt.expectWarning, got)
+			}
+			if stored := db.insertCalled || db.lastBatch != nil; stored != tt.expectStored {
+				t.Fatalf("expected stored %v got %v", tt.expectStored, stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/webhook"
+)
+
+// maxWebhookBytes bounds webhook payloads.
+const maxWebhookBytes = 1 << 20
+
+// Webhooks verifies and maps the payloads of third-party webhook senders.
+type Webhooks interface {
+	Event(provider string, header http.Header, body []byte) (ingest.Event, error)
+}
+
+// WebhookHandler stores the event carried by a signed webhook payload. It
+// answers like POST /events, so that senders retry on 5xx responses only.
+func (s *Server) WebhookHandler(c *gin.Context) {
+	if s.webhooks == nil {
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, "webhooks are not configured")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxWebhookBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			abortWithProblem(c, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, err.Error())
+			return
+		}
+		abortWithProblem(c, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	e, err := s.webhooks.Event(c.Param("provider"), c.Request.Header, body)
+	switch {
+	case errors.Is(err, webhook.ErrUnknownProvider):
+		abortWithProblem(c, http.StatusNotFound, CodeNotFound, err.Error())
+		return
+	case errors.Is(err, webhook.ErrSignature):
+		abortWithProblem(c, http.StatusUnauthorized, CodeUnauthorized, err.Error())
+		return
+	case err != nil:
+		abortWithInvalid(c, err)
+		return
+	}
+
+	res, ok := s.storeEvent(c, e)
+	if !ok {
+		return
+	}
+	switch {
+	case res.duplicate != nil:
+		c.Status(http.StatusOK)
+	case res.accepted:
+		c.Status(http.StatusAccepted)
+	default:
+		c.Status(http.StatusCreated)
+	}
+}
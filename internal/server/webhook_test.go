@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/webhook"
+)
+
+type fakeWebhooks struct {
+	err error
+}
+
+func (f *fakeWebhooks) Event(provider string, header http.Header, body []byte) (ingest.Event, error) {
+	if f.err != nil {
+		return ingest.Event{}, f.err
+	}
+	return ingest.Event{UserID: 42, Action: provider + ".push"}, nil
+}
+
+func TestWebhookHandler(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	tests := []struct {
+		name           string
+		unconfigured   bool
+		err            error
+		insertErr      error
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "stored", expectedStatus: http.StatusCreated},
+		{name: "bad signature", err: webhook.ErrSignature, expectedStatus: http.StatusUnauthorized, expectBody: CodeUnauthorized},
+		{name: "unknown provider", err: webhook.ErrUnknownProvider, expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+		{name: "unmappable payload", err: fmt.Errorf("%w: %w", ingest.ErrInvalid, ingest.NewFieldError("sender.id", "required", "sender.id is missing")), expectedStatus: http.StatusUnprocessableEntity, expectBody: CodeValidationFailed},
+		{name: "malformed payload", err: fmt.Errorf("%w: unexpected EOF", ingest.ErrInvalid), expectedStatus: http.StatusBadRequest, expectBody: CodeInvalidRequest},
+		{name: "database down", insertErr: fmt.Errorf("db down"), expectedStatus: http.StatusInternalServerError, expectBody: CodeDBUnavailable},
+		{name: "not configured", unconfigured: true, expectedStatus: http.StatusNotFound, expectBody: "not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &mockDB{insertErr: tt.insertErr}
+			s := &Server{l: logger, db: db, webhooks: &fakeWebhooks{err: tt.err}}
+			if tt.unconfigured {
+				s.webhooks = nil
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.POST("/webhooks/:provider", s.WebhookHandler)
+
+			req := httptest.NewRequest(http.MethodPost, "/webhooks/github", bytes.NewReader([]byte(`{"sender":{"id":42}}`)))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+			if tt.expectedStatus == http.StatusCreated && (db.lastUserID != 42 || db.lastAction != "github.push") {
+				t.Fatalf("unexpected stored event %d %q", db.lastUserID, db.lastAction)
+			}
+		})
+	}
+}
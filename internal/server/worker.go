@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// WorkerOptions holds the runtime handles of cmd/worker reported on its
+// listener.
+type WorkerOptions struct {
+	DB        database.Service
+	Readiness ReadinessChecker
+	// LogLevel is changed by PUT /log/level without a restart.
+	LogLevel *slog.LevelVar
+	// DeepCheckers run on GET /health?deep=true.
+	DeepCheckers []DeepChecker
+	Started      time.Time
+	// Status describes the subsystems on GET /status, by name.
+	Status map[string]StatusReporter
+}
+
+// NewWorkerServer returns the listener of cmd/worker on WORKER_PORT. It
+// serves the operational endpoints of the admin listener: metrics, health,
+// readiness, status, the log level and profiling, with the same token and
+// CIDRs.
+func NewWorkerServer(logger *slog.Logger, cfg *config.Config, opts WorkerOptions) *http.Server {
+	s := &Server{
+		l:            logger,
+		db:           opts.DB,
+		readiness:    opts.Readiness,
+		logLevel:     opts.LogLevel,
+		deepCheckers: opts.DeepCheckers,
+		started:      opts.Started,
+		statuses:     opts.Status,
+
+		adminToken: cfg.Admin.Token,
+		strictJSON: cfg.Server.StrictJSON,
+	}
+	if s.started.IsZero() {
+		s.started = time.Now()
+	}
+	s.setIPFilter(cfg.Admin.AllowCIDRs, cfg.Admin.DenyCIDRs)
+
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Worker.Port),
+		Handler:           s.RegisterWorkerRoutes(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+func (s *Server) RegisterWorkerRoutes() http.Handler {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	_ = r.SetTrustedProxies(nil)
+	r.Use(gin.CustomRecovery(s.recoveryHandler))
+	r.Use(s.IPFilterMiddleware())
+	r.NoRoute(noRouteHandler)
+
+	r.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.GET("/health", s.HealthHandler)
+	r.GET("/ready", s.ReadyHandler)
+
+	admin := r.Group("/", s.AdminAuthMiddleware())
+	admin.GET("/status", s.StatusHandler)
+	admin.GET("/log/level", s.GetLogLevelHandler)
+	admin.PUT("/log/level", s.SetLogLevelHandler)
+
+	debug := r.Group("/debug/pprof", s.AdminAuthMiddleware())
+	debug.GET("/*profile", s.PprofHandler)
+	debug.POST("/symbol", gin.WrapF(pprof.Symbol))
+
+	return r
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWorkerRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	statuses := map[string]StatusReporter{
+		"sources": StatusFunc(func(context.Context) (any, error) { return []string{"kafka consumer"}, nil }),
+	}
+
+	tests := []struct {
+		name           string
+		authHeader     string
+		path           string
+		expectedStatus int
+		expectBody     string
+	}{
+		{name: "health", path: "/health", expectedStatus: http.StatusOK, expectBody: `"status":"up"`},
+		{name: "ready", path: "/ready", expectedStatus: http.StatusOK, expectBody: `"status":"ready"`},
+		{name: "metrics", path: "/metrics", expectedStatus: http.StatusOK, expectBody: "go_goroutines"},
+		{name: "status", authHeader: "Bearer secret", path: "/status", expectedStatus: http.StatusOK, expectBody: `"sources":["kafka consumer"]`},
+		{name: "status without token", path: "/status", expectedStatus: http.StatusUnauthorized, expectBody: CodeUnauthorized},
+		{name: "no admin api", authHeader: "Bearer secret", path: "/projects", expectedStatus: http.StatusNotFound, expectBody: CodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				l:          logger,
+				db:         &mockDB{health: map[string]string{"status": "up"}},
+				readiness:  readyManager(logger),
+				adminToken: "secret",
+				statuses:   statuses,
+			}
+			router := s.RegisterWorkerRoutes()
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Fatalf("expected status %d got %d, body: %s", tt.expectedStatus, rr.Code, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.expectBody) {
+				t.Fatalf("expected body to contain %q, got: %s", tt.expectBody, rr.Body.String())
+			}
+		})
+	}
+}
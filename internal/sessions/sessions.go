@@ -0,0 +1,77 @@
+// Package sessions groups the events of a user into sessions: runs of
+// events without a gap of inactivity longer than a configured one.
+//
+// Sessions are derived on demand from the stored events, read newest first
+// through the database.Service chain, so that pseudonymized user ids and
+// shards are handled like for GET /events and nothing has to be kept in
+// sync with the events.
+package sessions
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Session is a run of events of a user. Its ID is the id of its first
+// event.
+type Session struct {
+	ID              int64     `json:"id"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds int64     `json:"duration_seconds"`
+	Events          int       `json:"events"`
+}
+
+// Sessionizer reads the events of users and splits them into sessions.
+type Sessionizer struct {
+	db  database.Streamer
+	gap time.Duration
+}
+
+// New returns a Sessionizer starting a new session after gap without events.
+func New(db database.Streamer, gap time.Duration) *Sessionizer {
+	return &Sessionizer{db: db, gap: gap}
+}
+
+// errEnough stops reading the events once the sessions are found.
+var errEnough = errors.New("enough sessions")
+
+// Recent returns the latest limit sessions of the user with events between
+// the optional start and end, newest first; a limit of 0 returns them all.
+// Sessions crossing start or end only count their events within the range.
+func (s *Sessionizer) Recent(ctx context.Context, projectID, userID int64, start, end *time.Time, limit int) ([]Session, error) {
+	found := []Session{}
+	var cur *Session
+	err := s.db.StreamEvents(ctx, projectID, &userID, start, end, 0, func(e database.Event) error {
+		if cur != nil && cur.Start.Sub(e.CreatedAt) <= s.gap {
+			cur.ID, cur.Start = e.ID, e.CreatedAt
+			cur.Events++
+			return nil
+		}
+		if cur != nil {
+			found = append(found, cur.done())
+			if limit > 0 && len(found) == limit {
+				cur = nil
+				return errEnough
+			}
+		}
+		cur = &Session{ID: e.ID, Start: e.CreatedAt, End: e.CreatedAt, Events: 1}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errEnough) {
+		return nil, err
+	}
+	if cur != nil {
+		found = append(found, cur.done())
+	}
+	return found, nil
+}
+
+// done sets the duration of the session once its first event is known.
+func (s *Session) done() Session {
+	s.DurationSeconds = int64(s.End.Sub(s.Start).Seconds())
+	return *s
+}
@@ -0,0 +1,82 @@
+package sessions
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeStreamer streams its events, stored newest first, and counts the
+// events read.
+type fakeStreamer struct {
+	events []database.Event
+	read   int
+	err    error
+}
+
+func (f *fakeStreamer) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	if f.err != nil {
+		return f.err
+	}
+	for _, e := range f.events {
+		f.read++
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestRecent(t *testing.T) {
+	base := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	minutes := []int{0, 10, 35, 100, 101, 200}
+	db := &fakeStreamer{}
+	for i := len(minutes) - 1; i >= 0; i-- {
+		db.events = append(db.events, database.Event{ID: int64(i + 1), UserID: 7, CreatedAt: base.Add(time.Duration(minutes[i]) * time.Minute)})
+	}
+	s := New(db, 30*time.Minute)
+
+	got, err := s.Recent(context.Background(), 1, 7, nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []Session{
+		{ID: 6, Start: base.Add(200 * time.Minute), End: base.Add(200 * time.Minute), Events: 1},
+		{ID: 4, Start: base.Add(100 * time.Minute), End: base.Add(101 * time.Minute), DurationSeconds: 60, Events: 2},
+		// 25 minutes apart: the gap is not exceeded
+		{ID: 1, Start: base, End: base.Add(35 * time.Minute), DurationSeconds: 35 * 60, Events: 3},
+	}
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d sessions got %+v", len(expect), got)
+	}
+	for i := range expect {
+		if got[i] != expect[i] {
+			t.Fatalf("expected session %d to be %+v got %+v", i, expect[i], got[i])
+		}
+	}
+
+	// Reading stops at the first event of the session after the last one
+	db.read = 0
+	got, err = s.Recent(context.Background(), 1, 7, nil, nil, 2)
+	if err != nil || len(got) != 2 || got[1].ID != 4 {
+		t.Fatalf("expected the 2 latest sessions got %+v, %v", got, err)
+	}
+	if db.read != 4 {
+		t.Fatalf("expected 4 events read got %d", db.read)
+	}
+
+	db.err = errors.New("connection refused")
+	if _, err := s.Recent(context.Background(), 1, 7, nil, nil, 0); err == nil {
+		t.Fatal("expected the error of the database")
+	}
+}
+
+func TestRecentWithoutEvents(t *testing.T) {
+	got, err := New(&fakeStreamer{}, time.Minute).Recent(context.Background(), 1, 7, nil, nil, 10)
+	if err != nil || got == nil || len(got) != 0 {
+		t.Fatalf("expected no sessions got %+v, %v", got, err)
+	}
+}
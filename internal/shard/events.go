@@ -0,0 +1,43 @@
+package shard
+
+import (
+	"context"
+	"errors"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// EventStore runs the maintenance operations of the admin API on every
+// shard, since a filter may match the events of several users.
+type EventStore struct {
+	shards []database.EventMaintainer
+}
+
+func NewEventStore(shards []database.EventMaintainer) *EventStore {
+	return &EventStore{shards: shards}
+}
+
+func (s *EventStore) Count(ctx context.Context, f database.EventFilter) (int64, error) {
+	var total int64
+	for _, shard := range s.shards {
+		n, err := shard.Count(ctx, f)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Delete removes the matching events of every shard, even when one fails,
+// and returns how many were removed along with the failures.
+func (s *EventStore) Delete(ctx context.Context, f database.EventFilter) (int64, error) {
+	var total int64
+	var errs []error
+	for _, shard := range s.shards {
+		n, err := shard.Delete(ctx, f)
+		total += n
+		errs = append(errs, err)
+	}
+	return total, errors.Join(errs...)
+}
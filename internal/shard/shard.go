@@ -0,0 +1,146 @@
+// Package shard spreads the events across several databases, for tenants
+// outgrowing a single one.
+//
+// An event is stored in the shard picked by a hash of its user_id, so that
+// the events of a user stay together: queries of a user and the duplicate
+// checks of InsertEventOnce go to a single shard, the other queries fan out
+// to all of them and their results are merged. Changing the number of
+// shards moves most users to another shard; their events must then be
+// moved offline.
+package shard
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Router is a Service storing each event in one of its shards.
+type Router struct {
+	shards []database.Service
+}
+
+var _ database.Service = (*Router)(nil)
+
+// New routes the events across shards. The order of shards picks the shard
+// of every user, so it must not change.
+func New(shards []database.Service) *Router {
+	return &Router{shards: shards}
+}
+
+// Of returns the index of the shard of the user among n.
+func Of(userID int64, n int) int {
+	h := fnv.New64a()
+	h.Write(strconv.AppendInt(nil, userID, 10))
+	return int(h.Sum64() % uint64(n))
+}
+
+func (r *Router) shard(userID int64) database.Service {
+	return r.shards[Of(userID, len(r.shards))]
+}
+
+// Health reports the health of every shard under shard_<index>_<key>, and
+// is up when every shard is.
+func (r *Router) Health() map[string]string {
+	stats := map[string]string{
+		"status": "up",
+		"shards": strconv.Itoa(len(r.shards)),
+	}
+	for i, s := range r.shards {
+		for k, v := range s.Health() {
+			stats["shard_"+strconv.Itoa(i)+"_"+k] = v
+		}
+		if status := stats["shard_"+strconv.Itoa(i)+"_status"]; status != "up" {
+			stats["status"] = status
+		}
+	}
+	return stats
+}
+
+func (r *Router) Close() error {
+	var errs []error
+	for _, s := range r.shards {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Router) InsertEvent(ctx context.Context, projectID, userID int64, action string, metadata map[string]string) (int64, error) {
+	return r.shard(userID).InsertEvent(ctx, projectID, userID, action, metadata)
+}
+
+func (r *Router) InsertEventOnce(ctx context.Context, e database.NewEvent, window time.Duration) (database.Event, bool, error) {
+	return r.shard(e.UserID).InsertEventOnce(ctx, e, window)
+}
+
+// InsertEvents stores the events of each shard in one batch, the shards in
+// parallel. A batch spanning shards is not atomic: when a shard fails, the
+// events of the others may be stored.
+func (r *Router) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	batches := make([][]database.NewEvent, len(r.shards))
+	for _, e := range events {
+		i := Of(e.UserID, len(r.shards))
+		batches[i] = append(batches[i], e)
+	}
+	return r.each(func(i int, s database.Service) error {
+		if len(batches[i]) == 0 {
+			return nil
+		}
+		return s.InsertEvents(ctx, batches[i])
+	})
+}
+
+// GetEvents asks the shard of the user, or every shard for the newest
+// events of each and keeps the newest of all.
+func (r *Router) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	if userID != nil {
+		return r.shard(*userID).GetEvents(ctx, projectID, userID, start, end, limit)
+	}
+
+	results := make([][]database.Event, len(r.shards))
+	err := r.each(func(i int, s database.Service) error {
+		var err error
+		results[i], err = s.GetEvents(ctx, projectID, userID, start, end, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := slices.Concat(results...)
+	slices.SortStableFunc(events, func(a, b database.Event) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// AggregateEvents aggregates the events of every shard into its own
+// aggregates tables; the counts of an action are split across the shards.
+func (r *Router) AggregateEvents(seconds int) error {
+	return r.each(func(_ int, s database.Service) error {
+		return s.AggregateEvents(seconds)
+	})
+}
+
+// each calls fn with every shard in parallel and returns their errors.
+func (r *Router) each(fn func(i int, s database.Service) error) error {
+	errs := make([]error, len(r.shards))
+	var wg sync.WaitGroup
+	for i, s := range r.shards {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i, s)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,182 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+)
+
+// memDB stores the events of a shard in memory, failing every call with
+// err when set.
+type memDB struct {
+	database.Service
+	mu     sync.Mutex
+	events []database.Event
+	err    error
+}
+
+func (m *memDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	for _, e := range events {
+		m.events = append(m.events, database.Event{ID: int64(len(m.events) + 1), UserID: e.UserID, Action: e.Action, CreatedAt: e.CreatedAt})
+	}
+	return nil
+}
+
+func (m *memDB) GetEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int) ([]database.Event, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	var events []database.Event
+	for _, e := range m.events {
+		if userID == nil || e.UserID == *userID {
+			events = append(events, e)
+		}
+	}
+	slices.SortFunc(events, func(a, b database.Event) int { return b.CreatedAt.Compare(a.CreatedAt) })
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+func (m *memDB) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	events, err := m.GetEvents(ctx, projectID, userID, start, end, limit)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRouter(n int) (*Router, []*memDB) {
+	dbs := make([]*memDB, n)
+	shards := make([]database.Service, n)
+	for i := range dbs {
+		dbs[i] = &memDB{}
+		shards[i] = dbs[i]
+	}
+	return New(shards), dbs
+}
+
+func TestRouter(t *testing.T) {
+	r, dbs := newRouter(3)
+	ctx := context.Background()
+	base := time.Unix(1700000000, 0)
+
+	// One event a second, users 1 to 10 in turn
+	var events []database.NewEvent
+	for i := range 30 {
+		events = append(events, database.NewEvent{UserID: int64(i%10 + 1), Action: "view", CreatedAt: base.Add(time.Duration(i) * time.Second)})
+	}
+	if err := r.InsertEvents(ctx, events); err != nil {
+		t.Fatal(err)
+	}
+	for i, db := range dbs {
+		if len(db.events) == 0 || len(db.events) == len(events) {
+			t.Fatalf("expected the events spread across the shards, shard %d holds %d", i, len(db.events))
+		}
+		for _, e := range db.events {
+			if Of(e.UserID, len(dbs)) != i {
+				t.Fatalf("expected user %d in shard %d, found in %d", e.UserID, Of(e.UserID, len(dbs)), i)
+			}
+		}
+	}
+
+	user := int64(4)
+	got, err := r.GetEvents(ctx, 0, &user, nil, nil, 0)
+	if err != nil || len(got) != 3 {
+		t.Fatalf("expected the 3 events of the user, got %d, %v", len(got), err)
+	}
+
+	// Fan-out: the newest of every shard, merged
+	got, err = r.GetEvents(ctx, 0, nil, nil, nil, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamed []database.Event
+	err = r.StreamEvents(ctx, 0, nil, nil, nil, 12, func(e database.Event) error {
+		streamed = append(streamed, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, events := range map[string][]database.Event{"get": got, "stream": streamed} {
+		if len(events) != 12 {
+			t.Fatalf("%s: expected 12 events got %d", name, len(events))
+		}
+		for i, e := range events {
+			if want := base.Add(time.Duration(29-i) * time.Second); !e.CreatedAt.Equal(want) {
+				t.Fatalf("%s: expected event %d created at %s got %s", name, i, want, e.CreatedAt)
+			}
+		}
+	}
+
+	// A stream stopped early leaves no shard behind
+	stop := errors.New("stop")
+	n := 0
+	err = r.StreamEvents(ctx, 0, nil, nil, nil, 0, func(e database.Event) error {
+		if n++; n == 5 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || n != 5 {
+		t.Fatalf("expected the stream to stop at the 5th event, got %d, %v", n, err)
+	}
+}
+
+func TestFailingShard(t *testing.T) {
+	r, dbs := newRouter(2)
+	ctx := context.Background()
+	down := errors.New("shard down")
+	dbs[1].err = down
+
+	if _, err := r.GetEvents(ctx, 0, nil, nil, nil, 10); !errors.Is(err, down) {
+		t.Fatalf("expected the error of the shard, got %v", err)
+	}
+	err := r.StreamEvents(ctx, 0, nil, nil, nil, 0, func(database.Event) error { return nil })
+	if !errors.Is(err, down) {
+		t.Fatalf("expected the stream to fail with the shard, got %v", err)
+	}
+
+	var events []database.NewEvent
+	for user := range int64(10) {
+		events = append(events, database.NewEvent{UserID: user, Action: "view"})
+	}
+	if err := r.InsertEvents(ctx, events); !errors.Is(err, down) {
+		t.Fatalf("expected the batch to fail with the shard, got %v", err)
+	}
+	if len(dbs[0].events) == 0 {
+		t.Fatal("expected the events of the healthy shard stored")
+	}
+}
+
+func TestFilterEventsOnTags(t *testing.T) {
+	r, _ := newRouter(2)
+	expr, err := filter.Parse(`action == "view" && tag != "bot-traffic"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.FilterEvents(context.Background(), 0, expr, nil, nil, nil, 0, func(database.Event) error { return nil })
+	if !errors.Is(err, database.ErrFilterUnsupported) {
+		t.Fatalf("expected tag filters to be unsupported, got %v", err)
+	}
+}
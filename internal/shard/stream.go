@@ -0,0 +1,105 @@
+package shard
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/filter"
+)
+
+// cursor reads the events streamed by a shard. err is set once events is
+// closed.
+type cursor struct {
+	events chan database.Event
+	err    error
+	head   database.Event
+	ok     bool
+}
+
+func (c *cursor) next() {
+	c.head, c.ok = <-c.events
+}
+
+// StreamEvents streams from the shard of the user, or merges the streams of
+// every shard, newest first, holding one event per shard in memory.
+func (r *Router) StreamEvents(ctx context.Context, projectID int64, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	if userID != nil {
+		return r.shard(*userID).StreamEvents(ctx, projectID, userID, start, end, limit, fn)
+	}
+	return r.merge(ctx, limit, func(ctx context.Context, s database.Service, fn func(database.Event) error) error {
+		return s.StreamEvents(ctx, projectID, nil, start, end, limit, fn)
+	}, fn)
+}
+
+// FilterEvents filters on the shard of the user, or merges the filtered
+// streams of every shard like StreamEvents. Events cannot be tagged with
+// shards, so filters on tags are rejected.
+func (r *Router) FilterEvents(ctx context.Context, projectID int64, expr *filter.Expr, userID *int64, start *time.Time, end *time.Time, limit int, fn func(database.Event) error) error {
+	if expr.Uses("tag") {
+		return fmt.Errorf("%w: tags are not available with shards", database.ErrFilterUnsupported)
+	}
+	if userID != nil {
+		return r.shard(*userID).FilterEvents(ctx, projectID, expr, userID, start, end, limit, fn)
+	}
+	return r.merge(ctx, limit, func(ctx context.Context, s database.Service, fn func(database.Event) error) error {
+		return s.FilterEvents(ctx, projectID, expr, nil, start, end, limit, fn)
+	}, fn)
+}
+
+// merge calls fn with the events streamed by every shard, newest first, at
+// most limit events unless 0.
+func (r *Router) merge(ctx context.Context, limit int, stream func(ctx context.Context, s database.Service, fn func(database.Event) error) error, fn func(database.Event) error) error {
+	// The shards still streaming are canceled before waiting for them
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cursors := make([]*cursor, len(r.shards))
+	for i, s := range r.shards {
+		c := &cursor{events: make(chan database.Event)}
+		cursors[i] = c
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(c.events)
+			c.err = stream(ctx, s, func(e database.Event) error {
+				select {
+				case c.events <- e:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+		}()
+	}
+
+	for _, c := range cursors {
+		c.next()
+		if !c.ok && c.err != nil {
+			return c.err
+		}
+	}
+	for sent := 0; limit <= 0 || sent < limit; sent++ {
+		var newest *cursor
+		for _, c := range cursors {
+			if c.ok && (newest == nil || c.head.CreatedAt.After(newest.head.CreatedAt)) {
+				newest = c
+			}
+		}
+		if newest == nil {
+			break
+		}
+		if err := fn(newest.head); err != nil {
+			return err
+		}
+		newest.next()
+		if !newest.ok && newest.err != nil {
+			return newest.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package signing
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifier(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := NewVerifier([]string{"new-secret", "old-secret"}, 5*time.Minute)
+	v.now = func() time.Time { return now }
+	body := []byte(`{"user_id":1,"action":"view"}`)
+
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		err    error
+	}{
+		{name: "current secret", header: Sign("new-secret", now, body), body: body},
+		{name: "previous secret", header: Sign("old-secret", now.Add(-time.Minute), body), body: body},
+		{name: "one of several signatures", header: Sign("other", now, body) + ",v1=" + strings.TrimPrefix(Sign("new-secret", now, []byte("{}")), "t=1700000000,v1="), body: []byte("{}")},
+		{name: "replayed", header: Sign("new-secret", now, body), body: body, err: ErrReplayed},
+		{name: "missing", body: body, err: ErrMissing},
+		{name: "malformed", header: "v1=abc", body: body, err: ErrMalformed},
+		{name: "too old", header: Sign("new-secret", now.Add(-6*time.Minute), body), body: body, err: ErrExpired},
+		{name: "from the future", header: Sign("new-secret", now.Add(6*time.Minute), body), body: body, err: ErrExpired},
+		{name: "wrong secret", header: Sign("wrong", now, body), body: body, err: ErrMismatch},
+		{name: "tampered body", header: Sign("new-secret", now.Add(-2*time.Second), body), body: []byte(`{"user_id":2,"action":"view"}`), err: ErrMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := v.Verify(tt.header, tt.body); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifierPrunesExpiredSignatures(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v := NewVerifier([]string{"secret"}, time.Minute)
+	v.now = func() time.Time { return now }
+
+	for i := range minPrune {
+		body := []byte{byte(i), byte(i >> 8)}
+		if err := v.Verify(Sign("secret", now, body), body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now = now.Add(2 * time.Minute)
+	if err := v.Verify(Sign("secret", now, nil), nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.seen) != 1 {
+		t.Fatalf("expected the expired signatures to be dropped, %d left", len(v.seen))
+	}
+}
@@ -0,0 +1,208 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// mapping makes actions facetable and metadata searchable by words and by
+// exact value.
+const mapping = `{
+  "mappings": {
+    "properties": {
+      "id": {"type": "long"},
+      "user_id": {"type": "long"},
+      "action": {"type": "keyword"},
+      "metadata_page": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 1024}}},
+      "created_at": {"type": "date"},
+      "project_id": {"type": "long"},
+      "expires_at": {"type": "date"}
+    }
+  }
+}`
+
+// Client talks to the REST API shared by Elasticsearch and OpenSearch.
+type Client struct {
+	url      string
+	username string
+	password string
+	apiKey   string
+	retries  int
+	backoff  time.Duration
+	http     *http.Client
+}
+
+// NewClient creates a client for the cluster of cfg.
+func NewClient(cfg config.ElasticsearchSinkConfig) *Client {
+	return &Client{
+		url:      strings.TrimRight(cfg.URL, "/"),
+		username: cfg.Username,
+		password: cfg.Password,
+		apiKey:   cfg.APIKey,
+		retries:  cfg.MaxRetries,
+		backoff:  500 * time.Millisecond,
+		http:     &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+	}
+}
+
+// BulkResult counts the documents of a bulk request.
+type BulkResult struct {
+	Indexed int
+	// Rejected documents failed for a reason retrying does not fix, such as
+	// a mapping conflict. Reason is the error of the first one.
+	Rejected int
+	Reason   string
+}
+
+// EnsureIndex creates index with the events mapping unless it exists.
+func (c *Client) EnsureIndex(ctx context.Context, index string) error {
+	resp, err := c.do(ctx, http.MethodHead, "/"+index, "", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("check index %s: status %d", index, resp.StatusCode)
+	}
+
+	resp, err = c.do(ctx, http.MethodPut, "/"+index, "application/json", strings.NewReader(mapping))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	// Another instance may have created it in the meantime
+	if resp.StatusCode/100 != 2 && !bytes.Contains(body, []byte("resource_already_exists_exception")) {
+		return fmt.Errorf("create index %s: status %d: %s", index, resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// Index stores events in index with their id as document id, so indexing
+// an event again replaces it. Documents failing with 429 or 5xx are retried
+// with backoff; an error is returned when some are still failing after the
+// last retry.
+func (c *Client) Index(ctx context.Context, index string, events []database.Event) (BulkResult, error) {
+	var res BulkResult
+	pending := events
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		retry, rejected, reason, err := c.bulk(ctx, index, pending)
+		if err == nil {
+			res.Indexed += len(pending) - len(retry) - rejected
+			res.Rejected += rejected
+			if res.Reason == "" {
+				res.Reason = reason
+			}
+			if len(retry) == 0 {
+				return res, nil
+			}
+			pending = retry
+			err = fmt.Errorf("%d documents not indexed", len(retry))
+		}
+		if attempt >= c.retries {
+			return res, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// bulk sends one bulk request. It returns the events to retry, the number
+// of rejected ones and the reason of the first; err is set when the whole
+// request failed.
+func (c *Client) bulk(ctx context.Context, index string, events []database.Event) (retry []database.Event, rejected int, reason string, err error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range events {
+		action := map[string]any{"index": map[string]string{"_index": index, "_id": strconv.FormatInt(e.ID, 10)}}
+		if err := enc.Encode(action); err != nil {
+			return nil, 0, "", err
+		}
+		if err := enc.Encode(e); err != nil {
+			return nil, 0, "", err
+		}
+	}
+
+	resp, err := c.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &body)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, "", fmt.Errorf("bulk request: status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	var out bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, 0, "", fmt.Errorf("decode bulk response: %w", err)
+	}
+	if !out.Errors {
+		return nil, 0, "", nil
+	}
+	if len(out.Items) != len(events) {
+		return nil, 0, "", fmt.Errorf("bulk response has %d items for %d documents", len(out.Items), len(events))
+	}
+	for i, item := range out.Items {
+		for _, result := range item {
+			switch {
+			case result.Status < 300:
+			case result.Status == http.StatusTooManyRequests || result.Status >= 500:
+				retry = append(retry, events[i])
+			default:
+				rejected++
+				if reason == "" && result.Error != nil {
+					reason = fmt.Sprintf("document %d: %s: %s", events[i].ID, result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+	}
+	return retry, rejected, reason, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+	return c.http.Do(req)
+}
@@ -0,0 +1,149 @@
+// Package elasticsearch indexes the stored events into Elasticsearch or
+// OpenSearch for full-text and faceted search. Events are relayed from the
+// events table in id order with the bulk API, and the event id is the
+// document id: an event indexed twice after a crash is replaced, not
+// duplicated. Reindex rebuilds an index from Postgres.
+package elasticsearch
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// sink names the relay cursor in sink_cursors.
+const sink = "elasticsearch"
+
+var documentsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sink_elasticsearch_documents_total",
+		Help: "Events sent to the Elasticsearch sink by result: indexed, rejected (skipped) or failed (retried on the next poll)",
+	},
+	[]string{"index", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(documentsTotal)
+}
+
+// Relayer is the part of database.Outbox used by the indexer.
+type Relayer interface {
+	Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []database.Event) error) (int, error)
+}
+
+type Indexer struct {
+	l       *slog.Logger
+	client  *Client
+	outbox  Relayer
+	index   string
+	poll    time.Duration
+	settle  time.Duration
+	size    int
+	now     func() time.Time
+	ensured bool
+
+	stopPoll    context.CancelFunc
+	stopPublish context.CancelFunc
+	done        chan struct{}
+}
+
+// New creates an indexer for cfg. It does not connect until Start.
+func New(logger *slog.Logger, cfg config.ElasticsearchSinkConfig, outbox Relayer) *Indexer {
+	return &Indexer{
+		l:      logger.With("sink", sink, "index", cfg.Index),
+		client: NewClient(cfg),
+		outbox: outbox,
+		index:  cfg.Index,
+		poll:   time.Duration(cfg.PollIntervalMillis) * time.Millisecond,
+		settle: time.Duration(cfg.SettleMillis) * time.Millisecond,
+		size:   cfg.BatchSize,
+		now:    time.Now,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start indexes in the background until Stop is called.
+func (x *Indexer) Start() {
+	pollCtx, stopPoll := context.WithCancel(context.Background())
+	publishCtx, stopPublish := context.WithCancel(context.Background())
+	x.stopPoll, x.stopPublish = stopPoll, stopPublish
+
+	go func() {
+		defer close(x.done)
+		x.run(pollCtx, publishCtx)
+	}()
+	x.l.Info("elasticsearch sink started")
+}
+
+// Stop stops polling and waits for the batch in progress. When ctx expires
+// first, the batch is abandoned and indexed again after a restart.
+func (x *Indexer) Stop(ctx context.Context) error {
+	x.stopPoll()
+	select {
+	case <-x.done:
+	case <-ctx.Done():
+		x.stopPublish()
+		<-x.done
+	}
+	x.stopPublish()
+	return nil
+}
+
+func (x *Indexer) run(pollCtx, publishCtx context.Context) {
+	ticker := time.NewTicker(x.poll)
+	defer ticker.Stop()
+	for {
+		x.relay(pollCtx, publishCtx)
+		select {
+		case <-pollCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay indexes batches until the events caught up with the settle delay.
+func (x *Indexer) relay(pollCtx, publishCtx context.Context) {
+	for pollCtx.Err() == nil {
+		n, err := x.outbox.Relay(publishCtx, sink, x.now().Add(-x.settle), x.size, x.publish)
+		if err != nil {
+			if publishCtx.Err() == nil {
+				x.l.Warn("failed to index events, retrying on the next poll", "error", err)
+			}
+			return
+		}
+		if n < x.size {
+			return
+		}
+	}
+}
+
+// publish indexes a batch. Rejected documents are logged and skipped, so a
+// single event the mapping refuses does not stop the sink.
+func (x *Indexer) publish(ctx context.Context, events []database.Event) error {
+	// The index is created with the mapping before the first document,
+	// which would otherwise create it with guessed field types
+	if !x.ensured {
+		if err := x.client.EnsureIndex(ctx, x.index); err != nil {
+			return err
+		}
+		x.ensured = true
+	}
+
+	res, err := x.client.Index(ctx, x.index, events)
+	documentsTotal.WithLabelValues(x.index, "indexed").Add(float64(res.Indexed))
+	documentsTotal.WithLabelValues(x.index, "rejected").Add(float64(res.Rejected))
+	if res.Rejected > 0 {
+		x.l.Error("documents rejected by elasticsearch", "count", res.Rejected, "reason", res.Reason)
+	}
+	if err != nil {
+		documentsTotal.WithLabelValues(x.index, "failed").Add(float64(len(events) - res.Indexed - res.Rejected))
+		return err
+	}
+	return nil
+}
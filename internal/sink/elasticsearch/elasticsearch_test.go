@@ -0,0 +1,221 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// fakeCluster answers the index and bulk APIs. Documents listed in busy
+// fail with 429 once; actions in rejected always fail with 400.
+type fakeCluster struct {
+	mu       sync.Mutex
+	indices  map[string]bool
+	docs     map[string]database.Event
+	busy     map[string]bool
+	rejected string
+	down     bool
+}
+
+func newFakeCluster() *fakeCluster {
+	return &fakeCluster{indices: map[string]bool{}, docs: map[string]database.Event{}, busy: map[string]bool{}}
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path != "/_bulk" {
+		index := strings.TrimPrefix(r.URL.Path, "/")
+		switch {
+		case r.Method == http.MethodHead && !f.indices[index]:
+			w.WriteHeader(http.StatusNotFound)
+		case r.Method == http.MethodPut:
+			f.indices[index] = true
+		}
+		return
+	}
+
+	var items []map[string]any
+	failed := false
+	sc := bufio.NewScanner(r.Body)
+	for sc.Scan() {
+		var action struct {
+			Index struct {
+				ID string `json:"_id"`
+			} `json:"index"`
+		}
+		_ = json.Unmarshal(sc.Bytes(), &action)
+		sc.Scan()
+		var e database.Event
+		_ = json.Unmarshal(sc.Bytes(), &e)
+
+		id := action.Index.ID
+		switch {
+		case f.busy[id]:
+			delete(f.busy, id)
+			failed = true
+			items = append(items, map[string]any{"index": map[string]any{"_id": id, "status": 429, "error": map[string]string{"type": "es_rejected_execution_exception"}}})
+		case e.Action == f.rejected:
+			failed = true
+			items = append(items, map[string]any{"index": map[string]any{"_id": id, "status": 400, "error": map[string]string{"type": "mapper_parsing_exception", "reason": "failed to parse"}}})
+		default:
+			f.docs[id] = e
+			items = append(items, map[string]any{"index": map[string]any{"_id": id, "status": 201}})
+		}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]any{"errors": failed, "items": items})
+}
+
+func newTestClient(t *testing.T, cluster *fakeCluster) *Client {
+	t.Helper()
+	srv := httptest.NewServer(cluster)
+	t.Cleanup(srv.Close)
+	c := NewClient(config.ElasticsearchSinkConfig{URL: srv.URL, TimeoutSeconds: 5, MaxRetries: 2})
+	c.backoff = time.Millisecond
+	return c
+}
+
+func testEvents(n int) []database.Event {
+	events := make([]database.Event, n)
+	for i := range events {
+		events[i] = database.Event{ID: int64(i + 1), UserID: 7, Action: "click", CreatedAt: time.Unix(1700000000, 0)}
+	}
+	return events
+}
+
+func TestIndex(t *testing.T) {
+	tests := []struct {
+		name           string
+		busy           []string
+		rejected       string
+		down           bool
+		expectIndexed  int
+		expectRejected int
+		expectErr      bool
+	}{
+		{name: "all indexed", expectIndexed: 3},
+		{name: "busy documents are retried", busy: []string{"1", "3"}, expectIndexed: 3},
+		{name: "rejected documents are skipped", rejected: "click", expectRejected: 3},
+		{name: "cluster down", down: true, expectErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := newFakeCluster()
+			cluster.rejected, cluster.down = tt.rejected, tt.down
+			for _, id := range tt.busy {
+				cluster.busy[id] = true
+			}
+			c := newTestClient(t, cluster)
+
+			res, err := c.Index(context.Background(), "events", testEvents(3))
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if res.Indexed != tt.expectIndexed || res.Rejected != tt.expectRejected || len(cluster.docs) != tt.expectIndexed {
+				t.Fatalf("unexpected result %+v, %d documents stored", res, len(cluster.docs))
+			}
+			if tt.rejected != "" && !strings.Contains(res.Reason, "mapper_parsing_exception") {
+				t.Fatalf("unexpected reason %q", res.Reason)
+			}
+		})
+	}
+}
+
+// fakeOutbox behaves like database.Outbox over an in-memory events table.
+type fakeOutbox struct {
+	events []database.Event
+	cursor int64
+}
+
+func (o *fakeOutbox) Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []database.Event) error) (int, error) {
+	var batch []database.Event
+	for _, e := range o.events {
+		if e.ID > o.cursor && e.CreatedAt.Before(settledBefore) && len(batch) < limit {
+			batch = append(batch, e)
+		}
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if err := publish(ctx, batch); err != nil {
+		return 0, err
+	}
+	o.cursor = batch[len(batch)-1].ID
+	return len(batch), nil
+}
+
+func TestRelay(t *testing.T) {
+	cluster := newFakeCluster()
+	cluster.down = true
+	outbox := &fakeOutbox{events: testEvents(5)}
+	x := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.ElasticsearchSinkConfig{
+		Index:          "events",
+		BatchSize:      2,
+		TimeoutSeconds: 5,
+	}, outbox)
+	x.client = newTestClient(t, cluster)
+	x.client.retries = 0
+	x.now = func() time.Time { return time.Unix(1700000060, 0) }
+
+	x.relay(context.Background(), context.Background())
+	if outbox.cursor != 0 {
+		t.Fatalf("expected the cursor to stay while the cluster is down, got %d", outbox.cursor)
+	}
+
+	cluster.mu.Lock()
+	cluster.down = false
+	cluster.mu.Unlock()
+	x.relay(context.Background(), context.Background())
+	if outbox.cursor != 5 || len(cluster.docs) != 5 || !cluster.indices["events"] {
+		t.Fatalf("expected 5 documents in a created index, cursor %d, documents %d", outbox.cursor, len(cluster.docs))
+	}
+}
+
+type fakeSource struct {
+	events []database.Event
+}
+
+func (f *fakeSource) Each(ctx context.Context, from, to time.Time, fn func(database.Event) error) error {
+	for _, e := range f.events {
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestReindex(t *testing.T) {
+	cluster := newFakeCluster()
+	c := newTestClient(t, cluster)
+	events := testEvents(5)
+	events[3].Action = "bad"
+	cluster.rejected = "bad"
+
+	var batches []string
+	total, err := Reindex(context.Background(), c, &fakeSource{events: events}, "events-v2", time.Unix(0, 0), time.Now(), 2, func(r BulkResult) {
+		batches = append(batches, fmt.Sprintf("%d/%d", r.Indexed, r.Rejected))
+	})
+	if err != nil {
+		t.Fatalf("reindex: %v", err)
+	}
+	if total.Indexed != 4 || total.Rejected != 1 || !cluster.indices["events-v2"] || strings.Join(batches, " ") != "2/0 3/1 4/1" {
+		t.Fatalf("unexpected result %+v, batches %v", total, batches)
+	}
+}
@@ -0,0 +1,54 @@
+package elasticsearch
+
+import (
+	"context"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Source reads the events of a time range, like database.EventStream.
+type Source interface {
+	Each(ctx context.Context, from, to time.Time, fn func(database.Event) error) error
+}
+
+// Reindex indexes the events created in [from, to) into index in batches
+// of size, creating the index when it does not exist. progress is called
+// with the running totals after every batch. Events already indexed are
+// replaced, so an interrupted reindex can be run again.
+func Reindex(ctx context.Context, c *Client, src Source, index string, from, to time.Time, size int, progress func(BulkResult)) (BulkResult, error) {
+	var total BulkResult
+	if err := c.EnsureIndex(ctx, index); err != nil {
+		return total, err
+	}
+
+	batch := make([]database.Event, 0, size)
+	flush := func() error {
+		res, err := c.Index(ctx, index, batch)
+		total.Indexed += res.Indexed
+		total.Rejected += res.Rejected
+		if total.Reason == "" {
+			total.Reason = res.Reason
+		}
+		batch = batch[:0]
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(total)
+		}
+		return nil
+	}
+
+	err := src.Each(ctx, from, to, func(e database.Event) error {
+		batch = append(batch, e)
+		if len(batch) < size {
+			return nil
+		}
+		return flush()
+	})
+	if err == nil && len(batch) > 0 {
+		err = flush()
+	}
+	return total, err
+}
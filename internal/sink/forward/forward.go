@@ -0,0 +1,214 @@
+// Package forward makes an edge deployment forward its stored events to a
+// central simple-events-handler through POST /events/batch. Events are
+// stored locally first, so the edge keeps accepting them (and spilling over
+// to its spool) while the central instance is unreachable. They are relayed
+// from the events table in id order and the relay cursor only moves once
+// the central instance stored the batch; every event carries the dedupe key
+// "<origin>:<id>", so batches sent again after a failure are not counted
+// twice.
+package forward
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/signing"
+)
+
+// sink names the relay cursor in sink_cursors.
+const sink = "forward"
+
+var eventsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sink_forward_events_total",
+		Help: "Events forwarded to the central instance by result: forwarded or failed (retried on the next poll)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(eventsTotal)
+}
+
+// Relayer is the part of database.Outbox used by the forwarder.
+type Relayer interface {
+	Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []database.Event) error) (int, error)
+}
+
+// event is an event of the POST /events/batch body. The project, TTL and
+// schema version are kept by the central instance when it requires a
+// federation token.
+type event struct {
+	ProjectID     int64             `json:"project_id,omitempty"`
+	UserID        int64             `json:"user_id"`
+	Action        string            `json:"action"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+	CreatedAt     time.Time         `json:"created_at"`
+	TTLSeconds    int               `json:"ttl_seconds,omitempty"`
+	SchemaVersion int               `json:"schema_version,omitempty"`
+	DedupeKey     string            `json:"dedupe_key"`
+}
+
+type Forwarder struct {
+	l      *slog.Logger
+	http   *http.Client
+	outbox Relayer
+	url    string
+	token  string
+	secret string
+	origin string
+	poll   time.Duration
+	settle time.Duration
+	size   int
+	now    func() time.Time
+
+	stopPoll    context.CancelFunc
+	stopPublish context.CancelFunc
+	done        chan struct{}
+}
+
+// New creates a forwarder for cfg.
+func New(logger *slog.Logger, cfg config.ForwardConfig, outbox Relayer) *Forwarder {
+	return &Forwarder{
+		l:      logger.With("sink", sink, "origin", cfg.Origin),
+		http:   &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+		outbox: outbox,
+		url:    strings.TrimRight(cfg.URL, "/") + "/events/batch",
+		token:  cfg.Token,
+		secret: cfg.SigningSecret,
+		origin: cfg.Origin,
+		poll:   time.Duration(cfg.PollIntervalMillis) * time.Millisecond,
+		settle: time.Duration(cfg.SettleMillis) * time.Millisecond,
+		size:   cfg.BatchSize,
+		now:    time.Now,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start forwards in the background until Stop is called.
+func (f *Forwarder) Start() {
+	pollCtx, stopPoll := context.WithCancel(context.Background())
+	publishCtx, stopPublish := context.WithCancel(context.Background())
+	f.stopPoll, f.stopPublish = stopPoll, stopPublish
+
+	go func() {
+		defer close(f.done)
+		f.run(pollCtx, publishCtx)
+	}()
+	f.l.Info("forwarder started", "url", f.url)
+}
+
+// Stop stops polling and waits for the batch in progress. When ctx expires
+// first, the batch is abandoned and forwarded again after a restart.
+func (f *Forwarder) Stop(ctx context.Context) error {
+	f.stopPoll()
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		f.stopPublish()
+		<-f.done
+	}
+	f.stopPublish()
+	return nil
+}
+
+func (f *Forwarder) run(pollCtx, publishCtx context.Context) {
+	ticker := time.NewTicker(f.poll)
+	defer ticker.Stop()
+	for {
+		f.relay(pollCtx, publishCtx)
+		select {
+		case <-pollCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay forwards batches until the events caught up with the settle delay.
+func (f *Forwarder) relay(pollCtx, publishCtx context.Context) {
+	for pollCtx.Err() == nil {
+		n, err := f.outbox.Relay(publishCtx, sink, f.now().Add(-f.settle), f.size, f.publish)
+		if err != nil {
+			if publishCtx.Err() == nil {
+				f.l.Warn("failed to forward events, retrying on the next poll", "error", err)
+			}
+			return
+		}
+		if n < f.size {
+			return
+		}
+	}
+}
+
+func (f *Forwarder) publish(ctx context.Context, events []database.Event) error {
+	batch := make([]event, len(events))
+	for i, e := range events {
+		batch[i] = event{
+			ProjectID:     e.ProjectID,
+			UserID:        e.UserID,
+			Action:        e.Action,
+			CreatedAt:     e.CreatedAt,
+			SchemaVersion: e.SchemaVersion,
+			DedupeKey:     f.origin + ":" + strconv.FormatInt(e.ID, 10),
+		}
+		if e.ExpiresAt != nil {
+			// Rounded up, so that the event does not expire earlier on
+			// the central instance
+			batch[i].TTLSeconds = max(int(math.Ceil(e.ExpiresAt.Sub(e.CreatedAt).Seconds())), 1)
+		}
+		if e.MetadataPage != nil {
+			batch[i].Metadata = map[string]string{"page": *e.MetadataPage}
+		}
+	}
+	body, err := json.Marshal(map[string]any{"events": batch})
+	if err != nil {
+		return err
+	}
+
+	if err := f.post(ctx, body); err != nil {
+		eventsTotal.WithLabelValues("failed").Add(float64(len(events)))
+		return err
+	}
+	eventsTotal.WithLabelValues("forwarded").Add(float64(len(events)))
+	return nil
+}
+
+func (f *Forwarder) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	if f.secret != "" {
+		req.Header.Set(signing.Header, signing.Sign(f.secret, f.now(), body))
+	}
+
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("central instance answered %d: %s", resp.StatusCode, bytes.TrimSpace(detail))
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return nil
+}
@@ -0,0 +1,132 @@
+package forward
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/signing"
+)
+
+// fakeCentral stores the events of POST /events/batch once per dedupe key.
+type fakeCentral struct {
+	mu       sync.Mutex
+	down     bool
+	verifier *signing.Verifier
+	events   map[string]event
+	posts    int
+}
+
+func (f *fakeCentral) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path != "/api/events/batch" || r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	raw, _ := io.ReadAll(r.Body)
+	if err := f.verifier.Verify(r.Header.Get(signing.Header), raw); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Events []event `json:"events"`
+	}
+	if err := json.Unmarshal(raw, &body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f.posts++
+	for _, e := range body.Events {
+		if _, ok := f.events[e.DedupeKey]; !ok {
+			f.events[e.DedupeKey] = e
+		}
+	}
+	_ = json.NewEncoder(w).Encode(map[string]int{"received": len(body.Events)})
+}
+
+// fakeOutbox behaves like database.Outbox over an in-memory events table.
+type fakeOutbox struct {
+	events []database.Event
+	cursor int64
+}
+
+func (o *fakeOutbox) Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []database.Event) error) (int, error) {
+	var batch []database.Event
+	for _, e := range o.events {
+		if e.ID > o.cursor && e.CreatedAt.Before(settledBefore) && len(batch) < limit {
+			batch = append(batch, e)
+		}
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if err := publish(ctx, batch); err != nil {
+		return 0, err
+	}
+	o.cursor = batch[len(batch)-1].ID
+	return len(batch), nil
+}
+
+func TestRelay(t *testing.T) {
+	created := time.Unix(1700000000, 0).UTC()
+	// The forwarder signs with its own clock, set back to created below
+	verifier := signing.NewVerifier([]string{"signing-secret-0123"}, time.Since(created)+time.Hour)
+	central := &fakeCentral{down: true, events: map[string]event{}, verifier: verifier}
+	srv := httptest.NewServer(central)
+	defer srv.Close()
+
+	page := "/docs"
+	outbox := &fakeOutbox{}
+	expires := created.Add(90 * time.Second)
+	for i := range 5 {
+		outbox.events = append(outbox.events, database.Event{ID: int64(i + 1), ProjectID: 4, UserID: 7, Action: "view", MetadataPage: &page, CreatedAt: created, ExpiresAt: &expires, SchemaVersion: 2})
+	}
+
+	f := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.ForwardConfig{
+		URL:            srv.URL + "/api/",
+		Token:          "secret",
+		SigningSecret:  "signing-secret-0123",
+		Origin:         "edge-1",
+		BatchSize:      2,
+		TimeoutSeconds: 5,
+	}, outbox)
+	f.now = func() time.Time { return created.Add(time.Minute) }
+
+	f.relay(context.Background(), context.Background())
+	if outbox.cursor != 0 {
+		t.Fatalf("expected the cursor to stay while the central instance is down, got %d", outbox.cursor)
+	}
+
+	central.mu.Lock()
+	central.down = false
+	central.mu.Unlock()
+	f.relay(context.Background(), context.Background())
+	if outbox.cursor != 5 || len(central.events) != 5 || central.posts != 3 {
+		t.Fatalf("expected 5 events in 3 batches, cursor %d, events %d, posts %d", outbox.cursor, len(central.events), central.posts)
+	}
+	e := central.events["edge-1:3"]
+	if e.ProjectID != 4 || e.UserID != 7 || e.Metadata["page"] != page || !e.CreatedAt.Equal(created) || e.TTLSeconds != 90 || e.SchemaVersion != 2 {
+		t.Fatalf("unexpected forwarded event %+v", e)
+	}
+
+	// Forwarding the same events again, e.g. after the cursor update was
+	// lost, does not add any
+	outbox.cursor = 0
+	f.relay(context.Background(), context.Background())
+	if len(central.events) != 5 {
+		t.Fatalf("expected duplicates to be dropped, got %d events", len(central.events))
+	}
+}
@@ -0,0 +1,216 @@
+// Package kafka publishes the stored events to a Kafka topic for
+// downstream stream processors. Events are relayed from the events table in
+// id order and the relay cursor only moves once Kafka acknowledged the
+// batch, so every event is published at least once, including the events
+// stored by other instances or while the brokers were down.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	kafkago "github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
+)
+
+// sink names the relay cursor in sink_cursors.
+const sink = "kafka"
+
+var messagesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "sink_kafka_messages_total",
+		Help: "Events published to the Kafka sink by result: published or failed (retried on the next poll)",
+	},
+	[]string{"topic", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(messagesTotal)
+}
+
+// Relayer is the part of database.Outbox used by the producer.
+type Relayer interface {
+	Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []database.Event) error) (int, error)
+}
+
+// writer is the part of *kafkago.Writer used by the producer.
+type writer interface {
+	WriteMessages(ctx context.Context, msgs ...kafkago.Message) error
+	Close() error
+}
+
+type Producer struct {
+	l      *slog.Logger
+	w      writer
+	outbox Relayer
+	topic  string
+	format string
+	poll   time.Duration
+	settle time.Duration
+	size   int
+	now    func() time.Time
+
+	stopPoll    context.CancelFunc
+	stopPublish context.CancelFunc
+	done        chan struct{}
+}
+
+// New creates a producer for cfg. It does not connect until Start.
+func New(logger *slog.Logger, cfg config.KafkaSinkConfig, outbox Relayer) *Producer {
+	// The topic is set per message, so that replays can target another one
+	w := &kafkago.Writer{
+		Addr:         kafkago.TCP(cfg.Brokers...),
+		Balancer:     &kafkago.Hash{},
+		RequiredAcks: kafkago.RequireAll,
+		BatchSize:    cfg.BatchSize,
+		// Batches are handed over whole, there is nothing to wait for
+		BatchTimeout: 10 * time.Millisecond,
+	}
+	return newProducer(logger, w, outbox, cfg)
+}
+
+func newProducer(logger *slog.Logger, w writer, outbox Relayer, cfg config.KafkaSinkConfig) *Producer {
+	return &Producer{
+		l:      logger.With("sink", sink, "topic", cfg.Topic),
+		w:      w,
+		outbox: outbox,
+		topic:  cfg.Topic,
+		format: cfg.Format,
+		poll:   time.Duration(cfg.PollIntervalMillis) * time.Millisecond,
+		settle: time.Duration(cfg.SettleMillis) * time.Millisecond,
+		size:   cfg.BatchSize,
+		now:    time.Now,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start publishes in the background until Stop is called.
+func (p *Producer) Start() {
+	pollCtx, stopPoll := context.WithCancel(context.Background())
+	publishCtx, stopPublish := context.WithCancel(context.Background())
+	p.stopPoll, p.stopPublish = stopPoll, stopPublish
+
+	go func() {
+		defer close(p.done)
+		p.run(pollCtx, publishCtx)
+	}()
+	p.l.Info("kafka sink started")
+}
+
+// Stop stops polling and waits for the batch in progress. When ctx expires
+// first, the batch is abandoned and published again after a restart. A
+// producer never started, only publishing replays, is just closed.
+func (p *Producer) Stop(ctx context.Context) error {
+	if p.stopPoll == nil {
+		return p.w.Close()
+	}
+	p.stopPoll()
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.stopPublish()
+		<-p.done
+	}
+	p.stopPublish()
+	return p.w.Close()
+}
+
+func (p *Producer) run(pollCtx, publishCtx context.Context) {
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+	for {
+		p.relay(pollCtx, publishCtx)
+		select {
+		case <-pollCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay publishes batches until the events caught up with the settle delay.
+func (p *Producer) relay(pollCtx, publishCtx context.Context) {
+	for pollCtx.Err() == nil {
+		n, err := p.outbox.Relay(publishCtx, sink, p.now().Add(-p.settle), p.size, p.publish)
+		if err != nil {
+			if publishCtx.Err() == nil {
+				p.l.Warn("failed to publish events, retrying on the next poll", "error", err)
+			}
+			return
+		}
+		if n < p.size {
+			return
+		}
+	}
+}
+
+func (p *Producer) publish(ctx context.Context, events []database.Event) error {
+	return p.PublishTo(ctx, p.topic, events)
+}
+
+// Topic returns the topic the sink publishes to.
+func (p *Producer) Topic() string {
+	return p.topic
+}
+
+// PublishTo publishes events to topic like the sink publishes them, without
+// moving the sink position. It is used to replay historical events.
+func (p *Producer) PublishTo(ctx context.Context, topic string, events []database.Event) error {
+	msgs := make([]kafkago.Message, len(events))
+	for i, e := range events {
+		value, err := p.encode(e)
+		if err != nil {
+			return err
+		}
+		msgs[i] = kafkago.Message{
+			Topic:   topic,
+			Key:     []byte(strconv.FormatInt(e.UserID, 10)),
+			Value:   value,
+			Headers: []kafkago.Header{{Key: "action", Value: []byte(e.Action)}},
+			Time:    e.CreatedAt,
+		}
+		if e.ProjectID != 0 {
+			msgs[i].Headers = append(msgs[i].Headers, kafkago.Header{Key: "project_id", Value: []byte(strconv.FormatInt(e.ProjectID, 10))})
+		}
+	}
+
+	if err := p.w.WriteMessages(ctx, msgs...); err != nil {
+		messagesTotal.WithLabelValues(topic, "failed").Add(float64(len(msgs)))
+		return err
+	}
+	messagesTotal.WithLabelValues(topic, "published").Add(float64(len(msgs)))
+	return nil
+}
+
+// encode returns the message value of e: the JSON of GET /events items, or
+// the protobuf Event of the canonical event model.
+func (p *Producer) encode(e database.Event) ([]byte, error) {
+	if p.format != "protobuf" {
+		return json.Marshal(e)
+	}
+	m := &eventsv1.Event{
+		Id:            e.ID,
+		UserId:        e.UserID,
+		Action:        e.Action,
+		MetadataPage:  e.MetadataPage,
+		CreatedAt:     timestamppb.New(e.CreatedAt),
+		SchemaVersion: int32(e.SchemaVersion),
+		ProjectId:     e.ProjectID,
+	}
+	if e.ExpiresAt != nil {
+		m.ExpiresAt = timestamppb.New(*e.ExpiresAt)
+	}
+	if e.MetadataPage != nil {
+		m.Metadata = map[string]string{"page": *e.MetadataPage}
+	}
+	return proto.Marshal(m)
+}
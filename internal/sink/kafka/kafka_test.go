@@ -0,0 +1,141 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
+)
+
+type fakeWriter struct {
+	err  error
+	msgs []kafkago.Message
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafkago.Message) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+func (w *fakeWriter) Close() error { return nil }
+
+// fakeOutbox behaves like database.Outbox over an in-memory events table.
+type fakeOutbox struct {
+	events []database.Event
+	cursor int64
+}
+
+func (o *fakeOutbox) Relay(ctx context.Context, sink string, settledBefore time.Time, limit int, publish func(context.Context, []database.Event) error) (int, error) {
+	var batch []database.Event
+	for _, e := range o.events {
+		if e.ID > o.cursor && e.CreatedAt.Before(settledBefore) && len(batch) < limit {
+			batch = append(batch, e)
+		}
+	}
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	if err := publish(ctx, batch); err != nil {
+		return 0, err
+	}
+	o.cursor = batch[len(batch)-1].ID
+	return len(batch), nil
+}
+
+func TestRelay(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	events := []database.Event{
+		{ID: 1, ProjectID: 2, UserID: 7, Action: "click", CreatedAt: now.Add(-time.Minute)},
+		{ID: 2, UserID: 8, Action: "view", CreatedAt: now.Add(-time.Minute)},
+		{ID: 3, UserID: 7, Action: "view", CreatedAt: now.Add(-30 * time.Second)},
+		{ID: 4, UserID: 9, Action: "click", CreatedAt: now},
+	}
+
+	tests := []struct {
+		name         string
+		writeErr     error
+		expectKeys   []string
+		expectCursor int64
+	}{
+		{name: "settled events in batches", expectKeys: []string{"7", "8", "7"}, expectCursor: 3},
+		{name: "brokers down", writeErr: errors.New("broker unavailable"), expectCursor: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := &fakeWriter{err: tt.writeErr}
+			outbox := &fakeOutbox{events: events}
+			p := newProducer(slog.New(slog.NewTextHandler(io.Discard, nil)), w, outbox, config.KafkaSinkConfig{
+				Topic:        "events-stored",
+				SettleMillis: 2000,
+				BatchSize:    2,
+			})
+			p.now = func() time.Time { return now }
+
+			p.relay(context.Background(), context.Background())
+
+			if outbox.cursor != tt.expectCursor || len(w.msgs) != len(tt.expectKeys) {
+				t.Fatalf("expected cursor %d and %d messages, got %d and %d", tt.expectCursor, len(tt.expectKeys), outbox.cursor, len(w.msgs))
+			}
+			for i, key := range tt.expectKeys {
+				if string(w.msgs[i].Key) != key || w.msgs[i].Topic != "events-stored" {
+					t.Fatalf("message %d: expected key %s got %s to %q", i, key, w.msgs[i].Key, w.msgs[i].Topic)
+				}
+			}
+			if len(w.msgs) > 0 && string(w.msgs[0].Value) != `{"id":1,"user_id":7,"action":"click","created_at":"`+now.Add(-time.Minute).Format(time.RFC3339)+`","project_id":2}` {
+				t.Fatalf("unexpected value %s", w.msgs[0].Value)
+			}
+			if len(w.msgs) > 0 && (len(w.msgs[0].Headers) != 2 || w.msgs[0].Headers[1].Key != "project_id" || string(w.msgs[0].Headers[1].Value) != "2") {
+				t.Fatalf("unexpected headers %+v", w.msgs[0].Headers)
+			}
+		})
+	}
+}
+
+func TestStopWithoutStart(t *testing.T) {
+	w := &fakeWriter{}
+	p := newProducer(slog.New(slog.NewTextHandler(io.Discard, nil)), w, &fakeOutbox{}, config.KafkaSinkConfig{Topic: "events-stored"})
+
+	// A producer kept for replays only publishes and is closed
+	if err := p.PublishTo(context.Background(), "replays", []database.Event{{ID: 1, UserID: 7, Action: "click"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.msgs) != 1 || w.msgs[0].Topic != "replays" {
+		t.Fatalf("unexpected messages %+v", w.msgs)
+	}
+}
+
+func TestPublishProtobuf(t *testing.T) {
+	w := &fakeWriter{}
+	p := newProducer(slog.New(slog.NewTextHandler(io.Discard, nil)), w, &fakeOutbox{}, config.KafkaSinkConfig{Topic: "events-stored", Format: "protobuf"})
+
+	page := "/home"
+	created := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	if err := p.PublishTo(context.Background(), "events-stored", []database.Event{{ID: 1, ProjectID: 3, UserID: 7, Action: "click", MetadataPage: &page, CreatedAt: created, SchemaVersion: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(w.msgs))
+	}
+	var e eventsv1.Event
+	if err := proto.Unmarshal(w.msgs[0].Value, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Id != 1 || e.UserId != 7 || e.Action != "click" || e.GetMetadataPage() != page || e.Metadata["page"] != page || !e.CreatedAt.AsTime().Equal(created) || e.SchemaVersion != 2 || e.ProjectId != 3 || e.ExpiresAt != nil {
+		t.Fatalf("unexpected event %v", &e)
+	}
+}
@@ -0,0 +1,279 @@
+// Package webhooks delivers stored events to the URLs registered as webhook
+// subscriptions. Deliveries are scheduled from the events table and kept in
+// webhook_deliveries, so they survive restarts and any instance can send
+// them; a delivery is retried with an exponential backoff until the
+// receiver answers with a 2xx status or the attempts run out.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+// Headers set on every delivery.
+const (
+	SignatureHeader = "X-Events-Signature-256"
+	DeliveryHeader  = "X-Events-Delivery"
+)
+
+const (
+	firstRetryDelay = 5 * time.Second
+	maxRetryDelay   = time.Hour
+	pruneInterval   = time.Hour
+	maxErrorLength  = 500
+)
+
+var deliveriesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_deliveries_total",
+		Help: "Outbound webhook delivery attempts by result: delivered, retried or failed (attempts exhausted)",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(deliveriesTotal)
+}
+
+// Store is the part of database.SubscriptionStore used by the dispatcher.
+type Store interface {
+	ScheduleDeliveries(ctx context.Context, settledBefore time.Time, limit int) (int, error)
+	ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]database.PendingDelivery, error)
+	CompleteDelivery(ctx context.Context, id int64, responseStatus int) error
+	FailDelivery(ctx context.Context, id int64, responseStatus int, cause string, next time.Time, final bool) error
+	PruneDeliveries(ctx context.Context, before time.Time) (int64, error)
+}
+
+type Dispatcher struct {
+	l      *slog.Logger
+	cfg    config.OutboundWebhooksConfig
+	store  Store
+	client *http.Client
+	now    func() time.Time
+
+	stopPoll context.CancelFunc
+	stopSend context.CancelFunc
+	done     chan struct{}
+}
+
+func New(logger *slog.Logger, cfg config.OutboundWebhooksConfig, store Store) *Dispatcher {
+	return &Dispatcher{
+		l:      logger.With("sink", "webhooks"),
+		cfg:    cfg,
+		store:  store,
+		client: &http.Client{Timeout: time.Duration(cfg.TimeoutSeconds) * time.Second},
+		now:    time.Now,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start polls for deliveries until Stop is called.
+func (d *Dispatcher) Start() {
+	pollCtx, stopPoll := context.WithCancel(context.Background())
+	sendCtx, stopSend := context.WithCancel(context.Background())
+	d.stopPoll, d.stopSend = stopPoll, stopSend
+
+	go d.run(pollCtx, sendCtx)
+	d.l.Info("webhook dispatcher started", "workers", d.cfg.Workers)
+}
+
+// Stop stops polling and waits for the deliveries in progress. When ctx
+// expires first they are abandoned and sent again once their lease is over.
+func (d *Dispatcher) Stop(ctx context.Context) error {
+	d.stopPoll()
+	defer d.stopSend()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		d.stopSend()
+		<-d.done
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) run(pollCtx, sendCtx context.Context) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(time.Duration(d.cfg.PollIntervalMillis) * time.Millisecond)
+	defer ticker.Stop()
+	lastPrune := time.Time{}
+	for {
+		d.poll(pollCtx, sendCtx)
+		if time.Since(lastPrune) > pruneInterval {
+			d.prune(pollCtx)
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-pollCtx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll schedules the deliveries of the new events, then sends the due ones
+// until none is left.
+func (d *Dispatcher) poll(pollCtx, sendCtx context.Context) {
+	settle := time.Duration(d.cfg.SettleMillis) * time.Millisecond
+	for pollCtx.Err() == nil {
+		n, err := d.store.ScheduleDeliveries(pollCtx, d.now().Add(-settle), d.cfg.BatchSize)
+		if err != nil {
+			if pollCtx.Err() == nil {
+				d.l.Warn("failed to schedule webhook deliveries", "error", err)
+			}
+			break
+		}
+		if n < d.cfg.BatchSize {
+			break
+		}
+	}
+
+	// The lease outlasts an attempt, so that a delivery is only claimed again
+	// when its sender is gone
+	lease := d.client.Timeout + 30*time.Second
+	for pollCtx.Err() == nil {
+		claimed, err := d.store.ClaimDeliveries(pollCtx, d.cfg.BatchSize, lease)
+		if err != nil {
+			if pollCtx.Err() == nil {
+				d.l.Warn("failed to claim webhook deliveries", "error", err)
+			}
+			return
+		}
+		d.sendAll(sendCtx, claimed)
+		if len(claimed) < d.cfg.BatchSize {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) sendAll(ctx context.Context, deliveries []database.PendingDelivery) {
+	sem := make(chan struct{}, d.cfg.Workers)
+	var wg sync.WaitGroup
+	for _, pd := range deliveries {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			d.deliver(ctx, pd)
+		}()
+	}
+	wg.Wait()
+}
+
+// deliver sends one attempt and records its outcome.
+func (d *Dispatcher) deliver(ctx context.Context, pd database.PendingDelivery) {
+	status, err := d.send(ctx, pd)
+	if ctx.Err() != nil {
+		// Shutting down: the delivery is sent again once its lease is over
+		return
+	}
+
+	recordCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err == nil {
+		deliveriesTotal.WithLabelValues("delivered").Inc()
+		if err := d.store.CompleteDelivery(recordCtx, pd.ID, status); err != nil {
+			d.l.Warn("failed to record webhook delivery, it may be sent twice", "delivery_id", pd.ID, "error", err)
+		}
+		return
+	}
+
+	final := pd.Attempt >= d.cfg.MaxAttempts
+	next := d.now().Add(retryDelay(pd.Attempt))
+	if final {
+		deliveriesTotal.WithLabelValues("failed").Inc()
+		d.l.Warn("webhook delivery failed, giving up", "delivery_id", pd.ID, "subscription_id", pd.SubscriptionID, "attempts", pd.Attempt, "error", err)
+	} else {
+		deliveriesTotal.WithLabelValues("retried").Inc()
+		d.l.Debug("webhook delivery failed, retrying", "delivery_id", pd.ID, "subscription_id", pd.SubscriptionID, "attempt", pd.Attempt, "next_attempt_at", next, "error", err)
+	}
+	cause := err.Error()
+	if len(cause) > maxErrorLength {
+		cause = cause[:maxErrorLength]
+	}
+	if err := d.store.FailDelivery(recordCtx, pd.ID, status, cause, next, final); err != nil {
+		d.l.Warn("failed to record webhook delivery attempt", "delivery_id", pd.ID, "error", err)
+	}
+}
+
+// send posts the event and returns the response status, 0 when none was
+// received. Statuses other than 2xx are errors.
+func (d *Dispatcher) send(ctx context.Context, pd database.PendingDelivery) (int, error) {
+	body, err := json.Marshal(pd.Event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pd.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simple-events-handler")
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(pd.ID, 10))
+	req.Header.Set(SignatureHeader, "sha256="+Sign(pd.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected response status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (d *Dispatcher) prune(ctx context.Context) {
+	n, err := d.store.PruneDeliveries(ctx, d.now().Add(-time.Duration(d.cfg.RetentionHours)*time.Hour))
+	if err != nil {
+		if ctx.Err() == nil {
+			d.l.Warn("failed to prune webhook deliveries", "error", err)
+		}
+		return
+	}
+	if n > 0 {
+		d.l.Info("pruned webhook deliveries", "deliveries", n)
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of body, as sent in SignatureHeader
+// after "sha256=".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// retryDelay doubles from firstRetryDelay with every attempt, up to
+// maxRetryDelay.
+func retryDelay(attempt int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
@@ -0,0 +1,135 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+)
+
+type outcome struct {
+	status int
+	cause  string
+	next   time.Time
+	final  bool
+}
+
+type fakeStore struct {
+	mu        sync.Mutex
+	pending   []database.PendingDelivery
+	scheduled int
+	completed map[int64]int
+	failed    map[int64]outcome
+}
+
+func (f *fakeStore) ScheduleDeliveries(ctx context.Context, settledBefore time.Time, limit int) (int, error) {
+	f.scheduled++
+	return 0, nil
+}
+func (f *fakeStore) ClaimDeliveries(ctx context.Context, limit int, lease time.Duration) ([]database.PendingDelivery, error) {
+	n := min(limit, len(f.pending))
+	claimed := f.pending[:n]
+	f.pending = f.pending[n:]
+	return claimed, nil
+}
+func (f *fakeStore) CompleteDelivery(ctx context.Context, id int64, responseStatus int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.completed[id] = responseStatus
+	return nil
+}
+func (f *fakeStore) FailDelivery(ctx context.Context, id int64, responseStatus int, cause string, next time.Time, final bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failed[id] = outcome{status: responseStatus, cause: cause, next: next, final: final}
+	return nil
+}
+func (f *fakeStore) PruneDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func TestPoll(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != "sha256="+Sign("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	event := database.Event{ID: 10, UserID: 7, Action: "click"}
+	store := &fakeStore{
+		pending: []database.PendingDelivery{
+			{ID: 1, Attempt: 1, URL: receiver.URL + "/ok", Secret: "s3cret", Event: event},
+			{ID: 2, Attempt: 1, URL: receiver.URL + "/ok", Secret: "wrong", Event: event},
+			{ID: 3, Attempt: 2, URL: receiver.URL + "/down", Secret: "s3cret", Event: event},
+			{ID: 4, Attempt: 3, URL: receiver.URL + "/down", Secret: "s3cret", Event: event},
+			{ID: 5, Attempt: 1, URL: "http://127.0.0.1:1/closed", Secret: "s3cret", Event: event},
+		},
+		completed: map[int64]int{},
+		failed:    map[int64]outcome{},
+	}
+	now := time.Unix(1700000000, 0)
+	d := New(slog.New(slog.NewTextHandler(io.Discard, nil)), config.OutboundWebhooksConfig{
+		BatchSize:      2,
+		Workers:        2,
+		TimeoutSeconds: 5,
+		MaxAttempts:    3,
+	}, store)
+	d.now = func() time.Time { return now }
+
+	d.poll(context.Background(), context.Background())
+
+	if store.scheduled != 1 || len(store.pending) != 0 {
+		t.Fatalf("expected one schedule and every delivery claimed, got %d and %d left", store.scheduled, len(store.pending))
+	}
+	if len(store.completed) != 1 || store.completed[1] != http.StatusNoContent {
+		t.Fatalf("unexpected completed deliveries %v", store.completed)
+	}
+
+	expected := map[int64]outcome{
+		2: {status: http.StatusUnauthorized, next: now.Add(5 * time.Second)},
+		3: {status: http.StatusServiceUnavailable, next: now.Add(10 * time.Second)},
+		4: {status: http.StatusServiceUnavailable, next: now.Add(20 * time.Second), final: true},
+		5: {next: now.Add(5 * time.Second)},
+	}
+	if len(store.failed) != len(expected) {
+		t.Fatalf("unexpected failed deliveries %v", store.failed)
+	}
+	for id, e := range expected {
+		got := store.failed[id]
+		if got.status != e.status || !got.next.Equal(e.next) || got.final != e.final || got.cause == "" {
+			t.Fatalf("delivery %d: expected %+v got %+v", id, e, got)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		expect  time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{5, 80 * time.Second},
+		{20, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt); got != tt.expect {
+			t.Fatalf("attempt %d: expected %s got %s", tt.attempt, tt.expect, got)
+		}
+	}
+}
@@ -0,0 +1,399 @@
+// Package spool keeps events that could not be inserted because the
+// database was unavailable. Events are appended to NDJSON segment files in
+// a directory and replayed in order, in batches, once the database accepts
+// writes again. A replayed segment is deleted; the position within the
+// segment being replayed is persisted so that a restart does not store a
+// batch twice.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+const (
+	segmentExt = ".ndjson"
+	// segmentBytes is the size after which appends move to a new segment.
+	segmentBytes = 16 << 20
+	posFile      = "replay.pos"
+)
+
+// ErrFull is returned by Append when the spool reached its size cap.
+var ErrFull = errors.New("spool is full")
+
+var (
+	sizeBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spool_size_bytes",
+		Help: "Bytes of spooled events waiting to be replayed",
+	})
+	segments = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "spool_segments",
+		Help: "Segment files in the spool directory",
+	})
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "spool_events_total",
+			Help: "Events handled by the spool: appended, rejected (spool full), replayed or skipped (unreadable line)",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sizeBytes, segments, eventsTotal)
+}
+
+type Spool struct {
+	l         *slog.Logger
+	db        database.Eventter
+	dir       string
+	maxBytes  int64
+	batchSize int
+	interval  time.Duration
+
+	mu sync.Mutex
+	// seqs lists the segments on disk, oldest first. The last one is the
+	// active segment when active is set.
+	seqs       []uint64
+	active     *os.File
+	activeSize int64
+	size       int64
+
+	stop       chan struct{}
+	stopReplay context.CancelFunc
+	done       chan struct{}
+}
+
+// Open creates the spool directory if needed and picks up the segments left
+// by a previous run.
+func Open(logger *slog.Logger, cfg config.SpoolConfig, db database.Eventter) (*Spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("create spool directory: %w", err)
+	}
+	s := &Spool{
+		l:         logger.With("component", "spool", "dir", cfg.Dir),
+		db:        db,
+		dir:       cfg.Dir,
+		maxBytes:  int64(cfg.MaxSizeMB) << 20,
+		batchSize: cfg.ReplayBatchSize,
+		interval:  time.Duration(cfg.ReplayIntervalMillis) * time.Millisecond,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	entries, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("read spool directory: %w", err)
+	}
+	for _, e := range entries {
+		seq, ok := parseSegment(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.seqs = append(s.seqs, seq)
+		s.size += info.Size()
+	}
+	slices.Sort(s.seqs)
+	s.updateGauges()
+	if len(s.seqs) > 0 {
+		s.l.Warn("spool has events to replay", "segments", len(s.seqs), "bytes", s.size)
+	}
+	return s, nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%016d%s", seq, segmentExt)
+}
+
+func parseSegment(name string) (uint64, bool) {
+	base, ok := strings.CutSuffix(name, segmentExt)
+	if !ok {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(base, 10, 64)
+	return seq, err == nil
+}
+
+func (s *Spool) updateGauges() {
+	sizeBytes.Set(float64(s.size))
+	segments.Set(float64(len(s.seqs)))
+}
+
+// record is a line of a segment: an event with the time it was accepted,
+// which it is stored with when replayed. Lines written before the time was
+// recorded are stored at the time of the replay.
+type record struct {
+	ingest.Event
+	AcceptedAt time.Time `json:"accepted_at"`
+}
+
+// Append writes e to the active segment, accepted now, and syncs it to
+// disk.
+func (s *Spool) Append(e ingest.Event) error {
+	line, err := json.Marshal(record{Event: e, AcceptedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.size+int64(len(line)) > s.maxBytes {
+		eventsTotal.WithLabelValues("rejected").Inc()
+		return ErrFull
+	}
+	if s.active == nil || s.activeSize >= segmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.active.Write(line); err != nil {
+		return fmt.Errorf("write spool segment: %w", err)
+	}
+	if err := s.active.Sync(); err != nil {
+		return fmt.Errorf("sync spool segment: %w", err)
+	}
+	s.activeSize += int64(len(line))
+	s.size += int64(len(line))
+	s.updateGauges()
+	eventsTotal.WithLabelValues("appended").Inc()
+	return nil
+}
+
+// rotate seals the active segment and starts a new one. s.mu must be held.
+func (s *Spool) rotate() error {
+	s.seal()
+	var seq uint64 = 1
+	if n := len(s.seqs); n > 0 {
+		seq = s.seqs[n-1] + 1
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, segmentName(seq)), os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("create spool segment: %w", err)
+	}
+	s.active, s.activeSize = f, 0
+	s.seqs = append(s.seqs, seq)
+	return nil
+}
+
+// seal closes the active segment so it can be replayed. s.mu must be held.
+func (s *Spool) seal() {
+	if s.active == nil {
+		return
+	}
+	if err := s.active.Close(); err != nil {
+		s.l.Error("failed to close spool segment", "error", err)
+	}
+	s.active = nil
+}
+
+// Pending reports whether events are waiting to be replayed.
+func (s *Spool) Pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seqs) > 0
+}
+
+// Start replays the spool in the background until Stop is called.
+func (s *Spool) Start() {
+	ctx, stopReplay := context.WithCancel(context.Background())
+	s.stopReplay = stopReplay
+
+	go func() {
+		defer close(s.done)
+		// Each attempt seals the active segment, so back off while the
+		// database is down instead of producing a segment per tick.
+		wait := s.interval
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(wait):
+			}
+			if err := s.replay(ctx); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				wait = min(wait*2, 30*time.Second)
+				s.l.Warn("spool replay paused", "retry_in", wait.String(), "error", err)
+				continue
+			}
+			wait = s.interval
+		}
+	}()
+}
+
+// Stop waits for the batch being replayed and closes the active segment.
+// Spooled events stay on disk for the next run.
+func (s *Spool) Stop(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.stopReplay()
+		<-s.done
+	}
+	s.stopReplay()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seal()
+	return nil
+}
+
+// replay stores the segments oldest first until the spool is empty or an
+// insert fails.
+func (s *Spool) replay(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if len(s.seqs) == 0 {
+			s.mu.Unlock()
+			return nil
+		}
+		seq := s.seqs[0]
+		if len(s.seqs) == 1 && s.active != nil {
+			// Appends continue in a new segment
+			s.seal()
+		}
+		s.mu.Unlock()
+
+		if err := s.replaySegment(ctx, seq); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Spool) replaySegment(ctx context.Context, seq uint64) error {
+	path := filepath.Join(s.dir, segmentName(seq))
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := s.readPos(seq)
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(f)
+	var (
+		batch []record
+		read  int64
+	)
+	flush := func() error {
+		if len(batch) > 0 {
+			if err := s.insert(ctx, batch); err != nil {
+				return err
+			}
+			eventsTotal.WithLabelValues("replayed").Add(float64(len(batch)))
+		}
+		offset += read
+		batch, read = batch[:0], 0
+		return s.writePos(seq, offset)
+	}
+
+	for {
+		line, err := r.ReadBytes('\n')
+		read += int64(len(line))
+		if len(line) > 0 {
+			var e record
+			if jerr := json.Unmarshal(line, &e); jerr != nil || line[len(line)-1] != '\n' {
+				// A torn write from a crash or a damaged file
+				s.l.Error("skipping unreadable spool line", "segment", segmentName(seq), "offset", offset+read-int64(len(line)))
+				eventsTotal.WithLabelValues("skipped").Inc()
+			} else {
+				batch = append(batch, e)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(batch) >= s.batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	_ = os.Remove(filepath.Join(s.dir, posFile))
+
+	s.mu.Lock()
+	s.seqs = slices.DeleteFunc(s.seqs, func(v uint64) bool { return v == seq })
+	s.size -= info.Size()
+	s.updateGauges()
+	s.mu.Unlock()
+	s.l.Info("spool segment replayed", "segment", segmentName(seq))
+	return nil
+}
+
+// insert makes a single attempt; a failure leaves the batch in the segment
+// for the next replay tick.
+func (s *Spool) insert(ctx context.Context, events []record) error {
+	batch := make([]database.NewEvent, len(events))
+	for i, e := range events {
+		batch[i] = database.NewEvent{ProjectID: e.ProjectID, UserID: e.UserID, Action: e.Action, Metadata: e.Metadata, CreatedAt: e.AcceptedAt, TTL: e.TTL(), SchemaVersion: e.SchemaVersion}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	return s.db.InsertEvents(ctx, batch)
+}
+
+// readPos returns the replay offset persisted for seq, 0 when replay has
+// not started on it.
+func (s *Spool) readPos(seq uint64) int64 {
+	b, err := os.ReadFile(filepath.Join(s.dir, posFile))
+	if err != nil {
+		return 0
+	}
+	var posSeq uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(b), "%d %d", &posSeq, &offset); err != nil || posSeq != seq {
+		return 0
+	}
+	return offset
+}
+
+func (s *Spool) writePos(seq uint64, offset int64) error {
+	tmp := filepath.Join(s.dir, posFile+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", seq, offset)), 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, posFile))
+}
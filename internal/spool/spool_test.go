@@ -0,0 +1,153 @@
+package spool
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+type fakeDB struct {
+	database.Eventter
+	err error
+	// failAfter makes every insert after the first failAfter ones fail.
+	failAfter int
+	calls     int
+	stored    []database.NewEvent
+}
+
+func (f *fakeDB) InsertEvents(ctx context.Context, events []database.NewEvent) error {
+	f.calls++
+	if f.err != nil || (f.failAfter > 0 && f.calls > f.failAfter) {
+		return errors.New("db down")
+	}
+	f.stored = append(f.stored, events...)
+	return nil
+}
+
+func open(t *testing.T, dir string, db database.Eventter, maxSizeMB int) *Spool {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	s, err := Open(logger, config.SpoolConfig{Dir: dir, MaxSizeMB: maxSizeMB, ReplayBatchSize: 2, ReplayIntervalMillis: 10}, db)
+	if err != nil {
+		t.Fatalf("open spool: %v", err)
+	}
+	return s
+}
+
+func appendN(t *testing.T, s *Spool, from, n int) {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		if err := s.Append(ingest.Event{UserID: int64(i), Action: "click"}); err != nil {
+			t.Fatalf("append %d: %v", i, err)
+		}
+	}
+}
+
+func assertStored(t *testing.T, db *fakeDB, want int) {
+	t.Helper()
+	if len(db.stored) != want {
+		t.Fatalf("expected %d stored events got %d", want, len(db.stored))
+	}
+	for i, e := range db.stored {
+		if e.UserID != int64(i+1) {
+			t.Fatalf("events replayed out of order: %+v", db.stored)
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	db := &fakeDB{err: errors.New("db down")}
+	s := open(t, dir, db, 1)
+	accepted := time.Now()
+	appendN(t, s, 1, 5)
+
+	// Nothing is lost while the database is down
+	if err := s.replay(context.Background()); err == nil {
+		t.Fatalf("expected replay to fail while the database is down")
+	}
+	if !s.Pending() {
+		t.Fatalf("expected events to stay spooled")
+	}
+
+	// New events go to a new segment after the failed attempt sealed the
+	// first one; both are replayed in order
+	appendN(t, s, 6, 2)
+	db.err = nil
+	if err := s.replay(context.Background()); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	assertStored(t, db, 7)
+	// Events keep the time they were accepted, not the time of the replay
+	if got := db.stored[0].CreatedAt; got.Before(accepted) || got.After(time.Now()) {
+		t.Fatalf("expected the accept time of the event, got %v", got)
+	}
+	if s.Pending() || s.size != 0 {
+		t.Fatalf("expected an empty spool, size %d", s.size)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected replayed segments to be deleted, found %d files", len(entries))
+	}
+}
+
+func TestReplayResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	db := &fakeDB{failAfter: 1}
+	s := open(t, dir, db, 1)
+	appendN(t, s, 1, 5)
+
+	// The first batch of 2 is stored, the second fails
+	if err := s.replay(context.Background()); err == nil {
+		t.Fatalf("expected replay to fail")
+	}
+	s.Start()
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	db.failAfter = 0
+	s = open(t, dir, db, 1)
+	if err := s.replay(context.Background()); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	assertStored(t, db, 5)
+}
+
+func TestSizeCap(t *testing.T) {
+	s := open(t, t.TempDir(), &fakeDB{}, 1)
+	s.maxBytes = 64
+
+	var err error
+	for i := 1; err == nil && i < 10; i++ {
+		err = s.Append(ingest.Event{UserID: int64(i), Action: "click"})
+	}
+	if !errors.Is(err, ErrFull) {
+		t.Fatalf("expected ErrFull got %v", err)
+	}
+	if s.size > s.maxBytes {
+		t.Fatalf("spool grew past its cap: %d bytes", s.size)
+	}
+}
+
+func TestTornLineIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	content := "{\"user_id\":1,\"action\":\"click\"}\n{\"user_id\":2,\"act"
+	if err := os.WriteFile(filepath.Join(dir, segmentName(1)), []byte(content), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	db := &fakeDB{}
+	s := open(t, dir, db, 1)
+	if err := s.replay(context.Background()); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	assertStored(t, db, 1)
+}
@@ -0,0 +1,176 @@
+// The page calls the admin API of the listener serving it, with the admin
+// token kept in the session storage of the tab.
+"use strict";
+
+const tokenInput = document.getElementById("token");
+tokenInput.value = sessionStorage.getItem("adminToken") || "";
+tokenInput.addEventListener("change", () => sessionStorage.setItem("adminToken", tokenInput.value));
+
+const errorBox = document.getElementById("error");
+
+function showError(message) {
+  errorBox.textContent = message;
+  errorBox.hidden = !message;
+}
+
+// api calls the admin API and returns the response, throwing the detail of
+// problem responses.
+async function api(path, options = {}) {
+  const headers = { Accept: "application/json", ...(options.headers || {}) };
+  if (tokenInput.value) {
+    headers.Authorization = "Bearer " + tokenInput.value;
+  }
+  const res = await fetch(path, { ...options, headers });
+  if (!res.ok) {
+    let detail = res.status + " " + res.statusText;
+    try {
+      const problem = await res.json();
+      detail = problem.detail || detail;
+      if (problem.errors) {
+        detail += ": " + problem.errors.map((e) => e.message).join(", ");
+      }
+    } catch (e) {
+      // not a problem response
+    }
+    throw new Error(detail);
+  }
+  return res;
+}
+
+// isoTime converts the value of a datetime-local input, in the time zone of
+// the browser, to RFC3339.
+function isoTime(value) {
+  return new Date(value).toISOString();
+}
+
+function cell(row, text) {
+  const td = document.createElement("td");
+  td.textContent = text == null ? "" : String(text);
+  row.appendChild(td);
+  return td;
+}
+
+function params(form, names) {
+  const data = new FormData(form);
+  const q = new URLSearchParams();
+  for (const name of names) {
+    const value = data.get(name);
+    if (value) {
+      q.set(name, name === "from" || name === "to" ? isoTime(value) : value);
+    }
+  }
+  return q;
+}
+
+function defaultRange(form, days) {
+  const local = (d) => new Date(d.getTime() - d.getTimezoneOffset() * 60000).toISOString().slice(0, 16);
+  const now = new Date();
+  form.elements.to.value = local(now);
+  form.elements.from.value = local(new Date(now.getTime() - days * 86400000));
+}
+
+function handle(form, fn) {
+  form.addEventListener("submit", async (e) => {
+    e.preventDefault();
+    showError("");
+    try {
+      await fn(form);
+    } catch (err) {
+      showError(err.message);
+    }
+  });
+}
+
+for (const button of document.querySelectorAll("nav button")) {
+  button.addEventListener("click", () => {
+    for (const b of document.querySelectorAll("nav button")) {
+      b.classList.toggle("active", b === button);
+      document.getElementById(b.dataset.tab).hidden = b !== button;
+    }
+    showError("");
+    if (button.dataset.tab === "exports") {
+      listExports().catch((err) => showError(err.message));
+    }
+  });
+}
+
+const eventsForm = document.getElementById("events-form");
+defaultRange(eventsForm, 1);
+handle(eventsForm, async (form) => {
+  const q = params(form, ["project_id", "user_id", "from", "to", "filter", "limit"]);
+  const res = await api("/events?" + q);
+  // the response_envelope feature flag wraps the events in an object
+  const body = await res.json();
+  const events = Array.isArray(body) ? body : body.events;
+  const rows = document.getElementById("events-rows");
+  rows.replaceChildren();
+  for (const e of events) {
+    const tr = document.createElement("tr");
+    cell(tr, e.id);
+    cell(tr, e.user_id);
+    cell(tr, e.action);
+    cell(tr, e.metadata && e.metadata.page);
+    cell(tr, e.created_at);
+    rows.appendChild(tr);
+  }
+  const truncated = res.headers.get("X-Result-Truncated") === "true";
+  document.getElementById("events-summary").textContent =
+    events.length + " events, newest first" + (truncated ? "; more match, raise the limit to see them" : "");
+});
+
+const aggregatesForm = document.getElementById("aggregates-form");
+defaultRange(aggregatesForm, 7);
+handle(aggregatesForm, async (form) => {
+  const q = params(form, ["project_id", "action", "from", "to", "bucket"]);
+  const res = await api("/stats/timeseries?" + q);
+  const series = await res.json();
+  const most = Math.max(1, ...series.points.map((p) => p.events));
+  const rows = document.getElementById("aggregates-rows");
+  rows.replaceChildren();
+  for (const p of series.points) {
+    const tr = document.createElement("tr");
+    cell(tr, p.start);
+    cell(tr, p.events);
+    cell(tr, p.users);
+    const bar = document.createElement("span");
+    bar.style.width = Math.round((p.events / most) * 300) + "px";
+    const td = cell(tr, "");
+    td.className = "bar";
+    td.appendChild(bar);
+    rows.appendChild(tr);
+  }
+});
+
+async function listExports() {
+  const res = await api("/exports");
+  const { runs } = await res.json();
+  const rows = document.getElementById("exports-rows");
+  rows.replaceChildren();
+  for (const r of runs) {
+    const tr = document.createElement("tr");
+    cell(tr, r.id);
+    cell(tr, r.trigger);
+    cell(tr, r.from);
+    cell(tr, r.to);
+    cell(tr, r.status);
+    cell(tr, (r.windows || []).reduce((n, w) => n + w.rows, 0));
+    cell(tr, r.error);
+    rows.appendChild(tr);
+  }
+}
+
+const exportsForm = document.getElementById("exports-form");
+defaultRange(exportsForm, 1);
+handle(exportsForm, async (form) => {
+  const data = new FormData(form);
+  await api("/exports", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({ from: isoTime(data.get("from")), to: isoTime(data.get("to")), force: data.get("force") === "on" }),
+  });
+  await listExports();
+});
+document.getElementById("exports-refresh").addEventListener("click", () => {
+  showError("");
+  listExports().catch((err) => showError(err.message));
+});
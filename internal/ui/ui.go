@@ -0,0 +1,24 @@
+// Package ui embeds the web UI of the admin listener: a single page
+// searching events, charting the aggregates and triggering exports through
+// the admin API, for support investigations without database access.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// Handler serves the files of the UI, with prefix stripped from the
+// request paths. The files hold no data: the page calls the admin API with
+// the admin token entered in it.
+func Handler(prefix string) http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(prefix, http.FileServerFS(files))
+}
@@ -0,0 +1,178 @@
+// Package usercheck asks an external user service whether the user of an
+// event exists, so that mistyped user ids do not silently pollute the
+// analytics.
+//
+// The service is called with GET on a URL template holding {user_id} and
+// optionally {project_id}: 2xx means the user exists, 404 that it does not,
+// and any other answer is an error. Answers are cached, the negative ones for
+// a shorter time so that a user created after its first events is soon
+// accepted.
+package usercheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+// Modes of handling the events of unknown users.
+const (
+	// Reject refuses the events of unknown users.
+	Reject = "reject"
+	// Flag stores them and reports the unknown user to the sender.
+	Flag = "flag"
+	// Allow stores them, only counting the unknown users.
+	Allow = "allow"
+)
+
+var checks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "user_checks_total",
+		Help: "User ids verified with the user service: known, unknown, or error when the service failed",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(checks)
+}
+
+type key struct {
+	projectID, userID int64
+}
+
+type answer struct {
+	exists  bool
+	expires time.Time
+}
+
+// Checker verifies user ids with the user service.
+type Checker struct {
+	url    string
+	token  string
+	client *http.Client
+
+	ttl         time.Duration
+	negativeTTL time.Duration
+	size        int
+	now         func() time.Time
+
+	mu    sync.Mutex
+	cache map[key]answer
+}
+
+// New returns a Checker of the user service of cfg.
+func New(cfg config.UserCheckConfig) *Checker {
+	return &Checker{
+		url:         cfg.URL,
+		token:       cfg.Token,
+		client:      &http.Client{Timeout: time.Duration(cfg.TimeoutMillis) * time.Millisecond},
+		ttl:         time.Duration(cfg.CacheSeconds) * time.Second,
+		negativeTTL: time.Duration(cfg.NegativeCacheSeconds) * time.Second,
+		size:        cfg.CacheSize,
+		now:         time.Now,
+		cache:       make(map[key]answer),
+	}
+}
+
+// Exists reports whether the user of the project exists.
+func (c *Checker) Exists(ctx context.Context, projectID, userID int64) (bool, error) {
+	k := key{projectID: projectID, userID: userID}
+	if exists, ok := c.cached(k); ok {
+		return exists, nil
+	}
+
+	exists, err := c.ask(ctx, k)
+	if err != nil {
+		checks.WithLabelValues("error").Inc()
+		return false, err
+	}
+	if exists {
+		checks.WithLabelValues("known").Inc()
+	} else {
+		checks.WithLabelValues("unknown").Inc()
+	}
+	c.remember(k, exists)
+	return exists, nil
+}
+
+func (c *Checker) ask(ctx context.Context, k key) (bool, error) {
+	url := strings.NewReplacer(
+		"{user_id}", strconv.FormatInt(k.userID, 10),
+		"{project_id}", strconv.FormatInt(k.projectID, 10),
+	).Replace(c.url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("user service: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return true, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return false, nil
+	default:
+		return false, errors.New("user service: unexpected status " + resp.Status)
+	}
+}
+
+func (c *Checker) cached(k key) (exists, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a, ok := c.cache[k]
+	if !ok || !c.now().Before(a.expires) {
+		return false, false
+	}
+	return a.exists, true
+}
+
+func (c *Checker) remember(k key, exists bool) {
+	ttl := c.ttl
+	if !exists {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 || c.size == 0 {
+		return
+	}
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.cache) >= c.size {
+		for k, a := range c.cache {
+			if !now.Before(a.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	// Still full of live answers: evict arbitrary ones
+	for k := range c.cache {
+		if len(c.cache) < c.size {
+			break
+		}
+		delete(c.cache, k)
+	}
+	c.cache[k] = answer{exists: exists, expires: now.Add(ttl)}
+}
@@ -0,0 +1,73 @@
+package usercheck
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+)
+
+func TestChecker(t *testing.T) {
+	calls := map[string]int{}
+	users := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.URL.Path]++
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/projects/1/users/42":
+			w.WriteHeader(http.StatusOK)
+		case "/projects/1/users/500":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer users.Close()
+
+	now := time.Unix(1700000000, 0)
+	c := New(config.UserCheckConfig{
+		URL:                  users.URL + "/projects/{project_id}/users/{user_id}",
+		Token:                "s3cret",
+		TimeoutMillis:        1000,
+		CacheSeconds:         300,
+		NegativeCacheSeconds: 30,
+		CacheSize:            10,
+	})
+	c.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		userID  int64
+		exists  bool
+		wantErr bool
+	}{
+		{name: "known", userID: 42, exists: true},
+		{name: "unknown", userID: 7},
+		{name: "service error", userID: 500, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exists, err := c.Exists(context.Background(), 1, tt.userID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if exists != tt.exists {
+				t.Fatalf("expected exists %v, got %v", tt.exists, exists)
+			}
+		})
+	}
+
+	// Answers are cached, errors are not; unknown users for a shorter time
+	now = now.Add(time.Minute)
+	for _, id := range []int64{42, 7, 500} {
+		_, _ = c.Exists(context.Background(), 1, id)
+	}
+	if calls["/projects/1/users/42"] != 1 || calls["/projects/1/users/7"] != 2 || calls["/projects/1/users/500"] != 2 {
+		t.Fatalf("unexpected calls to the user service: %v", calls)
+	}
+}
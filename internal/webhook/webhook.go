@@ -0,0 +1,223 @@
+// Package webhook turns signed payloads of third-party webhook senders
+// (GitHub, Stripe and alike) into events. Each provider has its own secret,
+// signature scheme and mapping of payload fields to the event.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+var (
+	// ErrUnknownProvider is returned for providers missing from the configuration.
+	ErrUnknownProvider = errors.New("unknown webhook provider")
+	// ErrSignature is returned when the signature is missing, stale or wrong.
+	ErrSignature = errors.New("invalid webhook signature")
+)
+
+const defaultTolerance = 5 * time.Minute
+
+var requestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "webhook_requests_total",
+		Help: "Webhook payloads by provider and result: mapped, invalid (not mappable to an event) or unauthorized (bad signature)",
+	},
+	[]string{"provider", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal)
+}
+
+type Receiver struct {
+	providers map[string]config.WebhookConfig
+	now       func() time.Time
+}
+
+func New(providers map[string]config.WebhookConfig) *Receiver {
+	return &Receiver{providers: providers, now: time.Now}
+}
+
+// Event verifies the signature of a payload sent by provider and maps it to
+// an event. Payloads that verify but cannot be mapped wrap ingest.ErrInvalid.
+func (r *Receiver) Event(provider string, header http.Header, body []byte) (ingest.Event, error) {
+	p, ok := r.providers[provider]
+	if !ok {
+		return ingest.Event{}, ErrUnknownProvider
+	}
+
+	e, err := r.event(p, header, body)
+	switch {
+	case errors.Is(err, ErrSignature):
+		requestsTotal.WithLabelValues(provider, "unauthorized").Inc()
+	case err != nil:
+		requestsTotal.WithLabelValues(provider, "invalid").Inc()
+	default:
+		requestsTotal.WithLabelValues(provider, "mapped").Inc()
+	}
+	return e, err
+}
+
+func (r *Receiver) event(p config.WebhookConfig, header http.Header, body []byte) (ingest.Event, error) {
+	if err := r.verify(p, header.Get(p.SignatureHeader), body); err != nil {
+		return ingest.Event{}, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var payload any
+	if err := dec.Decode(&payload); err != nil {
+		return ingest.Event{}, fmt.Errorf("%w: %v", ingest.ErrInvalid, err)
+	}
+	lookup := func(field string) (string, bool) {
+		if name, ok := strings.CutPrefix(field, "header:"); ok {
+			v := header.Get(name)
+			return v, v != ""
+		}
+		return lookupPath(payload, field)
+	}
+
+	var e ingest.Event
+	uid, ok := lookup(p.UserIDField)
+	if !ok {
+		return ingest.Event{}, fmt.Errorf("%w: %w", ingest.ErrInvalid, ingest.NewFieldError(p.UserIDField, "required", p.UserIDField+" is missing"))
+	}
+	var err error
+	if e.UserID, err = strconv.ParseInt(uid, 10, 64); err != nil {
+		return ingest.Event{}, fmt.Errorf("%w: %w", ingest.ErrInvalid, ingest.NewFieldError(p.UserIDField, "invalid", fmt.Sprintf("%s must be an integer, got %q", p.UserIDField, uid)))
+	}
+
+	e.Action = p.Action
+	if p.ActionField != "" {
+		if e.Action, ok = lookup(p.ActionField); !ok {
+			return ingest.Event{}, fmt.Errorf("%w: %w", ingest.ErrInvalid, ingest.NewFieldError(p.ActionField, "required", p.ActionField+" is missing"))
+		}
+	}
+	e.Action = p.ActionPrefix + e.Action
+
+	for key, field := range p.MetadataFields {
+		if v, ok := lookup(field); ok {
+			if e.Metadata == nil {
+				e.Metadata = make(map[string]string, len(p.MetadataFields))
+			}
+			e.Metadata[key] = v
+		}
+	}
+
+	if err := e.Validate(); err != nil {
+		return ingest.Event{}, fmt.Errorf("%w: %w", ingest.ErrInvalid, err)
+	}
+	return e, nil
+}
+
+func (r *Receiver) verify(p config.WebhookConfig, signature string, body []byte) error {
+	if signature == "" {
+		return fmt.Errorf("%w: %s header is missing", ErrSignature, p.SignatureHeader)
+	}
+
+	switch p.SignatureScheme {
+	case "stripe":
+		// t=<unix seconds>,v1=<hex>[,v1=<hex>...] over "<t>.<body>"
+		var ts string
+		var candidates []string
+		for _, part := range strings.Split(signature, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "t":
+				ts = v
+			case "v1":
+				candidates = append(candidates, v)
+			}
+		}
+		sec, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || len(candidates) == 0 {
+			return fmt.Errorf("%w: malformed %s header", ErrSignature, p.SignatureHeader)
+		}
+		tolerance := defaultTolerance
+		if p.ToleranceSeconds > 0 {
+			tolerance = time.Duration(p.ToleranceSeconds) * time.Second
+		}
+		if age := r.now().Sub(time.Unix(sec, 0)); age > tolerance || age < -tolerance {
+			return fmt.Errorf("%w: timestamp outside the tolerance", ErrSignature)
+		}
+		expected := sign(p.Secret, []byte(ts+"."), body)
+		for _, c := range candidates {
+			if equalHex(c, expected) {
+				return nil
+			}
+		}
+		return ErrSignature
+	default:
+		if !equalHex(strings.TrimPrefix(signature, "sha256="), sign(p.Secret, body)) {
+			return ErrSignature
+		}
+		return nil
+	}
+}
+
+func sign(secret string, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)
+}
+
+func equalHex(signature string, expected []byte) bool {
+	got, err := hex.DecodeString(signature)
+	return err == nil && hmac.Equal(got, expected)
+}
+
+// lookupPath walks a dotted path through objects and arrays (numeric
+// segments) and renders scalars as strings; objects and arrays are rendered
+// as JSON.
+func lookupPath(v any, path string) (string, bool) {
+	for _, seg := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[seg]; !ok {
+				return "", false
+			}
+		case []any:
+			i, err := strconv.Atoi(seg)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+
+	switch val := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return val, true
+	case json.Number:
+		return val.String(), true
+	case bool:
+		return strconv.FormatBool(val), true
+	default:
+		data, err := json.Marshal(val)
+		if err != nil {
+			return "", false
+		}
+		return string(data), true
+	}
+}
@@ -0,0 +1,128 @@
+package webhook
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/arimatakao/simple-events-handler/internal/config"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+)
+
+func TestEvent(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := New(map[string]config.WebhookConfig{
+		"github": {
+			Secret:          "gh-secret",
+			SignatureHeader: "X-Hub-Signature-256",
+			SignatureScheme: "sha256",
+			UserIDField:     "sender.id",
+			ActionField:     "header:X-GitHub-Event",
+			ActionPrefix:    "github.",
+			MetadataFields:  map[string]string{"repo": "repository.full_name", "first_commit": "commits.0.id"},
+		},
+		"stripe": {
+			Secret:          "whsec",
+			SignatureHeader: "Stripe-Signature",
+			SignatureScheme: "stripe",
+			UserIDField:     "data.object.metadata.user_id",
+			ActionField:     "type",
+		},
+	})
+	r.now = func() time.Time { return now }
+
+	githubBody := `{"sender":{"id":42},"repository":{"full_name":"acme/app"},"commits":[{"id":"abc"}]}`
+	stripeBody := `{"type":"invoice.paid","data":{"object":{"metadata":{"user_id":"7"}}}}`
+	stripeSig := func(ts int64, secret string) string {
+		mac := sign(secret, []byte(fmt.Sprintf("%d.", ts)), []byte(stripeBody))
+		return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac))
+	}
+
+	tests := []struct {
+		name         string
+		provider     string
+		header       http.Header
+		body         string
+		expectErr    error
+		expectUserID int64
+		expectAction string
+		expectMeta   map[string]string
+	}{
+		{
+			name:     "github",
+			provider: "github",
+			header: http.Header{
+				"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(sign("gh-secret", []byte(githubBody)))},
+				"X-Github-Event":      {"push"},
+			},
+			body:         githubBody,
+			expectUserID: 42,
+			expectAction: "github.push",
+			expectMeta:   map[string]string{"repo": "acme/app", "first_commit": "abc"},
+		},
+		{
+			name:      "github with a wrong secret",
+			provider:  "github",
+			header:    http.Header{"X-Hub-Signature-256": {"sha256=" + hex.EncodeToString(sign("other", []byte(githubBody)))}},
+			body:      githubBody,
+			expectErr: ErrSignature,
+		},
+		{name: "github without signature", provider: "github", body: githubBody, expectErr: ErrSignature},
+		{
+			name:      "github without the event header",
+			provider:  "github",
+			header:    http.Header{"X-Hub-Signature-256": {hex.EncodeToString(sign("gh-secret", []byte(githubBody)))}},
+			body:      githubBody,
+			expectErr: ingest.ErrInvalid,
+		},
+		{
+			name:         "stripe",
+			provider:     "stripe",
+			header:       http.Header{"Stripe-Signature": {stripeSig(now.Unix()-10, "whsec")}},
+			body:         stripeBody,
+			expectUserID: 7,
+			expectAction: "invoice.paid",
+		},
+		{
+			name:      "stripe replayed after the tolerance",
+			provider:  "stripe",
+			header:    http.Header{"Stripe-Signature": {stripeSig(now.Unix()-600, "whsec")}},
+			body:      stripeBody,
+			expectErr: ErrSignature,
+		},
+		{
+			name:      "stripe malformed header",
+			provider:  "stripe",
+			header:    http.Header{"Stripe-Signature": {"v1=abc"}},
+			body:      stripeBody,
+			expectErr: ErrSignature,
+		},
+		{name: "unknown provider", provider: "gitlab", body: "{}", expectErr: ErrUnknownProvider},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := r.Event(tt.provider, tt.header, []byte(tt.body))
+			if tt.expectErr != nil {
+				if !errors.Is(err, tt.expectErr) {
+					t.Fatalf("expected %v got %v", tt.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("event: %v", err)
+			}
+			if e.UserID != tt.expectUserID || e.Action != tt.expectAction || len(e.Metadata) != len(tt.expectMeta) {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			for k, v := range tt.expectMeta {
+				if e.Metadata[k] != v {
+					t.Fatalf("expected metadata %v got %v", tt.expectMeta, e.Metadata)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+-- Dual-write migration of the events to events_v2, whose metadata is a
+-- JSONB object instead of the metadata_page column. Run after
+-- init_tables.sql (and timescale.sql) on PostgreSQL; running it again
+-- changes nothing. Nothing is copied until the dual write is enabled with
+-- PUT /migrations/dual-write on the admin listener: from then on every
+-- insert, update and delete of events, whichever path stored it, is applied
+-- to events_v2 in the same transaction. The events stored before are copied
+-- by the verify_dual_write job with repair set.
+CREATE TABLE IF NOT EXISTS events_v2 (
+    -- The id of the event in events; no foreign key, so that events can be
+    -- a hypertable
+    id BIGINT PRIMARY KEY,
+    project_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    -- {"page": metadata_page}, or {} without a page
+    metadata JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ,
+    schema_version INTEGER NOT NULL DEFAULT 1
+);
+CREATE INDEX IF NOT EXISTS events_v2_project_created_at ON events_v2 (project_id, created_at);
+CREATE INDEX IF NOT EXISTS events_v2_created_at ON events_v2 (created_at);
+
+-- The state of each dual write, set through the admin listener
+CREATE TABLE IF NOT EXISTS dual_writes (
+    name TEXT PRIMARY KEY,
+    enabled BOOLEAN NOT NULL DEFAULT false,
+    -- Set when the dual write is enabled, cleared when disabled
+    started_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+INSERT INTO dual_writes (name) VALUES ('events_v2') ON CONFLICT DO NOTHING;
+
+CREATE OR REPLACE FUNCTION events_dual_write() RETURNS trigger AS $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM dual_writes WHERE name = 'events_v2' AND enabled) THEN
+        RETURN NULL;
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        DELETE FROM events_v2 WHERE id = OLD.id;
+        RETURN NULL;
+    END IF;
+    INSERT INTO events_v2 (id, project_id, user_id, action, metadata, created_at, expires_at, schema_version)
+    VALUES (
+        NEW.id, NEW.project_id, NEW.user_id, NEW.action,
+        CASE WHEN NEW.metadata_page IS NULL THEN '{}'::jsonb ELSE jsonb_build_object('page', NEW.metadata_page) END,
+        NEW.created_at, NEW.expires_at, NEW.schema_version
+    )
+    ON CONFLICT (id) DO UPDATE SET
+        project_id = EXCLUDED.project_id,
+        user_id = EXCLUDED.user_id,
+        action = EXCLUDED.action,
+        metadata = EXCLUDED.metadata,
+        created_at = EXCLUDED.created_at,
+        expires_at = EXCLUDED.expires_at,
+        schema_version = EXCLUDED.schema_version;
+    RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS events_dual_write ON events;
+CREATE TRIGGER events_dual_write AFTER INSERT OR UPDATE OR DELETE ON events
+    FOR EACH ROW EXECUTE FUNCTION events_dual_write();
@@ -0,0 +1,293 @@
+-- The schema of other/init_tables.sql for CockroachDB (DB_COCKROACH=true),
+-- which it must follow. SERIAL ids are generated by unique_rowid(), so no
+-- sequence is advanced, and the archive has a regular index, CockroachDB
+-- having no BRIN indexes.
+
+-- Every event belongs to a project; project 1 receives the events sent
+-- without an API key
+CREATE TABLE IF NOT EXISTS projects (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+INSERT INTO projects (id, name) VALUES (1, 'default') ON CONFLICT DO NOTHING;
+
+-- Only the SHA-256 of a key is stored; the prefix identifies it in listings
+CREATE TABLE IF NOT EXISTS api_keys (
+    id BIGSERIAL PRIMARY KEY,
+    project_id BIGINT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    name TEXT NOT NULL DEFAULT '',
+    prefix TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    revoked_at TIMESTAMPTZ
+);
+
+-- Usage of each API key per UTC day, counted against the quotas
+CREATE TABLE IF NOT EXISTS api_key_usage (
+    api_key_id BIGINT NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+    day DATE NOT NULL,
+    events BIGINT NOT NULL DEFAULT 0,
+    queries BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day)
+);
+
+CREATE TABLE IF NOT EXISTS events (
+    id SERIAL PRIMARY KEY,
+    project_id BIGINT NOT NULL DEFAULT 1,
+    user_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    metadata_page TEXT,
+    created_at TIMESTAMPTZ DEFAULT now(),
+    -- Set by the sender of POST /events/batch; an event is stored once per key
+    dedupe_key TEXT,
+    -- Hash of the project, user, action and metadata, set when deduplicated
+    fingerprint TEXT,
+    -- Creation time plus the ttl_seconds of the event, when sent
+    expires_at TIMESTAMPTZ,
+    -- Version of the event schema the event was sent with
+    schema_version INTEGER NOT NULL DEFAULT 1
+);
+
+ALTER TABLE events ADD COLUMN IF NOT EXISTS dedupe_key TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS events_dedupe_key ON events (dedupe_key) WHERE dedupe_key IS NOT NULL;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS project_id BIGINT NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS events_project_created_at ON events (project_id, created_at);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS fingerprint TEXT;
+CREATE INDEX IF NOT EXISTS events_fingerprint ON events (project_id, fingerprint, created_at) WHERE fingerprint IS NOT NULL;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS events_expires_at ON events (expires_at) WHERE expires_at IS NOT NULL;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS schema_version INTEGER NOT NULL DEFAULT 1;
+
+-- Labels put on events after the fact, e.g. bot-traffic
+CREATE TABLE IF NOT EXISTS event_tags (
+    event_id INT NOT NULL REFERENCES events(id) ON DELETE CASCADE,
+    tag TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (event_id, tag)
+);
+CREATE INDEX IF NOT EXISTS event_tags_tag ON event_tags (tag, event_id);
+
+CREATE TABLE IF NOT EXISTS user_event_counts (
+    project_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    event_count BIGINT NOT NULL,
+    PRIMARY KEY (project_id, user_id, period_start)
+);
+
+CREATE TABLE IF NOT EXISTS action_event_counts (
+    project_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    period_start TIMESTAMPTZ NOT NULL,
+    period_end TIMESTAMPTZ NOT NULL,
+    event_count BIGINT NOT NULL,
+    PRIMARY KEY (project_id, action, period_start)
+);
+
+-- The counts were kept for every project together before. A database
+-- created then is migrated once with, for each table (action for
+-- action_event_counts):
+--   ALTER TABLE user_event_counts ADD COLUMN project_id BIGINT NOT NULL DEFAULT 1;
+--   ALTER TABLE user_event_counts DROP CONSTRAINT user_event_counts_pkey,
+--       ADD CONSTRAINT user_event_counts_pkey PRIMARY KEY (project_id, user_id, period_start);
+
+-- The periods counted into user_event_counts and action_event_counts, see
+-- init_tables.sql
+CREATE TABLE IF NOT EXISTS aggregated_periods (
+    id INT PRIMARY KEY CHECK (id = 1),
+    period_seconds INT NOT NULL,
+    covered_from TIMESTAMPTZ NOT NULL,
+    covered_to TIMESTAMPTZ NOT NULL,
+    aggregated_at TIMESTAMPTZ NOT NULL,
+    checked_event_id BIGINT NOT NULL DEFAULT 0,
+    last_event_id BIGINT NOT NULL DEFAULT 0
+);
+
+-- Events of each user per action and UTC hour, for the time series of an
+-- action with its unique users
+CREATE TABLE IF NOT EXISTS action_user_hours (
+    project_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    hour TIMESTAMPTZ NOT NULL,
+    user_id BIGINT NOT NULL,
+    event_count BIGINT NOT NULL,
+    PRIMARY KEY (project_id, action, hour, user_id)
+);
+
+-- Anomalies of the action rates of each project; an action of a project
+-- has at most one open alert
+CREATE TABLE IF NOT EXISTS anomaly_alerts (
+    id BIGSERIAL PRIMARY KEY,
+    project_id BIGINT NOT NULL DEFAULT 1,
+    action TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    window_start TIMESTAMPTZ NOT NULL,
+    window_end TIMESTAMPTZ NOT NULL,
+    event_count BIGINT NOT NULL,
+    expected_count DOUBLE PRECISION NOT NULL,
+    detected_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ
+);
+-- The alerts raised for every project together before stay with the
+-- default project
+ALTER TABLE anomaly_alerts ADD COLUMN IF NOT EXISTS project_id BIGINT NOT NULL DEFAULT 1;
+DROP INDEX IF EXISTS anomaly_alerts_open;
+CREATE UNIQUE INDEX IF NOT EXISTS anomaly_alerts_open_project ON anomaly_alerts (project_id, action) WHERE resolved_at IS NULL;
+
+-- Threshold alerting rules managed on the admin listener, and their
+-- firings; a rule has at most one open firing per user (0 when the rule
+-- counts every user together)
+CREATE TABLE IF NOT EXISTS alert_rules (
+    id BIGSERIAL PRIMARY KEY,
+    name TEXT NOT NULL,
+    project_id BIGINT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    action TEXT NOT NULL,
+    per_user BOOLEAN NOT NULL DEFAULT false,
+    threshold BIGINT NOT NULL,
+    window_seconds INT NOT NULL,
+    active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS alert_firings (
+    id BIGSERIAL PRIMARY KEY,
+    rule_id BIGINT NOT NULL REFERENCES alert_rules(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL DEFAULT 0,
+    event_count BIGINT NOT NULL,
+    fired_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    resolved_at TIMESTAMPTZ
+);
+CREATE UNIQUE INDEX IF NOT EXISTS alert_firings_open ON alert_firings (rule_id, user_id) WHERE resolved_at IS NULL;
+CREATE INDEX IF NOT EXISTS alert_firings_rule ON alert_firings (rule_id, id DESC);
+
+-- Named queries of a project, run on the public API with
+-- GET /queries/:name/run; a NULL result_limit leaves the default limit
+CREATE TABLE IF NOT EXISTS saved_queries (
+    id BIGSERIAL PRIMARY KEY,
+    project_id BIGINT NOT NULL REFERENCES projects(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    filter TEXT NOT NULL DEFAULT '',
+    user_id BIGINT,
+    range_seconds INT NOT NULL,
+    group_by TEXT NOT NULL DEFAULT '',
+    format TEXT NOT NULL DEFAULT 'json',
+    result_limit INT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (project_id, name)
+);
+
+-- Position of each sink in the events table
+CREATE TABLE IF NOT EXISTS sink_cursors (
+    name TEXT PRIMARY KEY,
+    last_event_id BIGINT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+    id BIGSERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret TEXT NOT NULL,
+    -- Empty filters match every event
+    actions TEXT[] NOT NULL DEFAULT '{}',
+    user_ids BIGINT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT true,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    subscription_id BIGINT NOT NULL REFERENCES webhook_subscriptions(id) ON DELETE CASCADE,
+    event_id BIGINT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    response_status INT,
+    error TEXT,
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    finished_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_subscription ON webhook_deliveries (subscription_id, id DESC);
+
+-- Privileged operations made through the admin listener
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    actor TEXT NOT NULL DEFAULT '',
+    remote_addr TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    action TEXT NOT NULL,
+    status INT NOT NULL DEFAULT 0,
+    payload JSONB NOT NULL DEFAULT '{}'
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at);
+
+-- Overrides of the feature flags set on the admin listener, globally with
+-- project_id 0 or for a project; flags without a row keep their default
+CREATE TABLE IF NOT EXISTS feature_flags (
+    name TEXT NOT NULL,
+    project_id BIGINT NOT NULL DEFAULT 0,
+    enabled BOOLEAN NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (name, project_id)
+);
+
+-- Events moved out of events once older than ARCHIVE_AFTER_DAYS, with
+-- their tags
+CREATE TABLE IF NOT EXISTS events_archive (
+    id INT NOT NULL,
+    project_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    metadata_page TEXT,
+    created_at TIMESTAMPTZ,
+    schema_version INTEGER NOT NULL DEFAULT 1,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    archived_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+ALTER TABLE events_archive ADD COLUMN IF NOT EXISTS schema_version INTEGER NOT NULL DEFAULT 1;
+CREATE INDEX IF NOT EXISTS events_archive_created_at ON events_archive (created_at);
+
+-- Events of POST /events with a deliver_at, moved to events with that
+-- creation time once due
+CREATE TABLE IF NOT EXISTS pending_events (
+    id BIGSERIAL PRIMARY KEY,
+    project_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    action TEXT NOT NULL,
+    metadata_page TEXT,
+    deliver_at TIMESTAMPTZ NOT NULL,
+    expires_at TIMESTAMPTZ,
+    schema_version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS pending_events_due ON pending_events (deliver_at);
+
+-- Background jobs of POST /exports and POST /jobs, claimed by the workers
+-- of every instance; heartbeat_at is refreshed while a job runs, so that
+-- the jobs of a stopped instance are claimed again
+CREATE TABLE IF NOT EXISTS jobs (
+    id BIGSERIAL PRIMARY KEY,
+    project_id BIGINT NOT NULL,
+    kind TEXT NOT NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    status TEXT NOT NULL DEFAULT 'queued',
+    attempts INT NOT NULL DEFAULT 0,
+    done BIGINT NOT NULL DEFAULT 0,
+    total BIGINT NOT NULL DEFAULT 0,
+    error TEXT,
+    artifact TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at TIMESTAMPTZ,
+    heartbeat_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS jobs_unfinished ON jobs (id) WHERE status IN ('queued', 'running');
+CREATE INDEX IF NOT EXISTS jobs_finished_at ON jobs (finished_at) WHERE finished_at IS NOT NULL;
@@ -0,0 +1,112 @@
+-- TimescaleDB mode (DB_TIMESCALE=true), run after init_tables.sql on a
+-- TimescaleDB server. It turns events into a hypertable partitioned by
+-- created_at, and replaces the tables filled by AggregateEvents with
+-- continuous aggregates of the same names and columns. Running it again
+-- changes nothing. The chunk interval, compression and refresh policies are
+-- set by the service at startup.
+CREATE EXTENSION IF NOT EXISTS timescaledb;
+
+-- The unique constraints of a hypertable must hold its time column, so the
+-- tags no longer reference events and the dedupe keys move to a table of
+-- their own
+ALTER TABLE event_tags DROP CONSTRAINT IF EXISTS event_tags_event_id_fkey;
+ALTER TABLE events ALTER COLUMN created_at SET NOT NULL;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'events_pkey' AND conrelid = 'events'::regclass AND array_length(conkey, 1) = 2) THEN
+        ALTER TABLE events DROP CONSTRAINT IF EXISTS events_pkey;
+        ALTER TABLE events ADD CONSTRAINT events_pkey PRIMARY KEY (id, created_at);
+    END IF;
+END $$;
+
+-- An event is stored once per key; the key of a deleted event can be used
+-- again
+CREATE TABLE IF NOT EXISTS event_dedupe_keys (
+    dedupe_key TEXT PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+INSERT INTO event_dedupe_keys (dedupe_key, created_at)
+SELECT dedupe_key, created_at FROM events WHERE dedupe_key IS NOT NULL
+ON CONFLICT DO NOTHING;
+DROP INDEX IF EXISTS events_dedupe_key;
+
+-- Replaces ON DELETE CASCADE of the tags, and frees the dedupe key
+CREATE OR REPLACE FUNCTION events_deleted() RETURNS trigger AS $$
+BEGIN
+    DELETE FROM event_tags WHERE event_id = OLD.id;
+    IF OLD.dedupe_key IS NOT NULL THEN
+        DELETE FROM event_dedupe_keys WHERE dedupe_key = OLD.dedupe_key;
+    END IF;
+    RETURN OLD;
+END $$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS events_deleted ON events;
+CREATE TRIGGER events_deleted AFTER DELETE ON events FOR EACH ROW EXECUTE FUNCTION events_deleted();
+
+SELECT create_hypertable('events', by_range('created_at', INTERVAL '1 day'), if_not_exists => TRUE, migrate_data => TRUE);
+
+-- Chunks are compressed per project, newest events first
+ALTER TABLE events SET (
+    timescaledb.compress,
+    timescaledb.compress_segmentby = 'project_id',
+    timescaledb.compress_orderby = 'created_at DESC, id DESC'
+);
+
+-- The aggregates are counted again from the events below
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['user_event_counts', 'action_event_counts', 'action_user_hours'] LOOP
+        IF EXISTS (SELECT 1 FROM pg_class WHERE relname = t AND relnamespace = current_schema()::regnamespace AND relkind = 'r') THEN
+            EXECUTE format('DROP TABLE %I', t);
+        END IF;
+    END LOOP;
+END $$;
+
+-- The minutes were counted for every project together before; they are
+-- counted again per project
+DO $$
+DECLARE
+    t TEXT;
+BEGIN
+    FOREACH t IN ARRAY ARRAY['user_event', 'action_event'] LOOP
+        IF EXISTS (SELECT 1 FROM pg_class WHERE relname = t || '_minutes' AND relnamespace = current_schema()::regnamespace)
+            AND NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = t || '_minutes' AND column_name = 'project_id') THEN
+            EXECUTE format('DROP VIEW IF EXISTS %I', t || '_counts');
+            EXECUTE format('DROP MATERIALIZED VIEW %I', t || '_minutes');
+        END IF;
+    END LOOP;
+END $$;
+
+-- Events of each user and of each action per minute. The views keep the
+-- columns of the tables they replace, and the minutes that are over only,
+-- the current one being still counted
+CREATE MATERIALIZED VIEW IF NOT EXISTS user_event_minutes
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT project_id, user_id, time_bucket(INTERVAL '1 minute', created_at) AS period_start, count(*) AS event_count
+FROM events
+GROUP BY project_id, user_id, time_bucket(INTERVAL '1 minute', created_at);
+
+CREATE OR REPLACE VIEW user_event_counts AS
+SELECT project_id, user_id, period_start, period_start + INTERVAL '1 minute' AS period_end, event_count
+FROM user_event_minutes
+WHERE period_start + INTERVAL '1 minute' <= now();
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS action_event_minutes
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT project_id, action, time_bucket(INTERVAL '1 minute', created_at) AS period_start, count(*) AS event_count
+FROM events
+GROUP BY project_id, action, time_bucket(INTERVAL '1 minute', created_at);
+
+CREATE OR REPLACE VIEW action_event_counts AS
+SELECT project_id, action, period_start, period_start + INTERVAL '1 minute' AS period_end, event_count
+FROM action_event_minutes
+WHERE period_start + INTERVAL '1 minute' <= now();
+
+-- Events of each user per action and UTC hour, for the time series of an
+-- action with its unique users
+CREATE MATERIALIZED VIEW IF NOT EXISTS action_user_hours
+WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+SELECT project_id, action, time_bucket(INTERVAL '1 hour', created_at) AS hour, user_id, count(*) AS event_count
+FROM events
+GROUP BY project_id, action, time_bucket(INTERVAL '1 hour', created_at), user_id;
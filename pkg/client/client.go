@@ -0,0 +1,356 @@
+// Package client is the Go client of the simple-events-handler API.
+//
+//	c := client.New("http://localhost:8080/api")
+//	err := c.AddEvent(ctx, client.NewEvent{UserID: 42, Action: "view"})
+//
+//	for e, err := range c.Events(ctx, client.UserID(42), client.From(yesterday)) {
+//		...
+//	}
+//
+// Requests are retried with backoff while the server is overloaded or
+// unreachable. Retries never store an event twice: POST /events is only
+// retried when the server reports the event was not stored, and events with
+// an idempotency key are sent through POST /events/batch, which stores an
+// event once per key.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
+)
+
+// MaxBatchEvents is the largest batch accepted by AddEventsBatch.
+const MaxBatchEvents = 1000
+
+// Event is a stored event.
+type Event struct {
+	ID           int64     `json:"id"`
+	UserID       int64     `json:"user_id"`
+	Action       string    `json:"action"`
+	MetadataPage *string   `json:"metadata_page,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	// SchemaVersion is the version of the event schema the event was sent
+	// with, 1 for the events sent without one.
+	SchemaVersion int `json:"schema_version,omitempty"`
+	// ProjectID, ExpiresAt and Metadata are set on the messages of the
+	// Kafka sink, not on the events of GetEvents. ExpiresAt is set for the
+	// events stored with a TTL.
+	ProjectID int64             `json:"project_id,omitempty"`
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// EventFromProto converts an Event message of the canonical event model,
+// such as a message of the Kafka sink.
+func EventFromProto(m *eventsv1.Event) Event {
+	e := Event{
+		ID:            m.GetId(),
+		UserID:        m.GetUserId(),
+		Action:        m.GetAction(),
+		MetadataPage:  m.MetadataPage,
+		SchemaVersion: int(m.GetSchemaVersion()),
+		ProjectID:     m.GetProjectId(),
+		Metadata:      m.GetMetadata(),
+	}
+	if m.GetCreatedAt() != nil {
+		e.CreatedAt = m.GetCreatedAt().AsTime()
+	}
+	if m.GetExpiresAt() != nil {
+		expiresAt := m.GetExpiresAt().AsTime()
+		e.ExpiresAt = &expiresAt
+	}
+	return e
+}
+
+// NewEvent is an event to be stored.
+type NewEvent struct {
+	UserID   int64             `json:"user_id"`
+	Action   string            `json:"action"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// CreatedAt defaults to the time the server stores the event. It is
+	// only sent through POST /events/batch.
+	CreatedAt time.Time `json:"-"`
+	// IdempotencyKey, when set, makes the server store the event once per
+	// key, however many times it is sent.
+	IdempotencyKey string `json:"-"`
+}
+
+// NewEventFromProto converts an AddEvent message of the canonical event
+// model. Only its user_id, action and metadata are sent; the project is the
+// one of the API key.
+func NewEventFromProto(m *eventsv1.AddEvent) NewEvent {
+	return NewEvent{UserID: m.GetUserId(), Action: m.GetAction(), Metadata: m.GetMetadata()}
+}
+
+// Error is a problem answered by the server. A 422 lists the fields that
+// failed validation in Fields, a 400 means the request could not be parsed.
+type Error struct {
+	StatusCode int          `json:"status"`
+	Code       string       `json:"code"`
+	Title      string       `json:"title"`
+	Detail     string       `json:"detail"`
+	Fields     []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a field of a request failing validation, e.g.
+// events[1].user_id. Field is empty when the rule spans several fields.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("events api: %d %s", e.StatusCode, e.Code)
+	}
+	return fmt.Sprintf("events api: %d %s: %s", e.StatusCode, e.Code, e.Detail)
+}
+
+// Client calls one simple-events-handler instance. It is safe for
+// concurrent use.
+type Client struct {
+	baseURL string
+	http    *http.Client
+	token   string
+	apiKey  string
+	retries int
+	backoff time.Duration
+	window  time.Duration
+	page    int
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient replaces http.DefaultClient.
+func WithHTTPClient(h *http.Client) Option {
+	return func(c *Client) { c.http = h }
+}
+
+// WithToken sends token as a bearer token, e.g. the FEDERATION_TOKEN
+// required by POST /events/batch.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithAPIKey sends the API key of a project, so that events are stored in
+// and read from that project.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithRetries sets how many times a failed request is retried, 3 by
+// default, and the delay before the first retry, doubled on every attempt.
+// A Retry-After answered by the server takes precedence over the delay.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = n, backoff }
+}
+
+// WithPageWindow sets the time span fetched per request by Events, 24
+// hours by default. Lower it for users with many events per day.
+func WithPageWindow(d time.Duration) Option {
+	return func(c *Client) { c.window = d }
+}
+
+// WithPageSize sets the events fetched per request by Events, 1000 by
+// default. It must not exceed the EVENTS_MAX_LIMIT of the server.
+func WithPageSize(n int) Option {
+	return func(c *Client) { c.page = n }
+}
+
+// New creates a client for the API at baseURL, including the base path,
+// e.g. http://localhost:8080/api.
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		http:    http.DefaultClient,
+		retries: 3,
+		backoff: 200 * time.Millisecond,
+		window:  24 * time.Hour,
+		page:    1000,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// AddEvent stores an event. Events with an IdempotencyKey are sent through
+// AddEventsBatch so that every failure can be retried safely; the others
+// are retried only when the server rejected them before storing them.
+func (c *Client) AddEvent(ctx context.Context, e NewEvent) error {
+	if e.IdempotencyKey != "" || !e.CreatedAt.IsZero() {
+		return c.AddEventsBatch(ctx, []NewEvent{e})
+	}
+	return c.do(ctx, http.MethodPost, "/events", e, nil, retryRejected)
+}
+
+// batchEvent is an event of the POST /events/batch body.
+type batchEvent struct {
+	NewEvent
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	DedupeKey string     `json:"dedupe_key"`
+}
+
+// AddEventsBatch stores up to MaxBatchEvents events at once; either all of
+// them are stored or none. Events without an IdempotencyKey get one for the
+// duration of the call, so that retrying a batch whose response was lost
+// does not store it twice.
+func (c *Client) AddEventsBatch(ctx context.Context, events []NewEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	if len(events) > MaxBatchEvents {
+		return fmt.Errorf("events api: a batch holds at most %d events, got %d", MaxBatchEvents, len(events))
+	}
+
+	var prefix string
+	batch := make([]batchEvent, len(events))
+	for i, e := range events {
+		batch[i] = batchEvent{NewEvent: e, DedupeKey: e.IdempotencyKey}
+		if !e.CreatedAt.IsZero() {
+			batch[i].CreatedAt = &events[i].CreatedAt
+		}
+		if e.IdempotencyKey != "" {
+			continue
+		}
+		if prefix == "" {
+			var err error
+			if prefix, err = randomKey(); err != nil {
+				return err
+			}
+		}
+		batch[i].DedupeKey = prefix + ":" + strconv.Itoa(i)
+	}
+	return c.do(ctx, http.MethodPost, "/events/batch", map[string]any{"events": batch}, nil, retryAll)
+}
+
+func randomKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// retryPolicy reports whether a request may be sent again after failing
+// with status, 0 when no response was received.
+type retryPolicy func(status int) bool
+
+// retryAll retries idempotent requests on any transient failure.
+func retryAll(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// retryRejected retries requests that must not be repeated once handled,
+// on the statuses meaning the server did not handle them: buffer full,
+// overloaded or database known to be down.
+func retryRejected(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// do sends a JSON request, retrying it according to policy, and decodes the
+// JSON response into out when out is not nil.
+func (c *Client) do(ctx context.Context, method, path string, body, out any, policy retryPolicy) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	delay := c.backoff
+	for attempt := 0; ; attempt++ {
+		status, wait, err := c.send(ctx, method, path, payload, out)
+		if err == nil {
+			return nil
+		}
+		if attempt >= c.retries || !policy(status) || ctx.Err() != nil {
+			return err
+		}
+		if wait == 0 {
+			wait = delay
+		}
+		delay *= 2
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C:
+		}
+	}
+}
+
+// send makes a single attempt and returns the response status (0 when
+// there was none) and the Retry-After delay of the server.
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, out any) (int, time.Duration, error) {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		var wait time.Duration
+		if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+			wait = time.Duration(s) * time.Second
+		}
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Code == "" {
+			apiErr.Detail = strings.TrimSpace(string(data))
+		}
+		apiErr.StatusCode = resp.StatusCode
+		return resp.StatusCode, wait, apiErr
+	}
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, 0, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return resp.StatusCode, 0, fmt.Errorf("events api: decode response: %w", err)
+	}
+	return resp.StatusCode, 0, nil
+}
+
+// IsCode reports whether err is an Error with the given problem code, e.g.
+// "validation_failed".
+func IsCode(err error, code string) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.Code == code
+}
@@ -0,0 +1,281 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAPI serves the event routes over an in-memory table. The first
+// failures requests are answered with failStatus.
+type fakeAPI struct {
+	mu         sync.Mutex
+	events     []Event
+	keys       map[string]bool
+	failStatus int
+	failures   int
+	requests   int
+	// envelope answers GET /events like the response_envelope flag
+	envelope bool
+}
+
+func (f *fakeAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(f.failStatus)
+		_ = json.NewEncoder(w).Encode(map[string]any{"status": f.failStatus, "code": "overloaded", "detail": "busy"})
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/api/events":
+		var e NewEvent
+		_ = json.NewDecoder(r.Body).Decode(&e)
+		if e.UserID <= 0 {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": 422, "code": "validation_failed", "detail": "user_id must be a positive integer",
+				"errors": []map[string]string{{"field": "user_id", "code": "out_of_range", "message": "user_id must be a positive integer"}}})
+			return
+		}
+		f.add(e.UserID, e.Action, time.Now())
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/events/batch":
+		var body struct {
+			Events []batchEvent `json:"events"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		for _, e := range body.Events {
+			if f.keys[e.DedupeKey] {
+				continue
+			}
+			f.keys[e.DedupeKey] = true
+			f.add(e.UserID, e.Action, time.Now())
+		}
+		_ = json.NewEncoder(w).Encode(map[string]int{"received": len(body.Events)})
+	case r.Method == http.MethodGet && r.URL.Path == "/api/events":
+		from, _ := time.Parse(time.RFC3339Nano, r.URL.Query().Get("from"))
+		to, _ := time.Parse(time.RFC3339Nano, r.URL.Query().Get("to"))
+		// Only filters on the action are understood, and archived events
+		// are the ones created before 2025
+		filter := r.URL.Query().Get("filter")
+		archive := r.URL.Query().Get("include_archive") == "true"
+		out := []Event{}
+		for _, e := range f.events {
+			if filter != "" && filter != `action == "`+e.Action+`"` {
+				continue
+			}
+			if !archive && e.CreatedAt.Year() < 2025 {
+				continue
+			}
+			if !e.CreatedAt.Before(from) && !e.CreatedAt.After(to) {
+				out = append(out, e)
+			}
+		}
+		sort.SliceStable(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+		// Like the server, a small default limit, and limit=0 only on the
+		// admin listener
+		limit := 2
+		if v := r.URL.Query().Get("limit"); v != "" {
+			limit, _ = strconv.Atoi(v)
+		}
+		if limit <= 0 {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(map[string]any{"status": 422, "code": "validation_failed", "detail": "limit must be a positive integer up to 10000"})
+			return
+		}
+		if len(out) > limit {
+			out = out[:limit]
+		}
+		if f.envelope {
+			_ = json.NewEncoder(w).Encode(map[string]any{"events": out, "truncated": false})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(out)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (f *fakeAPI) add(userID int64, action string, at time.Time) {
+	f.events = append(f.events, Event{ID: int64(len(f.events) + 1), UserID: userID, Action: action, CreatedAt: at})
+}
+
+func newTestClient(t *testing.T, api *fakeAPI, opts ...Option) *Client {
+	t.Helper()
+	if api.keys == nil {
+		api.keys = map[string]bool{}
+	}
+	srv := httptest.NewServer(api)
+	t.Cleanup(srv.Close)
+	return New(srv.URL+"/api/", append([]Option{WithRetries(2, time.Millisecond)}, opts...)...)
+}
+
+func TestAddEvent(t *testing.T) {
+	tests := []struct {
+		name         string
+		event        NewEvent
+		failStatus   int
+		failures     int
+		expectErr    bool
+		expectStored int
+		expectCalls  int
+	}{
+		{name: "stored", event: NewEvent{UserID: 1, Action: "view"}, expectStored: 1, expectCalls: 1},
+		{name: "overloaded is retried", event: NewEvent{UserID: 1, Action: "view"}, failStatus: http.StatusServiceUnavailable, failures: 2, expectStored: 1, expectCalls: 3},
+		{name: "retries exhausted", event: NewEvent{UserID: 1, Action: "view"}, failStatus: http.StatusTooManyRequests, failures: 3, expectErr: true, expectCalls: 3},
+		{name: "timeout is not retried", event: NewEvent{UserID: 1, Action: "view"}, failStatus: http.StatusGatewayTimeout, failures: 1, expectErr: true, expectCalls: 1},
+		{name: "invalid event is not retried", event: NewEvent{UserID: 0, Action: "view"}, expectErr: true, expectCalls: 1},
+		{name: "idempotent event is retried on timeout", event: NewEvent{UserID: 1, Action: "view", IdempotencyKey: "k1"}, failStatus: http.StatusGatewayTimeout, failures: 1, expectStored: 1, expectCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := &fakeAPI{failStatus: tt.failStatus, failures: tt.failures}
+			c := newTestClient(t, api)
+
+			err := c.AddEvent(context.Background(), tt.event)
+			if (err != nil) != tt.expectErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.expectErr && tt.event.UserID <= 0 {
+				var apiErr *Error
+				if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity || len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "user_id" {
+					t.Fatalf("expected a 422 naming user_id, got %#v", err)
+				}
+			} else if tt.expectErr && !IsCode(err, "overloaded") {
+				t.Fatalf("expected an overloaded problem, got %v", err)
+			}
+			if len(api.events) != tt.expectStored || api.requests != tt.expectCalls {
+				t.Fatalf("expected %d stored in %d calls, got %d in %d", tt.expectStored, tt.expectCalls, len(api.events), api.requests)
+			}
+		})
+	}
+}
+
+func TestAddEventsBatch(t *testing.T) {
+	api := &fakeAPI{}
+	c := newTestClient(t, api)
+	events := []NewEvent{{UserID: 1, Action: "view"}, {UserID: 2, Action: "click", IdempotencyKey: "order-7"}}
+
+	if err := c.AddEventsBatch(context.Background(), events); err != nil {
+		t.Fatalf("add batch: %v", err)
+	}
+	// The same keyed event sent again is not stored twice
+	if err := c.AddEventsBatch(context.Background(), events[1:]); err != nil {
+		t.Fatalf("add batch: %v", err)
+	}
+	if len(api.events) != 2 || !api.keys["order-7"] {
+		t.Fatalf("expected 2 events stored, got %+v", api.events)
+	}
+	if err := c.AddEventsBatch(context.Background(), make([]NewEvent, MaxBatchEvents+1)); err == nil {
+		t.Fatal("expected an oversized batch to be refused")
+	}
+}
+
+func TestEvents(t *testing.T) {
+	api := &fakeAPI{}
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	// One event per 30 minutes, some on the page boundaries
+	for i := range 10 {
+		api.add(7, "view", start.Add(time.Duration(i)*30*time.Minute))
+	}
+	c := newTestClient(t, api, WithPageWindow(time.Hour))
+
+	var ids []int64
+	for e, err := range c.Events(context.Background(), From(start), To(start.Add(4*time.Hour+30*time.Minute))) {
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 10 || ids[0] != 10 || ids[9] != 1 {
+		t.Fatalf("expected the 10 events newest first, got %v", ids)
+	}
+	if api.requests != 5 {
+		t.Fatalf("expected 5 pages, got %d", api.requests)
+	}
+
+	api.add(7, "click", start.Add(time.Hour+time.Minute))
+	ids = nil
+	for e, err := range c.Events(context.Background(), From(start), To(start.Add(5*time.Hour)), Filter(`action == "click"`)) {
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 1 || ids[0] != 11 {
+		t.Fatalf("expected the click only, got %v", ids)
+	}
+
+	// Archived events are read on request only
+	api.add(7, "view", start.Add(-time.Hour))
+	ids = nil
+	for e, err := range c.Events(context.Background(), From(start.Add(-2*time.Hour)), To(start), IncludeArchive()) {
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 2 || ids[1] != 12 {
+		t.Fatalf("expected the archived event, got %v", ids)
+	}
+	if events, err := c.GetEvents(context.Background(), From(start.Add(-2*time.Hour)), To(start)); err != nil || len(events) != 1 {
+		t.Fatalf("expected the archived event to be left out, got %v, %v", events, err)
+	}
+
+	// The events are unwrapped from the envelope of the response_envelope
+	// feature flag
+	api.envelope = true
+	events, err := c.GetEvents(context.Background(), From(start), To(start.Add(5*time.Hour)), Limit(20))
+	if err != nil || len(events) != 11 || events[0].ID != 10 {
+		t.Fatalf("expected the 11 recent events unwrapped, got %v, %v", events, err)
+	}
+
+	api.envelope = false
+
+	// Full pages continue from their oldest event, skipping the events
+	// already yielded
+	api.add(7, "view", start.Add(4*time.Hour))
+	paged := newTestClient(t, api, WithPageWindow(time.Hour), WithPageSize(3))
+	ids = nil
+	for e, err := range paged.Events(context.Background(), From(start), To(start.Add(4*time.Hour+30*time.Minute))) {
+		if err != nil {
+			t.Fatalf("iterate: %v", err)
+		}
+		ids = append(ids, e.ID)
+	}
+	if len(ids) != 12 || ids[0] != 10 || ids[11] != 1 || slices.Index(ids, 13) != 2 {
+		t.Fatalf("expected the 12 events newest first, got %v", ids)
+	}
+
+	// A page filled by events of the same time cannot be continued
+	api.add(7, "view", start.Add(4*time.Hour))
+	var iterErr error
+	for _, err := range paged.Events(context.Background(), From(start), To(start.Add(4*time.Hour))) {
+		iterErr = err
+	}
+	if iterErr == nil {
+		t.Fatal("expected an error for a page of events created at the same time")
+	}
+
+	api.failStatus, api.failures = http.StatusInternalServerError, 10
+	for _, err := range c.Events(context.Background(), From(start)) {
+		if err == nil {
+			t.Fatal("expected the error to be yielded")
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query selects events by user and creation time; both bounds are
+// inclusive.
+type Query struct {
+	UserID *int64
+	From   time.Time
+	To     time.Time
+	// Limit bounds the events returned by GetEvents; nil leaves the
+	// server's default limit. 0 returns every event, on the admin listener
+	// only.
+	Limit *int
+	// Filter is an expression on the event fields, such as
+	// action == "click" && metadata.page =~ "^/checkout".
+	Filter string
+	// IncludeArchive also returns the events moved to the archive.
+	IncludeArchive bool
+}
+
+// QueryOption narrows the events returned by GetEvents and Events.
+type QueryOption func(*Query)
+
+// UserID selects the events of a single user.
+func UserID(id int64) QueryOption {
+	return func(q *Query) { q.UserID = &id }
+}
+
+// From selects the events created at or after t.
+func From(t time.Time) QueryOption {
+	return func(q *Query) { q.From = t }
+}
+
+// To selects the events created at or before t.
+func To(t time.Time) QueryOption {
+	return func(q *Query) { q.To = t }
+}
+
+// Limit bounds the events returned by GetEvents, the newest ones being
+// kept. The server caps it (EVENTS_MAX_LIMIT); 0 returns every event, on
+// the admin listener only.
+func Limit(n int) QueryOption {
+	return func(q *Query) { q.Limit = &n }
+}
+
+// Filter selects the events matching a filter expression (see "Filter
+// expressions" in the README).
+func Filter(expr string) QueryOption {
+	return func(q *Query) { q.Filter = expr }
+}
+
+// IncludeArchive also selects the events moved to the archive (see
+// ARCHIVE_AFTER_DAYS), which are slower to read.
+func IncludeArchive() QueryOption {
+	return func(q *Query) { q.IncludeArchive = true }
+}
+
+func newQuery(opts []QueryOption) Query {
+	var q Query
+	for _, opt := range opts {
+		opt(&q)
+	}
+	return q
+}
+
+// GetEvents returns the matching events, newest first, in a single
+// request, at most the server's default limit unless Limit is given. Use
+// Events for large ranges.
+func (c *Client) GetEvents(ctx context.Context, opts ...QueryOption) ([]Event, error) {
+	return c.getEvents(ctx, newQuery(opts))
+}
+
+func (c *Client) getEvents(ctx context.Context, q Query) ([]Event, error) {
+	v := url.Values{}
+	if q.UserID != nil {
+		v.Set("user_id", strconv.FormatInt(*q.UserID, 10))
+	}
+	if !q.From.IsZero() {
+		v.Set("from", q.From.UTC().Format(time.RFC3339Nano))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.UTC().Format(time.RFC3339Nano))
+	}
+	if q.Limit != nil {
+		v.Set("limit", strconv.Itoa(*q.Limit))
+	}
+	if q.Filter != "" {
+		v.Set("filter", q.Filter)
+	}
+	if q.IncludeArchive {
+		v.Set("include_archive", "true")
+	}
+	path := "/events"
+	if len(v) > 0 {
+		path += "?" + v.Encode()
+	}
+
+	var events eventList
+	if err := c.do(ctx, http.MethodGet, path, nil, &events, retryAll); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// eventList decodes the events of GET /events: an array, or the events
+// field of an object when the response_envelope feature flag is enabled
+// for the project.
+type eventList []Event
+
+func (l *eventList) UnmarshalJSON(data []byte) error {
+	if d := bytes.TrimLeft(data, " \t\r\n"); len(d) > 0 && d[0] == '{' {
+		var envelope struct {
+			Events []Event `json:"events"`
+		}
+		if err := json.Unmarshal(d, &envelope); err != nil {
+			return err
+		}
+		*l = envelope.Events
+		return nil
+	}
+	return json.Unmarshal(data, (*[]Event)(l))
+}
+
+// Events iterates over the matching events, newest first, fetching one
+// page window (see WithPageWindow) of the range at a time, in pages of at
+// most WithPageSize events, so that memory stays bounded. From is
+// required; To defaults to now. Iteration stops at the first error, which
+// is yielded with a zero Event, e.g. when a page is filled by events
+// created at the same time.
+func (c *Client) Events(ctx context.Context, opts ...QueryOption) iter.Seq2[Event, error] {
+	q := newQuery(opts)
+	return func(yield func(Event, error) bool) {
+		if q.From.IsZero() {
+			yield(Event{}, errors.New("events api: Events requires a From option"))
+			return
+		}
+		end := q.To
+		if end.IsZero() {
+			end = time.Now()
+		}
+
+		// Both bounds are inclusive, so the events created exactly at the
+		// start of a window come again at the end of the next one
+		var boundary map[int64]bool
+		for !end.Before(q.From) {
+			start := end.Add(-c.window)
+			if start.Before(q.From) {
+				start = q.From
+			}
+			page, err := c.getEvents(ctx, Query{UserID: q.UserID, From: start, To: end, Limit: &c.page, Filter: q.Filter, IncludeArchive: q.IncludeArchive})
+			if err != nil {
+				yield(Event{}, err)
+				return
+			}
+
+			// A full page may leave older events of the window, which the
+			// next page, ending at the oldest event, returns
+			full := len(page) == c.page
+			if full {
+				start = page[len(page)-1].CreatedAt
+			}
+			next := make(map[int64]bool)
+			if start.Equal(end) {
+				maps.Copy(next, boundary)
+			}
+			fresh := 0
+			for _, e := range page {
+				if e.CreatedAt.Equal(start) {
+					next[e.ID] = true
+				}
+				if boundary[e.ID] {
+					continue
+				}
+				fresh++
+				if !yield(e, nil) {
+					return
+				}
+			}
+			if full && fresh == 0 {
+				yield(Event{}, fmt.Errorf("events api: %d or more events were created at %s, raise WithPageSize", c.page, start.Format(time.RFC3339Nano)))
+				return
+			}
+			if !full && !start.After(q.From) {
+				return
+			}
+			end, boundary = start, next
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package eventsv1_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/arimatakao/simple-events-handler/internal/database"
+	"github.com/arimatakao/simple-events-handler/internal/ingest"
+	"github.com/arimatakao/simple-events-handler/internal/server"
+	"github.com/arimatakao/simple-events-handler/pkg/client"
+	eventsv1 "github.com/arimatakao/simple-events-handler/proto/events/v1"
+)
+
+// jsonFields returns the JSON names of the fields of the struct v.
+func jsonFields(v any) []string {
+	var names []string
+	typ := reflect.TypeOf(v)
+	for i := range typ.NumField() {
+		name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// TestSchemaDrift fails when a surface exchanging events has a field that
+// events.proto does not declare, or drops a field of the message it is
+// converted from. Every field of the messages is set, converted to the
+// surface, whose JSON is read back with protojson.
+func TestSchemaDrift(t *testing.T) {
+	page := "/home"
+	created := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	event := &eventsv1.Event{Id: 1, UserId: 7, Action: "click", MetadataPage: &page, CreatedAt: timestamppb.New(created), SchemaVersion: 2, ProjectId: 5, ExpiresAt: timestamppb.New(created.Add(time.Hour)), Metadata: map[string]string{"page": page}}
+	add := &eventsv1.AddEvent{UserId: 7, Action: "view", Metadata: map[string]string{"page": "/"}, TtlSeconds: 60, SchemaVersion: 3, DeliverAt: timestamppb.New(created), ProjectId: 4}
+
+	surfaces := []struct {
+		name    string
+		message proto.Message
+		convert func() any
+		// dropped are the fields the surface does not carry
+		dropped []protoreflect.Name
+	}{
+		{name: "database.Event (GET /events, sinks)", message: event, convert: func() any {
+			expiresAt := event.ExpiresAt.AsTime()
+			return database.Event{ID: event.Id, UserID: event.UserId, Action: event.Action, MetadataPage: event.MetadataPage, CreatedAt: event.CreatedAt.AsTime(), SchemaVersion: int(event.SchemaVersion), ProjectID: event.ProjectId, ExpiresAt: &expiresAt}
+		}, dropped: []protoreflect.Name{"metadata"}},
+		{name: "client.Event", message: event, convert: func() any { return client.EventFromProto(event) }},
+		{name: "server.AddEventRequest (POST /events)", message: add, convert: func() any { return server.AddEventRequestFromProto(add) }, dropped: []protoreflect.Name{"project_id"}},
+		{name: "ingest.Event (queue sources)", message: add, convert: func() any { return ingest.EventFromProto(add) }, dropped: []protoreflect.Name{"deliver_at"}},
+		{name: "client.NewEvent", message: add, convert: func() any { return client.NewEventFromProto(add) }, dropped: []protoreflect.Name{"ttl_seconds", "schema_version", "deliver_at", "project_id"}},
+	}
+	for _, s := range surfaces {
+		t.Run(s.name, func(t *testing.T) {
+			fields := s.message.ProtoReflect().Descriptor().Fields()
+			for i := range fields.Len() {
+				if !s.message.ProtoReflect().Has(fields.Get(i)) {
+					t.Fatalf("%s is not set by the test", fields.Get(i).FullName())
+				}
+			}
+
+			v := s.convert()
+			for _, name := range jsonFields(v) {
+				if fields.ByJSONName(name) == nil {
+					t.Errorf("the field %s is missing from %s", name, s.message.ProtoReflect().Descriptor().FullName())
+				}
+			}
+
+			data, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := s.message.ProtoReflect().New().Interface()
+			if err := protojson.Unmarshal(data, got); err != nil {
+				t.Fatalf("the JSON %s is not read by protojson: %v", data, err)
+			}
+			expect := proto.Clone(s.message)
+			for _, name := range s.dropped {
+				expect.ProtoReflect().Clear(fields.ByName(name))
+			}
+			if !proto.Equal(got, expect) {
+				t.Fatalf("expected %v, got %v: convert the new fields, or list them as dropped", expect, got)
+			}
+		})
+	}
+}